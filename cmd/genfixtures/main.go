@@ -0,0 +1,266 @@
+// Fixture generator for integration and load testing.
+// It writes a fixtures.json for ourcloud-stub and a matching config.yaml for
+// pushserver, so large scenarios can be reproduced from a single command.
+//
+// Usage:
+//
+//	genfixtures [-out dir] [-graph full|star|random] [-count N] [-devices N] [username[:devices] ...]
+//
+// Users come from the arguments (e.g. "alice@oc:2 bob@oc"), followed by -count
+// generated users named user0001@oc, user0002@oc, and so on. Each user gets
+// -devices devices unless the argument says otherwise.
+//
+// Keys are derived from usernames exactly as testutil.NewTestUser does, so
+// tests can sign requests from any generated user. FCM tokens and device IDs
+// are derived from usernames too, and the random graph uses -seed, so the same
+// command always produces the same files.
+//
+// # Consent Graphs
+//
+//   - full: every user consents to pushes from every other user
+//   - star: the -hub user (default: the first user) and everyone else consent
+//     to each other, but other users don't consent to each other
+//   - random: each ordered pair of users consents with probability -density
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/test/integration/testutil"
+)
+
+// Fixtures matches the ourcloud-stub fixtures format.
+type Fixtures struct {
+	Users map[string]UserFixture `json:"users"`
+}
+
+// UserFixture defines a test user's data.
+type UserFixture struct {
+	PublicSignKey  string            `json:"public_sign_key"`  // hex-encoded
+	PublicCryptKey string            `json:"public_crypt_key"` // hex-encoded
+	Consents       []string          `json:"consents"`         // usernames allowed to send pushes
+	Endpoints      []EndpointFixture `json:"endpoints"`
+}
+
+// EndpointFixture defines a push endpoint.
+type EndpointFixture struct {
+	DeviceID string `json:"device_id"`
+	FCMToken string `json:"fcm_token"`
+}
+
+// userSpec is a user to generate and how many devices they have.
+type userSpec struct {
+	username string
+	devices  int
+}
+
+// zeroCryptKey is used for every user; the gateway never encrypts.
+var zeroCryptKey = strings.Repeat("00", 32)
+
+func main() {
+	outDir := flag.String("out", ".", "directory to write fixtures.json and config.yaml to")
+	graph := flag.String("graph", "full", "consent graph: full, star, or random")
+	hub := flag.String("hub", "", "hub user for the star graph (default: first user)")
+	density := flag.Float64("density", 0.1, "consent probability for the random graph")
+	seed := flag.Int64("seed", 1, "random graph seed")
+	count := flag.Int("count", 0, "number of additional generated users")
+	devices := flag.Int("devices", 1, "devices per user when not given in the argument")
+	port := flag.Int("port", 8085, "pushserver port in config.yaml")
+	ourcloudAddr := flag.String("ourcloud", "localhost:50052", "ourcloud-stub gRPC address in config.yaml")
+	fcmEndpoint := flag.String("fcm", "http://localhost:9099", "fcm-stub endpoint in config.yaml")
+	flag.Parse()
+
+	users, err := parseUsers(flag.Args(), *count, *devices)
+	if err != nil {
+		log.Fatalf("Invalid users: %v", err)
+	}
+	if len(users) == 0 {
+		log.Fatalf("No users: pass usernames or -count")
+	}
+
+	consents, err := consentGraph(users, *graph, *hub, *density, *seed)
+	if err != nil {
+		log.Fatalf("Invalid consent graph: %v", err)
+	}
+
+	fixtures := buildFixtures(users, consents)
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatalf("Failed to create output directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode fixtures: %v", err)
+	}
+	fixturesPath := filepath.Join(*outDir, "fixtures.json")
+	if err := os.WriteFile(fixturesPath, append(data, '\n'), 0644); err != nil {
+		log.Fatalf("Failed to write fixtures: %v", err)
+	}
+
+	configPath := filepath.Join(*outDir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configYAML(*port, *ourcloudAddr, *fcmEndpoint)), 0644); err != nil {
+		log.Fatalf("Failed to write config: %v", err)
+	}
+
+	log.Printf("Wrote %d users (%s graph) to %s and %s", len(users), *graph, fixturesPath, configPath)
+}
+
+// parseUsers parses "username[:devices]" arguments and appends count
+// generated users. Duplicate usernames are rejected.
+func parseUsers(args []string, count, defaultDevices int) ([]userSpec, error) {
+	var users []userSpec
+	seen := make(map[string]bool)
+
+	add := func(u userSpec) error {
+		if seen[u.username] {
+			return fmt.Errorf("duplicate user %q", u.username)
+		}
+		seen[u.username] = true
+		users = append(users, u)
+		return nil
+	}
+
+	for _, arg := range args {
+		u := userSpec{username: arg, devices: defaultDevices}
+		if name, n, found := strings.Cut(arg, ":"); found {
+			devices, err := strconv.Atoi(n)
+			if err != nil || devices < 0 {
+				return nil, fmt.Errorf("invalid device count in %q", arg)
+			}
+			u = userSpec{username: name, devices: devices}
+		}
+		if !strings.Contains(u.username, "@") {
+			return nil, fmt.Errorf("username %q must look like name@oc", u.username)
+		}
+		if err := add(u); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 1; i <= count; i++ {
+		if err := add(userSpec{username: fmt.Sprintf("user%04d@oc", i), devices: defaultDevices}); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+// consentGraph returns each user's consent list (the senders allowed to push
+// to them) for the named graph.
+func consentGraph(users []userSpec, graph, hub string, density float64, seed int64) (map[string][]string, error) {
+	consents := make(map[string][]string, len(users))
+	for _, u := range users {
+		consents[u.username] = []string{}
+	}
+
+	switch graph {
+	case "full":
+		for _, recipient := range users {
+			for _, sender := range users {
+				if sender.username != recipient.username {
+					consents[recipient.username] = append(consents[recipient.username], sender.username)
+				}
+			}
+		}
+
+	case "star":
+		if hub == "" {
+			hub = users[0].username
+		}
+		if _, ok := consents[hub]; !ok {
+			return nil, fmt.Errorf("hub %q is not one of the users", hub)
+		}
+		for _, u := range users {
+			if u.username == hub {
+				continue
+			}
+			consents[hub] = append(consents[hub], u.username)
+			consents[u.username] = append(consents[u.username], hub)
+		}
+
+	case "random":
+		if density < 0 || density > 1 {
+			return nil, fmt.Errorf("density %v must be between 0 and 1", density)
+		}
+		rng := rand.New(rand.NewSource(seed))
+		for _, recipient := range users {
+			for _, sender := range users {
+				if sender.username != recipient.username && rng.Float64() < density {
+					consents[recipient.username] = append(consents[recipient.username], sender.username)
+				}
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown graph %q (want full, star, or random)", graph)
+	}
+
+	return consents, nil
+}
+
+// buildFixtures derives keys and endpoints for users.
+func buildFixtures(users []userSpec, consents map[string][]string) *Fixtures {
+	fixtures := &Fixtures{Users: make(map[string]UserFixture, len(users))}
+	for _, u := range users {
+		name, _, _ := strings.Cut(u.username, "@")
+		endpoints := make([]EndpointFixture, 0, u.devices)
+		for i := 1; i <= u.devices; i++ {
+			deviceID := fmt.Sprintf("%s-device-%d", name, i)
+			endpoints = append(endpoints, EndpointFixture{
+				DeviceID: deviceID,
+				FCMToken: "fcm-token-" + deviceID,
+			})
+		}
+
+		fixtures.Users[u.username] = UserFixture{
+			PublicSignKey:  hex.EncodeToString(testutil.NewTestUser(u.username).PublicKey),
+			PublicCryptKey: zeroCryptKey,
+			Consents:       consents[u.username],
+			Endpoints:      endpoints,
+		}
+	}
+	return fixtures
+}
+
+// configYAML returns a pushserver config pointing at the stub services.
+func configYAML(port int, ourcloudAddr, fcmEndpoint string) string {
+	return fmt.Sprintf(`# Generated by genfixtures; points to local stub services
+
+version: 1
+
+server:
+  port: %d
+  read_timeout: 10s
+  write_timeout: 10s
+
+firebase:
+  credentials_file: fake-credentials.json
+  project_id: test-project
+  endpoint: %s
+
+ourcloud:
+  grpc_address: %s
+
+storage:
+  path: /tmp/pushserver-fixtures-test.db
+  lock_timeout: 100ms
+
+batch:
+  window: 100ms
+  max_size: 10
+
+status:
+  retention: 1h
+`, port, fcmEndpoint, ourcloudAddr)
+}
@@ -2,28 +2,30 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
-	"github.com/wurp/ourcloud-fcm-push-gateway/internal/config"
-	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
-	"github.com/wurp/ourcloud-fcm-push-gateway/internal/handler"
-	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
-	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+	"github.com/wurp/ourcloud-fcm-push-gateway/gateway"
+)
+
+// Build information, set at build time via:
+//
+//	go build -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	commit    = "unknown"
+	buildTime = "unknown"
 )
 
 func main() {
 	configPath := flag.String("config", "config.yaml", "path to configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config path] [migrate [-verify] [-db path] | export-batches [-o file] | import-batches [file] | restore [-list] [-backup name] [-force]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	// Environment variable overrides
@@ -35,168 +37,52 @@ func main() {
 		log.Printf("Log level set to: %s", logLevel)
 	}
 
-	cfg, err := config.Load(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-
-	// Initialize OurCloud client
-	ocClient := ourcloud.NewClient(cfg.OurCloud.GRPCAddress)
-	if err := ocClient.Connect(); err != nil {
-		log.Fatalf("Failed to connect to OurCloud node: %v", err)
-	}
-	defer ocClient.Close()
-
-	log.Printf("Connected to OurCloud node at %s", cfg.OurCloud.GRPCAddress)
-
-	// Initialize store
-	st, err := store.New(store.Config{
-		Path: cfg.Storage.Path,
-	})
-	if err != nil {
-		log.Fatalf("Failed to initialize store: %v", err)
+	switch flag.Arg(0) {
+	case "migrate":
+		if err := runMigrate(*configPath, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	case "export-batches":
+		if err := runExportBatches(*configPath, flag.Args()[1:]); err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		return
+	case "import-batches":
+		if err := runImportBatches(*configPath, flag.Args()[1:]); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		return
+	case "restore":
+		if err := runRestore(*configPath, flag.Args()[1:]); err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		return
 	}
-	defer st.Close()
-
-	log.Printf("Initialized store at %s", cfg.Storage.Path)
 
-	// Initialize FCM sender
-	sender, err := fcm.New(context.Background(), fcm.Config{
-		CredentialsFile: cfg.Firebase.CredentialsFile,
-		ProjectID:       cfg.Firebase.ProjectID,
-		Endpoint:        cfg.Firebase.Endpoint,
-	})
+	cfg, err := gateway.LoadConfigEnv(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize FCM sender: %v", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
-
-	log.Printf("Initialized FCM sender")
-
-	b := batcher.New(st, sender, batcher.Config{
-		BatchWindow:     cfg.Batch.Window,
-		MaxBatchSize:    cfg.Batch.MaxSize,
-		LockTimeout:     cfg.Storage.LockTimeout,
-		StatusRetention: cfg.Status.Retention,
-	})
-	defer b.Stop()
-
-	// Recover any pending batches from previous run
-	if err := b.Recover(context.Background()); err != nil {
-		log.Fatalf("Failed to recover batches: %v", err)
+	if cfg.Log.SampleInterval > 0 {
+		defer gateway.SampleLogs(cfg.Log.SampleInterval)()
 	}
-
-	// Initialize handlers
-	pushHandler := handler.NewPushHandler(ocClient, b)
-	statusHandler := handler.NewStatusHandler(b)
-
-	r := chi.NewRouter()
-
-	// Middleware
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.RequestID)
-
-	// Routes
-	r.Get("/health", makeHealthHandler(ocClient, sender))
-	r.Post("/push", pushHandler.HandlePush)
-	r.Get("/status/{id}", statusHandler.HandleGetStatus)
-
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
-		Handler:      r,
-		ReadTimeout:  cfg.Server.ReadTimeout,
-		WriteTimeout: cfg.Server.WriteTimeout,
+	if err := gateway.SetLogPrivacyFromConfig(cfg); err != nil {
+		log.Fatalf("Invalid log.privacy: %v", err)
 	}
 
-	// Start server in goroutine
-	go func() {
-		log.Printf("Starting server on port %d", cfg.Server.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
-		}
-	}()
-
-	// Start status cleanup goroutine (runs hourly)
-	cleanupStop := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				deleted, err := st.CleanupExpiredStatus(context.Background())
-				if err != nil {
-					log.Printf("WARNING: status cleanup failed: %v", err)
-				} else if deleted > 0 {
-					log.Printf("Cleaned up %d expired status records", deleted)
-				}
-			case <-cleanupStop:
-				return
-			}
-		}
-	}()
-
-	// Wait for shutdown signal
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-
-	close(cleanupStop)
-
-	log.Println("Shutting down server...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+	g, err := gateway.New(cfg, gateway.WithBuildInfo(commit, buildTime))
+	if err != nil {
+		log.Fatalf("Failed to initialize gateway: %v", err)
 	}
+	defer g.Close()
 
-	log.Println("Server stopped")
-}
-
-// HealthResponse represents the JSON response from the health endpoint.
-type HealthResponse struct {
-	Status   string `json:"status"`
-	OurCloud string `json:"ourcloud,omitempty"`
-	Firebase string `json:"firebase,omitempty"`
-}
-
-func makeHealthHandler(ocClient *ourcloud.Client, fcmSender *fcm.Sender) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		resp := HealthResponse{
-			Status:   "ok",
-			OurCloud: "ok",
-			Firebase: "ok",
-		}
-
-		healthy := true
-
-		// Check OurCloud connectivity
-		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-		defer cancel()
-
-		if err := ocClient.HealthCheck(ctx); err != nil {
-			resp.OurCloud = fmt.Sprintf("error: %v", err)
-			healthy = false
-		}
-
-		// Check Firebase client initialization
-		if fcmSender == nil {
-			resp.Firebase = "not initialized"
-			healthy = false
-		}
+	// Serve until a shutdown signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		if !healthy {
-			resp.Status = "degraded"
-			w.WriteHeader(http.StatusServiceUnavailable)
-		} else {
-			w.WriteHeader(http.StatusOK)
-		}
-
-		json.NewEncoder(w).Encode(resp)
+	if err := g.Run(ctx); err != nil {
+		g.Close()
+		log.Fatalf("Gateway stopped: %v", err)
 	}
 }
-
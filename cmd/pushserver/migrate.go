@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/gateway"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// runMigrate implements "pushserver migrate". The gateway migrates its
+// database when it starts; this runs the migrations ahead of a deploy, with
+// a backup to roll back to, or with -verify, dry-runs them on a copy.
+func runMigrate(configPath string, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	verify := fs.Bool("verify", false, "run the migrations on a copy of the database and report, leaving it unchanged")
+	dbPath := fs.String("db", "", "database to migrate (default storage.path from the config, every shard)")
+	fs.Parse(args)
+
+	paths := []string{*dbPath}
+	if *dbPath == "" {
+		cfg, err := gateway.LoadConfigEnv(configPath)
+		if err != nil {
+			return fmt.Errorf("loading config: %w", err)
+		}
+		paths = store.ShardPaths(cfg.Storage.Path, cfg.Storage.Shards)
+	}
+
+	// Shards are migrated one by one; each is backed up and rolled back
+	// on its own
+	ctx := context.Background()
+	for _, path := range paths {
+		if err := migrateDB(ctx, path, *verify); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDB migrates the database at path, or with verify, a copy of it.
+func migrateDB(ctx context.Context, path string, verify bool) error {
+	before, err := store.Inspect(ctx, path)
+	if err != nil {
+		return fmt.Errorf("inspecting %s: %w", path, err)
+	}
+	if before.Version > store.SchemaVersion {
+		return fmt.Errorf("%s has schema v%d, newer than this build's v%d", path, before.Version, store.SchemaVersion)
+	}
+
+	if verify {
+		return verifyMigration(ctx, path, before)
+	}
+	if before.Version == store.SchemaVersion {
+		fmt.Printf("%s is already at schema v%d\n", path, before.Version)
+		return nil
+	}
+	return migrate(ctx, path, before)
+}
+
+// verifyMigration migrates a copy of the database at path and reports the
+// row counts before and after.
+func verifyMigration(ctx context.Context, path string, before store.SchemaInfo) error {
+	dir, err := os.MkdirTemp("", "pushserver-migrate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	dryRun := filepath.Join(dir, "verify.db")
+	if err := store.Backup(ctx, path, dryRun); err != nil {
+		return err
+	}
+	after, err := migrateFile(ctx, dryRun)
+	if err != nil {
+		return fmt.Errorf("migration failed on a copy of %s: %w", path, err)
+	}
+
+	report(os.Stdout, before, after)
+	if err := checkMigration(before, after); err != nil {
+		return err
+	}
+	fmt.Printf("Dry run OK; %s was not changed\n", path)
+	return nil
+}
+
+// migrate backs the database at path up beside it, migrates it, and
+// restores the backup if the migration fails or loses rows. The gateway
+// must be stopped.
+func migrate(ctx context.Context, path string, before store.SchemaInfo) error {
+	backup := fmt.Sprintf("%s.v%d.bak", path, before.Version)
+	if err := store.Backup(ctx, path, backup); err != nil {
+		return fmt.Errorf("backing up %s: %w", path, err)
+	}
+	fmt.Printf("Backed up %s to %s\n", path, backup)
+
+	after, err := migrateFile(ctx, path)
+	if err == nil {
+		report(os.Stdout, before, after)
+		err = checkMigration(before, after)
+	}
+	if err != nil {
+		if restoreErr := restore(backup, path); restoreErr != nil {
+			return fmt.Errorf("%w; restoring %s also failed: %v", err, backup, restoreErr)
+		}
+		return fmt.Errorf("%w; rolled back to %s", err, backup)
+	}
+	fmt.Printf("Migrated %s; keep %s until the gateway runs well on v%d\n", path, backup, after.Version)
+	return nil
+}
+
+// migrateFile opens the database at path, which runs any migrations, and
+// inspects the result.
+func migrateFile(ctx context.Context, path string) (store.SchemaInfo, error) {
+	s, err := store.New(store.Config{Path: path})
+	if err != nil {
+		return store.SchemaInfo{}, err
+	}
+	if err := s.Close(); err != nil {
+		return store.SchemaInfo{}, err
+	}
+	return store.Inspect(ctx, path)
+}
+
+// checkMigration reports an error if the migration didn't reach the current
+// schema or lost rows. No migration deletes rows.
+func checkMigration(before, after store.SchemaInfo) error {
+	if after.Version != store.SchemaVersion {
+		return fmt.Errorf("migrated to schema v%d, want v%d", after.Version, store.SchemaVersion)
+	}
+	for table, count := range before.Rows {
+		if after.Rows[table] < count {
+			return fmt.Errorf("table %s lost rows: %d before, %d after", table, count, after.Rows[table])
+		}
+	}
+	return nil
+}
+
+// restore replaces the database at path with backup, removing the WAL
+// files left beside it.
+func restore(backup, path string) error {
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// report writes the schema versions and per-table row counts.
+func report(w io.Writer, before, after store.SchemaInfo) {
+	fmt.Fprintf(w, "Schema v%d -> v%d\n", before.Version, after.Version)
+
+	tables := make([]string, 0, len(after.Rows))
+	for table := range after.Rows {
+		tables = append(tables, table)
+	}
+	for table := range before.Rows {
+		if _, ok := after.Rows[table]; !ok {
+			tables = append(tables, table)
+		}
+	}
+	slices.Sort(tables)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "table\tbefore\tafter\t")
+	for _, table := range tables {
+		b := "-"
+		if count, ok := before.Rows[table]; ok {
+			b = fmt.Sprint(count)
+		}
+		a := "-"
+		if count, ok := after.Rows[table]; ok {
+			a = fmt.Sprint(count)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", table, b, a)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/gateway"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/backup"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// runRestore implements "pushserver restore". It downloads a backup taken
+// by storage.backup into the database files at storage.path, or with
+// -list, lists the backups. The gateway must be stopped.
+func runRestore(configPath string, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	list := fs.Bool("list", false, "list the complete backups, newest first, and exit")
+	name := fs.String("backup", "", "backup to restore, as listed by -list (default the newest)")
+	force := fs.Bool("force", false, "replace existing database files")
+	fs.Parse(args)
+
+	cfg, err := gateway.LoadConfigEnv(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if cfg.Storage.Backup.URL == "" {
+		return fmt.Errorf("storage.backup.url is not set")
+	}
+	ctx := context.Background()
+	bucket, prefix, err := gateway.OpenBackupBucket(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		manifests, err := backup.List(ctx, bucket, prefix)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "BACKUP\tFILES\tSCHEMA\tBYTES")
+		for _, m := range manifests {
+			fmt.Fprintf(tw, "%s\t%d\tv%d\t%d\n", m.Name, len(m.Files), m.SchemaVersion, m.Bytes)
+		}
+		return tw.Flush()
+	}
+
+	paths := store.ShardPaths(cfg.Storage.Path, cfg.Storage.Shards)
+	m, err := backup.Restore(ctx, bucket, prefix, *name, paths, *force)
+	if err != nil {
+		return err
+	}
+	if m.SchemaVersion > store.SchemaVersion {
+		fmt.Fprintf(os.Stderr, "WARNING: backup %s has schema v%d, newer than this build's v%d\n", m.Name, m.SchemaVersion, store.SchemaVersion)
+	}
+	fmt.Printf("Restored backup %s (%d database files) to %s\n", m.Name, len(m.Files), cfg.Storage.Path)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/gateway"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// runExportBatches implements "pushserver export-batches". It writes the
+// pending batches and statuses in the configured store to a snapshot file,
+// for import-batches to load into another instance's store.
+func runExportBatches(configPath string, args []string) error {
+	fs := flag.NewFlagSet("export-batches", flag.ExitOnError)
+	output := fs.String("o", "", "file to write the snapshot to (default stdout)")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	s, err := openConfiguredStore(ctx, configPath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	counts, err := store.WriteSnapshot(ctx, s, w)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d batches and %d statuses\n", counts.Batches, counts.Statuses)
+	return nil
+}
+
+// runImportBatches implements "pushserver import-batches". It loads a
+// snapshot from export-batches or GET /admin/batches/export into the
+// configured store. The gateway using the store must be stopped; a running
+// one imports with POST /admin/batches/import instead.
+func runImportBatches(configPath string, args []string) error {
+	fs := flag.NewFlagSet("import-batches", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import-batches [snapshot file, default stdin]\n", os.Args[0])
+	}
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ctx := context.Background()
+	s, err := openConfiguredStore(ctx, configPath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	counts, err := store.ReadSnapshot(ctx, r, storeImporter{s})
+	if err != nil {
+		return fmt.Errorf("%w (after %d batches and %d statuses; importing the complete snapshot again is safe)",
+			err, counts.Batches, counts.Statuses)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d batches and %d statuses\n", counts.Batches, counts.Statuses)
+	return nil
+}
+
+// openConfiguredStore opens the store at storage.path, every shard of it.
+func openConfiguredStore(ctx context.Context, configPath string) (store.Store, error) {
+	cfg, err := gateway.LoadConfigEnv(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	if cfg.Storage.Shards < 1 {
+		return nil, fmt.Errorf("storage.shards must be at least 1")
+	}
+	if err := store.CheckShards(ctx, cfg.Storage.Path, cfg.Storage.Shards); err != nil {
+		return nil, err
+	}
+
+	paths := store.ShardPaths(cfg.Storage.Path, cfg.Storage.Shards)
+	shards := make([]store.Store, 0, len(paths))
+	for _, path := range paths {
+		s, err := store.New(store.Config{Path: path})
+		if err != nil {
+			for _, shard := range shards {
+				shard.Close()
+			}
+			return nil, fmt.Errorf("opening %s: %w", path, err)
+		}
+		shards = append(shards, s)
+	}
+	if len(shards) == 1 {
+		return shards[0], nil
+	}
+	return store.NewShardedStore(shards), nil
+}
+
+// storeImporter imports a snapshot straight into a store, merging each batch
+// into the one the store already holds for its token, if any.
+type storeImporter struct {
+	store.Store
+}
+
+func (s storeImporter) ImportBatch(ctx context.Context, fcmToken string, batch *store.Batch) error {
+	existing, err := s.ListBatchesByRecipient(ctx, batch.Recipient)
+	if err != nil {
+		return err
+	}
+	if current := existing[fcmToken]; current != nil {
+		if current.Merge(batch) == 0 {
+			return nil
+		}
+		batch = current
+	}
+	return s.SaveBatch(ctx, fcmToken, batch)
+}
@@ -0,0 +1,150 @@
+// Replays push requests captured with POST /admin/capture against a
+// gateway, normally one backed by the stubs, and reports the requests
+// answered differently than when they were captured.
+//
+// Usage:
+//
+//	replay [-target url] [-resign] [-pace] [-keep-times] [capture file, default stdin]
+//
+// With -resign, requests are signed with keys derived from their senders'
+// usernames as testutil.NewTestUser does, so they verify against a stub
+// loaded with fixtures from cmd/genfixtures. It is a development tool kept
+// out of pushserver so the gateway binary carries no test keys.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/handler"
+	"github.com/wurp/ourcloud-fcm-push-gateway/test/integration/testutil"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// replayedTimeHeaders hold Unix times, which replay moves forward by the
+// time since capture unless -keep-times is set.
+var replayedTimeHeaders = []string{handler.ExpiresAtHeader, handler.DeliverAfterHeader}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [capture file, default stdin]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	target := flag.String("target", "http://localhost:8080", "base URL of the gateway to send the requests to")
+	resign := flag.Bool("resign", false, "sign each request with its sender's test key, as genfixtures derives it")
+	pace := flag.Bool("pace", false, "keep the time between requests as captured")
+	keepTimes := flag.Bool("keep-times", false, "send X-Push-Expires-At and X-Push-Deliver-After unchanged")
+	flag.Parse()
+
+	if err := replay(flag.Arg(0), *target, *resign, *pace, *keepTimes); err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+}
+
+// replay sends the requests captured in path, or stdin if path is empty,
+// to the gateway at target.
+func replay(path, target string, resign, pace, keepTimes bool) error {
+	var r io.Reader = os.Stdin
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	reqs, err := handler.ReadCapturedRequests(r)
+	if err != nil {
+		return fmt.Errorf("reading captured requests: %w", err)
+	}
+
+	unsigned := 0
+	changed := 0
+	client := &http.Client{Timeout: 30 * time.Second}
+	start := time.Now()
+	for i, captured := range reqs {
+		if pace {
+			time.Sleep(time.Until(start.Add(captured.CapturedAt.Sub(reqs[0].CapturedAt))))
+		}
+		if captured.Body == nil {
+			fmt.Printf("#%d %s: skipped, body not captured\n", i+1, captured.TraceID)
+			continue
+		}
+		body, contentType := captured.Body, captured.Headers["Content-Type"]
+		if resign {
+			if body, err = resignPushBody(contentType, body); err != nil {
+				return fmt.Errorf("request #%d: %w", i+1, err)
+			}
+			contentType = "application/x-protobuf"
+		} else if captured.Scrubbed {
+			unsigned++
+		}
+
+		req, err := http.NewRequest(http.MethodPost, strings.TrimRight(target, "/")+"/push", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for name, value := range captured.Headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Content-Type", contentType)
+		if !keepTimes {
+			shift := time.Since(captured.CapturedAt)
+			for _, name := range replayedTimeHeaders {
+				if t, err := strconv.ParseInt(req.Header.Get(name), 10, 64); err == nil {
+					req.Header.Set(name, strconv.FormatInt(t+int64(shift.Seconds()), 10))
+				}
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("request #%d: %w", i+1, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		note := ""
+		if resp.StatusCode != captured.Status {
+			changed++
+			note = fmt.Sprintf(" (was %d)", captured.Status)
+		}
+		fmt.Printf("#%d %s: %d%s\n", i+1, captured.TraceID, resp.StatusCode, note)
+	}
+
+	if unsigned > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d scrubbed requests were sent without a signature; use -resign against a gateway backed by genfixtures users\n", unsigned)
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d requests, %d answered differently\n", len(reqs), changed)
+	return nil
+}
+
+// resignPushBody signs the PushRequest in body with its sender's test key,
+// returning it as protobuf.
+func resignPushBody(contentType string, body []byte) ([]byte, error) {
+	var req pb.PushRequest
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var err error
+	if mediaType == "application/json" {
+		err = protojson.Unmarshal(body, &req)
+	} else {
+		err = proto.Unmarshal(body, &req)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding push request: %w", err)
+	}
+	if err := testutil.SignPushRequest(&req); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&req)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/handler"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxStatusBatch is how many request IDs one POST /status/batch may carry.
+const maxStatusBatch = handler.MaxBatchStatusIDs
+
+// maxViolations stops the report from growing without bound when something
+// is badly broken.
+const maxViolations = 100
+
+// tracker records what the soak test sent and saw, and the violations found.
+// It is only used from the main loop, so it needs no locking.
+type tracker struct {
+	accepted         int
+	rejected         int
+	pushErrors       int
+	injectedFailures int
+
+	pending      map[string]time.Time // request ID -> when it was accepted
+	states       map[string]int       // terminal state -> count
+	delivered    map[string]bool      // token + "/" + data ID
+	deliveries   int
+	capturesSeen int
+	dbBytes      int64
+
+	violations []string
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		pending:   make(map[string]time.Time),
+		states:    make(map[string]int),
+		delivered: make(map[string]bool),
+	}
+}
+
+// violate records an invariant violation.
+func (t *tracker) violate(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("ERROR: invariant violated: %s", msg)
+	if len(t.violations) < maxViolations {
+		t.violations = append(t.violations, msg)
+	}
+}
+
+// track starts watching a request ID accepted at acceptedAt.
+func (t *tracker) track(requestID string, acceptedAt time.Time) {
+	t.pending[requestID] = acceptedAt
+}
+
+// pendingIDs returns the request IDs not yet seen in a terminal state.
+func (t *tracker) pendingIDs() []string {
+	ids := make([]string, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// observe records a polled state for a pending request. Requests still
+// pending after terminalWithin, and requests the gateway marked lost, are
+// violations.
+func (t *tracker) observe(requestID, state string, now time.Time, terminalWithin time.Duration) {
+	acceptedAt, ok := t.pending[requestID]
+	if !ok {
+		return
+	}
+
+	switch state {
+	case store.StatusQueued, store.StatusTimedOut, "not_found":
+		if age := now.Sub(acceptedAt); age > terminalWithin {
+			t.violate("request %s still %s after %s", requestID, state, age.Round(time.Second))
+			delete(t.pending, requestID)
+		}
+		return
+	case store.StatusLost:
+		t.violate("request %s was marked lost", requestID)
+	}
+
+	t.states[state]++
+	delete(t.pending, requestID)
+}
+
+// deliver records one FCM delivery of dataID to token; a repeat is a violation.
+func (t *tracker) deliver(token, dataID string) {
+	key := token + "/" + dataID
+	if t.delivered[key] {
+		t.violate("data ID %s delivered to %s more than once", dataID, token)
+		return
+	}
+	t.delivered[key] = true
+	t.deliveries++
+}
+
+// summary is a one-line progress report.
+func (t *tracker) summary() string {
+	return fmt.Sprintf("accepted=%d rejected=%d push_errors=%d deliveries=%d pending=%d injected_failures=%d db=%dKB violations=%d",
+		t.accepted, t.rejected, t.pushErrors, t.deliveries, len(t.pending), t.injectedFailures, t.dbBytes>>10, len(t.violations))
+}
+
+// decodePayload extracts the data IDs from an FCM message's payload field.
+func decodePayload(payload string) ([][]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var notification pb.DataUpdateNotification
+	if err := proto.Unmarshal(raw, &notification); err != nil {
+		return nil, err
+	}
+	return notification.DataIds, nil
+}
+
+// chunk splits ids into slices of at most size.
+func chunk(ids []string, size int) [][]string {
+	var chunks [][]string
+	for len(ids) > size {
+		chunks = append(chunks, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
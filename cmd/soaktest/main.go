@@ -0,0 +1,382 @@
+// Soak test for a running push gateway.
+// It sends a steady stream of signed pushes between random consenting users
+// for a long time, injects FCM failures through fcm-stub, and checks the
+// gateway's invariants as it goes. It exits non-zero with a report as soon as
+// one is violated, or when -duration elapses.
+//
+// Usage:
+//
+//	soaktest [-gateway URL] [-fcm-stub URL] [-fixtures path] [-duration 1h] [-rate 10] [-db path]
+//
+// Users and consents come from the ourcloud-stub fixtures file the gateway is
+// running against; pushes are signed with keys derived as testutil.NewTestUser
+// does, so fixtures from cmd/genfixtures work as-is.
+//
+// # Invariants
+//
+//   - No duplicate deliveries: fcm-stub never captures the same data ID for
+//     the same token twice.
+//   - Statuses eventually terminal: every request ID reaches a state other
+//     than queued or timed_out within -terminal-within.
+//   - DB size bounded: the gateway database, including its WAL, stays under
+//     -max-db-mb.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/test/integration/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+// pair is a recipient and a sender they consent to.
+type pair struct {
+	recipient string
+	sender    string
+}
+
+func main() {
+	gatewayURL := flag.String("gateway", "http://localhost:8085", "push gateway base URL")
+	fcmStubURL := flag.String("fcm-stub", "http://localhost:9099", "fcm-stub base URL")
+	fixturesPath := flag.String("fixtures", "test/integration/fixtures.json", "ourcloud-stub fixtures the gateway is using")
+	duration := flag.Duration("duration", time.Hour, "how long to run")
+	rate := flag.Float64("rate", 10, "pushes per second")
+	failEvery := flag.Duration("fail-every", time.Minute, "how often to make fcm-stub fail a send (0 disables)")
+	checkEvery := flag.Duration("check-every", 10*time.Second, "how often to check invariants")
+	terminalWithin := flag.Duration("terminal-within", 5*time.Minute, "how soon every request must reach a terminal state")
+	dbPath := flag.String("db", "", "gateway database path for the size check (empty skips it)")
+	maxDBMB := flag.Int64("max-db-mb", 512, "largest allowed gateway database size in MB")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random recipient seed")
+	flag.Parse()
+
+	if *rate <= 0 {
+		log.Fatalf("-rate must be positive")
+	}
+
+	pairs, err := loadPairs(*fixturesPath)
+	if err != nil {
+		log.Fatalf("Failed to load fixtures: %v", err)
+	}
+	if len(pairs) == 0 {
+		log.Fatalf("No recipient with devices consents to any sender in %s", *fixturesPath)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		log.Println("Interrupted, stopping...")
+		cancel()
+	}()
+
+	s := &soak{
+		gatewayURL:     strings.TrimSuffix(*gatewayURL, "/"),
+		fcmStubURL:     strings.TrimSuffix(*fcmStubURL, "/"),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		runID:          fmt.Sprintf("soak-%d", time.Now().Unix()),
+		terminalWithin: *terminalWithin,
+		dbPath:         *dbPath,
+		maxDBBytes:     *maxDBMB << 20,
+		tracker:        newTracker(),
+	}
+
+	log.Printf("Soak test %s: %d sender/recipient pairs, %.1f pushes/s for %s", s.runID, len(pairs), *rate, *duration)
+
+	rng := rand.New(rand.NewSource(*seed))
+	pushTick := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer pushTick.Stop()
+	checkTick := time.NewTicker(*checkEvery)
+	defer checkTick.Stop()
+
+	var failTick <-chan time.Time
+	if *failEvery > 0 {
+		t := time.NewTicker(*failEvery)
+		defer t.Stop()
+		failTick = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.check()
+			s.report()
+			if len(s.tracker.violations) > 0 {
+				os.Exit(1)
+			}
+			return
+
+		case <-pushTick.C:
+			s.push(pairs[rng.Intn(len(pairs))])
+
+		case <-failTick:
+			if err := s.injectFCMFailure(); err != nil {
+				log.Printf("WARNING: failure injection failed: %v", err)
+			}
+
+		case <-checkTick.C:
+			s.check()
+			if len(s.tracker.violations) > 0 {
+				s.report()
+				os.Exit(1)
+			}
+			log.Printf("%s", s.tracker.summary())
+		}
+	}
+}
+
+// loadPairs returns every recipient/sender pair the fixtures allow, skipping
+// recipients with no devices.
+func loadPairs(path string) ([]pair, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures struct {
+		Users map[string]struct {
+			Consents  []string          `json:"consents"`
+			Endpoints []json.RawMessage `json:"endpoints"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	var pairs []pair
+	for recipient, u := range fixtures.Users {
+		if len(u.Endpoints) == 0 {
+			continue
+		}
+		for _, sender := range u.Consents {
+			pairs = append(pairs, pair{recipient: recipient, sender: sender})
+		}
+	}
+	// Map order is random; sort so -seed reproduces a run
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].recipient != pairs[j].recipient {
+			return pairs[i].recipient < pairs[j].recipient
+		}
+		return pairs[i].sender < pairs[j].sender
+	})
+	return pairs, nil
+}
+
+// soak holds the running test's connections and state.
+type soak struct {
+	gatewayURL     string
+	fcmStubURL     string
+	client         *http.Client
+	runID          string
+	terminalWithin time.Duration
+	dbPath         string
+	maxDBBytes     int64
+
+	pushes  int // data IDs sent, used to make each one unique
+	tracker *tracker
+}
+
+// push sends one push carrying a fresh data ID and tracks its request IDs.
+func (s *soak) push(p pair) {
+	s.pushes++
+	dataID := fmt.Sprintf("%s-%d", s.runID, s.pushes)
+
+	req := &pb.PushRequest{
+		SenderUsername: p.sender,
+		TargetUsername: p.recipient,
+		Timestamp:      time.Now().Unix(),
+		DataIds:        [][]byte{[]byte(dataID)},
+	}
+	if err := testutil.SignPushRequest(req); err != nil {
+		log.Fatalf("Failed to sign push: %v", err)
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		log.Fatalf("Failed to marshal push: %v", err)
+	}
+
+	httpResp, err := s.client.Post(s.gatewayURL+"/push", "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		s.tracker.pushErrors++
+		log.Printf("WARNING: push %s failed: %v", dataID, err)
+		return
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		s.tracker.pushErrors++
+		return
+	}
+	var resp pb.PushResponse
+	if err := proto.Unmarshal(respBody, &resp); err != nil || !resp.Accepted {
+		s.tracker.rejected++
+		log.Printf("WARNING: push %s -> %s rejected (HTTP %d, code %d): %s", p.sender, p.recipient, httpResp.StatusCode, resp.ErrorCode, resp.Message)
+		return
+	}
+
+	ids := []string{resp.RequestId}
+	if header := httpResp.Header.Get("X-Push-Request-Ids"); header != "" {
+		ids = strings.Split(header, ",")
+	}
+	s.tracker.accepted++
+	for _, id := range ids {
+		s.tracker.track(strings.TrimSpace(id), time.Now())
+	}
+}
+
+// injectFCMFailure makes fcm-stub fail its next send.
+func (s *soak) injectFCMFailure() error {
+	resp, err := s.client.Post(s.fcmStubURL+"/fail-next", "application/json", strings.NewReader(`{"error": "INTERNAL: soak test failure"}`))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fcm-stub returned %s", resp.Status)
+	}
+	s.tracker.injectedFailures++
+	return nil
+}
+
+// check runs every invariant check, recording violations in the tracker.
+func (s *soak) check() {
+	if err := s.checkDeliveries(); err != nil {
+		log.Printf("WARNING: delivery check failed: %v", err)
+	}
+	if err := s.checkStatuses(); err != nil {
+		log.Printf("WARNING: status check failed: %v", err)
+	}
+	if s.dbPath != "" {
+		s.checkDBSize()
+	}
+}
+
+// checkDeliveries reads captures new since the last check and looks for
+// data IDs delivered to the same token twice.
+func (s *soak) checkDeliveries() error {
+	resp, err := s.client.Get(s.fcmStubURL + "/captured")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var captured struct {
+		Messages []struct {
+			Token string            `json:"token"`
+			Data  map[string]string `json:"data"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&captured); err != nil {
+		return fmt.Errorf("decoding captures: %w", err)
+	}
+
+	// Captures are append-only; a restarted stub starts over
+	if len(captured.Messages) < s.tracker.capturesSeen {
+		s.tracker.capturesSeen = 0
+	}
+	for _, msg := range captured.Messages[s.tracker.capturesSeen:] {
+		dataIDs, err := decodePayload(msg.Data["payload"])
+		if err != nil {
+			s.tracker.violate("undecodable FCM payload for %s: %v", msg.Token, err)
+			continue
+		}
+		for _, id := range dataIDs {
+			if strings.HasPrefix(string(id), s.runID+"-") {
+				s.tracker.deliver(msg.Token, string(id))
+			}
+		}
+	}
+	s.tracker.capturesSeen = len(captured.Messages)
+	return nil
+}
+
+// checkStatuses polls the gateway for requests that aren't terminal yet.
+func (s *soak) checkStatuses() error {
+	for _, ids := range chunk(s.tracker.pendingIDs(), maxStatusBatch) {
+		body, err := json.Marshal(map[string][]string{"request_ids": ids})
+		if err != nil {
+			return err
+		}
+		resp, err := s.client.Post(s.gatewayURL+"/status/batch", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		var statuses struct {
+			Statuses map[string]struct {
+				State string `json:"state"`
+				Error string `json:"error"`
+			} `json:"statuses"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&statuses)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding statuses: %w", err)
+		}
+
+		now := time.Now()
+		for _, id := range ids {
+			state := "not_found" // not flushed yet, or already expired
+			if st, ok := statuses.Statuses[id]; ok {
+				state = st.State
+			}
+			s.tracker.observe(id, state, now, s.terminalWithin)
+		}
+	}
+	return nil
+}
+
+// checkDBSize checks the gateway database and its WAL against the limit.
+func (s *soak) checkDBSize() {
+	var size int64
+	for _, path := range []string{s.dbPath, s.dbPath + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	s.tracker.dbBytes = size
+	if size > s.maxDBBytes {
+		s.tracker.violate("database is %d MB, over the %d MB limit", size>>20, s.maxDBBytes>>20)
+	}
+}
+
+// report prints the final summary and any violations.
+func (s *soak) report() {
+	t := s.tracker
+	fmt.Printf("\n=== Soak test %s ===\n", s.runID)
+	fmt.Printf("%s\n", t.summary())
+	fmt.Printf("Final states:\n")
+	states := make([]string, 0, len(t.states))
+	for state := range t.states {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		fmt.Printf("  %-22s %d\n", state, t.states[state])
+	}
+	if len(t.violations) == 0 {
+		fmt.Printf("PASS: no invariant violations\n")
+		return
+	}
+	fmt.Printf("FAIL: %d invariant violations\n", len(t.violations))
+	for _, v := range t.violations {
+		fmt.Printf("  %s\n", v)
+	}
+}
@@ -23,6 +23,28 @@
 //   - POST /oauth2/v4/token - returns fake OAuth tokens
 //   - GET /captured - returns all captured messages as JSON
 //   - DELETE /captured - clears captured messages
+//   - POST /fail-next - makes upcoming sends fail (see below)
+//   - DELETE /fail-next - clears configured failures
+//
+// # Simulated Failures
+//
+// POST /fail-next takes a JSON body describing the failure:
+//
+//	{"code": "UNREGISTERED", "token": "fcm-token-bob-phone", "count": 1}
+//
+// code is an FCM error code (UNREGISTERED, INVALID_ARGUMENT,
+// SENDER_ID_MISMATCH, QUOTA_EXCEEDED, THIRD_PARTY_AUTH_ERROR, UNAVAILABLE or
+// INTERNAL) and defaults to INTERNAL. token limits the failure to sends to
+// that token; without it the next send fails whatever its token. count is
+// how many sends fail, default 1, or -1 to fail until cleared. error
+// overrides the error message and retry_after, in seconds, sets a
+// Retry-After header.
+//
+// Error responses use the HTTP status, error.status and details array FCM v1
+// returns for each code, so the Admin SDK's classifiers
+// (messaging.IsUnregistered etc.) see them as they would in production. Note
+// the SDK retries UNAVAILABLE (503) up to four times, so a failure with
+// count 1 is absorbed by its retry.
 package main
 
 import (
@@ -34,6 +56,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -50,15 +73,42 @@ type CapturedMessage struct {
 	RawBody   json.RawMessage   `json:"raw_body"`
 }
 
+// fcmError describes how FCM v1 reports one error code.
+type fcmError struct {
+	httpStatus int
+	status     string // canonical status in error.status
+	message    string
+}
+
+// fcmErrors maps FCM error codes to their responses, as documented for the
+// HTTP v1 API.
+var fcmErrors = map[string]fcmError{
+	"UNREGISTERED":           {http.StatusNotFound, "NOT_FOUND", "Requested entity was not found."},
+	"INVALID_ARGUMENT":       {http.StatusBadRequest, "INVALID_ARGUMENT", "The registration token is not a valid FCM registration token"},
+	"SENDER_ID_MISMATCH":     {http.StatusForbidden, "PERMISSION_DENIED", "SenderId mismatch"},
+	"QUOTA_EXCEEDED":         {http.StatusTooManyRequests, "RESOURCE_EXHAUSTED", "Quota exceeded for quota metric 'Send requests' of service 'fcm.googleapis.com'."},
+	"THIRD_PARTY_AUTH_ERROR": {http.StatusUnauthorized, "UNAUTHENTICATED", "Auth error from APNS or Web Push Service"},
+	"UNAVAILABLE":            {http.StatusServiceUnavailable, "UNAVAILABLE", "The service is currently unavailable."},
+	"INTERNAL":               {http.StatusInternalServerError, "INTERNAL", "Internal error encountered."},
+}
+
+// Failure is a configured send failure, as posted to /fail-next.
+type Failure struct {
+	Code       string `json:"code"`        // FCM error code; default INTERNAL
+	Error      string `json:"error"`       // error.message; default is FCM's message for Code
+	Token      string `json:"token"`       // only fail sends to this token; empty matches any
+	Count      int    `json:"count"`       // sends to fail; default 1, -1 until cleared
+	RetryAfter int    `json:"retry_after"` // seconds for the Retry-After header; 0 omits it
+}
+
 // FCMStub captures and responds to FCM requests.
 type FCMStub struct {
 	mu       sync.Mutex
 	messages []CapturedMessage
 
 	// Configurable behavior
-	failNext     bool
-	failNextErr  string
-	projectID    string
+	failures  []*Failure
+	projectID string
 }
 
 func NewFCMStub(projectID string) *FCMStub {
@@ -103,21 +153,9 @@ func (s *FCMStub) HandleSend(w http.ResponseWriter, r *http.Request) {
 	defer s.mu.Unlock()
 
 	// Check if we should fail
-	if s.failNext {
-		s.failNext = false
-		errMsg := s.failNextErr
-		if errMsg == "" {
-			errMsg = "INTERNAL: simulated failure"
-		}
-		log.Printf("FCM stub: failing request to %s", truncateToken(fcmReq.Message.Token))
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]interface{}{
-				"code":    500,
-				"message": errMsg,
-				"status":  "INTERNAL",
-			},
-		})
+	if f := s.takeFailure(fcmReq.Message.Token); f != nil {
+		log.Printf("FCM stub: failing request to %s with %s", truncateToken(fcmReq.Message.Token), f.Code)
+		writeFCMError(w, f)
 		return
 	}
 
@@ -165,21 +203,113 @@ func (s *FCMStub) HandleClearCaptured(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]int{"cleared": count})
 }
 
-// HandleSetFailNext configures the next send to fail.
+// takeFailure returns the first configured failure matching token, counting
+// it against the failure's Count, or nil if the send should succeed.
+// Caller must hold s.mu.
+func (s *FCMStub) takeFailure(token string) *Failure {
+	for i, f := range s.failures {
+		if f.Token != "" && f.Token != token {
+			continue
+		}
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// writeFCMError writes the error response FCM v1 returns for f.Code.
+func writeFCMError(w http.ResponseWriter, f *Failure) {
+	e := fcmErrors[f.Code]
+	message := f.Error
+	if message == "" {
+		message = e.message
+	}
+
+	details := []interface{}{
+		map[string]interface{}{
+			"@type":     "type.googleapis.com/google.firebase.fcm.v1.FcmError",
+			"errorCode": f.Code,
+		},
+	}
+	if f.Code == "INVALID_ARGUMENT" {
+		details = append(details, map[string]interface{}{
+			"@type": "type.googleapis.com/google.rpc.BadRequest",
+			"fieldViolations": []interface{}{
+				map[string]interface{}{
+					"field":       "message.token",
+					"description": message,
+				},
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if f.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(f.RetryAfter))
+	}
+	w.WriteHeader(e.httpStatus)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    e.httpStatus,
+			"message": message,
+			"status":  e.status,
+			"details": details,
+		},
+	})
+}
+
+// HandleSetFailNext configures upcoming sends to fail.
 func (s *FCMStub) HandleSetFailNext(w http.ResponseWriter, r *http.Request) {
+	var f Failure
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil && err != io.EOF {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if f.Code == "" {
+		f.Code = "INTERNAL"
+	}
+	if _, ok := fcmErrors[f.Code]; !ok {
+		http.Error(w, fmt.Sprintf("unknown FCM error code %q", f.Code), http.StatusBadRequest)
+		return
+	}
+	if f.Count == 0 {
+		f.Count = 1
+	}
+	if f.Count < -1 {
+		http.Error(w, "count must be positive or -1", http.StatusBadRequest)
+		return
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.failures = append(s.failures, &f)
 
-	var req struct {
-		Error string `json:"error"`
+	target := "any token"
+	if f.Token != "" {
+		target = truncateToken(f.Token)
 	}
-	json.NewDecoder(r.Body).Decode(&req)
+	log.Printf("FCM stub: configured %s failure for %s (count %d)", f.Code, target, f.Count)
+	w.WriteHeader(http.StatusOK)
+}
 
-	s.failNext = true
-	s.failNextErr = req.Error
+// HandleClearFailures removes all configured failures.
+func (s *FCMStub) HandleClearFailures(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	log.Printf("FCM stub: configured to fail next request")
-	w.WriteHeader(http.StatusOK)
+	count := len(s.failures)
+	s.failures = nil
+
+	log.Printf("FCM stub: cleared %d configured failures", count)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"cleared": count})
 }
 
 func truncateToken(token string) string {
@@ -206,6 +336,7 @@ func main() {
 	r.Get("/captured", stub.HandleGetCaptured)
 	r.Delete("/captured", stub.HandleClearCaptured)
 	r.Post("/fail-next", stub.HandleSetFailNext)
+	r.Delete("/fail-next", stub.HandleClearFailures)
 
 	// Health check
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -257,7 +388,8 @@ func main() {
 	log.Printf("  POST /v1/projects/%s/messages:send - FCM send endpoint", *projectID)
 	log.Printf("  GET  /captured - get captured messages")
 	log.Printf("  DELETE /captured - clear captured messages")
-	log.Printf("  POST /fail-next - configure next send to fail")
+	log.Printf("  POST /fail-next - configure upcoming sends to fail with an FCM error")
+	log.Printf("  DELETE /fail-next - clear configured failures")
 
 	if err := srv.ListenAndServe(); err != nil && !strings.Contains(err.Error(), "Server closed") {
 		log.Fatalf("Failed to serve: %v", err)
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// fixtureKeyLen is the length of the public keys in fixtures, in bytes.
+const fixtureKeyLen = 32
+
+// parseFixtures decodes a fixtures file and validates it, reporting every
+// problem found, each with the user it concerns, rather than only the first.
+func parseFixtures(data []byte) (Fixtures, error) {
+	var fixtures Fixtures
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fixtures); err != nil {
+		return Fixtures{}, fmt.Errorf("parsing fixtures: %s", describeJSONError(data, err))
+	}
+
+	problems, err := duplicateUsers(data)
+	if err != nil {
+		return Fixtures{}, fmt.Errorf("parsing fixtures: %s", describeJSONError(data, err))
+	}
+	problems = append(problems, fixtures.validate()...)
+	if len(problems) > 0 {
+		return Fixtures{}, fmt.Errorf("invalid fixtures (%d problems):\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return fixtures, nil
+}
+
+// validate checks the users' keys, that consents name known users, and
+// that no user lists a device twice. Returns the problems found.
+func (f Fixtures) validate() []string {
+	usernames := make([]string, 0, len(f.Users))
+	for username := range f.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var problems []string
+	for _, username := range usernames {
+		user := f.Users[username]
+		at := fmt.Sprintf("users[%q]", username)
+		if strings.TrimSpace(username) == "" {
+			problems = append(problems, at+": empty username")
+		}
+		if problem := checkKey(user.PublicSignKey); problem != "" {
+			problems = append(problems, at+".public_sign_key: "+problem)
+		}
+		if problem := checkKey(user.PublicCryptKey); problem != "" {
+			problems = append(problems, at+".public_crypt_key: "+problem)
+		}
+		for i, consent := range user.Consents {
+			if _, ok := f.Users[consent]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.consents[%d]: unknown user %q", at, i, consent))
+			}
+		}
+		seen := make(map[string]int, len(user.Endpoints))
+		for i, ep := range user.Endpoints {
+			// Endpoints without a device ID are allowed, as in old clients
+			if ep.DeviceID == "" {
+				continue
+			}
+			if first, ok := seen[ep.DeviceID]; ok {
+				problems = append(problems, fmt.Sprintf("%s.endpoints[%d]: device_id %q already used by endpoints[%d]", at, i, ep.DeviceID, first))
+				continue
+			}
+			seen[ep.DeviceID] = i
+		}
+	}
+	return problems
+}
+
+// checkKey returns what is wrong with a hex-encoded public key, or "" if it
+// is empty, which loads as all zeros, or fixtureKeyLen bytes.
+func checkKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	if _, err := hex.DecodeString(key); err != nil {
+		return fmt.Sprintf("not hex: %v", err)
+	}
+	if len(key) != 2*fixtureKeyLen {
+		return fmt.Sprintf("%d hex characters, want %d (%d bytes)", len(key), 2*fixtureKeyLen, fixtureKeyLen)
+	}
+	return ""
+}
+
+// duplicateUsers returns a problem for each username defined more than once
+// in the fixtures file, with the line of each repeat. encoding/json keeps
+// the last definition silently.
+func duplicateUsers(data []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var problems []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "users" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if tok, err := dec.Token(); err != nil {
+			return nil, err
+		} else if tok == nil {
+			continue // "users": null
+		} else if tok != json.Delim('{') {
+			return nil, fmt.Errorf("users: expected an object")
+		}
+		firstLine := make(map[string]int)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			username, _ := tok.(string)
+			line := lineOf(data, dec.InputOffset())
+			if first, ok := firstLine[username]; ok {
+				problems = append(problems, fmt.Sprintf("line %d: user %q already defined on line %d", line, username, first))
+			} else {
+				firstLine[username] = line
+			}
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// expectDelim reads the next token from dec, failing unless it is delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q", delim)
+	}
+	return nil
+}
+
+// describeJSONError adds the line of a JSON syntax or type error in data to
+// its message.
+func describeJSONError(data []byte, err error) string {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		return fmt.Sprintf("line %d: %v", lineOf(data, syntax.Offset), err)
+	case errors.As(err, &typ):
+		return fmt.Sprintf("line %d: %v", lineOf(data, typ.Offset), err)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected end of file"
+	}
+	return err.Error()
+}
+
+// lineOf returns the 1-based line of the byte at offset in data.
+func lineOf(data []byte, offset int64) int {
+	offset = min(offset, int64(len(data)))
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// fixtureSummary describes what the fixtures define, for -check.
+func fixtureSummary(f Fixtures) string {
+	endpoints := 0
+	for _, user := range f.Users {
+		endpoints += len(user.Endpoints)
+	}
+	return fmt.Sprintf("%d users, %d endpoints", len(f.Users), endpoints)
+}
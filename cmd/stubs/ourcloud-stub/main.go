@@ -3,9 +3,41 @@
 //
 // Usage:
 //
-//	ourcloud-stub -port 50051 -config fixtures.json
+//	ourcloud-stub -port 50051 -config fixtures.json [-control-port 50053]
+//	ourcloud-stub -check -config fixtures.json
 //
-// The fixtures file configures users, consent lists, and endpoints.
+// The fixtures file configures users, consent lists, and endpoints. It is
+// validated when loaded: keys must be 32 bytes of hex (or empty, for all
+// zeros), usernames defined once, consents must name users in the file, and
+// no user may list a device ID twice. Every problem is reported, with the
+// user or line it concerns, and the stub exits. -check validates the file
+// and exits, 0 if it is valid, for linting fixtures in CI.
+//
+// # Runtime Updates
+//
+// When -control-port is set, an HTTP control API allows tests to change a user's
+// consent or endpoint label at runtime, simulating a real DHT update. Each update
+// stores a new content-addressed block and repoints the label; earlier blocks stay
+// readable, as they would in the DHT.
+//
+//   - PUT /users/{username}/consents - body: ["bob@oc", ...]
+//   - PUT /users/{username}/endpoints - body: [{"device_id": "...", "fcm_token": "..."}]
+//   - POST /stale - body: {"reads": 2, "duration": "500ms"}
+//   - GET /requests?limit=50 - recent GetBlock/GetLabel calls, newest first
+//
+// POST /stale configures stale-read simulation: after a label update, the previous
+// label version keeps being served for the given number of reads and/or duration,
+// like a lagging DHT replica. A zero config disables it.
+//
+// # Debugging Lookups
+//
+// GET /requests lists the last -request-history calls with their timings and
+// whether the block or label was found. Keys of the labels the gateway reads
+// are precomputed for every fixture user, so a missing label shows its path
+// (e.g. "/users/bob@oc/platform/push/endpoints") rather than just a hash.
+// -log-level sets what is logged: quiet (startup and errors), info (misses and
+// updates, the default), or debug (every lookup). gRPC server reflection is
+// enabled, so tools like grpcurl can list and call the stub's methods.
 package main
 
 import (
@@ -16,13 +48,18 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -33,9 +70,9 @@ type Fixtures struct {
 
 // UserFixture defines a test user's data.
 type UserFixture struct {
-	PublicSignKey  string           `json:"public_sign_key"`  // hex-encoded
-	PublicCryptKey string           `json:"public_crypt_key"` // hex-encoded
-	Consents       []string         `json:"consents"`         // usernames allowed to send pushes
+	PublicSignKey  string            `json:"public_sign_key"`  // hex-encoded
+	PublicCryptKey string            `json:"public_crypt_key"` // hex-encoded
+	Consents       []string          `json:"consents"`         // usernames allowed to send pushes
 	Endpoints      []EndpointFixture `json:"endpoints"`
 }
 
@@ -53,32 +90,59 @@ type StubServer struct {
 	fixtures Fixtures
 
 	// Computed data stores
-	labels map[string]*pb.Label       // label key (hex) -> Label
-	blocks map[string][]byte          // block ID (hex) -> raw data
+	labels map[string]*pb.Label // label key (hex) -> Label
+	blocks map[string][]byte    // block ID (hex) -> raw data
+	owners map[string][]byte    // username -> owner ID
+	names  map[string]string    // block ID or label key (hex) -> description, for debugging
+
+	requests *requestLog // recent gRPC calls, for GET /requests
+
+	// Stale-read simulation
+	stale       map[string]*staleLabel // label key (hex) -> superseded version
+	staleReads  int
+	stalePeriod time.Duration
 }
 
-func NewStubServer() *StubServer {
+// staleLabel is a superseded label version still served after an update,
+// simulating DHT propagation delay.
+type staleLabel struct {
+	label     *pb.Label
+	readsLeft int
+	until     time.Time
+}
+
+func NewStubServer(requestHistory int) *StubServer {
 	return &StubServer{
-		labels: make(map[string]*pb.Label),
-		blocks: make(map[string][]byte),
+		labels:   make(map[string]*pb.Label),
+		blocks:   make(map[string][]byte),
+		owners:   make(map[string][]byte),
+		names:    make(map[string]string),
+		stale:    make(map[string]*staleLabel),
+		requests: newRequestLog(requestHistory),
 	}
 }
 
-// LoadFixtures loads and processes the fixtures file.
+// LoadFixtures loads, validates, and processes the fixtures file.
 func (s *StubServer) LoadFixtures(path string) error {
-	data, err := os.ReadFile(path)
+	fixtures, err := readFixtures(path)
 	if err != nil {
-		return fmt.Errorf("reading fixtures file: %w", err)
-	}
-
-	if err := json.Unmarshal(data, &s.fixtures); err != nil {
-		return fmt.Errorf("parsing fixtures: %w", err)
+		return err
 	}
+	s.fixtures = fixtures
 
 	s.computeData()
 	return nil
 }
 
+// readFixtures reads and validates the fixtures file at path.
+func readFixtures(path string) (Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Fixtures{}, fmt.Errorf("reading fixtures file: %w", err)
+	}
+	return parseFixtures(data)
+}
+
 // computeData builds the labels and blocks maps from fixtures.
 func (s *StubServer) computeData() {
 	s.mu.Lock()
@@ -86,6 +150,9 @@ func (s *StubServer) computeData() {
 
 	s.labels = make(map[string]*pb.Label)
 	s.blocks = make(map[string][]byte)
+	s.owners = make(map[string][]byte)
+	s.names = make(map[string]string)
+	s.stale = make(map[string]*staleLabel)
 
 	// Root ID for user lookups: [31 zeros, 1]
 	rootID := make([]byte, 32)
@@ -104,72 +171,146 @@ func (s *StubServer) computeData() {
 		userAuthData, _ := proto.Marshal(userAuth)
 		userAuthID := contentAddress(userAuthData)
 		s.blocks[hexEncode(userAuthID)] = userAuthData
+		s.names[hexEncode(userAuthID)] = "UserAuth for " + username
 
 		// Create label for username lookup (root namespace)
 		userLabelKey := computeLabelKey(rootID, username)
 		s.labels[hexEncode(userLabelKey)] = &pb.Label{
 			DataId: &pb.ID{Value: userAuthID},
 		}
+		s.names[hexEncode(userLabelKey)] = "username " + username
 
 		// Compute owner ID (content address of UserAuth)
-		ownerID := computeContentAddress(userAuth)
-
-		// Create consent list
-		consentList := &pb.PushConsentList{}
-		for _, consentUser := range user.Consents {
-			consentList.Consents = append(consentList.Consents, &pb.PushConsent{
-				Username: consentUser,
-			})
+		s.owners[username] = computeContentAddress(userAuth)
+		for _, path := range knownLabelPaths {
+			labelPath := fmt.Sprintf(path, username)
+			s.names[hexEncode(computeLabelKey(s.owners[username], labelPath))] = labelPath
 		}
 
-		consentData, _ := proto.Marshal(consentList)
-		consentID := contentAddress(consentData)
-		s.blocks[hexEncode(consentID)] = consentData
+		s.setConsentsLocked(username, user.Consents)
+		s.setEndpointsLocked(username, user.Endpoints)
 
-		consentLabelKey := computeLabelKey(ownerID, fmt.Sprintf("/users/%s/platform/push/consents", username))
-		s.labels[hexEncode(consentLabelKey)] = &pb.Label{
-			DataId: &pb.ID{Value: consentID},
-		}
+		logf(logInfo, "Loaded user %s: %d consents, %d endpoints", username, len(user.Consents), len(user.Endpoints))
+	}
+}
 
-		// Create endpoint list
-		endpointList := &pb.PushEndpointList{}
-		for _, ep := range user.Endpoints {
-			endpointList.Endpoints = append(endpointList.Endpoints, &pb.PushEndpoint{
-				DeviceId: ep.DeviceID,
-				FcmToken: ep.FCMToken,
-			})
-		}
+// setConsentsLocked stores a new consent list block and points the user's
+// consent label at it. Caller must hold s.mu.
+func (s *StubServer) setConsentsLocked(username string, consents []string) {
+	consentList := &pb.PushConsentList{}
+	for _, consentUser := range consents {
+		consentList.Consents = append(consentList.Consents, &pb.PushConsent{
+			Username: consentUser,
+		})
+	}
+
+	s.putLabelLocked(username, fmt.Sprintf("/users/%s/platform/push/consents", username), consentList)
+}
+
+// setEndpointsLocked stores a new endpoint list block and points the user's
+// endpoint label at it. Caller must hold s.mu.
+func (s *StubServer) setEndpointsLocked(username string, endpoints []EndpointFixture) {
+	endpointList := &pb.PushEndpointList{}
+	for _, ep := range endpoints {
+		endpointList.Endpoints = append(endpointList.Endpoints, &pb.PushEndpoint{
+			DeviceId: ep.DeviceID,
+			FcmToken: ep.FCMToken,
+		})
+	}
 
-		endpointData, _ := proto.Marshal(endpointList)
-		endpointID := contentAddress(endpointData)
-		s.blocks[hexEncode(endpointID)] = endpointData
+	s.putLabelLocked(username, fmt.Sprintf("/users/%s/platform/push/endpoints", username), endpointList)
+}
 
-		endpointLabelKey := computeLabelKey(ownerID, fmt.Sprintf("/users/%s/platform/push/endpoints", username))
-		s.labels[hexEncode(endpointLabelKey)] = &pb.Label{
-			DataId: &pb.ID{Value: endpointID},
+// putLabelLocked stores msg as a block and repoints the owner's label at it.
+// The previous label version is kept for stale reads when simulation is enabled.
+// Caller must hold s.mu.
+func (s *StubServer) putLabelLocked(username, labelPath string, msg proto.Message) {
+	data, _ := proto.Marshal(msg)
+	dataID := contentAddress(data)
+	s.blocks[hexEncode(dataID)] = data
+	s.names[hexEncode(dataID)] = "data for " + labelPath
+
+	key := hexEncode(computeLabelKey(s.owners[username], labelPath))
+	if previous, ok := s.labels[key]; ok && (s.staleReads > 0 || s.stalePeriod > 0) {
+		s.stale[key] = &staleLabel{
+			label:     previous,
+			readsLeft: s.staleReads,
+			until:     time.Now().Add(s.stalePeriod),
 		}
+	} else {
+		delete(s.stale, key)
+	}
+
+	s.labels[key] = &pb.Label{
+		DataId: &pb.ID{Value: dataID},
+	}
+}
+
+// UpdateConsents replaces a user's consent list at runtime.
+func (s *StubServer) UpdateConsents(username string, consents []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		log.Printf("Loaded user %s: %d consents, %d endpoints", username, len(user.Consents), len(user.Endpoints))
+	user, ok := s.fixtures.Users[username]
+	if !ok {
+		return fmt.Errorf("unknown user %s", username)
 	}
+	user.Consents = consents
+	s.fixtures.Users[username] = user
+
+	s.setConsentsLocked(username, consents)
+	logf(logInfo, "Updated user %s: %d consents", username, len(consents))
+	return nil
+}
+
+// UpdateEndpoints replaces a user's endpoint list at runtime.
+func (s *StubServer) UpdateEndpoints(username string, endpoints []EndpointFixture) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.fixtures.Users[username]
+	if !ok {
+		return fmt.Errorf("unknown user %s", username)
+	}
+	user.Endpoints = endpoints
+	s.fixtures.Users[username] = user
+
+	s.setEndpointsLocked(username, endpoints)
+	logf(logInfo, "Updated user %s: %d endpoints", username, len(endpoints))
+	return nil
+}
+
+// SetStaleReads configures how long superseded label versions keep being served
+// after an update. Applies to subsequent updates.
+func (s *StubServer) SetStaleReads(reads int, period time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.staleReads = reads
+	s.stalePeriod = period
+	logf(logInfo, "Stale reads: %d reads, %s", reads, period)
 }
 
 // GetBlock implements pb.BlockStorageAPIServer.
 func (s *StubServer) GetBlock(ctx context.Context, req *pb.GetBlockRequest) (*pb.GetBlockResponse, error) {
+	start := time.Now()
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	if req.Id == nil {
+		s.recordLocked("GetBlock", "", false, start)
 		return &pb.GetBlockResponse{Found: false}, nil
 	}
 
 	key := hexEncode(req.Id.Value)
 	data, ok := s.blocks[key]
+	s.recordLocked("GetBlock", key, ok, start)
 	if !ok {
-		log.Printf("GetBlock: not found %s", key[:16])
+		logf(logInfo, "GetBlock: not found %s", s.describe(key))
 		return &pb.GetBlockResponse{Found: false}, nil
 	}
 
-	log.Printf("GetBlock: found %s (%d bytes)", key[:16], len(data))
+	logf(logDebug, "GetBlock: found %s (%d bytes)", s.describe(key), len(data))
 	return &pb.GetBlockResponse{
 		Found: true,
 		Block: &pb.Datum{
@@ -182,23 +323,111 @@ func (s *StubServer) GetBlock(ctx context.Context, req *pb.GetBlockRequest) (*pb
 
 // GetLabel implements pb.BlockStorageAPIServer.
 func (s *StubServer) GetLabel(ctx context.Context, req *pb.GetLabelRequest) (*pb.GetLabelResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	start := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	key := hexEncode(req.Key)
+
+	// Serve the superseded version while stale-read simulation is active
+	if st, ok := s.stale[key]; ok {
+		if st.readsLeft > 0 || time.Now().Before(st.until) {
+			if st.readsLeft > 0 {
+				st.readsLeft--
+			}
+			s.recordLocked("GetLabel", key, true, start)
+			logf(logDebug, "GetLabel: serving stale %s", s.describe(key))
+			return &pb.GetLabelResponse{
+				Found: true,
+				Label: st.label,
+			}, nil
+		}
+		delete(s.stale, key)
+	}
+
 	label, ok := s.labels[key]
+	s.recordLocked("GetLabel", key, ok, start)
 	if !ok {
-		log.Printf("GetLabel: not found %s", key[:16])
+		logf(logInfo, "GetLabel: not found %s", s.describe(key))
 		return &pb.GetLabelResponse{Found: false}, nil
 	}
 
-	log.Printf("GetLabel: found %s", key[:16])
+	logf(logDebug, "GetLabel: found %s", s.describe(key))
 	return &pb.GetLabelResponse{
 		Found: true,
 		Label: label,
 	}, nil
 }
 
+// newControlRouter returns the HTTP control API for runtime updates.
+func newControlRouter(s *StubServer) http.Handler {
+	r := chi.NewRouter()
+
+	r.Put("/users/{username}/consents", func(w http.ResponseWriter, r *http.Request) {
+		var consents []string
+		if err := json.NewDecoder(r.Body).Decode(&consents); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := s.UpdateConsents(chi.URLParam(r, "username"), consents); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Put("/users/{username}/endpoints", func(w http.ResponseWriter, r *http.Request) {
+		var endpoints []EndpointFixture
+		if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := s.UpdateEndpoints(chi.URLParam(r, "username"), endpoints); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Post("/stale", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Reads    int    `json:"reads"`
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		var period time.Duration
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			period = d
+		}
+		s.SetStaleReads(req.Reads, period)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/requests", func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.requests.recent(limit))
+	})
+
+	return r
+}
+
 // Helper functions
 
 func computeLabelKey(ownerID []byte, labelPath string) []byte {
@@ -235,9 +464,29 @@ func hexDecode(s string) []byte {
 func main() {
 	port := flag.Int("port", 50051, "gRPC server port")
 	fixturesPath := flag.String("config", "fixtures.json", "path to fixtures file")
+	controlPort := flag.Int("control-port", 0, "HTTP control API port for runtime label updates (0 disables)")
+	logLevelFlag := flag.String("log-level", "info", "lookup logging: quiet, info, or debug")
+	requestHistory := flag.Int("request-history", 200, "number of recent calls listed by GET /requests")
+	check := flag.Bool("check", false, "validate the fixtures file and exit")
 	flag.Parse()
 
-	server := NewStubServer()
+	if *check {
+		fixtures, err := readFixtures(*fixturesPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *fixturesPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK, %s\n", *fixturesPath, fixtureSummary(fixtures))
+		return
+	}
+
+	level, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+	verbosity = level
+
+	server := NewStubServer(*requestHistory)
 
 	if _, err := os.Stat(*fixturesPath); err == nil {
 		if err := server.LoadFixtures(*fixturesPath); err != nil {
@@ -254,6 +503,16 @@ func main() {
 
 	grpcServer := grpc.NewServer()
 	pb.RegisterBlockStorageAPIServer(grpcServer, server)
+	reflection.Register(grpcServer)
+
+	if *controlPort != 0 {
+		go func() {
+			log.Printf("OurCloud stub control API listening on :%d", *controlPort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", *controlPort), newControlRouter(server)); err != nil {
+				log.Fatalf("Control API failed: %v", err)
+			}
+		}()
+	}
 
 	// Graceful shutdown
 	go func() {
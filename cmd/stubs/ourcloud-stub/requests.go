@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// logLevel controls how much the stub logs about lookups.
+type logLevel int
+
+const (
+	logQuiet logLevel = iota // startup and errors only
+	logInfo                  // also misses and label updates
+	logDebug                 // also every successful lookup
+)
+
+// verbosity is set from the -log-level flag.
+var verbosity = logInfo
+
+// parseLogLevel parses a -log-level flag value.
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "quiet":
+		return logQuiet, nil
+	case "info":
+		return logInfo, nil
+	case "debug":
+		return logDebug, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want quiet, info, or debug)", s)
+}
+
+// logf logs when the stub's verbosity is at least level.
+func logf(level logLevel, format string, args ...any) {
+	if verbosity >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// knownLabelPaths are the per-user labels the gateway reads. The stub
+// precomputes their keys so lookups can be shown by path even when missing.
+var knownLabelPaths = []string{
+	"/users/%s/platform/push/consents",
+	"/users/%s/platform/push/endpoints",
+	"/users/%s/platform/push/gateways",
+	"/users/%s/platform/preferences/locale",
+	"/users/%s/platform/preferences/batch_window",
+}
+
+// RequestRecord is one gRPC call in the GET /requests listing.
+type RequestRecord struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"` // "GetBlock" or "GetLabel"
+	Key      string    `json:"key"`    // hex block ID or label key
+	Name     string    `json:"name,omitempty"`
+	Found    bool      `json:"found"`
+	Duration string    `json:"duration"`
+}
+
+// requestLog keeps the most recent gRPC calls in a ring buffer.
+type requestLog struct {
+	mu      sync.Mutex
+	records []RequestRecord
+	next    int
+	full    bool
+}
+
+func newRequestLog(size int) *requestLog {
+	return &requestLog{records: make([]RequestRecord, max(size, 1))}
+}
+
+func (l *requestLog) add(r RequestRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records[l.next] = r
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns up to limit records, newest first.
+func (l *requestLog) recent(limit int) []RequestRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.records)
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+
+	out := make([]RequestRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.records[(l.next-i+len(l.records))%len(l.records)])
+	}
+	return out
+}
+
+// recordLocked adds a lookup to s.requests. Caller must hold s.mu.
+func (s *StubServer) recordLocked(method, key string, found bool, start time.Time) {
+	s.requests.add(RequestRecord{
+		Time:     start,
+		Method:   method,
+		Key:      key,
+		Name:     s.names[key],
+		Found:    found,
+		Duration: time.Since(start).String(),
+	})
+}
+
+// describe formats a key for log lines, with its name when known.
+// Caller must hold s.mu.
+func (s *StubServer) describe(key string) string {
+	short := key
+	if len(short) > 16 {
+		short = short[:16]
+	}
+	if name := s.names[key]; name != "" {
+		return fmt.Sprintf("%s (%s)", short, name)
+	}
+	return short
+}
@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/handler"
+)
+
+// authChain builds the authenticators listed in auth.chain, in order.
+func (g *Gateway) authChain() (*handler.AuthChain, error) {
+	ac := g.cfg.Auth
+	auths := make([]handler.Authenticator, 0, len(ac.Chain))
+	for _, name := range ac.Chain {
+		switch name {
+		case handler.AuthSignature:
+			auths = append(auths, handler.NewSignatureAuth(g.oc))
+		case handler.AuthAPIKey:
+			if len(ac.APIKeys) == 0 {
+				return nil, errors.New("api_key needs auth.api_keys")
+			}
+			keys := make(map[string]string, len(ac.APIKeys))
+			for _, k := range ac.APIKeys {
+				if _, ok := keys[k.Key]; ok {
+					return nil, errors.New("API key listed twice in auth.api_keys")
+				}
+				keys[k.Key] = k.Sender
+			}
+			a, err := handler.NewAPIKeyAuth(keys)
+			if err != nil {
+				return nil, err
+			}
+			auths = append(auths, a)
+		case handler.AuthClientCert:
+			if len(ac.ClientCert.Senders) == 0 {
+				return nil, errors.New("client_cert needs auth.client_cert.senders")
+			}
+			if ac.ClientCert.Header != "" && len(g.cfg.Server.TrustedProxies) == 0 {
+				log.Printf("WARNING: auth.client_cert.header is only believed from server.trusted_proxies, and none are set")
+			}
+			a, err := handler.NewClientCertAuth(ac.ClientCert.Senders, ac.ClientCert.Header)
+			if err != nil {
+				return nil, err
+			}
+			auths = append(auths, a)
+		default:
+			return nil, fmt.Errorf("unknown authenticator %q (want %s, %s, or %s)", name, handler.AuthSignature, handler.AuthAPIKey, handler.AuthClientCert)
+		}
+	}
+	return handler.NewAuthChain(auths...)
+}
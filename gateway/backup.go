@@ -0,0 +1,93 @@
+package gateway
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/backup"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/egress"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// OpenBackupBucket opens the bucket storage.backup.url names, and returns
+// the prefix of the backups in it, for "pushserver restore".
+func OpenBackupBucket(ctx context.Context, cfg *Config) (backup.Bucket, string, error) {
+	var transport http.RoundTripper
+	if cfg.Proxy.URL != "" {
+		dialer, err := egress.New(egress.Config{URL: cfg.Proxy.URL, NoProxy: cfg.Proxy.NoProxy})
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid proxy settings: %w", err)
+		}
+		transport = dialer.Transport()
+	}
+	return openBackupBucket(ctx, cfg, transport)
+}
+
+// openBackupBucket opens the backup bucket, reached through transport, or
+// the default transport if nil.
+func openBackupBucket(ctx context.Context, cfg *Config, transport http.RoundTripper) (backup.Bucket, string, error) {
+	bc := cfg.Storage.Backup
+	credentialsFile := bc.CredentialsFile
+	var credentialsJSON string
+	if credentialsFile == "" {
+		credentialsFile = cfg.Firebase.CredentialsFile
+		credentialsJSON = cfg.Firebase.CredentialsJSON
+	}
+	return backup.Open(ctx, backup.Config{
+		URL: bc.URL,
+		S3: backup.S3Config{
+			Region:          bc.S3.Region,
+			Endpoint:        bc.S3.Endpoint,
+			AccessKeyID:     bc.S3.AccessKeyID,
+			SecretAccessKey: bc.S3.SecretAccessKey,
+		},
+		CredentialsFile: credentialsFile,
+		CredentialsJSON: credentialsJSON,
+		Transport:       transport,
+	})
+}
+
+// openBackups sets up backups of the store to storage.backup.url.
+func (g *Gateway) openBackups() error {
+	cfg := g.cfg
+	var transport http.RoundTripper
+	if g.egress != nil {
+		transport = g.egress.Transport()
+	}
+	bucket, prefix, err := openBackupBucket(context.Background(), cfg, transport)
+	if err != nil {
+		return err
+	}
+	g.backups = backup.New(bucket, prefix, store.ShardPaths(cfg.Storage.Path, cfg.Storage.Shards), backup.Retention{
+		Keep:   cfg.Storage.Backup.Keep,
+		MaxAge: cfg.Storage.Backup.MaxAge,
+	})
+	g.metrics.Set("backups", expvar.Func(func() any { return g.backups.Stats() }))
+	log.Printf("Backing up the store to %s every %s", cfg.Storage.Backup.URL, cfg.Storage.Backup.Interval)
+	return nil
+}
+
+// backupLoop backs the store up every storage.backup.interval until stop
+// is closed.
+func (g *Gateway) backupLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.cfg.Storage.Backup.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			m, err := g.backups.Run(context.Background())
+			if err != nil {
+				log.Printf("ERROR: store backup failed: %v", err)
+				continue
+			}
+			log.Printf("INFO: backed up the store as %s (%d bytes, %s)", m.Name, m.Bytes, time.Since(start).Round(time.Millisecond))
+		case <-stop:
+			return
+		}
+	}
+}
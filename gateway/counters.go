@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/counters"
+)
+
+// openCounters starts keeping the batcher's push totals, resuming them from
+// the store.
+func (g *Gateway) openCounters() error {
+	c, err := counters.New(context.Background(), g.store, batcher.CounterNames)
+	if err != nil {
+		return err
+	}
+	g.counters = c
+	g.metrics.Set("counters", expvar.Func(func() any { return c.Snapshot() }))
+	return nil
+}
+
+// countersLoop writes the push totals to the store every
+// admin.counters.flush_interval until stop is closed.
+func (g *Gateway) countersLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.cfg.Admin.Counters.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := g.counters.Flush(context.Background()); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,1539 @@
+// Package gateway runs an OurCloud FCM push gateway in-process.
+//
+// It wires up the store, batcher, handlers, and router exactly as the
+// pushserver binary does, so other Go services and tests can embed a gateway
+// without exec-ing the binary:
+//
+//	cfg, err := gateway.LoadConfig("config.yaml")
+//	...
+//	g, err := gateway.New(cfg)
+//	...
+//	defer g.Close()
+//	err = g.Run(ctx) // serves until ctx is cancelled
+//
+// Options replace individual components, such as the FCM sender or the
+// OurCloud client, for example with fakes in tests.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/abuse"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/adminui"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/backup"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/config"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/consent"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/counters"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/egress"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/endpointhealth"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/handler"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logsample"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/mirror"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/quota"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/senderclass"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/visible"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+// shutdownTimeout bounds how long Run waits for in-flight requests and the
+// handoff flush when ctx is cancelled.
+const shutdownTimeout = 30 * time.Second
+
+// compressionLevel is the gzip level for compressed responses. Status and
+// admin responses are small, so a middling level costs little CPU.
+const compressionLevel = 5
+
+// Config is the gateway configuration, as read from config.yaml.
+type Config = config.Config
+
+// Store persists batches and statuses. The gateway's SQLite store is used
+// unless WithStore replaces it.
+type Store = store.Store
+
+// Sender delivers a batch to one FCM token. A Sender that also implements
+// Broadcaster enables the /admin/broadcast and topic endpoints.
+type Sender = batcher.Sender
+
+// TokenValidator checks FCM tokens with dry-run sends. A Sender that also
+// implements it enables firebase.token_sweep.
+type TokenValidator = batcher.TokenValidator
+
+// Broadcaster sends to and manages FCM topics.
+type Broadcaster = handler.Broadcaster
+
+// SendOptions are the per-message settings passed to Sender.Send.
+type SendOptions = fcm.SendOptions
+
+// SignatureVerifier verifies users' signatures of requests they sign.
+type SignatureVerifier = handler.SignatureVerifier
+
+// ConsentInspector reads consent lists and verifies users' signatures.
+type ConsentInspector = handler.ConsentInspector
+
+// BlockChecker reports whether content-addressed blocks exist in OurCloud.
+type BlockChecker = handler.BlockChecker
+
+// CryptKeySource reads users' public crypt keys from OurCloud.
+type CryptKeySource = batcher.CryptKeySource
+
+// DNDSource reads users' Do-Not-Disturb settings from OurCloud.
+type DNDSource = batcher.DNDSource
+
+// OurCloud is what the gateway reads from OurCloud: sender keys, consent
+// lists, endpoints, and per-user preferences. An OurCloud that also
+// implements SignatureVerifier enables DELETE /push/{request_id},
+// GET /queue/{recipient} and, with batch.foreground.window set,
+// POST /presence/{recipient}/{device_id}, and one implementing
+// ConsentInspector enables GET /consents/{recipient}.
+// ourcloud.verify_content needs a BlockChecker,
+// firebase.encrypt_payload a CryptKeySource, dnd.enabled a DNDSource, and
+// ourcloud.service_record a LabelWriter.
+type OurCloud interface {
+	handler.OurCloudClient
+	handler.GatewayResolver
+	batcher.WindowSource
+	visible.LocaleSource
+	HealthCheck(ctx context.Context) error
+}
+
+// LoadConfig reads a YAML configuration file, applying defaults.
+func LoadConfig(path string) (*Config, error) {
+	return config.Load(path)
+}
+
+// LoadConfigEnv reads configuration from the YAML file at path, if it exists,
+// overridden by PUSHSERVER_ environment variables. See config.LoadEnv.
+func LoadConfigEnv(path string) (*Config, error) {
+	return config.LoadEnv(path)
+}
+
+// SampleLogs collapses repeated lines from the standard logger, writing each
+// line once per interval and then a summary of how often it repeated.
+// Suppressed lines are counted in the "log_sampling" metric. The returned
+// function writes the pending summaries and restores the logger.
+func SampleLogs(interval time.Duration) func() {
+	return logsample.Install(interval)
+}
+
+// SetLogPrivacy sets how much metadata log lines carry, as "full", "hashed"
+// or "minimal" (see Config.Log.Privacy). hashKey keys the username hash, as
+// privacy.hash_key does. The level applies to the whole process.
+func SetLogPrivacy(level, hashKey string) error {
+	l, err := logfield.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logfield.Configure(l, hashKey)
+	return nil
+}
+
+// SetLogPrivacyFromConfig is SetLogPrivacy with cfg's log.privacy level
+// and the username hash privacy.hasher selects.
+func SetLogPrivacyFromConfig(cfg *Config) error {
+	l, err := logfield.ParseLevel(cfg.Log.Privacy)
+	if err != nil {
+		return err
+	}
+	hasher, err := labelhash.New(cfg.Privacy.Hasher, cfg.Privacy.HashKey, cfg.Privacy.PreviousHashKeys)
+	if err != nil {
+		return err
+	}
+	logfield.ConfigureHasher(l, hasher)
+	return nil
+}
+
+// DefaultConfig returns a configuration with every setting at its default.
+func DefaultConfig() *Config {
+	return config.Default()
+}
+
+// Gateway is a push gateway wired from a Config.
+type Gateway struct {
+	cfg       *Config
+	commit    string
+	buildTime string
+	startTime time.Time
+
+	ocClient  *ourcloud.Client // nil when WithOurCloud replaced it
+	egress    *egress.Dialer   // nil unless proxy.url is set
+	oc        OurCloud
+	store     Store
+	ownStore  bool // close store on Close
+	sender    Sender
+	batcher   *batcher.Batcher
+	quota     *quota.Accountant // nil unless firebase.quota.enabled
+	backups   *backup.Backuper  // nil unless storage.backup.url is set
+	publisher *servicePublisher // nil unless ourcloud.service_record.account is set
+	labels    labelhash.Hasher  // replaces usernames in labels
+	listener  net.Listener
+
+	grpcListener   net.Listener
+	groupListeners map[string]net.Listener // by routes.*.listen address
+
+	metrics         *expvar.Map
+	lostStatuses    *expvar.Int
+	expiredStatuses *expvar.Map // deleted by the cleanup, by state
+	health          *healthHistory
+	endpoints       *endpointhealth.Tracker // nil unless batch.endpoint_health.enabled
+	router          http.Handler
+	groupRouters    map[string]http.Handler // by routes.*.listen address
+
+	abuse         *abuse.Detector           // nil unless abuse.enabled
+	duplicates    *handler.DuplicateTracker // nil unless ourcloud.dedup_endpoints
+	capture       *handler.CaptureBuffer    // records /push requests while switched on
+	senderClasses *senderclass.Classifier   // nil without sender_classes
+	replicator    *mirror.Replicator        // nil unless mirror.standby_url is set
+	standby       *mirror.Standby           // nil unless mirror.standby
+	counters      *counters.Counters        // nil unless admin.counters.enabled
+	reloadMu      sync.Mutex                // serializes Reload
+}
+
+// New builds a gateway from cfg, connecting to OurCloud and opening the store
+// unless options supply them. Call Close to release them.
+func New(cfg *Config, opts ...Option) (*Gateway, error) {
+	g := &Gateway{
+		cfg:             cfg,
+		commit:          "unknown",
+		buildTime:       "unknown",
+		startTime:       time.Now(),
+		metrics:         new(expvar.Map).Init(),
+		lostStatuses:    new(expvar.Int),
+		expiredStatuses: new(expvar.Map).Init(),
+		health:          newHealthHistory(),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.metrics.Set("statuses_marked_lost", g.lostStatuses)
+	g.metrics.Set("statuses_expired", g.expiredStatuses)
+
+	if err := g.build(); err != nil {
+		g.Close()
+		return nil, err
+	}
+	return g, nil
+}
+
+// ourCloudConnected records that the OurCloud client connected and, with
+// several nodes, starts probing them.
+func (g *Gateway) ourCloudConnected() {
+	cfg := g.cfg
+	g.health.record(healthCheckOurCloud, "", time.Now())
+	if len(cfg.OurCloud.Nodes) > 0 {
+		g.ocClient.Probe(context.Background())
+		g.ocClient.StartProbing(cfg.OurCloud.ProbeInterval)
+		log.Printf("Connected to %d OurCloud nodes (region %q)", len(cfg.OurCloud.Nodes), cfg.OurCloud.Region)
+	} else {
+		log.Printf("Connected to OurCloud node at %s", cfg.OurCloud.GRPCAddress)
+	}
+}
+
+// firebaseTransport returns the transport for requests to Firebase, or nil
+// for the SDK's default.
+func (g *Gateway) firebaseTransport() http.RoundTripper {
+	if g.egress == nil {
+		return nil
+	}
+	return g.egress.Transport()
+}
+
+// payloadSchemas converts the payload layouts to FCM payload schemas.
+func payloadSchemas(cfg config.PayloadConfig) []fcm.PayloadSchema {
+	schemas := []fcm.PayloadSchema{{Key: cfg.Key, Version: cfg.SchemaVersion}}
+	for _, v := range cfg.Versions {
+		schemas = append(schemas, fcm.PayloadSchema{MinAppVersion: v.MinAppVersion, Key: v.Key, Version: v.SchemaVersion})
+	}
+	return schemas
+}
+
+// payloadKey reports whether name is a data key a payload layout writes.
+func payloadKey(cfg config.PayloadConfig, name string) bool {
+	if name == cfg.Key || name == fcm.SchemaVersionKey {
+		return true
+	}
+	for _, v := range cfg.Versions {
+		if name == v.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// build initializes the components options didn't supply and the router.
+func (g *Gateway) build() error {
+	cfg := g.cfg
+
+	if cfg.Proxy.URL != "" {
+		dialer, err := egress.New(egress.Config{URL: cfg.Proxy.URL, NoProxy: cfg.Proxy.NoProxy})
+		if err != nil {
+			return fmt.Errorf("invalid proxy settings: %w", err)
+		}
+		g.egress = dialer
+		log.Printf("Routing Firebase and OurCloud connections through proxy %s", dialer)
+	}
+
+	// Initialize OurCloud client
+	if g.oc == nil {
+		var ocClient *ourcloud.Client
+		if len(cfg.OurCloud.Nodes) > 0 {
+			nodes := make([]ourcloud.Node, 0, len(cfg.OurCloud.Nodes))
+			for _, n := range cfg.OurCloud.Nodes {
+				nodes = append(nodes, ourcloud.Node{Address: n.Address, Region: n.Region})
+			}
+			ocClient = ourcloud.NewClientWithNodes(nodes, cfg.OurCloud.Region)
+		} else {
+			ocClient = ourcloud.NewClient(cfg.OurCloud.GRPCAddress)
+		}
+		if g.egress != nil {
+			ocClient.SetTunneler(g.egress)
+		}
+		g.ocClient = ocClient
+		g.oc = ocClient
+
+		var err error
+		if cfg.OurCloud.StartupWait > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.OurCloud.StartupWait)
+			err = ocClient.WaitReady(ctx)
+			cancel()
+		} else {
+			err = ocClient.Connect()
+		}
+		switch {
+		case err == nil:
+			g.ourCloudConnected()
+		case cfg.OurCloud.LazyConnect:
+			// Serve with degraded health until the node is up
+			log.Printf("WARNING: starting without OurCloud, retrying in the background: %v", err)
+			g.health.record(healthCheckOurCloud, fmt.Sprintf("error: %v", err), time.Now())
+			ocClient.ConnectInBackground(g.ourCloudConnected)
+		default:
+			return fmt.Errorf("connecting to OurCloud node: %w", err)
+		}
+	}
+
+	if cfg.OurCloud.ServiceRecord.Account != "" {
+		if err := g.openServiceRecord(); err != nil {
+			return fmt.Errorf("initializing service record: %w", err)
+		}
+	}
+
+	// Initialize store
+	if g.store == nil {
+		if err := g.openStore(); err != nil {
+			return fmt.Errorf("initializing store: %w", err)
+		}
+	}
+	// Only the database files the gateway opened itself can be backed up
+	if cfg.Storage.Backup.URL != "" && g.ownStore {
+		if err := g.openBackups(); err != nil {
+			return fmt.Errorf("initializing backups: %w", err)
+		}
+	}
+
+	// Initialize FCM sender
+	if _, err := logfield.ParseLevel(cfg.Log.Privacy); err != nil {
+		return fmt.Errorf("unknown log.privacy %q (want full, hashed or minimal)", cfg.Log.Privacy)
+	}
+	labels, err := labelhash.New(cfg.Privacy.Hasher, cfg.Privacy.HashKey, cfg.Privacy.PreviousHashKeys)
+	if err != nil {
+		return fmt.Errorf("invalid privacy.hasher: %w", err)
+	}
+	g.labels = labels
+	if cfg.Privacy.Hasher == labelhash.NamePlain {
+		if cfg.Privacy.Enabled || cfg.Log.Privacy == "hashed" {
+			log.Printf("WARNING: privacy.hasher is plain; usernames are written unhashed, which is only meant for development")
+		}
+	} else {
+		if cfg.Log.Privacy == "hashed" && cfg.Privacy.HashKey == "" {
+			log.Printf("WARNING: log.privacy is hashed without privacy.hash_key; hashed usernames can be reversed by guessing")
+		}
+		if cfg.Privacy.Enabled && cfg.Privacy.HashKey == "" {
+			log.Printf("WARNING: privacy.enabled is set without privacy.hash_key; hashed usernames can be reversed by guessing")
+		}
+	}
+	if cfg.Privacy.Enabled && cfg.Firebase.Provenance {
+		log.Printf("WARNING: firebase.provenance sends unkeyed sender hashes through FCM; they can be reversed by guessing")
+	}
+
+	if cfg.Firebase.Quota.Enabled {
+		if err := g.openQuota(); err != nil {
+			return fmt.Errorf("initializing FCM usage accounting: %w", err)
+		}
+	}
+
+	if g.sender == nil {
+		var usage fcm.UsageMeter
+		if g.quota != nil {
+			usage = g.quota
+		}
+		var labelHasher labelhash.Hasher
+		if cfg.Privacy.Enabled {
+			labelHasher = g.labels
+		}
+		sender, err := fcm.New(context.Background(), fcm.Config{
+			CredentialsFile: cfg.Firebase.CredentialsFile,
+			CredentialsJSON: cfg.Firebase.CredentialsJSON,
+			ProjectID:       cfg.Firebase.ProjectID,
+			Endpoint:        cfg.Firebase.Endpoint,
+			QPS:             cfg.Firebase.QPS,
+			Burst:           cfg.Firebase.Burst,
+			ChannelID:       cfg.Visible.ChannelID,
+			AnalyticsLabels: cfg.Firebase.AnalyticsLabels,
+			LabelHasher:     labelHasher,
+			Provenance:      cfg.Firebase.Provenance,
+			Transport:       g.firebaseTransport(),
+			Usage:           usage,
+			PayloadSchemas:  payloadSchemas(cfg.Firebase.Payload),
+		})
+		if err != nil {
+			return fmt.Errorf("initializing FCM sender: %w", err)
+		}
+		g.sender = sender
+		log.Printf("Initialized FCM sender")
+	}
+
+	switch cfg.Storage.FailurePolicy {
+	case "", batcher.StoreFailureMemory, batcher.StoreFailureReject:
+	default:
+		return fmt.Errorf("unknown storage.failure_policy %q (want memory or reject)", cfg.Storage.FailurePolicy)
+	}
+
+	newRequestID, err := batcher.NewIDGenerator(cfg.Status.IDFormat, cfg.Status.IDPrefix)
+	if err != nil {
+		return fmt.Errorf("invalid request ID settings: %w", err)
+	}
+	if err := batcher.ValidateStateRetention(cfg.Status.RetentionByState); err != nil {
+		return fmt.Errorf("invalid status.retention_by_state: %w", err)
+	}
+
+	var visibleRenderer batcher.VisibleRenderer
+	if cfg.Visible.Enabled {
+		templates := make(map[string]visible.Template, len(cfg.Visible.Templates))
+		for locale, t := range cfg.Visible.Templates {
+			templates[locale] = visible.Template{Title: t.Title, Body: t.Body}
+		}
+		renderer, err := visible.NewRenderer(localeSource{g.oc}, cfg.Visible.DefaultLocale, templates)
+		if err != nil {
+			return fmt.Errorf("invalid visible notification config: %w", err)
+		}
+		visibleRenderer = renderer
+	}
+
+	var windowSource batcher.WindowSource
+	if cfg.Batch.RecipientWindows {
+		windowSource = g.oc
+	}
+
+	var cryptKeys batcher.CryptKeySource
+	if cfg.Firebase.EncryptPayload {
+		keys, ok := g.oc.(CryptKeySource)
+		if !ok {
+			return errors.New("firebase.encrypt_payload needs an OurCloud client that can read crypt keys")
+		}
+		cryptKeys = keys
+	}
+
+	var dnd batcher.DNDSource
+	if cfg.DND.Enabled {
+		switch cfg.DND.Policy {
+		case batcher.DNDHold, batcher.DNDDrop:
+		default:
+			return fmt.Errorf("unknown dnd.policy %q (want hold or drop)", cfg.DND.Policy)
+		}
+		source, ok := g.oc.(DNDSource)
+		if !ok {
+			return errors.New("dnd.enabled needs an OurCloud client that can read Do-Not-Disturb settings")
+		}
+		dnd = source
+	}
+
+	var recipients batcher.RecipientSource
+	if cfg.OurCloud.VerifyRecipients {
+		recipients = recipientSource{g.oc}
+	}
+
+	var healthTracker batcher.HealthTracker
+	var unreachable func(recipient, fcmToken string)
+	if cfg.Batch.EndpointHealth.Enabled {
+		eh := cfg.Batch.EndpointHealth
+		tracker, err := endpointhealth.New(endpointhealth.Config{
+			HalfLife:     eh.HalfLife,
+			PauseBelow:   eh.PauseBelow,
+			MinAttempts:  eh.MinAttempts,
+			PauseFor:     eh.PauseFor,
+			MaxEndpoints: eh.MaxEndpoints,
+		})
+		if err != nil {
+			return fmt.Errorf("invalid batch.endpoint_health configuration: %w", err)
+		}
+		g.endpoints = tracker
+		healthTracker = tracker
+		if eh.NotifyDevices {
+			unreachable = g.notifyUnreachable
+		}
+	}
+
+	var preflight TokenValidator
+	if cfg.Firebase.TokenPreflight.Enabled {
+		validator, ok := g.sender.(TokenValidator)
+		if !ok {
+			return errors.New("firebase.token_preflight needs a sender that can validate tokens")
+		}
+		preflight = validator
+	}
+
+	leaseOwner := cfg.Batch.LeaseOwner
+	if cfg.Batch.LeaseTTL > 0 {
+		if cfg.Batch.LeaseTTL <= cfg.Batch.FlushTimeout {
+			return fmt.Errorf("batch.lease_ttl (%s) must exceed batch.flush_timeout (%s)", cfg.Batch.LeaseTTL, cfg.Batch.FlushTimeout)
+		}
+		// Coalesced writes replace whole rows, dropping what other
+		// instances saved to the same batch
+		if cfg.Storage.WriteInterval > 0 {
+			return fmt.Errorf("batch.lease_ttl can't be combined with storage.write_interval")
+		}
+		if leaseOwner == "" {
+			host, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("naming batch lease owner: %w", err)
+			}
+			leaseOwner = fmt.Sprintf("%s:%d", host, os.Getpid())
+		}
+	}
+
+	var mirrorHook func(recipient, fcmToken string, notif store.QueuedNotification)
+	eventBuffer := 0
+	if cfg.Mirror.StandbyURL != "" {
+		g.openReplicator()
+		mirrorHook = g.mirrorNotification
+		// Room for the outcomes of a send interval's pushes
+		eventBuffer = cfg.Mirror.Buffer
+	}
+
+	var counterSink batcher.CounterSink
+	if cfg.Admin.Counters.Enabled {
+		if err := g.openCounters(); err != nil {
+			return fmt.Errorf("restoring push counters: %w", err)
+		}
+		counterSink = g.counters
+	}
+
+	g.batcher = batcher.New(g.store, g.sender, batcher.Config{
+		BatchWindow:      cfg.Batch.Window,
+		MaxBatchSize:     cfg.Batch.MaxSize,
+		MaxDataIDs:       cfg.Batch.MaxDataIDs,
+		LockTimeout:      cfg.Storage.LockTimeout,
+		StatusRetention:  cfg.Status.Retention,
+		StateRetention:   cfg.Status.RetentionByState,
+		NewRequestID:     newRequestID,
+		DedupWindow:      cfg.Batch.DedupWindow,
+		FlushConcurrency: cfg.Batch.FlushConcurrency,
+		FreshWeight:      cfg.Batch.FreshWeight,
+		RecoveryWeight:   cfg.Batch.RecoveryWeight,
+		RecoveryRate:     cfg.Batch.RecoveryRate,
+		FlushTimeout:     cfg.Batch.FlushTimeout,
+		MaxFlushAttempts: cfg.Batch.MaxFlushAttempts,
+		MaxBatchAge:      cfg.Batch.MaxAge,
+		MinSendInterval:  cfg.Batch.MinSendInterval,
+		LostAfter:        cfg.Status.LostAfter,
+		Visible:          visibleRenderer,
+		Windows:          windowSource,
+		CryptKeys:        cryptKeys,
+		DND:              dnd,
+		DNDPolicy:        cfg.DND.Policy,
+		MinWindow:        cfg.Batch.MinWindow,
+		MaxWindow:        cfg.Batch.MaxWindow,
+		Adaptive:         cfg.Batch.AdaptiveWindow,
+		AdaptiveFullLoad: cfg.Batch.AdaptiveFullLoad,
+		PrivateStatus:    cfg.Privacy.Enabled,
+
+		StoreFailurePolicy: cfg.Storage.FailurePolicy,
+		LeaseOwner:         leaseOwner,
+		LeaseTTL:           cfg.Batch.LeaseTTL,
+		Recipients:         recipients,
+		Health:             healthTracker,
+		Unreachable:        unreachable,
+		SendReceipts:       cfg.Batch.SendReceipts,
+		Preflight:          preflight,
+		PreflightTokens:    cfg.Firebase.TokenPreflight.MaxTokens,
+		Mirror:             mirrorHook,
+		EventBuffer:        eventBuffer,
+		ForegroundWindow:   cfg.Batch.Foreground.Window,
+		ForegroundTTL:      cfg.Batch.Foreground.TTL,
+		ForegroundDevices:  cfg.Batch.Foreground.MaxDevices,
+		Counters:           counterSink,
+		ReserveRequestIDs:  cfg.Status.IDFormat == batcher.IDFormatShort,
+	})
+	b := g.batcher
+	g.metrics.Set("queue_drops", expvar.Func(func() any { return b.Drops() }))
+	g.metrics.Set("store_health", expvar.Func(func() any { return b.StoreHealth() }))
+	g.metrics.Set("batches_dead_lettered", expvar.Func(func() any { return b.DeadLettered() }))
+	g.metrics.Set("flush_errors", expvar.Func(func() any { return b.FlushErrors() }))
+	g.metrics.Set("flush_retries", expvar.Func(func() any { return b.Retries() }))
+	if cfg.Firebase.TokenSweep.Interval > 0 {
+		if _, ok := g.sender.(TokenValidator); !ok {
+			return fmt.Errorf("firebase.token_sweep needs a sender that can validate tokens")
+		}
+		g.metrics.Set("token_sweep", expvar.Func(func() any { return b.SweepStats() }))
+	}
+	if preflight != nil {
+		g.metrics.Set("token_preflight", expvar.Func(func() any { return b.Preflights() }))
+	}
+	if cfg.Batch.LeaseTTL > 0 {
+		g.metrics.Set("batch_leases", expvar.Func(func() any { return b.Leases() }))
+	}
+	if cfg.OurCloud.VerifyRecipients {
+		g.metrics.Set("recipients_gone", expvar.Func(func() any { return b.RecipientsGone() }))
+	}
+	if cfg.Batch.Watchdog.Interval > 0 {
+		g.metrics.Set("batch_watchdog", expvar.Func(func() any { return b.WatchdogStats() }))
+	}
+	if cfg.Batch.MaxRetention > 0 {
+		g.metrics.Set("batch_retention", expvar.Func(func() any { return b.RetentionStats() }))
+	}
+	if cfg.Batch.SendReceipts {
+		g.metrics.Set("send_receipts", expvar.Func(func() any { return b.ReceiptStats() }))
+	}
+	if cfg.Batch.Schedule.MaxDelay > 0 {
+		g.metrics.Set("scheduled_pushes", expvar.Func(func() any { return b.ScheduleStats() }))
+	}
+	if cfg.Batch.Foreground.Window > 0 {
+		g.metrics.Set("foreground", expvar.Func(func() any { return b.ForegroundStats() }))
+	}
+	if g.endpoints != nil {
+		g.metrics.Set("endpoint_health", expvar.Func(func() any { return g.endpoints.Stats() }))
+	}
+	if g.replicator != nil {
+		g.metrics.Set("taken_over_dropped", expvar.Func(func() any { return b.TakenOverDropped() }))
+	}
+	if cfg.Mirror.Standby {
+		if err := g.openStandby(); err != nil {
+			return err
+		}
+	}
+
+	router, groupRouters, err := g.routes()
+	if err != nil {
+		return err
+	}
+	g.router = router
+	g.groupRouters = groupRouters
+	return nil
+}
+
+// routes builds the handlers and the routers serving them: one for
+// server.port, and one for each routes.*.listen address.
+func (g *Gateway) routes() (http.Handler, map[string]http.Handler, error) {
+	cfg := g.cfg
+
+	// Initialize handlers
+	pushHandler := handler.NewPushHandlerWithClient(g.oc, g.batcher)
+	if cfg.Server.JSONAPI {
+		pushHandler.SetCodec(handler.NewCodec(true))
+	}
+	if cfg.Server.PushTiming {
+		pushHandler.SetTiming(true)
+	}
+	if len(cfg.Auth.Chain) > 0 {
+		chain, err := g.authChain()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid auth configuration: %w", err)
+		}
+		pushHandler.SetAuthChain(chain)
+		g.metrics.Set("auth", expvar.Func(func() any { return chain.Stats() }))
+		log.Printf("Authenticating senders with %s", strings.Join(cfg.Auth.Chain, ", then "))
+	}
+	if cfg.Consent.Policy != consent.PolicyList {
+		overrides := make([]consent.Override, len(cfg.Consent.Overrides))
+		for i, o := range cfg.Consent.Overrides {
+			overrides[i] = consent.Override{Recipient: o.Recipient, Sender: o.Sender}
+		}
+		policy, err := consent.New(consent.Config{
+			Policy:          cfg.Consent.Policy,
+			Overrides:       overrides,
+			WebhookURL:      cfg.Consent.Webhook.URL,
+			WebhookTimeout:  cfg.Consent.Webhook.Timeout,
+			WebhookFailOpen: cfg.Consent.Webhook.FailOpen,
+			WebhookSecret:   cfg.Consent.Webhook.Secret,
+			WebhookCacheTTL: cfg.Consent.Webhook.CacheTTL,
+		}, g.oc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid consent configuration: %w", err)
+		}
+		pushHandler.SetConsentPolicy(policy)
+		if cfg.Consent.Policy == consent.PolicyAllowAll {
+			log.Printf("WARNING: consent policy allow_all lets any sender push to any user; use only for development")
+		} else {
+			log.Printf("Consent policy: %s", cfg.Consent.Policy)
+		}
+		if cfg.Consent.Policy == consent.PolicyWebhook && !strings.HasPrefix(cfg.Consent.Webhook.URL, "https://") {
+			log.Printf("WARNING: consent webhook %s isn't HTTPS, so its decisions can be forged in transit", cfg.Consent.Webhook.URL)
+		}
+	}
+	if cfg.Consent.ReplyWindow > 0 {
+		pushHandler.SetReplyGrants(consent.NewReplyGrants(g.store, cfg.Consent.ReplyWindow))
+		log.Printf("Reply grants enabled for %s after each accepted push", cfg.Consent.ReplyWindow)
+	}
+	if len(cfg.Passthrough) > 0 {
+		fields := make([]handler.PassthroughField, len(cfg.Passthrough))
+		for i, f := range cfg.Passthrough {
+			if payloadKey(cfg.Firebase.Payload, f.Name) {
+				return nil, nil, fmt.Errorf("invalid passthrough configuration: field name %q is a payload key", f.Name)
+			}
+			fields[i] = handler.PassthroughField{Name: f.Name, Number: f.Number, Type: f.Type}
+		}
+		passthrough, err := handler.NewPassthrough(fields)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid passthrough configuration: %w", err)
+		}
+		pushHandler.SetPassthrough(passthrough)
+	}
+	if len(cfg.SenderClasses) > 0 {
+		classes := make([]senderclass.Class, len(cfg.SenderClasses))
+		for i, c := range cfg.SenderClasses {
+			classes[i] = senderclass.Class{
+				Name:      c.Name,
+				Senders:   c.Senders,
+				Window:    c.Window,
+				MaxSize:   c.MaxSize,
+				MaxPushes: c.MaxPushes,
+				Per:       c.Per,
+			}
+		}
+		classifier, err := senderclass.New(classes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid sender_classes: %w", err)
+		}
+		pushHandler.SetSenderClasses(classifier)
+		g.senderClasses = classifier
+		g.metrics.Set("sender_classes", expvar.Func(func() any { return classifier.Stats() }))
+	}
+	if cfg.Federation.Enabled {
+		if cfg.Federation.SelfURL == "" {
+			return nil, nil, errors.New("federation.self_url is required when federation is enabled")
+		}
+		if cfg.Federation.Secret == "" {
+			return nil, nil, errors.New("federation.secret is required when federation is enabled")
+		}
+		federation := handler.NewFederation(cfg.Federation.SelfURL, cfg.Federation.Secret, g.oc, cfg.Federation.ForwardTimeout)
+		federation.SetPeerHosts(cfg.Federation.PeerHosts)
+		pushHandler.SetFederation(federation)
+		log.Printf("Federation enabled as %s", cfg.Federation.SelfURL)
+	}
+	if cfg.Firebase.DeviceGroups.Enabled {
+		groups, err := fcm.NewGroupManager(context.Background(), fcm.GroupConfig{
+			CredentialsFile: cfg.Firebase.CredentialsFile,
+			CredentialsJSON: cfg.Firebase.CredentialsJSON,
+			SenderID:        cfg.Firebase.DeviceGroups.SenderID,
+			MinDevices:      cfg.Firebase.DeviceGroups.MinDevices,
+			Transport:       g.firebaseTransport(),
+		}, g.store)
+		if err != nil {
+			return nil, nil, fmt.Errorf("initializing device groups: %w", err)
+		}
+		pushHandler.SetDeviceGroups(groups)
+		log.Printf("Device groups enabled for users with %d or more devices", cfg.Firebase.DeviceGroups.MinDevices)
+	}
+	// Switched on with POST /admin/capture
+	g.capture = handler.NewCaptureBuffer(cfg.Admin.Capture.Size, cfg.Admin.Capture.MaxDuration, cfg.Admin.Capture.File)
+	if cfg.Auth.ClientCert.Header != "" {
+		g.capture.ExcludeHeaders(cfg.Auth.ClientCert.Header)
+	}
+	if cfg.OurCloud.DedupEndpoints {
+		g.duplicates = handler.NewDuplicateTracker(0)
+		pushHandler.SetDuplicateTracker(g.duplicates)
+	}
+	if cfg.Batch.Schedule.MaxDelay > 0 {
+		pushHandler.SetScheduling(cfg.Batch.Schedule.MaxDelay)
+	}
+	if cfg.OurCloud.VerifyContent {
+		blocks, ok := g.oc.(BlockChecker)
+		if !ok {
+			return nil, nil, errors.New("ourcloud.verify_content needs an OurCloud client that can check blocks")
+		}
+		pushHandler.SetContentVerifier(handler.NewContentVerifier(blocks))
+		log.Printf("Verifying pushed data IDs against OurCloud")
+	}
+	if cfg.Abuse.Enabled {
+		abuseDetector := abuse.New(abuse.Config{
+			Window:         cfg.Abuse.Window,
+			MinPushes:      cfg.Abuse.MinPushes,
+			MaxRejectRatio: cfg.Abuse.MaxRejectRatio,
+			BurstWindow:    cfg.Abuse.BurstWindow,
+			MaxBurst:       cfg.Abuse.MaxBurst,
+			Cooldown:       cfg.Abuse.Cooldown,
+		})
+		pushHandler.SetAbuseDetector(abuseDetector)
+		g.abuse = abuseDetector
+		g.metrics.Set("abuse", expvar.Func(func() any { return abuseDetector.Stats() }))
+	}
+	statusHandler := handler.NewStatusHandler(g.batcher)
+	var mirrorHandler *handler.MirrorHandler
+	if g.standby != nil {
+		mirrorHandler = handler.NewMirrorHandler(g.standby)
+	}
+
+	// Middleware, the same on every listener
+	var proxies *handler.TrustedProxies
+	if len(cfg.Server.TrustedProxies) > 0 {
+		var err error
+		proxies, err = handler.NewTrustedProxies(cfg.Server.TrustedProxies)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid server.trusted_proxies: %w", err)
+		}
+	}
+	newRouter := func() chi.Router {
+		r := chi.NewRouter()
+		if proxies != nil {
+			r.Use(proxies.Middleware)
+		}
+		r.Use(middleware.Logger)
+		r.Use(middleware.Recoverer)
+		r.Use(middleware.RequestID)
+		if cfg.Server.Compression {
+			r.Use(middleware.Compress(compressionLevel, "application/json"))
+		}
+		return r
+	}
+	r := newRouter()
+	groupRouters := make(map[string]chi.Router)
+	// group returns the router serving a route group, with its access
+	// rules, named by its config section in errors
+	group := func(name string, rc config.RouteGroup) (chi.Router, error) {
+		access, err := handler.RestrictAccess(rc.AllowFrom, rc.Token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid routes.%s.allow_from: %w", name, err)
+		}
+		gr := chi.Router(r)
+		if rc.Listen != "" {
+			if groupRouters[rc.Listen] == nil {
+				groupRouters[rc.Listen] = newRouter()
+			}
+			gr = groupRouters[rc.Listen]
+		}
+		return gr.With(access), nil
+	}
+	pushRouter, err := group("push", cfg.Routes.Push)
+	if err != nil {
+		return nil, nil, err
+	}
+	statusRouter, err := group("status", cfg.Routes.Status)
+	if err != nil {
+		return nil, nil, err
+	}
+	adminRouter, err := group("admin", cfg.Routes.Admin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Routes
+	r.Get("/health", g.handleHealth)
+	r.Get("/health/history", g.handleHealthHistory)
+	r.Get("/version", g.makeVersionHandler())
+	verifier, canVerify := g.oc.(SignatureVerifier)
+	pushRouter.Group(func(r chi.Router) {
+		r.Use(handler.RequestLimits(cfg.Routes.Push.Timeout, cfg.Routes.Push.MaxBody))
+		if cfg.Server.MaxConcurrentPush > 0 {
+			pushLimiter := handler.NewConcurrencyLimiter(cfg.Server.MaxConcurrentPush, cfg.Server.PushQueueSize, cfg.Server.PushQueueTimeout)
+			g.metrics.Set("push_limiter", expvar.Func(func() any { return pushLimiter.Stats() }))
+			r.With(pushLimiter.Middleware, g.capture.Middleware).Post("/push", pushHandler.HandlePush)
+			// Validations make the same OurCloud lookups as pushes
+			r.With(pushLimiter.Middleware).Post("/validate", pushHandler.HandleValidate)
+		} else {
+			r.With(g.capture.Middleware).Post("/push", pushHandler.HandlePush)
+			r.Post("/validate", pushHandler.HandleValidate)
+		}
+		if canVerify {
+			r.Delete("/push/{request_id}", handler.NewCancelHandler(g.batcher, verifier).HandleCancel)
+		}
+	})
+	statusRouter.Group(func(r chi.Router) {
+		r.Use(handler.RequestLimits(cfg.Routes.Status.Timeout, cfg.Routes.Status.MaxBody))
+		r.Get("/status/{id}", statusHandler.HandleGetStatus)
+		r.Post("/status/batch", statusHandler.HandleBatchStatus)
+		if canVerify {
+			r.Get("/queue/{recipient}", handler.NewQueueHandler(g.batcher, verifier, g.oc).HandleGetQueue)
+			if cfg.Batch.Foreground.Window > 0 {
+				r.Post("/presence/{recipient}/{device_id}", handler.NewPresenceHandler(g.batcher, verifier).HandlePresence)
+			}
+		}
+		if lists, ok := g.oc.(ConsentInspector); ok {
+			r.Get("/consents/{recipient}", handler.NewConsentHandler(lists, cfg.Consent.Policy).HandleGetConsents)
+		}
+	})
+	if mirrorHandler != nil {
+		mirrorAccess, err := handler.RestrictAccess(nil, cfg.Mirror.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		r.Group(func(r chi.Router) {
+			r.Use(mirrorAccess)
+			r.Post("/mirror", mirrorHandler.HandleReceive)
+			r.Get("/mirror/takeovers", mirrorHandler.HandleTakeovers)
+		})
+	}
+
+	if cfg.Admin.Token != "" {
+		adminHandler := handler.NewAdminHandler(g.batcher, cfg.Admin.Token)
+		adminHandler.SetAbuseDetector(g.abuse)
+		adminHandler.SetLabelHasher(g.labels)
+		adminHandler.SetReloader(g)
+		adminHandler.SetCapture(g.capture)
+		if g.endpoints != nil {
+			adminHandler.SetEndpointHealth(g.endpoints)
+		}
+		if g.duplicates != nil {
+			adminHandler.SetDuplicateTracker(g.duplicates)
+		}
+		if g.quota != nil {
+			adminHandler.SetQuota(g.quota)
+		}
+		if g.counters != nil {
+			adminHandler.SetCounters(g.counters)
+		}
+		broadcaster, canBroadcast := g.sender.(Broadcaster)
+		if cfg.Admin.UI {
+			// Outside the token check: the page is static and asks for the
+			// token itself
+			ui := adminui.Handler()
+			adminRouter.Handle(adminui.Prefix, ui)
+			adminRouter.Handle(adminui.Prefix+"/*", ui)
+		}
+		adminRouter.Route("/admin", func(r chi.Router) {
+			r.Use(handler.RequestLimits(cfg.Routes.Admin.Timeout, cfg.Routes.Admin.MaxBody))
+			r.Use(adminHandler.RequireToken)
+			r.Post("/requeue", adminHandler.HandleRequeue)
+			r.Get("/batches", adminHandler.HandleListBatches)
+			r.Get("/batches/export", adminHandler.HandleExportBatches)
+			r.Post("/batches/import", adminHandler.HandleImportBatches)
+			r.Get("/stats", adminHandler.HandleStats)
+			r.Get("/recovery", adminHandler.HandleRecovery)
+			r.Get("/history", adminHandler.HandleHistory)
+			r.Get("/failures", adminHandler.HandleListFailures)
+			r.Get("/status/export", adminHandler.HandleExportStatus)
+			r.Get("/labels/{username}", adminHandler.HandleLabels)
+			if g.endpoints != nil {
+				r.Get("/endpoints/health", adminHandler.HandleEndpointHealth)
+			}
+			if g.duplicates != nil {
+				r.Get("/endpoints/duplicates", adminHandler.HandleListDuplicates)
+			}
+			if g.quota != nil {
+				r.Get("/quota", adminHandler.HandleQuota)
+			}
+			if g.counters != nil {
+				r.Get("/counters", adminHandler.HandleCounters)
+			}
+			if mirrorHandler != nil {
+				r.Post("/mirror/takeover", mirrorHandler.HandleTakeOver)
+			}
+			r.Post("/reload/{component}", adminHandler.HandleReload)
+			r.Get("/capture", adminHandler.HandleCaptureStatus)
+			r.Post("/capture", adminHandler.HandleStartCapture)
+			r.Delete("/capture", adminHandler.HandleStopCapture)
+			r.Get("/capture/requests", adminHandler.HandleExportCaptures)
+			if g.abuse != nil {
+				r.Get("/suspensions", adminHandler.HandleListSuspensions)
+				r.Delete("/suspensions/{sender}", adminHandler.HandleLiftSuspension)
+			}
+			if canBroadcast {
+				broadcastHandler := handler.NewBroadcastHandler(broadcaster, g.store, cfg.Admin.BroadcastTopics)
+				r.Post("/broadcast", broadcastHandler.HandleBroadcast)
+				r.Get("/broadcasts", broadcastHandler.HandleListBroadcasts)
+				r.Post("/topics/{topic}/subscribe", broadcastHandler.HandleSubscribe)
+				r.Post("/topics/{topic}/unsubscribe", broadcastHandler.HandleUnsubscribe)
+			}
+			r.Get("/metrics", g.handleMetrics)
+		})
+	}
+
+	handlers := make(map[string]http.Handler, len(groupRouters))
+	for listen, gr := range groupRouters {
+		handlers[listen] = gr
+	}
+	return r, handlers, nil
+}
+
+// Handler returns the gateway's HTTP handler, for serving it from another
+// server or from httptest. Route groups with routes.*.listen set aren't
+// served by it. Batches pending from a previous run are only recovered by
+// Run.
+func (g *Gateway) Handler() http.Handler {
+	return g.router
+}
+
+// Run recovers batches pending from a previous run, then serves HTTP, on
+// server.port and any routes.*.listen addresses, and gRPC when enabled,
+// until ctx is cancelled, running the hourly status cleanup alongside. On
+// cancellation it shuts the servers down gracefully, waiting up to 30s for
+// in-flight requests. Run returns nil after a graceful shutdown.
+// With batch.recovery_weight set, it serves right away and recovers in the
+// background instead.
+func (g *Gateway) Run(ctx context.Context) error {
+	cfg := g.cfg
+
+	// Recover any pending batches from previous run. During a handoff the
+	// previous process may still be draining; leave it the batches that
+	// aren't due yet and collect any leftovers after handoff_grace.
+	recoverCutoff := time.Time{}
+	if cfg.Server.Handoff {
+		recoverCutoff = time.Now()
+	}
+	// Skip what the standby delivered while this gateway was down, and
+	// follow the outcomes from recovery on
+	var takenOver []string
+	if g.replicator != nil {
+		takenOver = g.suppressTakenOver(ctx)
+		go g.resolveLoop(g.batcher.Events())
+	}
+	if cfg.Batch.RecoveryWeight > 0 {
+		// Serve fresh pushes while the backlog drains
+		go func() {
+			if err := g.batcher.RecoverDue(ctx, recoverCutoff); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("ERROR: recovering batches: %v", err)
+				}
+				return
+			}
+			if g.replicator != nil {
+				g.replicator.Reconciled(takenOver)
+			}
+		}()
+	} else if err := g.batcher.RecoverDue(ctx, recoverCutoff); err != nil {
+		return fmt.Errorf("recovering batches: %w", err)
+	} else if g.replicator != nil {
+		g.replicator.Reconciled(takenOver)
+	}
+
+	ln := g.listener
+	if ln == nil {
+		var err error
+		ln, err = listen(cfg.Server.Port, cfg.Server.Handoff, cfg.Server.TCPKeepAlive)
+		if err != nil {
+			return fmt.Errorf("listening: %w", err)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:      g.router,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+	}
+
+	// Route groups served on their own addresses
+	groupServers := make([]*http.Server, 0, len(g.groupRouters))
+	groupLns := make([]net.Listener, 0, len(g.groupRouters))
+	for listen, h := range g.groupRouters {
+		groupLn := g.groupListeners[listen]
+		if groupLn == nil {
+			var err error
+			groupLn, err = net.Listen("tcp", listen)
+			if err != nil {
+				ln.Close()
+				for _, l := range groupLns {
+					l.Close()
+				}
+				return fmt.Errorf("listening on %s: %w", listen, err)
+			}
+		}
+		groupLns = append(groupLns, groupLn)
+		groupServers = append(groupServers, &http.Server{
+			Addr:         listen,
+			Handler:      h,
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		})
+	}
+
+	grpcLn := g.grpcListener
+	if grpcLn == nil && cfg.GRPC.Port > 0 {
+		var err error
+		grpcLn, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPC.Port))
+		if err != nil {
+			ln.Close()
+			for _, l := range groupLns {
+				l.Close()
+			}
+			return fmt.Errorf("listening for gRPC: %w", err)
+		}
+	}
+
+	serveErr := make(chan error, 2+len(groupServers))
+	go func() {
+		log.Printf("Starting server on %s", ln.Addr())
+		serveErr <- srv.Serve(ln)
+	}()
+	for i, groupSrv := range groupServers {
+		groupLn := groupLns[i]
+		go func() {
+			log.Printf("Starting route group server on %s", groupLn.Addr())
+			serveErr <- groupSrv.Serve(groupLn)
+		}()
+	}
+
+	cleanupStop := make(chan struct{})
+	defer close(cleanupStop)
+	go g.cleanupLoop(cleanupStop)
+	if validator, ok := g.sender.(TokenValidator); ok && cfg.Firebase.TokenSweep.Interval > 0 {
+		go g.sweepLoop(validator, cleanupStop)
+	}
+	if cfg.Batch.Watchdog.Interval > 0 {
+		go g.watchdogLoop(cleanupStop)
+	}
+	// Runs with scheduling disabled too, so pushes scheduled before it was
+	// disabled are still delivered
+	if cfg.Batch.Schedule.Interval > 0 {
+		go g.scheduleLoop(cleanupStop)
+	}
+	if g.backups != nil && cfg.Storage.Backup.Interval > 0 {
+		go g.backupLoop(cleanupStop)
+	}
+	if g.quota != nil {
+		go g.quotaLoop(cleanupStop)
+	}
+	if g.counters != nil {
+		go g.countersLoop(cleanupStop)
+	}
+	if g.publisher != nil {
+		go g.serviceRecordLoop(cleanupStop)
+	}
+	if g.replicator != nil {
+		go g.replicator.Run(cfg.Mirror.Interval, cleanupStop)
+	}
+	if g.standby != nil {
+		go g.standbyLoop(cleanupStop)
+	}
+
+	var grpcSrv *grpc.Server
+	var healthServer *health.Server
+	if grpcLn != nil {
+		grpcSrv, healthServer = g.newGRPCServer()
+	}
+	go g.watchHealth(healthServer, cleanupStop)
+	if grpcLn != nil {
+		go func() {
+			log.Printf("Starting gRPC server on %s", grpcLn.Addr())
+			serveErr <- grpcSrv.Serve(grpcLn)
+		}()
+	}
+
+	// Collect batches a previous process left behind after it has drained
+	if cfg.Server.Handoff {
+		go func() {
+			select {
+			case <-time.After(cfg.Server.HandoffGrace):
+				if err := g.batcher.Recover(context.Background()); err != nil {
+					log.Printf("WARNING: post-handoff recovery failed: %v", err)
+				}
+			case <-cleanupStop:
+			}
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		if grpcSrv != nil {
+			grpcSrv.Stop()
+		}
+		srv.Close()
+		for _, groupSrv := range groupServers {
+			groupSrv.Close()
+		}
+		return fmt.Errorf("server error: %w", err)
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if healthServer != nil {
+		// Report NOT_SERVING so load balancers stop routing here
+		healthServer.Shutdown()
+	}
+	err := srv.Shutdown(shutdownCtx)
+	for _, groupSrv := range groupServers {
+		if groupErr := groupSrv.Shutdown(shutdownCtx); err == nil {
+			err = groupErr
+		}
+	}
+	if grpcSrv != nil {
+		stopGRPC(shutdownCtx, grpcSrv)
+	}
+	if err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+
+	// The successor already ran its startup recovery, so send what's pending now
+	if cfg.Server.Handoff {
+		log.Println("Flushing pending batches for handoff...")
+		g.batcher.FlushPending(shutdownCtx)
+	}
+
+	log.Println("Server stopped")
+	return nil
+}
+
+// openStore opens the SQLite store at storage.path, split into
+// storage.shards files.
+func (g *Gateway) openStore() error {
+	cfg := g.cfg
+	if cfg.Storage.Shards < 1 {
+		return fmt.Errorf("storage.shards must be at least 1, got %d", cfg.Storage.Shards)
+	}
+	if err := store.CheckShards(context.Background(), cfg.Storage.Path, cfg.Storage.Shards); err != nil {
+		return err
+	}
+
+	paths := store.ShardPaths(cfg.Storage.Path, cfg.Storage.Shards)
+	shards := make([]Store, 0, len(paths))
+	var sizes []func() store.StoreMetrics
+	var writes []func() store.CoalescerStats
+	for _, path := range paths {
+		sqliteStore, err := store.New(store.Config{Path: path})
+		if err != nil {
+			for _, shard := range shards {
+				shard.Close()
+			}
+			return err
+		}
+		sizes = append(sizes, sqliteStore.Metrics)
+		var shard Store = sqliteStore
+		if cfg.Storage.WriteInterval > 0 {
+			coalescer := store.NewCoalescingStore(sqliteStore, cfg.Storage.WriteInterval, cfg.Storage.WriteBatchSize)
+			writes = append(writes, coalescer.Stats)
+			shard = coalescer
+		}
+		shards = append(shards, shard)
+	}
+	g.ownStore = true
+
+	if len(shards) == 1 {
+		g.store = shards[0]
+		g.metrics.Set("store", expvar.Func(func() any { return sizes[0]() }))
+		if len(writes) > 0 {
+			g.metrics.Set("store_writes", expvar.Func(func() any { return writes[0]() }))
+		}
+		log.Printf("Initialized store at %s", cfg.Storage.Path)
+		return nil
+	}
+
+	// Sharded metrics are listed in shard order
+	g.store = store.NewShardedStore(shards)
+	g.metrics.Set("store", expvar.Func(func() any {
+		metrics := make([]store.StoreMetrics, len(sizes))
+		for i, m := range sizes {
+			metrics[i] = m()
+		}
+		return metrics
+	}))
+	if len(writes) > 0 {
+		g.metrics.Set("store_writes", expvar.Func(func() any {
+			stats := make([]store.CoalescerStats, len(writes))
+			for i, s := range writes {
+				stats[i] = s()
+			}
+			return stats
+		}))
+	}
+	log.Printf("Initialized store at %s in %d shards", cfg.Storage.Path, len(shards))
+	return nil
+}
+
+// retentionScanLimit caps the batches each hourly cleanup checks against
+// batch.max_retention, oldest first.
+const retentionScanLimit = 1000
+
+// countExpiredStatuses adds the statuses the cleanup deleted, by state, to
+// the statuses_expired metric and returns their total.
+func (g *Gateway) countExpiredStatuses(byState map[string]int64) int64 {
+	var total int64
+	for state, n := range byState {
+		g.expiredStatuses.Add(state, n)
+		total += n
+	}
+	return total
+}
+
+// cleanupLoop expires old statuses, recent sends, reply grants and batches
+// past batch.max_retention and reconciles lost statuses every hour until
+// stop is closed.
+func (g *Gateway) cleanupLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			byState, err := g.store.CleanupExpiredStatusByState(context.Background())
+			if err != nil {
+				log.Printf("WARNING: status cleanup failed: %v", err)
+			} else if deleted := g.countExpiredStatuses(byState); deleted > 0 {
+				log.Printf("Cleaned up %d expired status records", deleted)
+			}
+			deleted, err := g.store.CleanupExpiredRecentSends(context.Background())
+			if err != nil {
+				log.Printf("WARNING: recent sends cleanup failed: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Cleaned up %d expired recent send records", deleted)
+			}
+			deleted, err = g.store.CleanupExpiredReplyGrants(context.Background())
+			if err != nil {
+				log.Printf("WARNING: reply grant cleanup failed: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Cleaned up %d expired reply grants", deleted)
+			}
+			deleted, err = g.store.CleanupExpiredBatchLeases(context.Background())
+			if err != nil {
+				log.Printf("WARNING: batch lease cleanup failed: %v", err)
+			} else if deleted > 0 {
+				log.Printf("Cleaned up %d expired batch leases", deleted)
+			}
+			if g.cfg.Batch.MaxRetention > 0 {
+				purged, err := g.batcher.PurgeUnclaimed(context.Background(), g.cfg.Batch.MaxRetention, retentionScanLimit)
+				if err != nil {
+					log.Printf("WARNING: batch retention purge failed: %v", err)
+				} else if purged > 0 {
+					log.Printf("Purged %d batches undelivered after %s", purged, g.cfg.Batch.MaxRetention)
+				}
+			}
+			lost, err := g.batcher.ReconcileLost(context.Background())
+			if err != nil {
+				log.Printf("WARNING: lost status reconciliation failed: %v", err)
+			} else if lost > 0 {
+				g.lostStatuses.Add(lost)
+				log.Printf("WARNING: marked %d stuck statuses as lost", lost)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweepLoop validates the tokens of pending batches and recent failures
+// every firebase.token_sweep.interval until stop is closed.
+func (g *Gateway) sweepLoop(validator TokenValidator, stop <-chan struct{}) {
+	sweep := g.cfg.Firebase.TokenSweep
+	ticker := time.NewTicker(sweep.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := g.batcher.SweepTokens(context.Background(), validator, sweep.Lookback, sweep.MaxTokens); err != nil {
+				log.Printf("WARNING: token sweep failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// recipientSource reads recipients' endpoint lists from OurCloud for
+// verification at flush time.
+type recipientSource struct {
+	oc OurCloud
+}
+
+func (s recipientSource) RecipientTokens(ctx context.Context, username string) ([]string, error) {
+	list, err := s.oc.GetEndpoints(ctx, username)
+	switch {
+	case errors.Is(err, ourcloud.ErrUserNotFound):
+		return nil, fmt.Errorf("%w: %w", batcher.ErrRecipientGone, err)
+	case errors.Is(err, ourcloud.ErrLabelNotFound):
+		// The account no longer lists any endpoints
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var tokens []string
+	for _, endpoint := range list.GetEndpoints() {
+		if endpoint.GetFcmToken() != "" {
+			tokens = append(tokens, endpoint.GetFcmToken())
+		}
+	}
+	return tokens, nil
+}
+
+// localeSource reads recipients' locale preferences from OurCloud for
+// visible notifications.
+type localeSource struct {
+	oc OurCloud
+}
+
+func (s localeSource) GetLocale(ctx context.Context, username string) (string, error) {
+	locale, err := s.oc.GetLocale(ctx, username)
+	if errors.Is(err, ourcloud.ErrLabelNotFound) || errors.Is(err, ourcloud.ErrUserNotFound) {
+		// No preference published, which the renderer may cache
+		return "", nil
+	}
+	return locale, err
+}
+
+// unreachableKey is the FCM data key naming the device in a notification
+// telling a recipient's other devices that one of theirs seems unreachable.
+const unreachableKey = "device_unreachable"
+
+// notifyUnreachable tells recipient's other devices that the device with
+// fcmToken seems unreachable, so the app can suggest reopening it. The
+// notification carries the device's ID under unreachableKey and no data
+// IDs.
+func (g *Gateway) notifyUnreachable(recipient, fcmToken string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	list, err := g.oc.GetEndpoints(ctx, recipient)
+	if err != nil {
+		log.Printf("WARNING: telling devices %s is unreachable failed: %v", fcmToken, err)
+		return
+	}
+	deviceID := ""
+	for _, endpoint := range list.GetEndpoints() {
+		if endpoint.GetFcmToken() == fcmToken {
+			deviceID = endpoint.GetDeviceId()
+		}
+	}
+	if deviceID == "" {
+		// No longer listed, so there's no device to name
+		return
+	}
+	for _, endpoint := range list.GetEndpoints() {
+		other := endpoint.GetFcmToken()
+		if other == "" || other == fcmToken || !g.endpoints.PausedUntil(other).IsZero() {
+			continue
+		}
+		if _, err := g.batcher.QueueWithOptions(ctx, recipient, other, nil, batcher.QueueOptions{
+			Data:     map[string]string{unreachableKey: deviceID},
+			DeviceID: endpoint.GetDeviceId(),
+		}); err != nil {
+			log.Printf("WARNING: telling %s that %s is unreachable failed: %v", other, deviceID, err)
+		}
+	}
+}
+
+// watchdogLoop flushes batches stuck past their flush time every
+// batch.watchdog.interval until stop is closed.
+func (g *Gateway) watchdogLoop(stop <-chan struct{}) {
+	watchdog := g.cfg.Batch.Watchdog
+	ticker := time.NewTicker(watchdog.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := g.batcher.FlushStuck(context.Background(), watchdog.StuckAfter, watchdog.MaxBatches); err != nil {
+				log.Printf("WARNING: stuck batch scan failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// scheduleLoop queues scheduled pushes that have come due every
+// batch.schedule.interval until stop is closed.
+func (g *Gateway) scheduleLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.cfg.Batch.Schedule.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := g.batcher.ReleaseDue(context.Background()); err != nil {
+				log.Printf("WARNING: releasing scheduled pushes failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// openQuota starts accounting FCM sends per project against the budgets in
+// firebase.quota, resuming today's counts from the store.
+func (g *Gateway) openQuota() error {
+	qc := g.cfg.Firebase.Quota
+	projects := make(map[string]quota.Budget, len(qc.Projects))
+	for projectID, budget := range qc.Projects {
+		projects[projectID] = quota.Budget{Hourly: budget.HourlyBudget, Daily: budget.DailyBudget}
+	}
+	accountant, err := quota.New(context.Background(), g.store, quota.Config{
+		Default:   quota.Budget{Hourly: qc.HourlyBudget, Daily: qc.DailyBudget},
+		Projects:  projects,
+		AlertAt:   qc.AlertAt,
+		HardLimit: qc.HardLimit,
+	})
+	if err != nil {
+		return err
+	}
+	if g.sender != nil {
+		log.Printf("WARNING: firebase.quota only counts sends by the built-in FCM sender")
+	}
+	g.quota = accountant
+	g.metrics.Set("fcm_usage", expvar.Func(func() any { return accountant.Stats() }))
+	return nil
+}
+
+// quotaLoop writes FCM usage counts to the store every
+// firebase.quota.flush_interval until stop is closed.
+func (g *Gateway) quotaLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.cfg.Firebase.Quota.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := g.quota.Flush(context.Background()); err != nil {
+				log.Printf("WARNING: writing FCM usage failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops the batcher and releases the store and OurCloud connection,
+// unless options supplied them. Pending batches stay persisted for the next
+// run.
+func (g *Gateway) Close() error {
+	if g.batcher != nil {
+		g.batcher.Stop()
+	}
+	if g.quota != nil {
+		if err := g.quota.Flush(context.Background()); err != nil {
+			log.Printf("WARNING: writing FCM usage failed: %v", err)
+		}
+	}
+	if g.counters != nil {
+		if err := g.counters.Flush(context.Background()); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	}
+	var err error
+	if g.ownStore && g.store != nil {
+		err = g.store.Close()
+	}
+	if g.ocClient != nil {
+		if closeErr := g.ocClient.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,637 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeOurCloud accepts every signature and consents every sender, and gives
+// each user a single device.
+type fakeOurCloud struct{}
+
+func (fakeOurCloud) VerifyPushRequest(ctx context.Context, req *pb.PushRequest) (bool, error) {
+	return true, nil
+}
+
+func (fakeOurCloud) HasConsent(ctx context.Context, recipientUsername, senderUsername string) (bool, error) {
+	return true, nil
+}
+
+func (fakeOurCloud) GetEndpoints(ctx context.Context, username string) (*pb.PushEndpointList, error) {
+	return &pb.PushEndpointList{Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: username + "-token"}}}, nil
+}
+
+func (fakeOurCloud) GetGatewayAssignments(ctx context.Context, username string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (fakeOurCloud) GetBatchWindow(ctx context.Context, username string) (time.Duration, error) {
+	return 0, nil
+}
+
+func (fakeOurCloud) GetLocale(ctx context.Context, username string) (string, error) {
+	return "", nil
+}
+
+func (fakeOurCloud) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+// recordingSender records the tokens it was asked to deliver to.
+type recordingSender struct {
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (s *recordingSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, fcmToken)
+	return "msg-1", nil
+}
+
+func (s *recordingSender) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.tokens...)
+}
+
+func testConfig(t *testing.T) *Config {
+	cfg := DefaultConfig()
+	cfg.Storage.Path = filepath.Join(t.TempDir(), "push.db")
+	cfg.Batch.Window = 20 * time.Millisecond
+	cfg.Admin.Token = "secret"
+	return cfg
+}
+
+func push(t *testing.T, h http.Handler, target string) *pb.PushResponse {
+	t.Helper()
+	body, err := proto.Marshal(&pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: target,
+		DataIds:        [][]byte{{1}},
+		Signature:      []byte("sig"),
+	})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	var resp pb.PushResponse
+	if err := proto.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	return &resp
+}
+
+func TestGateway_Handler(t *testing.T) {
+	sender := &recordingSender{}
+	g, err := New(testConfig(t), WithOurCloud(fakeOurCloud{}), WithSender(sender))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	resp := push(t, g.Handler(), "bob@oc")
+	if !resp.Accepted {
+		t.Fatalf("push not accepted: %+v", resp)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := sender.sent(); len(got) != 1 || got[0] != "bob@oc-token" {
+		t.Errorf("sent to %v, want [bob@oc-token]", got)
+	}
+
+	// The recording sender can't broadcast, so those endpoints aren't served
+	req := httptest.NewRequest(http.MethodGet, "/admin/broadcasts", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	g.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/broadcasts: status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestGateway_SeveralInProcess(t *testing.T) {
+	// Each gateway keeps its own metrics, so a second one doesn't collide
+	// with the first's
+	for i := 0; i < 2; i++ {
+		g, err := New(testConfig(t), WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{}))
+		if err != nil {
+			t.Fatalf("New() #%d error = %v", i, err)
+		}
+		defer g.Close()
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/metrics", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, req)
+
+		var metrics map[string]json.RawMessage
+		if err := json.NewDecoder(rr.Body).Decode(&metrics); err != nil {
+			t.Fatalf("decode metrics: %v", err)
+		}
+		for _, key := range []string{"queue_drops", "statuses_marked_lost", "memstats"} {
+			if _, ok := metrics[key]; !ok {
+				t.Errorf("metrics missing %q", key)
+			}
+		}
+	}
+}
+
+func TestGateway_Shards(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.Shards = 3
+	sender := &recordingSender{}
+	g, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(sender))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	targets := []string{"a@oc", "b@oc", "c@oc", "d@oc", "e@oc", "f@oc"}
+	var ids []string
+	for _, target := range targets {
+		resp := push(t, g.Handler(), target)
+		if !resp.Accepted {
+			t.Fatalf("push to %s not accepted: %+v", target, resp)
+		}
+		ids = append(ids, resp.RequestId)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := sender.sent(); len(got) != len(targets) {
+		t.Errorf("sent to %v, want every target", got)
+	}
+
+	// Statuses are found whichever shard the token went to
+	for _, id := range ids {
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/status/"+id, nil))
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"state":"sent"`) {
+			t.Errorf("GET /status/%s = %d %s, want sent", id, rr.Code, rr.Body.String())
+		}
+	}
+
+	// A batch left pending stops a gateway with another shard count from
+	// starting and stranding it
+	cfg.Batch.Window = time.Hour
+	g.Close()
+	g, err = New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(sender))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	push(t, g.Handler(), "g@oc")
+	g.Close()
+
+	cfg.Storage.Shards = 2
+	if g, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(sender)); err == nil {
+		g.Close()
+		t.Error("New() with a different shard count succeeded, want error for the pending batch")
+	}
+	for _, path := range store.ShardPaths(cfg.Storage.Path, 3) {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("shard file: %v", err)
+		}
+	}
+}
+
+func TestGateway_Run(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	g, err := New(testConfig(t), WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{}), WithListener(ln))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = http.Get("http://" + ln.Addr().String() + "/health")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /health: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+}
+
+// flakyOurCloud is a fakeOurCloud whose health check fails while down is set.
+type flakyOurCloud struct {
+	fakeOurCloud
+	down atomic.Bool
+}
+
+func (f *flakyOurCloud) HealthCheck(ctx context.Context) error {
+	if f.down.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestGateway_HealthHistory(t *testing.T) {
+	oc := &flakyOurCloud{}
+	g, err := New(testConfig(t), WithOurCloud(oc), WithSender(&recordingSender{}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+	get("/health")
+	oc.down.Store(true)
+	get("/health")
+	get("/health") // still down; not a new event
+	oc.down.Store(false)
+	get("/health")
+
+	rr := get("/health/history")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /health/history: status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var history HealthHistoryResponse
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if len(history.Events) != 2 {
+		t.Fatalf("events = %+v, want degraded then recovered", history.Events)
+	}
+	recovered, degraded := history.Events[0], history.Events[1]
+	if degraded.Check != "ourcloud" || degraded.Status != "degraded" || !strings.Contains(degraded.Error, "connection refused") {
+		t.Errorf("first event = %+v, want ourcloud degraded", degraded)
+	}
+	if recovered.Check != "ourcloud" || recovered.Status != "ok" || recovered.DegradedFor == "" {
+		t.Errorf("latest event = %+v, want ourcloud recovered", recovered)
+	}
+	for _, check := range []string{"ourcloud", "firebase", "store"} {
+		if state := history.Checks[check]; state.Status != "ok" {
+			t.Errorf("%s = %+v, want ok", check, state)
+		}
+	}
+}
+
+func TestGateway_GRPCHealthAndReflection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	g, err := New(testConfig(t), WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{}),
+		WithListener(ln), WithGRPCListener(grpcLn))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+
+	conn, err := grpc.NewClient(grpcLn.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	defer conn.Close()
+
+	// The first health check runs as the server starts
+	var status healthpb.HealthCheckResponse_ServingStatus
+	for i := 0; i < 50; i++ {
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		if err == nil {
+			status = resp.Status
+			if status == healthpb.HealthCheckResponse_SERVING {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("health status = %v, want SERVING", status)
+	}
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatalf("ServerReflectionInfo: %v", err)
+	}
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		t.Fatalf("send reflection request: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("receive reflection response: %v", err)
+	}
+	found := false
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if svc.Name == healthpb.Health_ServiceDesc.ServiceName {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("reflection services = %v, want %s listed", resp.GetListServicesResponse().GetService(), healthpb.Health_ServiceDesc.ServiceName)
+	}
+	stream.CloseSend()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+}
+
+func TestGateway_Compression(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Server.Compression = true
+	g, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/admin/metrics", "gzip")
+	if enc := rr.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	var metrics map[string]json.RawMessage
+	if err := json.NewDecoder(zr).Decode(&metrics); err != nil {
+		t.Fatalf("decode metrics: %v", err)
+	}
+
+	if enc := get("/admin/metrics", "").Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("without Accept-Encoding: Content-Encoding = %q, want none", enc)
+	}
+}
+
+func TestGateway_AdminUI(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Admin.UI = true
+	g, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	// The page itself needs no token
+	rr := get("/admin/ui/")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<title>Push gateway</title>") {
+		t.Errorf("GET /admin/ui/: status = %d, body = %.100q", rr.Code, rr.Body.String())
+	}
+	if rr := get("/admin/ui/app.js"); rr.Code != http.StatusOK {
+		t.Errorf("GET /admin/ui/app.js: status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr := get("/admin/ui"); rr.Code != http.StatusMovedPermanently {
+		t.Errorf("GET /admin/ui: status = %d, want %d", rr.Code, http.StatusMovedPermanently)
+	}
+	// The API it reads still does
+	if rr := get("/admin/failures"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/failures without token: status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGateway_Reload(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Storage.Shards = 2
+	cfg.Storage.WriteInterval = time.Hour
+	sender := &recordingSender{}
+	g, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(sender))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	reload := func(component string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload/"+component+"?confirm="+component, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Reopening the store writes the coalesced batch before it flushes
+	before := push(t, g.Handler(), "a@oc")
+	if got := reload(ReloadStore); got != http.StatusOK {
+		t.Fatalf("reload store: status = %d, want %d", got, http.StatusOK)
+	}
+	after := push(t, g.Handler(), "b@oc")
+	time.Sleep(200 * time.Millisecond)
+	for _, id := range []string{before.RequestId, after.RequestId} {
+		rr := httptest.NewRecorder()
+		g.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/status/"+id, nil))
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"state":"sent"`) {
+			t.Errorf("GET /status/%s = %d %s, want sent", id, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Components supplied by options, or not configured, are left alone
+	for _, component := range []string{ReloadOurCloud, ReloadFCM, ReloadRateLimits} {
+		if got := reload(component); got != http.StatusConflict {
+			t.Errorf("reload %s: status = %d, want %d", component, got, http.StatusConflict)
+		}
+	}
+}
+
+// labelOurCloud is a fakeOurCloud that records the labels written to it.
+type labelOurCloud struct {
+	fakeOurCloud
+	mu     sync.Mutex
+	labels map[string][]byte
+}
+
+func (l *labelOurCloud) WriteLabel(ctx context.Context, account, path string, data []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.labels[account+path] = data
+	return nil
+}
+
+func TestGateway_ServiceRecord(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Federation.SelfURL = "https://push.example.com"
+	cfg.OurCloud.ServiceRecord.Account = "push@oc"
+	cfg.OurCloud.ServiceRecord.KeyFile = filepath.Join(t.TempDir(), "gateway.key")
+
+	if _, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{})); err == nil {
+		t.Fatal("New() with an OurCloud that can't write labels succeeded, want an error")
+	}
+
+	oc := &labelOurCloud{labels: make(map[string][]byte)}
+	g, err := New(cfg, WithOurCloud(oc), WithSender(&recordingSender{}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+	if err := g.publishServiceRecord(context.Background()); err != nil {
+		t.Fatalf("publishServiceRecord() error = %v", err)
+	}
+
+	var record ServiceRecord
+	if err := json.Unmarshal(oc.labels["push@oc"+ServiceRecordLabel], &record); err != nil {
+		t.Fatalf("decoding service record: %v", err)
+	}
+	if record.URL != "https://push.example.com" || !record.Verify() {
+		t.Errorf("service record = %+v, want a signed record for https://push.example.com", record)
+	}
+	record.URL = "https://evil.example.com"
+	if record.Verify() {
+		t.Error("Verify() accepted a modified record")
+	}
+
+	// The key is kept across restarts
+	g2, err := New(cfg, WithOurCloud(oc), WithSender(&recordingSender{}))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g2.Close()
+	if err := g2.publishServiceRecord(context.Background()); err != nil {
+		t.Fatalf("publishServiceRecord() error = %v", err)
+	}
+	var again ServiceRecord
+	json.Unmarshal(oc.labels["push@oc"+ServiceRecordLabel], &again)
+	if !bytes.Equal(again.PublicKey, record.PublicKey) {
+		t.Error("public key changed after restarting with the same key_file")
+	}
+}
+
+func TestGateway_RouteListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	internalLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cfg := testConfig(t)
+	cfg.Routes.Status.Listen = "internal:8081"
+	cfg.Routes.Status.AllowFrom = []string{"127.0.0.0/8"}
+	g, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{}),
+		WithListener(ln), WithRouteListener("internal:8081", internalLn))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer g.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// get returns the status and body of GET path on addr.
+	get := func(addr net.Addr, path string) (int, string) {
+		t.Helper()
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			resp, err = http.Get("http://" + addr.String() + path)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	if code, body := get(internalLn.Addr(), "/status/unknown"); code != http.StatusNotFound || !strings.Contains(body, `"code":"not_found"`) {
+		t.Errorf("GET /status on the status listener = %d %q, want the status handler's 404", code, body)
+	}
+	if code, body := get(ln.Addr(), "/status/unknown"); code != http.StatusNotFound || strings.Contains(body, `"code":"not_found"`) {
+		t.Errorf("GET /status on server.port = %d %q, want no such route", code, body)
+	}
+	if code, _ := get(ln.Addr(), "/health"); code != http.StatusOK {
+		t.Errorf("GET /health on server.port: status = %d, want 200", code)
+	}
+	if code, _ := get(internalLn.Addr(), "/health"); code != http.StatusNotFound {
+		t.Errorf("GET /health on the status listener: status = %d, want 404", code)
+	}
+
+	cfg.Routes.Status.AllowFrom = []string{"internal"}
+	if _, err := New(cfg, WithOurCloud(fakeOurCloud{}), WithSender(&recordingSender{})); err == nil {
+		t.Error("New() with an invalid routes.status.allow_from succeeded, want an error")
+	}
+}
@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+)
+
+// newGRPCServer builds the gRPC server with keepalive enforcement, the
+// standard health service, and server reflection. gRPC API services are
+// registered on the same server.
+func (g *Gateway) newGRPCServer() (*grpc.Server, *health.Server) {
+	ka := g.cfg.GRPC.Keepalive
+	srv := grpc.NewServer(
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             ka.MinTime,
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  ka.Time,
+			Timeout:               ka.Timeout,
+			MaxConnectionAge:      ka.MaxConnectionAge,
+			MaxConnectionAgeGrace: ka.MaxConnectionAgeGrace,
+		}),
+	)
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthServer)
+	reflection.Register(srv)
+	return srv, healthServer
+}
+
+// watchHealth runs the health checks until stop is closed, recording them in
+// the health history and keeping the gRPC health status, if healthServer
+// isn't nil, in line with GET /health.
+func (g *Gateway) watchHealth(healthServer *health.Server, stop <-chan struct{}) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		status := healthpb.HealthCheckResponse_SERVING
+		if _, healthy := g.checkHealth(ctx); !healthy {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		cancel()
+		if healthServer != nil {
+			healthServer.SetServingStatus("", status)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopGRPC stops srv gracefully, cancelling RPCs still running when ctx
+// ends. Health watches stay open until cancelled, so graceful stop alone
+// could wait forever.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
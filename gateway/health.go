@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthInterval is how often the health checks run in the background, for
+// the health history and the gRPC health status.
+const healthInterval = 10 * time.Second
+
+// healthHistorySize bounds the events GET /health/history keeps.
+const healthHistorySize = 200
+
+// Health checks recorded in the history.
+const (
+	healthCheckOurCloud = "ourcloud"
+	healthCheckFirebase = "firebase"
+	healthCheckStore    = "store"
+)
+
+// HealthEvent is a change in one health check's result.
+type HealthEvent struct {
+	Check  string    `json:"check"`  // "ourcloud", "firebase" or "store"
+	Status string    `json:"status"` // "ok" or "degraded"
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+	// DegradedFor is how long the check had failed, when it recovers.
+	DegradedFor string `json:"degraded_for,omitempty"`
+}
+
+// HealthCheckState is one health check's current result.
+type HealthCheckState struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	Since  time.Time `json:"since"` // when it last changed
+}
+
+// HealthHistoryResponse represents the JSON response from the health history
+// endpoint.
+type HealthHistoryResponse struct {
+	Checks map[string]HealthCheckState `json:"checks"`
+	Events []HealthEvent               `json:"events"` // newest first
+}
+
+// healthHistory records when health checks start and stop failing, so
+// operators can see when a degradation began without searching the logs.
+type healthHistory struct {
+	mu     sync.Mutex
+	checks map[string]HealthCheckState
+	events []HealthEvent // oldest first, at most healthHistorySize
+}
+
+func newHealthHistory() *healthHistory {
+	return &healthHistory{checks: make(map[string]HealthCheckState)}
+}
+
+// record notes check's result at at; errMsg is empty if it passed. Only
+// changes from the previous result become events.
+func (h *healthHistory) record(check, errMsg string, at time.Time) {
+	status := "ok"
+	if errMsg != "" {
+		status = "degraded"
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	prev, seen := h.checks[check]
+	if seen && prev.Status == status {
+		return
+	}
+	h.checks[check] = HealthCheckState{Status: status, Error: errMsg, Since: at}
+
+	// A check passing from the start isn't news
+	if !seen && status == "ok" {
+		return
+	}
+	event := HealthEvent{Check: check, Status: status, Error: errMsg, At: at}
+	if seen && status == "ok" {
+		event.DegradedFor = at.Sub(prev.Since).Round(time.Second).String()
+	}
+	if len(h.events) == healthHistorySize {
+		h.events = append(h.events[:0], h.events[1:]...)
+	}
+	h.events = append(h.events, event)
+}
+
+// observe records the results of a health check made now.
+func (h *healthHistory) observe(resp HealthResponse) {
+	at := time.Now()
+	for check, result := range map[string]string{
+		healthCheckOurCloud: resp.OurCloud,
+		healthCheckFirebase: resp.Firebase,
+		healthCheckStore:    resp.Store,
+	} {
+		errMsg := ""
+		if result != "ok" {
+			errMsg = result
+		}
+		h.record(check, errMsg, at)
+	}
+}
+
+// snapshot returns the current results and the events, newest first.
+func (h *healthHistory) snapshot() HealthHistoryResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	resp := HealthHistoryResponse{
+		Checks: make(map[string]HealthCheckState, len(h.checks)),
+		Events: make([]HealthEvent, 0, len(h.events)),
+	}
+	for check, state := range h.checks {
+		resp.Checks[check] = state
+	}
+	for i := len(h.events) - 1; i >= 0; i-- {
+		resp.Events = append(resp.Events, h.events[i])
+	}
+	return resp
+}
+
+func (g *Gateway) handleHealthHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g.health.snapshot())
+}
@@ -0,0 +1,288 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// HealthResponse represents the JSON response from the health endpoint.
+type HealthResponse struct {
+	Status    string `json:"status"`
+	OurCloud  string `json:"ourcloud,omitempty"`
+	Firebase  string `json:"firebase,omitempty"`
+	Store     string `json:"store,omitempty"`
+	Timestamp int64  `json:"timestamp"` // Unix timestamp (seconds) of the check
+}
+
+// VersionResponse represents the JSON response from the version endpoint.
+type VersionResponse struct {
+	Commit        string   `json:"commit"`
+	BuildTime     string   `json:"build_time"`
+	GoVersion     string   `json:"go_version"`
+	UptimeSeconds int64    `json:"uptime_seconds"`
+	ConfigHash    string   `json:"config_hash"`
+	Providers     []string `json:"providers"`
+	StoreDriver   string   `json:"store_driver"`
+	Features      []string `json:"features"`
+}
+
+// enabledFeatures lists optional behaviors switched on by the configuration.
+func enabledFeatures(cfg *Config) []string {
+	features := []string{}
+	if cfg.Batch.DedupWindow > 0 {
+		features = append(features, "dedup")
+	}
+	if cfg.Batch.FlushConcurrency > 0 {
+		features = append(features, "flush_concurrency")
+	}
+	if cfg.Batch.RecoveryWeight > 0 {
+		features = append(features, "background_recovery")
+	}
+	if cfg.Firebase.QPS > 0 {
+		features = append(features, "rate_limit")
+	}
+	if cfg.Server.MaxConcurrentPush > 0 {
+		features = append(features, "push_concurrency_limit")
+	}
+	if cfg.Visible.Enabled {
+		features = append(features, "visible_notifications")
+	}
+	if cfg.Firebase.AnalyticsLabels {
+		features = append(features, "analytics_labels")
+	}
+	if cfg.Firebase.Provenance {
+		features = append(features, "provenance")
+	}
+	if cfg.Firebase.EncryptPayload {
+		features = append(features, "encrypt_payload")
+	}
+	if len(cfg.Firebase.Payload.Versions) > 0 {
+		features = append(features, "payload_versions")
+	}
+	if cfg.Firebase.DeviceGroups.Enabled {
+		features = append(features, "device_groups")
+	}
+	if cfg.Firebase.TokenSweep.Interval > 0 {
+		features = append(features, "token_sweep")
+	}
+	if cfg.Firebase.TokenPreflight.Enabled {
+		features = append(features, "token_preflight")
+	}
+	if cfg.Consent.ReplyWindow > 0 {
+		features = append(features, "reply_grants")
+	}
+	if cfg.Firebase.Quota.Enabled {
+		features = append(features, "fcm_quota")
+	}
+	if len(cfg.Auth.Chain) > 0 {
+		features = append(features, "auth_chain")
+	}
+	if cfg.Admin.Counters.Enabled {
+		features = append(features, "persistent_counters")
+	}
+	if cfg.Batch.LeaseTTL > 0 {
+		features = append(features, "batch_leases")
+	}
+	if cfg.Batch.Watchdog.Interval > 0 {
+		features = append(features, "batch_watchdog")
+	}
+	if cfg.Batch.MaxRetention > 0 {
+		features = append(features, "batch_retention")
+	}
+	if cfg.Batch.SendReceipts {
+		features = append(features, "send_receipts")
+	}
+	if cfg.Batch.Schedule.MaxDelay > 0 {
+		features = append(features, "scheduled_push")
+	}
+	if cfg.Batch.Foreground.Window > 0 {
+		features = append(features, "foreground_window")
+	}
+	if cfg.Storage.Backup.URL != "" {
+		features = append(features, "store_backups")
+	}
+	if cfg.Batch.EndpointHealth.Enabled {
+		features = append(features, "endpoint_health")
+	}
+	if cfg.OurCloud.DedupEndpoints {
+		features = append(features, "dedup_endpoints")
+	}
+	if len(cfg.SenderClasses) > 0 {
+		features = append(features, "sender_classes")
+	}
+	if cfg.Privacy.Enabled {
+		features = append(features, "privacy")
+	}
+	if cfg.Log.Privacy != "full" {
+		features = append(features, "log_privacy_"+cfg.Log.Privacy)
+	}
+	if cfg.Federation.Enabled {
+		features = append(features, "federation")
+	}
+	if cfg.Mirror.StandbyURL != "" {
+		features = append(features, "mirror")
+	}
+	if cfg.Mirror.Standby {
+		features = append(features, "mirror_standby")
+	}
+	if cfg.Storage.WriteInterval > 0 {
+		features = append(features, "write_coalescing")
+	}
+	if cfg.Storage.Shards > 1 {
+		features = append(features, "store_shards")
+	}
+	if cfg.Server.Handoff {
+		features = append(features, "handoff")
+	}
+	if cfg.Batch.RecipientWindows {
+		features = append(features, "recipient_windows")
+	}
+	if cfg.Batch.AdaptiveWindow {
+		features = append(features, "adaptive_window")
+	}
+	if len(cfg.Passthrough) > 0 {
+		features = append(features, "passthrough")
+	}
+	if len(cfg.Server.TrustedProxies) > 0 {
+		features = append(features, "trusted_proxies")
+	}
+	if cfg.Proxy.URL != "" {
+		features = append(features, "proxy")
+	}
+	if cfg.Server.JSONAPI {
+		features = append(features, "json_api")
+	}
+	if cfg.Server.PushTiming {
+		features = append(features, "push_timing")
+	}
+	if cfg.OurCloud.VerifyContent {
+		features = append(features, "verify_content")
+	}
+	if cfg.OurCloud.ServiceRecord.Account != "" {
+		features = append(features, "service_record")
+	}
+	if cfg.OurCloud.VerifyRecipients {
+		features = append(features, "verify_recipients")
+	}
+	if cfg.Server.Compression {
+		features = append(features, "compression")
+	}
+	if cfg.Abuse.Enabled {
+		features = append(features, "abuse_detection")
+	}
+	if cfg.GRPC.Port > 0 {
+		features = append(features, "grpc")
+	}
+	if cfg.Storage.FailurePolicy == "reject" {
+		features = append(features, "store_failure_reject")
+	}
+	if cfg.DND.Enabled {
+		features = append(features, "dnd_"+cfg.DND.Policy)
+	}
+	if cfg.Consent.Policy != "list" {
+		features = append(features, "consent_"+cfg.Consent.Policy)
+	}
+	if len(cfg.OurCloud.Nodes) > 1 {
+		features = append(features, "ourcloud_multi_node")
+	}
+	if cfg.Admin.Token != "" {
+		features = append(features, "admin")
+		if cfg.Admin.UI {
+			features = append(features, "admin_ui")
+		}
+	}
+	return features
+}
+
+func (g *Gateway) makeVersionHandler() http.HandlerFunc {
+	features := enabledFeatures(g.cfg)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(VersionResponse{
+			Commit:        g.commit,
+			BuildTime:     g.buildTime,
+			GoVersion:     runtime.Version(),
+			UptimeSeconds: int64(time.Since(g.startTime).Seconds()),
+			ConfigHash:    g.cfg.Hash,
+			Providers:     []string{"fcm"},
+			StoreDriver:   "sqlite3",
+			Features:      features,
+		})
+	}
+}
+
+func (g *Gateway) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp, healthy := g.checkHealth(ctx)
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkHealth checks the gateway's dependencies, reporting whether all of
+// them are usable.
+func (g *Gateway) checkHealth(ctx context.Context) (HealthResponse, bool) {
+	resp := HealthResponse{
+		Status:    "ok",
+		OurCloud:  "ok",
+		Firebase:  "ok",
+		Store:     "ok",
+		Timestamp: time.Now().Unix(),
+	}
+
+	healthy := true
+
+	// Check OurCloud connectivity
+	if err := g.oc.HealthCheck(ctx); err != nil {
+		resp.OurCloud = fmt.Sprintf("error: %v", err)
+		healthy = false
+	}
+
+	// Check Firebase client initialization
+	if g.sender == nil {
+		resp.Firebase = "not initialized"
+		healthy = false
+	}
+
+	// Check that batches are being persisted
+	if store := g.batcher.StoreHealth(); !store.Healthy {
+		resp.Store = fmt.Sprintf("error since %s (%s): %s", store.Since.UTC().Format(time.RFC3339), store.Policy, store.Error)
+		healthy = false
+	}
+
+	if !healthy {
+		resp.Status = "degraded"
+	}
+	g.health.observe(resp)
+	return resp, healthy
+}
+
+// handleMetrics serves the process-wide expvar variables, like
+// expvar.Handler, plus this gateway's own counters. The gateway's counters
+// aren't published globally, so several gateways can run in one process.
+func (g *Gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	g.metrics.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(vars)
+}
@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdListenFD is the first file descriptor systemd passes to a
+// socket-activated service.
+const systemdListenFD = 3
+
+// listen returns the HTTP listener. A socket passed by systemd socket
+// activation is used when present. Otherwise the port is bound, with
+// SO_REUSEPORT when reusePort is set so a successor process can bind it
+// while this one drains. keepAlive sets the TCP keep-alive interval of
+// accepted connections, as in net.ListenConfig; a systemd socket keeps its
+// own settings.
+func listen(port int, reusePort bool, keepAlive time.Duration) (net.Listener, error) {
+	if ln, err := systemdListener(); ln != nil || err != nil {
+		return ln, err
+	}
+
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	if reusePort {
+		lc.Control = setReusePort
+	}
+	return lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", port))
+}
+
+// systemdListener returns the first socket passed by systemd, or nil if the
+// process wasn't socket-activated.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdListenFD, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("using systemd socket: %w", err)
+	}
+	return ln, nil
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/mirror"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// openReplicator sets up mirroring of accepted pushes to
+// mirror.standby_url.
+func (g *Gateway) openReplicator() {
+	cfg := g.cfg
+	var transport http.RoundTripper
+	if g.egress != nil {
+		transport = g.egress.Transport()
+	}
+	g.replicator = mirror.NewReplicator(mirror.Config{
+		URL:       cfg.Mirror.StandbyURL,
+		Token:     cfg.Mirror.Token,
+		Buffer:    cfg.Mirror.Buffer,
+		Timeout:   cfg.Mirror.Timeout,
+		Transport: transport,
+		DropTakenOver: func(ctx context.Context, requestIDs []string) {
+			if n := g.batcher.DropTakenOver(ctx, requestIDs); n > 0 {
+				log.Printf("WARNING: the standby gateway took over %d pushes still pending here; dropped them", n)
+			}
+		},
+	})
+	g.metrics.Set("mirror", expvar.Func(func() any { return g.replicator.Stats() }))
+	log.Printf("Mirroring accepted pushes to standby %s every %s", cfg.Mirror.StandbyURL, cfg.Mirror.Interval)
+}
+
+// mirrorNotification is the batcher's Config.Mirror, holding an accepted
+// notification for the next send to the standby.
+func (g *Gateway) mirrorNotification(recipient, fcmToken string, notif store.QueuedNotification) {
+	g.replicator.Mirror(mirror.Notification{FCMToken: fcmToken, Recipient: recipient, Notification: notif})
+}
+
+// openStandby sets up holding the pushes a primary gateway mirrors here.
+func (g *Gateway) openStandby() error {
+	cfg := g.cfg
+	if cfg.Mirror.Token == "" {
+		return errors.New("mirror.standby needs mirror.token, or anyone who can reach POST /mirror could queue pushes here")
+	}
+	g.standby = mirror.NewStandby(g.store, g.batcher, mirror.StandbyConfig{
+		TakeoverAfter:   cfg.Mirror.TakeoverAfter,
+		Retention:       cfg.Mirror.Retention,
+		StatusRetention: cfg.Status.Retention,
+	})
+	g.metrics.Set("mirror_standby", expvar.Func(func() any { return g.standby.Stats() }))
+	if cfg.Mirror.TakeoverAfter > 0 {
+		log.Printf("Standby for a primary gateway, taking over after %s of silence", cfg.Mirror.TakeoverAfter)
+	} else {
+		log.Printf("Standby for a primary gateway, taking over with POST /admin/mirror/takeover")
+	}
+	return nil
+}
+
+// suppressTakenOver asks the standby which pushes it delivered while this
+// gateway was down, so recovery doesn't send them again. Returns their
+// request IDs, to reconcile once recovery is done. Failing to reach the
+// standby isn't fatal: it may be the one that's down.
+func (g *Gateway) suppressTakenOver(ctx context.Context) []string {
+	ctx, cancel := context.WithTimeout(ctx, g.cfg.Mirror.Timeout)
+	defer cancel()
+	ids, err := g.replicator.Takeovers(ctx)
+	if err != nil {
+		log.Printf("WARNING: couldn't ask the standby gateway for takeovers; recovering every batch: %v", err)
+		return nil
+	}
+	if len(ids) > 0 {
+		log.Printf("INFO: the standby gateway delivered %d pushes while this one was down; skipping them", len(ids))
+		g.batcher.SuppressTakenOver(ids)
+	}
+	return ids
+}
+
+// resolveLoop tells the standby about the pushes delivered or given up on,
+// from the batcher's events, until they end. Events missed because the
+// channel was full leave their pushes with the standby until
+// mirror.retention, to be sent again if it takes over before then.
+func (g *Gateway) resolveLoop(events <-chan batcher.Event) {
+	for e := range events {
+		switch e.Type {
+		case batcher.EventFlushed, batcher.EventDropped:
+		case batcher.EventFlushFailed:
+			if e.Retry {
+				continue
+			}
+		default:
+			continue
+		}
+		if len(e.RequestIDs) > 0 {
+			g.replicator.Resolve(e.RequestIDs)
+		}
+	}
+}
+
+// standbyLoop takes over from a silent primary, and removes mirrored pushes
+// past mirror.retention, every mirror.interval until stop is closed.
+func (g *Gateway) standbyLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.cfg.Mirror.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			if _, err := g.standby.Check(context.Background(), now); err != nil {
+				log.Printf("ERROR: taking over from the primary gateway: %v", err)
+			}
+			if _, err := g.standby.Cleanup(context.Background(), now); err != nil {
+				log.Printf("ERROR: removing expired mirrored pushes: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package gateway
+
+import "net"
+
+// Option overrides a component New would otherwise build from the Config.
+type Option func(*Gateway)
+
+// WithOurCloud uses oc instead of connecting to the OurCloud nodes in the
+// Config. The caller owns oc; Close leaves it open.
+func WithOurCloud(oc OurCloud) Option {
+	return func(g *Gateway) {
+		g.oc = oc
+	}
+}
+
+// WithStore uses s instead of opening the SQLite store at storage.path.
+// The caller owns s; Close leaves it open.
+func WithStore(s Store) Option {
+	return func(g *Gateway) {
+		g.store = s
+	}
+}
+
+// WithSender delivers through s instead of Firebase. The broadcast endpoints
+// are only served if s also implements Broadcaster.
+func WithSender(s Sender) Option {
+	return func(g *Gateway) {
+		g.sender = s
+	}
+}
+
+// WithListener makes Run serve on ln instead of binding server.port.
+// Run closes ln when it returns.
+func WithListener(ln net.Listener) Option {
+	return func(g *Gateway) {
+		g.listener = ln
+	}
+}
+
+// WithRouteListener makes Run serve the route groups whose routes.*.listen
+// is listen on ln instead of binding that address. Run closes ln when it
+// returns.
+func WithRouteListener(listen string, ln net.Listener) Option {
+	return func(g *Gateway) {
+		if g.groupListeners == nil {
+			g.groupListeners = make(map[string]net.Listener)
+		}
+		g.groupListeners[listen] = ln
+	}
+}
+
+// WithGRPCListener makes Run serve gRPC on ln instead of binding grpc.port,
+// enabling the gRPC listener even when grpc.port is unset. Run closes ln
+// when it returns.
+func WithGRPCListener(ln net.Listener) Option {
+	return func(g *Gateway) {
+		g.grpcListener = ln
+	}
+}
+
+// WithBuildInfo sets the commit and build time reported by GET /version.
+func WithBuildInfo(commit, buildTime string) Option {
+	return func(g *Gateway) {
+		g.commit = commit
+		g.buildTime = buildTime
+	}
+}
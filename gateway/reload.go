@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/handler"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// Components Reload restarts.
+const (
+	ReloadOurCloud   = handler.ComponentOurCloud
+	ReloadStore      = handler.ComponentStore
+	ReloadFCM        = handler.ComponentFCM
+	ReloadRateLimits = handler.ComponentRateLimits
+)
+
+// ErrNotReloadable is returned by Reload for a component the gateway can't
+// restart, such as one an Option supplied.
+var ErrNotReloadable = handler.ErrNotReloadable
+
+// reloadTimeout bounds how long Reload waits for OurCloud to answer before
+// leaving the client reconnecting in the background.
+const reloadTimeout = 30 * time.Second
+
+// reconnecter is a Sender that can rebuild its FCM client. *fcm.Sender
+// implements it.
+type reconnecter interface {
+	Reconnect(ctx context.Context) error
+}
+
+// Reload restarts one component in place, without restarting the process:
+//
+//   - ReloadOurCloud closes the OurCloud connections and connects afresh.
+//     If no node answers within 30s, the client keeps reconnecting in the
+//     background, as with ourcloud.lazy_connect.
+//   - ReloadStore writes any coalesced batches and reopens the database,
+//     e.g. after it was vacuumed or restored from a backup.
+//   - ReloadFCM rebuilds the FCM client, rereading the credentials.
+//   - ReloadRateLimits refills every sender's push allowance, for sender
+//     classes and abuse detection. Suspensions stay in place.
+//
+// Requests using a component wait or fail while it restarts. Reloads run
+// one at a time.
+func (g *Gateway) Reload(ctx context.Context, component string) error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	switch component {
+	case ReloadOurCloud:
+		return g.reloadOurCloud(ctx)
+	case ReloadStore:
+		s, ok := g.store.(store.Reopener)
+		if !ok {
+			return fmt.Errorf("%w: the store can't be reopened", ErrNotReloadable)
+		}
+		return s.Reopen(ctx)
+	case ReloadFCM:
+		s, ok := g.sender.(reconnecter)
+		if !ok {
+			return fmt.Errorf("%w: the sender has no FCM client to rebuild", ErrNotReloadable)
+		}
+		return s.Reconnect(ctx)
+	case ReloadRateLimits:
+		if g.abuse == nil && g.senderClasses == nil {
+			return fmt.Errorf("%w: neither abuse detection nor sender class limits are enabled", ErrNotReloadable)
+		}
+		g.abuse.Reset()
+		g.senderClasses.Reset()
+		return nil
+	}
+	return fmt.Errorf("%w: unknown component %q", ErrNotReloadable, component)
+}
+
+// reloadOurCloud closes the OurCloud client's connections and reconnects.
+func (g *Gateway) reloadOurCloud(ctx context.Context) error {
+	if g.ocClient == nil {
+		return fmt.Errorf("%w: the OurCloud client was supplied by WithOurCloud", ErrNotReloadable)
+	}
+	if err := g.ocClient.Close(); err != nil {
+		log.Printf("WARNING: closing OurCloud connections for reload: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, reloadTimeout)
+	defer cancel()
+	if err := g.ocClient.WaitReady(ctx); err != nil {
+		g.health.record(healthCheckOurCloud, fmt.Sprintf("error: %v", err), time.Now())
+		g.ocClient.ConnectInBackground(g.ourCloudConnected)
+		return fmt.Errorf("reconnecting to OurCloud, still retrying in the background: %w", err)
+	}
+	g.ourCloudConnected()
+	return nil
+}
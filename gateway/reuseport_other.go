@@ -0,0 +1,13 @@
+//go:build !unix
+
+package gateway
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setReusePort fails: SO_REUSEPORT isn't supported on this platform.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ServiceRecordLabel is the label, under the account in
+// ourcloud.service_record.account, that holds the gateway's ServiceRecord.
+const ServiceRecordLabel = "/platform/push/gateway"
+
+// LabelWriter writes labels owned by an OurCloud account. An OurCloud that
+// implements it enables ourcloud.service_record.
+type LabelWriter interface {
+	WriteLabel(ctx context.Context, account, path string, data []byte) error
+}
+
+// ServiceRecord is what the gateway publishes about itself, as JSON, for
+// apps to discover it instead of having its URL built in. Signature is the
+// gateway's ed25519 signature of the record's JSON encoding without it.
+type ServiceRecord struct {
+	URL       string   `json:"url"`
+	PublicKey []byte   `json:"public_key"`
+	Features  []string `json:"features"`
+	Version   string   `json:"version"`
+	UpdatedAt int64    `json:"updated_at"` // Unix timestamp (seconds)
+	Signature []byte   `json:"signature,omitempty"`
+}
+
+// Verify reports whether the record is signed by its public key.
+func (r ServiceRecord) Verify() bool {
+	if len(r.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	unsigned := r
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(r.PublicKey, data, r.Signature)
+}
+
+// servicePublisher publishes the gateway's service record.
+type servicePublisher struct {
+	writer  LabelWriter
+	account string
+	key     ed25519.PrivateKey
+
+	mu            sync.Mutex
+	published     int64
+	failures      int64
+	lastPublished time.Time
+	lastError     string
+}
+
+// openServiceRecord sets up publishing the gateway's service record under
+// ourcloud.service_record.account.
+func (g *Gateway) openServiceRecord() error {
+	rc := g.cfg.OurCloud.ServiceRecord
+	writer, ok := g.oc.(LabelWriter)
+	if !ok {
+		return errors.New("ourcloud.service_record needs an OurCloud client that can write labels")
+	}
+	if rc.URL == "" && g.cfg.Federation.SelfURL == "" {
+		return errors.New("ourcloud.service_record needs url or federation.self_url")
+	}
+	key, err := loadServiceKey(rc.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading ourcloud.service_record.key_file: %w", err)
+	}
+	g.publisher = &servicePublisher{writer: writer, account: rc.Account, key: key}
+	g.metrics.Set("service_record", expvar.Func(func() any { return g.publisher.stats() }))
+	return nil
+}
+
+// loadServiceKey reads the ed25519 key in path, generating and saving one
+// if the file doesn't exist.
+func loadServiceKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated a service record key in %s", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s holds no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s holds a %T, not an ed25519 key", path, parsed)
+	}
+	return key, nil
+}
+
+// serviceRecord builds and signs the gateway's current service record.
+func (g *Gateway) serviceRecord(now time.Time) (ServiceRecord, error) {
+	url := g.cfg.OurCloud.ServiceRecord.URL
+	if url == "" {
+		url = g.cfg.Federation.SelfURL
+	}
+	record := ServiceRecord{
+		URL:       url,
+		PublicKey: g.publisher.key.Public().(ed25519.PublicKey),
+		Features:  enabledFeatures(g.cfg),
+		Version:   g.commit,
+		UpdatedAt: now.Unix(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return ServiceRecord{}, err
+	}
+	record.Signature = ed25519.Sign(g.publisher.key, data)
+	return record, nil
+}
+
+// publishServiceRecord writes the gateway's service record to OurCloud.
+func (g *Gateway) publishServiceRecord(ctx context.Context) error {
+	p := g.publisher
+	record, err := g.serviceRecord(time.Now())
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(record); err == nil {
+			err = p.writer.WriteLabel(ctx, p.account, ServiceRecordLabel, data)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.failures++
+		p.lastError = err.Error()
+		return fmt.Errorf("publishing service record for %s: %w", p.account, err)
+	}
+	p.published++
+	p.lastPublished = time.Now()
+	p.lastError = ""
+	return nil
+}
+
+// stats returns the counts reported in the "service_record" metric.
+func (p *servicePublisher) stats() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := map[string]any{
+		"account":    p.account,
+		"published":  p.published,
+		"failures":   p.failures,
+		"last_error": p.lastError,
+	}
+	if !p.lastPublished.IsZero() {
+		stats["last_published"] = p.lastPublished.Unix()
+	}
+	return stats
+}
+
+// serviceRecordLoop publishes the service record at startup and again
+// every ourcloud.service_record.refresh until stop is closed.
+func (g *Gateway) serviceRecordLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.cfg.OurCloud.ServiceRecord.Refresh)
+	defer ticker.Stop()
+	for {
+		if err := g.publishServiceRecord(context.Background()); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
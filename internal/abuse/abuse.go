@@ -0,0 +1,317 @@
+// Package abuse detects senders misusing the gateway and suspends them.
+//
+// A sender is suspended for a cooldown when too many of its pushes are
+// rejected (typically pushing to users who never consented), or when it
+// sends a burst of pushes far above normal use.
+package abuse
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Suspension reasons.
+const (
+	ReasonRejectRatio = "reject_ratio"
+	ReasonBurst       = "burst"
+)
+
+// Config sets the detection thresholds. Zero values take the defaults below.
+type Config struct {
+	// Window is the sliding window over which rejections are counted.
+	// Defaults to 10m.
+	Window time.Duration
+	// MinPushes is how many pushes a sender must make within Window before
+	// its rejection ratio is judged, so a few early failures don't count.
+	// Defaults to 20.
+	MinPushes int
+	// MaxRejectRatio is the fraction of rejected pushes within Window above
+	// which a sender is suspended. Defaults to 0.5.
+	MaxRejectRatio float64
+	// BurstWindow and MaxBurst suspend a sender making more than MaxBurst
+	// pushes within BurstWindow. Default to 10s and 200.
+	BurstWindow time.Duration
+	MaxBurst    int
+	// Cooldown is how long a suspension lasts. Defaults to 15m.
+	Cooldown time.Duration
+}
+
+func (c *Config) setDefaults() {
+	if c.Window == 0 {
+		c.Window = 10 * time.Minute
+	}
+	if c.MinPushes == 0 {
+		c.MinPushes = 20
+	}
+	if c.MaxRejectRatio == 0 {
+		c.MaxRejectRatio = 0.5
+	}
+	if c.BurstWindow == 0 {
+		c.BurstWindow = 10 * time.Second
+	}
+	if c.MaxBurst == 0 {
+		c.MaxBurst = 200
+	}
+	if c.Cooldown == 0 {
+		c.Cooldown = 15 * time.Minute
+	}
+}
+
+// Suspension describes a suspended sender.
+type Suspension struct {
+	Sender string    `json:"sender"`
+	Reason string    `json:"reason"`
+	Detail string    `json:"detail"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// Stats summarizes the detector's state.
+type Stats struct {
+	TrackedSenders   int    `json:"tracked_senders"`
+	SuspendedSenders int    `json:"suspended_senders"`
+	Suspensions      uint64 `json:"suspensions"` // Total since startup
+}
+
+// Quota is a sender's remaining burst allowance, for well-behaved senders to
+// throttle themselves before being suspended.
+type Quota struct {
+	Limit     int       `json:"limit"`     // pushes allowed within BurstWindow
+	Remaining int       `json:"remaining"` // pushes the sender can make now
+	Reset     time.Time `json:"reset"`     // when Remaining is back to Limit, or the suspension ends
+}
+
+// counts is the number of pushes and rejections in one window.
+type counts struct {
+	pushes   int
+	rejected int
+}
+
+// senderStats tracks one sender. Rejections are counted with a sliding
+// window approximated from the current and previous fixed windows.
+type senderStats struct {
+	windowStart time.Time
+	current     counts
+	previous    counts
+	burst       *rate.Limiter
+	lastSeen    time.Time
+}
+
+// Detector tracks per-sender push outcomes and suspends abusive senders.
+// A nil *Detector never suspends anyone.
+type Detector struct {
+	cfg Config
+	now func() time.Time
+
+	mu          sync.Mutex
+	senders     map[string]*senderStats
+	suspended   map[string]Suspension
+	suspensions uint64
+	lastPrune   time.Time
+}
+
+// New creates a Detector.
+func New(cfg Config) *Detector {
+	cfg.setDefaults()
+	return &Detector{
+		cfg:       cfg,
+		now:       time.Now,
+		senders:   make(map[string]*senderStats),
+		suspended: make(map[string]Suspension),
+	}
+}
+
+// Suspended returns sender's suspension, if it is currently suspended.
+func (d *Detector) Suspended(sender string) (Suspension, bool) {
+	if d == nil {
+		return Suspension{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.suspended[sender]
+	if !ok {
+		return Suspension{}, false
+	}
+	if !d.now().Before(s.Until) {
+		delete(d.suspended, sender)
+		return Suspension{}, false
+	}
+	return s, true
+}
+
+// Record counts a push from sender, rejected or not, and suspends the sender
+// if it crosses a threshold. Returns true if this push caused a suspension.
+func (d *Detector) Record(sender string, rejected bool) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	d.prune(now)
+
+	st, ok := d.senders[sender]
+	if !ok {
+		st = &senderStats{
+			windowStart: now,
+			burst:       rate.NewLimiter(rate.Limit(float64(d.cfg.MaxBurst)/d.cfg.BurstWindow.Seconds()), d.cfg.MaxBurst),
+		}
+		d.senders[sender] = st
+	}
+	st.lastSeen = now
+
+	// Advance the fixed windows
+	if elapsed := now.Sub(st.windowStart); elapsed >= d.cfg.Window {
+		if elapsed >= 2*d.cfg.Window {
+			st.previous = counts{}
+		} else {
+			st.previous = st.current
+		}
+		st.current = counts{}
+		st.windowStart = now.Add(-(elapsed % d.cfg.Window))
+	}
+	st.current.pushes++
+	if rejected {
+		st.current.rejected++
+	}
+
+	if !st.burst.AllowN(now, 1) {
+		d.suspend(sender, now, ReasonBurst,
+			fmt.Sprintf("more than %d pushes in %s", d.cfg.MaxBurst, d.cfg.BurstWindow))
+		return true
+	}
+
+	// Weight the previous window by how much of it the sliding window still covers
+	weight := 1 - float64(now.Sub(st.windowStart))/float64(d.cfg.Window)
+	pushes := float64(st.current.pushes) + weight*float64(st.previous.pushes)
+	rejections := float64(st.current.rejected) + weight*float64(st.previous.rejected)
+	if pushes >= float64(d.cfg.MinPushes) && rejections/pushes > d.cfg.MaxRejectRatio {
+		d.suspend(sender, now, ReasonRejectRatio,
+			fmt.Sprintf("%.0f of %.0f pushes rejected in %s", rejections, pushes, d.cfg.Window))
+		return true
+	}
+	return false
+}
+
+// suspend suspends sender for the cooldown and forgets its history, so it
+// starts afresh when the suspension ends. Caller must hold d.mu.
+func (d *Detector) suspend(sender string, now time.Time, reason, detail string) {
+	delete(d.senders, sender)
+	d.suspended[sender] = Suspension{
+		Sender: sender,
+		Reason: reason,
+		Detail: detail,
+		Since:  now,
+		Until:  now.Add(d.cfg.Cooldown),
+	}
+	d.suspensions++
+	log.Printf("WARNING: suspended sender %s until %s: %s", sender, now.Add(d.cfg.Cooldown).Format(time.RFC3339), detail)
+}
+
+// prune drops senders not seen for two windows and expired suspensions, at
+// most once per window. Caller must hold d.mu.
+func (d *Detector) prune(now time.Time) {
+	if now.Sub(d.lastPrune) < d.cfg.Window {
+		return
+	}
+	d.lastPrune = now
+	for sender, st := range d.senders {
+		if now.Sub(st.lastSeen) >= 2*d.cfg.Window {
+			delete(d.senders, sender)
+		}
+	}
+	for sender, s := range d.suspended {
+		if !now.Before(s.Until) {
+			delete(d.suspended, sender)
+		}
+	}
+}
+
+// List returns the current suspensions, soonest to end first.
+func (d *Detector) List() []Suspension {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	list := make([]Suspension, 0, len(d.suspended))
+	for _, s := range d.suspended {
+		if now.Before(s.Until) {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list
+}
+
+// Quota returns sender's burst allowance. A suspended sender has none left
+// until the suspension ends. The reject ratio isn't reflected, since it
+// depends on pushes the sender can't predict the outcome of.
+func (d *Detector) Quota(sender string) (Quota, bool) {
+	if d == nil {
+		return Quota{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	q := Quota{Limit: d.cfg.MaxBurst, Remaining: d.cfg.MaxBurst, Reset: now}
+	if s, ok := d.suspended[sender]; ok && now.Before(s.Until) {
+		q.Remaining = 0
+		q.Reset = s.Until
+		return q, true
+	}
+	st, ok := d.senders[sender]
+	if !ok {
+		return q, true
+	}
+	tokens := max(st.burst.TokensAt(now), 0)
+	q.Remaining = int(tokens)
+	missing := float64(d.cfg.MaxBurst) - tokens
+	q.Reset = now.Add(time.Duration(missing / float64(st.burst.Limit()) * float64(time.Second)))
+	return q, true
+}
+
+// Lift ends sender's suspension early. Returns false if it wasn't suspended.
+func (d *Detector) Lift(sender string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s, ok := d.suspended[sender]
+	delete(d.suspended, sender)
+	return ok && d.now().Before(s.Until)
+}
+
+// Reset forgets every sender's push history, refilling their burst
+// allowances. Current suspensions stay in place; Lift ends them.
+func (d *Detector) Reset() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.senders = make(map[string]*senderStats)
+}
+
+// Stats returns a snapshot of the detector's state.
+func (d *Detector) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return Stats{
+		TrackedSenders:   len(d.senders),
+		SuspendedSenders: len(d.suspended),
+		Suspensions:      d.suspensions,
+	}
+}
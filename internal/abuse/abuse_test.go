@@ -0,0 +1,204 @@
+package abuse
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestDetector returns a Detector with a clock the test advances.
+func newTestDetector(cfg Config) (*Detector, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	d := New(cfg)
+	d.now = func() time.Time { return now }
+	return d, &now
+}
+
+func TestRecord_RejectRatio(t *testing.T) {
+	d, _ := newTestDetector(Config{MinPushes: 10, MaxRejectRatio: 0.5})
+
+	// Mostly accepted: never suspended
+	for i := 0; i < 20; i++ {
+		if d.Record("alice@oc", i%3 == 0) {
+			t.Fatalf("alice suspended after push %d", i)
+		}
+	}
+
+	// All rejected: suspended once MinPushes is reached
+	for i := 0; i < 9; i++ {
+		if d.Record("spammer@oc", true) {
+			t.Fatalf("spammer suspended after %d pushes, before MinPushes", i+1)
+		}
+	}
+	if !d.Record("spammer@oc", true) {
+		t.Fatal("spammer not suspended at MinPushes")
+	}
+
+	s, ok := d.Suspended("spammer@oc")
+	if !ok || s.Reason != ReasonRejectRatio {
+		t.Errorf("Suspended = %+v, %v; want %s", s, ok, ReasonRejectRatio)
+	}
+	if _, ok := d.Suspended("alice@oc"); ok {
+		t.Error("alice suspended")
+	}
+}
+
+func TestRecord_SlidingWindow(t *testing.T) {
+	d, now := newTestDetector(Config{Window: time.Minute, MinPushes: 10, MaxRejectRatio: 0.5})
+
+	// Rejections in the previous window still count while it slides out
+	for i := 0; i < 9; i++ {
+		d.Record("bob@oc", true)
+	}
+	*now = now.Add(70 * time.Second)
+	for i := 0; i < 3; i++ {
+		d.Record("bob@oc", false)
+	}
+	if _, ok := d.Suspended("bob@oc"); !ok {
+		t.Error("bob not suspended; previous window's rejections were ignored")
+	}
+
+	// Rejections two windows back are forgotten
+	for i := 0; i < 8; i++ {
+		d.Record("carol@oc", true)
+	}
+	*now = now.Add(3 * time.Minute)
+	for i := 0; i < 10; i++ {
+		d.Record("carol@oc", false)
+	}
+	if _, ok := d.Suspended("carol@oc"); ok {
+		t.Error("carol suspended for rejections outside the window")
+	}
+}
+
+func TestRecord_Burst(t *testing.T) {
+	d, now := newTestDetector(Config{MaxBurst: 5, BurstWindow: 10 * time.Second})
+
+	for i := 0; i < 5; i++ {
+		if d.Record("alice@oc", false) {
+			t.Fatalf("suspended after %d pushes, within the burst limit", i+1)
+		}
+	}
+	// Pushes spread out refill the allowance
+	*now = now.Add(10 * time.Second)
+	for i := 0; i < 5; i++ {
+		if d.Record("alice@oc", false) {
+			t.Fatalf("suspended after %d spread-out pushes", i+1)
+		}
+	}
+	if !d.Record("alice@oc", false) {
+		t.Fatal("not suspended after exceeding the burst limit")
+	}
+	if s, _ := d.Suspended("alice@oc"); s.Reason != ReasonBurst {
+		t.Errorf("reason = %q, want %q", s.Reason, ReasonBurst)
+	}
+}
+
+func TestSuspension_Cooldown(t *testing.T) {
+	d, now := newTestDetector(Config{MaxBurst: 1, Cooldown: time.Minute})
+	d.Record("alice@oc", false)
+	d.Record("alice@oc", false)
+
+	s, ok := d.Suspended("alice@oc")
+	if !ok {
+		t.Fatal("not suspended")
+	}
+	if want := now.Add(time.Minute); !s.Until.Equal(want) {
+		t.Errorf("Until = %v, want %v", s.Until, want)
+	}
+
+	*now = now.Add(time.Minute)
+	if _, ok := d.Suspended("alice@oc"); ok {
+		t.Error("still suspended after cooldown")
+	}
+	if list := d.List(); len(list) != 0 {
+		t.Errorf("List = %+v, want empty", list)
+	}
+	// History was reset, so the sender starts afresh
+	if d.Record("alice@oc", false) {
+		t.Error("suspended again on first push after cooldown")
+	}
+}
+
+func TestLift(t *testing.T) {
+	d, _ := newTestDetector(Config{MaxBurst: 1})
+	d.Record("alice@oc", false)
+	d.Record("alice@oc", false)
+
+	if !d.Lift("alice@oc") {
+		t.Error("Lift = false for suspended sender")
+	}
+	if _, ok := d.Suspended("alice@oc"); ok {
+		t.Error("still suspended after Lift")
+	}
+	if d.Lift("alice@oc") {
+		t.Error("Lift = true for sender not suspended")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	d, now := newTestDetector(Config{MaxBurst: 5, BurstWindow: 10 * time.Second, Cooldown: time.Minute})
+
+	q, ok := d.Quota("alice@oc")
+	if !ok || q.Limit != 5 || q.Remaining != 5 || !q.Reset.Equal(*now) {
+		t.Errorf("new sender: Quota = %+v, %v, want a full allowance", q, ok)
+	}
+
+	d.Record("alice@oc", false)
+	d.Record("alice@oc", false)
+	q, _ = d.Quota("alice@oc")
+	if q.Remaining != 3 {
+		t.Errorf("Remaining = %d, want 3", q.Remaining)
+	}
+	// Each push takes BurstWindow/MaxBurst to refill
+	if want := now.Add(4 * time.Second); !q.Reset.Equal(want) {
+		t.Errorf("Reset = %v, want %v", q.Reset, want)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if q, _ = d.Quota("alice@oc"); q.Remaining != 4 {
+		t.Errorf("after refill: Remaining = %d, want 4", q.Remaining)
+	}
+
+	for range 5 {
+		d.Record("alice@oc", false)
+	}
+	q, _ = d.Quota("alice@oc")
+	if q.Remaining != 0 || !q.Reset.Equal(now.Add(time.Minute)) {
+		t.Errorf("suspended: Quota = %+v, want none left until the cooldown ends", q)
+	}
+}
+
+func TestReset(t *testing.T) {
+	d, _ := newTestDetector(Config{MaxBurst: 2})
+	d.Record("alice@oc", false)
+	d.Record("bob@oc", false)
+	d.Record("bob@oc", false)
+	d.Record("bob@oc", false)
+
+	d.Reset()
+	if q, _ := d.Quota("alice@oc"); q.Remaining != 2 {
+		t.Errorf("Remaining after Reset = %d, want a full allowance of 2", q.Remaining)
+	}
+	if _, ok := d.Suspended("bob@oc"); !ok {
+		t.Error("Reset lifted a suspension")
+	}
+	if stats := d.Stats(); stats.TrackedSenders != 0 {
+		t.Errorf("TrackedSenders after Reset = %d, want 0", stats.TrackedSenders)
+	}
+}
+
+func TestNilDetector(t *testing.T) {
+	var d *Detector
+	if d.Record("alice@oc", true) {
+		t.Error("nil detector suspended a sender")
+	}
+	if _, ok := d.Suspended("alice@oc"); ok {
+		t.Error("nil detector reports a suspension")
+	}
+	if d.List() != nil || d.Lift("alice@oc") {
+		t.Error("nil detector has suspensions")
+	}
+	if _, ok := d.Quota("alice@oc"); ok {
+		t.Error("nil detector reports a quota")
+	}
+}
@@ -0,0 +1,45 @@
+// Package adminui serves a small web page showing gateway health, pending
+// batches, and recent failures, for operators without a metrics stack.
+//
+// The page is static and embedded in the binary. It reads the admin API from
+// the browser with the admin token the operator enters, so serving it needs
+// no authorization of its own.
+package adminui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+//go:embed static
+var static embed.FS
+
+// Prefix is the path the UI is served under.
+const Prefix = "/admin/ui"
+
+// Handler serves the UI under Prefix. Prefix itself redirects to Prefix + "/".
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err) // the embedded directory always exists
+	}
+	fileServer := http.StripPrefix(Prefix, http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == Prefix {
+			http.Redirect(w, r, Prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, Prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		// Scripts come only from the embedded files, and the page can't be
+		// framed, so the token typed into it stays put
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		fileServer.ServeHTTP(w, r)
+	})
+}
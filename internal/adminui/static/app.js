@@ -0,0 +1,156 @@
+// Admin UI for the push gateway. Reads the admin API with the token the
+// operator enters, kept in sessionStorage so it's gone when the tab closes.
+"use strict";
+
+const refreshMillis = 5000;
+
+let token = sessionStorage.getItem("adminToken") || "";
+
+function $(id) {
+  return document.getElementById(id);
+}
+
+async function api(path) {
+  const resp = await fetch(path, { headers: { Authorization: "Bearer " + token } });
+  if (resp.status === 401) {
+    throw new Error("Unauthorized: check the admin token");
+  }
+  if (!resp.ok) {
+    throw new Error(path + ": " + resp.status + " " + (await resp.text()));
+  }
+  return resp.json();
+}
+
+function showError(err) {
+  $("error").textContent = err ? err.message : "";
+  $("error").hidden = !err;
+}
+
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  row.appendChild(td);
+}
+
+// fillTable replaces tbody's rows with columns(row) for each of rows, or a
+// single row saying empty.
+function fillTable(tbody, rows, columns, empty) {
+  tbody.replaceChildren();
+  if (rows.length === 0) {
+    const tr = tbody.insertRow();
+    const td = document.createElement("td");
+    td.colSpan = tbody.parentElement.tHead.rows[0].cells.length;
+    td.textContent = empty;
+    tr.appendChild(td);
+    return;
+  }
+  for (const row of rows) {
+    const tr = tbody.insertRow();
+    for (const text of columns(row)) {
+      cell(tr, text);
+    }
+  }
+}
+
+function time(value) {
+  return value ? new Date(value).toLocaleString() : "";
+}
+
+function bytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+async function refreshHealth() {
+  const resp = await fetch("/health");
+  const health = await resp.json();
+  $("health").textContent = health.status;
+  $("health").className = "badge " + health.status;
+}
+
+async function refreshStats() {
+  const [stats, metrics] = await Promise.all([api("/admin/stats"), api("/admin/metrics")]);
+
+  const items = [["Dropped notifications", stats.dropped_notifications]];
+  for (const [cause, n] of Object.entries(stats.drops)) {
+    if (cause !== "total") {
+      items.push(["  " + cause.replaceAll("_", " "), n]);
+    }
+  }
+  if (metrics.store) {
+    items.push(["Pending batches", metrics.store.batches]);
+    items.push(["Status records", metrics.store.statuses]);
+    items.push(["Database size", bytes(metrics.store.file_bytes)]);
+  }
+  if (metrics.push_limiter) {
+    items.push(["Pushes in flight", metrics.push_limiter.in_flight]);
+    items.push(["Pushes waiting", metrics.push_limiter.waiting]);
+  }
+  if (metrics.abuse) {
+    items.push(["Suspended senders", metrics.abuse.suspended_senders]);
+  }
+  if (metrics.statuses_marked_lost !== undefined) {
+    items.push(["Statuses marked lost", metrics.statuses_marked_lost]);
+  }
+
+  const dl = $("stats");
+  dl.replaceChildren();
+  for (const [name, value] of items) {
+    const dt = document.createElement("dt");
+    dt.textContent = name;
+    const dd = document.createElement("dd");
+    dd.textContent = value;
+    dl.append(dt, dd);
+  }
+}
+
+async function refreshFailures() {
+  const failures = await api("/admin/failures?since=24h&limit=50");
+  fillTable($("failures"), failures, (f) => [
+    time(f.failed_at), f.request_id, f.state, f.error_code || f.error || "",
+  ], "No failures in the last 24 hours");
+}
+
+async function refreshBatches() {
+  const recipient = $("recipient").value.trim();
+  if (!recipient) {
+    return;
+  }
+  const batches = await api("/admin/batches?recipient=" + encodeURIComponent(recipient));
+  fillTable($("batches"), batches, (b) => [
+    b.fcm_token, b.request_ids.length, time(b.created_at), time(b.flush_at),
+  ], "Nothing pending for " + recipient);
+}
+
+async function refresh() {
+  try {
+    await refreshHealth();
+    if (token) {
+      await Promise.all([refreshStats(), refreshFailures(), refreshBatches()]);
+    }
+    showError(null);
+    $("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+$("token").value = token;
+$("token-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  token = $("token").value;
+  sessionStorage.setItem("adminToken", token);
+  refresh();
+});
+$("batches-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  refreshBatches().catch(showError);
+});
+
+refresh();
+setInterval(refresh, refreshMillis);
@@ -0,0 +1,421 @@
+// Package backup uploads snapshots of the gateway's SQLite databases to
+// S3 or Google Cloud Storage, and restores them, so losing the disk doesn't
+// lose pending notifications and statuses.
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// manifestName is the object written last in each backup, listing its
+// files. A backup without one is incomplete and never restored.
+const manifestName = "manifest.json"
+
+// nameFormat names backups by when they were taken, so names sort by age.
+const nameFormat = "20060102T150405Z"
+
+// Manifest describes one backup.
+type Manifest struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Files are the base names of the database files backed up, one per
+	// shard; each is stored gzipped as the object Name/File.gz.
+	Files         []string `json:"files"`
+	SchemaVersion int      `json:"schema_version"`
+	Bytes         int64    `json:"bytes"` // compressed size of the files
+}
+
+// Retention says which backups are deleted after each new one. The newest
+// backup is always kept.
+type Retention struct {
+	// Keep is how many of the newest backups are kept. Zero keeps any
+	// number.
+	Keep int
+	// MaxAge deletes backups older than this. Zero keeps them however old.
+	MaxAge time.Duration
+}
+
+// Stats counts backups taken since startup.
+type Stats struct {
+	Succeeded  uint64    `json:"succeeded"`
+	Failed     uint64    `json:"failed"`
+	Deleted    uint64    `json:"deleted"` // removed by Retention
+	LastName   string    `json:"last_name,omitempty"`
+	LastAt     time.Time `json:"last_at,omitzero"`
+	LastBytes  int64     `json:"last_bytes"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastFailed time.Time `json:"last_failed,omitzero"`
+}
+
+// Backuper backs up a set of database files to a bucket.
+type Backuper struct {
+	bucket    Bucket
+	prefix    string
+	paths     []string
+	retention Retention
+
+	run   sync.Mutex // one backup at a time
+	mu    sync.Mutex
+	stats Stats
+}
+
+// New creates a Backuper uploading the database files at paths, such as
+// store.ShardPaths, to bucket under prefix.
+func New(bucket Bucket, prefix string, paths []string, retention Retention) *Backuper {
+	return &Backuper{
+		bucket:    bucket,
+		prefix:    prefix,
+		paths:     paths,
+		retention: retention,
+	}
+}
+
+// Run takes a backup of every database file, uploads it, and then deletes
+// backups beyond the retention policy. The databases are copied with
+// store.Backup, so the gateway keeps serving meanwhile.
+func (b *Backuper) Run(ctx context.Context) (Manifest, error) {
+	b.run.Lock()
+	defer b.run.Unlock()
+
+	m, err := b.upload(ctx)
+	b.mu.Lock()
+	if err != nil {
+		b.stats.Failed++
+		b.stats.LastError = err.Error()
+		b.stats.LastFailed = time.Now()
+	} else {
+		b.stats.Succeeded++
+		b.stats.LastName = m.Name
+		b.stats.LastAt = m.CreatedAt
+		b.stats.LastBytes = m.Bytes
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	deleted, err := b.prune(ctx, m.CreatedAt)
+	b.mu.Lock()
+	b.stats.Deleted += uint64(deleted)
+	b.mu.Unlock()
+	if err != nil {
+		log.Printf("WARNING: deleting old backups: %v", err)
+	}
+	return m, nil
+}
+
+// upload copies each database file, then uploads the copies and the
+// manifest.
+func (b *Backuper) upload(ctx context.Context) (Manifest, error) {
+	now := time.Now().UTC()
+	m := Manifest{
+		Name:          now.Format(nameFormat),
+		CreatedAt:     now,
+		SchemaVersion: store.SchemaVersion,
+	}
+
+	dir, err := os.MkdirTemp("", "pushserver-backup-")
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, path := range b.paths {
+		file := filepath.Base(path)
+		snapshot := filepath.Join(dir, file)
+		if err := store.Backup(ctx, path, snapshot); err != nil {
+			return Manifest{}, fmt.Errorf("copying %s: %w", path, err)
+		}
+		n, err := b.putFile(ctx, b.prefix+m.Name+"/"+file+".gz", snapshot)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("uploading %s: %w", file, err)
+		}
+		// Free the space before copying the next shard
+		os.Remove(snapshot)
+		m.Files = append(m.Files, file)
+		m.Bytes += n
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if err := b.bucket.Put(ctx, b.prefix+m.Name+"/"+manifestName, strings.NewReader(string(data)), int64(len(data))); err != nil {
+		return Manifest{}, fmt.Errorf("uploading manifest: %w", err)
+	}
+	return m, nil
+}
+
+// putFile gzips the file at path and uploads it as name, returning the
+// compressed size.
+func (b *Backuper) putFile(ctx context.Context, name, path string) (int64, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, b.bucket.Put(ctx, name, out, size)
+}
+
+// prune deletes the backups Retention no longer keeps, including
+// incomplete ones older than the newest, as of now.
+func (b *Backuper) prune(ctx context.Context, now time.Time) (int, error) {
+	backups, err := list(ctx, b.bucket, b.prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// Newest first; the newest complete backup is always kept
+	slices.SortFunc(backups, func(x, y listedBackup) int { return strings.Compare(y.name, x.name) })
+	var drop []listedBackup
+	complete := 0
+	for _, bk := range backups {
+		if !bk.complete {
+			if complete > 0 {
+				drop = append(drop, bk)
+			}
+			continue
+		}
+		complete++
+		if complete == 1 {
+			continue
+		}
+		tooMany := b.retention.Keep > 0 && complete > b.retention.Keep
+		tooOld := b.retention.MaxAge > 0 && now.Sub(bk.createdAt) > b.retention.MaxAge
+		if tooMany || tooOld {
+			drop = append(drop, bk)
+		}
+	}
+
+	deleted := 0
+	for _, bk := range drop {
+		if err := b.delete(ctx, bk); err != nil {
+			return deleted, fmt.Errorf("deleting backup %s: %w", bk.name, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// delete removes the objects of bk, its manifest first, so a backup half
+// deleted is incomplete rather than restorable.
+func (b *Backuper) delete(ctx context.Context, bk listedBackup) error {
+	manifest := b.prefix + bk.name + "/" + manifestName
+	if bk.complete {
+		if err := b.bucket.Delete(ctx, manifest); err != nil {
+			return err
+		}
+	}
+	for _, name := range bk.objects {
+		if name == manifest {
+			continue
+		}
+		if err := b.bucket.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns counts of backups taken and the outcome of the last one.
+func (b *Backuper) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// listedBackup is the objects of one backup, from a bucket listing.
+type listedBackup struct {
+	name      string
+	createdAt time.Time
+	complete  bool
+	objects   []string
+}
+
+// list groups the objects under prefix by backup. Objects not named like
+// a backup are left out.
+func list(ctx context.Context, bucket Bucket, prefix string) ([]listedBackup, error) {
+	names, err := bucket.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing backups: %w", err)
+	}
+	byName := make(map[string]*listedBackup)
+	for _, object := range names {
+		name, file, ok := strings.Cut(strings.TrimPrefix(object, prefix), "/")
+		if !ok {
+			continue
+		}
+		createdAt, err := time.Parse(nameFormat, name)
+		if err != nil {
+			continue
+		}
+		bk, ok := byName[name]
+		if !ok {
+			bk = &listedBackup{name: name, createdAt: createdAt}
+			byName[name] = bk
+		}
+		bk.objects = append(bk.objects, object)
+		bk.complete = bk.complete || file == manifestName
+	}
+	backups := make([]listedBackup, 0, len(byName))
+	for _, bk := range byName {
+		backups = append(backups, *bk)
+	}
+	return backups, nil
+}
+
+// List returns the manifests of the complete backups under prefix, newest
+// first.
+func List(ctx context.Context, bucket Bucket, prefix string) ([]Manifest, error) {
+	backups, err := list(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []Manifest
+	for _, bk := range backups {
+		if !bk.complete {
+			continue
+		}
+		m, err := readManifest(ctx, bucket, prefix, bk.name)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+	slices.SortFunc(manifests, func(x, y Manifest) int { return strings.Compare(y.Name, x.Name) })
+	return manifests, nil
+}
+
+// readManifest reads the manifest of the backup name.
+func readManifest(ctx context.Context, bucket Bucket, prefix, name string) (Manifest, error) {
+	r, err := bucket.Get(ctx, prefix+name+"/"+manifestName)
+	if errors.Is(err, ErrNotFound) {
+		return Manifest{}, fmt.Errorf("backup %s not found or incomplete", name)
+	}
+	if err != nil {
+		return Manifest{}, fmt.Errorf("reading backup %s: %w", name, err)
+	}
+	defer r.Close()
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return Manifest{}, fmt.Errorf("decoding manifest of backup %s: %w", name, err)
+	}
+	return m, nil
+}
+
+// Restore downloads the backup name under prefix, or the newest if name is
+// empty, into the database files at paths, which must match the files it
+// holds by base name. Existing files are replaced only with overwrite. The
+// gateway must be stopped.
+func Restore(ctx context.Context, bucket Bucket, prefix, name string, paths []string, overwrite bool) (Manifest, error) {
+	var m Manifest
+	if name == "" {
+		manifests, err := List(ctx, bucket, prefix)
+		if err != nil {
+			return Manifest{}, err
+		}
+		if len(manifests) == 0 {
+			return Manifest{}, errors.New("no complete backups found")
+		}
+		m = manifests[0]
+	} else {
+		var err error
+		if m, err = readManifest(ctx, bucket, prefix, name); err != nil {
+			return Manifest{}, err
+		}
+	}
+
+	byFile := make(map[string]string, len(paths))
+	for _, path := range paths {
+		byFile[filepath.Base(path)] = path
+	}
+	if len(m.Files) != len(paths) {
+		return Manifest{}, fmt.Errorf("backup %s holds %d database files, but storage expects %d; check storage.shards", m.Name, len(m.Files), len(paths))
+	}
+	for _, file := range m.Files {
+		path, ok := byFile[file]
+		if !ok {
+			return Manifest{}, fmt.Errorf("backup %s holds %s, which storage.path doesn't name", m.Name, file)
+		}
+		if _, err := os.Stat(path); err == nil && !overwrite {
+			return Manifest{}, fmt.Errorf("%s already exists", path)
+		}
+	}
+
+	for _, file := range m.Files {
+		if err := restoreFile(ctx, bucket, prefix+m.Name+"/"+file+".gz", byFile[file]); err != nil {
+			return Manifest{}, fmt.Errorf("restoring %s: %w", file, err)
+		}
+	}
+	return m, nil
+}
+
+// restoreFile downloads and unzips the object name to path, through a
+// temporary file so a failed download leaves path as it was.
+func restoreFile(ctx context.Context, bucket Bucket, name, path string) error {
+	r, err := bucket.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, zr); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// A stale WAL would be replayed onto the restored database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,191 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// memBucket is a Bucket held in memory.
+type memBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{objects: make(map[string][]byte)}
+}
+
+func (b *memBucket) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[name] = data
+	return nil
+}
+
+func (b *memBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (b *memBucket) Delete(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, name)
+	return nil
+}
+
+func TestRunAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pushserver.db")
+	paths := store.ShardPaths(path, 2)
+
+	// One database per shard, each with a batch of its own
+	for i, p := range paths {
+		st, err := store.New(store.Config{Path: p})
+		if err != nil {
+			t.Fatalf("store.New() error = %v", err)
+		}
+		batch := &store.Batch{
+			CreatedAt:     time.Now(),
+			FlushAt:       time.Now().Add(time.Minute),
+			Notifications: []store.QueuedNotification{{RequestID: fmt.Sprintf("req-%d", i), DataIDs: [][]byte{{1}}}},
+		}
+		if err := st.SaveBatch(ctx, fmt.Sprintf("token-%d", i), batch); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+		defer st.Close()
+	}
+
+	bucket := newMemBucket()
+	b := New(bucket, "gw/", paths, Retention{})
+	m, err := b.Run(ctx)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(m.Files) != 2 || m.SchemaVersion != store.SchemaVersion {
+		t.Errorf("manifest = %+v, want 2 files at schema v%d", m, store.SchemaVersion)
+	}
+
+	// Existing databases are kept unless overwritten
+	if _, err := Restore(ctx, bucket, "gw/", "", paths, false); err == nil {
+		t.Fatal("Restore() over existing databases succeeded, want an error")
+	}
+	if _, err := Restore(ctx, bucket, "gw/", "", paths[:1], true); err == nil {
+		t.Error("Restore() with a different shard count succeeded, want an error")
+	}
+
+	restoreDir := t.TempDir()
+	restorePath := filepath.Join(restoreDir, "pushserver.db")
+	got, err := Restore(ctx, bucket, "gw/", m.Name, store.ShardPaths(restorePath, 2), false)
+	if err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if got.Name != m.Name {
+		t.Errorf("restored backup %s, want %s", got.Name, m.Name)
+	}
+
+	for i, p := range store.ShardPaths(restorePath, 2) {
+		restored, err := store.New(store.Config{Path: p})
+		if err != nil {
+			t.Fatalf("opening restored %s: %v", p, err)
+		}
+		defer restored.Close()
+		batches, err := restored.LoadOldestBatches(ctx, 10)
+		if err != nil {
+			t.Fatalf("LoadOldestBatches() error = %v", err)
+		}
+		token, id := fmt.Sprintf("token-%d", i), fmt.Sprintf("req-%d", i)
+		if got := batches[token]; len(batches) != 1 || got == nil || got.Notifications[0].RequestID != id {
+			t.Errorf("restored shard %d batches = %+v, want %s for %s", i, batches, id, token)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	bucket := newMemBucket()
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	put := func(age time.Duration, complete bool) string {
+		name := now.Add(-age).Format(nameFormat)
+		bucket.Put(ctx, "gw/"+name+"/pushserver.db.gz", strings.NewReader("db"), 2)
+		if complete {
+			bucket.Put(ctx, "gw/"+name+"/"+manifestName, strings.NewReader("{}"), 2)
+		}
+		return name
+	}
+	newest := put(0, true)
+	kept := put(time.Hour, true)
+	tooMany := put(2*time.Hour, true)
+	incomplete := put(90*time.Minute, false)
+	inProgress := put(-time.Minute, false)
+	bucket.Put(ctx, "gw/notes.txt", strings.NewReader("x"), 1)
+
+	b := New(bucket, "gw/", nil, Retention{Keep: 2})
+	deleted, err := b.prune(ctx, now)
+	if err != nil {
+		t.Fatalf("prune() error = %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("prune() deleted %d backups, want 2", deleted)
+	}
+
+	var names []string
+	backups, _ := list(ctx, bucket, "gw/")
+	for _, bk := range backups {
+		names = append(names, bk.name)
+	}
+	slices.Sort(names)
+	want := []string{kept, newest, inProgress}
+	if !slices.Equal(names, want) {
+		t.Errorf("backups left = %v, want %v (without %s and %s)", names, want, tooMany, incomplete)
+	}
+	if _, err := bucket.Get(ctx, "gw/notes.txt"); err != nil {
+		t.Error("prune() deleted an object that isn't a backup")
+	}
+
+	// Even an old newest backup is kept
+	b = New(bucket, "gw/", nil, Retention{MaxAge: time.Minute})
+	if _, err := b.prune(ctx, now.Add(24*time.Hour)); err != nil {
+		t.Fatalf("prune() error = %v", err)
+	}
+	manifests, err := List(ctx, bucket, "gw/")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(manifests) != 1 {
+		t.Errorf("complete backups after pruning by age = %d, want 1", len(manifests))
+	}
+}
@@ -0,0 +1,70 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned by Bucket.Get for an object that doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// Bucket stores backup files as named objects.
+type Bucket interface {
+	// Put uploads size bytes from r as the object name, replacing any
+	// object of that name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get opens the object name for reading.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the objects starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object name.
+	Delete(ctx context.Context, name string) error
+}
+
+// Config says where backups are kept.
+type Config struct {
+	// URL is the bucket and the prefix of the backups' object names, as
+	// "s3://bucket/prefix" or "gs://bucket/prefix".
+	URL string
+	// S3 holds the settings for an s3:// URL.
+	S3 S3Config
+	// CredentialsFile and CredentialsJSON authenticate to Google Cloud
+	// Storage for a gs:// URL, as in fcm.Config. Empty uses the
+	// application default credentials.
+	CredentialsFile string
+	CredentialsJSON string
+	// Transport carries the uploads, such as through a proxy. Nil uses the
+	// default transport.
+	Transport http.RoundTripper
+}
+
+// Open returns the bucket cfg.URL names, and the prefix within it.
+func Open(ctx context.Context, cfg Config) (Bucket, string, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid backup URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("backup URL %q names no bucket", cfg.URL)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	switch u.Scheme {
+	case "s3":
+		b, err := newS3Bucket(u.Host, cfg.S3, cfg.Transport)
+		return b, prefix, err
+	case "gs":
+		b, err := newGCSBucket(ctx, u.Host, cfg)
+		return b, prefix, err
+	default:
+		return nil, "", fmt.Errorf("backup URL %q must start with s3:// or gs://", cfg.URL)
+	}
+}
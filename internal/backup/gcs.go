@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// gcsBucket is a Google Cloud Storage bucket, reached through the JSON API.
+type gcsBucket struct {
+	name    string
+	objects *storage.ObjectsService
+}
+
+func newGCSBucket(ctx context.Context, name string, cfg Config) (*gcsBucket, error) {
+	opts := []option.ClientOption{option.WithScopes(storage.DevstorageReadWriteScope)}
+	switch {
+	case cfg.CredentialsJSON != "":
+		opts = append(opts, option.WithCredentialsJSON([]byte(cfg.CredentialsJSON)))
+	case cfg.CredentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+	if cfg.Transport != nil {
+		transport, err := htransport.NewTransport(ctx, cfg.Transport, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("creating storage transport: %w", err)
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+
+	service, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating storage client: %w", err)
+	}
+	return &gcsBucket{name: name, objects: service.Objects}, nil
+}
+
+func (b *gcsBucket) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := b.objects.Insert(b.name, &storage.Object{Name: name, Size: uint64(size)}).
+		Media(r).Context(ctx).Do()
+	return err
+}
+
+func (b *gcsBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := b.objects.Get(b.name, name).Context(ctx).Download()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *gcsBucket) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := b.objects.List(b.name).Prefix(prefix).Fields("nextPageToken", "items/name").
+		Pages(ctx, func(objects *storage.Objects) error {
+			for _, o := range objects.Items {
+				names = append(names, o.Name)
+			}
+			return nil
+		})
+	return names, err
+}
+
+func (b *gcsBucket) Delete(ctx context.Context, name string) error {
+	return b.objects.Delete(b.name, name).Context(ctx).Do()
+}
@@ -3,61 +3,535 @@ package batcher
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+	"golang.org/x/time/rate"
 )
 
-// Sender sends batched notifications to FCM.
+// Sender sends batched notifications to FCM and returns the message ID.
+// *fcm.Sender implements this interface.
 type Sender interface {
-	Send(ctx context.Context, fcmToken string, dataIDs [][]byte) error
+	Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error)
+}
+
+// VisibleSender is implemented by senders that can attach an OS-rendered
+// notification (opts.Title and opts.Body) alongside the data payload.
+type VisibleSender interface {
+	SendVisible(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error)
+}
+
+// SendOptions holds optional per-message settings for a send.
+type SendOptions struct {
+	// TTL tells FCM to drop the message if it can't be delivered in time.
+	// Zero leaves FCM's default.
+	TTL time.Duration
+	// Title and Body, when set, add an OS-rendered notification alongside
+	// the data payload. The batcher sets them only for a VisibleSender.
+	Title string
+	Body  string
+	// Sender is the username that requested the push, or "" if the message
+	// combines several senders. Used for analytics labels.
+	Sender string
+	// DataSenders maps data IDs, as strings, to the username that pushed
+	// them. Used for provenance.
+	DataSenders map[string]string
+	// Data adds keys to the FCM data payload. It can't replace the payload
+	// key or SchemaVersionKey.
+	Data map[string]string
+	// Endpoint holds the target endpoint's options. The fcm package's
+	// Endpoint* keys are honored; others are ignored.
+	Endpoint map[string]string
+	// CryptKey, when set, is the recipient's X25519 public crypt key. The
+	// payload is sealed to it and sent as SealedPayloadKey, so FCM can't
+	// read the data IDs.
+	CryptKey []byte
+}
+
+// invalidTokenError is implemented by sender errors reporting that the token
+// is permanently invalid, such as FCM's UNREGISTERED.
+type invalidTokenError interface {
+	InvalidToken() bool
+}
+
+// unregistered reports whether err says the token is no longer registered.
+func unregistered(err error) bool {
+	var invalid invalidTokenError
+	return errors.As(err, &invalid) && invalid.InvalidToken()
+}
+
+// VisibleRenderer renders the visible notification text for a recipient.
+type VisibleRenderer interface {
+	Render(ctx context.Context, recipient string, count int) (title, body string, err error)
+}
+
+// retryableError is implemented by sender errors that should delay the flush
+// rather than fail the batch (for example, an exhausted FCM QPS budget).
+type retryableError interface {
+	RetryAfter() time.Duration
+}
+
+// errorCoder is implemented by sender errors carrying a structured FCM error
+// code, which is stored in the status instead of the error text.
+type errorCoder interface {
+	ErrorCode() string
 }
 
 // Config holds batcher configuration.
 type Config struct {
-	BatchWindow     time.Duration
-	MaxBatchSize    int
+	BatchWindow  time.Duration
+	MaxBatchSize int
+	// MaxDataIDs caps the data IDs sent in one FCM message, however many
+	// notifications carry them. A batch reaching it flushes early, and one
+	// holding more, e.g. after a merge, is sent as several messages. Zero
+	// means no cap.
+	MaxDataIDs      int
 	LockTimeout     time.Duration
 	StatusRetention time.Duration
+	// StateRetention overrides StatusRetention for statuses in the states
+	// it names, e.g. to keep failed statuses longer for debugging. A
+	// status's expiry is set when it enters a state.
+	StateRetention map[string]time.Duration
+	// NewRequestID generates request IDs. Defaults to random UUIDs.
+	NewRequestID IDGenerator
+	// ReserveRequestIDs reserves each generated request ID in the store,
+	// regenerating IDs already in use. Set it for IDFormatShort, whose IDs
+	// can collide; UUIDs are used as generated.
+	ReserveRequestIDs bool
+	// FlushConcurrency caps how many flushes run at once. Due flushes wait in
+	// FlushAt order. Zero means each flush runs as soon as it is due.
+	FlushConcurrency int
+	// FreshWeight and RecoveryWeight share the FlushConcurrency workers
+	// between fresh batches and batches Recover loads from the store: while
+	// both wait, FreshWeight fresh flushes run for every RecoveryWeight
+	// recovered ones. Zero RecoveryWeight makes Recover flush each batch
+	// itself, one at a time, without waiting for the workers.
+	FreshWeight    int
+	RecoveryWeight int
+	// RecoveryRate caps how many batches per second Recover flushes, so a
+	// backlog left by a long outage doesn't exhaust the FCM quota at once.
+	// Zero means no limit.
+	RecoveryRate float64
+	// DedupWindow suppresses data IDs already sent to the same token within
+	// this window. Zero disables duplicate suppression.
+	DedupWindow time.Duration
+	// FlushTimeout bounds each FCM send. A timed-out send is retried after
+	// BatchWindow. Zero means no timeout.
+	FlushTimeout time.Duration
+	// MaxFlushAttempts and MaxBatchAge bound retries of a batch whose flush
+	// keeps timing out or being rate limited. Once a batch's flush has
+	// failed MaxFlushAttempts times, counting attempts before a restart, or
+	// it is older than MaxBatchAge when a flush fails, it is moved to the
+	// dead letters and its requests marked failed_permanent. Zero means no
+	// limit.
+	MaxFlushAttempts int
+	MaxBatchAge      time.Duration
+	// MinSendInterval is the least time between sends to one endpoint, so
+	// chatty senders can't keep waking the device. A batch due sooner after
+	// the previous send waits until the interval has passed, even when full.
+	// Zero means no minimum.
+	MinSendInterval time.Duration
+	// LostAfter is how long a status may stay pending (queued or timed_out)
+	// with no batch left to deliver it before ReconcileLost marks it lost.
+	// Zero disables reconciliation.
+	LostAfter time.Duration
+	// Visible, when set, adds OS-rendered notification text to batches
+	// whose recipient is known.
+	Visible VisibleRenderer
+	// Windows, when set, lets recipients choose their own batch window,
+	// used instead of BatchWindow for new batches.
+	Windows WindowSource
+	// CryptKeys, when set, seals each payload to the recipient's public
+	// crypt key. A flush whose key can't be read is retried after
+	// BatchWindow; the payload is never sent unsealed.
+	CryptKeys CryptKeySource
+	// DND, when set, honors recipients' Do-Not-Disturb setting: their
+	// batches are held or dropped according to DNDPolicy, except for
+	// notifications from the urgent senders they allow.
+	DND DNDSource
+	// DNDPolicy is DNDHold (the default) or DNDDrop. Held batches are
+	// rechecked every minute and, like failing ones, dropped once older
+	// than MaxBatchAge.
+	DNDPolicy string
+	// MinWindow and MaxWindow bound recipient-chosen and adaptive windows.
+	// Zero leaves that side unbounded.
+	MinWindow time.Duration
+	MaxWindow time.Duration
+	// Adaptive replaces BatchWindow with a window between MinWindow and
+	// MaxWindow that grows with the endpoint's queue and the number of
+	// pending batches. Recipient-chosen windows still take precedence.
+	Adaptive bool
+	// AdaptiveFullLoad is how many pending batches push the adaptive window
+	// to MaxWindow. Defaults to 1000.
+	AdaptiveFullLoad int
+	// PrivateStatus leaves the target and device ID out of status records,
+	// so status lookups don't reveal who a request was addressed to.
+	PrivateStatus bool
+	// StoreFailurePolicy is StoreFailureMemory (the default) or
+	// StoreFailureReject, selecting what Queue does while the store fails.
+	StoreFailurePolicy string
+	// LeaseOwner and LeaseTTL let gateways sharing a store flush each batch
+	// once: an instance claims a batch's lease as LeaseOwner before flushing
+	// it and holds it for up to LeaseTTL, which should exceed FlushTimeout.
+	// Batches leased by another instance are retried after LeaseTTL, leaving
+	// out the notifications it delivered meanwhile. Zero LeaseTTL disables
+	// leasing.
+	LeaseOwner string
+	LeaseTTL   time.Duration
+	// Recipients, when set, re-reads each batch's recipient before it is
+	// sent. Notifications for accounts deleted since they were queued, or
+	// for endpoints their recipient has since removed, are dropped with
+	// status recipient_gone.
+	Recipients RecipientSource
+	// Health, when set, scores each endpoint by how its flushes went.
+	// Batches for an endpoint it paused wait until the pause ends.
+	Health HealthTracker
+	// Unreachable, when set, is called in a goroutine of its own with the
+	// recipient and token of each endpoint Health finds unreachable, such
+	// as to tell the recipient's other devices.
+	Unreachable func(recipient, fcmToken string)
+	// SendReceipts records each batch FCM accepted before deleting it, so
+	// a batch recovered after a crash or a failed delete is marked sent
+	// instead of being sent again.
+	SendReceipts bool
+	// Preflight, when set, checks each token the batcher hasn't seen
+	// before with a dry-run send before queueing to it. Queue returns
+	// ErrInvalidToken for tokens it finds unregistered. The outcome is
+	// remembered for the PreflightTokens tokens checked last, 100000 if
+	// zero.
+	Preflight       TokenValidator
+	PreflightTokens int
+	// EventBuffer is how many events Events buffers for a slow reader.
+	// Zero means 256.
+	EventBuffer int
+	// Mirror, when set, is called with each notification Queue adds to a
+	// batch, and each scheduled one when it joins its batch, such as to
+	// copy it to a standby gateway. It must not block.
+	Mirror func(recipient, fcmToken string, notif store.QueuedNotification)
+	// ForegroundWindow, when set, is the window for pushes to devices
+	// marked with MarkForeground within ForegroundTTL, bringing their
+	// pending batch forward like QueueOptions.Window. A recipient's own
+	// window still applies if it's shorter. ForegroundDevices caps the
+	// devices remembered, 100000 if zero.
+	ForegroundWindow  time.Duration
+	ForegroundTTL     time.Duration
+	ForegroundDevices int
+	// Counters, when set, keeps running totals of the notifications
+	// accepted, delivered, failed and dropped, under CounterNames.
+	Counters CounterSink
 }
 
 // Batcher queues notifications per endpoint and flushes periodically.
 type Batcher struct {
-	store           store.Store
-	sender          Sender
-	cfg             Config
+	store  store.Store
+	sender Sender
+	cfg    Config
 
 	mu      sync.Mutex
 	batches map[string]*batchEntry
 	timers  map[string]*time.Timer
 	stopped bool
+
+	// ctx is cancelled by Stop to abort in-flight timer-triggered flushes.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	flushQueue *flushQueue     // nil when FlushConcurrency is unlimited
+	windows    *windowCache    // nil when recipients can't choose windows
+	cryptKeys  *cryptKeyCache  // nil when payloads aren't sealed
+	dnd        *dndCache       // nil when Do-Not-Disturb isn't honored
+	preflights *preflightCache // nil when tokens aren't preflighted
+	foreground *foregroundSet  // nil without ForegroundWindow
+
+	drops        dropCounters
+	storeHealth  storeHealth
+	deadLettered atomic.Uint64
+	flushErrors  flushErrorCounters
+	retries      retryCounters
+	sweep        sweepCounters
+	leases       leaseCounters
+	watchdog     watchdogCounters
+	retention    retentionCounters
+	receipts     receiptCounters
+	recovery     recoveryProgress
+	events       eventStream
+	schedules    scheduleCounters
+	takenOver    takenOverSet
+
+	recoveryLimiter *rate.Limiter // nil when recovery isn't paced
+
+	recipientsGone atomic.Uint64
+}
+
+// flushErrorCounters counts failed flushes by flushErrorClass.
+type flushErrorCounters struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (c *flushErrorCounters) add(class string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[class]++
+}
+
+// flushErrorClass returns the label a flush failing with err is counted
+// under: the FCM error code when the sender reported one, otherwise the
+// cause.
+func flushErrorClass(err error) string {
+	var (
+		cryptKey *cryptKeyError
+		retry    retryableError
+		coded    errorCoder
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &cryptKey):
+		return "crypt_key"
+	case errors.As(err, &retry):
+		return "rate_limited"
+	case errors.As(err, &coded) && coded.ErrorCode() != "":
+		return coded.ErrorCode()
+	default:
+		return "other"
+	}
+}
+
+// dropCounters counts notifications Queue could not accept, by cause.
+type dropCounters struct {
+	lockTimeout atomic.Uint64
+	cancelled   atomic.Uint64
+	stopped     atomic.Uint64
+	rejected    atomic.Uint64
+
+	storeUnavailable atomic.Uint64
+	invalidToken     atomic.Uint64
+}
+
+// DropStats counts notifications that were never queued, by cause.
+type DropStats struct {
+	LockTimeout uint64 `json:"lock_timeout"` // endpoint lock not acquired within LockTimeout
+	Cancelled   uint64 `json:"cancelled"`    // caller gave up while waiting for the lock
+	Stopped     uint64 `json:"stopped"`      // batcher was shutting down
+	Rejected    uint64 `json:"rejected"`     // no request ID could be assigned
+	// StoreUnavailable counts notifications rejected because the store
+	// failed under StoreFailureReject.
+	StoreUnavailable uint64 `json:"store_unavailable"`
+	// InvalidToken counts notifications for tokens a preflight check
+	// found unregistered.
+	InvalidToken uint64 `json:"invalid_token"`
+	Total        uint64 `json:"total"`
 }
 
 // batchEntry holds a batch and its per-endpoint lock.
 type batchEntry struct {
-	mu    sync.Mutex
-	batch *store.Batch
+	mu       sync.Mutex
+	batch    *store.Batch
+	lastSent time.Time // when FCM last accepted a send to the endpoint
+	// contended is set when another instance held the batch's lease, so
+	// the next flush first drops what that instance delivered.
+	contended bool
+	// recovered is set when the batch was loaded from the store, so the
+	// next flush first checks whether FCM already accepted it.
+	recovered bool
 }
 
+// maxIDAttempts bounds retries when a generated request ID is already in use.
+const maxIDAttempts = 5
+
 // New creates a new Batcher.
 func New(s store.Store, sender Sender, cfg Config) *Batcher {
-	return &Batcher{
+	if cfg.NewRequestID == nil {
+		cfg.NewRequestID, _ = NewIDGenerator(IDFormatUUID, "")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Batcher{
 		store:   s,
 		sender:  sender,
 		cfg:     cfg,
 		batches: make(map[string]*batchEntry),
 		timers:  make(map[string]*time.Timer),
+		ctx:     ctx,
+		cancel:  cancel,
+
+		recoveryLimiter: newRecoveryLimiter(cfg.RecoveryRate),
+	}
+	if cfg.FlushConcurrency > 0 {
+		b.flushQueue = newFlushQueue(cfg.FlushConcurrency, b.flush)
+		b.flushQueue.setWeights(cfg.FreshWeight, cfg.RecoveryWeight)
+	}
+	if cfg.Windows != nil {
+		b.windows = &windowCache{source: cfg.Windows, entries: make(map[string]cachedWindow)}
+	}
+	if cfg.CryptKeys != nil {
+		b.cryptKeys = &cryptKeyCache{source: cfg.CryptKeys, entries: make(map[string]cachedCryptKey)}
+	}
+	if cfg.DND != nil {
+		b.dnd = &dndCache{source: cfg.DND, entries: make(map[string]cachedDND)}
 	}
+	if cfg.Preflight != nil {
+		b.preflights = newPreflightCache(cfg.PreflightTokens)
+	}
+	if cfg.ForegroundWindow > 0 {
+		b.foreground = newForegroundSet(cfg.ForegroundTTL, cfg.ForegroundDevices)
+	}
+	return b
 }
 
-// Queue adds a notification to the batch for the given FCM token.
-// Returns the generated request ID for status tracking.
-func (b *Batcher) Queue(ctx context.Context, fcmToken string, dataIDs [][]byte) (string, error) {
-	requestID := uuid.New().String()
+// QueueOptions holds optional per-request delivery settings.
+type QueueOptions struct {
+	// Deadline drops the notification, with status expired, if its batch
+	// flushes after this time. It is also forwarded to FCM as the message TTL.
+	// Zero means no deadline.
+	Deadline time.Time
+	// Sender is the username that requested the push, used to attribute
+	// FCM delivery analytics.
+	Sender string
+	// Data is extra FCM data payload, such as passthrough PushRequest fields.
+	Data map[string]string
+	// DeviceID identifies the recipient's device owning the endpoint, recorded
+	// with the status for context.
+	DeviceID string
+	// EndpointOptions are the endpoint's delivery settings from its endpoint
+	// list entry, passed to the sender. The latest request's options apply
+	// to the whole batch.
+	EndpointOptions map[string]string
+	// Window, when set, is how long the notification may wait, such as its
+	// sender class's window. It replaces the batch window for a new batch
+	// and brings forward a pending batch due later. A recipient's chosen
+	// window still takes precedence.
+	Window time.Duration
+	// MaxBatchSize, when set, replaces Config.MaxBatchSize as the batch
+	// size at which adding this notification flushes the batch.
+	MaxBatchSize int
+	// TraceID identifies the push in log lines and metric exemplars, from
+	// queueing to the flush. It is persisted with the notification.
+	TraceID string
+	// EndpointsDigest is the EndpointsDigest of the recipient's endpoint
+	// list the push was queued from. With Config.Recipients set, a flush
+	// finding the list changed checks that it still holds the token.
+	EndpointsDigest string
+	// DeliverAfter, when in the future, holds the notification with status
+	// scheduled until this time instead of queueing it; ReleaseDue queues it
+	// then. Deadline still applies from when it is queued.
+	DeliverAfter time.Time
+}
+
+// Queue adds a notification to the batch for the given FCM token, owned by
+// recipient. Returns the generated request ID for status tracking.
+func (b *Batcher) Queue(ctx context.Context, recipient, fcmToken string, dataIDs [][]byte) (string, error) {
+	return b.QueueWithOptions(ctx, recipient, fcmToken, dataIDs, QueueOptions{})
+}
 
+// QueueWithOptions is like Queue but applies per-request delivery options.
+func (b *Batcher) QueueWithOptions(ctx context.Context, recipient, fcmToken string, dataIDs [][]byte, opts QueueOptions) (string, error) {
+	ctx = logfield.WithTrace(ctx, opts.TraceID)
+	if b.preflights != nil {
+		if err := b.preflight(ctx, fcmToken); err != nil {
+			b.drops.invalidToken.Add(1)
+			b.emitRejected(recipient, fcmToken, "", "invalid_token", err)
+			return "", err
+		}
+	}
+	requestID, err := b.newRequestID(ctx)
+	if err != nil {
+		if errors.Is(err, ErrStoreUnavailable) {
+			b.drops.storeUnavailable.Add(1)
+			b.emitRejected(recipient, fcmToken, "", "store_unavailable", err)
+		} else {
+			b.drops.rejected.Add(1)
+			b.emitRejected(recipient, fcmToken, "", "rejected", err)
+		}
+		return "", err
+	}
+
+	notif := store.QueuedNotification{
+		DataIDs:   dataIDs,
+		RequestID: requestID,
+		Deadline:  opts.Deadline,
+		Sender:    opts.Sender,
+		Data:      opts.Data,
+		QueuedAt:  time.Now(),
+
+		EndpointOptions: opts.EndpointOptions,
+		TraceID:         opts.TraceID,
+		EndpointsDigest: opts.EndpointsDigest,
+	}
+	if !b.cfg.PrivateStatus {
+		notif.Target = recipient
+		notif.DeviceID = opts.DeviceID
+	}
+	if opts.DeliverAfter.After(notif.QueuedAt) {
+		if err := b.schedule(ctx, recipient, fcmToken, notif, opts); err != nil {
+			return "", err
+		}
+		b.count(CounterAccepted, 1)
+		return requestID, nil
+	}
+	if err := b.enqueue(ctx, recipient, fcmToken, notif, b.policyFor(ctx, recipient, opts)); err != nil {
+		return "", err
+	}
+	b.count(CounterAccepted, 1)
+	if b.cfg.Mirror != nil {
+		b.cfg.Mirror(recipient, fcmToken, notif)
+	}
+
+	return requestID, nil
+}
+
+// newRequestID generates a request ID. Short formats have a small but real
+// collision risk; a collision would let one request overwrite another's
+// status, so with ReserveRequestIDs each ID is reserved in the store and IDs
+// in use are regenerated.
+func (b *Batcher) newRequestID(ctx context.Context) (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := b.cfg.NewRequestID()
+		if err != nil {
+			return "", fmt.Errorf("generating request ID: %w", err)
+		}
+		if !b.cfg.ReserveRequestIDs {
+			return id, nil
+		}
+
+		err = b.store.ReserveRequestID(ctx, id, time.Now())
+		if err == nil {
+			return id, nil
+		}
+		if errors.Is(err, store.ErrRequestIDTaken) {
+			log.Printf("WARNING: generated request ID %s already in use, regenerating", id)
+			continue
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("reserving request ID: %w", err)
+		}
+		b.storeFailed(ctx, "reserving request ID", err)
+		if b.policy() == StoreFailureReject {
+			return "", fmt.Errorf("reserving request ID: %w: %w", ErrStoreUnavailable, err)
+		}
+		// Generated IDs are random enough that skipping the reservation
+		// is safer than refusing the push
+		return id, nil
+	}
+	return "", fmt.Errorf("no unused request ID after %d attempts", maxIDAttempts)
+}
+
+// enqueue adds a notification to the batch for fcmToken, starting a batch
+// that flushes after policy's window if there is none. A zero window sizes
+// the batch adaptively and resizes it as notifications are added.
+// An empty recipient leaves the batch's existing recipient unchanged.
+func (b *Batcher) enqueue(ctx context.Context, recipient, fcmToken string, notif store.QueuedNotification, policy flushPolicy) error {
+	window := policy.window
 	entry := b.getOrCreateEntry(fcmToken)
 
 	// Acquire per-endpoint lock with timeout
@@ -71,10 +545,16 @@ func (b *Batcher) Queue(ctx context.Context, fcmToken string, dataIDs [][]byte)
 	case <-locked:
 		// Got the lock
 	case <-time.After(b.cfg.LockTimeout):
-		log.Printf("ERROR: lock timeout for fcmToken %s, dropping notification", fcmToken)
-		return "", context.DeadlineExceeded
+		go releaseWhenLocked(entry, locked)
+		b.drops.lockTimeout.Add(1)
+		log.Printf("ERROR: lock timeout for fcmToken %s, dropping notification%s", fcmToken, logfield.Format(logfield.Trace(ctx)))
+		b.emitRejected(recipient, fcmToken, notif.RequestID, "lock_timeout", context.DeadlineExceeded)
+		return context.DeadlineExceeded
 	case <-ctx.Done():
-		return "", ctx.Err()
+		go releaseWhenLocked(entry, locked)
+		b.drops.cancelled.Add(1)
+		b.emitRejected(recipient, fcmToken, notif.RequestID, "cancelled", ctx.Err())
+		return ctx.Err()
 	}
 	defer entry.mu.Unlock()
 
@@ -82,7 +562,9 @@ func (b *Batcher) Queue(ctx context.Context, fcmToken string, dataIDs [][]byte)
 	b.mu.Lock()
 	if b.stopped {
 		b.mu.Unlock()
-		return "", context.Canceled
+		b.drops.stopped.Add(1)
+		b.emitRejected(recipient, fcmToken, notif.RequestID, "stopped", context.Canceled)
+		return context.Canceled
 	}
 	b.mu.Unlock()
 
@@ -93,33 +575,102 @@ func (b *Batcher) Queue(ctx context.Context, fcmToken string, dataIDs [][]byte)
 	if entry.batch == nil {
 		entry.batch = &store.Batch{
 			CreatedAt: now,
-			FlushAt:   now.Add(b.cfg.BatchWindow),
+			FlushAt:   b.notBefore(entry, now.Add(window)),
 		}
 	}
+	if recipient != "" {
+		entry.batch.Recipient = recipient
+	}
 
-	entry.batch.Notifications = append(entry.batch.Notifications, store.QueuedNotification{
-		DataIDs:   dataIDs,
-		RequestID: requestID,
-	})
+	entry.batch.Notifications = append(entry.batch.Notifications, notif)
+	prevFlushAt := entry.batch.FlushAt
+
+	resized := false
+	if window == 0 {
+		flushAt := b.notBefore(entry, entry.batch.CreatedAt.Add(b.adaptiveWindow(len(entry.batch.Notifications))))
+		resized = !flushAt.Equal(entry.batch.FlushAt)
+		entry.batch.FlushAt = flushAt
+	} else if policy.firm && !isNewBatch {
+		if flushAt := b.notBefore(entry, now.Add(window)); flushAt.Before(entry.batch.FlushAt) {
+			entry.batch.FlushAt = flushAt
+			resized = true
+		}
+	}
 
 	// Persist to DB
-	if err := b.store.SaveBatch(ctx, fcmToken, entry.batch); err != nil {
-		log.Printf("ERROR: failed to persist batch for %s: %v", fcmToken, err)
-		// Continue anyway - we have it in memory
+	if err := b.saveBatch(ctx, fcmToken, entry.batch); err != nil && b.policy() == StoreFailureReject && ctx.Err() == nil {
+		// Undo the add, so the rejected notification is never sent
+		entry.batch.Notifications = entry.batch.Notifications[:len(entry.batch.Notifications)-1]
+		entry.batch.FlushAt = prevFlushAt
+		if isNewBatch {
+			entry.batch = nil
+		}
+		b.drops.storeUnavailable.Add(1)
+		err = fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+		b.emitRejected(recipient, fcmToken, notif.RequestID, "store_unavailable", err)
+		return err
 	}
+	b.emit(Event{
+		Type:       EventQueued,
+		At:         now,
+		FCMToken:   fcmToken,
+		Recipient:  entry.batch.Recipient,
+		RequestIDs: []string{notif.RequestID},
+	})
 
-	// Start timer if this is a new batch
-	if isNewBatch {
-		b.startTimer(fcmToken, entry.batch.FlushAt.Sub(now))
+	// Start timer if this is a new batch, or move it if the batch was resized
+	if isNewBatch || resized {
+		b.startTimer(fcmToken, max(0, entry.batch.FlushAt.Sub(now)))
 	}
 
 	// Check if we need to flush immediately due to size
-	if len(entry.batch.Notifications) >= b.cfg.MaxBatchSize {
+	if b.full(entry.batch, policy.maxSize) {
 		b.stopTimer(fcmToken)
-		go b.flush(fcmToken)
+		go b.dispatchFlush(fcmToken, now)
 	}
 
-	return requestID, nil
+	return nil
+}
+
+// full reports whether batch holds maxSize notifications, or MaxDataIDs
+// data IDs between them.
+func (b *Batcher) full(batch *store.Batch, maxSize int) bool {
+	if len(batch.Notifications) >= maxSize {
+		return true
+	}
+	if b.cfg.MaxDataIDs <= 0 {
+		return false
+	}
+	count := 0
+	for _, notif := range batch.Notifications {
+		count += len(notif.DataIDs)
+	}
+	return count >= b.cfg.MaxDataIDs
+}
+
+// notBefore returns flushAt, or the end of MinSendInterval after the
+// endpoint's last send if that is later.
+func (b *Batcher) notBefore(entry *batchEntry, flushAt time.Time) time.Time {
+	if b.cfg.MinSendInterval <= 0 || entry.lastSent.IsZero() {
+		return flushAt
+	}
+	if earliest := entry.lastSent.Add(b.cfg.MinSendInterval); flushAt.Before(earliest) {
+		return earliest
+	}
+	return flushAt
+}
+
+// saveBatch persists batch, tracking store health. Failures are logged;
+// the batch stays in memory either way.
+func (b *Batcher) saveBatch(ctx context.Context, fcmToken string, batch *store.Batch) error {
+	batch.Owner = b.batchOwner()
+	if err := b.store.SaveBatch(ctx, fcmToken, batch); err != nil {
+		log.Printf("ERROR: failed to persist batch for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		b.storeFailed(ctx, "saving batch", err)
+		return err
+	}
+	b.storeSucceeded()
+	return nil
 }
 
 // getOrCreateEntry returns the batch entry for an FCM token, creating if needed.
@@ -149,8 +700,9 @@ func (b *Batcher) startTimer(fcmToken string, duration time.Duration) {
 		timer.Stop()
 	}
 
+	flushAt := time.Now().Add(duration)
 	b.timers[fcmToken] = time.AfterFunc(duration, func() {
-		b.flush(fcmToken)
+		b.dispatchFlush(fcmToken, flushAt)
 	})
 }
 
@@ -165,13 +717,25 @@ func (b *Batcher) stopTimer(fcmToken string) {
 	}
 }
 
+// dispatchFlush flushes the batch for an FCM token that became due at flushAt.
+// With a concurrency cap the flush waits its turn in the fair flush queue.
+func (b *Batcher) dispatchFlush(fcmToken string, flushAt time.Time) {
+	if b.flushQueue == nil {
+		b.flush(fcmToken)
+		return
+	}
+	b.flushQueue.push(fcmToken, flushAt)
+}
+
 // flush sends the batch for an FCM token and updates status (async, for timer callback).
 func (b *Batcher) flush(fcmToken string) {
-	b.flushSync(context.Background(), fcmToken)
+	b.flushSync(b.ctx, fcmToken, false)
 }
 
-// flushSync sends the batch for an FCM token and updates status.
-func (b *Batcher) flushSync(ctx context.Context, fcmToken string) {
+// flushSync sends the batch for an FCM token and updates status. Unless
+// force is set, a batch due within MinSendInterval of the previous send is
+// deferred instead.
+func (b *Batcher) flushSync(ctx context.Context, fcmToken string, force bool) {
 	b.mu.Lock()
 	entry, ok := b.batches[fcmToken]
 	if !ok {
@@ -186,6 +750,42 @@ func (b *Batcher) flushSync(ctx context.Context, fcmToken string) {
 	if entry.batch == nil || len(entry.batch.Notifications) == 0 {
 		return
 	}
+	ctx = withTrace(ctx, entry.batch)
+
+	if !force {
+		now := time.Now()
+		if earliest := b.notBefore(entry, now); earliest.After(now) {
+			entry.batch.FlushAt = earliest
+			b.saveBatch(ctx, fcmToken, entry.batch)
+			b.startTimer(fcmToken, earliest.Sub(now))
+			return
+		}
+	}
+
+	release, ok := b.claimLease(ctx, fcmToken, entry)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if !b.dropDelivered(ctx, fcmToken, entry) {
+		return
+	}
+	if !b.dropAcknowledged(ctx, fcmToken, entry) {
+		return
+	}
+	if !b.dropExpired(ctx, fcmToken, entry) {
+		return
+	}
+	if !b.verifyRecipient(ctx, fcmToken, entry) {
+		return
+	}
+	if !b.applyDND(ctx, fcmToken, entry) {
+		return
+	}
+	if !b.holdPaused(ctx, fcmToken, entry) {
+		return
+	}
 
 	// Collect all data IDs
 	var allDataIDs [][]byte
@@ -193,29 +793,141 @@ func (b *Batcher) flushSync(ctx context.Context, fcmToken string) {
 		allDataIDs = append(allDataIDs, notif.DataIDs...)
 	}
 
+	// Drop data IDs the device was woken for recently
+	suppressed := false
+	if b.cfg.DedupWindow > 0 && len(allDataIDs) > 0 {
+		unique := uniqueDataIDs(allDataIDs)
+		remaining, err := b.store.FilterRecentSends(ctx, fcmToken, unique)
+		if err != nil {
+			log.Printf("WARNING: duplicate check failed for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+			remaining = unique
+		}
+		suppressed = len(remaining) == 0
+		allDataIDs = remaining
+	}
+
 	// Send to FCM
 	now := time.Now()
 	var status store.Status
 
-	err := b.sender.Send(ctx, fcmToken, allDataIDs)
+	var (
+		messageID string
+		err       error
+	)
+	if !suppressed {
+		messageID, err = b.sendSplit(ctx, fcmToken, entry.batch.Recipient, allDataIDs, SendOptions{
+			TTL:         messageTTL(entry.batch.Notifications, now),
+			Sender:      commonSender(entry.batch.Notifications),
+			DataSenders: dataSenders(entry.batch.Notifications),
+			Data:        mergeData(entry.batch.Notifications),
+			Endpoint:    latestEndpointOptions(entry.batch.Notifications),
+		})
+	}
+
+	// Shutting down: leave the batch persisted for recovery on restart
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		log.Printf("INFO: flush for %s cancelled, batch kept for recovery%s", fcmToken, logfield.Format(logfield.Trace(ctx)))
+		return
+	}
+
+	if err != nil {
+		b.flushErrors.add(flushErrorClass(err))
+	}
+
+	// A hung send must not hold the endpoint lock forever; mark and retry later
+	if errors.Is(err, context.DeadlineExceeded) {
+		b.recordHealth(ctx, fcmToken, entry.batch.Recipient, false)
+		entry.batch.Attempts++
+		if reason := b.giveUpReason(entry.batch, now); reason != "" {
+			b.emitFlushFailed(fcmToken, entry.batch, err, false)
+			b.deadLetter(ctx, fcmToken, entry, fmt.Sprintf("%s: %v", reason, err))
+			return
+		}
+		b.emitFlushFailed(fcmToken, entry.batch, err, true)
+		log.Printf("WARNING: flush for %s timed out after %s, retrying in %s%s", fcmToken, b.cfg.FlushTimeout, b.cfg.BatchWindow, logfield.Format(logfield.Trace(ctx)))
+		if err := b.store.SetStatus(ctx, fcmToken, requestIDs(entry.batch.Notifications), store.Status{
+			State:     store.StatusTimedOut,
+			Error:     err.Error(),
+			ExpiresAt: b.statusExpiry(store.StatusTimedOut, now),
+		}); err != nil {
+			log.Printf("ERROR: failed to record timeout for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		}
+		b.scheduleRetry(ctx, fcmToken, entry, b.cfg.BatchWindow)
+		return
+	}
+
+	// Keep the batch and try again later if the sender asked us to back off
+	var retry retryableError
+	if errors.As(err, &retry) {
+		entry.batch.Attempts++
+		if reason := b.giveUpReason(entry.batch, now); reason != "" {
+			b.emitFlushFailed(fcmToken, entry.batch, err, false)
+			b.deadLetter(ctx, fcmToken, entry, fmt.Sprintf("%s: %v", reason, err))
+			return
+		}
+		b.emitFlushFailed(fcmToken, entry.batch, err, true)
+		log.Printf("INFO: flush for %s rescheduled in %s: %v%s", fcmToken, retry.RetryAfter(), err, logfield.Format(logfield.Trace(ctx)))
+		b.scheduleRetry(ctx, fcmToken, entry, retry.RetryAfter())
+		return
+	}
+
 	if err != nil {
-		log.Printf("ERROR: flush failed for %s: %v", fcmToken, err)
+		log.Printf("ERROR: flush failed for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		if unregistered(err) {
+			if err := b.store.RecordInvalidToken(ctx, fcmToken); err != nil {
+				log.Printf("WARNING: failed to record invalid token %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+			}
+			if b.preflights != nil {
+				b.preflights.remember(fcmToken, false)
+			}
+		}
 		status = store.Status{
 			State:     store.StatusFailed,
-			Error:     err.Error(),
-			ExpiresAt: now.Add(b.cfg.StatusRetention),
+			ExpiresAt: b.statusExpiry(store.StatusFailed, now),
+		}
+		var coded errorCoder
+		if errors.As(err, &coded) && coded.ErrorCode() != "" {
+			status.ErrorCode = coded.ErrorCode()
+		} else {
+			status.Error = err.Error()
 		}
 	} else {
+		if !suppressed {
+			entry.lastSent = now
+			b.recordReceipt(ctx, fcmToken, entry, messageID, now)
+		}
 		status = store.Status{
 			State:     store.StatusSent,
 			SentAt:    &now,
-			ExpiresAt: now.Add(b.cfg.StatusRetention),
+			MessageID: messageID,
+			ExpiresAt: b.statusExpiry(store.StatusSent, now),
+		}
+		if b.cfg.DedupWindow > 0 && !suppressed {
+			if err := b.store.RecordRecentSends(ctx, fcmToken, allDataIDs, now.Add(b.cfg.DedupWindow)); err != nil {
+				log.Printf("WARNING: failed to record recent sends for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+			}
 		}
 	}
 
+	if err != nil || !suppressed {
+		b.recordHealth(ctx, fcmToken, entry.batch.Recipient, err == nil)
+	}
+
 	// Delete batch from DB and set status
-	if err := b.store.DeleteBatchAndSetStatus(ctx, fcmToken, status); err != nil {
-		log.Printf("ERROR: failed to update status for %s: %v", fcmToken, err)
+	if err := b.deleteBatch(ctx, fcmToken, entry.batch, status); err != nil {
+		log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		b.storeFailed(ctx, "updating status", err)
+	} else {
+		b.storeSucceeded()
+	}
+
+	if err != nil {
+		b.emitFlushFailed(fcmToken, entry.batch, err, false)
+	} else {
+		b.emitBatch(EventFlushed, fcmToken, entry.batch, func(e *Event) {
+			e.MessageID = messageID
+			e.Suppressed = suppressed
+		})
 	}
 
 	// Clear from memory
@@ -226,13 +938,340 @@ func (b *Batcher) flushSync(ctx context.Context, fcmToken string) {
 	b.mu.Unlock()
 }
 
+// sendSplit sends dataIDs in messages of at most MaxDataIDs each, returning
+// the last message's ID. It stops at the first failure; the batch is then
+// kept or failed as a whole, so a retry may wake the device again for data
+// IDs an earlier message already carried.
+func (b *Batcher) sendSplit(ctx context.Context, fcmToken, recipient string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	limit := b.cfg.MaxDataIDs
+	if limit <= 0 || len(dataIDs) <= limit {
+		return b.send(ctx, fcmToken, recipient, dataIDs, opts)
+	}
+	log.Printf("INFO: splitting %d data IDs for %s into messages of %d%s", len(dataIDs), fcmToken, limit, logfield.Format(logfield.Trace(ctx)))
+	var messageID string
+	for start := 0; start < len(dataIDs); start += limit {
+		var err error
+		messageID, err = b.send(ctx, fcmToken, recipient, dataIDs[start:min(start+limit, len(dataIDs))], opts)
+		if err != nil {
+			return "", err
+		}
+	}
+	return messageID, nil
+}
+
+// send calls the sender, bounded by FlushTimeout when configured.
+// The payload is sealed to the recipient when configured. Visible text is
+// attached when configured; rendering failures fall back to a data-only
+// message.
+func (b *Batcher) send(ctx context.Context, fcmToken, recipient string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	if b.cfg.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.cfg.FlushTimeout)
+		defer cancel()
+	}
+
+	if b.cryptKeys != nil {
+		if recipient == "" {
+			return "", errors.New("recipient unknown, can't seal payload")
+		}
+		key, err := b.cryptKeys.key(ctx, recipient)
+		if err != nil {
+			return "", &cryptKeyError{recipient: recipient, err: err, delay: b.cfg.BatchWindow}
+		}
+		opts.CryptKey = key
+	}
+
+	if vs, ok := b.sender.(VisibleSender); ok && b.cfg.Visible != nil && recipient != "" {
+		title, body, err := b.cfg.Visible.Render(ctx, recipient, len(dataIDs))
+		if err == nil {
+			opts.Title, opts.Body = title, body
+			return vs.SendVisible(ctx, fcmToken, dataIDs, opts)
+		}
+		log.Printf("WARNING: rendering visible notification: %v%s", err, logfield.Format(logfield.User("recipient", recipient), logfield.Trace(ctx)))
+	}
+
+	return b.sender.Send(ctx, fcmToken, dataIDs, opts)
+}
+
+// commonSender returns the sender shared by all notifications, or "" if they
+// come from different (or unrecorded) senders.
+func commonSender(notifications []store.QueuedNotification) string {
+	if len(notifications) == 0 {
+		return ""
+	}
+	sender := notifications[0].Sender
+	for _, notif := range notifications[1:] {
+		if notif.Sender != sender {
+			return ""
+		}
+	}
+	return sender
+}
+
+// dataSenders maps each data ID, as a string, to the sender that queued it.
+// A data ID queued by several senders is attributed to the newest.
+func dataSenders(notifications []store.QueuedNotification) map[string]string {
+	var senders map[string]string
+	for _, notif := range notifications {
+		if notif.Sender == "" {
+			continue
+		}
+		for _, id := range notif.DataIDs {
+			if senders == nil {
+				senders = make(map[string]string)
+			}
+			senders[string(id)] = notif.Sender
+		}
+	}
+	return senders
+}
+
+// mergeData combines the notifications' extra FCM data. A key set by several
+// notifications takes the newest value.
+func mergeData(notifications []store.QueuedNotification) map[string]string {
+	var data map[string]string
+	for _, notif := range notifications {
+		for k, v := range notif.Data {
+			if data == nil {
+				data = make(map[string]string)
+			}
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// latestEndpointOptions returns the endpoint options of the most recently
+// queued notification, which reflect the endpoint's current settings.
+func latestEndpointOptions(notifications []store.QueuedNotification) map[string]string {
+	if len(notifications) == 0 {
+		return nil
+	}
+	return notifications[len(notifications)-1].EndpointOptions
+}
+
+// releaseWhenLocked unlocks entry once the abandoned lock attempt that will
+// close locked succeeds, so giving up on the lock doesn't leave it held.
+func releaseWhenLocked(entry *batchEntry, locked <-chan struct{}) {
+	<-locked
+	entry.mu.Unlock()
+}
+
+// BatchWindow returns how long notifications wait before their batch flushes.
+func (b *Batcher) BatchWindow() time.Duration {
+	return b.cfg.BatchWindow
+}
+
+// Drops returns counts of notifications that could not be queued.
+func (b *Batcher) Drops() DropStats {
+	stats := DropStats{
+		LockTimeout: b.drops.lockTimeout.Load(),
+		Cancelled:   b.drops.cancelled.Load(),
+		Stopped:     b.drops.stopped.Load(),
+		Rejected:    b.drops.rejected.Load(),
+
+		StoreUnavailable: b.drops.storeUnavailable.Load(),
+		InvalidToken:     b.drops.invalidToken.Load(),
+	}
+	stats.Total = stats.LockTimeout + stats.Cancelled + stats.Stopped + stats.Rejected + stats.StoreUnavailable + stats.InvalidToken
+	return stats
+}
+
+// FlushErrors returns counts of failed flush attempts, keyed by FCM error
+// code (e.g. "UNREGISTERED") or cause ("timeout", "rate_limited",
+// "crypt_key", "other"). Retried flushes count once per attempt.
+func (b *Batcher) FlushErrors() map[string]uint64 {
+	b.flushErrors.mu.Lock()
+	defer b.flushErrors.mu.Unlock()
+	counts := make(map[string]uint64, len(b.flushErrors.counts))
+	for class, n := range b.flushErrors.counts {
+		counts[class] = n
+	}
+	return counts
+}
+
+// requestIDs returns the request IDs of the given notifications.
+func requestIDs(notifications []store.QueuedNotification) []string {
+	ids := make([]string, 0, len(notifications))
+	for _, notif := range notifications {
+		ids = append(ids, notif.RequestID)
+	}
+	return ids
+}
+
+// withTrace returns ctx carrying the trace IDs of batch's notifications, for
+// the log lines and store metrics about the batch.
+func withTrace(ctx context.Context, batch *store.Batch) context.Context {
+	ids := make([]string, 0, len(batch.Notifications))
+	for _, notif := range batch.Notifications {
+		ids = append(ids, notif.TraceID)
+	}
+	return logfield.WithTrace(ctx, ids...)
+}
+
+// dropExpired removes notifications whose deadline has passed from the batch,
+// marking them expired. Returns false if nothing is left to send.
+// Caller must hold entry.mu.
+func (b *Batcher) dropExpired(ctx context.Context, fcmToken string, entry *batchEntry) bool {
+	now := time.Now()
+
+	var live []store.QueuedNotification
+	var expiredIDs []string
+	for _, notif := range entry.batch.Notifications {
+		if !notif.Deadline.IsZero() && now.After(notif.Deadline) {
+			expiredIDs = append(expiredIDs, notif.RequestID)
+			continue
+		}
+		live = append(live, notif)
+	}
+
+	if len(expiredIDs) == 0 {
+		return true
+	}
+
+	log.Printf("INFO: dropping %d expired notifications for %s%s", len(expiredIDs), fcmToken, logfield.Format(logfield.Trace(ctx)))
+	return b.removeNotifications(ctx, fcmToken, entry, live, expiredIDs, store.Status{
+		State:     store.StatusExpired,
+		Error:     "delivery deadline passed before flush",
+		ExpiresAt: b.statusExpiry(store.StatusExpired, now),
+	})
+}
+
+// removeNotifications removes the notifications with removedIDs from the
+// batch, leaving live, and gives them status. Returns false if nothing is
+// left to send.
+// Caller must hold entry.mu.
+func (b *Batcher) removeNotifications(ctx context.Context, fcmToken string, entry *batchEntry, live []store.QueuedNotification, removedIDs []string, status store.Status) bool {
+	b.emitDropped(fcmToken, entry.batch, removedIDs, status.State)
+	if len(live) == 0 {
+		if err := b.deleteBatch(ctx, fcmToken, entry.batch, status); err != nil {
+			log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		}
+		entry.batch = nil
+
+		b.mu.Lock()
+		delete(b.timers, fcmToken)
+		b.mu.Unlock()
+		return false
+	}
+
+	// Set the status before rewriting the batch; if we crash in between,
+	// recovery removes the same notifications again.
+	if err := b.store.SetStatus(ctx, fcmToken, removedIDs, status); err != nil {
+		log.Printf("ERROR: failed to mark %s requests for %s: %v%s", status.State, fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	entry.batch.Notifications = live
+	b.saveBatch(ctx, fcmToken, entry.batch)
+	return true
+}
+
+// giveUpReason returns why a batch whose flush just failed should be
+// dead-lettered instead of retried, or "" to retry it.
+func (b *Batcher) giveUpReason(batch *store.Batch, now time.Time) string {
+	if b.cfg.MaxFlushAttempts > 0 && batch.Attempts >= b.cfg.MaxFlushAttempts {
+		return fmt.Sprintf("%d flush attempts failed", batch.Attempts)
+	}
+	if age := now.Sub(batch.CreatedAt); b.cfg.MaxBatchAge > 0 && age >= b.cfg.MaxBatchAge {
+		return fmt.Sprintf("still undelivered after %s", age.Round(time.Second))
+	}
+	return ""
+}
+
+// deadLetter gives up on the batch for fcmToken, moving it to the dead
+// letters and marking its requests failed_permanent with reason.
+// Caller must hold entry.mu.
+func (b *Batcher) deadLetter(ctx context.Context, fcmToken string, entry *batchEntry, reason string) {
+	log.Printf("ERROR: giving up on batch for %s: %s%s", fcmToken, reason, logfield.Format(logfield.Trace(ctx)))
+	if err := b.deleteBatch(ctx, fcmToken, entry.batch, store.Status{
+		State:     store.StatusFailedPermanent,
+		Error:     reason,
+		ExpiresAt: b.statusExpiry(store.StatusFailedPermanent, time.Now()),
+	}); err != nil {
+		log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		b.storeFailed(ctx, "updating status", err)
+	} else {
+		b.storeSucceeded()
+	}
+	b.deadLettered.Add(1)
+	b.emitDropped(fcmToken, entry.batch, requestIDs(entry.batch.Notifications), store.StatusFailedPermanent)
+
+	entry.batch = nil
+
+	b.mu.Lock()
+	delete(b.timers, fcmToken)
+	b.mu.Unlock()
+}
+
+// DeadLettered returns how many batches were given up on since startup.
+func (b *Batcher) DeadLettered() uint64 {
+	return b.deadLettered.Load()
+}
+
+// messageTTL returns the FCM TTL for a batch: the time until the latest
+// deadline, so no notification is cut short. Zero if any notification has no deadline.
+func messageTTL(notifications []store.QueuedNotification, now time.Time) time.Duration {
+	var latest time.Time
+	for _, notif := range notifications {
+		if notif.Deadline.IsZero() {
+			return 0
+		}
+		if notif.Deadline.After(latest) {
+			latest = notif.Deadline
+		}
+	}
+	if ttl := latest.Sub(now); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// uniqueDataIDs returns dataIDs with duplicates removed, preserving order.
+func uniqueDataIDs(dataIDs [][]byte) [][]byte {
+	seen := make(map[string]bool, len(dataIDs))
+	unique := make([][]byte, 0, len(dataIDs))
+	for _, id := range dataIDs {
+		if seen[string(id)] {
+			continue
+		}
+		seen[string(id)] = true
+		unique = append(unique, id)
+	}
+	return unique
+}
+
 // Recover loads persisted batches from the database and flushes them synchronously.
-// Call this at startup before processing new requests.
+// Batches for tokens FCM has reported unregistered are skipped rather than sent.
+// Call this at startup before processing new requests, or, with
+// RecoveryWeight and FlushConcurrency set, alongside them: the recovered
+// flushes then take turns with fresh ones on the flush workers, and Recover
+// returns once they have run.
+// With RecoveryRate set, flushes are started no faster than that; progress
+// is logged every 10s and reported by RecoveryProgress.
 func (b *Batcher) Recover(ctx context.Context) error {
+	return b.RecoverDue(ctx, time.Time{})
+}
+
+// RecoverDue is like Recover, but only flushes batches due before cutoff; a
+// zero cutoff recovers them all. Batches this Batcher already holds in memory
+// are left to their timers, with any persisted notifications they lack merged
+// in, so it is safe to call while serving. A process taking over from one
+// that is still draining uses it to leave the old process's not-yet-due
+// batches alone.
+func (b *Batcher) RecoverDue(ctx context.Context, cutoff time.Time) error {
 	const pageSize = 100
 
+	b.recovery.start()
+	defer b.recovery.finish()
+
+	// Batches left in the DB after their turn, such as retries waiting for
+	// their time and flushes the sender rescheduled, are loaded again by
+	// later pages. Track them so they are visited once, and load past them
+	// so they can't fill a page and stall recovery.
+	seen := make(map[string]bool)
+	limit := pageSize
+
 	for {
-		batches, err := b.store.LoadOldestBatches(ctx, pageSize)
+		batches, err := b.store.LoadOldestBatches(ctx, limit)
 		if err != nil {
 			return err
 		}
@@ -241,22 +1280,293 @@ func (b *Batcher) Recover(ctx context.Context) error {
 			break
 		}
 
-		// Flush each batch synchronously
-		for fcmToken, batch := range batches {
-			entry := b.getOrCreateEntry(fcmToken)
-			entry.batch = batch
-			b.flushSync(ctx, fcmToken)
+		// Flush each batch, oldest first, and wait for the page to finish
+		var pending sync.WaitGroup
+		visited := 0
+		for _, fcmToken := range tokensByFlushAt(batches) {
+			if seen[fcmToken] {
+				continue
+			}
+			seen[fcmToken] = true
+			visited++
+			b.recovery.loaded.Add(1)
+
+			// Oldest first, so none of the remaining batches are due either
+			if !cutoff.IsZero() && batches[fcmToken].FlushAt.After(cutoff) {
+				return b.waitRecovered(ctx, &pending)
+			}
+
+			if b.skipInvalidToken(withTrace(ctx, batches[fcmToken]), fcmToken, batches[fcmToken]) {
+				b.recovery.skipped.Add(1)
+				continue
+			}
+			if b.dropTakenOver(withTrace(ctx, batches[fcmToken]), fcmToken, batches[fcmToken]) {
+				b.recovery.skipped.Add(1)
+				continue
+			}
+
+			// A retry the previous run scheduled waits for its time, as it
+			// would have there, and keeps its attempt count
+			if pendingRetry(batches[fcmToken], time.Now()) {
+				if !b.adopt(ctx, fcmToken, batches[fcmToken]) {
+					b.recovery.skipped.Add(1)
+					continue
+				}
+				b.startTimer(fcmToken, time.Until(batches[fcmToken].FlushAt))
+				b.retries.resumed.Add(1)
+				b.recovery.deferred.Add(1)
+				continue
+			}
+
+			// Paced before adopting, so a batch left waiting stays in the
+			// store for the next recovery
+			if b.recoveryLimiter != nil {
+				if err := b.recoveryLimiter.Wait(ctx); err != nil {
+					return err
+				}
+			}
+			if !b.adopt(ctx, fcmToken, batches[fcmToken]) {
+				b.recovery.skipped.Add(1)
+				continue
+			}
+			b.recovery.flushed.Add(1)
+			b.recovery.logProgress()
+			if b.flushQueue != nil && b.cfg.RecoveryWeight > 0 {
+				pending.Add(1)
+				b.flushQueue.pushRecovered(fcmToken, batches[fcmToken].FlushAt, pending.Done)
+				continue
+			}
+			b.flushSync(ctx, fcmToken, false)
+		}
+		if err := b.waitRecovered(ctx, &pending); err != nil {
+			return err
 		}
 
-		if len(batches) < pageSize {
+		// A short page held every stored batch
+		if len(batches) < limit {
 			break
 		}
-		// Flushed batches are deleted from DB, so next query returns new oldest
+		// Flushed batches are deleted from DB, so the next page holds new
+		// batches past the ones visited before this page, which stay. Ones
+		// visited in this page may stay too; if they fill the next page,
+		// it visits nothing and the one after is wider still.
+		limit = pageSize + len(batches) - visited
 	}
 
 	return nil
 }
 
+// waitRecovered waits for the recovered flushes in pending to finish, or
+// for ctx to be cancelled.
+func (b *Batcher) waitRecovered(ctx context.Context, pending *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// adopt makes a persisted batch the pending batch for fcmToken. Returns true
+// if adopted, for the caller to flush.
+//
+// Pushes queued while recovery runs may have started a batch in memory for
+// the same token, which replaced the persisted one in the store. The
+// persisted notifications that batch lacks are merged into it instead, keeping
+// their request IDs, and it is flushed by its timer.
+func (b *Batcher) adopt(ctx context.Context, fcmToken string, batch *store.Batch) bool {
+	entry := b.getOrCreateEntry(fcmToken)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.batch == nil || len(entry.batch.Notifications) == 0 {
+		entry.batch = batch
+		entry.recovered = true
+		return true
+	}
+
+	// The persisted notifications were queued first
+	live := entry.batch
+	merged := live.Merge(batch)
+	if merged == 0 {
+		return false
+	}
+	ctx = withTrace(ctx, batch)
+	log.Printf("INFO: merged %d recovered notifications into the pending batch for %s%s", merged, fcmToken, logfield.Format(logfield.Trace(ctx)))
+
+	// Flush when the persisted batch was due, if sooner, or now if full
+	wait := max(time.Until(live.FlushAt), 0)
+	if b.full(live, b.cfg.MaxBatchSize) {
+		wait = 0
+	}
+	b.saveBatch(ctx, fcmToken, live)
+	b.startTimer(fcmToken, wait)
+	return false
+}
+
+// ImportBatch adds a batch exported from another instance to the pending
+// batches, merging it into the batch already pending for fcmToken, if any.
+// It flushes when it was due there, or right away if that has passed or it
+// is full.
+func (b *Batcher) ImportBatch(ctx context.Context, fcmToken string, batch *store.Batch) error {
+	entry := b.getOrCreateEntry(fcmToken)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	b.mu.Lock()
+	stopped := b.stopped
+	b.mu.Unlock()
+	if stopped {
+		return context.Canceled
+	}
+
+	if entry.batch == nil || len(entry.batch.Notifications) == 0 {
+		entry.batch = batch
+	} else if entry.batch.Merge(batch) == 0 {
+		return nil
+	}
+
+	if err := b.saveBatch(ctx, fcmToken, entry.batch); err != nil {
+		return err
+	}
+	wait := max(time.Until(entry.batch.FlushAt), 0)
+	if b.full(entry.batch, b.cfg.MaxBatchSize) {
+		wait = 0
+	}
+	b.startTimer(fcmToken, wait)
+	return nil
+}
+
+// ImportStatuses writes statuses exported from another instance to the
+// store. See store.Store.ImportStatuses.
+func (b *Batcher) ImportStatuses(ctx context.Context, records []store.StatusRecord) error {
+	return b.store.ImportStatuses(ctx, records)
+}
+
+// WriteSnapshot writes the persisted batches and statuses to w, for another
+// instance to import. See store.WriteSnapshot.
+func (b *Batcher) WriteSnapshot(ctx context.Context, w io.Writer) (store.SnapshotCounts, error) {
+	return store.WriteSnapshot(ctx, b.store, w)
+}
+
+// FlushPending synchronously flushes every batch held in memory without
+// waiting for its window or MinSendInterval. A process handing off to a successor calls it after
+// it stops accepting pushes and before Stop, so nothing is left waiting for a
+// recovery that has already run.
+func (b *Batcher) FlushPending(ctx context.Context) {
+	b.mu.Lock()
+	tokens := make([]string, 0, len(b.batches))
+	for fcmToken := range b.batches {
+		tokens = append(tokens, fcmToken)
+	}
+	b.mu.Unlock()
+
+	for _, fcmToken := range tokens {
+		if ctx.Err() != nil {
+			return
+		}
+		b.flushSync(ctx, fcmToken, true)
+	}
+}
+
+// skipInvalidToken marks the recovered batch skipped_invalid_token and
+// deletes it if FCM previously reported fcmToken unregistered. Returns true
+// if skipped.
+func (b *Batcher) skipInvalidToken(ctx context.Context, fcmToken string, batch *store.Batch) bool {
+	invalid, err := b.store.IsInvalidToken(ctx, fcmToken)
+	if err != nil {
+		log.Printf("WARNING: invalid token check failed for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		return false
+	}
+	if !invalid {
+		return false
+	}
+
+	log.Printf("INFO: skipping recovered batch for unregistered token %s%s", fcmToken, logfield.Format(logfield.Trace(ctx)))
+	if err := b.deleteBatch(ctx, fcmToken, batch, store.Status{
+		State:     store.StatusSkippedInvalidToken,
+		Error:     "FCM token no longer registered",
+		ExpiresAt: b.statusExpiry(store.StatusSkippedInvalidToken, time.Now()),
+	}); err != nil {
+		log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	b.emitDropped(fcmToken, batch, requestIDs(batch.Notifications), store.StatusSkippedInvalidToken)
+	return true
+}
+
+// RequeueFailed requeues deliveries that failed within the last since duration,
+// reusing their original request IDs so status polling continues to work.
+// Each is marked requeued before it is queued, so a flush failing it again
+// can't be overwritten, and concurrent calls queue it once.
+// Returns the number of requests requeued.
+func (b *Batcher) RequeueFailed(ctx context.Context, since time.Duration) (int, error) {
+	failed, err := b.store.LoadFailedSince(ctx, time.Now().Add(-since))
+	if err != nil {
+		return 0, err
+	}
+
+	requeued := 0
+	for _, fd := range failed {
+		claimed, err := b.store.MarkRequeued(ctx, fd)
+		if err != nil {
+			log.Printf("WARNING: failed to mark request %s requeued: %v", fd.RequestID, err)
+			continue
+		}
+		if !claimed {
+			// Requeued by another call, or failed again since it was loaded
+			continue
+		}
+		if err := b.enqueue(ctx, "", fd.FcmToken, store.QueuedNotification{
+			DataIDs:   fd.DataIDs,
+			RequestID: fd.RequestID,
+		}, flushPolicy{window: b.defaultWindow(), maxSize: b.cfg.MaxBatchSize}); err != nil {
+			log.Printf("WARNING: failed to requeue request %s: %v", fd.RequestID, err)
+			// Its retained copy is gone, so it can't be requeued again
+			if err := b.store.SetStatus(ctx, fd.FcmToken, []string{fd.RequestID}, store.Status{
+				State:     store.StatusFailed,
+				Error:     "requeue failed",
+				ExpiresAt: b.statusExpiry(store.StatusFailed, time.Now()),
+			}); err != nil {
+				log.Printf("ERROR: failed to update status for %s: %v", fd.RequestID, err)
+			}
+			continue
+		}
+		requeued++
+	}
+
+	return requeued, nil
+}
+
+// FailedSince returns the deliveries that failed within since and are still
+// retained for requeueing, oldest first.
+func (b *Batcher) FailedSince(ctx context.Context, since time.Duration) ([]store.FailedDelivery, error) {
+	return b.store.LoadFailedSince(ctx, time.Now().Add(-since))
+}
+
+// ListByRecipient returns the pending batches for endpoints owned by recipient,
+// keyed by FCM token.
+func (b *Batcher) ListByRecipient(ctx context.Context, recipient string) (map[string]*store.Batch, error) {
+	return b.store.ListBatchesByRecipient(ctx, recipient)
+}
+
+// DeliveryHistory returns daily per-sender delivery counts rolled up from
+// expired statuses, from since onward. A non-empty sender limits the results
+// to that sender.
+func (b *Batcher) DeliveryHistory(ctx context.Context, since time.Time, sender string) ([]store.DailySummary, error) {
+	return b.store.ListDailySummaries(ctx, since, sender)
+}
+
+// StatusesSince returns up to limit request statuses updated at or after
+// since that come after the cursor, in update order.
+func (b *Batcher) StatusesSince(ctx context.Context, since time.Time, after store.StatusCursor, limit int) ([]store.StatusRecord, error) {
+	return b.store.ListStatusesSince(ctx, since, after, limit)
+}
+
 // Stop gracefully shuts down the batcher.
 // Pending batches remain in the database for recovery on restart.
 // In-memory batches that haven't been persisted yet may be lost, but this window
@@ -272,6 +1582,25 @@ func (b *Batcher) Stop() {
 	}
 	b.timers = make(map[string]*time.Timer)
 	b.mu.Unlock()
+
+	// Abort in-flight flushes; their batches stay in the DB
+	b.cancel()
+
+	if b.flushQueue != nil {
+		b.flushQueue.stop()
+	}
+	b.events.close()
+}
+
+// ReconcileLost marks statuses that have been pending longer than LostAfter,
+// and whose batch no longer exists, as lost so pollers get a final answer.
+// Returns the number of statuses marked.
+func (b *Batcher) ReconcileLost(ctx context.Context) (int64, error) {
+	if b.cfg.LostAfter <= 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	return b.store.MarkLost(ctx, now.Add(-b.cfg.LostAfter), b.statusExpiry(store.StatusLost, now))
 }
 
 // GetStatus returns the delivery status for a request.
@@ -3,12 +3,16 @@ package batcher
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
 )
 
@@ -23,25 +27,65 @@ type mockSender struct {
 type sendCall struct {
 	FcmToken string
 	DataIDs  [][]byte
+	TTL      time.Duration
+	Title    string
+	Body     string
+	Sender   string
+	Data     map[string]string
+
+	DataSenders map[string]string
+	Endpoint    map[string]string
+	CryptKey    []byte
+	Trace       []string
 }
 
-func (m *mockSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte) error {
+func (m *mockSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.calls = append(m.calls, sendCall{FcmToken: fcmToken, DataIDs: dataIDs})
+	m.calls = append(m.calls, sendCall{
+		FcmToken: fcmToken,
+		DataIDs:  dataIDs,
+		TTL:      opts.TTL,
+		Title:    opts.Title,
+		Body:     opts.Body,
+		Sender:   opts.Sender,
+		Data:     opts.Data,
+
+		DataSenders: opts.DataSenders,
+		Endpoint:    opts.Endpoint,
+		CryptKey:    opts.CryptKey,
+		Trace:       logfield.TraceIDs(ctx),
+	})
 
 	if m.failCount > 0 {
 		m.failCount--
 		if m.failErr != nil {
-			return m.failErr
+			return "", m.failErr
 		}
-		return errors.New("mock send error")
+		return "", errors.New("mock send error")
 	}
 
-	return nil
+	return fmt.Sprintf("projects/test/messages/%d", len(m.calls)), nil
+}
+
+func (m *mockSender) SendVisible(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	return m.Send(ctx, fcmToken, dataIDs, opts)
 }
 
+// invalidTokenErr is a sender error for a token FCM no longer knows.
+type invalidTokenErr struct{}
+
+func (invalidTokenErr) Error() string      { return "NotRegistered" }
+func (invalidTokenErr) InvalidToken() bool { return true }
+func (invalidTokenErr) ErrorCode() string  { return "UNREGISTERED" }
+
+// codedErr is a sender error carrying an FCM error code.
+type codedErr struct{ code string }
+
+func (e codedErr) Error() string     { return "fcm error " + e.code }
+func (e codedErr) ErrorCode() string { return e.code }
+
 func (m *mockSender) getCalls() []sendCall {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -92,7 +136,7 @@ func TestQueue_FirstItemStartsTimer(t *testing.T) {
 	defer b.Stop()
 
 	// Queue first item
-	requestID, err := b.Queue(context.Background(), "token1", [][]byte{{1, 2, 3}})
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1, 2, 3}})
 	if err != nil {
 		t.Fatalf("Queue() error = %v", err)
 	}
@@ -130,7 +174,7 @@ func TestQueue_MaxSizeTriggersImmediateFlush(t *testing.T) {
 
 	// Queue items up to max size
 	for i := 0; i < 5; i++ {
-		_, err := b.Queue(context.Background(), "token1", [][]byte{{byte(i)}})
+		_, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{byte(i)}})
 		if err != nil {
 			t.Fatalf("Queue() error = %v", err)
 		}
@@ -151,6 +195,98 @@ func TestQueue_MaxSizeTriggersImmediateFlush(t *testing.T) {
 	}
 }
 
+func TestQueue_MaxDataIDsFlushesAndSplits(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute, // Long window - won't trigger
+		MaxBatchSize:    100,
+		MaxDataIDs:      3,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	// Two notifications carrying five data IDs reach the cap on their own
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}, {2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	requestID, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{3}, {4}, {5}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 send calls, got %d", len(calls))
+	}
+	if len(calls[0].DataIDs) != 3 || len(calls[1].DataIDs) != 2 || calls[1].DataIDs[0][0] != 4 {
+		t.Errorf("sent data IDs = %v then %v, want 3 then the remaining 2", calls[0].DataIDs, calls[1].DataIDs)
+	}
+	status, err := b.GetStatus(ctx, requestID)
+	if err != nil || status.State != store.StatusSent || status.MessageID != "projects/test/messages/2" {
+		t.Errorf("GetStatus() = %+v, %v; want sent with the last message ID", status, err)
+	}
+}
+
+func TestFlush_MinSendIntervalDefersNextBatch(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     10 * time.Millisecond,
+		MaxBatchSize:    2,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		MinSendInterval: 150 * time.Millisecond,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := sender.callCount(); n != 1 {
+		t.Fatalf("expected the first batch sent after its window, got %d sends", n)
+	}
+
+	// A full batch would normally flush at once
+	for i := 2; i <= 3; i++ {
+		if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{byte(i)}}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := sender.callCount(); n != 1 {
+		t.Fatalf("expected the second batch held back by the interval, got %d sends", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	calls := sender.getCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected the second batch sent once the interval passed, got %d sends", len(calls))
+	}
+	if len(calls[1].DataIDs) != 2 {
+		t.Errorf("expected 2 data IDs in the deferred batch, got %d", len(calls[1].DataIDs))
+	}
+
+	// Other endpoints aren't affected
+	if _, err := b.Queue(ctx, "bob@oc", "token2", [][]byte{{4}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := sender.callCount(); n != 3 {
+		t.Errorf("expected another endpoint sent after its window, got %d sends", n)
+	}
+}
+
 func TestQueue_TimerExpiryFlushes(t *testing.T) {
 	st, cleanup := createTestStore(t)
 	defer cleanup()
@@ -165,7 +301,7 @@ func TestQueue_TimerExpiryFlushes(t *testing.T) {
 	defer b.Stop()
 
 	// Queue single item
-	_, err := b.Queue(context.Background(), "token1", [][]byte{{1, 2, 3}})
+	_, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1, 2, 3}})
 	if err != nil {
 		t.Fatalf("Queue() error = %v", err)
 	}
@@ -213,11 +349,11 @@ func TestRecover_RestoresAndFlushesPendingBatches(t *testing.T) {
 	})
 
 	// Queue items to two different endpoints
-	_, err = b1.Queue(context.Background(), "token-a", [][]byte{{1, 2, 3}})
+	_, err = b1.Queue(context.Background(), "bob@oc", "token-a", [][]byte{{1, 2, 3}})
 	if err != nil {
 		t.Fatalf("Queue() error = %v", err)
 	}
-	_, err = b1.Queue(context.Background(), "token-b", [][]byte{{4, 5, 6}})
+	_, err = b1.Queue(context.Background(), "bob@oc", "token-b", [][]byte{{4, 5, 6}})
 	if err != nil {
 		t.Fatalf("Queue() error = %v", err)
 	}
@@ -283,9 +419,9 @@ func TestQueue_MultipleEndpoints(t *testing.T) {
 	defer b.Stop()
 
 	// Queue to different endpoints
-	_, _ = b.Queue(context.Background(), "token1", [][]byte{{1}})
-	_, _ = b.Queue(context.Background(), "token2", [][]byte{{2}})
-	_, _ = b.Queue(context.Background(), "token1", [][]byte{{3}}) // Add to first endpoint
+	_, _ = b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	_, _ = b.Queue(context.Background(), "bob@oc", "token2", [][]byte{{2}})
+	_, _ = b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{3}}) // Add to first endpoint
 
 	// Wait for timers to expire
 	time.Sleep(60 * time.Millisecond)
@@ -324,7 +460,7 @@ func TestQueue_StatusAfterFlush(t *testing.T) {
 	defer b.Stop()
 
 	// Queue item
-	requestID, err := b.Queue(context.Background(), "token1", [][]byte{{1}})
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
 	if err != nil {
 		t.Fatalf("Queue() error = %v", err)
 	}
@@ -352,6 +488,92 @@ func TestQueue_StatusAfterFlush(t *testing.T) {
 	}
 }
 
+func TestQueue_StatusContext(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		st, cleanup := createTestStore(t)
+		defer cleanup()
+
+		b := New(st, &mockSender{}, Config{
+			BatchWindow:     20 * time.Millisecond,
+			MaxBatchSize:    100,
+			LockTimeout:     100 * time.Millisecond,
+			StatusRetention: time.Hour,
+			PrivateStatus:   private,
+		})
+		defer b.Stop()
+
+		before := time.Now().Truncate(time.Second)
+		requestID, err := b.QueueWithOptions(context.Background(), "bob@oc", "token1", [][]byte{{1}}, QueueOptions{
+			Sender:   "alice@oc",
+			DeviceID: "phone",
+		})
+		if err != nil {
+			t.Fatalf("QueueWithOptions() error = %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		status, err := b.GetStatus(context.Background(), requestID)
+		if err != nil {
+			t.Fatalf("GetStatus() error = %v", err)
+		}
+
+		wantTarget, wantDevice := "bob@oc", "phone"
+		if private {
+			wantTarget, wantDevice = "", ""
+		}
+		if status.Sender != "alice@oc" || status.Target != wantTarget || status.DeviceID != wantDevice {
+			t.Errorf("private=%v: context = (%q, %q, %q), want (%q, %q, %q)", private,
+				status.Sender, status.Target, status.DeviceID, "alice@oc", wantTarget, wantDevice)
+		}
+		if status.QueuedAt.Before(before) || status.QueuedAt.After(time.Now()) {
+			t.Errorf("private=%v: QueuedAt = %v, want about %v", private, status.QueuedAt, before)
+		}
+	}
+}
+
+func TestQueue_TraceCarriedToFlush(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for i, trace := range []string{"req-1", "req-2", "req-1"} {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{byte(i)}}, QueueOptions{TraceID: trace}); err != nil {
+			t.Fatalf("QueueWithOptions() error = %v", err)
+		}
+	}
+
+	// The trace IDs are persisted, so they survive a restart
+	batches, err := st.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	var persisted []string
+	for _, notif := range batches["token1"].Notifications {
+		persisted = append(persisted, notif.TraceID)
+	}
+	if want := []string{"req-1", "req-2", "req-1"}; !reflect.DeepEqual(persisted, want) {
+		t.Errorf("persisted trace IDs = %v, want %v", persisted, want)
+	}
+
+	b.FlushPending(ctx)
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("sends = %d, want 1", len(calls))
+	}
+	if want := []string{"req-1", "req-2"}; !reflect.DeepEqual(calls[0].Trace, want) {
+		t.Errorf("flush trace = %v, want %v", calls[0].Trace, want)
+	}
+}
+
 func TestQueue_StatusAfterFailedFlush(t *testing.T) {
 	st, cleanup := createTestStore(t)
 	defer cleanup()
@@ -369,7 +591,7 @@ func TestQueue_StatusAfterFailedFlush(t *testing.T) {
 	defer b.Stop()
 
 	// Queue item
-	requestID, err := b.Queue(context.Background(), "token1", [][]byte{{1}})
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
 	if err != nil {
 		t.Fatalf("Queue() error = %v", err)
 	}
@@ -407,7 +629,7 @@ func TestQueue_StoppedBatcherRejects(t *testing.T) {
 	b.Stop()
 
 	// Queue should fail
-	_, err := b.Queue(context.Background(), "token1", [][]byte{{1}})
+	_, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
 	if err == nil {
 		t.Error("expected error when queuing to stopped batcher")
 	}
@@ -438,7 +660,7 @@ func TestQueue_ConcurrentAccess(t *testing.T) {
 			defer wg.Done()
 			for j := 0; j < itemsPerGoroutine; j++ {
 				token := "token" // All go to same endpoint
-				_, err := b.Queue(context.Background(), token, [][]byte{{byte(goroutineID), byte(j)}})
+				_, err := b.Queue(context.Background(), "bob@oc", token, [][]byte{{byte(goroutineID), byte(j)}})
 				if err == nil {
 					atomic.AddInt32(&successCount, 1)
 				}
@@ -492,6 +714,192 @@ func TestRecover_EmptyDatabase(t *testing.T) {
 	}
 }
 
+func TestImportBatch(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token-a", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// An overdue batch merges into the pending one, which then flushes
+	now := time.Now()
+	overdue := &store.Batch{
+		Recipient:     "bob@oc",
+		Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "imported-1"}},
+		CreatedAt:     now.Add(-2 * time.Minute),
+		FlushAt:       now.Add(-time.Minute),
+	}
+	if err := b.ImportBatch(ctx, "token-a", overdue); err != nil {
+		t.Fatalf("ImportBatch() error = %v", err)
+	}
+	// One that isn't due yet waits
+	later := &store.Batch{
+		Recipient:     "bob@oc",
+		Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{3}}, RequestID: "imported-2"}},
+		CreatedAt:     now,
+		FlushAt:       now.Add(time.Minute),
+	}
+	if err := b.ImportBatch(ctx, "token-b", later); err != nil {
+		t.Fatalf("ImportBatch() error = %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-a" {
+		t.Fatalf("sends = %+v, want one to token-a", calls)
+	}
+	if len(calls[0].DataIDs) != 2 || calls[0].DataIDs[0][0] != 1 || calls[0].DataIDs[1][0] != 2 {
+		t.Errorf("sent data IDs = %v, want the imported one then the queued one", calls[0].DataIDs)
+	}
+	status, err := b.GetStatus(ctx, "imported-1")
+	if err != nil || status.State != store.StatusSent {
+		t.Errorf("GetStatus(imported-1) = %+v, %v; want sent", status, err)
+	}
+}
+
+func TestRecover_SkipsInvalidTokens(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+	for _, token := range []string{"token-live", "token-gone"} {
+		if err := st.SaveBatch(ctx, token, &store.Batch{
+			Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "req-" + token}},
+			CreatedAt:     now,
+			FlushAt:       now,
+		}); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+	if err := st.RecordInvalidToken(ctx, "token-gone"); err != nil {
+		t.Fatalf("RecordInvalidToken() error = %v", err)
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-live" {
+		t.Errorf("sends = %v, want one for token-live", calls)
+	}
+
+	status, err := b.GetStatus(ctx, "req-token-gone")
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSkippedInvalidToken {
+		t.Errorf("expected state=%q, got %q", store.StatusSkippedInvalidToken, status.State)
+	}
+
+	batches, err := st.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 0 {
+		t.Errorf("expected skipped batch to be deleted, got %d batches", len(batches))
+	}
+}
+
+func TestFlush_RecordsInvalidToken(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{failCount: 1, failErr: invalidTokenErr{}}
+	b := New(st, sender, Config{
+		BatchWindow:     10 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	requestID, _ := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}})
+	time.Sleep(40 * time.Millisecond)
+
+	invalid, err := st.IsInvalidToken(ctx, "token1")
+	if err != nil {
+		t.Fatalf("IsInvalidToken() error = %v", err)
+	}
+	if !invalid {
+		t.Error("expected token1 to be recorded as invalid")
+	}
+
+	status, err := b.GetStatus(ctx, requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusFailed {
+		t.Errorf("expected state=%q, got %q", store.StatusFailed, status.State)
+	}
+	if status.ErrorCode != "UNREGISTERED" || status.Error != "" {
+		t.Errorf("expected error_code=UNREGISTERED and no error text, got code=%q error=%q", status.ErrorCode, status.Error)
+	}
+}
+
+func TestFlush_RecordsFCMResponse(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{failCount: 1, failErr: codedErr{code: "QUOTA_EXCEEDED"}}
+	b := New(st, sender, Config{
+		BatchWindow:     10 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	failedID, _ := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}})
+	time.Sleep(40 * time.Millisecond)
+	sentID, _ := b.Queue(ctx, "bob@oc", "token1", [][]byte{{2}})
+	time.Sleep(40 * time.Millisecond)
+
+	failed, err := b.GetStatus(ctx, failedID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if failed.State != store.StatusFailed || failed.ErrorCode != "QUOTA_EXCEEDED" || failed.Error != "" {
+		t.Errorf("failed status = %+v, want error_code QUOTA_EXCEEDED", failed)
+	}
+
+	sent, err := b.GetStatus(ctx, sentID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if sent.State != store.StatusSent || sent.MessageID != "projects/test/messages/2" {
+		t.Errorf("sent status = %+v, want message ID projects/test/messages/2", sent)
+	}
+
+	if got := b.FlushErrors(); !reflect.DeepEqual(got, map[string]uint64{"QUOTA_EXCEEDED": 1}) {
+		t.Errorf("FlushErrors() = %v, want one QUOTA_EXCEEDED", got)
+	}
+}
+
 func TestStop_CancelsTimers(t *testing.T) {
 	st, cleanup := createTestStore(t)
 	defer cleanup()
@@ -505,7 +913,7 @@ func TestStop_CancelsTimers(t *testing.T) {
 	})
 
 	// Queue item to start timer
-	_, _ = b.Queue(context.Background(), "token1", [][]byte{{1}})
+	_, _ = b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
 
 	// Verify timer exists
 	b.mu.Lock()
@@ -535,3 +943,1238 @@ func TestStop_CancelsTimers(t *testing.T) {
 		t.Errorf("expected no sends after stop, got %d", sender.callCount())
 	}
 }
+
+func TestFlush_DedupWindowSuppressesRecentlySent(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		DedupWindow:     time.Minute,
+	})
+	defer b.Stop()
+
+	// First batch is sent normally
+	_, _ = b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}, {1}})
+	time.Sleep(50 * time.Millisecond)
+
+	// Second batch repeats data ID {1} and adds {2}
+	_, _ = b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}, {2}})
+	time.Sleep(50 * time.Millisecond)
+
+	// Third batch only repeats already-sent IDs
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 send calls (third suppressed), got %d", len(calls))
+	}
+	if len(calls[0].DataIDs) != 1 {
+		t.Errorf("expected in-batch duplicates collapsed to 1 data ID, got %d", len(calls[0].DataIDs))
+	}
+	if len(calls[1].DataIDs) != 1 || calls[1].DataIDs[0][0] != 2 {
+		t.Errorf("expected only data ID {2} in second send, got %v", calls[1].DataIDs)
+	}
+
+	// Suppressed request still reports as sent
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSent {
+		t.Errorf("expected state=%q, got %q", store.StatusSent, status.State)
+	}
+}
+
+func TestRequeueFailed_ReusesRequestID(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{
+		failCount: 1,
+		failErr:   errors.New("FCM unavailable"),
+	}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1, 2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// First flush fails
+	time.Sleep(50 * time.Millisecond)
+
+	requeued, err := b.RequeueFailed(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatalf("RequeueFailed() error = %v", err)
+	}
+	if requeued != 1 {
+		t.Fatalf("expected 1 requeued request, got %d", requeued)
+	}
+
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusQueued {
+		t.Errorf("expected state=%q after requeue, got %q", store.StatusQueued, status.State)
+	}
+
+	// Second flush succeeds
+	time.Sleep(50 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 send calls, got %d", len(calls))
+	}
+	if len(calls[1].DataIDs) != 1 || calls[1].DataIDs[0][1] != 2 {
+		t.Errorf("expected retained data ID to be resent, got %v", calls[1].DataIDs)
+	}
+
+	status, err = b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSent {
+		t.Errorf("expected state=%q, got %q", store.StatusSent, status.State)
+	}
+
+	// Nothing left to requeue
+	requeued, err = b.RequeueFailed(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatalf("RequeueFailed() error = %v", err)
+	}
+	if requeued != 0 {
+		t.Errorf("expected 0 requeued requests, got %d", requeued)
+	}
+}
+
+// retryLaterError mimics a sender error asking for the flush to be delayed.
+type retryLaterError struct {
+	delay time.Duration
+}
+
+func (e *retryLaterError) Error() string             { return "rate limited" }
+func (e *retryLaterError) RetryAfter() time.Duration { return e.delay }
+
+func TestFlush_RetryableErrorReschedules(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{
+		failCount: 1,
+		failErr:   &retryLaterError{delay: 20 * time.Millisecond},
+	}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// First attempt is rate limited; no status recorded yet
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.GetStatus(context.Background(), requestID); err == nil {
+		t.Error("expected no status while flush is rescheduled")
+	}
+
+	// Rescheduled attempt succeeds
+	time.Sleep(50 * time.Millisecond)
+
+	if sender.callCount() != 2 {
+		t.Fatalf("expected 2 send attempts, got %d", sender.callCount())
+	}
+
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSent {
+		t.Errorf("expected state=%q, got %q", store.StatusSent, status.State)
+	}
+}
+
+func TestRequeueFailed_ConcurrentCallsQueueOnce(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{failCount: 1}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	if _, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	counts := make([]int, 4)
+	for i := range counts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counts[i], _ = b.RequeueFailed(context.Background(), time.Hour)
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != 1 {
+		t.Errorf("requeued %v times in total, want 1", counts)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	calls := sender.getCalls()
+	if len(calls) != 2 || len(calls[1].DataIDs) != 1 {
+		t.Errorf("sends = %+v, want the failed send and one resend of its data ID", calls)
+	}
+}
+
+func TestListByRecipient(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	_, _ = b.Queue(ctx, "alice@oc", "alice-phone", [][]byte{{1}})
+	_, _ = b.Queue(ctx, "alice@oc", "alice-tablet", [][]byte{{2}})
+	_, _ = b.Queue(ctx, "bob@oc", "bob-phone", [][]byte{{3}})
+
+	batches, err := b.ListByRecipient(ctx, "alice@oc")
+	if err != nil {
+		t.Fatalf("ListByRecipient() error = %v", err)
+	}
+	if len(batches) != 2 || batches["alice-phone"] == nil || batches["alice-tablet"] == nil {
+		t.Fatalf("expected alice's two batches, got %v", batches)
+	}
+	if batches["alice-phone"].Recipient != "alice@oc" {
+		t.Errorf("Recipient = %q, want %q", batches["alice-phone"].Recipient, "alice@oc")
+	}
+
+	batches, err = b.ListByRecipient(ctx, "carol@oc")
+	if err != nil {
+		t.Fatalf("ListByRecipient() error = %v", err)
+	}
+	if len(batches) != 0 {
+		t.Errorf("expected no batches for carol@oc, got %d", len(batches))
+	}
+}
+
+func TestFlush_DropsExpiredAndSetsTTL(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     50 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	expiredID, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{1}}, QueueOptions{
+		Deadline: time.Now().Add(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	liveID, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{2}}, QueueOptions{
+		Deadline: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 send call, got %d", len(calls))
+	}
+	if len(calls[0].DataIDs) != 1 || calls[0].DataIDs[0][0] != 2 {
+		t.Errorf("expected only the live data ID {2}, got %v", calls[0].DataIDs)
+	}
+	if calls[0].TTL <= 59*time.Minute || calls[0].TTL > time.Hour {
+		t.Errorf("TTL = %s, want just under 1h", calls[0].TTL)
+	}
+
+	status, err := b.GetStatus(ctx, expiredID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusExpired {
+		t.Errorf("expected state=%q for expired request, got %q", store.StatusExpired, status.State)
+	}
+
+	status, err = b.GetStatus(ctx, liveID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSent {
+		t.Errorf("expected state=%q for live request, got %q", store.StatusSent, status.State)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		deadlines []time.Time
+		want      time.Duration
+	}{
+		{name: "no deadlines", deadlines: []time.Time{{}, {}}, want: 0},
+		{name: "mixed", deadlines: []time.Time{now.Add(time.Minute), {}}, want: 0},
+		{name: "latest wins", deadlines: []time.Time{now.Add(time.Minute), now.Add(time.Hour)}, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var notifications []store.QueuedNotification
+			for _, d := range tt.deadlines {
+				notifications = append(notifications, store.QueuedNotification{Deadline: d})
+			}
+			if got := messageTTL(notifications, now); got != tt.want {
+				t.Errorf("messageTTL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// hangingSender blocks until the context is done for the first hangCount sends.
+type hangingSender struct {
+	mockSender
+	hangCount int
+}
+
+func (h *hangingSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	h.mu.Lock()
+	hang := h.hangCount > 0
+	if hang {
+		h.hangCount--
+	}
+	h.mu.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return h.mockSender.Send(ctx, fcmToken, dataIDs, opts)
+}
+
+func TestFlush_TimeoutMarksTimedOutAndRetries(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &hangingSender{hangCount: 1}
+	b := New(st, sender, Config{
+		BatchWindow:     50 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		FlushTimeout:    20 * time.Millisecond,
+	})
+	defer b.Stop()
+
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// First flush at 50ms hangs until the 20ms timeout
+	time.Sleep(90 * time.Millisecond)
+
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusTimedOut {
+		t.Fatalf("expected state=%q after timeout, got %q", store.StatusTimedOut, status.State)
+	}
+
+	// Retry after another batch window succeeds
+	time.Sleep(80 * time.Millisecond)
+
+	status, err = b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSent {
+		t.Errorf("expected state=%q after retry, got %q", store.StatusSent, status.State)
+	}
+	if sender.callCount() != 1 {
+		t.Errorf("expected 1 completed send, got %d", sender.callCount())
+	}
+}
+
+func TestFlush_GivesUpAfterMaxAttempts(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &hangingSender{hangCount: 100}
+	b := New(st, sender, Config{
+		BatchWindow:      20 * time.Millisecond,
+		MaxBatchSize:     100,
+		LockTimeout:      100 * time.Millisecond,
+		StatusRetention:  time.Hour,
+		FlushTimeout:     10 * time.Millisecond,
+		MaxFlushAttempts: 2,
+	})
+	defer b.Stop()
+
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// Attempts at ~30ms and ~60ms both time out
+	time.Sleep(150 * time.Millisecond)
+
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusFailedPermanent {
+		t.Fatalf("expected state=%q, got %q", store.StatusFailedPermanent, status.State)
+	}
+	if !strings.Contains(status.Error, "2 flush attempts failed") {
+		t.Errorf("error = %q, want the attempt count", status.Error)
+	}
+	if got := b.DeadLettered(); got != 1 {
+		t.Errorf("DeadLettered() = %d, want 1", got)
+	}
+
+	batches, err := st.LoadOldestBatches(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 0 {
+		t.Errorf("expected dead-lettered batch removed from pending, got %d batches", len(batches))
+	}
+
+	// No further attempts once given up
+	time.Sleep(60 * time.Millisecond)
+	sender.mu.Lock()
+	remaining := sender.hangCount
+	sender.mu.Unlock()
+	if remaining != 98 {
+		t.Errorf("expected 2 send attempts, got %d", 100-remaining)
+	}
+}
+
+func TestFlush_GivesUpAfterMaxAge(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{
+		failCount: 100,
+		failErr:   &retryLaterError{delay: 20 * time.Millisecond},
+	}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		MaxBatchAge:     50 * time.Millisecond,
+	})
+	defer b.Stop()
+
+	requestID, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// Rate-limited flushes reschedule until the batch is 50ms old
+	time.Sleep(150 * time.Millisecond)
+
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusFailedPermanent {
+		t.Fatalf("expected state=%q, got %q", store.StatusFailedPermanent, status.State)
+	}
+	if calls := sender.callCount(); calls < 2 || calls > 4 {
+		t.Errorf("expected 2-4 send attempts, got %d", calls)
+	}
+}
+
+func TestStop_CancelsInFlightFlush(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &hangingSender{hangCount: 1}
+	b := New(st, sender, Config{
+		BatchWindow:     10 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+
+	_, _ = b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	time.Sleep(30 * time.Millisecond) // flush is now hanging
+
+	b.Stop()
+	time.Sleep(20 * time.Millisecond)
+
+	// Batch remains persisted for recovery
+	batches, err := st.LoadOldestBatches(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if batches["token1"] == nil {
+		t.Error("expected cancelled batch to remain in store")
+	}
+}
+
+// stubRenderer renders fixed text, failing for recipients in fail.
+type stubRenderer struct {
+	fail map[string]bool
+}
+
+func (r *stubRenderer) Render(ctx context.Context, recipient string, count int) (string, string, error) {
+	if r.fail[recipient] {
+		return "", "", errors.New("template error")
+	}
+	return "Hi " + recipient, fmt.Sprintf("%d new", count), nil
+}
+
+func TestFlush_VisibleNotification(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Visible:         &stubRenderer{fail: map[string]bool{"carol@oc": true}},
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	_, _ = b.Queue(ctx, "alice@oc", "alice-phone", [][]byte{{1}, {2}})
+	_, _ = b.Queue(ctx, "carol@oc", "carol-phone", [][]byte{{3}})
+	time.Sleep(60 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 sends, got %d", len(calls))
+	}
+	for _, call := range calls {
+		switch call.FcmToken {
+		case "alice-phone":
+			if call.Title != "Hi alice@oc" || call.Body != "2 new" {
+				t.Errorf("alice visible text = (%q, %q), want (%q, %q)", call.Title, call.Body, "Hi alice@oc", "2 new")
+			}
+		case "carol-phone":
+			// Rendering failure falls back to a data-only send
+			if call.Title != "" || call.Body != "" {
+				t.Errorf("carol visible text = (%q, %q), want data-only", call.Title, call.Body)
+			}
+		}
+	}
+}
+
+// dataOnlySender is a Sender that isn't a VisibleSender.
+type dataOnlySender struct{ m *mockSender }
+
+func (s dataOnlySender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	return s.m.Send(ctx, fcmToken, dataIDs, opts)
+}
+
+func TestFlush_VisibleNeedsVisibleSender(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, dataOnlySender{sender}, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Visible:         &stubRenderer{},
+	})
+	defer b.Stop()
+
+	_, _ = b.Queue(context.Background(), "alice@oc", "alice-phone", [][]byte{{1}})
+	time.Sleep(60 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 send, got %d", len(calls))
+	}
+	if calls[0].Title != "" || calls[0].Body != "" {
+		t.Errorf("visible text = (%q, %q), want data-only for a plain Sender", calls[0].Title, calls[0].Body)
+	}
+}
+
+func TestReconcileLost_MarksOnlyOrphanedStatuses(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		LostAfter:       time.Nanosecond,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	pendingID, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	queued := store.Status{State: store.StatusQueued, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := st.SetStatus(ctx, "token1", []string{pendingID, "orphan-id"}, queued); err != nil {
+		t.Fatalf("SetStatus() error = %v", err)
+	}
+
+	// Status timestamps have one-second resolution
+	time.Sleep(1100 * time.Millisecond)
+
+	lost, err := b.ReconcileLost(ctx)
+	if err != nil {
+		t.Fatalf("ReconcileLost() error = %v", err)
+	}
+	if lost != 1 {
+		t.Errorf("ReconcileLost() = %d, want 1", lost)
+	}
+
+	status, _ := b.GetStatus(ctx, "orphan-id")
+	if status.State != store.StatusLost {
+		t.Errorf("orphan state = %q, want %q", status.State, store.StatusLost)
+	}
+	status, _ = b.GetStatus(ctx, pendingID)
+	if status.State != store.StatusQueued {
+		t.Errorf("pending state = %q, want %q (batch still exists)", status.State, store.StatusQueued)
+	}
+}
+
+func TestQueue_CountsDrops(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     20 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+
+	ctx := context.Background()
+
+	// Hold the endpoint lock so Queue times out
+	entry := b.getOrCreateEntry("token1")
+	entry.mu.Lock()
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Queue() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	entry.mu.Unlock()
+
+	// The abandoned lock attempt must not leave the endpoint locked
+	time.Sleep(10 * time.Millisecond)
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() after timeout error = %v", err)
+	}
+
+	b.Stop()
+	if _, err := b.Queue(ctx, "bob@oc", "token2", [][]byte{{3}}); err == nil {
+		t.Fatal("expected Queue() to fail after Stop")
+	}
+
+	drops := b.Drops()
+	if drops.LockTimeout != 1 || drops.Stopped != 1 || drops.Total != 2 {
+		t.Errorf("Drops() = %+v, want 1 lock timeout and 1 stopped", drops)
+	}
+}
+
+func TestRecoverDue_LeavesLaterBatches(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+	for token, flushAt := range map[string]time.Time{
+		"token-due":    now.Add(-time.Second),
+		"token-future": now.Add(time.Minute),
+	} {
+		if err := st.SaveBatch(ctx, token, &store.Batch{
+			Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "req-" + token}},
+			CreatedAt:     now,
+			FlushAt:       flushAt,
+		}); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	if err := b.RecoverDue(ctx, now); err != nil {
+		t.Fatalf("RecoverDue() error = %v", err)
+	}
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-due" {
+		t.Errorf("sends = %v, want one for token-due", calls)
+	}
+
+	batches, err := st.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 1 || batches["token-future"] == nil {
+		t.Errorf("expected token-future batch to remain, got %v", batches)
+	}
+}
+
+func TestRecover_OnFlushWorkers(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	for _, token := range []string{"token-a", "token-b", "token-c"} {
+		if err := st.SaveBatch(ctx, token, &store.Batch{
+			Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "req-" + token}},
+			CreatedAt:     past,
+			FlushAt:       past,
+		}); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:      time.Minute,
+		MaxBatchSize:     100,
+		LockTimeout:      100 * time.Millisecond,
+		StatusRetention:  time.Hour,
+		FlushConcurrency: 2,
+		RecoveryWeight:   1,
+	})
+	defer b.Stop()
+
+	// Returns once the workers have flushed every recovered batch
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if n := sender.callCount(); n != 3 {
+		t.Errorf("sends = %d, want 3", n)
+	}
+	batches, err := st.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 0 {
+		t.Errorf("batches left after recovery: %v", batches)
+	}
+}
+
+func TestRecover_LeavesBatchesHeldInMemory(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token-a", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if sender.callCount() != 0 {
+		t.Errorf("expected batch held in memory to wait for its timer, got %d sends", sender.callCount())
+	}
+}
+
+// loadHookStore runs afterLoad once, after the first page of batches is
+// loaded, like a push arriving while recovery is under way.
+type loadHookStore struct {
+	store.Store
+	once      sync.Once
+	afterLoad func()
+}
+
+func (s *loadHookStore) LoadOldestBatches(ctx context.Context, limit int) (map[string]*store.Batch, error) {
+	batches, err := s.Store.LoadOldestBatches(ctx, limit)
+	s.once.Do(s.afterLoad)
+	return batches, err
+}
+
+func TestRecover_MergesIntoLiveBatch(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	if err := st.SaveBatch(ctx, "token-a", &store.Batch{
+		Recipient: "bob@oc",
+		Notifications: []store.QueuedNotification{
+			{DataIDs: [][]byte{{1}}, RequestID: "persisted-1"},
+			{DataIDs: [][]byte{{2}}, RequestID: "persisted-2"},
+		},
+		CreatedAt: past,
+		FlushAt:   past,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	sender := &mockSender{}
+	hooked := &loadHookStore{Store: st}
+	b := New(hooked, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	var liveID string
+	hooked.afterLoad = func() {
+		var err error
+		if liveID, err = b.Queue(ctx, "bob@oc", "token-a", [][]byte{{3}}); err != nil {
+			t.Errorf("Queue() error = %v", err)
+		}
+	}
+
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	// The merged batch keeps the persisted flush time, which is already past
+	time.Sleep(50 * time.Millisecond)
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("sends = %d, want 1 merged send", len(calls))
+	}
+	if want := [][]byte{{1}, {2}, {3}}; !reflect.DeepEqual(calls[0].DataIDs, want) {
+		t.Errorf("DataIDs = %v, want %v", calls[0].DataIDs, want)
+	}
+	for _, id := range []string{"persisted-1", "persisted-2", liveID} {
+		status, err := b.GetStatus(ctx, id)
+		if err != nil {
+			t.Fatalf("GetStatus(%s) error = %v", id, err)
+		}
+		if status.State != store.StatusSent {
+			t.Errorf("status of %s = %q, want %q", id, status.State, store.StatusSent)
+		}
+	}
+}
+
+func TestRecover_ConcurrentQueue(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	const tokens = 20
+	past := time.Now().Add(-time.Minute)
+	var wantIDs []string
+	for i := 0; i < tokens; i++ {
+		id := fmt.Sprintf("persisted-%d", i)
+		if err := st.SaveBatch(ctx, fmt.Sprintf("token-%d", i), &store.Batch{
+			Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{byte(i)}}, RequestID: id}},
+			CreatedAt:     past,
+			FlushAt:       past,
+		}); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+		wantIDs = append(wantIDs, id)
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     time.Second,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < tokens; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := b.Queue(ctx, "bob@oc", fmt.Sprintf("token-%d", i), [][]byte{{byte(100 + i)}})
+			if err != nil {
+				t.Errorf("Queue() error = %v", err)
+				return
+			}
+			mu.Lock()
+			wantIDs = append(wantIDs, id)
+			mu.Unlock()
+		}(i)
+	}
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	wg.Wait()
+	b.FlushPending(ctx)
+
+	// Whichever won each race, no notification is lost
+	for _, id := range wantIDs {
+		status, err := b.GetStatus(ctx, id)
+		if err != nil {
+			t.Fatalf("GetStatus(%s) error = %v", id, err)
+		}
+		if status.State != store.StatusSent {
+			t.Errorf("status of %s = %q, want %q", id, status.State, store.StatusSent)
+		}
+	}
+}
+
+func TestFlushPending(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for _, token := range []string{"token-a", "token-b"} {
+		if _, err := b.Queue(ctx, "bob@oc", token, [][]byte{{1}}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+
+	b.FlushPending(ctx)
+
+	if sender.callCount() != 2 {
+		t.Errorf("expected 2 sends, got %d", sender.callCount())
+	}
+	batches, err := st.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 0 {
+		t.Errorf("expected no batches left, got %d", len(batches))
+	}
+}
+
+func TestCleanupExpiredStatus_SummarizesDaily(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: -time.Second, // statuses expire as soon as they are written
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for _, sender := range []string{"alice@oc", "alice@oc", "carol@oc"} {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token-"+sender, [][]byte{{1}}, QueueOptions{Sender: sender}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+	b.FlushPending(ctx)
+
+	deleted, err := st.CleanupExpiredStatus(ctx)
+	if err != nil {
+		t.Fatalf("CleanupExpiredStatus() error = %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("CleanupExpiredStatus() = %d, want 3", deleted)
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	history, err := b.DeliveryHistory(ctx, time.Now().Add(-24*time.Hour), "")
+	if err != nil {
+		t.Fatalf("DeliveryHistory() error = %v", err)
+	}
+	want := []store.DailySummary{
+		{Day: today, Sender: "alice@oc", State: store.StatusSent, Count: 2},
+		{Day: today, Sender: "carol@oc", State: store.StatusSent, Count: 1},
+	}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("DeliveryHistory() = %+v, want %+v", history, want)
+	}
+
+	// Summaries accumulate across cleanups
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token-carol@oc", [][]byte{{2}}, QueueOptions{Sender: "carol@oc"}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	b.FlushPending(ctx)
+	if _, err := st.CleanupExpiredStatus(ctx); err != nil {
+		t.Fatalf("CleanupExpiredStatus() error = %v", err)
+	}
+	history, err = b.DeliveryHistory(ctx, time.Now().Add(-24*time.Hour), "carol@oc")
+	if err != nil {
+		t.Fatalf("DeliveryHistory() error = %v", err)
+	}
+	if len(history) != 1 || history[0].Count != 2 {
+		t.Errorf("DeliveryHistory(carol) = %+v, want one day with count 2", history)
+	}
+}
+
+func TestFlush_MergesData(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for _, data := range []map[string]string{
+		{"thread_id": "old", "kind": "chat"},
+		nil,
+		{"thread_id": "new"},
+	} {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{1}}, QueueOptions{Data: data}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+	b.FlushPending(ctx)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("sends = %d, want 1", len(calls))
+	}
+	want := map[string]string{"thread_id": "new", "kind": "chat"}
+	if !reflect.DeepEqual(calls[0].Data, want) {
+		t.Errorf("Data = %v, want %v", calls[0].Data, want)
+	}
+}
+
+func TestFlush_UsesLatestEndpointOptions(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    2,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for _, channel := range []string{"old", "chat"} {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{1}}, QueueOptions{
+			EndpointOptions: map[string]string{"channel_id": channel},
+		}); err != nil {
+			t.Fatalf("QueueWithOptions() error = %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("expected 1 send, got %d", len(calls))
+	}
+	if got := calls[0].Endpoint["channel_id"]; got != "chat" {
+		t.Errorf("channel_id = %q, want the latest, chat", got)
+	}
+}
+
+func TestFlush_AttributesDataIDsToSenders(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for _, q := range []struct {
+		sender  string
+		dataIDs [][]byte
+	}{
+		{"alice@oc", [][]byte{{1}, {2}}},
+		{"", [][]byte{{3}}},
+		{"carol@oc", [][]byte{{2}}},
+	} {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", q.dataIDs, QueueOptions{Sender: q.sender}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+	b.FlushPending(ctx)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("sends = %d, want 1", len(calls))
+	}
+	// The newest sender of a repeated data ID wins; unattributed IDs are left out
+	want := map[string]string{"\x01": "alice@oc", "\x02": "carol@oc"}
+	if !reflect.DeepEqual(calls[0].DataSenders, want) {
+		t.Errorf("DataSenders = %q, want %q", calls[0].DataSenders, want)
+	}
+}
+
+// failingStore fails writes while fail is set, like a full disk would.
+type failingStore struct {
+	store.Store
+	fail atomic.Bool
+}
+
+var errDiskFull = errors.New("database or disk is full")
+
+func (s *failingStore) SaveBatch(ctx context.Context, fcmToken string, batch *store.Batch) error {
+	if s.fail.Load() {
+		return errDiskFull
+	}
+	return s.Store.SaveBatch(ctx, fcmToken, batch)
+}
+
+func (s *failingStore) ReserveRequestID(ctx context.Context, requestID string, at time.Time) error {
+	if s.fail.Load() {
+		return errDiskFull
+	}
+	return s.Store.ReserveRequestID(ctx, requestID, at)
+}
+
+func TestQueue_StoreFailureReject(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	fs := &failingStore{Store: st}
+
+	sender := &mockSender{}
+	b := New(fs, sender, Config{
+		BatchWindow:        20 * time.Millisecond,
+		MaxBatchSize:       100,
+		LockTimeout:        100 * time.Millisecond,
+		StatusRetention:    time.Hour,
+		StoreFailurePolicy: StoreFailureReject,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	fs.fail.Store(true)
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}}); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("Queue() error = %v, want %v", err, ErrStoreUnavailable)
+	}
+	health := b.StoreHealth()
+	if health.Healthy || health.Since == nil || health.Error == "" {
+		t.Errorf("StoreHealth() = %+v, want unhealthy with since and error", health)
+	}
+	if drops := b.Drops(); drops.StoreUnavailable != 1 {
+		t.Errorf("Drops().StoreUnavailable = %d, want 1", drops.StoreUnavailable)
+	}
+
+	// Nothing was queued, so nothing is sent
+	time.Sleep(60 * time.Millisecond)
+	if sender.callCount() != 0 {
+		t.Fatalf("expected no sends for a rejected notification, got %d", sender.callCount())
+	}
+
+	fs.fail.Store(false)
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() after recovery error = %v", err)
+	}
+	if health := b.StoreHealth(); !health.Healthy {
+		t.Errorf("StoreHealth() after recovery = %+v, want healthy", health)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	calls := sender.getCalls()
+	if len(calls) != 1 || len(calls[0].DataIDs) != 1 || calls[0].DataIDs[0][0] != 2 {
+		t.Errorf("sends = %+v, want one send of the accepted notification", calls)
+	}
+}
+
+func TestQueue_StoreFailureMemory(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	fs := &failingStore{Store: st}
+
+	sender := &mockSender{}
+	b := New(fs, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	fs.fail.Store(true)
+	if _, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v, want queued in memory", err)
+	}
+	if health := b.StoreHealth(); health.Healthy || health.Policy != StoreFailureMemory {
+		t.Errorf("StoreHealth() = %+v, want unhealthy with policy %q", health, StoreFailureMemory)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if sender.callCount() != 1 {
+		t.Errorf("expected the in-memory batch to be sent, got %d sends", sender.callCount())
+	}
+}
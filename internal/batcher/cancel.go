@@ -0,0 +1,112 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// ErrNotPending is returned by PendingSender and Cancel when no batch this
+// batcher holds contains the request and it isn't scheduled, e.g. because
+// it was already sent.
+var ErrNotPending = errors.New("request is not pending")
+
+// PendingSender returns the username that queued requestID, so a
+// cancellation can be authorized before calling Cancel. Returns
+// ErrNotPending if no pending batch holds requestID and it isn't scheduled.
+func (b *Batcher) PendingSender(ctx context.Context, requestID string) (string, error) {
+	p, err := b.store.FindPendingRequest(ctx, requestID)
+	if err != nil {
+		return "", fmt.Errorf("finding request: %w", err)
+	}
+	if p != nil {
+		return p.Notification.Sender, nil
+	}
+	n, err := b.store.GetScheduled(ctx, requestID)
+	if err != nil {
+		return "", fmt.Errorf("finding scheduled request: %w", err)
+	}
+	if n == nil {
+		return "", ErrNotPending
+	}
+	return n.Notification.Sender, nil
+}
+
+// Cancel removes requestID from its pending batch and sets its status to
+// cancelled, if sender queued it. A batch left empty is deleted without
+// being sent. A scheduled request is removed before it is queued. Returns
+// ErrNotPending if the batch flushed first, isn't held in memory yet (it
+// awaits recovery), or the request is another sender's.
+func (b *Batcher) Cancel(ctx context.Context, requestID, sender string) error {
+	p, err := b.store.FindPendingRequest(ctx, requestID)
+	if err != nil {
+		return fmt.Errorf("finding request: %w", err)
+	}
+	if p == nil {
+		return b.cancelScheduled(ctx, requestID, sender)
+	}
+
+	b.mu.Lock()
+	entry, ok := b.batches[p.FcmToken]
+	b.mu.Unlock()
+	if !ok {
+		return ErrNotPending
+	}
+
+	// Waits out an in-flight flush, after which the request is gone
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.batch == nil {
+		return ErrNotPending
+	}
+	notifications := entry.batch.Notifications
+
+	// The stored index is a hint; notifications may have been merged in since
+	i := p.Index
+	if i >= len(notifications) || notifications[i].RequestID != requestID {
+		i = slices.IndexFunc(notifications, func(n store.QueuedNotification) bool {
+			return n.RequestID == requestID
+		})
+	}
+	if i < 0 || notifications[i].Sender != sender {
+		return ErrNotPending
+	}
+
+	status := store.Status{
+		State:     store.StatusCancelled,
+		ExpiresAt: b.statusExpiry(store.StatusCancelled, time.Now()),
+	}
+
+	if len(notifications) == 1 {
+		b.stopTimer(p.FcmToken)
+		if err := b.deleteBatch(ctx, p.FcmToken, entry.batch, status); err != nil {
+			b.storeFailed(ctx, "cancelling request", err)
+			return fmt.Errorf("deleting batch: %w", err)
+		}
+		b.storeSucceeded()
+		b.emitDropped(p.FcmToken, entry.batch, []string{requestID}, store.StatusCancelled)
+		entry.batch = nil
+		log.Printf("INFO: cancelled request %s, leaving the batch for %s empty", requestID, p.FcmToken)
+		return nil
+	}
+
+	notif := notifications[i]
+	entry.batch.Notifications = slices.Delete(notifications, i, i+1)
+	if err := b.saveBatch(ctx, p.FcmToken, entry.batch); err != nil {
+		// Still sent after a restart, so don't report it cancelled
+		entry.batch.Notifications = slices.Insert(entry.batch.Notifications, i, notif)
+		return fmt.Errorf("saving batch: %w", err)
+	}
+	if err := b.store.SetStatus(ctx, p.FcmToken, []string{requestID}, status); err != nil {
+		log.Printf("ERROR: failed to record cancellation of %s: %v", requestID, err)
+	}
+	b.emitDropped(p.FcmToken, entry.batch, []string{requestID}, store.StatusCancelled)
+	log.Printf("INFO: cancelled request %s from the batch for %s", requestID, p.FcmToken)
+	return nil
+}
@@ -0,0 +1,72 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestCancel(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     100 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	queue := func(fcmToken string, dataID byte) string {
+		t.Helper()
+		id, err := b.QueueWithOptions(ctx, "bob@oc", fcmToken, [][]byte{{dataID}}, QueueOptions{Sender: "alice@oc"})
+		if err != nil {
+			t.Fatalf("QueueWithOptions() error = %v", err)
+		}
+		return id
+	}
+	keep := queue("token1", 1)
+	cancelled := queue("token1", 2)
+	alone := queue("token2", 3)
+
+	if s, err := b.PendingSender(ctx, cancelled); err != nil || s != "alice@oc" {
+		t.Fatalf("PendingSender() = %q, %v, want alice@oc", s, err)
+	}
+	if err := b.Cancel(ctx, cancelled, "mallory@oc"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Cancel() by another sender error = %v, want ErrNotPending", err)
+	}
+	if err := b.Cancel(ctx, cancelled, "alice@oc"); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	if err := b.Cancel(ctx, alone, "alice@oc"); err != nil {
+		t.Fatalf("Cancel() of a batch's only request error = %v", err)
+	}
+	if err := b.Cancel(ctx, cancelled, "alice@oc"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("second Cancel() error = %v, want ErrNotPending", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token1" || len(calls[0].DataIDs) != 1 || calls[0].DataIDs[0][0] != 1 {
+		t.Fatalf("expected only the kept request sent to token1, got %+v", calls)
+	}
+	for id, want := range map[string]string{keep: store.StatusSent, cancelled: store.StatusCancelled, alone: store.StatusCancelled} {
+		status, err := b.GetStatus(ctx, id)
+		if err != nil {
+			t.Fatalf("GetStatus(%s) error = %v", id, err)
+		}
+		if status.State != want {
+			t.Errorf("status of %s = %s, want %s", id, status.State, want)
+		}
+	}
+	if err := b.Cancel(ctx, keep, "alice@oc"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Cancel() after flush error = %v, want ErrNotPending", err)
+	}
+}
@@ -0,0 +1,32 @@
+package batcher
+
+// Names of the running totals passed to Config.Counters.
+const (
+	// CounterAccepted counts notifications Queue accepted, scheduled ones
+	// included.
+	CounterAccepted = "pushes_accepted"
+	// CounterDelivered counts notifications in batches FCM accepted, or
+	// not sent because their data IDs were all sent within DedupWindow.
+	CounterDelivered = "pushes_delivered"
+	// CounterFailed counts notifications whose send failed for good.
+	CounterFailed = "pushes_failed"
+	// CounterDropped counts notifications given up on unsent after they
+	// were accepted, such as expired or cancelled ones.
+	CounterDropped = "pushes_dropped"
+)
+
+// CounterNames lists the running totals the batcher adds to.
+var CounterNames = []string{CounterAccepted, CounterDelivered, CounterFailed, CounterDropped}
+
+// CounterSink keeps running totals of the notifications the batcher
+// handles. *counters.Counters implements it.
+type CounterSink interface {
+	Add(name string, n int64)
+}
+
+// count adds n to the running total called name, if totals are kept.
+func (b *Batcher) count(name string, n int) {
+	if b.cfg.Counters != nil {
+		b.cfg.Counters.Add(name, int64(n))
+	}
+}
@@ -0,0 +1,63 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memCounters records the totals the batcher adds to.
+type memCounters struct {
+	mu     sync.Mutex
+	totals map[string]int64
+}
+
+func (m *memCounters) Add(name string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totals[name] += n
+}
+
+func (m *memCounters) get(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.totals[name]
+}
+
+func TestQueue_CountsOutcomes(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{failCount: 1, failErr: errors.New("FCM unavailable")}
+	totals := &memCounters{totals: make(map[string]int64)}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Counters:        totals,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := b.Queue(ctx, "bob@oc", "token1", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if got := totals.get(CounterAccepted); got != 2 {
+		t.Errorf("%s = %d, want 2", CounterAccepted, got)
+	}
+	if got := totals.get(CounterFailed); got != 1 {
+		t.Errorf("%s = %d, want 1", CounterFailed, got)
+	}
+	if got := totals.get(CounterDelivered); got != 1 {
+		t.Errorf("%s = %d, want 1", CounterDelivered, got)
+	}
+}
@@ -0,0 +1,77 @@
+package batcher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// cryptKeyCacheTTL is how long a recipient's public crypt key is reused
+// before re-reading it.
+const cryptKeyCacheTTL = time.Hour
+
+// CryptKeySource looks up a user's public crypt key.
+// *ourcloud.Client implements this interface.
+type CryptKeySource interface {
+	GetCryptKey(ctx context.Context, username string) ([]byte, error)
+}
+
+// cachedCryptKey is a recipient's public crypt key.
+type cachedCryptKey struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+// cryptKeyCache caches recipients' public crypt keys. Failed lookups aren't
+// cached, so a flush delayed by one retries the lookup.
+type cryptKeyCache struct {
+	source CryptKeySource
+
+	mu      sync.Mutex
+	entries map[string]cachedCryptKey
+}
+
+// key returns recipient's public crypt key.
+func (c *cryptKeyCache) key(ctx context.Context, recipient string) ([]byte, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	cached, ok := c.entries[recipient]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.key, nil
+	}
+
+	key, err := c.source.GetCryptKey(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[recipient] = cachedCryptKey{key: key, expiresAt: now.Add(cryptKeyCacheTTL)}
+	c.mu.Unlock()
+
+	return key, nil
+}
+
+// cryptKeyError delays a flush whose recipient's public crypt key can't be
+// read, rather than sending the payload unsealed.
+type cryptKeyError struct {
+	recipient string
+	err       error
+	delay     time.Duration
+}
+
+func (e *cryptKeyError) Error() string {
+	return fmt.Sprintf("reading public crypt key for %s: %v", e.recipient, e.err)
+}
+
+func (e *cryptKeyError) Unwrap() error {
+	return e.err
+}
+
+// RetryAfter returns how long to wait before reading the key again.
+func (e *cryptKeyError) RetryAfter() time.Duration {
+	return e.delay
+}
@@ -0,0 +1,79 @@
+package batcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// mockCryptKeySource returns fixed keys and counts lookups.
+type mockCryptKeySource struct {
+	mu      sync.Mutex
+	keys    map[string][]byte
+	lookups int
+}
+
+func (m *mockCryptKeySource) GetCryptKey(ctx context.Context, username string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookups++
+	key, ok := m.keys[username]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	return key, nil
+}
+
+func (m *mockCryptKeySource) set(username string, key []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[username] = key
+}
+
+func TestFlush_SealsToRecipientKey(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	aliceKey := bytes.Repeat([]byte{1}, 32)
+	keys := &mockCryptKeySource{keys: map[string][]byte{"alice@oc": aliceKey}}
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     20 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		CryptKeys:       keys,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	_, _ = b.Queue(ctx, "alice@oc", "alice-phone", [][]byte{{1}})
+	carolID, _ := b.Queue(ctx, "carol@oc", "carol-phone", [][]byte{{2}})
+	time.Sleep(60 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "alice-phone" {
+		t.Fatalf("sends = %v, want only alice-phone", calls)
+	}
+	if !bytes.Equal(calls[0].CryptKey, aliceKey) {
+		t.Errorf("CryptKey = %x, want alice's key", calls[0].CryptKey)
+	}
+
+	// Carol's batch is kept, not sent unsealed or failed, until her key can be read
+	if status, err := st.GetStatus(ctx, carolID); err == nil && status.State == store.StatusFailed {
+		t.Errorf("carol's status = %q while her key is unreadable", status.State)
+	}
+	carolKey := bytes.Repeat([]byte{2}, 32)
+	keys.set("carol@oc", carolKey)
+	time.Sleep(60 * time.Millisecond)
+
+	calls = sender.getCalls()
+	if len(calls) != 2 || calls[1].FcmToken != "carol-phone" || !bytes.Equal(calls[1].CryptKey, carolKey) {
+		t.Errorf("sends = %v, want carol-phone sealed to her key", calls)
+	}
+}
@@ -0,0 +1,136 @@
+package batcher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// Do-Not-Disturb policies, selecting what happens to pushes for a recipient
+// with Do-Not-Disturb enabled.
+const (
+	DNDHold = "hold" // keep them batched until Do-Not-Disturb ends
+	DNDDrop = "drop" // drop them with status dropped_dnd
+)
+
+// dndCacheTTL is how long a recipient's Do-Not-Disturb setting is reused
+// before re-reading it. Held batches are rechecked this often.
+const dndCacheTTL = time.Minute
+
+// DNDSource looks up a user's Do-Not-Disturb setting and the senders allowed
+// to bypass it.
+// *ourcloud.Client implements this interface.
+type DNDSource interface {
+	GetDoNotDisturb(ctx context.Context, username string) (bool, error)
+	GetUrgentSenders(ctx context.Context, username string) ([]string, error)
+}
+
+// cachedDND is a recipient's Do-Not-Disturb setting.
+type cachedDND struct {
+	enabled   bool
+	urgent    map[string]bool // senders bypassing Do-Not-Disturb
+	expiresAt time.Time
+}
+
+// dndCache caches recipients' Do-Not-Disturb settings.
+type dndCache struct {
+	source DNDSource
+
+	mu      sync.Mutex
+	entries map[string]cachedDND
+}
+
+// setting returns recipient's Do-Not-Disturb setting. Settings that can't be
+// read count as disabled, so a missing label never holds up delivery.
+func (c *dndCache) setting(ctx context.Context, recipient string) cachedDND {
+	now := time.Now()
+
+	c.mu.Lock()
+	cached, ok := c.entries[recipient]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached
+	}
+
+	cached = cachedDND{expiresAt: now.Add(dndCacheTTL)}
+	enabled, err := c.source.GetDoNotDisturb(ctx, recipient)
+	if err == nil && enabled {
+		cached.enabled = true
+		// A missing allowlist is normal; nobody bypasses Do-Not-Disturb then
+		senders, _ := c.source.GetUrgentSenders(ctx, recipient)
+		cached.urgent = make(map[string]bool, len(senders))
+		for _, sender := range senders {
+			cached.urgent[sender] = true
+		}
+	}
+
+	c.mu.Lock()
+	c.entries[recipient] = cached
+	c.mu.Unlock()
+
+	return cached
+}
+
+// applyDND holds or drops the batch's notifications while its recipient has
+// Do-Not-Disturb enabled, unless they come from an urgent sender. Once an
+// urgent notification wakes the device, held notifications go along with it.
+// Returns false if nothing is to be sent now.
+// Caller must hold entry.mu.
+func (b *Batcher) applyDND(ctx context.Context, fcmToken string, entry *batchEntry) bool {
+	if b.dnd == nil || entry.batch.Recipient == "" {
+		return true
+	}
+	setting := b.dnd.setting(ctx, entry.batch.Recipient)
+	if !setting.enabled {
+		return true
+	}
+
+	var urgent []store.QueuedNotification
+	var quietIDs []string
+	for _, notif := range entry.batch.Notifications {
+		if setting.urgent[notif.Sender] {
+			urgent = append(urgent, notif)
+			continue
+		}
+		quietIDs = append(quietIDs, notif.RequestID)
+	}
+	if len(quietIDs) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	reason := "recipient has Do-Not-Disturb enabled"
+	held := b.cfg.DNDPolicy != DNDDrop
+	if held && len(urgent) > 0 {
+		return true
+	}
+	if age := now.Sub(entry.batch.CreatedAt); held && b.cfg.MaxBatchAge > 0 && age >= b.cfg.MaxBatchAge {
+		// Don't hold forever
+		reason = fmt.Sprintf("held for Do-Not-Disturb for %s", age.Round(time.Second))
+		held = false
+	}
+
+	if held {
+		log.Printf("INFO: holding %d notifications for %s until Do-Not-Disturb ends%s", len(quietIDs), fcmToken, logfield.Format(logfield.Trace(ctx)))
+		if err := b.store.SetStatus(ctx, fcmToken, quietIDs, store.Status{
+			State:     store.StatusHeldDND,
+			ExpiresAt: b.statusExpiry(store.StatusHeldDND, now),
+		}); err != nil {
+			log.Printf("ERROR: failed to mark held requests for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		}
+		b.startTimer(fcmToken, dndCacheTTL)
+		return false
+	}
+
+	log.Printf("INFO: dropping %d notifications for %s during Do-Not-Disturb%s", len(quietIDs), fcmToken, logfield.Format(logfield.Trace(ctx)))
+	return b.removeNotifications(ctx, fcmToken, entry, urgent, quietIDs, store.Status{
+		State:     store.StatusDroppedDND,
+		Error:     reason,
+		ExpiresAt: b.statusExpiry(store.StatusDroppedDND, now),
+	})
+}
@@ -0,0 +1,114 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// stubDNDSource reports Do-Not-Disturb for the users in enabled.
+type stubDNDSource struct {
+	enabled map[string]bool
+	urgent  map[string][]string
+}
+
+func (s *stubDNDSource) GetDoNotDisturb(ctx context.Context, username string) (bool, error) {
+	enabled, ok := s.enabled[username]
+	if !ok {
+		return false, errors.New("label not found")
+	}
+	return enabled, nil
+}
+
+func (s *stubDNDSource) GetUrgentSenders(ctx context.Context, username string) ([]string, error) {
+	return s.urgent[username], nil
+}
+
+func newDNDBatcher(t *testing.T, policy string) (*Batcher, store.Store, *mockSender) {
+	t.Helper()
+	st, cleanup := createTestStore(t)
+	t.Cleanup(cleanup)
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour, // flushed by hand
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		DND: &stubDNDSource{
+			enabled: map[string]bool{"bob@oc": true, "carol@oc": false},
+			urgent:  map[string][]string{"bob@oc": {"mom@oc"}},
+		},
+		DNDPolicy: policy,
+	})
+	t.Cleanup(b.Stop)
+	return b, st, sender
+}
+
+func TestFlush_DNDHold(t *testing.T) {
+	b, _, sender := newDNDBatcher(t, DNDHold)
+	ctx := context.Background()
+
+	quietID, _ := b.QueueWithOptions(ctx, "bob@oc", "bob-phone", [][]byte{{1}}, QueueOptions{Sender: "alice@oc"})
+	carolID, _ := b.QueueWithOptions(ctx, "carol@oc", "carol-phone", [][]byte{{2}}, QueueOptions{Sender: "alice@oc"})
+	b.flushSync(ctx, "bob-phone", true)
+	b.flushSync(ctx, "carol-phone", true)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "carol-phone" {
+		t.Fatalf("sends = %v, want only carol-phone", calls)
+	}
+	if status, _ := b.GetStatus(ctx, quietID); status.State != store.StatusHeldDND {
+		t.Errorf("held request state = %q, want %q", status.State, store.StatusHeldDND)
+	}
+	if status, _ := b.GetStatus(ctx, carolID); status.State != store.StatusSent {
+		t.Errorf("carol's request state = %q, want %q", status.State, store.StatusSent)
+	}
+
+	// An urgent sender wakes the device, and the held push goes along
+	urgentID, _ := b.QueueWithOptions(ctx, "bob@oc", "bob-phone", [][]byte{{3}}, QueueOptions{Sender: "mom@oc"})
+	b.flushSync(ctx, "bob-phone", true)
+
+	calls = sender.getCalls()
+	if len(calls) != 2 || calls[1].FcmToken != "bob-phone" || len(calls[1].DataIDs) != 2 {
+		t.Fatalf("sends = %v, want bob-phone with both data IDs", calls)
+	}
+	for _, id := range []string{quietID, urgentID} {
+		if status, _ := b.GetStatus(ctx, id); status.State != store.StatusSent {
+			t.Errorf("request %s state = %q, want %q", id, status.State, store.StatusSent)
+		}
+	}
+}
+
+func TestFlush_DNDDrop(t *testing.T) {
+	b, _, sender := newDNDBatcher(t, DNDDrop)
+	ctx := context.Background()
+
+	quietID, _ := b.QueueWithOptions(ctx, "bob@oc", "bob-phone", [][]byte{{1}}, QueueOptions{Sender: "alice@oc"})
+	urgentID, _ := b.QueueWithOptions(ctx, "bob@oc", "bob-phone", [][]byte{{2}}, QueueOptions{Sender: "mom@oc"})
+	b.flushSync(ctx, "bob-phone", true)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || len(calls[0].DataIDs) != 1 || calls[0].DataIDs[0][0] != 2 {
+		t.Fatalf("sends = %v, want only the urgent data ID {2}", calls)
+	}
+	if status, _ := b.GetStatus(ctx, quietID); status.State != store.StatusDroppedDND {
+		t.Errorf("quiet request state = %q, want %q", status.State, store.StatusDroppedDND)
+	}
+	if status, _ := b.GetStatus(ctx, urgentID); status.State != store.StatusSent {
+		t.Errorf("urgent request state = %q, want %q", status.State, store.StatusSent)
+	}
+
+	// With nothing urgent, the whole batch is dropped without waking the device
+	droppedID, _ := b.QueueWithOptions(ctx, "bob@oc", "bob-phone", [][]byte{{3}}, QueueOptions{Sender: "alice@oc"})
+	b.flushSync(ctx, "bob-phone", true)
+	if n := sender.callCount(); n != 1 {
+		t.Errorf("send count = %d, want 1", n)
+	}
+	if status, _ := b.GetStatus(ctx, droppedID); status.State != store.StatusDroppedDND {
+		t.Errorf("dropped request state = %q, want %q", status.State, store.StatusDroppedDND)
+	}
+}
@@ -0,0 +1,51 @@
+package batcher
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// HealthTracker scores endpoints by their delivery outcomes and pauses
+// those that keep failing.
+// *endpointhealth.Tracker implements this interface.
+type HealthTracker interface {
+	// Record scores a send, reporting whether it just paused the endpoint
+	// for the first time since it last succeeded.
+	Record(fcmToken, recipient string, delivered bool) (unreachable bool)
+	// PausedUntil returns when the endpoint's pause ends, or the zero time
+	// if it isn't paused.
+	PausedUntil(fcmToken string) time.Time
+}
+
+// holdPaused keeps the batch until its endpoint's pause ends. The flush
+// then probes whether the endpoint recovered.
+// Returns false if the batch is held.
+// Caller must hold entry.mu.
+func (b *Batcher) holdPaused(ctx context.Context, fcmToken string, entry *batchEntry) bool {
+	if b.cfg.Health == nil {
+		return true
+	}
+	until := b.cfg.Health.PausedUntil(fcmToken)
+	wait := time.Until(until)
+	if wait <= 0 {
+		return true
+	}
+	log.Printf("INFO: holding batch for %s for %s, the endpoint is paused after repeated delivery failures%s", fcmToken, wait.Round(time.Second), logfield.Format(logfield.Trace(ctx)))
+	b.startTimer(fcmToken, wait)
+	return false
+}
+
+// recordHealth scores a flush's outcome for the endpoint. An endpoint found
+// unreachable is reported to Config.Unreachable.
+func (b *Batcher) recordHealth(ctx context.Context, fcmToken, recipient string, delivered bool) {
+	if b.cfg.Health == nil || !b.cfg.Health.Record(fcmToken, recipient, delivered) {
+		return
+	}
+	log.Printf("WARNING: pausing deliveries to %s, which keeps failing%s", fcmToken, logfield.Format(logfield.User("recipient", recipient), logfield.Trace(ctx)))
+	if b.cfg.Unreachable != nil && recipient != "" {
+		go b.cfg.Unreachable(recipient, fcmToken)
+	}
+}
@@ -0,0 +1,100 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// mockHealth records outcomes and pauses the tokens in paused. It reports
+// an endpoint unreachable on its first failure.
+type mockHealth struct {
+	mu       sync.Mutex
+	outcomes map[string][]bool
+	paused   map[string]time.Time
+}
+
+func (m *mockHealth) Record(fcmToken, recipient string, delivered bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outcomes[fcmToken] = append(m.outcomes[fcmToken], delivered)
+	return !delivered && len(m.outcomes[fcmToken]) == 1
+}
+
+func (m *mockHealth) PausedUntil(fcmToken string) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.paused[fcmToken]
+}
+
+func TestFlush_EndpointHealth(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	health := &mockHealth{
+		outcomes: make(map[string][]bool),
+		paused:   map[string]time.Time{"paused": time.Now().Add(time.Hour)},
+	}
+	unreachable := make(chan string, 1)
+	sender := &mockSender{failCount: 1, failErr: errors.New("FCM unavailable")}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Health:          health,
+		Unreachable: func(recipient, fcmToken string) {
+			unreachable <- recipient + " " + fcmToken
+		},
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	failedID, err := b.Queue(ctx, "bob@oc", "failing", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	b.FlushPending(ctx)
+	if status, _ := b.GetStatus(ctx, failedID); status.State != store.StatusFailed {
+		t.Fatalf("state = %q, want %q", status.State, store.StatusFailed)
+	}
+	select {
+	case got := <-unreachable:
+		if got != "bob@oc failing" {
+			t.Errorf("Unreachable(%s), want bob@oc failing", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("Unreachable not called")
+	}
+
+	okID, _ := b.Queue(ctx, "bob@oc", "healthy", [][]byte{{2}})
+	pausedID, _ := b.Queue(ctx, "bob@oc", "paused", [][]byte{{3}})
+	b.FlushPending(ctx)
+
+	if status, _ := b.GetStatus(ctx, okID); status.State != store.StatusSent {
+		t.Errorf("healthy state = %q, want %q", status.State, store.StatusSent)
+	}
+	// A paused endpoint's batch waits for the pause to end
+	if pending, err := st.FindPendingRequest(ctx, pausedID); err != nil || pending == nil {
+		t.Errorf("paused endpoint's request not pending: %v, %v", pending, err)
+	}
+	if got := sender.callCount(); got != 2 {
+		t.Errorf("sends = %d, want 2", got)
+	}
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if got := health.outcomes["failing"]; len(got) != 1 || got[0] {
+		t.Errorf("failing outcomes = %v, want [false]", got)
+	}
+	if got := health.outcomes["healthy"]; len(got) != 1 || !got[0] {
+		t.Errorf("healthy outcomes = %v, want [true]", got)
+	}
+	if got := health.outcomes["paused"]; len(got) != 0 {
+		t.Errorf("paused outcomes = %v, want none", got)
+	}
+}
@@ -0,0 +1,193 @@
+package batcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// defaultEventBuffer is how many events Events buffers when
+// Config.EventBuffer is zero.
+const defaultEventBuffer = 256
+
+// EventType says what an Event reports.
+type EventType string
+
+const (
+	// EventQueued reports a notification added to its endpoint's batch.
+	EventQueued EventType = "queued"
+	// EventFlushed reports a batch FCM accepted, or one not sent because
+	// its data IDs were all sent within DedupWindow.
+	EventFlushed EventType = "flushed"
+	// EventFlushFailed reports a failed send. With Retry the batch is kept
+	// and sent again later; otherwise its requests are marked failed.
+	EventFlushFailed EventType = "flush_failed"
+	// EventDropped reports notifications given up on without being sent:
+	// rejected by Queue, or removed from their batch before it was sent.
+	EventDropped EventType = "dropped"
+)
+
+// Event is something that happened to queued notifications, received from
+// the channel returned by Events.
+type Event struct {
+	Type      EventType
+	At        time.Time
+	FCMToken  string
+	Recipient string // empty when not known
+	// RequestIDs are the notifications concerned: one for EventQueued, the
+	// batch's for flushes. A notification Queue rejected has none if it
+	// failed before it was given an ID.
+	RequestIDs []string
+	// MessageID is the FCM message ID of an EventFlushed. Suppressed is set
+	// instead when nothing was sent.
+	MessageID  string
+	Suppressed bool
+	// Err is the send error of an EventFlushFailed, or the error Queue
+	// returned for a notification it rejected.
+	Err   error
+	Retry bool // EventFlushFailed: the batch is sent again later
+	// Reason is why an EventDropped's notifications were dropped: the
+	// status they were given, such as "expired" or "failed_permanent", or
+	// for a notification Queue rejected, the DropStats field counting it,
+	// such as "lock_timeout".
+	Reason string
+}
+
+// eventStream delivers events to the channel returned by Events.
+type eventStream struct {
+	mu     sync.Mutex
+	ch     chan Event // nil until Events is first called
+	closed bool
+
+	dropped atomic.Uint64
+}
+
+// Events returns a channel receiving the batcher's events, so embedders
+// and tests can react to queueing and flushes without polling the store.
+// Every call returns the same channel; receivers share its events.
+//
+// Only events after the first call are delivered. They are buffered up to
+// Config.EventBuffer (default 256) and never block the batcher: an event
+// arriving while the buffer is full is discarded and counted by
+// EventsDropped, so a reader that falls behind misses events rather than
+// slowing delivery. Events for one FCM token arrive in the order they
+// happened. Stop closes the channel.
+func (b *Batcher) Events() <-chan Event {
+	s := &b.events
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		size := b.cfg.EventBuffer
+		if size <= 0 {
+			size = defaultEventBuffer
+		}
+		s.ch = make(chan Event, size)
+		if s.closed {
+			close(s.ch)
+		}
+	}
+	return s.ch
+}
+
+// EventsDropped returns how many events were discarded because the
+// channel returned by Events was full.
+func (b *Batcher) EventsDropped() uint64 {
+	return b.events.dropped.Load()
+}
+
+// emit delivers e to the Events channel, if anyone asked for it.
+func (b *Batcher) emit(e Event) {
+	s := &b.events
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil || s.closed {
+		return
+	}
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	select {
+	case s.ch <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// emitBatch emits an event of type t about every notification in batch.
+// set, if not nil, fills in the type-specific fields. A flushed batch is
+// counted as delivered.
+func (b *Batcher) emitBatch(t EventType, fcmToken string, batch *store.Batch, set func(*Event)) {
+	if t == EventFlushed {
+		b.count(CounterDelivered, len(batch.Notifications))
+	}
+	e := Event{
+		Type:       t,
+		FCMToken:   fcmToken,
+		Recipient:  batch.Recipient,
+		RequestIDs: requestIDs(batch.Notifications),
+	}
+	if set != nil {
+		set(&e)
+	}
+	b.emit(e)
+}
+
+// emitFlushFailed emits an EventFlushFailed about batch, whose send failed
+// with err. retry says whether the batch is kept to be sent again; if not,
+// its notifications are counted as failed.
+func (b *Batcher) emitFlushFailed(fcmToken string, batch *store.Batch, err error, retry bool) {
+	if !retry {
+		b.count(CounterFailed, len(batch.Notifications))
+	}
+	b.emitBatch(EventFlushFailed, fcmToken, batch, func(e *Event) {
+		e.Err = err
+		e.Retry = retry
+	})
+}
+
+// emitDropped emits an EventDropped about the notifications in batch with
+// ids, which were given status state, and counts them as dropped. Dead
+// letters were already counted as failed by emitFlushFailed.
+func (b *Batcher) emitDropped(fcmToken string, batch *store.Batch, ids []string, state string) {
+	if state != store.StatusFailedPermanent {
+		b.count(CounterDropped, len(ids))
+	}
+	b.emit(Event{
+		Type:       EventDropped,
+		FCMToken:   fcmToken,
+		Recipient:  batch.Recipient,
+		RequestIDs: ids,
+		Reason:     state,
+	})
+}
+
+// emitRejected emits an EventDropped about a notification Queue rejected
+// with err, counted under the DropStats field named reason.
+func (b *Batcher) emitRejected(recipient, fcmToken, requestID, reason string, err error) {
+	e := Event{
+		Type:      EventDropped,
+		FCMToken:  fcmToken,
+		Recipient: recipient,
+		Err:       err,
+		Reason:    reason,
+	}
+	if requestID != "" {
+		e.RequestIDs = []string{requestID}
+	}
+	b.emit(e)
+}
+
+// close closes the Events channel; later events are discarded.
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.ch != nil {
+		close(s.ch)
+	}
+}
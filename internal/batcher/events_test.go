@@ -0,0 +1,118 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// nextEvent returns the next event from events, failing if none arrives.
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("events channel closed")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event within 2s")
+		return Event{}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     50 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+	events := b.Events()
+	ctx := context.Background()
+
+	// Queued, then flushed by the timer
+	id, err := b.Queue(ctx, "bob@oc", "token-1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	e := nextEvent(t, events)
+	if e.Type != EventQueued || e.FCMToken != "token-1" || e.Recipient != "bob@oc" || !slices.Equal(e.RequestIDs, []string{id}) {
+		t.Errorf("first event = %+v, want %s queued for bob@oc", e, id)
+	}
+	e = nextEvent(t, events)
+	if e.Type != EventFlushed || !slices.Equal(e.RequestIDs, []string{id}) || e.MessageID == "" {
+		t.Errorf("second event = %+v, want %s flushed with a message ID", e, id)
+	}
+
+	// A failed send the sender doesn't ask to retry
+	sender.failCount = 1
+	sender.failErr = errors.New("internal error")
+	if _, err := b.Queue(ctx, "bob@oc", "token-2", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	nextEvent(t, events)
+	e = nextEvent(t, events)
+	if e.Type != EventFlushFailed || e.Err == nil || e.Retry {
+		t.Errorf("event after a failed send = %+v, want flush_failed without retry", e)
+	}
+
+	// A notification past its deadline at the flush
+	id, err = b.QueueWithOptions(ctx, "bob@oc", "token-3", [][]byte{{3}}, QueueOptions{Deadline: time.Now()})
+	if err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	nextEvent(t, events)
+	e = nextEvent(t, events)
+	if e.Type != EventDropped || e.Reason != store.StatusExpired || !slices.Equal(e.RequestIDs, []string{id}) {
+		t.Errorf("event for an expired notification = %+v, want %s dropped as expired", e, id)
+	}
+
+	b.Stop()
+	if _, ok := <-events; ok {
+		t.Error("events channel still open after Stop()")
+	}
+}
+
+func TestEvents_FullBuffer(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		EventBuffer:     2,
+	})
+	defer b.Stop()
+
+	// Events before the first call to Events aren't kept
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token-1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	events := b.Events()
+
+	// An unread channel never holds up Queue
+	for i := range 5 {
+		if _, err := b.Queue(ctx, "bob@oc", "token-1", [][]byte{{byte(i)}}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+	if got := len(events); got != 2 {
+		t.Errorf("events buffered = %d, want 2", got)
+	}
+	if got := b.EventsDropped(); got != 3 {
+		t.Errorf("EventsDropped() = %d, want 3", got)
+	}
+}
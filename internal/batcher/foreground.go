@@ -0,0 +1,131 @@
+package batcher
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultForegroundDevices is how many foreground devices are tracked when
+// Config.ForegroundDevices is zero.
+const defaultForegroundDevices = 100000
+
+// foregroundSet remembers when each device last reported being in the
+// foreground, keyed by recipient and device ID.
+type foregroundSet struct {
+	ttl        time.Duration
+	maxDevices int
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+
+	pings     atomic.Uint64
+	shortened atomic.Uint64
+}
+
+// ForegroundStats counts foreground devices and the pushes batched for them.
+type ForegroundStats struct {
+	Devices int    `json:"devices"` // devices seen within ForegroundTTL
+	Pings   uint64 `json:"pings"`   // MarkForeground calls since startup
+	// Shortened counts pushes given ForegroundWindow because their device
+	// was in the foreground.
+	Shortened uint64 `json:"shortened"`
+}
+
+func newForegroundSet(ttl time.Duration, maxDevices int) *foregroundSet {
+	if maxDevices <= 0 {
+		maxDevices = defaultForegroundDevices
+	}
+	return &foregroundSet{ttl: ttl, maxDevices: maxDevices, lastSeen: make(map[string]time.Time)}
+}
+
+// foregroundKey identifies deviceID of recipient.
+func foregroundKey(recipient, deviceID string) string {
+	return recipient + "\x00" + deviceID
+}
+
+// mark records that deviceID of recipient was in the foreground at now.
+func (f *foregroundSet) mark(recipient, deviceID string, now time.Time) {
+	f.pings.Add(1)
+	key := foregroundKey(recipient, deviceID)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.lastSeen[key]; !ok {
+		f.evict(now)
+	}
+	f.lastSeen[key] = now
+}
+
+// active reports whether deviceID of recipient was in the foreground within
+// the TTL before now.
+func (f *foregroundSet) active(recipient, deviceID string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen, ok := f.lastSeen[foregroundKey(recipient, deviceID)]
+	return ok && now.Sub(seen) < f.ttl
+}
+
+// evict makes room for a new device if the set is full: it forgets the
+// devices last seen more than the TTL ago, or if none, the least recently
+// seen tenth. Caller must hold f.mu.
+func (f *foregroundSet) evict(now time.Time) {
+	if len(f.lastSeen) < f.maxDevices {
+		return
+	}
+	for key, seen := range f.lastSeen {
+		if now.Sub(seen) >= f.ttl {
+			delete(f.lastSeen, key)
+		}
+	}
+	if len(f.lastSeen) < f.maxDevices {
+		return
+	}
+	keys := make([]string, 0, len(f.lastSeen))
+	for key := range f.lastSeen {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return f.lastSeen[keys[i]].Before(f.lastSeen[keys[j]]) })
+	for _, key := range keys[:len(keys)/10+1] {
+		delete(f.lastSeen, key)
+	}
+}
+
+// MarkForeground records that the recipient's device with deviceID is in
+// the foreground, such as because the app pinged the gateway or handled a
+// push. For ForegroundTTL, pushes to it are batched on ForegroundWindow.
+// It does nothing unless ForegroundWindow is set.
+func (b *Batcher) MarkForeground(recipient, deviceID string) {
+	if b.foreground == nil || recipient == "" || deviceID == "" {
+		return
+	}
+	b.foreground.mark(recipient, deviceID, time.Now())
+}
+
+// isForeground reports whether the recipient's device with deviceID is in
+// the foreground.
+func (b *Batcher) isForeground(recipient, deviceID string) bool {
+	if b.foreground == nil || recipient == "" || deviceID == "" {
+		return false
+	}
+	return b.foreground.active(recipient, deviceID, time.Now())
+}
+
+// ForegroundStats returns the foreground devices tracked and the pushes
+// batched for them.
+func (b *Batcher) ForegroundStats() ForegroundStats {
+	if b.foreground == nil {
+		return ForegroundStats{}
+	}
+	f := b.foreground
+	now := time.Now()
+	f.mu.Lock()
+	devices := 0
+	for _, seen := range f.lastSeen {
+		if now.Sub(seen) < f.ttl {
+			devices++
+		}
+	}
+	f.mu.Unlock()
+	return ForegroundStats{Devices: devices, Pings: f.pings.Load(), Shortened: f.shortened.Load()}
+}
@@ -0,0 +1,67 @@
+package batcher
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueue_ForegroundDeviceShortensWindow(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:      time.Minute,
+		MaxBatchSize:     100,
+		LockTimeout:      100 * time.Millisecond,
+		StatusRetention:  time.Hour,
+		ForegroundWindow: 20 * time.Millisecond,
+		ForegroundTTL:    time.Minute,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	// Queued while the phone was in the background
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token-phone", [][]byte{{1}}, QueueOptions{DeviceID: "phone"}); err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	b.MarkForeground("bob@oc", "phone")
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token-phone", [][]byte{{2}}, QueueOptions{DeviceID: "phone"}); err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token-laptop", [][]byte{{3}}, QueueOptions{DeviceID: "laptop"}); err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-phone" || len(calls[0].DataIDs) != 2 {
+		t.Errorf("sends = %v, want token-phone flushed with both pushes", calls)
+	}
+	stats := b.ForegroundStats()
+	if stats.Devices != 1 || stats.Pings != 1 || stats.Shortened != 1 {
+		t.Errorf("stats = %+v, want 1 device, 1 ping, 1 shortened", stats)
+	}
+}
+
+func TestForegroundSet_ExpiresAndEvicts(t *testing.T) {
+	f := newForegroundSet(time.Minute, 2)
+	now := time.Now()
+
+	f.mark("bob@oc", "phone", now.Add(-2*time.Minute))
+	if f.active("bob@oc", "phone", now) {
+		t.Error("device seen past the TTL counts as foreground")
+	}
+
+	f.mark("bob@oc", "laptop", now)
+	// Full: the expired phone makes room
+	f.mark("alice@oc", "phone", now)
+	if !f.active("bob@oc", "laptop", now) || !f.active("alice@oc", "phone", now) {
+		t.Error("active devices were evicted while an expired one was tracked")
+	}
+	if len(f.lastSeen) != 2 {
+		t.Errorf("tracked %d devices, want 2", len(f.lastSeen))
+	}
+}
@@ -0,0 +1,138 @@
+package batcher
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// LeaseStats counts how batch leases decided flushes since startup.
+type LeaseStats struct {
+	Owner     string `json:"owner"`
+	Claimed   uint64 `json:"claimed"`   // flushes run under a lease this instance took
+	Contended uint64 `json:"contended"` // flushes deferred while another instance held the lease
+	Delivered uint64 `json:"delivered"` // notifications dropped because another instance delivered them
+	Errors    uint64 `json:"errors"`    // failed claims; the flush went ahead without a lease
+}
+
+// leaseCounters counts lease outcomes for LeaseStats.
+type leaseCounters struct {
+	claimed   atomic.Uint64
+	contended atomic.Uint64
+	delivered atomic.Uint64
+	errors    atomic.Uint64
+}
+
+// claimLease takes the lease on fcmToken's batch before it is flushed. If
+// another instance holds it, the flush is retried once the lease could have
+// expired and claimLease returns false. Otherwise the caller must call
+// release when the flush is done.
+// Caller must hold entry.mu.
+func (b *Batcher) claimLease(ctx context.Context, fcmToken string, entry *batchEntry) (release func(), ok bool) {
+	if b.cfg.LeaseTTL <= 0 {
+		return func() {}, true
+	}
+
+	claimed, err := b.store.ClaimBatch(ctx, fcmToken, b.cfg.LeaseOwner, b.cfg.LeaseTTL)
+	if err != nil {
+		// Holding every flush back while the store fails would stop delivery
+		// even when this is the only instance
+		b.leases.errors.Add(1)
+		log.Printf("WARNING: claiming batch for %s failed, flushing without a lease: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		return func() {}, true
+	}
+	if !claimed {
+		b.leases.contended.Add(1)
+		entry.contended = true
+		log.Printf("INFO: batch for %s is leased by another instance, retrying in %s%s", fcmToken, b.cfg.LeaseTTL, logfield.Format(logfield.Trace(ctx)))
+		b.startTimer(fcmToken, b.cfg.LeaseTTL)
+		return nil, false
+	}
+
+	b.leases.claimed.Add(1)
+	return func() {
+		// Release even when shutting down, or the lease blocks the next
+		// instance until it expires
+		if err := b.store.ReleaseBatch(context.WithoutCancel(ctx), fcmToken, b.cfg.LeaseOwner); err != nil {
+			log.Printf("WARNING: failed to release batch lease for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		}
+	}, true
+}
+
+// dropDelivered removes notifications that another instance settled while
+// it held the batch's lease, so they aren't sent twice. Returns false if
+// nothing is left to send.
+// Caller must hold entry.mu.
+func (b *Batcher) dropDelivered(ctx context.Context, fcmToken string, entry *batchEntry) bool {
+	if !entry.contended {
+		return true
+	}
+	entry.contended = false
+
+	var live []store.QueuedNotification
+	for _, notif := range entry.batch.Notifications {
+		status, err := b.store.GetStatus(ctx, notif.RequestID)
+		if err == nil && !pendingState(status.State) {
+			continue
+		}
+		live = append(live, notif)
+	}
+
+	dropped := len(entry.batch.Notifications) - len(live)
+	if dropped == 0 {
+		return true
+	}
+	b.leases.delivered.Add(uint64(dropped))
+	log.Printf("INFO: dropping %d notifications for %s already handled by another instance%s", dropped, fcmToken, logfield.Format(logfield.Trace(ctx)))
+
+	if len(live) == 0 {
+		// The other instance deleted the persisted batch when it flushed
+		entry.batch = nil
+
+		b.mu.Lock()
+		delete(b.timers, fcmToken)
+		b.mu.Unlock()
+		return false
+	}
+	entry.batch.Notifications = live
+	b.saveBatch(ctx, fcmToken, entry.batch)
+	return true
+}
+
+// batchOwner returns the owner SaveBatch should record so gateways sharing
+// the store keep each other's notifications, or "" without leasing.
+func (b *Batcher) batchOwner() string {
+	if b.cfg.LeaseTTL <= 0 {
+		return ""
+	}
+	return b.cfg.LeaseOwner
+}
+
+// deleteBatch deletes batch, the one persisted for fcmToken, and gives its
+// requests status. With leasing, other gateways may have saved
+// notifications to the same row, so only batch's own are deleted.
+func (b *Batcher) deleteBatch(ctx context.Context, fcmToken string, batch *store.Batch, status store.Status) error {
+	if b.batchOwner() == "" {
+		return b.store.DeleteBatchAndSetStatus(ctx, fcmToken, status)
+	}
+	return b.store.DeleteNotificationsAndSetStatus(ctx, fcmToken, requestIDs(batch.Notifications), status)
+}
+
+// pendingState reports whether a request in state may still be delivered.
+func pendingState(state string) bool {
+	return state == store.StatusQueued || state == store.StatusTimedOut || state == store.StatusHeldDND
+}
+
+// Leases returns counts of flushes decided by batch leases.
+func (b *Batcher) Leases() LeaseStats {
+	return LeaseStats{
+		Owner:     b.cfg.LeaseOwner,
+		Claimed:   b.leases.claimed.Load(),
+		Contended: b.leases.contended.Load(),
+		Delivered: b.leases.delivered.Load(),
+		Errors:    b.leases.errors.Load(),
+	}
+}
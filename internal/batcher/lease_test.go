@@ -0,0 +1,182 @@
+package batcher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestFlush_LeaseHeldByOtherInstance(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	if err := st.SaveBatch(ctx, "token-a", &store.Batch{
+		Recipient:     "bob@oc",
+		Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "persisted-1"}},
+		CreatedAt:     past,
+		FlushAt:       past,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	// Another instance recovered the batch too and is flushing it
+	if claimed, err := st.ClaimBatch(ctx, "token-a", "other", time.Minute); err != nil || !claimed {
+		t.Fatalf("ClaimBatch() = %v, %v, want claimed", claimed, err)
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		LeaseOwner:      "self",
+		LeaseTTL:        50 * time.Millisecond,
+	})
+	defer b.Stop()
+
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if sender.callCount() != 0 {
+		t.Fatalf("sends = %d while another instance held the lease, want 0", sender.callCount())
+	}
+
+	// The other instance delivers the batch and lets go
+	if err := st.DeleteBatchAndSetStatus(ctx, "token-a", store.Status{
+		State:     store.StatusSent,
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("DeleteBatchAndSetStatus() error = %v", err)
+	}
+	if err := st.ReleaseBatch(ctx, "token-a", "other"); err != nil {
+		t.Fatalf("ReleaseBatch() error = %v", err)
+	}
+	liveID, err := b.Queue(ctx, "bob@oc", "token-a", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	calls := sender.getCalls()
+	if len(calls) != 1 {
+		t.Fatalf("sends = %d, want 1", len(calls))
+	}
+	if want := [][]byte{{2}}; !reflect.DeepEqual(calls[0].DataIDs, want) {
+		t.Errorf("DataIDs = %v, want only %v; the rest was delivered by the other instance", calls[0].DataIDs, want)
+	}
+	status, err := b.GetStatus(ctx, liveID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusSent {
+		t.Errorf("status = %q, want %q", status.State, store.StatusSent)
+	}
+
+	leases := b.Leases()
+	if leases.Contended != 1 || leases.Claimed != 1 || leases.Delivered != 1 {
+		t.Errorf("Leases() = %+v, want 1 contended, 1 claimed, 1 delivered", leases)
+	}
+	// The lease was released after the flush
+	if claimed, err := st.ClaimBatch(ctx, "token-a", "other", time.Minute); err != nil || !claimed {
+		t.Errorf("ClaimBatch() after flush = %v, %v, want claimed", claimed, err)
+	}
+}
+
+func TestFlush_TakesOverExpiredLease(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	if err := st.SaveBatch(ctx, "token-a", &store.Batch{
+		Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "persisted-1"}},
+		CreatedAt:     past,
+		FlushAt:       past,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	// An instance that died mid-flush never releases its lease
+	if claimed, err := st.ClaimBatch(ctx, "token-a", "dead", time.Millisecond); err != nil || !claimed {
+		t.Fatalf("ClaimBatch() = %v, %v, want claimed", claimed, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		LeaseOwner:      "self",
+		LeaseTTL:        time.Minute,
+	})
+	defer b.Stop()
+
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if sender.callCount() != 1 {
+		t.Errorf("sends = %d, want the batch sent under the expired lease", sender.callCount())
+	}
+	if leases := b.Leases(); leases.Claimed != 1 || leases.Contended != 0 {
+		t.Errorf("Leases() = %+v, want 1 claimed", leases)
+	}
+}
+
+func TestFlush_SharedBatchKeepsOtherInstancesNotifications(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	newInstance := func(owner string) (*Batcher, *mockSender) {
+		sender := &mockSender{}
+		b := New(st, sender, Config{
+			BatchWindow:     time.Hour,
+			MaxBatchSize:    100,
+			LockTimeout:     100 * time.Millisecond,
+			StatusRetention: time.Hour,
+			LeaseOwner:      owner,
+			LeaseTTL:        time.Minute,
+		})
+		t.Cleanup(b.Stop)
+		return b, sender
+	}
+	a, senderA := newInstance("a")
+	b, senderB := newInstance("b")
+
+	idA, err := a.Queue(ctx, "bob@oc", "token-a", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	idB, err := b.Queue(ctx, "bob@oc", "token-a", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// a delivers its own notification and leaves b's in the store
+	a.flushSync(ctx, "token-a", true)
+	if calls := senderA.getCalls(); len(calls) != 1 || !reflect.DeepEqual(calls[0].DataIDs, [][]byte{{1}}) {
+		t.Fatalf("a sent %v, want only its own notification", calls)
+	}
+	if pending, err := st.FindPendingRequest(ctx, idB); err != nil || pending == nil {
+		t.Fatalf("FindPendingRequest(b's request) = %+v, %v, want still pending", pending, err)
+	}
+
+	b.flushSync(ctx, "token-a", true)
+	if calls := senderB.getCalls(); len(calls) != 1 || !reflect.DeepEqual(calls[0].DataIDs, [][]byte{{2}}) {
+		t.Fatalf("b sent %v, want only its own notification", calls)
+	}
+	for _, id := range []string{idA, idB} {
+		if status, err := st.GetStatus(ctx, id); err != nil || status.State != store.StatusSent {
+			t.Errorf("GetStatus(%s) = %+v, %v, want %s", id, status, err, store.StatusSent)
+		}
+	}
+	if batches, _ := st.LoadOldestBatches(ctx, 10); len(batches) != 0 {
+		t.Errorf("%d batches left in the store, want none", len(batches))
+	}
+}
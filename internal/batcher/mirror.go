@@ -0,0 +1,161 @@
+package batcher
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// takenOverSet holds the request IDs a standby gateway delivered while
+// this one was down, for recovery to drop.
+type takenOverSet struct {
+	mu  sync.Mutex
+	ids map[string]bool
+
+	dropped atomic.Uint64
+}
+
+// SuppressTakenOver makes recovery drop the notifications with requestIDs,
+// which a standby gateway delivered while this one was down, instead of
+// sending them a second time. Their status becomes taken_over. Call it
+// before Recover or RecoverDue.
+func (b *Batcher) SuppressTakenOver(requestIDs []string) {
+	s := &b.takenOver
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[string]bool, len(requestIDs))
+	}
+	for _, id := range requestIDs {
+		s.ids[id] = true
+	}
+}
+
+// DropTakenOver removes the notifications with requestIDs, which a standby
+// gateway delivered while it couldn't hear from this one, from the batches
+// this batcher holds, so they aren't sent a second time. Their status
+// becomes taken_over, and a batch left empty is deleted. Batches not
+// recovered yet are left to SuppressTakenOver. Returns how many were
+// removed.
+func (b *Batcher) DropTakenOver(ctx context.Context, requestIDs []string) int {
+	byToken := make(map[string]map[string]bool)
+	for _, id := range requestIDs {
+		p, err := b.store.FindPendingRequest(ctx, id)
+		if err != nil {
+			log.Printf("WARNING: finding taken-over request %s: %v", id, err)
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		if byToken[p.FcmToken] == nil {
+			byToken[p.FcmToken] = make(map[string]bool)
+		}
+		byToken[p.FcmToken][id] = true
+	}
+
+	dropped := 0
+	for fcmToken, taken := range byToken {
+		b.mu.Lock()
+		entry, ok := b.batches[fcmToken]
+		b.mu.Unlock()
+		if !ok {
+			continue
+		}
+		dropped += b.dropTakenOverLive(ctx, fcmToken, entry, taken)
+	}
+	b.takenOver.dropped.Add(uint64(dropped))
+	return dropped
+}
+
+// dropTakenOverLive removes the notifications in taken from entry's batch,
+// waiting out an in-flight flush. Returns how many were removed.
+func (b *Batcher) dropTakenOverLive(ctx context.Context, fcmToken string, entry *batchEntry, taken map[string]bool) int {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.batch == nil {
+		return 0
+	}
+	var live []store.QueuedNotification
+	var removedIDs []string
+	for _, notif := range entry.batch.Notifications {
+		if taken[notif.RequestID] {
+			removedIDs = append(removedIDs, notif.RequestID)
+			continue
+		}
+		live = append(live, notif)
+	}
+	if len(removedIDs) == 0 {
+		return 0
+	}
+
+	log.Printf("INFO: dropping %d notifications for %s the standby gateway delivered%s", len(removedIDs), fcmToken, logfield.Format(logfield.Trace(withTrace(ctx, entry.batch))))
+	b.removeNotifications(ctx, fcmToken, entry, live, removedIDs, store.Status{
+		State:     store.StatusTakenOver,
+		ExpiresAt: b.statusExpiry(store.StatusTakenOver, time.Now()),
+	})
+	return len(removedIDs)
+}
+
+// TakenOverDropped returns how many pending notifications were dropped
+// because a standby gateway delivered them.
+func (b *Batcher) TakenOverDropped() uint64 {
+	return b.takenOver.dropped.Load()
+}
+
+// dropTakenOver removes the notifications passed to SuppressTakenOver from
+// the recovered batch, deleting the batch if none are left. Returns true if
+// it was deleted.
+func (b *Batcher) dropTakenOver(ctx context.Context, fcmToken string, batch *store.Batch) bool {
+	s := &b.takenOver
+	s.mu.Lock()
+	if len(s.ids) == 0 {
+		s.mu.Unlock()
+		return false
+	}
+	var live []store.QueuedNotification
+	var removedIDs []string
+	for _, notif := range batch.Notifications {
+		if s.ids[notif.RequestID] {
+			delete(s.ids, notif.RequestID)
+			removedIDs = append(removedIDs, notif.RequestID)
+			continue
+		}
+		live = append(live, notif)
+	}
+	s.mu.Unlock()
+	if len(removedIDs) == 0 {
+		return false
+	}
+
+	s.dropped.Add(uint64(len(removedIDs)))
+	log.Printf("INFO: dropping %d recovered notifications for %s the standby gateway delivered%s", len(removedIDs), fcmToken, logfield.Format(logfield.Trace(ctx)))
+	status := store.Status{
+		State:     store.StatusTakenOver,
+		ExpiresAt: b.statusExpiry(store.StatusTakenOver, time.Now()),
+	}
+	b.emitDropped(fcmToken, batch, removedIDs, store.StatusTakenOver)
+	if len(live) == 0 {
+		if err := b.deleteBatch(ctx, fcmToken, batch, status); err != nil {
+			log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		}
+		return true
+	}
+
+	// Set the status before rewriting the batch, as removeNotifications does
+	if err := b.store.SetStatus(ctx, fcmToken, removedIDs, status); err != nil {
+		log.Printf("ERROR: failed to mark %s requests for %s: %v%s", status.State, fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	batch.Notifications = live
+	batch.Owner = b.batchOwner()
+	if err := b.store.SaveBatch(ctx, fcmToken, batch); err != nil {
+		log.Printf("ERROR: failed to save batch for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package batcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestRecover_DropsTakenOver(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Hour)
+	batches := map[string][]string{
+		"token-all":  {"req-1", "req-2"},
+		"token-some": {"req-3", "req-4"},
+		"token-none": {"req-5"},
+	}
+	for token, ids := range batches {
+		batch := &store.Batch{CreatedAt: past, FlushAt: past}
+		for _, id := range ids {
+			batch.Notifications = append(batch.Notifications, store.QueuedNotification{DataIDs: [][]byte{{1}}, RequestID: id})
+		}
+		if err := st.SaveBatch(ctx, token, batch); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	b.SuppressTakenOver([]string{"req-1", "req-2", "req-3"})
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	sent := make(map[string]int)
+	for _, call := range sender.getCalls() {
+		sent[call.FcmToken]++
+	}
+	if sent["token-all"] != 0 || sent["token-some"] != 1 || sent["token-none"] != 1 {
+		t.Errorf("sends per token = %v, want token-some and token-none once", sent)
+	}
+	for _, id := range []string{"req-1", "req-2", "req-3"} {
+		status, err := b.GetStatus(ctx, id)
+		if err != nil {
+			t.Fatalf("GetStatus(%s) error = %v", id, err)
+		}
+		if status.State != store.StatusTakenOver {
+			t.Errorf("GetStatus(%s).State = %q, want %q", id, status.State, store.StatusTakenOver)
+		}
+	}
+	if status, err := b.GetStatus(ctx, "req-4"); err != nil || status.State != store.StatusSent {
+		t.Errorf("GetStatus(req-4) = %+v, %v, want sent", status, err)
+	}
+	if got := b.TakenOverDropped(); got != 3 {
+		t.Errorf("TakenOverDropped() = %d, want 3", got)
+	}
+	if got := b.RecoveryProgress(); got.Skipped != 1 {
+		t.Errorf("RecoveryProgress().Skipped = %d, want 1", got.Skipped)
+	}
+}
+
+func TestDropTakenOver_LiveBatches(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	taken, err := b.Queue(ctx, "bob@oc", "token-1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	kept, err := b.Queue(ctx, "bob@oc", "token-1", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	alone, err := b.Queue(ctx, "bob@oc", "token-2", [][]byte{{3}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	if n := b.DropTakenOver(ctx, []string{taken, alone, "unknown"}); n != 2 {
+		t.Errorf("DropTakenOver() = %d, want 2", n)
+	}
+	for _, id := range []string{taken, alone} {
+		if status, err := b.GetStatus(ctx, id); err != nil || status.State != store.StatusTakenOver {
+			t.Errorf("GetStatus(%s) = %+v, %v, want %s", id, status, err, store.StatusTakenOver)
+		}
+	}
+	if pending, err := st.FindPendingRequest(ctx, kept); err != nil || pending == nil {
+		t.Errorf("FindPendingRequest(%s) = %+v, %v, want still pending", kept, pending, err)
+	}
+
+	b.FlushPending(ctx)
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-1" || len(calls[0].DataIDs) != 1 || calls[0].DataIDs[0][0] != 2 {
+		t.Errorf("sends = %+v, want only the notification not taken over", calls)
+	}
+	if got := b.TakenOverDropped(); got != 2 {
+		t.Errorf("TakenOverDropped() = %d, want 2", got)
+	}
+}
+
+func TestQueue_Mirror(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	type mirrored struct {
+		recipient, fcmToken string
+		notif               store.QueuedNotification
+	}
+	var got []mirrored
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Mirror: func(recipient, fcmToken string, notif store.QueuedNotification) {
+			got = append(got, mirrored{recipient, fcmToken, notif})
+		},
+	})
+	defer b.Stop()
+
+	id, err := b.QueueWithOptions(ctx, "bob@oc", "token-1", [][]byte{{1}}, QueueOptions{Sender: "alice@oc", DeviceID: "phone", TraceID: "trace-1"})
+	if err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	// Scheduled pushes are mirrored when they join a batch, not before
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token-1", [][]byte{{2}}, QueueOptions{DeliverAfter: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("QueueWithOptions() scheduled error = %v", err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("mirrored %d notifications, want 1", len(got))
+	}
+	m := got[0]
+	if m.recipient != "bob@oc" || m.fcmToken != "token-1" || m.notif.RequestID != id || m.notif.Sender != "alice@oc" || m.notif.DeviceID != "phone" || m.notif.TraceID != "trace-1" {
+		t.Errorf("mirrored %+v, want the queued notification %s", m, id)
+	}
+}
@@ -0,0 +1,131 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// defaultPreflightTokens is how many tokens preflight remembers when
+// Config.PreflightTokens is zero.
+const defaultPreflightTokens = 100000
+
+// ErrInvalidToken is returned by Queue for a token FCM reported unregistered,
+// when preflight checks are on. Nothing is queued for it.
+var ErrInvalidToken = errors.New("FCM token is not registered")
+
+// preflightCache remembers the outcome for the tokens preflight checked
+// most recently, forgetting the oldest first.
+type preflightCache struct {
+	mu     sync.Mutex
+	valid  map[string]bool
+	order  []string // ring of the remembered tokens, in the order checked
+	next   int      // position in order to overwrite when full
+	maxLen int
+
+	checked atomic.Uint64
+	invalid atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// PreflightStats counts the tokens preflight checked since startup.
+type PreflightStats struct {
+	Checked uint64 `json:"checked"` // tokens validated on first sight
+	Invalid uint64 `json:"invalid"` // tokens FCM reported unregistered
+	// Errors counts checks that failed for other reasons, such as the FCM
+	// rate limit. Their pushes are queued anyway.
+	Errors     uint64 `json:"errors"`
+	Remembered int    `json:"remembered"` // tokens whose outcome is cached
+}
+
+func newPreflightCache(maxLen int) *preflightCache {
+	if maxLen <= 0 {
+		maxLen = defaultPreflightTokens
+	}
+	return &preflightCache{valid: make(map[string]bool), maxLen: maxLen}
+}
+
+// lookup returns the remembered outcome for fcmToken, if any.
+func (c *preflightCache) lookup(fcmToken string) (valid, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	valid, ok = c.valid[fcmToken]
+	return valid, ok
+}
+
+// remember records the outcome for fcmToken.
+func (c *preflightCache) remember(fcmToken string, valid bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.valid[fcmToken]; ok {
+		c.valid[fcmToken] = valid
+		return
+	}
+	if len(c.order) < c.maxLen {
+		c.order = append(c.order, fcmToken)
+	} else {
+		delete(c.valid, c.order[c.next])
+		c.order[c.next] = fcmToken
+		c.next = (c.next + 1) % c.maxLen
+	}
+	c.valid[fcmToken] = valid
+}
+
+// preflight checks, the first time the batcher sees fcmToken, that FCM
+// accepts it, with a dry-run send. Returns ErrInvalidToken for tokens
+// recorded as invalid or reported unregistered, which are recorded so
+// sweeps and recovery skip them too. A check that fails for another
+// reason admits the token and is tried again on its next push.
+func (b *Batcher) preflight(ctx context.Context, fcmToken string) error {
+	if valid, ok := b.preflights.lookup(fcmToken); ok {
+		if !valid {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+
+	invalid, err := b.store.IsInvalidToken(ctx, fcmToken)
+	if err == nil && invalid {
+		b.preflights.remember(fcmToken, false)
+		return ErrInvalidToken
+	}
+
+	err = b.cfg.Preflight.Validate(ctx, fcmToken)
+	switch {
+	case err == nil:
+		b.preflights.checked.Add(1)
+		b.preflights.remember(fcmToken, true)
+		return nil
+	case unregistered(err):
+		b.preflights.checked.Add(1)
+		b.preflights.invalid.Add(1)
+		log.Printf("INFO: preflight found token %s unregistered%s", fcmToken, logfield.Format(logfield.Trace(ctx)))
+		if err := b.store.RecordInvalidToken(ctx, fcmToken); err != nil {
+			log.Printf("WARNING: failed to record invalid token %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		}
+		b.preflights.remember(fcmToken, false)
+		return ErrInvalidToken
+	default:
+		b.preflights.errors.Add(1)
+		log.Printf("WARNING: preflight check of token %s failed, queueing anyway: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		return nil
+	}
+}
+
+// Preflights returns the preflight check counts since startup.
+func (b *Batcher) Preflights() PreflightStats {
+	c := b.preflights
+	c.mu.Lock()
+	remembered := len(c.valid)
+	c.mu.Unlock()
+	return PreflightStats{
+		Checked:    c.checked.Load(),
+		Invalid:    c.invalid.Load(),
+		Errors:     c.errors.Load(),
+		Remembered: remembered,
+	}
+}
@@ -0,0 +1,122 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQueue_PreflightChecksNewTokensOnce(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	validator := &mockValidator{dead: map[string]bool{"garbage": true}}
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Preflight:       validator,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	for range 2 {
+		if _, err := b.Queue(ctx, "bob@oc", "good", [][]byte{{1}}); err != nil {
+			t.Fatalf("Queue(good) error = %v", err)
+		}
+		if _, err := b.Queue(ctx, "bob@oc", "garbage", [][]byte{{1}}); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("Queue(garbage) error = %v, want ErrInvalidToken", err)
+		}
+	}
+
+	// Each token is checked on first sight only
+	if len(validator.checked) != 2 {
+		t.Errorf("checked = %v, want each token once", validator.checked)
+	}
+	if invalid, err := st.IsInvalidToken(ctx, "garbage"); err != nil || !invalid {
+		t.Errorf("IsInvalidToken(garbage) = %v, %v; want recorded", invalid, err)
+	}
+	if batches, _ := st.LoadOldestBatches(ctx, 10); batches["garbage"] != nil || batches["good"] == nil {
+		t.Errorf("stored batches = %v, want only good's", batches)
+	}
+
+	got := b.Preflights()
+	if got.Checked != 2 || got.Invalid != 1 || got.Errors != 0 || got.Remembered != 2 {
+		t.Errorf("Preflights() = %+v, want 2 checked, 1 invalid, 2 remembered", got)
+	}
+	if drops := b.Drops(); drops.InvalidToken != 2 {
+		t.Errorf("Drops().InvalidToken = %d, want 2", drops.InvalidToken)
+	}
+}
+
+func TestQueue_PreflightRecordedInvalidToken(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := st.RecordInvalidToken(ctx, "uninstalled"); err != nil {
+		t.Fatalf("RecordInvalidToken() error = %v", err)
+	}
+	validator := &mockValidator{}
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Preflight:       validator,
+	})
+	defer b.Stop()
+
+	// A token already known to be unregistered needs no dry run
+	if _, err := b.Queue(ctx, "bob@oc", "uninstalled", [][]byte{{1}}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Queue() error = %v, want ErrInvalidToken", err)
+	}
+	if len(validator.checked) != 0 {
+		t.Errorf("checked = %v, want none", validator.checked)
+	}
+}
+
+// failingValidator fails every check with err.
+type failingValidator struct{ err error }
+
+func (f failingValidator) Validate(ctx context.Context, fcmToken string) error { return f.err }
+
+func TestQueue_PreflightErrorAdmitsToken(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Preflight:       failingValidator{err: &retryLaterError{delay: time.Second}},
+	})
+	defer b.Stop()
+
+	if _, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v, want the push queued when the check fails", err)
+	}
+	if got := b.Preflights(); got.Errors != 1 || got.Remembered != 0 {
+		t.Errorf("Preflights() = %+v, want 1 error and nothing remembered", got)
+	}
+}
+
+func TestPreflightCache_ForgetsOldest(t *testing.T) {
+	c := newPreflightCache(2)
+	c.remember("a", true)
+	c.remember("b", false)
+	c.remember("c", true)
+
+	if _, ok := c.lookup("a"); ok {
+		t.Error("a still remembered, want it forgotten first")
+	}
+	if valid, ok := c.lookup("b"); !ok || valid {
+		t.Errorf("lookup(b) = %v, %v; want remembered invalid", valid, ok)
+	}
+	if valid, ok := c.lookup("c"); !ok || !valid {
+		t.Errorf("lookup(c) = %v, %v; want remembered valid", valid, ok)
+	}
+}
@@ -0,0 +1,113 @@
+package batcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// ReceiptStats counts send receipts since startup.
+type ReceiptStats struct {
+	Recorded uint64 `json:"recorded"` // batches FCM accepted, recorded before deletion
+	// Skipped counts recovered batches FCM had already accepted, marked
+	// sent instead of being sent again.
+	Skipped uint64 `json:"skipped"`
+	Errors  uint64 `json:"errors"` // failed reads and writes of receipts
+}
+
+// receiptCounters counts receipts for ReceiptStats.
+type receiptCounters struct {
+	recorded atomic.Uint64
+	skipped  atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// batchHash identifies a batch by its request IDs, which are never reused,
+// so a receipt only matches the batch FCM accepted.
+func batchHash(notifications []store.QueuedNotification) string {
+	h := sha256.New()
+	for _, notif := range notifications {
+		h.Write([]byte(notif.RequestID))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordReceipt records that FCM accepted the batch as messageID, ahead of
+// deleting it.
+// Caller must hold entry.mu.
+func (b *Batcher) recordReceipt(ctx context.Context, fcmToken string, entry *batchEntry, messageID string, sentAt time.Time) {
+	if !b.cfg.SendReceipts {
+		return
+	}
+	err := b.store.RecordReceipt(ctx, fcmToken, store.Receipt{
+		BatchHash: batchHash(entry.batch.Notifications),
+		MessageID: messageID,
+		SentAt:    sentAt,
+	})
+	if err != nil {
+		b.receipts.errors.Add(1)
+		log.Printf("WARNING: failed to record send receipt for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		return
+	}
+	b.receipts.recorded.Add(1)
+}
+
+// dropAcknowledged marks a recovered batch sent if its receipt shows FCM
+// already accepted it, deleting it instead of sending it again. Returns
+// false if the batch was dropped. A receipt that can't be read is treated
+// as missing, since a duplicate beats a lost notification.
+// Caller must hold entry.mu.
+func (b *Batcher) dropAcknowledged(ctx context.Context, fcmToken string, entry *batchEntry) bool {
+	if !b.cfg.SendReceipts || !entry.recovered {
+		return true
+	}
+	entry.recovered = false
+
+	receipt, err := b.store.GetReceipt(ctx, fcmToken, batchHash(entry.batch.Notifications))
+	if err != nil {
+		b.receipts.errors.Add(1)
+		log.Printf("WARNING: failed to read send receipt for %s, sending: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		return true
+	}
+	if receipt == nil {
+		return true
+	}
+
+	b.receipts.skipped.Add(1)
+	log.Printf("INFO: recovered batch for %s was already accepted by FCM as %s, marking it sent%s", fcmToken, receipt.MessageID, logfield.Format(logfield.Trace(ctx)))
+	sentAt := receipt.SentAt
+	if err := b.deleteBatch(ctx, fcmToken, entry.batch, store.Status{
+		State:     store.StatusSent,
+		SentAt:    &sentAt,
+		MessageID: receipt.MessageID,
+		ExpiresAt: b.statusExpiry(store.StatusSent, time.Now()),
+	}); err != nil {
+		log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		b.storeFailed(ctx, "updating status", err)
+	} else {
+		b.storeSucceeded()
+	}
+
+	entry.batch = nil
+
+	b.mu.Lock()
+	delete(b.timers, fcmToken)
+	b.mu.Unlock()
+	return false
+}
+
+// ReceiptStats returns counts of send receipts recorded and used.
+func (b *Batcher) ReceiptStats() ReceiptStats {
+	return ReceiptStats{
+		Recorded: b.receipts.recorded.Load(),
+		Skipped:  b.receipts.skipped.Load(),
+		Errors:   b.receipts.errors.Load(),
+	}
+}
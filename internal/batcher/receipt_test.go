@@ -0,0 +1,86 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// failingDeleteStore fails every DeleteBatchAndSetStatus, as when the
+// process dies between FCM accepting a batch and the batch being deleted.
+type failingDeleteStore struct {
+	store.Store
+}
+
+func (failingDeleteStore) DeleteBatchAndSetStatus(ctx context.Context, fcmToken string, status store.Status) error {
+	return errors.New("disk I/O error")
+}
+
+func TestRecover_SkipsAcknowledgedBatches(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	cfg := Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		SendReceipts:    true,
+	}
+	ctx := context.Background()
+
+	// The first run sends the batch, but can't delete it
+	first := &mockSender{}
+	b := New(failingDeleteStore{st}, first, cfg)
+	sentID, err := b.Queue(ctx, "bob@oc", "phone", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	b.FlushPending(ctx)
+	b.Stop()
+	if got := first.callCount(); got != 1 {
+		t.Fatalf("first run sends = %d, want 1", got)
+	}
+	if got := b.ReceiptStats(); got.Recorded != 1 {
+		t.Errorf("first run ReceiptStats() = %+v, want 1 recorded", got)
+	}
+
+	// A batch FCM never accepted is left alongside it
+	if err := st.SaveBatch(ctx, "tablet", &store.Batch{
+		Recipient:     "bob@oc",
+		Notifications: []store.QueuedNotification{{RequestID: "unsent-req", DataIDs: [][]byte{{2}}}},
+		CreatedAt:     time.Now(),
+		FlushAt:       time.Now(),
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	second := &mockSender{}
+	b = New(st, second, cfg)
+	defer b.Stop()
+	if err := b.Recover(ctx); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	if got := second.callCount(); got != 1 || second.calls[0].FcmToken != "tablet" {
+		t.Errorf("recovery sent %+v, want only the unsent batch", second.calls)
+	}
+	status, err := b.GetStatus(ctx, sentID)
+	if err != nil || status.State != store.StatusSent || status.MessageID != "projects/test/messages/1" {
+		t.Errorf("acknowledged request status = %+v, %v; want sent as the first run's message", status, err)
+	}
+	if got := b.ReceiptStats(); got.Skipped != 1 || got.Recorded != 1 {
+		t.Errorf("recovery ReceiptStats() = %+v, want 1 skipped and 1 recorded", got)
+	}
+
+	if batches, _ := st.LoadOldestBatches(ctx, 10); len(batches) != 0 {
+		t.Errorf("batches still stored after recovery: %v", batches)
+	}
+	hash := batchHash([]store.QueuedNotification{{RequestID: sentID}})
+	if receipt, err := st.GetReceipt(ctx, "phone", hash); err != nil || receipt != nil {
+		t.Errorf("GetReceipt() after recovery = %+v, %v; want the receipt deleted with its batch", receipt, err)
+	}
+}
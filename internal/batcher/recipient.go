@@ -0,0 +1,97 @@
+package batcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// ErrRecipientGone is returned by a RecipientSource when the recipient's
+// account no longer exists.
+var ErrRecipientGone = errors.New("recipient account no longer exists")
+
+// RecipientSource looks up a recipient's account and the FCM tokens of the
+// endpoints they list.
+type RecipientSource interface {
+	// RecipientTokens returns the FCM tokens username lists, or an error
+	// wrapping ErrRecipientGone if the account no longer exists.
+	RecipientTokens(ctx context.Context, username string) ([]string, error)
+}
+
+// EndpointsDigest returns a digest of the FCM tokens in a recipient's
+// endpoint list, in any order. Pushes record it in
+// QueueOptions.EndpointsDigest so a flush can tell whether the list changed.
+func EndpointsDigest(fcmTokens []string) string {
+	sorted := slices.Clone(fcmTokens)
+	slices.Sort(sorted)
+	h := sha256.New()
+	for _, fcmToken := range sorted {
+		h.Write([]byte(fcmToken))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// verifyRecipient re-reads the batch's recipient before sending. If the
+// account is gone, the whole batch is dropped with status recipient_gone.
+// Notifications queued with an endpoint list digest the recipient's list no
+// longer matches are dropped the same way if the list doesn't hold the
+// batch's token any more. Lookups that fail for other reasons are logged and
+// the batch sent, so an OurCloud outage doesn't hold up delivery.
+// Returns false if nothing is left to send.
+// Caller must hold entry.mu.
+func (b *Batcher) verifyRecipient(ctx context.Context, fcmToken string, entry *batchEntry) bool {
+	if b.cfg.Recipients == nil || entry.batch.Recipient == "" {
+		return true
+	}
+
+	tokens, err := b.cfg.Recipients.RecipientTokens(ctx, entry.batch.Recipient)
+	reason := "recipient account no longer exists"
+	switch {
+	case errors.Is(err, ErrRecipientGone):
+		tokens = nil
+	case err != nil:
+		log.Printf("WARNING: verifying recipient for %s failed, sending anyway: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		return true
+	default:
+		reason = "endpoint no longer listed by recipient"
+	}
+
+	digest := EndpointsDigest(tokens)
+	listed := err == nil && slices.Contains(tokens, fcmToken)
+	var live []store.QueuedNotification
+	var goneIDs []string
+	for _, notif := range entry.batch.Notifications {
+		// Without a digest, only the account is checked
+		unchanged := notif.EndpointsDigest == "" || notif.EndpointsDigest == digest
+		if err == nil && (unchanged || listed) {
+			live = append(live, notif)
+			continue
+		}
+		goneIDs = append(goneIDs, notif.RequestID)
+	}
+	if len(goneIDs) == 0 {
+		return true
+	}
+
+	log.Printf("INFO: dropping %d notifications for %s: %s%s", len(goneIDs), fcmToken, reason, logfield.Format(logfield.Trace(ctx)))
+	b.recipientsGone.Add(uint64(len(goneIDs)))
+	return b.removeNotifications(ctx, fcmToken, entry, live, goneIDs, store.Status{
+		State:     store.StatusRecipientGone,
+		Error:     reason,
+		ExpiresAt: b.statusExpiry(store.StatusRecipientGone, time.Now()),
+	})
+}
+
+// RecipientsGone returns how many notifications were dropped since startup
+// because their recipient's account or endpoint was gone.
+func (b *Batcher) RecipientsGone() uint64 {
+	return b.recipientsGone.Load()
+}
@@ -0,0 +1,95 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// mockRecipients lists each recipient's FCM tokens; recipients missing
+// from it are gone.
+type mockRecipients struct {
+	tokens map[string][]string
+	err    error
+}
+
+func (m *mockRecipients) RecipientTokens(ctx context.Context, username string) ([]string, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	tokens, ok := m.tokens[username]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRecipientGone, username)
+	}
+	return tokens, nil
+}
+
+func TestFlush_VerifiesRecipient(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	recipients := &mockRecipients{tokens: map[string][]string{
+		"bob@oc": {"phone", "tablet"},
+	}}
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Recipients:      recipients,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	queue := func(recipient, fcmToken string, listed ...string) string {
+		t.Helper()
+		id, err := b.QueueWithOptions(ctx, recipient, fcmToken, [][]byte{{1}}, QueueOptions{
+			EndpointsDigest: EndpointsDigest(listed),
+		})
+		if err != nil {
+			t.Fatalf("QueueWithOptions() error = %v", err)
+		}
+		return id
+	}
+	phoneID := queue("bob@oc", "phone", "tablet", "phone")
+	tabletID := queue("bob@oc", "tablet", "phone", "tablet", "laptop")
+	laptopID := queue("bob@oc", "laptop", "phone", "tablet", "laptop")
+	goneID := queue("carol@oc", "carol-phone", "carol-phone")
+
+	b.FlushPending(ctx)
+
+	tests := []struct {
+		name      string
+		requestID string
+		want      string
+	}{
+		{"list unchanged", phoneID, store.StatusSent},
+		{"list changed, token still listed", tabletID, store.StatusSent},
+		{"endpoint removed", laptopID, store.StatusRecipientGone},
+		{"account deleted", goneID, store.StatusRecipientGone},
+	}
+	for _, tt := range tests {
+		if status, _ := b.GetStatus(ctx, tt.requestID); status.State != tt.want {
+			t.Errorf("%s: state = %q, want %q", tt.name, status.State, tt.want)
+		}
+	}
+	if got := sender.callCount(); got != 2 {
+		t.Errorf("sends = %d, want 2", got)
+	}
+	if got := b.RecipientsGone(); got != 2 {
+		t.Errorf("RecipientsGone() = %d, want 2", got)
+	}
+
+	// A failed lookup doesn't hold up delivery
+	recipients.err = errors.New("OurCloud unavailable")
+	id := queue("carol@oc", "carol-phone", "carol-phone")
+	b.FlushPending(ctx)
+	if status, _ := b.GetStatus(ctx, id); status.State != store.StatusSent {
+		t.Errorf("state after failed lookup = %q, want %q", status.State, store.StatusSent)
+	}
+}
@@ -0,0 +1,126 @@
+package batcher
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// recoveryLogInterval is the least time between recovery progress lines.
+const recoveryLogInterval = 10 * time.Second
+
+// RecoveryProgress reports how far the latest Recover or RecoverDue has got.
+type RecoveryProgress struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Loaded counts the persisted batches read so far. Batches loaded
+	// again after a retry are counted once.
+	Loaded uint64 `json:"loaded"`
+	// Flushed counts the loaded batches handed to a flush, whatever its
+	// outcome. Skipped counts those dropped without one, such as batches
+	// for unregistered tokens or merged into one already in memory.
+	Flushed uint64 `json:"flushed"`
+	Skipped uint64 `json:"skipped"`
+	// Deferred counts the loaded batches waiting on a retry that wasn't
+	// due yet, left to flush at the time persisted with it.
+	Deferred uint64 `json:"deferred"`
+	// Rate is the most batches flushed per second, or zero if unlimited.
+	Rate float64 `json:"rate"`
+}
+
+// recoveryProgress tracks the latest recovery for RecoveryProgress.
+type recoveryProgress struct {
+	mu         sync.Mutex
+	running    int // recoveries in progress
+	startedAt  time.Time
+	finishedAt time.Time
+	lastLog    time.Time
+
+	loaded   atomic.Uint64
+	flushed  atomic.Uint64
+	skipped  atomic.Uint64
+	deferred atomic.Uint64
+}
+
+// newRecoveryLimiter returns the limiter pacing recovered flushes at
+// perSecond, or nil if perSecond is zero. Recovered batches are spread out
+// rather than sent in bursts, so the burst is one.
+func newRecoveryLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+// start resets the counts for a new recovery, unless one is already
+// running, which the new one then adds to.
+func (p *recoveryProgress) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running == 0 {
+		p.startedAt = time.Now()
+		p.finishedAt = time.Time{}
+		p.lastLog = p.startedAt
+		p.loaded.Store(0)
+		p.flushed.Store(0)
+		p.skipped.Store(0)
+		p.deferred.Store(0)
+	}
+	p.running++
+}
+
+// finish ends a recovery started with start, logging its totals once none
+// remain running.
+func (p *recoveryProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running--
+	if p.running > 0 {
+		return
+	}
+	p.finishedAt = time.Now()
+	if p.loaded.Load() > 0 {
+		log.Printf("INFO: recovery finished: %d batches flushed, %d skipped, %d waiting to retry in %s", p.flushed.Load(), p.skipped.Load(), p.deferred.Load(), p.finishedAt.Sub(p.startedAt).Round(time.Millisecond))
+	}
+}
+
+// logProgress logs the counts so far, at most once per recoveryLogInterval.
+func (p *recoveryProgress) logProgress() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.lastLog) < recoveryLogInterval {
+		return
+	}
+	p.lastLog = now
+	elapsed := now.Sub(p.startedAt)
+	flushed := p.flushed.Load()
+	log.Printf("INFO: recovery in progress: %d batches flushed, %d skipped of %d loaded in %s (%.1f/s)", flushed, p.skipped.Load(), p.loaded.Load(), elapsed.Round(time.Second), float64(flushed)/elapsed.Seconds())
+}
+
+// RecoveryProgress returns the progress of the latest recovery.
+func (b *Batcher) RecoveryProgress() RecoveryProgress {
+	p := &b.recovery
+	p.mu.Lock()
+	progress := RecoveryProgress{Running: p.running > 0}
+	if !p.startedAt.IsZero() {
+		startedAt := p.startedAt
+		progress.StartedAt = &startedAt
+	}
+	if !p.finishedAt.IsZero() {
+		finishedAt := p.finishedAt
+		progress.FinishedAt = &finishedAt
+	}
+	p.mu.Unlock()
+
+	progress.Loaded = p.loaded.Load()
+	progress.Flushed = p.flushed.Load()
+	progress.Skipped = p.skipped.Load()
+	progress.Deferred = p.deferred.Load()
+	progress.Rate = b.cfg.RecoveryRate
+	return progress
+}
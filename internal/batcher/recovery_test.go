@@ -0,0 +1,140 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// saveDueBatches stores n batches that were due an hour ago.
+func saveDueBatches(t *testing.T, st store.Store, n int) {
+	t.Helper()
+	past := time.Now().Add(-time.Hour)
+	for i := range n {
+		token := fmt.Sprintf("token-%d", i)
+		if err := st.SaveBatch(context.Background(), token, &store.Batch{
+			Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "req-" + token}},
+			CreatedAt:     past,
+			FlushAt:       past,
+		}); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+}
+
+func TestRecover_RecoveryRate(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	saveDueBatches(t, st, 5)
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		RecoveryRate:    20,
+	})
+	defer b.Stop()
+
+	if got := b.RecoveryProgress(); got.Running || got.StartedAt != nil {
+		t.Errorf("RecoveryProgress() before recovery = %+v, want none started", got)
+	}
+
+	start := time.Now()
+	if err := b.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	// The first flush starts at once, the other four 50ms apart
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("recovered 5 batches at 20/s in %s, want at least 200ms", elapsed)
+	}
+	if n := sender.callCount(); n != 5 {
+		t.Errorf("sends = %d, want 5", n)
+	}
+
+	got := b.RecoveryProgress()
+	if got.Running || got.StartedAt == nil || got.FinishedAt == nil {
+		t.Errorf("RecoveryProgress() after recovery = %+v, want finished", got)
+	}
+	if got.Loaded != 5 || got.Flushed != 5 || got.Skipped != 0 || got.Rate != 20 {
+		t.Errorf("RecoveryProgress() = %+v, want 5 loaded and flushed at rate 20", got)
+	}
+}
+
+func TestRecover_RecoveryRateCancelled(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	saveDueBatches(t, st, 5)
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		RecoveryRate:    1,
+	})
+	defer b.Stop()
+
+	// As at shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := b.Recover(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Recover() error = %v, want it cancelled", err)
+	}
+	if n := sender.callCount(); n != 1 {
+		t.Errorf("sends = %d, want 1 before cancellation", n)
+	}
+
+	// Batches not yet flushed stay stored for the next recovery
+	batches, err := st.LoadOldestBatches(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 4 {
+		t.Errorf("batches left = %d, want 4", len(batches))
+	}
+}
+
+func TestRecover_PagesPastRescheduledBatches(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	// More rate-limited batches than a page holds, due before the rest
+	saveDueBatches(t, st, 150)
+	later := time.Now().Add(time.Hour)
+	for i := range 5 {
+		token := fmt.Sprintf("later-%d", i)
+		if err := st.SaveBatch(context.Background(), token, &store.Batch{
+			Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{2}}, RequestID: "req-" + token}},
+			CreatedAt:     time.Now(),
+			FlushAt:       later,
+		}); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+
+	// Rescheduled flushes sort before the later batches
+	sender := &mockSender{failCount: 150, failErr: &retryLaterError{delay: time.Minute}}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	if err := b.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+	if n := sender.callCount(); n != 155 {
+		t.Errorf("sends = %d, want every batch tried once", n)
+	}
+	if got := b.RecoveryProgress(); got.Loaded != 155 {
+		t.Errorf("RecoveryProgress().Loaded = %d, want 155", got.Loaded)
+	}
+}
@@ -0,0 +1,77 @@
+package batcher
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Request ID formats.
+const (
+	IDFormatUUID   = "uuid"   // Random UUIDv4 (default)
+	IDFormatUUIDv7 = "uuidv7" // Time-ordered UUIDv7, sortable by creation time
+	IDFormatShort  = "short"  // 16-character base32, easier for QR codes and manual lookup
+)
+
+// shortIDBytes is the amount of randomness in a short ID (80 bits).
+const shortIDBytes = 10
+
+// shortIDEncoding is lowercase RFC 4648 base32 without padding.
+var shortIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// IDGenerator produces request IDs for status tracking.
+type IDGenerator func() (string, error)
+
+// NewIDGenerator returns a generator for the given format.
+// A non-empty prefix (for example a node identifier in clustered deployments)
+// is prepended as "<prefix>-<id>".
+func NewIDGenerator(format, prefix string) (IDGenerator, error) {
+	var gen IDGenerator
+
+	switch format {
+	case "", IDFormatUUID:
+		gen = func() (string, error) {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return "", err
+			}
+			return id.String(), nil
+		}
+	case IDFormatUUIDv7:
+		gen = func() (string, error) {
+			id, err := uuid.NewV7()
+			if err != nil {
+				return "", err
+			}
+			return id.String(), nil
+		}
+	case IDFormatShort:
+		gen = func() (string, error) {
+			buf := make([]byte, shortIDBytes)
+			if _, err := rand.Read(buf); err != nil {
+				return "", err
+			}
+			return shortIDEncoding.EncodeToString(buf), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown request ID format %q", format)
+	}
+
+	if prefix == "" {
+		return gen, nil
+	}
+	if strings.ContainsAny(prefix, "/?#") {
+		return nil, fmt.Errorf("request ID prefix %q contains URL-reserved characters", prefix)
+	}
+
+	return func() (string, error) {
+		id, err := gen()
+		if err != nil {
+			return "", err
+		}
+		return prefix + "-" + id, nil
+	}, nil
+}
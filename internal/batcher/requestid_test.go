@@ -0,0 +1,96 @@
+package batcher
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIDGenerator_Formats(t *testing.T) {
+	tests := []struct {
+		format  string
+		prefix  string
+		pattern string
+	}{
+		{format: "", pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}$`},
+		{format: IDFormatUUID, pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}$`},
+		{format: IDFormatUUIDv7, pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}$`},
+		{format: IDFormatShort, pattern: `^[a-z2-7]{16}$`},
+		{format: IDFormatShort, prefix: "node1", pattern: `^node1-[a-z2-7]{16}$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.prefix, func(t *testing.T) {
+			gen, err := NewIDGenerator(tt.format, tt.prefix)
+			if err != nil {
+				t.Fatalf("NewIDGenerator() error = %v", err)
+			}
+			id, err := gen()
+			if err != nil {
+				t.Fatalf("generator error = %v", err)
+			}
+			if !regexp.MustCompile(tt.pattern).MatchString(id) {
+				t.Errorf("id %q does not match %s", id, tt.pattern)
+			}
+		})
+	}
+}
+
+func TestNewIDGenerator_Invalid(t *testing.T) {
+	if _, err := NewIDGenerator("snowflake", ""); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if _, err := NewIDGenerator(IDFormatShort, "a/b"); err == nil {
+		t.Error("expected error for prefix with URL-reserved characters")
+	}
+}
+
+func TestNewIDGenerator_UUIDv7Sortable(t *testing.T) {
+	gen, _ := NewIDGenerator(IDFormatUUIDv7, "")
+	first, _ := gen()
+	time.Sleep(2 * time.Millisecond)
+	second, _ := gen()
+
+	if strings.Compare(first, second) >= 0 {
+		t.Errorf("expected %q < %q", first, second)
+	}
+}
+
+func TestQueue_RegeneratesCollidingRequestID(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	ids := []string{"dup", "dup", "fresh"}
+	next := 0
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:       time.Minute,
+		MaxBatchSize:      100,
+		LockTimeout:       100 * time.Millisecond,
+		StatusRetention:   time.Hour,
+		ReserveRequestIDs: true,
+		NewRequestID: func() (string, error) {
+			id := ids[next]
+			next++
+			return id, nil
+		},
+	})
+	defer b.Stop()
+
+	first, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	second, err := b.Queue(context.Background(), "bob@oc", "token2", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	if first != "dup" {
+		t.Errorf("first request ID = %q, want %q", first, "dup")
+	}
+	if second != "fresh" {
+		t.Errorf("second request ID = %q, want %q (pending ID must not be reused)", second, "fresh")
+	}
+}
@@ -0,0 +1,105 @@
+package batcher
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// retentionCounters counts what PurgeUnclaimed purged since startup.
+type retentionCounters struct {
+	scans         atomic.Uint64
+	batches       atomic.Uint64
+	notifications atomic.Uint64
+	lastScan      atomic.Int64 // Unix time of the last scan
+}
+
+// RetentionStats counts batches purged for outliving the retention limit
+// since startup.
+type RetentionStats struct {
+	Scans               uint64 `json:"scans"`
+	PurgedBatches       uint64 `json:"purged_batches"`
+	PurgedNotifications uint64 `json:"purged_notifications"`
+	LastScan            int64  `json:"last_scan"` // Unix timestamp (seconds); 0 before the first scan
+}
+
+// PurgeUnclaimed deletes persisted batches created more than maxAge ago,
+// such as those for a device whose app was uninstalled, marking their
+// requests expired_unclaimed. It looks at the limit batches due longest
+// ago. Batches this batcher doesn't hold are adopted first, and one being
+// flushed is left to that flush. Returns how many batches were purged.
+func (b *Batcher) PurgeUnclaimed(ctx context.Context, maxAge time.Duration, limit int) (int, error) {
+	batches, err := b.store.LoadOldestBatches(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	b.retention.scans.Add(1)
+	b.retention.lastScan.Store(now.Unix())
+
+	cutoff := now.Add(-maxAge)
+	purged := 0
+	for _, fcmToken := range tokensByFlushAt(batches) {
+		if ctx.Err() != nil {
+			return purged, ctx.Err()
+		}
+		batch := batches[fcmToken]
+		if !batch.CreatedAt.Before(cutoff) {
+			continue
+		}
+		b.adopt(ctx, fcmToken, batch)
+		if b.purgeBatch(ctx, fcmToken, cutoff) {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// purgeBatch deletes the batch for fcmToken if it was created before
+// cutoff. Returns true if it was deleted.
+func (b *Batcher) purgeBatch(ctx context.Context, fcmToken string, cutoff time.Time) bool {
+	entry := b.getOrCreateEntry(fcmToken)
+
+	// Waits out an in-flight flush, which may have sent the batch already
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.batch == nil || len(entry.batch.Notifications) == 0 || !entry.batch.CreatedAt.Before(cutoff) {
+		return false
+	}
+	ctx = withTrace(ctx, entry.batch)
+
+	age := time.Since(entry.batch.CreatedAt).Round(time.Second)
+	b.stopTimer(fcmToken)
+	if err := b.deleteBatch(ctx, fcmToken, entry.batch, store.Status{
+		State:     store.StatusExpiredUnclaimed,
+		Error:     "undelivered after " + age.String(),
+		ExpiresAt: b.statusExpiry(store.StatusExpiredUnclaimed, time.Now()),
+	}); err != nil {
+		log.Printf("ERROR: failed to purge batch for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		b.storeFailed(ctx, "purging batch", err)
+		return false
+	}
+	b.storeSucceeded()
+
+	n := len(entry.batch.Notifications)
+	b.retention.batches.Add(1)
+	b.retention.notifications.Add(uint64(n))
+	b.emitDropped(fcmToken, entry.batch, requestIDs(entry.batch.Notifications), store.StatusExpiredUnclaimed)
+	log.Printf("INFO: purged batch of %d notifications for %s, undelivered after %s%s", n, fcmToken, age, logfield.Format(logfield.Trace(ctx)))
+	entry.batch = nil
+	return true
+}
+
+// RetentionStats returns counts of batches purged for their age.
+func (b *Batcher) RetentionStats() RetentionStats {
+	return RetentionStats{
+		Scans:               b.retention.scans.Load(),
+		PurgedBatches:       b.retention.batches.Load(),
+		PurgedNotifications: b.retention.notifications.Load(),
+		LastScan:            b.retention.lastScan.Load(),
+	}
+}
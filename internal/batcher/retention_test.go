@@ -0,0 +1,84 @@
+package batcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestPurgeUnclaimed(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	freshID, err := b.Queue(ctx, "bob@oc", "fresh-token", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	oldID, err := b.Queue(ctx, "bob@oc", "old-token", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	if _, err := b.Queue(ctx, "bob@oc", "old-token", [][]byte{{3}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// old-token's batch was created long ago
+	created := time.Now().Add(-31 * 24 * time.Hour)
+	entry := b.getOrCreateEntry("old-token")
+	entry.mu.Lock()
+	entry.batch.CreatedAt, entry.batch.FlushAt = created, created
+	err = st.SaveBatch(ctx, "old-token", entry.batch)
+	entry.mu.Unlock()
+	if err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	// As is a batch no instance holds, like one left by a crashed process
+	if err := st.SaveBatch(ctx, "orphan-token", &store.Batch{
+		Recipient:     "carol@oc",
+		Notifications: []store.QueuedNotification{{RequestID: "orphan-req", DataIDs: [][]byte{{4}}}},
+		CreatedAt:     created,
+		FlushAt:       created,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	purged, err := b.PurgeUnclaimed(ctx, 30*24*time.Hour, 10)
+	if err != nil {
+		t.Fatalf("PurgeUnclaimed() error = %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("PurgeUnclaimed() = %d, want 2", purged)
+	}
+
+	for _, id := range []string{oldID, "orphan-req"} {
+		if status, _ := b.GetStatus(ctx, id); status.State != store.StatusExpiredUnclaimed {
+			t.Errorf("request %s state = %q, want %q", id, status.State, store.StatusExpiredUnclaimed)
+		}
+	}
+	if pending, err := st.FindPendingRequest(ctx, freshID); err != nil || pending == nil {
+		t.Errorf("fresh request not pending: %v, %v", pending, err)
+	}
+	if orphans, _ := b.ListByRecipient(ctx, "carol@oc"); len(orphans) != 0 {
+		t.Errorf("orphaned batch still pending: %v", orphans)
+	}
+	if got := sender.callCount(); got != 0 {
+		t.Errorf("sends = %d, want 0", got)
+	}
+
+	got := b.RetentionStats()
+	if got.Scans != 1 || got.PurgedBatches != 2 || got.PurgedNotifications != 3 {
+		t.Errorf("RetentionStats() = %+v, want 1 scan purging 2 batches of 3 notifications", got)
+	}
+}
@@ -0,0 +1,48 @@
+package batcher
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// retryCounters counts flush retries since startup.
+type retryCounters struct {
+	scheduled atomic.Uint64
+	resumed   atomic.Uint64
+}
+
+// RetryStats counts flush retries since startup.
+type RetryStats struct {
+	// Scheduled counts failed flushes that were persisted for a retry,
+	// timed out or rate limited.
+	Scheduled uint64 `json:"scheduled"`
+	// Resumed counts retries loaded by Recover that weren't due yet, and
+	// were rescheduled for the time persisted with them.
+	Resumed uint64 `json:"resumed"`
+}
+
+// scheduleRetry persists when the batch for fcmToken, whose flush just
+// failed, is next tried, along with its attempt count, so the retry
+// survives a restart, and starts its timer. Caller must hold entry.mu.
+func (b *Batcher) scheduleRetry(ctx context.Context, fcmToken string, entry *batchEntry, delay time.Duration) {
+	entry.batch.FlushAt = time.Now().Add(delay)
+	b.saveBatch(ctx, fcmToken, entry.batch)
+	b.retries.scheduled.Add(1)
+	b.startTimer(fcmToken, delay)
+}
+
+// pendingRetry reports whether batch is waiting for a retry not due at now.
+func pendingRetry(batch *store.Batch, now time.Time) bool {
+	return batch.Attempts > 0 && batch.FlushAt.After(now)
+}
+
+// Retries returns the flush retry counts since startup.
+func (b *Batcher) Retries() RetryStats {
+	return RetryStats{
+		Scheduled: b.retries.scheduled.Load(),
+		Resumed:   b.retries.resumed.Load(),
+	}
+}
@@ -0,0 +1,142 @@
+package batcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestFlush_RetryPersistsAttempts(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{
+		failCount: 1,
+		failErr:   &retryLaterError{delay: time.Hour},
+	}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    1,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	if _, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	batches, err := st.LoadOldestBatches(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	batch := batches["token1"]
+	if batch == nil {
+		t.Fatal("rescheduled batch not stored")
+	}
+	if batch.Attempts != 1 {
+		t.Errorf("stored attempts = %d, want 1", batch.Attempts)
+	}
+	if until := time.Until(batch.FlushAt); until < 50*time.Minute {
+		t.Errorf("stored retry due in %s, want about an hour", until)
+	}
+	if got := b.Retries(); got.Scheduled != 1 {
+		t.Errorf("Retries() = %+v, want 1 scheduled", got)
+	}
+}
+
+func TestRecover_ResumesPendingRetry(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	saveDueBatches(t, st, 1)
+	now := time.Now()
+	if err := st.SaveBatch(context.Background(), "token-retry", &store.Batch{
+		Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{2}}, RequestID: "req-retry"}},
+		CreatedAt:     now.Add(-time.Hour),
+		FlushAt:       now.Add(time.Hour),
+		Attempts:      3,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	if err := b.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	// Only the due batch is sent; the retry waits for its time
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-0" {
+		t.Fatalf("sends = %+v, want one to token-0", calls)
+	}
+	b.mu.Lock()
+	_, hasTimer := b.timers["token-retry"]
+	b.mu.Unlock()
+	if !hasTimer {
+		t.Error("expected a timer for the pending retry")
+	}
+	if got := b.RecoveryProgress(); got.Loaded != 2 || got.Flushed != 1 || got.Deferred != 1 {
+		t.Errorf("RecoveryProgress() = %+v, want 2 loaded, 1 flushed and 1 deferred", got)
+	}
+	if got := b.Retries(); got.Resumed != 1 {
+		t.Errorf("Retries() = %+v, want 1 resumed", got)
+	}
+	batches, err := st.LoadOldestBatches(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if batch := batches["token-retry"]; batch == nil || batch.Attempts != 3 {
+		t.Errorf("stored retry = %+v, want it kept with 3 attempts", batch)
+	}
+}
+
+func TestRecover_PersistedAttemptsCountTowardLimit(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+	past := time.Now().Add(-time.Minute)
+	if err := st.SaveBatch(context.Background(), "token1", &store.Batch{
+		Notifications: []store.QueuedNotification{{DataIDs: [][]byte{{1}}, RequestID: "req-1"}},
+		CreatedAt:     past,
+		FlushAt:       past,
+		Attempts:      2,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	sender := &mockSender{
+		failCount: 1,
+		failErr:   &retryLaterError{delay: time.Hour},
+	}
+	b := New(st, sender, Config{
+		BatchWindow:      time.Minute,
+		MaxBatchSize:     100,
+		LockTimeout:      100 * time.Millisecond,
+		StatusRetention:  time.Hour,
+		MaxFlushAttempts: 3,
+	})
+	defer b.Stop()
+
+	if err := b.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	// The attempts made before the restart count, so the third gives up
+	status, err := b.GetStatus(context.Background(), "req-1")
+	if err != nil || status.State != store.StatusFailedPermanent {
+		t.Errorf("GetStatus() = %+v, %v; want failed_permanent", status, err)
+	}
+	if n := b.DeadLettered(); n != 1 {
+		t.Errorf("DeadLettered() = %d, want 1", n)
+	}
+}
@@ -0,0 +1,188 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// scheduledPageSize bounds the due scheduled notifications ReleaseDue
+// loads at a time.
+const scheduledPageSize = 500
+
+// scheduleCounters counts scheduled notifications for ScheduleStats.
+type scheduleCounters struct {
+	scheduled atomic.Uint64
+	released  atomic.Uint64
+	errors    atomic.Uint64
+}
+
+// ScheduleStats counts notifications held for later delivery since startup.
+type ScheduleStats struct {
+	Scheduled uint64 `json:"scheduled"` // stored to be queued later
+	Released  uint64 `json:"released"`  // queued once due
+	Errors    uint64 `json:"errors"`    // failed to queue when due, retried at the next release
+}
+
+// schedule stores notif until opts.DeliverAfter instead of queueing it,
+// with status scheduled.
+func (b *Batcher) schedule(ctx context.Context, recipient, fcmToken string, notif store.QueuedNotification, opts QueueOptions) error {
+	b.mu.Lock()
+	stopped := b.stopped
+	b.mu.Unlock()
+	if stopped {
+		b.drops.stopped.Add(1)
+		b.emitRejected(recipient, fcmToken, notif.RequestID, "stopped", context.Canceled)
+		return context.Canceled
+	}
+
+	deliverAt := opts.DeliverAfter
+	err := b.store.SaveScheduled(ctx, store.ScheduledNotification{
+		FcmToken:     fcmToken,
+		Recipient:    recipient,
+		Notification: notif,
+		DeliverAt:    deliverAt,
+		Window:       opts.Window,
+		MaxBatchSize: opts.MaxBatchSize,
+	}, store.Status{
+		State:     store.StatusScheduled,
+		ExpiresAt: b.statusExpiry(store.StatusScheduled, deliverAt),
+	})
+	if err != nil {
+		log.Printf("ERROR: failed to store scheduled notification for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+		if ctx.Err() == nil {
+			b.storeFailed(ctx, "saving scheduled notification", err)
+		}
+		b.drops.storeUnavailable.Add(1)
+		err = fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+		b.emitRejected(recipient, fcmToken, notif.RequestID, "store_unavailable", err)
+		return err
+	}
+	b.storeSucceeded()
+	b.schedules.scheduled.Add(1)
+	return nil
+}
+
+// ReleaseDue queues the scheduled notifications whose delivery time has
+// come, as if they were pushed now. Each is taken out of the store before
+// it is queued, so gateways sharing a store queue it once, and put back if
+// it can't be queued. Notifications left due, such as after a restart, are
+// queued at the first call. Returns the number queued.
+func (b *Batcher) ReleaseDue(ctx context.Context) (int, error) {
+	released := 0
+	for {
+		due, err := b.store.LoadDueScheduled(ctx, time.Now(), scheduledPageSize)
+		if err != nil {
+			return released, fmt.Errorf("loading scheduled notifications: %w", err)
+		}
+		progressed := false
+		for _, n := range due {
+			ok, err := b.release(ctx, n)
+			if err != nil {
+				return released, err
+			}
+			if ok {
+				released++
+				progressed = true
+			}
+		}
+		if len(due) < scheduledPageSize || !progressed {
+			return released, nil
+		}
+	}
+}
+
+// release queues the scheduled notification n. Returns false if another
+// caller released or cancelled it first, or if it was put back to be
+// retried.
+func (b *Batcher) release(ctx context.Context, n store.ScheduledNotification) (bool, error) {
+	ctx = logfield.WithTrace(ctx, n.Notification.TraceID)
+	notif := n.Notification
+
+	claimed, err := b.store.DeleteScheduledAndSetStatus(ctx, notif.RequestID, store.Status{
+		State:     store.StatusQueued,
+		ExpiresAt: b.statusExpiry(store.StatusQueued, time.Now()),
+	})
+	if err != nil {
+		return false, fmt.Errorf("claiming scheduled notification %s: %w", notif.RequestID, err)
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	opts := QueueOptions{Window: n.Window, MaxBatchSize: n.MaxBatchSize, DeviceID: notif.DeviceID}
+	err = b.enqueue(ctx, n.Recipient, n.FcmToken, notif, b.policyFor(ctx, n.Recipient, opts))
+	if err == nil {
+		b.schedules.released.Add(1)
+		if b.cfg.Mirror != nil {
+			b.cfg.Mirror(n.Recipient, n.FcmToken, notif)
+		}
+		return true, nil
+	}
+
+	// Put it back for the next release; shutting down leaves it for the
+	// next start
+	b.schedules.errors.Add(1)
+	if !errors.Is(err, context.Canceled) {
+		log.Printf("WARNING: failed to queue scheduled notification %s for %s, retrying: %v%s", notif.RequestID, n.FcmToken, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	if err := b.store.SaveScheduled(context.WithoutCancel(ctx), n, store.Status{
+		State:     store.StatusScheduled,
+		ExpiresAt: b.statusExpiry(store.StatusScheduled, n.DeliverAt),
+	}); err != nil {
+		log.Printf("ERROR: failed to put back scheduled notification %s: %v%s", notif.RequestID, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	return false, nil
+}
+
+// cancelScheduled removes requestID from the scheduled notifications and
+// sets its status to cancelled, if sender scheduled it. Returns
+// ErrNotPending if it isn't scheduled or is another sender's.
+func (b *Batcher) cancelScheduled(ctx context.Context, requestID, sender string) error {
+	n, err := b.store.GetScheduled(ctx, requestID)
+	if err != nil {
+		return fmt.Errorf("finding scheduled request: %w", err)
+	}
+	if n == nil || n.Notification.Sender != sender {
+		return ErrNotPending
+	}
+
+	cancelled, err := b.store.DeleteScheduledAndSetStatus(ctx, requestID, store.Status{
+		State:     store.StatusCancelled,
+		ExpiresAt: b.statusExpiry(store.StatusCancelled, time.Now()),
+	})
+	if err != nil {
+		return fmt.Errorf("deleting scheduled request: %w", err)
+	}
+	if !cancelled {
+		// Released meanwhile
+		return ErrNotPending
+	}
+	b.emit(Event{
+		Type:       EventDropped,
+		FCMToken:   n.FcmToken,
+		Recipient:  n.Recipient,
+		RequestIDs: []string{requestID},
+		Reason:     store.StatusCancelled,
+	})
+	log.Printf("INFO: cancelled scheduled request %s for %s", requestID, n.FcmToken)
+	return nil
+}
+
+// ScheduleStats returns counts of notifications scheduled and released.
+func (b *Batcher) ScheduleStats() ScheduleStats {
+	return ScheduleStats{
+		Scheduled: b.schedules.scheduled.Load(),
+		Released:  b.schedules.released.Load(),
+		Errors:    b.schedules.errors.Load(),
+	}
+}
@@ -0,0 +1,105 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestQueueWithOptions_DeliverAfter(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     10 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+	ctx := context.Background()
+
+	// Delivery times are kept to the second
+	deliverAt := time.Now().Add(time.Second).Truncate(time.Second)
+	id, err := b.QueueWithOptions(ctx, "bob@oc", "token-1", [][]byte{{1}}, QueueOptions{
+		Sender:       "alice@oc",
+		DeliverAfter: deliverAt,
+	})
+	if err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	if status, _ := st.GetStatus(ctx, id); status.State != store.StatusScheduled {
+		t.Errorf("status before delivery = %q, want %q", status.State, store.StatusScheduled)
+	}
+
+	// Not released early
+	if n, err := b.ReleaseDue(ctx); err != nil || n != 0 {
+		t.Fatalf("ReleaseDue() before due = %d, %v; want 0, nil", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := sender.callCount(); got != 0 {
+		t.Fatalf("sends before delivery time = %d, want 0", got)
+	}
+
+	time.Sleep(time.Until(deliverAt))
+	if n, err := b.ReleaseDue(ctx); err != nil || n != 1 {
+		t.Fatalf("ReleaseDue() when due = %d, %v; want 1, nil", n, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if status, _ := st.GetStatus(ctx, id); status.State != store.StatusSent {
+		t.Errorf("status after delivery = %q, want %q", status.State, store.StatusSent)
+	}
+
+	// Released only once
+	if n, err := b.ReleaseDue(ctx); err != nil || n != 0 {
+		t.Errorf("second ReleaseDue() = %d, %v; want 0, nil", n, err)
+	}
+	if got := b.ScheduleStats(); got.Scheduled != 1 || got.Released != 1 {
+		t.Errorf("ScheduleStats() = %+v, want 1 scheduled and released", got)
+	}
+}
+
+func TestCancel_Scheduled(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	b := New(st, &mockSender{}, Config{
+		BatchWindow:     10 * time.Millisecond,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+	ctx := context.Background()
+
+	id, err := b.QueueWithOptions(ctx, "bob@oc", "token-1", [][]byte{{1}}, QueueOptions{
+		Sender:       "alice@oc",
+		DeliverAfter: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+
+	if sender, err := b.PendingSender(ctx, id); err != nil || sender != "alice@oc" {
+		t.Errorf("PendingSender() = %q, %v; want alice@oc", sender, err)
+	}
+	if err := b.Cancel(ctx, id, "mallory@oc"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("Cancel() by another sender error = %v, want ErrNotPending", err)
+	}
+	if err := b.Cancel(ctx, id, "alice@oc"); err != nil {
+		t.Fatalf("Cancel() error = %v", err)
+	}
+	if status, _ := st.GetStatus(ctx, id); status.State != store.StatusCancelled {
+		t.Errorf("status after Cancel() = %q, want %q", status.State, store.StatusCancelled)
+	}
+	if n, err := st.GetScheduled(ctx, id); err != nil || n != nil {
+		t.Errorf("GetScheduled() after Cancel() = %+v, %v; want nil", n, err)
+	}
+	if err := b.Cancel(ctx, id, "alice@oc"); !errors.Is(err, ErrNotPending) {
+		t.Errorf("second Cancel() error = %v, want ErrNotPending", err)
+	}
+}
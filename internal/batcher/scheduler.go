@@ -0,0 +1,184 @@
+package batcher
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// flushQueue orders due flushes by FlushAt and runs a bounded number at once.
+// Each endpoint has at most one pending batch, so ordering by FlushAt
+// interleaves recipients: a backlog for one endpoint cannot starve others.
+//
+// Batches recovered from the store wait in a lane of their own. Their
+// FlushAt is long past after an outage, so in one heap they would all run
+// before any fresh batch. While both lanes wait, the workers take
+// freshWeight fresh flushes for every recoveredWeight recovered ones.
+type flushQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	items     flushHeap
+	recovered flushHeap
+	queued    map[string]bool
+	stopped   bool
+	wg        sync.WaitGroup
+
+	freshWeight     int
+	recoveredWeight int
+	turn            int // position in the freshWeight+recoveredWeight cycle
+}
+
+// newFlushQueue starts workers goroutines that call flush for due endpoints.
+func newFlushQueue(workers int, flush func(fcmToken string)) *flushQueue {
+	q := &flushQueue{
+		queued:          make(map[string]bool),
+		freshWeight:     1,
+		recoveredWeight: 1,
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.run(flush)
+	}
+	return q
+}
+
+// setWeights sets how many fresh flushes run for every recovered one while
+// both lanes wait. Weights below 1 count as 1.
+func (q *flushQueue) setWeights(fresh, recovered int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.freshWeight = max(fresh, 1)
+	q.recoveredWeight = max(recovered, 1)
+	q.turn = 0
+}
+
+// push schedules a flush for fcmToken. An endpoint already waiting is not added twice.
+func (q *flushQueue) push(fcmToken string, flushAt time.Time) {
+	q.add(&q.items, flushItem{fcmToken: fcmToken, flushAt: flushAt})
+}
+
+// pushRecovered schedules a flush for a batch recovered from the store, in
+// the recovered lane. done is called once the flush has run, or right away
+// if the endpoint is already waiting or the queue is stopped.
+func (q *flushQueue) pushRecovered(fcmToken string, flushAt time.Time, done func()) {
+	q.add(&q.recovered, flushItem{fcmToken: fcmToken, flushAt: flushAt, done: done})
+}
+
+func (q *flushQueue) add(lane *flushHeap, item flushItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped || q.queued[item.fcmToken] {
+		if item.done != nil {
+			item.done()
+		}
+		return
+	}
+	q.queued[item.fcmToken] = true
+	heap.Push(lane, item)
+	q.cond.Signal()
+}
+
+// next pops the flush to run next. Caller must hold q.mu, and a lane must
+// be non-empty.
+func (q *flushQueue) next() flushItem {
+	lane := &q.items
+	switch {
+	case len(q.items) == 0:
+		lane = &q.recovered
+	case len(q.recovered) > 0:
+		if q.turn >= q.freshWeight {
+			lane = &q.recovered
+		}
+		q.turn = (q.turn + 1) % (q.freshWeight + q.recoveredWeight)
+	}
+	return heap.Pop(lane).(flushItem)
+}
+
+// run pops the oldest due flush and runs it until the queue is stopped.
+func (q *flushQueue) run(flush func(fcmToken string)) {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && len(q.recovered) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mu.Unlock()
+			return
+		}
+		item := q.next()
+		delete(q.queued, item.fcmToken)
+		q.mu.Unlock()
+
+		flush(item.fcmToken)
+		if item.done != nil {
+			item.done()
+		}
+	}
+}
+
+// stop discards pending flushes and waits for in-progress ones to finish.
+// Discarded batches remain in the database for recovery.
+func (q *flushQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.items = nil
+	for _, item := range q.recovered {
+		item.done()
+	}
+	q.recovered = nil
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+// flushItem is a pending flush for one endpoint.
+type flushItem struct {
+	fcmToken string
+	flushAt  time.Time
+	done     func() // set for recovered batches; see pushRecovered
+}
+
+// flushHeap is a min-heap of flushItems ordered by flushAt.
+type flushHeap []flushItem
+
+func (h flushHeap) Len() int           { return len(h) }
+func (h flushHeap) Less(i, j int) bool { return h[i].flushAt.Before(h[j].flushAt) }
+func (h flushHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *flushHeap) Push(x any) {
+	*h = append(*h, x.(flushItem))
+}
+
+func (h *flushHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// tokensByFlushAt returns the tokens of batches ordered by FlushAt, oldest first.
+// Ties are broken by token so the order is deterministic.
+func tokensByFlushAt(batches map[string]*store.Batch) []string {
+	tokens := make([]string, 0, len(batches))
+	for fcmToken := range batches {
+		tokens = append(tokens, fcmToken)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		a, b := batches[tokens[i]].FlushAt, batches[tokens[j]].FlushAt
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return tokens[i] < tokens[j]
+	})
+	return tokens
+}
@@ -0,0 +1,146 @@
+package batcher
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// slowSender records send order and the peak number of concurrent sends.
+type slowSender struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	active  int
+	peak    int
+	ordered []string
+}
+
+func (s *slowSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.peak {
+		s.peak = s.active
+	}
+	s.ordered = append(s.ordered, fcmToken)
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return "", nil
+}
+
+func TestFlushQueue_CapsConcurrencyAndOrdersByFlushAt(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &slowSender{delay: 20 * time.Millisecond}
+	b := New(st, sender, Config{
+		BatchWindow:      time.Minute,
+		MaxBatchSize:     100,
+		LockTimeout:      100 * time.Millisecond,
+		StatusRetention:  time.Hour,
+		FlushConcurrency: 1,
+	})
+	defer b.Stop()
+
+	// Hold the only worker so the remaining flushes queue up
+	_, _ = b.Queue(context.Background(), "bob@oc", "busy", [][]byte{{0}})
+	b.dispatchFlush("busy", time.Now())
+	time.Sleep(5 * time.Millisecond)
+
+	// Queue due flushes out of FlushAt order
+	base := time.Now()
+	for i, fcmToken := range []string{"late", "early", "middle"} {
+		_, _ = b.Queue(context.Background(), "bob@oc", fcmToken, [][]byte{{byte(i)}})
+	}
+	b.dispatchFlush("late", base.Add(3*time.Second))
+	b.dispatchFlush("early", base.Add(1*time.Second))
+	b.dispatchFlush("middle", base.Add(2*time.Second))
+
+	time.Sleep(150 * time.Millisecond)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+
+	if sender.peak != 1 {
+		t.Errorf("expected at most 1 concurrent flush, got %d", sender.peak)
+	}
+	want := []string{"busy", "early", "middle", "late"}
+	if len(sender.ordered) != len(want) {
+		t.Fatalf("expected %d sends, got %v", len(want), sender.ordered)
+	}
+	for i := range want {
+		if sender.ordered[i] != want[i] {
+			t.Errorf("send order = %v, want %v", sender.ordered, want)
+			break
+		}
+	}
+}
+
+func TestFlushQueue_InterleavesRecovered(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		ordered []string
+	)
+	release := make(chan struct{})
+	q := newFlushQueue(1, func(fcmToken string) {
+		if fcmToken == "busy" {
+			<-release
+		}
+		mu.Lock()
+		ordered = append(ordered, fcmToken)
+		mu.Unlock()
+	})
+	defer q.stop()
+	q.setWeights(2, 1)
+
+	// Hold the only worker so both lanes fill up
+	q.push("busy", time.Now())
+	time.Sleep(5 * time.Millisecond)
+
+	// Recovered batches are due long before the fresh ones
+	var recovered sync.WaitGroup
+	base := time.Now()
+	for i, fcmToken := range []string{"r1", "r2", "r3"} {
+		recovered.Add(1)
+		q.pushRecovered(fcmToken, base.Add(time.Duration(i-10)*time.Hour), recovered.Done)
+	}
+	for i, fcmToken := range []string{"f1", "f2", "f3", "f4"} {
+		q.push(fcmToken, base.Add(time.Duration(i)*time.Second))
+	}
+	close(release)
+	recovered.Wait()
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"busy", "f1", "f2", "r1", "f3", "f4", "r2", "r3"}
+	if !slices.Equal(ordered, want) {
+		t.Errorf("flush order = %v, want %v", ordered, want)
+	}
+}
+
+func TestTokensByFlushAt(t *testing.T) {
+	base := time.Now()
+	batches := map[string]*store.Batch{
+		"c": {FlushAt: base.Add(2 * time.Second)},
+		"a": {FlushAt: base},
+		"d": {FlushAt: base.Add(time.Second)},
+		"b": {FlushAt: base},
+	}
+
+	got := tokensByFlushAt(batches)
+	want := []string{"a", "b", "d", "c"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("tokensByFlushAt() = %v, want %v", got, want)
+		}
+	}
+}
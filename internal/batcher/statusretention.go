@@ -0,0 +1,51 @@
+package batcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// retainedStates are the states the batcher sets a status's expiry on
+// entering, and so the ones StateRetention may name.
+var retainedStates = map[string]bool{
+	store.StatusSent:                true,
+	store.StatusFailed:              true,
+	store.StatusExpired:             true,
+	store.StatusTimedOut:            true,
+	store.StatusLost:                true,
+	store.StatusFailedPermanent:     true,
+	store.StatusCancelled:           true,
+	store.StatusSkippedInvalidToken: true,
+	store.StatusHeldDND:             true,
+	store.StatusDroppedDND:          true,
+	store.StatusRecipientGone:       true,
+	store.StatusExpiredUnclaimed:    true,
+	store.StatusScheduled:           true,
+	store.StatusTakenOver:           true,
+}
+
+// ValidateStateRetention checks that retention, as for
+// Config.StateRetention, names only states statuses are recorded in, each
+// with a positive period.
+func ValidateStateRetention(retention map[string]time.Duration) error {
+	for state, d := range retention {
+		if !retainedStates[state] {
+			return fmt.Errorf("unknown status state %q", state)
+		}
+		if d <= 0 {
+			return fmt.Errorf("retention for %s must be positive, got %s", state, d)
+		}
+	}
+	return nil
+}
+
+// statusExpiry returns when a status entering state at now expires: after
+// its StateRetention period, or StatusRetention if it has none.
+func (b *Batcher) statusExpiry(state string, now time.Time) time.Time {
+	if d, ok := b.cfg.StateRetention[state]; ok {
+		return now.Add(d)
+	}
+	return now.Add(b.cfg.StatusRetention)
+}
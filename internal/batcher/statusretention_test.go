@@ -0,0 +1,76 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestStateRetention(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	// Failed statuses expire as soon as they are written, others are kept
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		StateRetention:  map[string]time.Duration{store.StatusFailed: -time.Second},
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	sentID, err := b.Queue(ctx, "bob@oc", "token-sent", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	b.FlushPending(ctx)
+
+	sender.failCount = 1
+	sender.failErr = errors.New("internal error")
+	if _, err := b.Queue(ctx, "bob@oc", "token-failed", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	b.FlushPending(ctx)
+
+	status, err := b.GetStatus(ctx, sentID)
+	if err != nil || status.State != store.StatusSent {
+		t.Fatalf("GetStatus() = %+v, %v; want sent", status, err)
+	}
+	if until := time.Until(status.ExpiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("sent status expires in %s, want StatusRetention", until)
+	}
+
+	deleted, err := st.CleanupExpiredStatusByState(ctx)
+	if err != nil {
+		t.Fatalf("CleanupExpiredStatusByState() error = %v", err)
+	}
+	if want := map[string]int64{store.StatusFailed: 1}; !maps.Equal(deleted, want) {
+		t.Errorf("CleanupExpiredStatusByState() = %v, want %v", deleted, want)
+	}
+}
+
+func TestValidateStateRetention(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention map[string]time.Duration
+		wantErr   bool
+	}{
+		{"none", nil, false},
+		{"known states", map[string]time.Duration{store.StatusSent: time.Hour, store.StatusFailed: 72 * time.Hour}, false},
+		{"unknown state", map[string]time.Duration{"delivered": time.Hour}, true},
+		{"queued has no expiry of its own", map[string]time.Duration{store.StatusQueued: time.Hour}, true},
+		{"zero period", map[string]time.Duration{store.StatusExpired: 0}, true},
+	}
+	for _, tt := range tests {
+		if err := ValidateStateRetention(tt.retention); (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidateStateRetention() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Store failure policies, selecting what Queue does while the store can't
+// persist batches.
+const (
+	// StoreFailureMemory keeps queuing in memory. Batches that couldn't be
+	// persisted are lost if the process restarts before the store recovers.
+	StoreFailureMemory = "memory"
+	// StoreFailureReject rejects new notifications with ErrStoreUnavailable,
+	// so callers retry later instead of trusting an unpersisted request ID.
+	StoreFailureReject = "reject"
+)
+
+// ErrStoreUnavailable is returned by Queue when the store can't persist the
+// notification and the failure policy is StoreFailureReject.
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// StoreHealth reports whether the store is persisting batches.
+type StoreHealth struct {
+	Healthy  bool       `json:"healthy"`
+	Policy   string     `json:"policy"`
+	Since    *time.Time `json:"since,omitempty"` // when the store started failing
+	Error    string     `json:"error,omitempty"` // the latest failure
+	Failures uint64     `json:"failures"`        // failed store operations since startup
+}
+
+// storeHealth tracks store failures seen by the batcher. The store counts as
+// failing from its first failed write until a write succeeds again.
+type storeHealth struct {
+	mu       sync.Mutex
+	failing  bool
+	since    time.Time
+	lastErr  error
+	failures uint64
+}
+
+// storeFailed records a failed store operation. Errors caused by the
+// caller's context ending say nothing about the store and are ignored.
+func (b *Batcher) storeFailed(ctx context.Context, op string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	h := &b.storeHealth
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures++
+	h.lastErr = err
+	if h.failing {
+		return
+	}
+	h.failing = true
+	h.since = time.Now()
+	if b.policy() == StoreFailureReject {
+		log.Printf("ERROR: store unavailable (%s: %v); rejecting new notifications until it recovers", op, err)
+	} else {
+		log.Printf("ERROR: store unavailable (%s: %v); queuing in memory only, batches will be lost on restart until it recovers", op, err)
+	}
+}
+
+// storeSucceeded records a successful store write, ending a failure period.
+func (b *Batcher) storeSucceeded() {
+	h := &b.storeHealth
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.failing {
+		return
+	}
+	log.Printf("INFO: store recovered after %s", time.Since(h.since).Round(time.Second))
+	h.failing = false
+	h.lastErr = nil
+}
+
+// StoreHealth returns whether the store is currently persisting batches.
+func (b *Batcher) StoreHealth() StoreHealth {
+	h := &b.storeHealth
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	health := StoreHealth{
+		Healthy:  !h.failing,
+		Policy:   b.policy(),
+		Failures: h.failures,
+	}
+	if h.failing {
+		since := h.since
+		health.Since = &since
+		health.Error = h.lastErr.Error()
+	}
+	return health
+}
+
+// policy returns the configured store failure policy.
+func (b *Batcher) policy() string {
+	if b.cfg.StoreFailurePolicy == "" {
+		return StoreFailureMemory
+	}
+	return b.cfg.StoreFailurePolicy
+}
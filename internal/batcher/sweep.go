@@ -0,0 +1,178 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// TokenValidator checks whether FCM still accepts a token, without
+// delivering anything to it.
+// *fcm.Sender implements this interface.
+type TokenValidator interface {
+	Validate(ctx context.Context, fcmToken string) error
+}
+
+// sweepCounters counts what SweepTokens found since startup.
+type sweepCounters struct {
+	sweeps  atomic.Uint64
+	checked atomic.Uint64
+	invalid atomic.Uint64
+	skipped atomic.Uint64
+	errors  atomic.Uint64
+	last    atomic.Int64 // Unix time of the last sweep
+}
+
+// SweepStats counts the results of token validation sweeps since startup.
+type SweepStats struct {
+	Sweeps  uint64 `json:"sweeps"`
+	Checked uint64 `json:"checked"` // tokens validated
+	Invalid uint64 `json:"invalid"` // tokens FCM reported unregistered
+	// SkippedBatches counts pending batches dropped because their token
+	// turned out to be unregistered.
+	SkippedBatches uint64 `json:"skipped_batches"`
+	Errors         uint64 `json:"errors"`     // validations that failed for other reasons
+	LastSweep      int64  `json:"last_sweep"` // Unix timestamp (seconds); 0 before the first sweep
+}
+
+// SweepTokens validates, with FCM dry-run sends, the tokens of the pending
+// batches this batcher holds and of deliveries that failed within since,
+// at most limit of them, batches first. Tokens FCM reports unregistered are
+// recorded as invalid, and their pending batches are dropped with status
+// skipped_invalid_token instead of waiting to fail. Tokens already recorded
+// as invalid aren't checked again. The sweep stops early, without error,
+// when the FCM QPS budget runs out. Returns how many tokens were invalid.
+func (b *Batcher) SweepTokens(ctx context.Context, v TokenValidator, since time.Duration, limit int) (int, error) {
+	tokens, err := b.sweepCandidates(ctx, since, limit)
+	if err != nil {
+		return 0, err
+	}
+	b.sweep.sweeps.Add(1)
+	b.sweep.last.Store(time.Now().Unix())
+
+	invalid := 0
+	for _, fcmToken := range tokens {
+		if ctx.Err() != nil {
+			return invalid, ctx.Err()
+		}
+		err := v.Validate(ctx, fcmToken)
+		var retry retryableError
+		if errors.As(err, &retry) {
+			log.Printf("INFO: token sweep stopped, FCM rate limit reached: %v", err)
+			break
+		}
+		b.sweep.checked.Add(1)
+		if err == nil {
+			continue
+		}
+		if !unregistered(err) {
+			b.sweep.errors.Add(1)
+			log.Printf("WARNING: validating token %s: %v", fcmToken, err)
+			continue
+		}
+
+		invalid++
+		b.sweep.invalid.Add(1)
+		if err := b.store.RecordInvalidToken(ctx, fcmToken); err != nil {
+			log.Printf("WARNING: failed to record invalid token %s: %v", fcmToken, err)
+		}
+		if b.dropForInvalidToken(ctx, fcmToken) {
+			b.sweep.skipped.Add(1)
+		}
+	}
+	if invalid > 0 {
+		log.Printf("INFO: token sweep found %d of %d tokens unregistered", invalid, len(tokens))
+	}
+	return invalid, nil
+}
+
+// sweepCandidates returns the tokens SweepTokens checks: those of pending
+// batches held in memory, then those of deliveries that failed within
+// since, leaving out tokens already recorded as invalid.
+func (b *Batcher) sweepCandidates(ctx context.Context, since time.Duration, limit int) ([]string, error) {
+	// Every pending batch has a flush timer
+	var candidates []string
+	b.mu.Lock()
+	for fcmToken := range b.timers {
+		candidates = append(candidates, fcmToken)
+	}
+	b.mu.Unlock()
+
+	failed, err := b.store.LoadFailedSince(ctx, time.Now().Add(-since))
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range failed {
+		candidates = append(candidates, fd.FcmToken)
+	}
+
+	seen := make(map[string]bool, len(candidates))
+	var tokens []string
+	for _, fcmToken := range candidates {
+		if len(tokens) == limit {
+			break
+		}
+		if seen[fcmToken] {
+			continue
+		}
+		seen[fcmToken] = true
+		invalid, err := b.store.IsInvalidToken(ctx, fcmToken)
+		if err != nil {
+			return nil, err
+		}
+		if !invalid {
+			tokens = append(tokens, fcmToken)
+		}
+	}
+	return tokens, nil
+}
+
+// dropForInvalidToken deletes the pending batch for fcmToken, if this
+// batcher holds one, marking its requests skipped_invalid_token. Returns
+// true if a batch was dropped.
+func (b *Batcher) dropForInvalidToken(ctx context.Context, fcmToken string) bool {
+	b.mu.Lock()
+	entry, ok := b.batches[fcmToken]
+	b.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	// Waits out an in-flight flush, which may have sent the batch already
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.batch == nil || len(entry.batch.Notifications) == 0 {
+		return false
+	}
+	ctx = withTrace(ctx, entry.batch)
+
+	b.stopTimer(fcmToken)
+	if err := b.deleteBatch(ctx, fcmToken, entry.batch, store.Status{
+		State:     store.StatusSkippedInvalidToken,
+		Error:     "FCM token no longer registered",
+		ExpiresAt: b.statusExpiry(store.StatusSkippedInvalidToken, time.Now()),
+	}); err != nil {
+		log.Printf("ERROR: failed to update status for %s: %v%s", fcmToken, err, logfield.Format(logfield.Trace(ctx)))
+	}
+	b.emitDropped(fcmToken, entry.batch, requestIDs(entry.batch.Notifications), store.StatusSkippedInvalidToken)
+	entry.batch = nil
+	log.Printf("INFO: dropped pending batch for unregistered token %s%s", fcmToken, logfield.Format(logfield.Trace(ctx)))
+	return true
+}
+
+// SweepStats returns counts of what token validation sweeps found.
+func (b *Batcher) SweepStats() SweepStats {
+	return SweepStats{
+		Sweeps:         b.sweep.sweeps.Load(),
+		Checked:        b.sweep.checked.Load(),
+		Invalid:        b.sweep.invalid.Load(),
+		SkippedBatches: b.sweep.skipped.Load(),
+		Errors:         b.sweep.errors.Load(),
+		LastSweep:      b.sweep.last.Load(),
+	}
+}
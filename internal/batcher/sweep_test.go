@@ -0,0 +1,93 @@
+package batcher
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// mockValidator reports the tokens in dead as unregistered.
+type mockValidator struct {
+	dead map[string]bool
+
+	mu      sync.Mutex
+	checked []string
+}
+
+func (m *mockValidator) Validate(ctx context.Context, fcmToken string) error {
+	m.mu.Lock()
+	m.checked = append(m.checked, fcmToken)
+	m.mu.Unlock()
+	if m.dead[fcmToken] {
+		return invalidTokenErr{}
+	}
+	return nil
+}
+
+func TestSweepTokens(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	deadID, err := b.Queue(ctx, "bob@oc", "dead-token", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	liveID, err := b.Queue(ctx, "bob@oc", "live-token", [][]byte{{2}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	validator := &mockValidator{dead: map[string]bool{"dead-token": true}}
+	invalid, err := b.SweepTokens(ctx, validator, time.Hour, 10)
+	if err != nil {
+		t.Fatalf("SweepTokens() error = %v", err)
+	}
+	if invalid != 1 {
+		t.Errorf("SweepTokens() = %d, want 1", invalid)
+	}
+
+	if recorded, _ := st.IsInvalidToken(ctx, "dead-token"); !recorded {
+		t.Error("dead token not recorded as invalid")
+	}
+	if status, _ := b.GetStatus(ctx, deadID); status.State != store.StatusSkippedInvalidToken {
+		t.Errorf("dead token's request state = %q, want %q", status.State, store.StatusSkippedInvalidToken)
+	}
+	pending, err := b.ListByRecipient(ctx, "bob@oc")
+	if err != nil {
+		t.Fatalf("ListByRecipient() error = %v", err)
+	}
+	if len(pending) != 1 || pending["live-token"] == nil || pending["live-token"].Notifications[0].RequestID != liveID {
+		t.Errorf("pending batches = %v, want only the live token's", pending)
+	}
+
+	want := SweepStats{Sweeps: 1, Checked: 2, Invalid: 1, SkippedBatches: 1}
+	got := b.SweepStats()
+	got.LastSweep = 0
+	if got != want {
+		t.Errorf("SweepStats() = %+v, want %+v", got, want)
+	}
+
+	// Recorded tokens aren't checked again
+	validator.checked = nil
+	if _, err := b.SweepTokens(ctx, validator, time.Hour, 10); err != nil {
+		t.Fatalf("SweepTokens() error = %v", err)
+	}
+	for _, fcmToken := range validator.checked {
+		if fcmToken == "dead-token" {
+			t.Error("second sweep checked the recorded invalid token")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package batcher
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// watchdogCounters counts what FlushStuck found since startup.
+type watchdogCounters struct {
+	scans     atomic.Uint64
+	stuck     atomic.Uint64
+	lastScan  atomic.Int64 // Unix time of the last scan
+	lastStuck atomic.Int64 // Unix time a stuck batch was last found
+}
+
+// WatchdogStats counts the results of stuck batch scans since startup.
+type WatchdogStats struct {
+	Scans uint64 `json:"scans"`
+	// Stuck counts batches found long overdue with no flush scheduled,
+	// which the watchdog flushed. Anything above zero points at a bug in
+	// flush scheduling.
+	Stuck     uint64 `json:"stuck"`
+	LastScan  int64  `json:"last_scan"`  // Unix timestamp (seconds); 0 before the first scan
+	LastStuck int64  `json:"last_stuck"` // Unix timestamp (seconds); 0 if none was found
+}
+
+// FlushStuck flushes persisted batches that were due more than after ago
+// but have no flush scheduled or running, looking at the limit oldest
+// batches. A batch waiting on a retry or a lease still has its timer and is
+// left alone, as are batches flushing right now. Batches this batcher doesn't
+// hold, such as ones left by an instance that died, are adopted first.
+// Each stuck batch is logged and counted. Returns how many were found.
+func (b *Batcher) FlushStuck(ctx context.Context, after time.Duration, limit int) (int, error) {
+	batches, err := b.store.LoadOldestBatches(ctx, limit)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	b.watchdog.scans.Add(1)
+	b.watchdog.lastScan.Store(now.Unix())
+
+	cutoff := now.Add(-after)
+	stuck := 0
+	for _, fcmToken := range tokensByFlushAt(batches) {
+		if ctx.Err() != nil {
+			return stuck, ctx.Err()
+		}
+		batch := batches[fcmToken]
+		// Oldest first, so none of the remaining batches are overdue either
+		if batch.FlushAt.After(cutoff) {
+			break
+		}
+		if !b.unscheduled(fcmToken) {
+			continue
+		}
+
+		stuck++
+		b.watchdog.stuck.Add(1)
+		b.watchdog.lastStuck.Store(now.Unix())
+		log.Printf("WARNING: batch for %s was due %s ago but no flush is scheduled, flushing it now%s",
+			fcmToken, now.Sub(batch.FlushAt).Round(time.Second), logfield.Format(logfield.Trace(withTrace(ctx, batch))))
+
+		b.adopt(ctx, fcmToken, batch)
+		b.flushSync(ctx, fcmToken, true)
+	}
+	return stuck, nil
+}
+
+// unscheduled reports whether nothing will flush the batch for fcmToken:
+// it has no timer and isn't being flushed.
+func (b *Batcher) unscheduled(fcmToken string) bool {
+	b.mu.Lock()
+	_, timed := b.timers[fcmToken]
+	entry := b.batches[fcmToken]
+	stopped := b.stopped
+	b.mu.Unlock()
+
+	if stopped || timed {
+		return false
+	}
+	if entry != nil {
+		// A flush holds the entry while it sends
+		if !entry.mu.TryLock() {
+			return false
+		}
+		entry.mu.Unlock()
+	}
+	return true
+}
+
+// WatchdogStats returns counts of stuck batch scans.
+func (b *Batcher) WatchdogStats() WatchdogStats {
+	return WatchdogStats{
+		Scans:     b.watchdog.scans.Load(),
+		Stuck:     b.watchdog.stuck.Load(),
+		LastScan:  b.watchdog.lastScan.Load(),
+		LastStuck: b.watchdog.lastStuck.Load(),
+	}
+}
@@ -0,0 +1,85 @@
+package batcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestFlushStuck(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Hour,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	lostID, err := b.Queue(ctx, "bob@oc", "lost-token", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	if _, err := b.Queue(ctx, "bob@oc", "timed-token", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	// Both batches are long overdue, but only lost-token lost its timer
+	overdue := time.Now().Add(-time.Hour)
+	for _, fcmToken := range []string{"lost-token", "timed-token"} {
+		batches, err := b.ListByRecipient(ctx, "bob@oc")
+		if err != nil {
+			t.Fatalf("ListByRecipient() error = %v", err)
+		}
+		batch := batches[fcmToken]
+		batch.FlushAt = overdue
+		if err := st.SaveBatch(ctx, fcmToken, batch); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+	b.stopTimer("lost-token")
+
+	// A batch no instance holds, like one left by a crashed process
+	orphanAt := overdue.Add(time.Minute)
+	if err := st.SaveBatch(ctx, "orphan-token", &store.Batch{
+		Recipient:     "carol@oc",
+		Notifications: []store.QueuedNotification{{RequestID: "orphan-req", DataIDs: [][]byte{{3}}}},
+		CreatedAt:     orphanAt,
+		FlushAt:       orphanAt,
+	}); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	stuck, err := b.FlushStuck(ctx, 5*time.Minute, 10)
+	if err != nil {
+		t.Fatalf("FlushStuck() error = %v", err)
+	}
+	if stuck != 2 {
+		t.Errorf("FlushStuck() = %d, want 2", stuck)
+	}
+	if got := sender.callCount(); got != 2 {
+		t.Errorf("sends = %d, want 2", got)
+	}
+	if status, _ := b.GetStatus(ctx, lostID); status.State != store.StatusSent {
+		t.Errorf("lost batch's request state = %q, want %q", status.State, store.StatusSent)
+	}
+	if orphans, _ := b.ListByRecipient(ctx, "carol@oc"); len(orphans) != 0 {
+		t.Errorf("orphaned batch still pending: %v", orphans)
+	}
+
+	got := b.WatchdogStats()
+	if got.Scans != 1 || got.Stuck != 2 || got.LastStuck == 0 {
+		t.Errorf("WatchdogStats() = %+v, want 1 scan finding 2 stuck batches", got)
+	}
+
+	// The batch with a timer is still waiting for it
+	if stuck, err := b.FlushStuck(ctx, 5*time.Minute, 10); err != nil || stuck != 0 {
+		t.Errorf("second FlushStuck() = %d, %v; want 0, nil", stuck, err)
+	}
+}
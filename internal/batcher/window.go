@@ -0,0 +1,156 @@
+package batcher
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultAdaptiveFullLoad is used when Config.AdaptiveFullLoad is zero.
+const defaultAdaptiveFullLoad = 1000
+
+// windowCacheTTL is how long a recipient's batch window preference is reused
+// before re-reading it.
+const windowCacheTTL = 10 * time.Minute
+
+// WindowSource looks up a user's preferred batch window.
+// *ourcloud.Client implements this interface.
+type WindowSource interface {
+	GetBatchWindow(ctx context.Context, username string) (time.Duration, error)
+}
+
+// cachedWindow is a recipient's window preference; zero means none.
+type cachedWindow struct {
+	window    time.Duration
+	expiresAt time.Time
+}
+
+// windowCache caches recipients' batch window preferences.
+type windowCache struct {
+	source WindowSource
+
+	mu      sync.Mutex
+	entries map[string]cachedWindow
+}
+
+// preference returns recipient's preferred window, or zero if they have none
+// or it can't be read.
+func (c *windowCache) preference(ctx context.Context, recipient string) time.Duration {
+	now := time.Now()
+
+	c.mu.Lock()
+	cached, ok := c.entries[recipient]
+	c.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.window
+	}
+
+	// A missing preference label is normal; cache the miss like a hit
+	window, err := c.source.GetBatchWindow(ctx, recipient)
+	if err != nil {
+		window = 0
+	}
+
+	c.mu.Lock()
+	c.entries[recipient] = cachedWindow{window: window, expiresAt: now.Add(windowCacheTTL)}
+	c.mu.Unlock()
+
+	return window
+}
+
+// flushPolicy says when the batch a notification joins flushes.
+type flushPolicy struct {
+	// window is how long a new batch waits; zero sizes it adaptively.
+	window time.Duration
+	// firm brings a pending batch due later than window from now forward,
+	// so notifications that mustn't wait long aren't held by others.
+	firm bool
+	// maxSize flushes the batch once it holds this many notifications.
+	maxSize int
+}
+
+// policyFor returns the flush policy for a notification to recipient queued
+// with opts.
+func (b *Batcher) policyFor(ctx context.Context, recipient string, opts QueueOptions) flushPolicy {
+	policy := flushPolicy{window: b.windowFor(ctx, recipient), maxSize: b.cfg.MaxBatchSize}
+	if opts.Window > 0 && b.preferredWindow(ctx, recipient) == 0 {
+		policy.window = opts.Window
+		policy.firm = true
+	}
+	if opts.MaxBatchSize > 0 {
+		policy.maxSize = opts.MaxBatchSize
+	}
+	// Adaptive windows are zero here, and can grow past it
+	if (policy.window == 0 || policy.window > b.cfg.ForegroundWindow) && b.isForeground(recipient, opts.DeviceID) {
+		policy.window = b.cfg.ForegroundWindow
+		policy.firm = true
+		b.foreground.shortened.Add(1)
+	}
+	return policy
+}
+
+// windowFor returns the batch window for a new batch to recipient: their
+// preference clamped to [MinWindow, MaxWindow], or the default window if
+// they have none.
+func (b *Batcher) windowFor(ctx context.Context, recipient string) time.Duration {
+	if window := b.preferredWindow(ctx, recipient); window > 0 {
+		return window
+	}
+	return b.defaultWindow()
+}
+
+// preferredWindow returns recipient's preferred window clamped to
+// [MinWindow, MaxWindow], or zero if they have none or recipients can't
+// choose.
+func (b *Batcher) preferredWindow(ctx context.Context, recipient string) time.Duration {
+	if b.windows == nil || recipient == "" {
+		return 0
+	}
+
+	window := b.windows.preference(ctx, recipient)
+	if window <= 0 {
+		return 0
+	}
+	if b.cfg.MinWindow > 0 {
+		window = max(window, b.cfg.MinWindow)
+	}
+	if b.cfg.MaxWindow > 0 {
+		window = min(window, b.cfg.MaxWindow)
+	}
+	return window
+}
+
+// defaultWindow returns BatchWindow, or zero to have enqueue size the batch
+// adaptively.
+func (b *Batcher) defaultWindow() time.Duration {
+	if b.cfg.Adaptive {
+		return 0
+	}
+	return b.cfg.BatchWindow
+}
+
+// adaptiveWindow returns the window for a batch holding queued notifications.
+// It is MinWindow for a lone notification on an idle gateway and grows
+// linearly to MaxWindow as the batch fills toward MaxBatchSize or the number
+// of pending batches reaches AdaptiveFullLoad, whichever is further along.
+// Waiting longer under load merges more notifications into each FCM call.
+func (b *Batcher) adaptiveWindow(queued int) time.Duration {
+	b.mu.Lock()
+	pending := len(b.timers)
+	b.mu.Unlock()
+
+	fullLoad := b.cfg.AdaptiveFullLoad
+	if fullLoad <= 0 {
+		fullLoad = defaultAdaptiveFullLoad
+	}
+	maxWindow := b.cfg.MaxWindow
+	if maxWindow <= 0 {
+		maxWindow = b.cfg.BatchWindow
+	}
+	minWindow := min(b.cfg.MinWindow, maxWindow)
+
+	// A lone notification counts as an empty queue
+	fill := float64(queued-1) / float64(max(b.cfg.MaxBatchSize-1, 1))
+	load := min(max(fill, float64(pending)/float64(fullLoad)), 1)
+	return minWindow + time.Duration(load*float64(maxWindow-minWindow))
+}
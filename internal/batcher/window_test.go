@@ -0,0 +1,209 @@
+package batcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockWindowSource returns fixed window preferences and counts lookups.
+type mockWindowSource struct {
+	mu      sync.Mutex
+	windows map[string]time.Duration
+	lookups int
+}
+
+func (m *mockWindowSource) GetBatchWindow(ctx context.Context, username string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookups++
+	w, ok := m.windows[username]
+	if !ok {
+		return 0, errors.New("label not found")
+	}
+	return w, nil
+}
+
+func TestWindowFor(t *testing.T) {
+	source := &mockWindowSource{windows: map[string]time.Duration{
+		"realtime@oc": time.Second,
+		"saver@oc":    time.Hour,
+		"normal@oc":   2 * time.Minute,
+	}}
+	b := New(nil, &mockSender{}, Config{
+		BatchWindow: time.Minute,
+		Windows:     source,
+		MinWindow:   5 * time.Second,
+		MaxWindow:   15 * time.Minute,
+	})
+	defer b.Stop()
+
+	tests := []struct {
+		recipient string
+		want      time.Duration
+	}{
+		{recipient: "normal@oc", want: 2 * time.Minute},
+		{recipient: "realtime@oc", want: 5 * time.Second},
+		{recipient: "saver@oc", want: 15 * time.Minute},
+		{recipient: "unset@oc", want: time.Minute},
+		{recipient: "", want: time.Minute},
+	}
+	for _, tt := range tests {
+		if got := b.windowFor(context.Background(), tt.recipient); got != tt.want {
+			t.Errorf("windowFor(%q) = %v, want %v", tt.recipient, got, tt.want)
+		}
+	}
+
+	// Preferences, including misses, are cached
+	lookups := source.lookups
+	b.windowFor(context.Background(), "normal@oc")
+	b.windowFor(context.Background(), "unset@oc")
+	if source.lookups != lookups {
+		t.Errorf("expected cached lookups, got %d more", source.lookups-lookups)
+	}
+}
+
+func TestQueue_UsesRecipientWindow(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		Windows:         &mockWindowSource{windows: map[string]time.Duration{"realtime@oc": 20 * time.Millisecond}},
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "realtime@oc", "token-fast", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	if _, err := b.Queue(ctx, "other@oc", "token-slow", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-fast" {
+		t.Errorf("sends = %v, want only token-fast flushed", calls)
+	}
+}
+
+func TestQueue_OptionWindowBringsBatchForward(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    100,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	// A bulk notification starts a batch with a long window
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{1}}, QueueOptions{Window: time.Hour}); err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	// An interactive one mustn't wait for it
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{2}}, QueueOptions{Window: 20 * time.Millisecond}); err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+	// Neither does a longer window push the batch back
+	if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{3}}, QueueOptions{Window: time.Hour}); err != nil {
+		t.Fatalf("QueueWithOptions() error = %v", err)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	calls := sender.getCalls()
+	if len(calls) != 1 || len(calls[0].DataIDs) != 3 {
+		t.Fatalf("sends = %v, want one send of all three notifications", calls)
+	}
+
+	// MaxBatchSize flushes at the queuing notification's limit
+	for i := 0; i < 2; i++ {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token2", [][]byte{{byte(i)}}, QueueOptions{MaxBatchSize: 2}); err != nil {
+			t.Fatalf("QueueWithOptions() error = %v", err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if sender.callCount() != 2 {
+		t.Errorf("sends = %d, want the batch flushed at 2 notifications", sender.callCount())
+	}
+}
+
+func TestAdaptiveWindow(t *testing.T) {
+	b := New(nil, &mockSender{}, Config{
+		BatchWindow:      time.Minute,
+		MaxBatchSize:     11,
+		MinWindow:        time.Second,
+		MaxWindow:        11 * time.Second,
+		Adaptive:         true,
+		AdaptiveFullLoad: 4,
+	})
+	defer b.Stop()
+
+	if got := b.windowFor(context.Background(), "bob@oc"); got != 0 {
+		t.Errorf("windowFor() = %v, want 0 (adaptive)", got)
+	}
+
+	// Idle gateway: the window follows the endpoint's queue
+	if got := b.adaptiveWindow(1); got != time.Second {
+		t.Errorf("adaptiveWindow(1) = %v, want 1s", got)
+	}
+	if got := b.adaptiveWindow(6); got != 6*time.Second {
+		t.Errorf("adaptiveWindow(6) = %v, want 6s", got)
+	}
+
+	// Half the full load of pending batches lifts even a lone notification
+	b.mu.Lock()
+	b.timers["a"] = time.NewTimer(time.Hour)
+	b.timers["b"] = time.NewTimer(time.Hour)
+	b.mu.Unlock()
+	if got := b.adaptiveWindow(1); got != 6*time.Second {
+		t.Errorf("adaptiveWindow(1) under load = %v, want 6s", got)
+	}
+}
+
+func TestQueue_AdaptiveWindowGrows(t *testing.T) {
+	st, cleanup := createTestStore(t)
+	defer cleanup()
+
+	sender := &mockSender{}
+	b := New(st, sender, Config{
+		BatchWindow:     time.Minute,
+		MaxBatchSize:    3,
+		LockTimeout:     100 * time.Millisecond,
+		StatusRetention: time.Hour,
+		MinWindow:       30 * time.Millisecond,
+		MaxWindow:       time.Second,
+		Adaptive:        true,
+	})
+	defer b.Stop()
+
+	ctx := context.Background()
+	if _, err := b.Queue(ctx, "bob@oc", "token-quiet", [][]byte{{1}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	// A second notification stretches token-busy's window to ~0.5s
+	for i := byte(0); i < 2; i++ {
+		if _, err := b.Queue(ctx, "carol@oc", "token-busy", [][]byte{{i}}); err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	calls := sender.getCalls()
+	if len(calls) != 1 || calls[0].FcmToken != "token-quiet" {
+		t.Errorf("sends = %v, want only token-quiet flushed", calls)
+	}
+}
@@ -1,7 +1,13 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"time"
 
@@ -10,12 +16,38 @@ import (
 
 // Config holds all configuration for the push gateway server.
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Firebase FirebaseConfig `yaml:"firebase"`
-	OurCloud OurCloudConfig `yaml:"ourcloud"`
-	Storage  StorageConfig  `yaml:"storage"`
-	Batch    BatchConfig    `yaml:"batch"`
-	Status   StatusConfig   `yaml:"status"`
+	// Version is the config schema version. Load converts older files, so
+	// a loaded Config is always CurrentVersion.
+	Version    int              `yaml:"version"`
+	Server     ServerConfig     `yaml:"server"`
+	Firebase   FirebaseConfig   `yaml:"firebase"`
+	OurCloud   OurCloudConfig   `yaml:"ourcloud"`
+	Proxy      ProxyConfig      `yaml:"proxy"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Batch      BatchConfig      `yaml:"batch"`
+	Status     StatusConfig     `yaml:"status"`
+	Admin      AdminConfig      `yaml:"admin"`
+	Visible    VisibleConfig    `yaml:"visible"`
+	Privacy    PrivacyConfig    `yaml:"privacy"`
+	Federation FederationConfig `yaml:"federation"`
+	Mirror     MirrorConfig     `yaml:"mirror"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Consent    ConsentConfig    `yaml:"consent"`
+	DND        DNDConfig        `yaml:"dnd"`
+	Abuse      AbuseConfig      `yaml:"abuse"`
+	GRPC       GRPCConfig       `yaml:"grpc"`
+	Log        LogConfig        `yaml:"log"`
+	Routes     RoutesConfig     `yaml:"routes"`
+	// Passthrough lists PushRequest fields outside the gateway's schema
+	// that are copied into the FCM data payload.
+	Passthrough []PassthroughField `yaml:"passthrough"`
+	// SenderClasses give groups of senders their own batch window, batch
+	// size, and push rate. A sender is in the first class matching it.
+	SenderClasses []SenderClassConfig `yaml:"sender_classes"`
+
+	// Hash is the hex SHA-256 of the loaded config file, used to identify
+	// which configuration a running instance was started with.
+	Hash string `yaml:"-"`
 }
 
 // ServerConfig holds HTTP server settings.
@@ -23,53 +55,806 @@ type ServerConfig struct {
 	Port         int           `yaml:"port"`
 	ReadTimeout  time.Duration `yaml:"read_timeout"`
 	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout is how long a keep-alive connection stays open waiting for
+	// the next request, so polling clients can reuse it.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// TCPKeepAlive is the interval between TCP keep-alive probes, which
+	// detect clients that vanished without closing. Zero uses Go's default
+	// (15s); negative disables probes.
+	TCPKeepAlive time.Duration `yaml:"tcp_keep_alive"`
+	// Compression gzips JSON responses for clients that accept it.
+	Compression bool `yaml:"compression"`
+	// MaxConcurrentPush caps in-flight /push and /validate requests, which
+	// share the limit. Zero disables it.
+	MaxConcurrentPush int `yaml:"max_concurrent_push"`
+	// PushQueueSize is how many /push requests may wait for a slot before
+	// further requests get 503.
+	PushQueueSize int `yaml:"push_queue_size"`
+	// PushQueueTimeout is how long a queued /push request waits for a slot.
+	PushQueueTimeout time.Duration `yaml:"push_queue_timeout"`
+	// Handoff lets a new process start while the old one drains: the port is
+	// bound with SO_REUSEPORT, startup recovery leaves batches that aren't due
+	// yet to the old process, and shutdown flushes every pending batch.
+	Handoff bool `yaml:"handoff"`
+	// HandoffGrace is how long a handoff process waits after startup before
+	// recovering batches the old process left behind.
+	HandoffGrace time.Duration `yaml:"handoff_grace"`
+	// TrustedProxies lists the IPs or CIDR ranges of reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers identify the client.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// JSONAPI lets protobuf endpoints such as /push also accept and return
+	// the protobuf JSON mapping, as application/json.
+	JSONAPI bool `yaml:"json_api"`
+	// PushTiming reports how long each stage of a /push request took in a
+	// Server-Timing response header, for clients diagnosing slow pushes.
+	PushTiming bool `yaml:"push_timing"`
 }
 
 // FirebaseConfig holds Firebase Admin SDK settings.
 type FirebaseConfig struct {
 	CredentialsFile string `yaml:"credentials_file"`
+	// CredentialsJSON is the service account JSON itself, used instead of
+	// CredentialsFile when set, e.g. from a secret in the environment.
+	CredentialsJSON string `yaml:"credentials_json"`
 	ProjectID       string `yaml:"project_id"`
 	// Endpoint overrides the FCM API endpoint (for testing only).
 	Endpoint string `yaml:"endpoint,omitempty"`
+	// QPS caps FCM sends per second for the project. Zero disables the limit.
+	QPS float64 `yaml:"qps"`
+	// Burst allows short bursts above QPS. Defaults to QPS when unset.
+	Burst int `yaml:"burst"`
+	// AnalyticsLabels tags each message with its sender so Firebase delivery
+	// reports can be broken down per sending application or service.
+	AnalyticsLabels bool `yaml:"analytics_labels"`
+	// Provenance attributes each data ID in a notification to a hash of its
+	// sender's username, so the receiving app can prioritize syncs.
+	Provenance bool `yaml:"provenance"`
+	// EncryptPayload seals each payload to the recipient's public crypt
+	// key, so FCM can't see which data IDs a user is notified about.
+	EncryptPayload bool `yaml:"encrypt_payload"`
+	// DeviceGroups sends pushes for users with several devices to an FCM
+	// device group, one message per flush instead of one per device.
+	DeviceGroups DeviceGroupsConfig `yaml:"device_groups"`
+	// TokenSweep checks tokens with pending batches or recent failures
+	// with FCM dry-run sends, to find uninstalled apps before a push does.
+	TokenSweep TokenSweepConfig `yaml:"token_sweep"`
+	// TokenPreflight checks each token the gateway hasn't seen before with
+	// an FCM dry-run send, so pushes to garbage tokens are refused instead
+	// of batched.
+	TokenPreflight TokenPreflightConfig `yaml:"token_preflight"`
+	// Quota counts messages sent per project and hour, with optional
+	// budgets, so operators see Firebase quota exhaustion coming.
+	Quota QuotaConfig `yaml:"quota"`
+	// Payload lays out the payload in the FCM data map, and can give apps
+	// a different layout by the app version their endpoints report.
+	Payload PayloadConfig `yaml:"payload"`
+}
+
+// PayloadConfig holds the FCM data map layout.
+type PayloadConfig struct {
+	// Key is the data key carrying the base64 payload.
+	Key string `yaml:"key"`
+	// SchemaVersion is written as data["schema_version"]. Zero leaves it
+	// out, as the Android app before schema versions expects.
+	SchemaVersion int `yaml:"schema_version"`
+	// Versions gives endpoints reporting an app_version option at least
+	// MinAppVersion their own layout. The newest one they reach applies.
+	Versions []PayloadVersionConfig `yaml:"versions"`
+}
+
+// PayloadVersionConfig is the data map layout for apps from MinAppVersion on.
+type PayloadVersionConfig struct {
+	MinAppVersion string `yaml:"min_app_version"`
+	// Key defaults to PayloadConfig.Key.
+	Key           string `yaml:"key"`
+	SchemaVersion int    `yaml:"schema_version"`
+}
+
+// QuotaConfig holds FCM usage accounting settings.
+type QuotaConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// HourlyBudget and DailyBudget cap each project's messages per UTC hour
+	// and day. Zero leaves the period unbudgeted.
+	HourlyBudget int64 `yaml:"hourly_budget"`
+	DailyBudget  int64 `yaml:"daily_budget"`
+	// Projects overrides the budgets per Firebase project ID.
+	Projects map[string]QuotaBudget `yaml:"projects"`
+	// AlertAt is the fraction of a budget at which a warning is logged,
+	// once per period.
+	AlertAt float64 `yaml:"alert_at"`
+	// HardLimit holds sends past a budget until the period ends, instead
+	// of only warning.
+	HardLimit bool `yaml:"hard_limit"`
+	// FlushInterval is how often counts are written to the store.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// QuotaBudget is one project's budgets.
+type QuotaBudget struct {
+	HourlyBudget int64 `yaml:"hourly_budget"`
+	DailyBudget  int64 `yaml:"daily_budget"`
+}
+
+// TokenSweepConfig holds token validation sweep settings.
+type TokenSweepConfig struct {
+	// Interval is how often to sweep. Zero disables sweeping.
+	Interval time.Duration `yaml:"interval"`
+	// Lookback is how far back failed deliveries are swept.
+	Lookback time.Duration `yaml:"lookback"`
+	// MaxTokens caps the tokens checked per sweep.
+	MaxTokens int `yaml:"max_tokens"`
+}
+
+// TokenPreflightConfig holds first-sight token validation settings.
+type TokenPreflightConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxTokens caps how many tokens' outcomes are remembered. Tokens
+	// forgotten are checked again on their next push.
+	MaxTokens int `yaml:"max_tokens"`
+}
+
+// DeviceGroupsConfig holds FCM device group settings.
+type DeviceGroupsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SenderID is the Firebase project number, which device group
+	// management requests must name.
+	SenderID string `yaml:"sender_id"`
+	// MinDevices is the fewest local endpoints a user needs before their
+	// pushes go to a group.
+	MinDevices int `yaml:"min_devices"`
 }
 
 // OurCloudConfig holds OurCloud DHT connection settings.
 type OurCloudConfig struct {
 	GRPCAddress string `yaml:"grpc_address"`
+	// Nodes lists several OurCloud nodes to route between. When set,
+	// GRPCAddress is ignored and requests go to the lowest-latency healthy
+	// node, preferring those in Region.
+	Nodes []OurCloudNode `yaml:"nodes"`
+	// Region is this gateway's region, matched against node regions.
+	Region string `yaml:"region"`
+	// ProbeInterval is how often node latency and health are measured.
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+	// VerifyContent rejects pushes whose data IDs don't resolve to a block
+	// in OurCloud. Each uncached ID costs a DHT lookup.
+	VerifyContent bool `yaml:"verify_content"`
+	// VerifyRecipients re-reads each batch's recipient before sending it,
+	// dropping pushes for accounts deleted or endpoints removed since they
+	// were queued. Each flush reads the endpoint list again, as a push does.
+	VerifyRecipients bool `yaml:"verify_recipients"`
+	// DedupEndpoints pushes to one endpoint per device ID and FCM token,
+	// preferring the most recently registered, so a device whose app was
+	// reinstalled isn't woken once per token it accumulated.
+	DedupEndpoints bool `yaml:"dedup_endpoints"`
+	// StartupWait is how long startup retries, with backoff, until a node
+	// answers a health check, for nodes started alongside the gateway.
+	// Zero connects without checking.
+	StartupWait time.Duration `yaml:"startup_wait"`
+	// LazyConnect starts the gateway even if no node is reachable by then.
+	// Health checks report OurCloud as down, and pushes fail, until a
+	// connection retried in the background succeeds.
+	LazyConnect bool `yaml:"lazy_connect"`
+	// ServiceRecord publishes this gateway's address, public key and
+	// features in OurCloud, for apps to discover it.
+	ServiceRecord ServiceRecordConfig `yaml:"service_record"`
+}
+
+// ServiceRecordConfig describes how the gateway publishes its service record
+// under an OurCloud account's /platform/push/gateway label.
+type ServiceRecordConfig struct {
+	// Account is the OurCloud account the record is published under, e.g.
+	// "push@oc". Empty doesn't publish.
+	Account string `yaml:"account"`
+	// URL is the base URL apps reach the gateway at. Empty uses
+	// federation.self_url.
+	URL string `yaml:"url"`
+	// KeyFile holds the gateway's ed25519 key, as PKCS #8 PEM, which signs
+	// the record. It is generated if missing.
+	KeyFile string `yaml:"key_file"`
+	// Refresh is how often the record is published again (default 1h).
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+// OurCloudNode is one OurCloud node with its region label.
+type OurCloudNode struct {
+	Address string `yaml:"address"`
+	Region  string `yaml:"region"`
+}
+
+// ProxyConfig routes the gateway's connections to Firebase and OurCloud
+// through a proxy.
+type ProxyConfig struct {
+	// URL is the proxy: "http://host:port", "https://host:port" or
+	// "socks5://host:port", optionally with "user:password@". Empty connects
+	// directly.
+	URL string `yaml:"url"`
+	// NoProxy lists the destinations reached directly, in NO_PROXY syntax:
+	// a host (and its subdomains), ".domain" (only subdomains), an IP
+	// address or CIDR range, any of them with ":port", or "*".
+	NoProxy []string `yaml:"no_proxy"`
 }
 
 // StorageConfig holds SQLite database settings.
 type StorageConfig struct {
 	Path        string        `yaml:"path"`
 	LockTimeout time.Duration `yaml:"lock_timeout"`
+	// WriteInterval queues batch writes in memory and commits them together
+	// at this interval, trading a crash window of up to one interval for far
+	// fewer fsyncs. Zero writes every batch immediately.
+	WriteInterval time.Duration `yaml:"write_interval"`
+	// WriteBatchSize commits queued writes early once this many devices
+	// are waiting. Saves block once twice as many are waiting.
+	WriteBatchSize int `yaml:"write_batch_size"`
+	// FailurePolicy is what happens to new pushes while the database can't
+	// be written, e.g. when the disk is full: "memory" keeps queuing in
+	// memory, losing those batches on restart; "reject" refuses pushes with
+	// a retryable error. Either way /health reports the store as failing.
+	FailurePolicy string `yaml:"failure_policy"`
+	// Shards splits the database into this many SQLite files, choosing one
+	// by a hash of the FCM token, so writes aren't limited to one writer.
+	// The files are named after Path with the shard and count added, e.g.
+	// "pushserver.0-of-4.db". One keeps the single file at Path.
+	Shards int `yaml:"shards"`
+	// Backup uploads snapshots of the database to object storage.
+	Backup BackupConfig `yaml:"backup"`
+}
+
+// BackupConfig holds database backup settings.
+type BackupConfig struct {
+	// URL is where backups are uploaded: "s3://bucket/prefix" or
+	// "gs://bucket/prefix". Empty disables backups.
+	URL string `yaml:"url"`
+	// Interval is how often a backup is taken.
+	Interval time.Duration `yaml:"interval"`
+	// Keep is how many of the newest backups are kept, and MaxAge how old
+	// they may get. Zero disables either limit; the newest is always kept.
+	Keep   int           `yaml:"keep"`
+	MaxAge time.Duration `yaml:"max_age"`
+	// S3 authenticates to an s3:// URL.
+	S3 S3BackupConfig `yaml:"s3"`
+	// CredentialsFile authenticates to a gs:// URL. Defaults to the
+	// Firebase credentials.
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+// S3BackupConfig holds S3 settings for backups.
+type S3BackupConfig struct {
+	Region string `yaml:"region"`
+	// Endpoint overrides the AWS endpoint, e.g. for MinIO.
+	Endpoint string `yaml:"endpoint"`
+	// AccessKeyID and SecretAccessKey default to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY from the environment.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
 }
 
 // BatchConfig holds notification batching settings.
 type BatchConfig struct {
 	Window  time.Duration `yaml:"window"`
 	MaxSize int           `yaml:"max_size"`
+	// MaxDataIDs caps the data IDs in one FCM message: a batch holding this
+	// many flushes early, and a larger one is split. Zero means no cap.
+	MaxDataIDs int `yaml:"max_data_ids"`
+	// DedupWindow suppresses re-sending the same data ID to a device within
+	// this window. Zero disables duplicate suppression.
+	DedupWindow time.Duration `yaml:"dedup_window"`
+	// FlushConcurrency caps concurrent flushes; due batches wait oldest first.
+	// Zero means unlimited.
+	FlushConcurrency int `yaml:"flush_concurrency"`
+	// RecoveryWeight starts serving before the batches pending from the
+	// previous run are recovered, which happens in the background instead.
+	// With FlushConcurrency set, recovered and fresh batches then share the
+	// flush workers: while both wait, FreshWeight fresh flushes run for
+	// every RecoveryWeight recovered ones, so a backlog left by an outage
+	// doesn't delay new pushes. Zero recovers everything before serving.
+	RecoveryWeight int `yaml:"recovery_weight"`
+	FreshWeight    int `yaml:"fresh_weight"`
+	// RecoveryRate caps how many recovered batches are flushed per second,
+	// so a restart after a long outage doesn't spend the FCM quota at once.
+	// Zero means no limit.
+	RecoveryRate float64 `yaml:"recovery_rate"`
+	// FlushTimeout bounds each FCM send so a hung call can't hold an
+	// endpoint's batch forever. Timed-out flushes are retried after Window.
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+	// MaxFlushAttempts and MaxAge bound how long a batch whose flush keeps
+	// timing out or being rate limited is retried before it is moved to the dead letters and its
+	// requests marked failed_permanent. Negative values remove the limit.
+	MaxFlushAttempts int           `yaml:"max_flush_attempts"`
+	MaxAge           time.Duration `yaml:"max_age"`
+	// MaxRetention purges persisted batches older than this, whatever
+	// holds them up, such as a device whose app was uninstalled. Their
+	// requests are marked expired_unclaimed. Zero keeps batches until they
+	// are delivered or given up on.
+	MaxRetention time.Duration `yaml:"max_retention"`
+	// SendReceipts records each batch FCM accepted before the batch is
+	// deleted, so a batch left behind by a crash or a failed delete is
+	// marked sent on recovery instead of being sent again.
+	SendReceipts bool `yaml:"send_receipts"`
+	// MinSendInterval is the least time between wakeups of one device. A
+	// batch due sooner after the previous send waits for the interval to
+	// pass. Zero means no minimum.
+	MinSendInterval time.Duration `yaml:"min_send_interval"`
+	// RecipientWindows uses the batch window each recipient publishes in
+	// OurCloud, if any, instead of Window.
+	RecipientWindows bool `yaml:"recipient_windows"`
+	// MinWindow and MaxWindow bound recipient-chosen and adaptive windows.
+	MinWindow time.Duration `yaml:"min_window"`
+	MaxWindow time.Duration `yaml:"max_window"`
+	// AdaptiveWindow replaces Window with one between MinWindow and
+	// MaxWindow that is short when idle and grows under load.
+	AdaptiveWindow bool `yaml:"adaptive_window"`
+	// AdaptiveFullLoad is the number of pending batches at which the
+	// adaptive window reaches MaxWindow.
+	AdaptiveFullLoad int `yaml:"adaptive_full_load"`
+	// LeaseTTL lets gateways sharing a store flush each batch once: an
+	// instance leases a batch for this long before flushing it and leaves
+	// batches another instance leased until that lease is released or
+	// expires. It must exceed FlushTimeout and can't be combined with
+	// Storage.WriteInterval. Zero disables leasing.
+	LeaseTTL time.Duration `yaml:"lease_ttl"`
+	// LeaseOwner names this instance in leases. Defaults to the hostname
+	// and process ID.
+	LeaseOwner string `yaml:"lease_owner"`
+	// Watchdog flushes batches left long past their flush time with no
+	// flush scheduled, a safety net against lost flush timers.
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+	// EndpointHealth scores each endpoint by how its flushes went.
+	EndpointHealth EndpointHealthConfig `yaml:"endpoint_health"`
+	// Schedule holds pushes sent with a delivery time until it comes.
+	Schedule ScheduleConfig `yaml:"schedule"`
+	// Foreground shortens the window for devices the app is open on.
+	Foreground ForegroundConfig `yaml:"foreground"`
+}
+
+// WatchdogConfig holds stuck batch watchdog settings.
+type WatchdogConfig struct {
+	// Interval is how often to scan the batches table. Zero disables the
+	// watchdog.
+	Interval time.Duration `yaml:"interval"`
+	// StuckAfter is how long past its flush time a batch with no flush
+	// scheduled counts as stuck.
+	StuckAfter time.Duration `yaml:"stuck_after"`
+	// MaxBatches caps the overdue batches checked per scan, oldest first.
+	MaxBatches int `yaml:"max_batches"`
+}
+
+// EndpointHealthConfig holds endpoint health scoring settings.
+type EndpointHealthConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// HalfLife is how long until a flush outcome counts half as much as a
+	// new one.
+	HalfLife time.Duration `yaml:"half_life"`
+	// PauseBelow pauses flushes to an endpoint whose score, the share of
+	// recent flushes delivered, falls below it. Zero never pauses.
+	PauseBelow float64 `yaml:"pause_below"`
+	// MinAttempts is how many recent flushes an endpoint needs before it
+	// can be paused.
+	MinAttempts float64 `yaml:"min_attempts"`
+	// PauseFor is how long a pause lasts before the next flush probes the
+	// endpoint.
+	PauseFor time.Duration `yaml:"pause_for"`
+	// NotifyDevices tells the recipient's other devices when one of theirs
+	// is first paused.
+	NotifyDevices bool `yaml:"notify_devices"`
+	// MaxEndpoints caps the endpoints tracked.
+	MaxEndpoints int `yaml:"max_endpoints"`
+}
+
+// ScheduleConfig holds scheduled delivery settings.
+type ScheduleConfig struct {
+	// MaxDelay is how far ahead a push may ask to be delivered. Zero
+	// rejects pushes asking for a delivery time.
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// Interval is how often scheduled pushes that have come due are
+	// queued, and so how late they may be queued.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ForegroundConfig holds settings for batching pushes to foreground devices,
+// those that pinged POST /presence recently, on a shorter window.
+type ForegroundConfig struct {
+	// Window is the batch window for foreground devices. Zero disables
+	// POST /presence.
+	Window time.Duration `yaml:"window"`
+	// TTL is how long after its last ping a device counts as foreground.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxDevices caps the foreground devices tracked.
+	MaxDevices int `yaml:"max_devices"`
 }
 
 // StatusConfig holds delivery status tracking settings.
 type StatusConfig struct {
 	Retention time.Duration `yaml:"retention"`
+	// RetentionByState overrides Retention for statuses in the states it
+	// names, such as "failed", so failures can be kept longer for
+	// debugging than successful sends.
+	RetentionByState map[string]time.Duration `yaml:"retention_by_state"`
+	// IDFormat selects the request ID format: "uuid", "uuidv7", or "short".
+	IDFormat string `yaml:"id_format"`
+	// IDPrefix is prepended to request IDs, e.g. a node identifier in clustered deployments.
+	IDPrefix string `yaml:"id_prefix"`
+	// LostAfter marks statuses pending this long with no batch left as "lost".
+	LostAfter time.Duration `yaml:"lost_after"`
+}
+
+// AdminConfig holds settings for the operator-only /admin endpoints.
+type AdminConfig struct {
+	// Token is the bearer token required by /admin endpoints.
+	// If empty, the admin endpoints are not mounted.
+	Token string `yaml:"token"`
+	// BroadcastTopics limits which FCM topics /admin/broadcast and topic
+	// subscription changes may use. Empty allows any topic.
+	BroadcastTopics []string `yaml:"broadcast_topics"`
+	// UI serves a web page at /admin/ui showing stats, pending batches, and
+	// recent failures from the admin API.
+	UI bool `yaml:"ui"`
+	// Capture records POST /push requests, while switched on with
+	// POST /admin/capture, for cmd/replay.
+	Capture CaptureConfig `yaml:"capture"`
+	// Counters keeps totals of the pushes accepted, delivered, failed, and
+	// dropped in the store, so they survive restarts.
+	Counters CountersConfig `yaml:"counters"`
+}
+
+// CountersConfig controls the push totals kept across restarts.
+type CountersConfig struct {
+	// Enabled restores the totals from the store at startup and serves
+	// them at GET /admin/counters and in /admin/metrics.
+	Enabled bool `yaml:"enabled"`
+	// FlushInterval is how often the totals are written to the store
+	// (default 10s). Pushes counted since the last write are lost if the
+	// gateway dies without shutting down.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// CaptureConfig sizes the capture of push requests for debugging.
+type CaptureConfig struct {
+	// Size is how many of the latest captured requests are kept in memory
+	// (default 1000).
+	Size int `yaml:"size"`
+	// MaxDuration is the longest a capture may be switched on for
+	// (default 1h).
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// File, if set, is appended every captured request as a JSON line.
+	File string `yaml:"file"`
+}
+
+// VisibleConfig holds settings for OS-rendered notifications sent alongside
+// the data payload, localized by each recipient's OurCloud locale preference.
+type VisibleConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ChannelID is the Android notification channel the notification is posted to.
+	ChannelID string `yaml:"channel_id"`
+	// DefaultLocale is used when the recipient's locale has no template.
+	DefaultLocale string `yaml:"default_locale"`
+	// Templates maps locale tags ("en", "de-AT") to title/body text/template
+	// strings. Templates can use {{.Count}} and {{.Recipient}}.
+	Templates map[string]VisibleTemplate `yaml:"templates"`
+}
+
+// PrivacyConfig holds settings that limit what the gateway reveals to
+// third parties.
+type PrivacyConfig struct {
+	// Enabled hashes usernames before they leave the gateway, e.g. in FCM
+	// analytics labels, and keeps targets and device IDs out of status
+	// records.
+	Enabled bool `yaml:"enabled"`
+	// HashKey keys the username hash so labels can't be reversed by hashing
+	// known usernames. Should be set when Enabled.
+	HashKey string `yaml:"hash_key"`
+	// PreviousHashKeys are keys HashKey replaced, newest first. Labels are
+	// only made with HashKey, but GET /admin/labels/{username} also lists
+	// the labels these gave, to follow a user across a key rotation.
+	PreviousHashKeys []string `yaml:"previous_hash_keys"`
+	// Hasher is "hmac" or "plain", which keeps usernames as they are
+	// wherever they'd be hashed, for development.
+	Hasher string `yaml:"hasher"`
+}
+
+// PassthroughField allows one unknown PushRequest field into FCM data.
+type PassthroughField struct {
+	// Name is the FCM data key.
+	Name string `yaml:"name"`
+	// Number is the protobuf field number in PushRequest.
+	Number int32 `yaml:"number"`
+	// Type is "string", "bytes" (base64, also for messages such as
+	// google.protobuf.Any), "int", "uint", or "bool".
+	Type string `yaml:"type"`
+}
+
+// SenderClassConfig defines one sender class.
+type SenderClassConfig struct {
+	Name string `yaml:"name"`
+	// Senders lists username patterns, such as "*@chat.example", with *
+	// and ? wildcards.
+	Senders []string `yaml:"senders"`
+	// Window is how long the class's notifications may wait before their
+	// batch flushes. A pending batch due later is flushed sooner. Zero uses
+	// batch.window.
+	Window time.Duration `yaml:"window"`
+	// MaxSize flushes a batch once a notification from the class brings it
+	// to this size. Zero uses batch.max_size.
+	MaxSize int `yaml:"max_size"`
+	// MaxPushes limits each sender in the class to this many pushes per
+	// Per (default 1m). Zero means no limit.
+	MaxPushes int           `yaml:"max_pushes"`
+	Per       time.Duration `yaml:"per"`
+}
+
+// FederationConfig holds settings for forwarding pushes to peer gateways.
+// Users assign devices to gateways in their OurCloud gateways label.
+type FederationConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SelfURL is this gateway's public base URL, exactly as it appears in
+	// users' gateway assignments (e.g. "https://push.example.com").
+	SelfURL string `yaml:"self_url"`
+	// Secret is shared by the peer gateways and signs the pushes they
+	// forward to each other. Required when federation is enabled.
+	Secret string `yaml:"secret"`
+	// PeerHosts, when set, are the only hosts pushes are forwarded to.
+	// Assignments naming other hosts, or not using https, fail.
+	PeerHosts []string `yaml:"peer_hosts"`
+	// ForwardTimeout bounds each forward to a peer gateway.
+	ForwardTimeout time.Duration `yaml:"forward_timeout"`
+}
+
+// MirrorConfig holds settings for mirroring accepted pushes to a standby
+// gateway, which delivers them if this one goes down.
+type MirrorConfig struct {
+	// StandbyURL, when set, is the base URL of the standby gateway this
+	// one mirrors its accepted pushes to.
+	StandbyURL string `yaml:"standby_url"`
+	// Standby accepts pushes mirrored by a primary gateway at POST /mirror.
+	Standby bool `yaml:"standby"`
+	// Token authenticates the primary to the standby, as an
+	// "Authorization: Bearer" token on the mirror routes.
+	Token string `yaml:"token"`
+	// Interval is how often the primary sends what it accepted since the
+	// last send, or a heartbeat if nothing.
+	Interval time.Duration `yaml:"interval"`
+	// Buffer caps the pushes the primary holds for the next send, such as
+	// while the standby is unreachable. More are dropped.
+	Buffer int `yaml:"buffer"`
+	// Timeout bounds each request to the standby.
+	Timeout time.Duration `yaml:"timeout"`
+	// TakeoverAfter is how long the standby waits without hearing from the
+	// primary before delivering its mirrored pushes. Negative leaves
+	// takeovers to POST /admin/mirror/takeover.
+	TakeoverAfter time.Duration `yaml:"takeover_after"`
+	// Retention is how long the standby holds a mirrored push without
+	// hearing its outcome, and remembers a takeover the primary hasn't
+	// reconciled.
+	Retention time.Duration `yaml:"retention"`
+}
+
+// AuthConfig selects how POST /push establishes who sent a push.
+type AuthConfig struct {
+	// Chain lists the authenticators tried in order: signature (the
+	// sender's OurCloud signature), api_key, and client_cert. The first to
+	// establish the push's sender accepts it. Empty requires the signature.
+	Chain []string `yaml:"chain"`
+	// APIKeys are the keys the api_key authenticator accepts in the
+	// X-Push-API-Key header.
+	APIKeys []APIKeyConfig `yaml:"api_keys"`
+	// ClientCert maps client certificates to senders for the client_cert
+	// authenticator.
+	ClientCert ClientCertConfig `yaml:"client_cert"`
+}
+
+// APIKeyConfig issues an API key to a sender.
+type APIKeyConfig struct {
+	Key    string `yaml:"key"`
+	Sender string `yaml:"sender"`
 }
 
-// Load reads configuration from a YAML file.
+// ClientCertConfig maps client certificate subjects to senders.
+type ClientCertConfig struct {
+	// Senders maps subjects, each a distinguished name in RFC 2253 form or
+	// a common name, to sender usernames.
+	Senders map[string]string `yaml:"senders"`
+	// Header names the header in which a TLS-terminating proxy passes the
+	// subject of the client certificate it verified, such as nginx's
+	// $ssl_client_s_dn. Only believed from server.trusted_proxies.
+	Header string `yaml:"header"`
+}
+
+// ConsentConfig selects how the gateway decides whether a sender may push
+// to a recipient.
+type ConsentConfig struct {
+	// Policy is "list" (recipients' OurCloud consent lists), "allow_all"
+	// (development only), "deny" (only Overrides), or "webhook".
+	Policy string `yaml:"policy"`
+	// Overrides are the sender/recipient pairs the deny policy allows.
+	Overrides []ConsentOverride `yaml:"overrides"`
+	Webhook   ConsentWebhook    `yaml:"webhook"`
+	// ReplyWindow, when set, lets the recipient of an accepted push push
+	// back to its sender for this long, whatever the sender's consent.
+	ReplyWindow time.Duration `yaml:"reply_window"`
+}
+
+// ConsentOverride allows Sender to push to Recipient. Either may be "*".
+type ConsentOverride struct {
+	Recipient string `yaml:"recipient"`
+	Sender    string `yaml:"sender"`
+}
+
+// ConsentWebhook configures the webhook consent policy.
+type ConsentWebhook struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// FailOpen allows pushes when the webhook fails, instead of denying them.
+	FailOpen bool `yaml:"fail_open"`
+	// Secret, when set, signs each request with an HMAC-SHA256 so the
+	// service can check it came from the gateway.
+	Secret string `yaml:"secret"`
+	// CacheTTL reuses each decision for this long. Zero asks the webhook
+	// for every push.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// DNDConfig holds settings for honoring recipients' Do-Not-Disturb, which
+// they publish in OurCloud along with the senders allowed to bypass it.
+type DNDConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Policy is "hold" (keep pushes batched until Do-Not-Disturb ends, at
+	// most batch.max_age) or "drop".
+	Policy string `yaml:"policy"`
+}
+
+// AbuseConfig holds the thresholds for suspending abusive senders.
+type AbuseConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is the sliding window over which rejected pushes are counted.
+	Window time.Duration `yaml:"window"`
+	// MinPushes is how many pushes a sender must make within Window before
+	// its rejection ratio is judged.
+	MinPushes int `yaml:"min_pushes"`
+	// MaxRejectRatio is the fraction of rejected pushes (no consent or no
+	// endpoints) within Window above which a sender is suspended.
+	MaxRejectRatio float64 `yaml:"max_reject_ratio"`
+	// MaxBurst pushes are allowed within BurstWindow; more suspends the sender.
+	BurstWindow time.Duration `yaml:"burst_window"`
+	MaxBurst    int           `yaml:"max_burst"`
+	// Cooldown is how long a suspension lasts.
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// GRPCConfig holds the gRPC listener settings. The listener serves the
+// standard grpc.health.v1 health service and server reflection.
+type GRPCConfig struct {
+	// Port enables the gRPC listener. Zero disables it.
+	Port      int                 `yaml:"port"`
+	Keepalive GRPCKeepaliveConfig `yaml:"keepalive"`
+}
+
+// GRPCKeepaliveConfig holds gRPC keepalive settings.
+type GRPCKeepaliveConfig struct {
+	// MinTime is the shortest interval at which clients may ping. Clients
+	// pinging more often are disconnected.
+	MinTime time.Duration `yaml:"min_time"`
+	// PermitWithoutStream lets clients ping on connections with no RPCs.
+	PermitWithoutStream bool `yaml:"permit_without_stream"`
+	// Time is how long a connection may be idle before the server pings the
+	// client, and Timeout how long it waits for the reply before closing it.
+	Time    time.Duration `yaml:"time"`
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxConnectionAge closes connections after this long, allowing
+	// MaxConnectionAgeGrace for RPCs in flight, so clients rebalance across
+	// instances. Zero keeps connections open.
+	MaxConnectionAge      time.Duration `yaml:"max_connection_age"`
+	MaxConnectionAgeGrace time.Duration `yaml:"max_connection_age_grace"`
+}
+
+// LogConfig holds logging settings.
+type LogConfig struct {
+	// SampleInterval collapses identical log lines: the first in each
+	// interval is written, and the rest are counted in a "repeated" summary
+	// when it ends. Zero writes every line.
+	SampleInterval time.Duration `yaml:"sample_interval"`
+	// Privacy sets how much metadata, such as usernames, data ID counts and
+	// timings, log lines carry: "full", "hashed" (usernames replaced with
+	// privacy.hash_key's hash) or "minimal" (none of it).
+	Privacy string `yaml:"privacy"`
+}
+
+// RoutesConfig holds the request limits, listener and access rules of each
+// group of routes.
+type RoutesConfig struct {
+	// Push covers POST /push and DELETE /push/{request_id}.
+	Push RouteGroup `yaml:"push"`
+	// Status covers GET /status/{id}, POST /status/batch, GET /queue and
+	// GET /consents.
+	Status RouteGroup `yaml:"status"`
+	// Admin covers the token-protected /admin endpoints and the admin UI.
+	Admin RouteGroup `yaml:"admin"`
+}
+
+// RouteGroup bounds the requests to a group of routes, and says where and
+// to whom they are served. For the limits, zero takes the group's default
+// and negative removes the limit.
+type RouteGroup struct {
+	// Timeout is the deadline for handling a request, including the
+	// OurCloud and store lookups it makes.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxBody is the largest request body accepted, in bytes.
+	MaxBody int64 `yaml:"max_body"`
+	// Listen serves the group on its own address, e.g. "10.0.0.5:8081" or
+	// ":8081", instead of server.port. Groups with the same address share
+	// a listener. Empty serves it on server.port.
+	Listen string `yaml:"listen"`
+	// AllowFrom restricts the group to clients in these IP addresses or
+	// CIDR ranges, as resolved through server.trusted_proxies. Others get
+	// 403. Empty allows everyone.
+	AllowFrom []string `yaml:"allow_from"`
+	// Token, if set, is required as an "Authorization: Bearer" token.
+	// Admin routes still need admin.token too.
+	Token string `yaml:"token"`
+}
+
+// VisibleTemplate is the notification text for one locale.
+type VisibleTemplate struct {
+	Title string `yaml:"title"`
+	Body  string `yaml:"body"`
+}
+
+// Load reads configuration from a YAML file. Unknown keys are rejected, so
+// a typo like "batchh:" fails loudly instead of leaving defaults in place.
+// Files written for an older config version are converted.
 func Load(path string) (*Config, error) {
+	cfg, data, err := decode(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+
+	sum := sha256.Sum256(data)
+	cfg.Hash = hex.EncodeToString(sum[:])
+
+	return cfg, nil
+}
+
+// decode reads the config file at path without applying defaults. It also
+// returns the file's contents, as converted to CurrentVersion.
+func decode(path string) (*Config, []byte, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("reading config file: %w", err)
+		return nil, nil, fmt.Errorf("reading config file: %w", err)
 	}
 
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	version, changed, err := upgrade(&doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	if version < CurrentVersion {
+		log.Printf("WARNING: %s is config version %d; converting to version %d. Update it and set \"version: %d\"", path, version, CurrentVersion, CurrentVersion)
+	}
+
+	// Decode the original text when possible, so errors point at its lines
+	if changed {
+		if data, err = yaml.Marshal(&doc); err != nil {
+			return nil, nil, fmt.Errorf("converting config file: %w", err)
+		}
+	}
 	cfg := &Config{}
-	if err := yaml.Unmarshal(data, cfg); err != nil {
-		return nil, fmt.Errorf("parsing config file: %w", err)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("parsing config file: %w", err)
 	}
+	cfg.Version = CurrentVersion
 
-	cfg.setDefaults()
+	return cfg, data, nil
+}
 
-	return cfg, nil
+// Default returns a configuration with every setting at its default.
+func Default() *Config {
+	cfg := &Config{Version: CurrentVersion}
+	cfg.setDefaults()
+	return cfg
 }
 
 // setDefaults applies default values for unset fields.
@@ -83,22 +868,219 @@ func (c *Config) setDefaults() {
 	if c.Server.WriteTimeout == 0 {
 		c.Server.WriteTimeout = 30 * time.Second
 	}
+	if c.Server.IdleTimeout == 0 {
+		c.Server.IdleTimeout = 2 * time.Minute
+	}
+	if c.Server.PushQueueTimeout == 0 {
+		c.Server.PushQueueTimeout = 2 * time.Second
+	}
+	if c.Server.HandoffGrace == 0 {
+		c.Server.HandoffGrace = time.Minute
+	}
+	if c.Firebase.Payload.Key == "" {
+		c.Firebase.Payload.Key = "payload"
+	}
+	for i := range c.Firebase.Payload.Versions {
+		if c.Firebase.Payload.Versions[i].Key == "" {
+			c.Firebase.Payload.Versions[i].Key = c.Firebase.Payload.Key
+		}
+	}
 	if c.OurCloud.GRPCAddress == "" {
 		c.OurCloud.GRPCAddress = "localhost:50051"
 	}
+	if c.OurCloud.ProbeInterval == 0 {
+		c.OurCloud.ProbeInterval = 30 * time.Second
+	}
+	if c.OurCloud.ServiceRecord.KeyFile == "" {
+		c.OurCloud.ServiceRecord.KeyFile = "/var/lib/pushserver/gateway.key"
+	}
+	if c.OurCloud.ServiceRecord.Refresh == 0 {
+		c.OurCloud.ServiceRecord.Refresh = time.Hour
+	}
 	if c.Storage.Path == "" {
 		c.Storage.Path = "/var/lib/pushserver/pushserver.db"
 	}
 	if c.Storage.LockTimeout == 0 {
 		c.Storage.LockTimeout = 100 * time.Millisecond
 	}
+	if c.Storage.WriteBatchSize == 0 {
+		c.Storage.WriteBatchSize = 500
+	}
+	if c.Storage.FailurePolicy == "" {
+		c.Storage.FailurePolicy = "memory"
+	}
+	if c.Storage.Shards == 0 {
+		c.Storage.Shards = 1
+	}
+	if c.Firebase.DeviceGroups.MinDevices == 0 {
+		c.Firebase.DeviceGroups.MinDevices = 2
+	}
+	if c.Firebase.TokenSweep.Lookback == 0 {
+		c.Firebase.TokenSweep.Lookback = 24 * time.Hour
+	}
+	if c.Firebase.TokenSweep.MaxTokens == 0 {
+		c.Firebase.TokenSweep.MaxTokens = 500
+	}
+	if c.Firebase.TokenPreflight.MaxTokens == 0 {
+		c.Firebase.TokenPreflight.MaxTokens = 100000
+	}
+	if c.Firebase.Quota.AlertAt == 0 {
+		c.Firebase.Quota.AlertAt = 0.8
+	}
+	if c.Firebase.Quota.FlushInterval == 0 {
+		c.Firebase.Quota.FlushInterval = time.Minute
+	}
 	if c.Batch.Window == 0 {
 		c.Batch.Window = 60 * time.Second
 	}
+	if c.Batch.FreshWeight == 0 {
+		c.Batch.FreshWeight = 4
+	}
 	if c.Batch.MaxSize == 0 {
 		c.Batch.MaxSize = 100
 	}
+	if c.Batch.FlushTimeout == 0 {
+		c.Batch.FlushTimeout = 30 * time.Second
+	}
+	if c.Batch.MaxFlushAttempts == 0 {
+		c.Batch.MaxFlushAttempts = 10
+	}
+	if c.Batch.MaxAge == 0 {
+		c.Batch.MaxAge = 24 * time.Hour
+	}
+	if c.Batch.MinWindow == 0 {
+		c.Batch.MinWindow = 5 * time.Second
+	}
+	if c.Batch.MaxWindow == 0 {
+		c.Batch.MaxWindow = 15 * time.Minute
+	}
+	if c.Batch.AdaptiveFullLoad == 0 {
+		c.Batch.AdaptiveFullLoad = 1000
+	}
+	if c.Batch.Watchdog.StuckAfter == 0 {
+		c.Batch.Watchdog.StuckAfter = 5 * time.Minute
+	}
+	if c.Batch.Watchdog.MaxBatches == 0 {
+		c.Batch.Watchdog.MaxBatches = 500
+	}
+	if c.Batch.EndpointHealth.HalfLife == 0 {
+		c.Batch.EndpointHealth.HalfLife = 24 * time.Hour
+	}
+	if c.Batch.EndpointHealth.MinAttempts == 0 {
+		c.Batch.EndpointHealth.MinAttempts = 5
+	}
+	if c.Batch.EndpointHealth.PauseFor == 0 {
+		c.Batch.EndpointHealth.PauseFor = time.Hour
+	}
+	if c.Batch.EndpointHealth.MaxEndpoints == 0 {
+		c.Batch.EndpointHealth.MaxEndpoints = 100000
+	}
+	if c.Storage.Backup.Interval == 0 {
+		c.Storage.Backup.Interval = time.Hour
+	}
+	if c.Storage.Backup.Keep == 0 {
+		c.Storage.Backup.Keep = 48
+	}
+	if c.Batch.Schedule.Interval == 0 {
+		c.Batch.Schedule.Interval = 5 * time.Second
+	}
+	if c.Batch.Foreground.TTL == 0 {
+		c.Batch.Foreground.TTL = 2 * time.Minute
+	}
+	if c.Batch.Foreground.MaxDevices == 0 {
+		c.Batch.Foreground.MaxDevices = 100000
+	}
 	if c.Status.Retention == 0 {
 		c.Status.Retention = time.Hour
 	}
+	if c.Status.LostAfter == 0 {
+		c.Status.LostAfter = time.Hour
+	}
+	if c.Status.IDFormat == "" {
+		c.Status.IDFormat = "uuid"
+	}
+	if c.Visible.DefaultLocale == "" {
+		c.Visible.DefaultLocale = "en"
+	}
+	if c.Federation.ForwardTimeout == 0 {
+		c.Federation.ForwardTimeout = 10 * time.Second
+	}
+	if c.Mirror.Interval == 0 {
+		c.Mirror.Interval = time.Second
+	}
+	if c.Mirror.Buffer == 0 {
+		c.Mirror.Buffer = 10000
+	}
+	if c.Mirror.Timeout == 0 {
+		c.Mirror.Timeout = 10 * time.Second
+	}
+	if c.Mirror.TakeoverAfter == 0 {
+		c.Mirror.TakeoverAfter = time.Minute
+	}
+	if c.Mirror.Retention == 0 {
+		c.Mirror.Retention = time.Hour
+	}
+	if c.Consent.Policy == "" {
+		c.Consent.Policy = "list"
+	}
+	if c.Consent.Webhook.Timeout == 0 {
+		c.Consent.Webhook.Timeout = 2 * time.Second
+	}
+	if c.DND.Policy == "" {
+		c.DND.Policy = "hold"
+	}
+	if c.Privacy.Hasher == "" {
+		c.Privacy.Hasher = "hmac"
+	}
+	if c.Log.Privacy == "" {
+		c.Log.Privacy = "full"
+	}
+	if c.Abuse.Window == 0 {
+		c.Abuse.Window = 10 * time.Minute
+	}
+	if c.Abuse.MinPushes == 0 {
+		c.Abuse.MinPushes = 20
+	}
+	if c.Abuse.MaxRejectRatio == 0 {
+		c.Abuse.MaxRejectRatio = 0.5
+	}
+	if c.Abuse.BurstWindow == 0 {
+		c.Abuse.BurstWindow = 10 * time.Second
+	}
+	if c.Abuse.MaxBurst == 0 {
+		c.Abuse.MaxBurst = 200
+	}
+	if c.Abuse.Cooldown == 0 {
+		c.Abuse.Cooldown = 15 * time.Minute
+	}
+	if c.Admin.Capture.Size == 0 {
+		c.Admin.Capture.Size = 1000
+	}
+	if c.Admin.Capture.MaxDuration == 0 {
+		c.Admin.Capture.MaxDuration = time.Hour
+	}
+	if c.Admin.Counters.FlushInterval == 0 {
+		c.Admin.Counters.FlushInterval = 10 * time.Second
+	}
+	if c.Routes.Push.Timeout == 0 {
+		c.Routes.Push.Timeout = 15 * time.Second
+	}
+	if c.Routes.Push.MaxBody == 0 {
+		c.Routes.Push.MaxBody = 64 << 10
+	}
+	if c.Routes.Status.Timeout == 0 {
+		c.Routes.Status.Timeout = 30 * time.Second
+	}
+	if c.Routes.Status.MaxBody == 0 {
+		c.Routes.Status.MaxBody = 1 << 20
+	}
+	if c.GRPC.Keepalive.MinTime == 0 {
+		c.GRPC.Keepalive.MinTime = 10 * time.Second
+	}
+	if c.GRPC.Keepalive.Time == 0 {
+		c.GRPC.Keepalive.Time = 2 * time.Hour
+	}
+	if c.GRPC.Keepalive.Timeout == 0 {
+		c.GRPC.Keepalive.Timeout = 20 * time.Second
+	}
 }
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the environment variables that set configuration. A
+// setting's variable is its YAML path in upper case, joined by underscores:
+// batch.window is PUSHSERVER_BATCH_WINDOW, and firebase.device_groups.enabled
+// is PUSHSERVER_FIREBASE_DEVICE_GROUPS_ENABLED.
+const EnvPrefix = "PUSHSERVER_"
+
+// envFileSuffix, appended to a setting's variable, names a file holding the
+// value instead, e.g. PUSHSERVER_ADMIN_TOKEN_FILE=/run/secrets/admin_token.
+const envFileSuffix = "_FILE"
+
+// envCommandVars are variables cmd/pushserver reads itself; they aren't settings.
+var envCommandVars = map[string]bool{
+	"PUSHSERVER_CONFIG":    true,
+	"PUSHSERVER_LOG_LEVEL": true,
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envVar is the setting an environment variable sets.
+type envVar struct {
+	key   string // YAML path, e.g. "batch.window"
+	index []int  // field index path in Config
+}
+
+// LoadEnv reads configuration from the YAML file at path, then overrides it
+// with environment variables. If path doesn't exist, configuration comes from
+// the environment alone. Unknown PUSHSERVER_ variables are rejected, like
+// unknown keys in the file.
+//
+// Settings take their value as text: durations like "30s", booleans like
+// "true", and lists of strings separated by commas. Lists of mappings, and
+// mappings such as visible.templates, take YAML flow syntax, e.g.
+// PUSHSERVER_OURCLOUD_NODES='[{address: oc1:50051, region: eu-west}]'.
+func LoadEnv(path string) (*Config, error) {
+	return loadEnv(path, os.Environ())
+}
+
+func loadEnv(path string, environ []string) (*Config, error) {
+	cfg, data, err := decode(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("INFO: no config file at %s; configuring from the environment", path)
+		cfg, data, err = &Config{Version: CurrentVersion}, nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := cfg.applyEnv(environ)
+	if err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+
+	// The hash covers the variables too, so it changes with them
+	h := sha256.New()
+	h.Write(data)
+	for _, kv := range applied {
+		h.Write([]byte("\n" + kv))
+	}
+	cfg.Hash = hex.EncodeToString(h.Sum(nil))
+
+	return cfg, nil
+}
+
+// applyEnv sets the settings named by PUSHSERVER_ variables in environ.
+// Returns the variables applied, as NAME=value, sorted by name.
+func (c *Config) applyEnv(environ []string) ([]string, error) {
+	vars := make(map[string]envVar)
+	envVars(reflect.TypeOf(*c), EnvPrefix, "", nil, vars)
+
+	values := make(map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, EnvPrefix) && !envCommandVars[name] {
+			values[name] = value
+		}
+	}
+
+	var applied []string
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		value := values[name]
+		v, ok := vars[name]
+		if !ok {
+			setting, isFile := strings.CutSuffix(name, envFileSuffix)
+			if v, ok = vars[setting]; !ok || !isFile {
+				return nil, fmt.Errorf("unknown configuration variable %s", name)
+			}
+			if _, both := values[setting]; both {
+				return nil, fmt.Errorf("both %s and %s are set", setting, name)
+			}
+			data, err := os.ReadFile(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+
+		if err := setEnvValue(reflect.ValueOf(c).Elem().FieldByIndex(v.index), value); err != nil {
+			return nil, fmt.Errorf("%s (%s): %w", name, v.key, err)
+		}
+		applied = append(applied, name+"="+value)
+	}
+	return applied, nil
+}
+
+// envVars adds the variables for the settings in struct type t to vars.
+func envVars(t reflect.Type, prefix, keyPrefix string, index []int, vars map[string]envVar) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" || tag == "version" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		key := keyPrefix + tag
+		idx := append(slices.Clone(index), i)
+
+		if f.Type.Kind() == reflect.Struct {
+			envVars(f.Type, name+"_", key+".", idx, vars)
+			continue
+		}
+		vars[name] = envVar{key: key, index: idx}
+	}
+}
+
+// setEnvValue parses value into v according to its type.
+func setEnvValue(v reflect.Value, value string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case v.CanFloat():
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		v.SetZero()
+		dec := yaml.NewDecoder(strings.NewReader(value))
+		dec.KnownFields(true)
+		if err := dec.Decode(v.Addr().Interface()); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	return nil
+}
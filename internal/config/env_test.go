@@ -0,0 +1,126 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "admin_token")
+	if err := os.WriteFile(secret, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("writing secret: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		environ []string
+		check   func(*Config) bool
+	}{
+		{
+			name:    "underscore path",
+			environ: []string{"PUSHSERVER_BATCH_WINDOW=45s"},
+			check:   func(c *Config) bool { return c.Batch.Window == 45*time.Second },
+		},
+		{
+			name:    "underscores inside a key",
+			environ: []string{"PUSHSERVER_FIREBASE_DEVICE_GROUPS_ENABLED=true"},
+			check:   func(c *Config) bool { return c.Firebase.DeviceGroups.Enabled },
+		},
+		{
+			name:    "overrides the file",
+			environ: []string{"PUSHSERVER_SERVER_PORT=9191"},
+			check:   func(c *Config) bool { return c.Server.Port == 9191 },
+		},
+		{
+			name:    "secret from a file",
+			environ: []string{"PUSHSERVER_ADMIN_TOKEN_FILE=" + secret},
+			check:   func(c *Config) bool { return c.Admin.Token == "from-file" },
+		},
+		{
+			name:    "YAML flow list",
+			environ: []string{"PUSHSERVER_OURCLOUD_NODES=[{address: oc1:50051, region: eu-west}, {address: oc2:50051}]"},
+			check: func(c *Config) bool {
+				return reflect.DeepEqual(c.OurCloud.Nodes, []OurCloudNode{{Address: "oc1:50051", Region: "eu-west"}, {Address: "oc2:50051"}})
+			},
+		},
+		{
+			name:    "YAML flow mapping",
+			environ: []string{"PUSHSERVER_VISIBLE_TEMPLATES={en: {title: Hi, body: New message}}"},
+			check: func(c *Config) bool {
+				return reflect.DeepEqual(c.Visible.Templates, map[string]VisibleTemplate{"en": {Title: "Hi", Body: "New message"}})
+			},
+		},
+		{
+			name:    "other variables ignored",
+			environ: []string{"HOME=/root", "PUSHSERVER_CONFIG=/etc/pushserver.yaml", "PUSHSERVER_LOG_LEVEL=debug"},
+			check:   func(c *Config) bool { return c.Server.Port == 9090 },
+		},
+	}
+	path := writeConfig(t, "version: 1\nserver:\n  port: 9090\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadEnv(path, tt.environ)
+			if err != nil {
+				t.Fatalf("loadEnv() error = %v", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("loadEnv() with %v = %+v, settings not applied", tt.environ, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadEnv_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		want    string
+	}{
+		{"unknown variable", []string{"PUSHSERVER_BATCH_WINDOWW=30s"}, "unknown configuration variable PUSHSERVER_BATCH_WINDOWW"},
+		{"section, not a setting", []string{"PUSHSERVER_BATCH=30s"}, "unknown configuration variable"},
+		{"_FILE of an unknown setting", []string{"PUSHSERVER_NOPE_FILE=/tmp/x"}, "unknown configuration variable"},
+		{"version isn't a setting", []string{"PUSHSERVER_VERSION=1"}, "unknown configuration variable"},
+		{"value and file both set", []string{"PUSHSERVER_ADMIN_TOKEN=a", "PUSHSERVER_ADMIN_TOKEN_FILE=/tmp/x"}, "both PUSHSERVER_ADMIN_TOKEN and PUSHSERVER_ADMIN_TOKEN_FILE"},
+		{"missing secret file", []string{"PUSHSERVER_ADMIN_TOKEN_FILE=" + filepath.Join(t.TempDir(), "missing")}, "PUSHSERVER_ADMIN_TOKEN_FILE"},
+		{"bad duration", []string{"PUSHSERVER_BATCH_WINDOW=soon"}, "batch.window"},
+		{"unknown key in a flow value", []string{"PUSHSERVER_OURCLOUD_NODES=[{adress: oc1:50051}]"}, "ourcloud.nodes"},
+	}
+	path := writeConfig(t, "version: 1\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadEnv(path, tt.environ)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadEnv() error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnv_WithoutFile(t *testing.T) {
+	cfg, err := loadEnv(filepath.Join(t.TempDir(), "missing.yaml"), []string{"PUSHSERVER_SERVER_PORT=9191"})
+	if err != nil {
+		t.Fatalf("loadEnv() error = %v", err)
+	}
+	if cfg.Version != CurrentVersion || cfg.Server.Port != 9191 || cfg.Batch.Window != Default().Batch.Window {
+		t.Errorf("loadEnv() = version %d, port %d, window %s, want the variable over the defaults", cfg.Version, cfg.Server.Port, cfg.Batch.Window)
+	}
+}
+
+func TestLoadEnv_HashCoversVariables(t *testing.T) {
+	path := writeConfig(t, "version: 1\n")
+	a, err := loadEnv(path, nil)
+	if err != nil {
+		t.Fatalf("loadEnv() error = %v", err)
+	}
+	b, err := loadEnv(path, []string{"PUSHSERVER_SERVER_PORT=9191"})
+	if err != nil {
+		t.Fatalf("loadEnv() error = %v", err)
+	}
+	if a.Hash == b.Hash {
+		t.Error("Hash unchanged by an environment variable")
+	}
+}
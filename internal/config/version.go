@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the config schema version this build reads. Files with
+// an older version are converted when loaded; newer ones are rejected.
+const CurrentVersion = 1
+
+// conversions[v] converts a version v document to version v+1 in place,
+// reporting whether it changed anything beyond the version number.
+//
+// Version 0 is a file written before versioning.
+var conversions = []func(root *yaml.Node) (bool, error){
+	0: convertV0,
+}
+
+// convertV0 drops batch.storage_path, which early config files set but the
+// gateway never read. Batches have always been stored at storage.path.
+func convertV0(root *yaml.Node) (bool, error) {
+	batch := mappingValue(root, "batch")
+	if batch == nil || batch.Kind != yaml.MappingNode || mappingValue(batch, "storage_path") == nil {
+		return false, nil
+	}
+	log.Printf("WARNING: ignoring batch.storage_path (line %d), which never had an effect; batches are stored in storage.path", mappingValue(batch, "storage_path").Line)
+	deleteMappingKey(batch, "storage_path")
+	return true, nil
+}
+
+// upgrade converts the document doc to CurrentVersion. It returns the
+// version the file was written for and whether the conversion changed its
+// keys, in which case doc must be decoded instead of the original file.
+func upgrade(doc *yaml.Node) (version int, changed bool, err error) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return CurrentVersion, false, nil // empty file
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return 0, false, fmt.Errorf("line %d: config must be a mapping", root.Line)
+	}
+
+	versionNode := mappingValue(root, "version")
+	if versionNode != nil {
+		version, err = strconv.Atoi(versionNode.Value)
+		if err != nil || version < 0 {
+			return 0, false, fmt.Errorf("line %d: invalid version %q", versionNode.Line, versionNode.Value)
+		}
+	}
+	if version > CurrentVersion {
+		return 0, false, fmt.Errorf("config version %d is newer than this gateway supports (%d)", version, CurrentVersion)
+	}
+
+	for v := version; v < CurrentVersion; v++ {
+		c, err := conversions[v](root)
+		if err != nil {
+			return 0, false, fmt.Errorf("converting config from version %d: %w", v, err)
+		}
+		changed = changed || c
+	}
+	if changed {
+		setMappingValue(root, "version", strconv.Itoa(CurrentVersion))
+	}
+	return version, changed, nil
+}
+
+// mappingValue returns the value node for key in mapping m, or nil.
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// deleteMappingKey removes key from mapping m.
+func deleteMappingKey(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = append(m.Content[:i], m.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// setMappingValue sets key in mapping m to the scalar value.
+func setMappingValue(m *yaml.Node, key, value string) {
+	if n := mappingValue(m, key); n != nil {
+		n.Kind, n.Tag, n.Value, n.Content = yaml.ScalarNode, "", value, nil
+		return
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a config file in a temporary directory and
+// returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	return path
+}
+
+func TestLoad_UpgradesVersion0(t *testing.T) {
+	// batch.storage_path was only ever set by files written before versioning
+	path := writeConfig(t, `
+server:
+  port: 9090
+batch:
+  window: 45s
+  storage_path: /var/lib/old/batches.db
+`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Version != CurrentVersion {
+		t.Errorf("Version = %d, want %d", cfg.Version, CurrentVersion)
+	}
+	if cfg.Server.Port != 9090 || cfg.Batch.Window != 45*time.Second {
+		t.Errorf("Server.Port = %d, Batch.Window = %s, want 9090 and 45s kept through the upgrade", cfg.Server.Port, cfg.Batch.Window)
+	}
+}
+
+func TestLoad_Version0WithoutChanges(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "server:\n  port: 9090\n"))
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.Version != CurrentVersion || cfg.Server.Port != 9090 {
+		t.Errorf("Load() = version %d, port %d, want %d and 9090", cfg.Version, cfg.Server.Port, CurrentVersion)
+	}
+}
+
+func TestLoad_RejectsNewerVersion(t *testing.T) {
+	_, err := Load(writeConfig(t, "version: 99\nserver:\n  port: 9090\n"))
+	if err == nil || !strings.Contains(err.Error(), "newer than this gateway supports") {
+		t.Errorf("Load() error = %v, want a newer version error", err)
+	}
+}
+
+func TestLoad_RejectsInvalidVersion(t *testing.T) {
+	for _, version := range []string{"-1", "one"} {
+		_, err := Load(writeConfig(t, "version: "+version+"\n"))
+		if err == nil || !strings.Contains(err.Error(), "invalid version") {
+			t.Errorf("Load() of version %s error = %v, want an invalid version error", version, err)
+		}
+	}
+}
+
+func TestLoad_RejectsUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"top level", "version: 1\nbatchh:\n  window: 30s\n"},
+		{"nested", "version: 1\nbatch:\n  windw: 30s\n"},
+		// Only version 0 files are converted, so a current file keeps the
+		// key and fails on it
+		{"removed key in a current file", "version: 1\nbatch:\n  storage_path: /tmp/batches.db\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), "not found") {
+				t.Errorf("Load() error = %v, want an unknown key error", err)
+			}
+		})
+	}
+}
+
+func TestLoad_UnknownKeyErrorNamesLine(t *testing.T) {
+	// The converted document is decoded after an upgrade; errors still
+	// point into the file
+	_, err := Load(writeConfig(t, "batch:\n  storage_path: /tmp/batches.db\n  windw: 30s\n"))
+	if err == nil || !strings.Contains(err.Error(), "windw") {
+		t.Errorf("Load() error = %v, want it to name windw", err)
+	}
+	_, err = Load(writeConfig(t, "version: 1\nserver:\n  port: 9090\nbatchh: {}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("Load() error = %v, want it to point at line 4", err)
+	}
+}
+
+func TestLoad_EmptyFile(t *testing.T) {
+	for _, content := range []string{"", "# nothing set yet\n"} {
+		cfg, err := Load(writeConfig(t, content))
+		if err != nil {
+			t.Fatalf("Load(%q) error = %v", content, err)
+		}
+		if cfg.Version != CurrentVersion {
+			t.Errorf("Load(%q) Version = %d, want %d", content, cfg.Version, CurrentVersion)
+		}
+		if def := Default(); cfg.Server.Port != def.Server.Port || cfg.Batch.Window != def.Batch.Window {
+			t.Errorf("Load(%q) = port %d, window %s, want the defaults", content, cfg.Server.Port, cfg.Batch.Window)
+		}
+	}
+}
+
+func TestLoad_RejectsNonMapping(t *testing.T) {
+	_, err := Load(writeConfig(t, "- server\n- batch\n"))
+	if err == nil || !strings.Contains(err.Error(), "must be a mapping") {
+		t.Errorf("Load() error = %v, want a mapping error", err)
+	}
+}
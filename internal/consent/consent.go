@@ -0,0 +1,355 @@
+// Package consent decides whether a sender may push to a recipient.
+//
+// The gateway normally honors the consent list each recipient publishes in
+// OurCloud. Other policies cover development (allow everything), locked-down
+// deployments (deny unless an operator allows a pair), and delegating the
+// decision to an external service.
+package consent
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Policy names accepted by New.
+const (
+	PolicyList     = "list"
+	PolicyAllowAll = "allow_all"
+	PolicyDeny     = "deny"
+	PolicyWebhook  = "webhook"
+)
+
+// defaultWebhookTimeout is used when Config.WebhookTimeout is zero.
+const defaultWebhookTimeout = 2 * time.Second
+
+// maxWebhookCacheEntries caps the decisions a WebhookPolicy caches.
+const maxWebhookCacheEntries = 10000
+
+// webhookRevalidateInterval is how often a WebhookPolicy drops the cached
+// denial of a pair on request, so revalidation can't bypass the cache.
+const webhookRevalidateInterval = time.Minute
+
+// Headers authenticating webhook requests when the policy has a secret.
+// The signature is "sha256=" and the hex HMAC-SHA256, keyed by the secret,
+// of the timestamp, a ".", and the request body.
+const (
+	WebhookTimestampHeader = "X-Consent-Timestamp" // Unix time in seconds
+	WebhookSignatureHeader = "X-Consent-Signature"
+)
+
+// Policy decides whether sender may push to recipient.
+type Policy interface {
+	Allow(ctx context.Context, recipient, sender string) (bool, error)
+}
+
+// Revalidator is implemented by policies that cache decisions, so consent a
+// recipient just granted can apply before its cached denial expires.
+type Revalidator interface {
+	// Revalidate drops the cached denial of sender by recipient, so the
+	// next Allow decides afresh. Returns false if there is none, or if the
+	// pair was revalidated too recently.
+	Revalidate(recipient, sender string) bool
+}
+
+// ListSource checks recipients' published consent lists.
+// *ourcloud.Client implements this interface.
+type ListSource interface {
+	HasConsent(ctx context.Context, recipientUsername, senderUsername string) (bool, error)
+}
+
+// Override allows Sender to push to Recipient under the deny policy.
+// Either may be "*" to match any user.
+type Override struct {
+	Recipient string
+	Sender    string
+}
+
+// Config selects and configures a policy.
+type Config struct {
+	// Policy is one of PolicyList (the default), PolicyAllowAll,
+	// PolicyDeny, or PolicyWebhook.
+	Policy string
+	// Overrides are the pairs allowed by PolicyDeny.
+	Overrides []Override
+	// WebhookURL receives a POST per decision for PolicyWebhook.
+	WebhookURL string
+	// WebhookTimeout bounds each webhook call. Defaults to 2s.
+	WebhookTimeout time.Duration
+	// WebhookFailOpen allows pushes when the webhook can't be reached or
+	// fails, instead of denying them.
+	WebhookFailOpen bool
+	// WebhookSecret, when set, signs each webhook request so the service
+	// can tell it came from the gateway. See WebhookSignatureHeader.
+	WebhookSecret string
+	// WebhookCacheTTL, when set, reuses each decision for this long instead
+	// of calling the webhook for every push.
+	WebhookCacheTTL time.Duration
+}
+
+// New returns the policy cfg selects. lists backs PolicyList.
+func New(cfg Config, lists ListSource) (Policy, error) {
+	switch cfg.Policy {
+	case "", PolicyList:
+		return ListPolicy{Lists: lists}, nil
+	case PolicyAllowAll:
+		return AllowAllPolicy{}, nil
+	case PolicyDeny:
+		return NewDenyPolicy(cfg.Overrides), nil
+	case PolicyWebhook:
+		if cfg.WebhookURL == "" {
+			return nil, errors.New("webhook policy requires a webhook URL")
+		}
+		p := NewWebhookPolicy(cfg.WebhookURL, cfg.WebhookTimeout, cfg.WebhookFailOpen)
+		p.SetSecret(cfg.WebhookSecret)
+		p.SetCacheTTL(cfg.WebhookCacheTTL)
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown consent policy %q (want list, allow_all, deny, or webhook)", cfg.Policy)
+}
+
+// ListPolicy allows senders on the recipient's OurCloud consent list.
+type ListPolicy struct {
+	Lists ListSource
+}
+
+// Allow implements Policy.
+func (p ListPolicy) Allow(ctx context.Context, recipient, sender string) (bool, error) {
+	return p.Lists.HasConsent(ctx, recipient, sender)
+}
+
+// AllowAllPolicy allows every push. It is meant for development only.
+type AllowAllPolicy struct{}
+
+// Allow implements Policy.
+func (AllowAllPolicy) Allow(ctx context.Context, recipient, sender string) (bool, error) {
+	return true, nil
+}
+
+// DenyPolicy denies every push except those matching an override.
+type DenyPolicy struct {
+	overrides []Override
+}
+
+// NewDenyPolicy creates a DenyPolicy allowing only overrides.
+func NewDenyPolicy(overrides []Override) *DenyPolicy {
+	return &DenyPolicy{overrides: overrides}
+}
+
+// Allow implements Policy.
+func (p *DenyPolicy) Allow(ctx context.Context, recipient, sender string) (bool, error) {
+	for _, o := range p.overrides {
+		if matches(o.Recipient, recipient) && matches(o.Sender, sender) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matches reports whether username matches pattern, which is a username or "*".
+func matches(pattern, username string) bool {
+	return pattern == "*" || pattern == username
+}
+
+// WebhookRequest is the JSON body POSTed to the policy webhook.
+type WebhookRequest struct {
+	Recipient string `json:"recipient"`
+	Sender    string `json:"sender"`
+}
+
+// WebhookResponse is the JSON body the policy webhook returns with 200 OK.
+type WebhookResponse struct {
+	Allow bool `json:"allow"`
+}
+
+// WebhookPolicy asks an external service whether to allow each push.
+type WebhookPolicy struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+	secret   []byte        // nil when requests aren't signed
+	cacheTTL time.Duration // zero when decisions aren't cached
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[webhookPair]webhookDecision
+}
+
+// webhookPair keys cached decisions.
+type webhookPair struct {
+	recipient, sender string
+}
+
+// webhookDecision is a cached webhook answer.
+type webhookDecision struct {
+	allow       bool
+	expires     time.Time
+	revalidated time.Time // last Revalidate that dropped a denial of the pair
+}
+
+// NewWebhookPolicy creates a WebhookPolicy that POSTs a WebhookRequest to url.
+// A zero timeout uses the default.
+func NewWebhookPolicy(url string, timeout time.Duration, failOpen bool) *WebhookPolicy {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &WebhookPolicy{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: failOpen,
+		now:      time.Now,
+	}
+}
+
+// SetSecret signs webhook requests with secret, or stops signing them if
+// it is empty. Must be called before the policy is used.
+func (p *WebhookPolicy) SetSecret(secret string) {
+	p.secret = nil
+	if secret != "" {
+		p.secret = []byte(secret)
+	}
+}
+
+// SetCacheTTL caches each decision for ttl, or turns caching off if it is
+// zero. Failed calls aren't cached. Must be called before the policy is
+// used.
+func (p *WebhookPolicy) SetCacheTTL(ttl time.Duration) {
+	p.cacheTTL = ttl
+	p.cache = nil
+	if ttl > 0 {
+		p.cache = make(map[webhookPair]webhookDecision)
+	}
+}
+
+// Allow implements Policy. Webhook failures deny the push, or allow it when
+// the policy fails open.
+func (p *WebhookPolicy) Allow(ctx context.Context, recipient, sender string) (bool, error) {
+	pair := webhookPair{recipient: recipient, sender: sender}
+	if allow, ok := p.cached(pair); ok {
+		return allow, nil
+	}
+	allow, err := p.ask(ctx, recipient, sender)
+	if err == nil {
+		p.remember(pair, allow)
+	}
+	if err != nil && p.failOpen {
+		log.Printf("WARNING: consent webhook failed, allowing %s -> %s: %v", sender, recipient, err)
+		return true, nil
+	}
+	return allow, err
+}
+
+// ask calls the webhook for one decision.
+func (p *WebhookPolicy) ask(ctx context.Context, recipient, sender string) (bool, error) {
+	body, err := json.Marshal(&WebhookRequest{Recipient: recipient, Sender: sender})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("building consent webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.secret != nil {
+		timestamp := strconv.FormatInt(p.now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(p.secret, timestamp, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("calling consent webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("consent webhook returned %s", resp.Status)
+	}
+
+	var decision WebhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("decoding consent webhook response: %w", err)
+	}
+	return decision.Allow, nil
+}
+
+// cached returns the cached decision for pair, if there is one.
+func (p *WebhookPolicy) cached(pair webhookPair) (allow, ok bool) {
+	if p.cache == nil {
+		return false, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d, ok := p.cache[pair]
+	if !ok || !p.now().Before(d.expires) {
+		return false, false
+	}
+	return d.allow, true
+}
+
+// remember caches the decision for pair. A full cache drops its expired
+// decisions first, and all of them if none had expired.
+func (p *WebhookPolicy) remember(pair webhookPair, allow bool) {
+	if p.cache == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if len(p.cache) >= maxWebhookCacheEntries {
+		for k, d := range p.cache {
+			if !now.Before(d.expires) {
+				delete(p.cache, k)
+			}
+		}
+		if len(p.cache) >= maxWebhookCacheEntries {
+			clear(p.cache)
+		}
+	}
+	p.cache[pair] = webhookDecision{allow: allow, expires: now.Add(p.cacheTTL), revalidated: p.cache[pair].revalidated}
+}
+
+// Revalidate implements Revalidator. Each pair's denial is dropped at most
+// once per webhookRevalidateInterval; the decision stays cached meanwhile.
+func (p *WebhookPolicy) Revalidate(recipient, sender string) bool {
+	if p.cache == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pair := webhookPair{recipient: recipient, sender: sender}
+	now := p.now()
+	d, ok := p.cache[pair]
+	if !ok || d.allow || !now.Before(d.expires) || now.Sub(d.revalidated) < webhookRevalidateInterval {
+		return false
+	}
+	// Expired rather than deleted, so the limit carries over to the next
+	// decision
+	d.expires, d.revalidated = now, now
+	p.cache[pair] = d
+	return true
+}
+
+// SignWebhook returns the WebhookSignatureHeader value for a request with
+// body sent at timestamp, for webhook services to check requests against.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,235 @@
+package consent
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// mockLists allows the senders listed for each recipient.
+type mockLists map[string][]string
+
+func (m mockLists) HasConsent(ctx context.Context, recipient, sender string) (bool, error) {
+	for _, s := range m[recipient] {
+		if s == sender {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestNew(t *testing.T) {
+	lists := mockLists{}
+	tests := []struct {
+		cfg     Config
+		wantErr bool
+	}{
+		{cfg: Config{}},
+		{cfg: Config{Policy: PolicyList}},
+		{cfg: Config{Policy: PolicyAllowAll}},
+		{cfg: Config{Policy: PolicyDeny}},
+		{cfg: Config{Policy: PolicyWebhook, WebhookURL: "http://localhost/consent"}},
+		{cfg: Config{Policy: PolicyWebhook}, wantErr: true},
+		{cfg: Config{Policy: "maybe"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		_, err := New(tt.cfg, lists)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	lists := mockLists{"bob@oc": {"alice@oc"}}
+	deny := NewDenyPolicy([]Override{
+		{Recipient: "bob@oc", Sender: "alice@oc"},
+		{Recipient: "*", Sender: "ops@oc"},
+	})
+
+	tests := []struct {
+		name      string
+		policy    Policy
+		recipient string
+		sender    string
+		want      bool
+	}{
+		{name: "list allows listed sender", policy: ListPolicy{Lists: lists}, recipient: "bob@oc", sender: "alice@oc", want: true},
+		{name: "list denies unlisted sender", policy: ListPolicy{Lists: lists}, recipient: "bob@oc", sender: "carol@oc", want: false},
+		{name: "allow all", policy: AllowAllPolicy{}, recipient: "bob@oc", sender: "carol@oc", want: true},
+		{name: "deny override", policy: deny, recipient: "bob@oc", sender: "alice@oc", want: true},
+		{name: "deny wildcard override", policy: deny, recipient: "carol@oc", sender: "ops@oc", want: true},
+		{name: "deny without override", policy: deny, recipient: "carol@oc", sender: "alice@oc", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.Allow(context.Background(), tt.recipient, tt.sender)
+			if err != nil {
+				t.Fatalf("Allow() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Allow(%s, %s) = %v, want %v", tt.recipient, tt.sender, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookPolicy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if req.Recipient == "broken@oc" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(&WebhookResponse{Allow: req.Sender == "alice@oc"})
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	p := NewWebhookPolicy(srv.URL, time.Second, false)
+
+	if ok, err := p.Allow(ctx, "bob@oc", "alice@oc"); err != nil || !ok {
+		t.Errorf("Allow(alice) = %v, %v; want true, nil", ok, err)
+	}
+	if ok, err := p.Allow(ctx, "bob@oc", "carol@oc"); err != nil || ok {
+		t.Errorf("Allow(carol) = %v, %v; want false, nil", ok, err)
+	}
+	if ok, err := p.Allow(ctx, "broken@oc", "alice@oc"); err == nil || ok {
+		t.Errorf("Allow() on webhook failure = %v, %v; want false and an error", ok, err)
+	}
+
+	failOpen := NewWebhookPolicy(srv.URL, time.Second, true)
+	if ok, err := failOpen.Allow(ctx, "broken@oc", "carol@oc"); err != nil || !ok {
+		t.Errorf("fail-open Allow() on webhook failure = %v, %v; want true, nil", ok, err)
+	}
+}
+
+func TestWebhookPolicy_SignedAndCached(t *testing.T) {
+	secret := []byte("webhook secret")
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		want := SignWebhook(secret, r.Header.Get(WebhookTimestampHeader), body)
+		if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(want)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var req WebhookRequest
+		json.Unmarshal(body, &req)
+		json.NewEncoder(w).Encode(&WebhookResponse{Allow: req.Sender == "alice@oc"})
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{
+		Policy:          PolicyWebhook,
+		WebhookURL:      srv.URL,
+		WebhookSecret:   string(secret),
+		WebhookCacheTTL: time.Minute,
+	}, nil)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	webhook := p.(*WebhookPolicy)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	webhook.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	for range 3 {
+		if ok, err := p.Allow(ctx, "bob@oc", "alice@oc"); err != nil || !ok {
+			t.Fatalf("Allow(alice) = %v, %v; want true, nil", ok, err)
+		}
+		if ok, err := p.Allow(ctx, "bob@oc", "carol@oc"); err != nil || ok {
+			t.Fatalf("Allow(carol) = %v, %v; want false, nil", ok, err)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("webhook calls = %d, want 2 with decisions cached", got)
+	}
+
+	now = now.Add(time.Minute)
+	p.Allow(ctx, "bob@oc", "alice@oc")
+	if got := calls.Load(); got != 3 {
+		t.Errorf("webhook calls after the cache expired = %d, want 3", got)
+	}
+
+	// An unsigned request is refused, and the failure isn't cached
+	webhook.SetSecret("")
+	webhook.SetCacheTTL(time.Minute)
+	for range 2 {
+		if ok, err := p.Allow(ctx, "bob@oc", "alice@oc"); err == nil || ok {
+			t.Errorf("unsigned Allow() = %v, %v; want false and an error", ok, err)
+		}
+	}
+	if got := calls.Load(); got != 5 {
+		t.Errorf("webhook calls after failures = %d, want 5", got)
+	}
+}
+
+func TestWebhookPolicy_Revalidate(t *testing.T) {
+	var calls atomic.Int32
+	var granted atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(&WebhookResponse{Allow: granted.Load()})
+	}))
+	defer srv.Close()
+
+	p := NewWebhookPolicy(srv.URL, time.Second, false)
+	p.SetCacheTTL(time.Hour)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if p.Revalidate("bob@oc", "alice@oc") {
+		t.Error("Revalidate() with nothing cached = true, want false")
+	}
+	if ok, _ := p.Allow(ctx, "bob@oc", "alice@oc"); ok {
+		t.Fatal("Allow() = true before consent was granted")
+	}
+
+	// The recipient grants consent; the cached denial still applies
+	granted.Store(true)
+	if ok, _ := p.Allow(ctx, "bob@oc", "alice@oc"); ok {
+		t.Fatal("Allow() = true from the cache, want the cached denial")
+	}
+	if !p.Revalidate("bob@oc", "alice@oc") {
+		t.Fatal("Revalidate() = false, want the denial dropped")
+	}
+	if ok, err := p.Allow(ctx, "bob@oc", "alice@oc"); err != nil || !ok {
+		t.Errorf("Allow() after Revalidate = %v, %v; want true, nil", ok, err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("webhook calls = %d, want 2", got)
+	}
+
+	// Allowed pairs have nothing to revalidate, and a pair denied again is
+	// limited to one revalidation per interval
+	if p.Revalidate("bob@oc", "alice@oc") {
+		t.Error("Revalidate() of an allowed pair = true, want false")
+	}
+	granted.Store(false)
+	now = now.Add(2 * time.Hour)
+	p.Allow(ctx, "bob@oc", "alice@oc")
+	if !p.Revalidate("bob@oc", "alice@oc") {
+		t.Fatal("Revalidate() after the interval = false, want true")
+	}
+	p.Allow(ctx, "bob@oc", "alice@oc")
+	if p.Revalidate("bob@oc", "alice@oc") {
+		t.Error("Revalidate() again within the interval = true, want false")
+	}
+	now = now.Add(webhookRevalidateInterval)
+	if !p.Revalidate("bob@oc", "alice@oc") {
+		t.Error("Revalidate() once the interval passed = false, want true")
+	}
+}
@@ -0,0 +1,40 @@
+package consent
+
+import (
+	"context"
+	"time"
+)
+
+// GrantStore persists reply grants.
+// *store.SQLiteStore and *store.ShardedStore implement this interface.
+type GrantStore interface {
+	GrantReply(ctx context.Context, recipient, sender string, expiresAt time.Time) error
+	HasReplyGrant(ctx context.Context, recipient, sender string) (bool, error)
+}
+
+// ReplyGrants lets users push back to senders that recently pushed to them,
+// so request/response interactions work without both sides publishing
+// consent. Accepting a push from a consented sender grants its recipient a
+// reply path to that sender for the reply window.
+type ReplyGrants struct {
+	store  GrantStore
+	window time.Duration
+}
+
+// NewReplyGrants creates ReplyGrants whose grants last window.
+func NewReplyGrants(st GrantStore, window time.Duration) *ReplyGrants {
+	return &ReplyGrants{store: st, window: window}
+}
+
+// Grant lets recipient push to sender for the reply window, after sender's
+// push to recipient was accepted. A grant still running is extended.
+func (g *ReplyGrants) Grant(ctx context.Context, sender, recipient string) error {
+	return g.store.GrantReply(ctx, sender, recipient, time.Now().Add(g.window))
+}
+
+// Allow reports whether sender may push to recipient as a reply, because
+// recipient pushed to sender within the reply window. It has Policy's
+// signature, but is consulted only after the policy denies a push.
+func (g *ReplyGrants) Allow(ctx context.Context, recipient, sender string) (bool, error) {
+	return g.store.HasReplyGrant(ctx, recipient, sender)
+}
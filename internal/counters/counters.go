@@ -0,0 +1,138 @@
+// Package counters keeps running totals, such as pushes accepted and
+// delivered, that survive restarts, so dashboards computing increases over
+// long ranges don't see them fall back to zero.
+//
+// Additions are counted in memory and written to the store periodically.
+// At startup the totals resume from the store. Additions made since the
+// last write are lost if the process dies without a final Flush.
+package counters
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// Store persists the totals.
+// *store.SQLiteStore and *store.ShardedStore implement this interface.
+type Store interface {
+	AddCounters(ctx context.Context, deltas map[string]int64, at time.Time) error
+	ListCounters(ctx context.Context) ([]store.Counter, error)
+}
+
+// Snapshot is the totals at one moment.
+type Snapshot struct {
+	Counters map[string]int64 `json:"counters"`
+	// Since is when the first counter was first written, so a total can be
+	// read as a count since then.
+	Since time.Time `json:"since,omitzero"`
+	// Unflushed counts additions not yet written to the store, lost if
+	// the gateway dies before the next flush.
+	Unflushed int64 `json:"unflushed"`
+	// Restored is true if the totals were resumed from the store at
+	// startup.
+	Restored bool `json:"restored"`
+}
+
+// Counters keeps named totals across restarts. Names are fixed by the
+// caller; Add with a name New wasn't given is ignored.
+type Counters struct {
+	store Store
+
+	mu       sync.Mutex
+	totals   map[string]int64
+	pending  map[string]int64
+	since    time.Time
+	restored bool
+}
+
+// New creates Counters for names, resuming their totals from st.
+func New(ctx context.Context, st Store, names []string) (*Counters, error) {
+	c := &Counters{
+		store:   st,
+		totals:  make(map[string]int64, len(names)),
+		pending: make(map[string]int64, len(names)),
+	}
+	for _, name := range names {
+		c.totals[name] = 0
+	}
+	stored, err := st.ListCounters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading counters: %w", err)
+	}
+	for _, sc := range stored {
+		if _, ok := c.totals[sc.Name]; !ok {
+			continue // no longer kept
+		}
+		c.totals[sc.Name] = sc.Value
+		c.restored = true
+		if c.since.IsZero() || sc.CreatedAt.Before(c.since) {
+			c.since = sc.CreatedAt
+		}
+	}
+	return c, nil
+}
+
+// Add adds n to the total called name.
+func (c *Counters) Add(name string, n int64) {
+	if n == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.totals[name]; !ok {
+		return
+	}
+	c.totals[name] += n
+	c.pending[name] += n
+}
+
+// Flush writes the additions since the last flush to the store, as of now.
+// On failure they are kept for the next flush.
+func (c *Counters) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	if len(c.pending) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	deltas := c.pending
+	c.pending = make(map[string]int64, len(deltas))
+	c.mu.Unlock()
+
+	now := time.Now()
+	err := c.store.AddCounters(ctx, deltas, now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		for name, n := range deltas {
+			c.pending[name] += n
+		}
+		return fmt.Errorf("writing counters: %w", err)
+	}
+	if c.since.IsZero() {
+		c.since = now
+	}
+	return nil
+}
+
+// Snapshot returns the totals, including additions not yet flushed.
+func (c *Counters) Snapshot() Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snap := Snapshot{
+		Counters: make(map[string]int64, len(c.totals)),
+		Since:    c.since,
+		Restored: c.restored,
+	}
+	for name, total := range c.totals {
+		snap.Counters[name] = total
+	}
+	for _, n := range c.pending {
+		snap.Unflushed += n
+	}
+	return snap
+}
@@ -0,0 +1,99 @@
+package counters
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func newTestStore(t *testing.T) *store.SQLiteStore {
+	t.Helper()
+	st, err := store.New(store.Config{Path: filepath.Join(t.TempDir(), "counters.db")})
+	if err != nil {
+		t.Fatalf("store.New() error = %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func TestCounters_ResumeAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	st := newTestStore(t)
+
+	c, err := New(ctx, st, []string{"accepted", "failed"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c.Add("accepted", 3)
+	c.Add("unknown", 5)
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	c.Add("accepted", 2)
+	c.Add("failed", 1)
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	restarted, err := New(ctx, st, []string{"accepted", "failed"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	snap := restarted.Snapshot()
+	if snap.Counters["accepted"] != 5 || snap.Counters["failed"] != 1 {
+		t.Errorf("counters = %v, want accepted 5, failed 1", snap.Counters)
+	}
+	if _, ok := snap.Counters["unknown"]; ok {
+		t.Error("counter not asked for was kept")
+	}
+	if !snap.Restored || snap.Since.IsZero() || snap.Unflushed != 0 {
+		t.Errorf("snapshot = %+v, want restored with a since time and nothing unflushed", snap)
+	}
+}
+
+// failingStore fails writes while fail is set.
+type failingStore struct {
+	*store.SQLiteStore
+	fail bool
+}
+
+func (f *failingStore) AddCounters(ctx context.Context, deltas map[string]int64, at time.Time) error {
+	if f.fail {
+		return errors.New("disk full")
+	}
+	return f.SQLiteStore.AddCounters(ctx, deltas, at)
+}
+
+func TestCounters_FlushFailureKeepsAdditions(t *testing.T) {
+	ctx := context.Background()
+	st := &failingStore{SQLiteStore: newTestStore(t), fail: true}
+
+	c, err := New(ctx, st, []string{"delivered"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c.Add("delivered", 4)
+	if err := c.Flush(ctx); err == nil {
+		t.Fatal("Flush() succeeded with a failing store")
+	}
+	if snap := c.Snapshot(); snap.Counters["delivered"] != 4 || snap.Unflushed != 4 {
+		t.Errorf("snapshot = %+v, want 4 delivered, 4 unflushed", snap)
+	}
+
+	st.fail = false
+	c.Add("delivered", 1)
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	counters, err := st.ListCounters(ctx)
+	if err != nil {
+		t.Fatalf("ListCounters() error = %v", err)
+	}
+	if len(counters) != 1 || counters[0].Value != 5 {
+		t.Errorf("stored = %+v, want delivered 5", counters)
+	}
+}
@@ -0,0 +1,290 @@
+// Package egress routes the gateway's outgoing connections to Firebase and
+// OurCloud through a proxy, for deployments that may only reach the internet
+// through one.
+//
+// HTTP clients use Transport. Clients that only take an address to dial,
+// like the OurCloud client library, use Tunnel: it forwards a loopback port
+// to the destination through the proxy.
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout bounds connecting to a destination through the proxy,
+// including the proxy's handshake.
+const dialTimeout = 30 * time.Second
+
+// Config holds proxy settings.
+type Config struct {
+	// URL is the proxy: "http://host:port", "https://host:port" or
+	// "socks5://host:port", optionally with "user:password@".
+	URL string
+	// NoProxy lists the destinations reached directly, in NO_PROXY syntax:
+	// a host name (also matching its subdomains), ".domain" (only
+	// subdomains), an IP address or CIDR range, any of them with ":port",
+	// or "*". Loopback addresses are always reached directly.
+	NoProxy []string
+}
+
+// Dialer connects to destinations through the proxy, unless they bypass it.
+type Dialer struct {
+	proxy     *url.URL
+	proxyFunc func(*url.URL) (*url.URL, error)
+	direct    net.Dialer
+}
+
+// New returns a Dialer for cfg.
+func New(cfg Config) (*Dialer, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", u.Redacted())
+	}
+
+	proxyConfig := &httpproxy.Config{
+		HTTPProxy:  cfg.URL,
+		HTTPSProxy: cfg.URL,
+		NoProxy:    strings.Join(cfg.NoProxy, ","),
+	}
+	return &Dialer{proxy: u, proxyFunc: proxyConfig.ProxyFunc()}, nil
+}
+
+// String returns the proxy URL without its password, for logging.
+func (d *Dialer) String() string {
+	return d.proxy.Redacted()
+}
+
+// proxyFor returns the proxy to reach address ("host:port") through, or nil
+// if address bypasses it.
+func (d *Dialer) proxyFor(address string) *url.URL {
+	// New validated the proxy URL, so this can't fail
+	u, _ := d.proxyFunc(&url.URL{Scheme: "https", Host: address})
+	return u
+}
+
+// Transport returns an HTTP transport sending requests through the proxy,
+// unless their host bypasses it.
+func (d *Dialer) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		return d.proxyFunc(req.URL)
+	}
+	return t
+}
+
+// DialContext connects to address through the proxy, or directly if address
+// bypasses it.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	p := d.proxyFor(address)
+	if p == nil {
+		return d.direct.DialContext(ctx, network, address)
+	}
+
+	switch p.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if p.User != nil {
+			password, _ := p.User.Password()
+			auth = &proxy.Auth{User: p.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", hostPort(p), auth, &d.direct)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := socks.(proxy.ContextDialer).DialContext(ctx, network, address)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %s through proxy %s: %w", address, p.Redacted(), err)
+		}
+		return conn, nil
+	default:
+		return d.connect(ctx, p, address)
+	}
+}
+
+// connect opens a tunnel to address with an HTTP CONNECT request to p.
+func (d *Dialer) connect(ctx context.Context, p *url.URL, address string) (net.Conn, error) {
+	conn, err := d.direct.DialContext(ctx, "tcp", hostPort(p))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy %s: %w", p.Redacted(), err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if p.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connecting to proxy %s: %w", p.Redacted(), err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending CONNECT to proxy %s: %w", p.Redacted(), err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response from proxy %s: %w", p.Redacted(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", p.Redacted(), address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// hostPort returns p's "host:port", with the scheme's default port if p has
+// none.
+func hostPort(p *url.URL) string {
+	if p.Port() != "" {
+		return p.Host
+	}
+	port := "1080"
+	switch p.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(p.Hostname(), port)
+}
+
+// Tunnel listens on a loopback port and forwards every connection made to
+// it to address through the proxy. It returns the loopback address to dial
+// and a function that stops the tunnel and closes its connections. If
+// address bypasses the proxy, it returns address itself.
+func (d *Dialer) Tunnel(address string) (string, func() error, error) {
+	if d.proxyFor(address) == nil {
+		return address, func() error { return nil }, nil
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("opening tunnel to %s: %w", address, err)
+	}
+	t := &tunnel{dialer: d, address: address, ln: ln, conns: make(map[net.Conn]struct{})}
+	go t.serve()
+	return ln.Addr().String(), t.close, nil
+}
+
+// tunnel forwards connections from a loopback listener to one destination.
+type tunnel struct {
+	dialer  *Dialer
+	address string
+	ln      net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func (t *tunnel) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+		go t.forward(conn)
+	}
+}
+
+// forward copies between conn and a new connection to the destination until
+// either side closes.
+func (t *tunnel) forward(conn net.Conn) {
+	if !t.track(conn) {
+		conn.Close()
+		return
+	}
+	defer t.untrack(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	remote, err := t.dialer.DialContext(ctx, "tcp", t.address)
+	cancel()
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return
+	}
+	if !t.track(remote) {
+		remote.Close()
+		return
+	}
+	defer t.untrack(remote)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, conn)
+		remote.Close()
+		close(done)
+	}()
+	io.Copy(conn, remote)
+	conn.Close()
+	<-done
+}
+
+// track registers conn to be closed with the tunnel. It returns false if the
+// tunnel is already closed.
+func (t *tunnel) track(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *tunnel) untrack(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+}
+
+func (t *tunnel) close() error {
+	t.mu.Lock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	return t.ln.Close()
+}
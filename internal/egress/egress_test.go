@@ -0,0 +1,224 @@
+package egress
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// destination is an unresolvable address the fake proxies map to the echo
+// server, so reaching it proves the connection went through the proxy.
+const destination = "ourcloud.internal:50051"
+
+// echoServer returns the address of a server that echoes what it reads.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+}
+
+// listen serves every connection to a new loopback listener with handle.
+func listen(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// connectProxy returns the address of an HTTP CONNECT proxy that forwards
+// every tunnel to backend, recording the requests it gets.
+func connectProxy(t *testing.T, backend string, requests chan<- *http.Request) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		requests <- req
+		remote, err := net.Dial("tcp", backend)
+		if err != nil {
+			return
+		}
+		defer remote.Close()
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(remote, br)
+		io.Copy(conn, remote)
+	})
+}
+
+// socksProxy returns the address of an unauthenticated SOCKS5 proxy that
+// forwards every connection to backend, reporting the requested host.
+func socksProxy(t *testing.T, backend string, hosts chan<- string) string {
+	t.Helper()
+	return listen(t, func(conn net.Conn) {
+		// Greeting: version, methods
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, buf[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 0})
+
+		// Request: version, command, reserved, domain name address, port
+		head := make([]byte, 5)
+		if _, err := io.ReadFull(conn, head); err != nil || head[3] != 3 {
+			return
+		}
+		name := make([]byte, head[4]+2)
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		port := binary.BigEndian.Uint16(name[len(name)-2:])
+		hosts <- net.JoinHostPort(string(name[:len(name)-2]), strconv.Itoa(int(port)))
+
+		remote, err := net.Dial("tcp", backend)
+		if err != nil {
+			return
+		}
+		defer remote.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+	})
+}
+
+// roundTrip writes a line through a tunnel and checks it comes back.
+func roundTrip(t *testing.T, address string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo = %q, %v; want %q", line, err, "ping\n")
+	}
+}
+
+func TestTunnel_Connect(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	proxyAddr := connectProxy(t, echoServer(t), requests)
+
+	d, err := New(Config{URL: "http://gw:secret@" + proxyAddr})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	local, closeTunnel, err := d.Tunnel(destination)
+	if err != nil {
+		t.Fatalf("Tunnel() error = %v", err)
+	}
+	defer closeTunnel()
+
+	roundTrip(t, local)
+	req := <-requests
+	if req.Method != http.MethodConnect || req.Host != destination {
+		t.Errorf("proxy got %s %s, want CONNECT %s", req.Method, req.Host, destination)
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("gw:secret"))
+	if got := req.Header.Get("Proxy-Authorization"); got != want {
+		t.Errorf("Proxy-Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestTunnel_SOCKS5(t *testing.T) {
+	hosts := make(chan string, 1)
+	proxyAddr := socksProxy(t, echoServer(t), hosts)
+
+	d, err := New(Config{URL: "socks5://" + proxyAddr})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	local, closeTunnel, err := d.Tunnel(destination)
+	if err != nil {
+		t.Fatalf("Tunnel() error = %v", err)
+	}
+	defer closeTunnel()
+
+	roundTrip(t, local)
+	if host := <-hosts; host != destination {
+		t.Errorf("proxy got request for %s, want %s", host, destination)
+	}
+}
+
+func TestTunnel_NoProxy(t *testing.T) {
+	d, err := New(Config{URL: "http://proxy.internal:3128", NoProxy: []string{".internal"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	local, closeTunnel, err := d.Tunnel(destination)
+	if err != nil {
+		t.Fatalf("Tunnel() error = %v", err)
+	}
+	defer closeTunnel()
+	if local != destination {
+		t.Errorf("Tunnel() = %s, want %s (bypassing the proxy)", local, destination)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	d, err := New(Config{URL: "http://proxy.internal:3128", NoProxy: []string{"direct.example.com"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	transport := d.Transport()
+
+	tests := []struct {
+		url  string
+		want string // proxy host, or "" for direct
+	}{
+		{"https://fcm.googleapis.com/v1/projects/p/messages:send", "proxy.internal:3128"},
+		{"https://direct.example.com/", ""},
+		{"https://api.direct.example.com/", ""},
+		{"http://127.0.0.1:8080/", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		got, err := transport.Proxy(req)
+		if err != nil {
+			t.Fatalf("Proxy(%s) error = %v", tt.url, err)
+		}
+		host := ""
+		if got != nil {
+			host = got.Host
+		}
+		if host != tt.want {
+			t.Errorf("Proxy(%s) = %q, want %q", tt.url, host, tt.want)
+		}
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, proxyURL := range []string{"ftp://proxy:21", "http://", "socks4://proxy:1080"} {
+		if _, err := New(Config{URL: proxyURL}); err == nil {
+			t.Errorf("New(%q) succeeded, want error", proxyURL)
+		}
+	}
+}
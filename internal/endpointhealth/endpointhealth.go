@@ -0,0 +1,276 @@
+// Package endpointhealth scores FCM endpoints by how their recent
+// deliveries went, so operators can see which devices have become
+// unreachable, and the gateway can stop waking an endpoint that keeps
+// failing.
+//
+// An endpoint's score is its share of successful sends, with each outcome
+// weighed down by half every HalfLife, so a device that recovers is soon
+// scored by its new behavior.
+package endpointhealth
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config sets how endpoints are scored and paused. Zero values take the
+// defaults below.
+type Config struct {
+	// HalfLife is how long until an outcome counts half as much as a new
+	// one. Defaults to 24h.
+	HalfLife time.Duration
+	// PauseBelow pauses an endpoint whose score falls below it, once
+	// MinAttempts sends have been scored. Zero never pauses.
+	PauseBelow float64
+	// MinAttempts is how many recent sends, weighed by age, an endpoint
+	// needs before PauseBelow applies. Defaults to 5.
+	MinAttempts float64
+	// PauseFor is how long a pause lasts. The next send after it probes
+	// whether the endpoint recovered. Defaults to 1h.
+	PauseFor time.Duration
+	// MaxEndpoints caps the endpoints tracked. The least recently sent to
+	// are forgotten first. Defaults to 100000.
+	MaxEndpoints int
+}
+
+func (c *Config) setDefaults() {
+	if c.HalfLife == 0 {
+		c.HalfLife = 24 * time.Hour
+	}
+	if c.MinAttempts == 0 {
+		c.MinAttempts = 5
+	}
+	if c.PauseFor == 0 {
+		c.PauseFor = time.Hour
+	}
+	if c.MaxEndpoints == 0 {
+		c.MaxEndpoints = 100000
+	}
+}
+
+// Endpoint is one endpoint's health.
+type Endpoint struct {
+	FcmToken  string  `json:"fcm_token"`
+	Recipient string  `json:"recipient,omitempty"`
+	Score     float64 `json:"score"` // share of recent sends that succeeded, 0 to 1
+	// Attempts is the number of recent sends the score is based on,
+	// weighed by age.
+	Attempts    float64   `json:"attempts"`
+	Successes   uint64    `json:"successes"` // since tracking began
+	Failures    uint64    `json:"failures"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	LastFailure time.Time `json:"last_failure,omitzero"`
+	PausedUntil time.Time `json:"paused_until,omitzero"`
+}
+
+// Stats summarizes the tracker.
+type Stats struct {
+	Tracked int `json:"tracked"`
+	Paused  int `json:"paused"` // endpoints paused now
+	// Unreachable counts endpoints paused since startup, each once until it
+	// succeeds again.
+	Unreachable uint64 `json:"unreachable"`
+}
+
+// endpoint tracks one endpoint. successes and attempts decay with HalfLife
+// from updated.
+type endpoint struct {
+	recipient   string
+	successes   float64
+	attempts    float64
+	updated     time.Time
+	lastSent    time.Time
+	okCount     uint64
+	failCount   uint64
+	lastSuccess time.Time
+	lastFailure time.Time
+	pausedUntil time.Time
+	// unreachable is set by the first pause and cleared by a success, so
+	// the pauses that follow failed probes aren't reported again.
+	unreachable bool
+}
+
+// Tracker scores endpoints by their delivery outcomes.
+type Tracker struct {
+	cfg Config
+	now func() time.Time
+
+	mu          sync.Mutex
+	endpoints   map[string]*endpoint // by FCM token
+	unreachable uint64               // endpoints found unreachable since startup
+}
+
+// New creates a Tracker.
+func New(cfg Config) (*Tracker, error) {
+	cfg.setDefaults()
+	if cfg.PauseBelow < 0 || cfg.PauseBelow > 1 {
+		return nil, fmt.Errorf("pause threshold %v is outside 0 to 1", cfg.PauseBelow)
+	}
+	if cfg.HalfLife < 0 || cfg.PauseFor < 0 || cfg.MinAttempts < 0 || cfg.MaxEndpoints < 0 {
+		return nil, fmt.Errorf("endpoint health settings must not be negative")
+	}
+	return &Tracker{
+		cfg:       cfg,
+		now:       time.Now,
+		endpoints: make(map[string]*endpoint),
+	}, nil
+}
+
+// Record scores a send to fcmToken, owned by recipient. A failure that
+// leaves the score below PauseBelow pauses the endpoint, and a success ends
+// the pause. Record reports whether the endpoint was just found
+// unreachable: paused for the first time since it last succeeded.
+func (t *Tracker) Record(fcmToken, recipient string, delivered bool) (unreachable bool) {
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.endpoints[fcmToken]
+	if !ok {
+		t.evict()
+		e = &endpoint{updated: now}
+		t.endpoints[fcmToken] = e
+	}
+	if recipient != "" {
+		e.recipient = recipient
+	}
+	t.decay(e, now)
+	e.attempts++
+	e.lastSent = now
+	if delivered {
+		e.successes++
+		e.okCount++
+		e.lastSuccess = now
+		e.pausedUntil = time.Time{}
+		e.unreachable = false
+		return false
+	}
+	e.failCount++
+	e.lastFailure = now
+
+	if t.cfg.PauseBelow == 0 || e.attempts < t.cfg.MinAttempts || e.successes/e.attempts >= t.cfg.PauseBelow {
+		return false
+	}
+	e.pausedUntil = now.Add(t.cfg.PauseFor)
+	if e.unreachable {
+		return false
+	}
+	e.unreachable = true
+	t.unreachable++
+	return true
+}
+
+// PausedUntil returns when fcmToken's pause ends, or the zero time if it
+// isn't paused.
+func (t *Tracker) PausedUntil(fcmToken string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.endpoints[fcmToken]; ok && t.now().Before(e.pausedUntil) {
+		return e.pausedUntil
+	}
+	return time.Time{}
+}
+
+// List returns the endpoints scoring maxScore or less, worst first, and
+// optionally only recipient's, at most limit of them (0 for all).
+func (t *Tracker) List(recipient string, maxScore float64, limit int) []Endpoint {
+	now := t.now()
+
+	t.mu.Lock()
+	var list []Endpoint
+	for fcmToken, e := range t.endpoints {
+		if recipient != "" && e.recipient != recipient {
+			continue
+		}
+		t.decay(e, now)
+		info := t.info(fcmToken, e, now)
+		if info.Score <= maxScore {
+			list = append(list, info)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score < list[j].Score
+		}
+		return list[i].FcmToken < list[j].FcmToken
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list
+}
+
+// Stats returns a summary of the tracker.
+func (t *Tracker) Stats() Stats {
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := Stats{Tracked: len(t.endpoints), Unreachable: t.unreachable}
+	for _, e := range t.endpoints {
+		if now.Before(e.pausedUntil) {
+			stats.Paused++
+		}
+	}
+	return stats
+}
+
+// info describes e. Caller must hold t.mu.
+func (t *Tracker) info(fcmToken string, e *endpoint, now time.Time) Endpoint {
+	info := Endpoint{
+		FcmToken:    fcmToken,
+		Recipient:   e.recipient,
+		Score:       1,
+		Attempts:    math.Round(e.attempts*100) / 100,
+		Successes:   e.okCount,
+		Failures:    e.failCount,
+		LastSuccess: e.lastSuccess,
+		LastFailure: e.lastFailure,
+	}
+	if e.attempts > 0 {
+		info.Score = math.Round(e.successes/e.attempts*1000) / 1000
+	}
+	if now.Before(e.pausedUntil) {
+		info.PausedUntil = e.pausedUntil
+	}
+	return info
+}
+
+// decay ages e's outcomes to now. Caller must hold t.mu.
+func (t *Tracker) decay(e *endpoint, now time.Time) {
+	elapsed := now.Sub(e.updated)
+	if elapsed <= 0 {
+		return
+	}
+	factor := math.Exp2(-elapsed.Seconds() / t.cfg.HalfLife.Seconds())
+	e.successes *= factor
+	e.attempts *= factor
+	e.updated = now
+}
+
+// evict forgets the least recently sent to tenth of the endpoints if the
+// tracker is full, so a full tracker isn't scanned for every new endpoint.
+// Caller must hold t.mu.
+func (t *Tracker) evict() {
+	if len(t.endpoints) < t.cfg.MaxEndpoints {
+		return
+	}
+	tokens := make([]string, 0, len(t.endpoints))
+	for fcmToken := range t.endpoints {
+		tokens = append(tokens, fcmToken)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return t.endpoints[tokens[i]].lastSent.Before(t.endpoints[tokens[j]].lastSent)
+	})
+	for _, fcmToken := range tokens[:len(tokens)/10+1] {
+		delete(t.endpoints, fcmToken)
+	}
+}
@@ -0,0 +1,117 @@
+package endpointhealth
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestTracker returns a Tracker with a clock the test advances.
+func newTestTracker(t *testing.T, cfg Config) (*Tracker, *time.Time) {
+	t.Helper()
+	tr, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time { return now }
+	return tr, &now
+}
+
+func TestRecord_Score(t *testing.T) {
+	tr, now := newTestTracker(t, Config{HalfLife: time.Hour})
+
+	tr.Record("phone", "bob@oc", true)
+	tr.Record("phone", "bob@oc", false)
+	tr.Record("tablet", "bob@oc", true)
+	tr.Record("laptop", "carol@oc", false)
+
+	list := tr.List("bob@oc", 1, 0)
+	if len(list) != 2 || list[0].FcmToken != "phone" || list[1].FcmToken != "tablet" {
+		t.Fatalf("List(bob@oc) = %+v, want phone then tablet", list)
+	}
+	if list[0].Score != 0.5 || list[0].Successes != 1 || list[0].Failures != 1 {
+		t.Errorf("phone = %+v, want score 0.5 from one success and one failure", list[0])
+	}
+
+	// Older outcomes count for less: an hour on, a success outweighs the
+	// earlier failure
+	*now = now.Add(time.Hour)
+	tr.Record("phone", "bob@oc", true)
+	if got := tr.List("bob@oc", 1, 1)[0]; got.FcmToken != "phone" || got.Score != 0.75 {
+		t.Errorf("phone after decay = %+v, want score 0.75", got)
+	}
+
+	if got := tr.List("", 0.5, 0); len(got) != 1 || got[0].FcmToken != "laptop" {
+		t.Errorf("List(max 0.5) = %+v, want only laptop", got)
+	}
+}
+
+func TestRecord_Pause(t *testing.T) {
+	tr, now := newTestTracker(t, Config{PauseBelow: 0.2, MinAttempts: 3, PauseFor: time.Hour})
+
+	var unreachable int
+	for range 5 {
+		if tr.Record("phone", "bob@oc", false) {
+			unreachable++
+		}
+	}
+	if unreachable != 1 {
+		t.Errorf("found unreachable %d times, want once", unreachable)
+	}
+	if got, want := tr.PausedUntil("phone"), now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("PausedUntil() = %v, want %v", got, want)
+	}
+	if stats := tr.Stats(); stats.Paused != 1 || stats.Unreachable != 1 {
+		t.Errorf("Stats() = %+v, want one paused and unreachable", stats)
+	}
+
+	// A failed probe extends the pause without reporting again
+	*now = now.Add(time.Hour)
+	if !tr.PausedUntil("phone").IsZero() {
+		t.Error("pause didn't end")
+	}
+	if tr.Record("phone", "bob@oc", false) {
+		t.Error("failed probe reported the endpoint unreachable again")
+	}
+	if tr.PausedUntil("phone").IsZero() {
+		t.Error("failed probe didn't pause the endpoint")
+	}
+
+	// A success ends the pause, and the next pause is reported
+	tr.Record("phone", "bob@oc", true)
+	if !tr.PausedUntil("phone").IsZero() {
+		t.Error("success didn't end the pause")
+	}
+	var reported bool
+	for range 20 {
+		reported = tr.Record("phone", "bob@oc", false) || reported
+	}
+	if !reported {
+		t.Error("pause after recovery not reported")
+	}
+}
+
+func TestRecord_Evict(t *testing.T) {
+	tr, now := newTestTracker(t, Config{MaxEndpoints: 3})
+
+	for _, token := range []string{"a", "b", "c", "d"} {
+		*now = now.Add(time.Minute)
+		tr.Record(token, "", true)
+	}
+	if got := tr.Stats().Tracked; got != 3 {
+		t.Errorf("tracked = %d, want 3", got)
+	}
+	for _, e := range tr.List("", 1, 0) {
+		if e.FcmToken == "a" {
+			t.Error("least recently sent endpoint kept")
+		}
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, cfg := range []Config{{PauseBelow: 1.5}, {PauseFor: -time.Hour}} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) succeeded, want error", cfg)
+		}
+	}
+}
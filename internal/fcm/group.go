@@ -0,0 +1,317 @@
+package fcm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// groupEndpoint is FCM's device group management API. The HTTP v1 API
+// sends to groups but can't manage them.
+const groupEndpoint = "https://fcm.googleapis.com/fcm/notification"
+
+// messagingScope authorizes FCM requests made as the service account.
+const messagingScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// errGroupExists is returned by a create operation for a key name that
+// already has a group.
+var errGroupExists = errors.New("device group already exists")
+
+// maxGroupMembers is FCM's limit on devices in one group.
+const maxGroupMembers = 20
+
+// defaultMinDevices is used when GroupConfig.MinDevices is zero.
+const defaultMinDevices = 2
+
+// GroupStore persists device groups.
+// store.Store implements this interface.
+type GroupStore interface {
+	GetDeviceGroup(ctx context.Context, username string) (*store.DeviceGroup, error)
+	SaveDeviceGroup(ctx context.Context, username string, group store.DeviceGroup) error
+}
+
+// GroupConfig holds device group manager configuration.
+type GroupConfig struct {
+	CredentialsFile string
+	// CredentialsJSON is used instead of CredentialsFile when set.
+	CredentialsJSON string
+	// SenderID is the Firebase project number, which group management
+	// requests must name.
+	SenderID string
+	// Endpoint overrides the group management endpoint (for testing only).
+	Endpoint string
+	// MinDevices is the fewest endpoints a user needs before their pushes go
+	// to a device group. Defaults to 2.
+	MinDevices int
+	// Transport carries group management requests, e.g. through a proxy.
+	// Nil uses the default transport.
+	Transport http.RoundTripper
+}
+
+// GroupManager keeps an FCM device group per user whose members are the
+// user's endpoints, so a flush reaches all of them with one send.
+type GroupManager struct {
+	client     *http.Client
+	endpoint   string
+	senderID   string
+	minDevices int
+	store      GroupStore
+
+	mu    sync.Mutex
+	locks map[string]*groupLock // per-user locks, held while a group changes
+}
+
+// groupLock serializes changes to one user's group.
+type groupLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// NewGroupManager creates a GroupManager authenticating as the service
+// account in cfg.CredentialsJSON or cfg.CredentialsFile.
+func NewGroupManager(ctx context.Context, cfg GroupConfig, s GroupStore) (*GroupManager, error) {
+	if cfg.SenderID == "" {
+		return nil, errors.New("device groups require the firebase sender ID")
+	}
+	creds, err := credentials(cfg.CredentialsFile, cfg.CredentialsJSON)
+	if err != nil {
+		return nil, err
+	}
+	client, err := authorizedClient(ctx, creds, cfg.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("creating device group client: %w", err)
+	}
+	return newGroupManager(client, cfg, s), nil
+}
+
+func newGroupManager(client *http.Client, cfg GroupConfig, s GroupStore) *GroupManager {
+	m := &GroupManager{
+		client:     client,
+		endpoint:   cfg.Endpoint,
+		senderID:   cfg.SenderID,
+		minDevices: cfg.MinDevices,
+		store:      s,
+		locks:      make(map[string]*groupLock),
+	}
+	if m.endpoint == "" {
+		m.endpoint = groupEndpoint
+	}
+	if m.minDevices <= 0 {
+		m.minDevices = defaultMinDevices
+	}
+	return m
+}
+
+// Group returns the notification key of username's device group, creating
+// the group or changing its members so it holds exactly fcmTokens. It
+// returns "" when there are too few tokens to be worth grouping, or more
+// than a group can hold; the caller then sends to each token.
+func (m *GroupManager) Group(ctx context.Context, username string, fcmTokens []string) (string, error) {
+	tokens := slices.Clone(fcmTokens)
+	slices.Sort(tokens)
+	tokens = slices.Compact(tokens)
+	if len(tokens) < m.minDevices || len(tokens) > maxGroupMembers {
+		return "", nil
+	}
+
+	unlock := m.lock(username)
+	defer unlock()
+
+	group, err := m.store.GetDeviceGroup(ctx, username)
+	if err != nil {
+		return "", fmt.Errorf("loading device group: %w", err)
+	}
+
+	switch {
+	case group == nil:
+		key, err := m.create(ctx, username, tokens)
+		if err != nil {
+			return "", err
+		}
+		group = &store.DeviceGroup{NotificationKey: key}
+	case slices.Equal(group.Members, tokens):
+		return group.NotificationKey, nil
+	default:
+		if err := m.update(ctx, username, group, tokens); err != nil {
+			return "", err
+		}
+	}
+
+	group.Members = tokens
+	group.UpdatedAt = time.Now()
+	if err := m.store.SaveDeviceGroup(ctx, username, *group); err != nil {
+		// The group is correct in FCM; the next push repeats the update
+		log.Printf("WARNING: failed to save device group: %v%s", err, logfield.Format(logfield.User("user", username)))
+	}
+	return group.NotificationKey, nil
+}
+
+// create creates username's group holding tokens and returns its key. A
+// group left by an earlier database is reused, with tokens added to it.
+func (m *GroupManager) create(ctx context.Context, username string, tokens []string) (string, error) {
+	key, err := m.modify(ctx, "create", username, "", tokens)
+	if err == nil {
+		log.Printf("INFO: created device group%s", logfield.Format(logfield.User("user", username), logfield.Count("devices", len(tokens))))
+		return key, nil
+	}
+	if !errors.Is(err, errGroupExists) {
+		return "", err
+	}
+
+	key, err = m.lookup(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	if _, err := m.modify(ctx, "add", username, key, tokens); err != nil {
+		return "", err
+	}
+	log.Printf("WARNING: reusing existing device group; members it had before can't be listed and stay in it%s", logfield.Format(logfield.User("user", username)))
+	return key, nil
+}
+
+// update adds and removes members so group holds tokens. When every member
+// changes, tokens are added first, since removing a group's last member
+// deletes it; otherwise members are removed first, to stay within
+// maxGroupMembers.
+func (m *GroupManager) update(ctx context.Context, username string, group *store.DeviceGroup, tokens []string) error {
+	var add, remove []string
+	for _, t := range tokens {
+		if !slices.Contains(group.Members, t) {
+			add = append(add, t)
+		}
+	}
+	for _, t := range group.Members {
+		if !slices.Contains(tokens, t) {
+			remove = append(remove, t)
+		}
+	}
+
+	ops := []struct {
+		operation string
+		tokens    []string
+	}{{"remove", remove}, {"add", add}}
+	if len(remove) == len(group.Members) {
+		ops[0], ops[1] = ops[1], ops[0]
+	}
+	for _, op := range ops {
+		if len(op.tokens) == 0 {
+			continue
+		}
+		if _, err := m.modify(ctx, op.operation, username, group.NotificationKey, op.tokens); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupRequest is the body of a group management request.
+type groupRequest struct {
+	Operation       string   `json:"operation"`
+	KeyName         string   `json:"notification_key_name"`
+	Key             string   `json:"notification_key,omitempty"`
+	RegistrationIDs []string `json:"registration_ids"`
+}
+
+// groupResponse is the body FCM returns for group management requests.
+type groupResponse struct {
+	Key   string `json:"notification_key"`
+	Error string `json:"error"`
+}
+
+// keyName returns the notification key name of username's group.
+func keyName(username string) string {
+	return "ourcloud-" + username
+}
+
+// modify runs a create, add, or remove operation on username's group and
+// returns the group's key.
+func (m *GroupManager) modify(ctx context.Context, operation, username, key string, tokens []string) (string, error) {
+	body, err := json.Marshal(&groupRequest{
+		Operation:       operation,
+		KeyName:         keyName(username),
+		Key:             key,
+		RegistrationIDs: tokens,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("building device group request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return m.do(req, operation)
+}
+
+// lookup returns the key of username's existing group.
+func (m *GroupManager) lookup(ctx context.Context, username string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.endpoint+"?notification_key_name="+url.QueryEscape(keyName(username)), nil)
+	if err != nil {
+		return "", fmt.Errorf("building device group request: %w", err)
+	}
+	return m.do(req, "lookup")
+}
+
+// do sends a group management request and returns the key in the response.
+func (m *GroupManager) do(req *http.Request, operation string) (string, error) {
+	req.Header.Set("project_id", m.senderID)
+	req.Header.Set("access_token_auth", "true")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("device group %s: %w", operation, err)
+	}
+	defer resp.Body.Close()
+
+	var result groupResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("device group %s: decoding response: %w", operation, err)
+	}
+	if resp.StatusCode != http.StatusOK || result.Key == "" {
+		if strings.Contains(result.Error, "already exists") {
+			return "", fmt.Errorf("device group %s: %w (%s)", operation, errGroupExists, result.Error)
+		}
+		if result.Error != "" {
+			return "", fmt.Errorf("device group %s: %s", operation, result.Error)
+		}
+		return "", fmt.Errorf("device group %s: FCM returned %s", operation, resp.Status)
+	}
+	return result.Key, nil
+}
+
+// lock takes username's group lock, returning the function that releases it.
+func (m *GroupManager) lock(username string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[username]
+	if !ok {
+		l = &groupLock{}
+		m.locks[username] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, username)
+		}
+		m.mu.Unlock()
+	}
+}
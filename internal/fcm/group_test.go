@@ -0,0 +1,175 @@
+package fcm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// memGroupStore keeps device groups in memory.
+type memGroupStore struct {
+	groups map[string]store.DeviceGroup
+}
+
+func (s *memGroupStore) GetDeviceGroup(ctx context.Context, username string) (*store.DeviceGroup, error) {
+	group, ok := s.groups[username]
+	if !ok {
+		return nil, nil
+	}
+	return &group, nil
+}
+
+func (s *memGroupStore) SaveDeviceGroup(ctx context.Context, username string, group store.DeviceGroup) error {
+	s.groups[username] = group
+	return nil
+}
+
+// fakeGroupAPI implements FCM's device group management API, recording the
+// operations it receives.
+type fakeGroupAPI struct {
+	mu      sync.Mutex
+	members map[string][]string // by notification key name
+	ops     []string
+}
+
+func (f *fakeGroupAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("project_id") != "123" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(&groupResponse{Error: "missing project_id"})
+		return
+	}
+	if r.Method == http.MethodGet {
+		name := r.URL.Query().Get("notification_key_name")
+		f.ops = append(f.ops, "lookup")
+		if _, ok := f.members[name]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&groupResponse{Error: "notification_key not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(&groupResponse{Key: "key-" + name})
+		return
+	}
+
+	var req groupRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	f.ops = append(f.ops, req.Operation)
+	switch req.Operation {
+	case "create":
+		if _, ok := f.members[req.KeyName]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&groupResponse{Error: "notification_key already exists"})
+			return
+		}
+		f.members[req.KeyName] = req.RegistrationIDs
+	case "add":
+		f.members[req.KeyName] = append(f.members[req.KeyName], req.RegistrationIDs...)
+	case "remove":
+		f.members[req.KeyName] = slices.DeleteFunc(f.members[req.KeyName], func(t string) bool {
+			return slices.Contains(req.RegistrationIDs, t)
+		})
+	}
+	json.NewEncoder(w).Encode(&groupResponse{Key: "key-" + req.KeyName})
+}
+
+func (f *fakeGroupAPI) takeOps() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ops := f.ops
+	f.ops = nil
+	return ops
+}
+
+func TestGroupManager_Group(t *testing.T) {
+	api := &fakeGroupAPI{members: make(map[string][]string)}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	st := &memGroupStore{groups: make(map[string]store.DeviceGroup)}
+	m := newGroupManager(srv.Client(), GroupConfig{SenderID: "123", Endpoint: srv.URL}, st)
+	ctx := context.Background()
+
+	steps := []struct {
+		name        string
+		tokens      []string
+		wantKey     string
+		wantOps     []string
+		wantMembers []string
+	}{
+		{name: "one device", tokens: []string{"t1"}, wantKey: ""},
+		{name: "first grouped push", tokens: []string{"t2", "t1"}, wantKey: "key-ourcloud-bob@oc", wantOps: []string{"create"}, wantMembers: []string{"t1", "t2"}},
+		{name: "unchanged", tokens: []string{"t1", "t2"}, wantKey: "key-ourcloud-bob@oc"},
+		{name: "device replaced", tokens: []string{"t1", "t3"}, wantKey: "key-ourcloud-bob@oc", wantOps: []string{"remove", "add"}, wantMembers: []string{"t1", "t3"}},
+		{name: "all devices replaced", tokens: []string{"t4", "t5"}, wantKey: "key-ourcloud-bob@oc", wantOps: []string{"add", "remove"}, wantMembers: []string{"t4", "t5"}},
+	}
+
+	for _, step := range steps {
+		key, err := m.Group(ctx, "bob@oc", step.tokens)
+		if err != nil {
+			t.Fatalf("%s: Group() error = %v", step.name, err)
+		}
+		if key != step.wantKey {
+			t.Errorf("%s: key = %q, want %q", step.name, key, step.wantKey)
+		}
+		if ops := api.takeOps(); !slices.Equal(ops, step.wantOps) {
+			t.Errorf("%s: operations = %v, want %v", step.name, ops, step.wantOps)
+		}
+		if step.wantMembers != nil {
+			members := slices.Sorted(slices.Values(api.members["ourcloud-bob@oc"]))
+			if !slices.Equal(members, step.wantMembers) {
+				t.Errorf("%s: FCM members = %v, want %v", step.name, members, step.wantMembers)
+			}
+			if saved := st.groups["bob@oc"].Members; !slices.Equal(saved, step.wantMembers) {
+				t.Errorf("%s: saved members = %v, want %v", step.name, saved, step.wantMembers)
+			}
+		}
+	}
+}
+
+func TestGroupManager_ReusesExistingGroup(t *testing.T) {
+	// The group exists in FCM but not in this gateway's database
+	api := &fakeGroupAPI{members: map[string][]string{"ourcloud-bob@oc": {"t1"}}}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	st := &memGroupStore{groups: make(map[string]store.DeviceGroup)}
+	m := newGroupManager(srv.Client(), GroupConfig{SenderID: "123", Endpoint: srv.URL}, st)
+
+	key, err := m.Group(context.Background(), "bob@oc", []string{"t1", "t2"})
+	if err != nil {
+		t.Fatalf("Group() error = %v", err)
+	}
+	if key != "key-ourcloud-bob@oc" {
+		t.Errorf("key = %q, want the existing group's", key)
+	}
+	if ops := api.takeOps(); !slices.Equal(ops, []string{"create", "lookup", "add"}) {
+		t.Errorf("operations = %v, want create, lookup, add", ops)
+	}
+	if st.groups["bob@oc"].NotificationKey != key {
+		t.Errorf("saved group = %+v, want key %q", st.groups["bob@oc"], key)
+	}
+}
+
+func TestGroupManager_Errors(t *testing.T) {
+	api := &fakeGroupAPI{members: make(map[string][]string)}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	st := &memGroupStore{groups: make(map[string]store.DeviceGroup)}
+	m := newGroupManager(srv.Client(), GroupConfig{SenderID: "wrong", Endpoint: srv.URL}, st)
+
+	if _, err := m.Group(context.Background(), "bob@oc", []string{"t1", "t2"}); err == nil {
+		t.Fatal("expected an error when FCM rejects the request")
+	}
+	if len(st.groups) != 0 {
+		t.Errorf("expected nothing saved, got %v", st.groups)
+	}
+}
@@ -0,0 +1,45 @@
+package fcm
+
+import (
+	"strings"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+)
+
+// maxLabelLength is FCM's limit on analytics label length.
+const maxLabelLength = 50
+
+// unattributedLabel labels messages that combine several senders.
+const unattributedLabel = "unattributed"
+
+// labeler derives FCM analytics labels from sender usernames.
+type labeler struct {
+	hasher labelhash.Hasher // nil labels with the username itself
+}
+
+// label returns the analytics label for sender. FCM only accepts
+// [a-zA-Z0-9-_.~%]{1,50}, so other characters are replaced with '_'
+// (e.g. "alice@oc" becomes "alice_oc"). With a hasher, the hasher's label
+// for the username is used instead.
+func (l *labeler) label(sender string) string {
+	if sender == "" {
+		return unattributedLabel
+	}
+	if l.hasher != nil {
+		sender = l.hasher.Label(sender)
+	}
+
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '~', r == '%':
+			return r
+		}
+		return '_'
+	}, sender)
+	if len(label) > maxLabelLength {
+		label = label[:maxLabelLength]
+	}
+	return label
+}
@@ -0,0 +1,61 @@
+package fcm
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+)
+
+var validLabel = regexp.MustCompile(`^[a-zA-Z0-9\-_.~%]{1,50}$`)
+
+func TestLabel_Sanitized(t *testing.T) {
+	l := &labeler{}
+
+	tests := []struct {
+		sender string
+		want   string
+	}{
+		{sender: "alice@oc", want: "alice_oc"},
+		{sender: "backup-service.v2@oc", want: "backup-service.v2_oc"},
+		{sender: "üser@oc", want: "_ser_oc"},
+		{sender: "", want: unattributedLabel},
+		{sender: strings.Repeat("a", 60) + "@oc", want: strings.Repeat("a", 50)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sender, func(t *testing.T) {
+			got := l.label(tt.sender)
+			if got != tt.want {
+				t.Errorf("label(%q) = %q, want %q", tt.sender, got, tt.want)
+			}
+			if !validLabel.MatchString(got) {
+				t.Errorf("label(%q) = %q is not a valid FCM analytics label", tt.sender, got)
+			}
+		})
+	}
+}
+
+func TestLabel_Hashed(t *testing.T) {
+	l := &labeler{hasher: labelhash.NewHMAC("secret")}
+
+	got := l.label("alice@oc")
+	if !validLabel.MatchString(got) || len(got) != 32 {
+		t.Errorf("label() = %q, want 32 hex digits", got)
+	}
+	if strings.Contains(got, "alice") {
+		t.Errorf("hashed label %q leaks the username", got)
+	}
+	if l.label("alice@oc") != got {
+		t.Error("expected hashed labels to be stable")
+	}
+	if l.label("bob@oc") == got {
+		t.Error("expected different senders to get different labels")
+	}
+
+	other := &labeler{hasher: labelhash.NewHMAC("other")}
+	if other.label("alice@oc") == got {
+		t.Error("expected the hash key to change the label")
+	}
+}
@@ -0,0 +1,25 @@
+package fcm
+
+import (
+	"log"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/pkg/payload"
+)
+
+// SenderHash returns the hash identifying sender in provenance (see
+// payload.SenderHash).
+func SenderHash(sender string) []byte {
+	return payload.SenderHash(sender)
+}
+
+// appendProvenance appends a data_senders entry to the marshaled
+// DataUpdateNotification payload for each data ID with a known sender. If
+// the result would be too large for FCM, payload is returned unchanged.
+func appendProvenance(raw []byte, dataIDs [][]byte, senders map[string]string) []byte {
+	out, ok := payload.AppendProvenance(raw, dataIDs, senders)
+	if !ok {
+		log.Printf("WARNING: omitting provenance; payload would exceed %d bytes%s", payload.MaxProvenanceSize, logfield.Format(logfield.Count("data_ids", len(dataIDs))))
+	}
+	return out
+}
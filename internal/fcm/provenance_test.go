@@ -0,0 +1,109 @@
+package fcm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// dataSendersField is the DataUpdateNotification field carrying provenance.
+const dataSendersField = 2
+
+// decodeProvenance returns the data_senders entries of a message payload,
+// keyed by data ID, along with the data IDs.
+func decodeProvenance(t *testing.T, payload string) (map[string][]byte, [][]byte) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("decode payload: %v", err)
+	}
+	var notification pb.DataUpdateNotification
+	if err := proto.Unmarshal(raw, &notification); err != nil {
+		t.Fatalf("unmarshal payload: %v", err)
+	}
+
+	senders := make(map[string][]byte)
+	unknown := notification.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 || num != dataSendersField || typ != protowire.BytesType {
+			t.Fatalf("unexpected unknown field %d (type %d)", num, typ)
+		}
+		unknown = unknown[n:]
+		entry, n := protowire.ConsumeBytes(unknown)
+		if n < 0 {
+			t.Fatal("malformed data_senders entry")
+		}
+		unknown = unknown[n:]
+
+		var id, hash []byte
+		for len(entry) > 0 {
+			num, _, n := protowire.ConsumeTag(entry)
+			entry = entry[n:]
+			v, n := protowire.ConsumeBytes(entry)
+			entry = entry[n:]
+			switch num {
+			case 1:
+				id = v
+			case 2:
+				hash = v
+			}
+		}
+		senders[string(id)] = hash
+	}
+	return senders, notification.DataIds
+}
+
+func TestNewMessage_Provenance(t *testing.T) {
+	dataIDs := [][]byte{{0x01}, {0x02}, {0x03}}
+	msg, err := newMessage("test-token", dataIDs, map[string]string{
+		"\x01": "alice@oc",
+		"\x02": "bob@oc",
+	}, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+
+	senders, ids := decodeProvenance(t, msg.Data["payload"])
+	if len(ids) != 3 {
+		t.Errorf("data IDs = %d, want 3", len(ids))
+	}
+	if len(senders) != 2 {
+		t.Fatalf("provenance entries = %d, want 2", len(senders))
+	}
+	if got := senders["\x01"]; !bytes.Equal(got, SenderHash("alice@oc")) {
+		t.Errorf("sender hash for 0x01 = %x, want %x", got, SenderHash("alice@oc"))
+	}
+	if got := senders["\x02"]; !bytes.Equal(got, SenderHash("bob@oc")) {
+		t.Errorf("sender hash for 0x02 = %x, want %x", got, SenderHash("bob@oc"))
+	}
+	if _, ok := senders["\x03"]; ok {
+		t.Error("data ID without a sender should have no provenance entry")
+	}
+}
+
+func TestNewMessage_ProvenanceOmittedWhenTooLarge(t *testing.T) {
+	dataIDs := make([][]byte, 60)
+	senders := make(map[string]string)
+	for i := range dataIDs {
+		dataIDs[i] = make([]byte, 32)
+		dataIDs[i][0] = byte(i)
+		senders[string(dataIDs[i])] = "alice@oc"
+	}
+
+	msg, err := newMessage("test-token", dataIDs, senders, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+	got, ids := decodeProvenance(t, msg.Data["payload"])
+	if len(ids) != 60 {
+		t.Errorf("data IDs = %d, want 60", len(ids))
+	}
+	if len(got) != 0 {
+		t.Errorf("provenance entries = %d, want none for an oversized payload", len(got))
+	}
+}
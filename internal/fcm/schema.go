@@ -0,0 +1,159 @@
+package fcm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/wurp/ourcloud-fcm-push-gateway/pkg/payload"
+)
+
+// DefaultPayloadKey is the data key carrying the base64 payload unless a
+// PayloadSchema names another. The Android app reads it.
+const DefaultPayloadKey = payload.Key
+
+// SchemaVersionKey is the data key carrying the payload schema version,
+// for schemas that set one.
+const SchemaVersionKey = "schema_version"
+
+// PayloadSchema describes how the payload is laid out in the FCM data map.
+type PayloadSchema struct {
+	// MinAppVersion is the oldest app version, in dotted numeric form such
+	// as "2.0", that gets this schema. Empty marks the schema for endpoints
+	// that don't report a version, and older ones than any schema names.
+	MinAppVersion string
+	// Key is the data key carrying the payload. Empty means
+	// DefaultPayloadKey.
+	Key string
+	// Version is written as data["schema_version"]. Zero leaves the key
+	// out, as apps from before schema versions expect.
+	Version int
+}
+
+// legacySchema is the layout apps from before schema versions expect.
+var legacySchema = PayloadSchema{Key: DefaultPayloadKey}
+
+// schemaSet selects the payload schema for an endpoint's app version.
+type schemaSet struct {
+	base      PayloadSchema     // for endpoints matching no versioned schema
+	versioned []versionedSchema // newest MinAppVersion first
+}
+
+// versionedSchema is a schema with its MinAppVersion parsed.
+type versionedSchema struct {
+	min    []int
+	schema PayloadSchema
+}
+
+// newSchemaSet validates schemas and returns a set choosing among them.
+// Without a schema for unversioned endpoints, they get the legacy layout.
+func newSchemaSet(schemas []PayloadSchema) (*schemaSet, error) {
+	set := &schemaSet{base: legacySchema}
+	seen := make(map[string]bool, len(schemas))
+	for _, schema := range schemas {
+		if schema.Key == "" {
+			schema.Key = DefaultPayloadKey
+		}
+		switch {
+		case schema.Key == SealedPayloadKey || schema.Key == SchemaVersionKey:
+			return nil, fmt.Errorf("payload key %q is reserved", schema.Key)
+		case schema.Version < 0:
+			return nil, fmt.Errorf("payload schema version %d is negative", schema.Version)
+		case seen[schema.MinAppVersion]:
+			return nil, fmt.Errorf("two payload schemas for app version %q", schema.MinAppVersion)
+		}
+		seen[schema.MinAppVersion] = true
+
+		if schema.MinAppVersion == "" {
+			set.base = schema
+			continue
+		}
+		oldest, ok := parseAppVersion(schema.MinAppVersion)
+		if !ok {
+			return nil, fmt.Errorf("invalid min app version %q", schema.MinAppVersion)
+		}
+		set.versioned = append(set.versioned, versionedSchema{min: oldest, schema: schema})
+	}
+	sort.Slice(set.versioned, func(i, j int) bool {
+		return compareAppVersions(set.versioned[i].min, set.versioned[j].min) > 0
+	})
+	return set, nil
+}
+
+// forApp returns the schema for an app at appVersion: the one with the
+// newest MinAppVersion it has reached, or the base schema.
+func (s *schemaSet) forApp(appVersion string) PayloadSchema {
+	if s == nil {
+		return legacySchema
+	}
+	version, ok := parseAppVersion(appVersion)
+	if !ok {
+		return s.base
+	}
+	for _, v := range s.versioned {
+		if compareAppVersions(version, v.min) >= 0 {
+			return v.schema
+		}
+	}
+	return s.base
+}
+
+// applySchema moves message's payload from DefaultPayloadKey, where
+// newMessage puts it, to schema's key and adds its version.
+func applySchema(message *messaging.Message, schema PayloadSchema) {
+	if schema.Key != DefaultPayloadKey {
+		message.Data[schema.Key] = message.Data[DefaultPayloadKey]
+		delete(message.Data, DefaultPayloadKey)
+	}
+	if schema.Version > 0 {
+		message.Data[SchemaVersionKey] = strconv.Itoa(schema.Version)
+	}
+}
+
+// parseAppVersion parses a dotted version such as "2.3.1". Each part may
+// carry a suffix after its digits, as in "2.4.0-beta", which is ignored.
+func parseAppVersion(s string) ([]int, bool) {
+	if s == "" {
+		return nil, false
+	}
+	parts := strings.Split(s, ".")
+	version := make([]int, 0, len(parts))
+	for _, part := range parts {
+		digits := len(part) - len(strings.TrimLeft(part, "0123456789"))
+		if digits == 0 {
+			return nil, false
+		}
+		n, err := strconv.Atoi(part[:digits])
+		if err != nil {
+			return nil, false
+		}
+		version = append(version, n)
+		if digits < len(part) {
+			break
+		}
+	}
+	return version, true
+}
+
+// compareAppVersions returns -1, 0 or 1 as a is older than, the same as or
+// newer than b. Missing parts count as zero, so "2" equals "2.0".
+func compareAppVersions(a, b []int) int {
+	for i := 0; i < max(len(a), len(b)); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
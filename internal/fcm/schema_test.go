@@ -0,0 +1,107 @@
+package fcm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchemaSet_ForApp(t *testing.T) {
+	set, err := newSchemaSet([]PayloadSchema{
+		{Key: "payload", Version: 1},
+		{MinAppVersion: "3.0", Key: "update", Version: 3},
+		{MinAppVersion: "2.1", Key: "update", Version: 2},
+	})
+	if err != nil {
+		t.Fatalf("newSchemaSet() error = %v", err)
+	}
+
+	tests := []struct {
+		appVersion string
+		want       int
+	}{
+		{"", 1},        // no version reported
+		{"garbage", 1}, // unparseable
+		{"2.0.9", 1},
+		{"2.1", 2},
+		{"2.1.0-beta", 2},
+		{"2.10", 2},
+		{"3", 3},
+		{"4.2.1", 3},
+	}
+	for _, tt := range tests {
+		if got := set.forApp(tt.appVersion); got.Version != tt.want {
+			t.Errorf("forApp(%q) = schema %d, want %d", tt.appVersion, got.Version, tt.want)
+		}
+	}
+
+	var none *schemaSet
+	if got := none.forApp("2.1"); got != legacySchema {
+		t.Errorf("nil set forApp() = %+v, want the legacy schema", got)
+	}
+}
+
+func TestApplySchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema PayloadSchema
+		want   map[string]string
+	}{
+		{
+			name:   "v0 legacy",
+			schema: legacySchema,
+			want:   map[string]string{"payload": "AQ=="},
+		},
+		{
+			name:   "v1 versioned",
+			schema: PayloadSchema{Key: "payload", Version: 1},
+			want:   map[string]string{"payload": "AQ==", "schema_version": "1"},
+		},
+		{
+			name:   "v2 renamed key",
+			schema: PayloadSchema{Key: "update", Version: 2},
+			want:   map[string]string{"update": "AQ==", "schema_version": "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := newMessage("test-token", [][]byte{{0x01}}, nil, 0)
+			if err != nil {
+				t.Fatalf("newMessage() error = %v", err)
+			}
+			// newMessage's payload, for a comparable want
+			msg.Data[DefaultPayloadKey] = "AQ=="
+
+			applySchema(msg, tt.schema)
+			if !reflect.DeepEqual(msg.Data, tt.want) {
+				t.Errorf("Data = %v, want %v", msg.Data, tt.want)
+			}
+
+			// Sealing replaces the payload wherever the schema put it
+			if err := seal(msg, make([]byte, cryptKeySize), tt.schema.Key); err != nil {
+				t.Fatalf("seal() error = %v", err)
+			}
+			if _, ok := msg.Data[tt.schema.Key]; ok || msg.Data[SealedPayloadKey] == "" {
+				t.Errorf("Data after seal = %v, want %s replaced by %s", msg.Data, tt.schema.Key, SealedPayloadKey)
+			}
+		})
+	}
+}
+
+func TestNewSchemaSet_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemas []PayloadSchema
+	}{
+		{"reserved key", []PayloadSchema{{Key: SchemaVersionKey}}},
+		{"sealed key", []PayloadSchema{{MinAppVersion: "2", Key: SealedPayloadKey}}},
+		{"negative version", []PayloadSchema{{Version: -1}}},
+		{"bad app version", []PayloadSchema{{MinAppVersion: "v2"}}},
+		{"duplicate app version", []PayloadSchema{{MinAppVersion: "2"}, {MinAppVersion: "2"}}},
+		{"two base schemas", []PayloadSchema{{Version: 1}, {Version: 2}}},
+	}
+	for _, tt := range tests {
+		if _, err := newSchemaSet(tt.schemas); err == nil {
+			t.Errorf("%s: newSchemaSet() succeeded, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package fcm
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/wurp/ourcloud-fcm-push-gateway/pkg/payload"
+)
+
+// SealedPayloadKey is the data key carrying the payload sealed to the
+// recipient's public crypt key. It replaces the payload key, so apps can
+// tell the two apart.
+const SealedPayloadKey = payload.SealedKey
+
+// cryptKeySize is the size of an X25519 public key.
+const cryptKeySize = payload.CryptKeySize
+
+// seal replaces message's payload, in payloadKey, with a NaCl sealed box for
+// key, the recipient's X25519 public crypt key. This is libsodium's crypto_box_seal,
+// so the app opens it with crypto_box_seal_open and its private key, or
+// payload.Open. Sealing adds 48 bytes: an ephemeral public key and a MAC.
+func seal(message *messaging.Message, key []byte, payloadKey string) error {
+	raw, err := base64.StdEncoding.DecodeString(message.Data[payloadKey])
+	if err != nil {
+		return fmt.Errorf("decoding payload: %w", err)
+	}
+
+	sealed, err := payload.Seal(raw, key)
+	if err != nil {
+		return err
+	}
+	delete(message.Data, payloadKey)
+	message.Data[SealedPayloadKey] = sealed
+	return nil
+}
@@ -0,0 +1,60 @@
+package fcm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSeal(t *testing.T) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	dataIDs := [][]byte{{0x01, 0x02}, {0x03}}
+	msg, err := newMessage("test-token", dataIDs, nil, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+
+	if err := seal(msg, publicKey[:], DefaultPayloadKey); err != nil {
+		t.Fatalf("seal() error = %v", err)
+	}
+	if _, ok := msg.Data["payload"]; ok {
+		t.Error("plain payload still present after sealing")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(msg.Data[SealedPayloadKey])
+	if err != nil {
+		t.Fatalf("decoding %s: %v", SealedPayloadKey, err)
+	}
+	opened, ok := box.OpenAnonymous(nil, sealed, publicKey, privateKey)
+	if !ok {
+		t.Fatal("recipient can't open the sealed payload")
+	}
+	var notification pb.DataUpdateNotification
+	if err := proto.Unmarshal(opened, &notification); err != nil {
+		t.Fatalf("unmarshaling opened payload: %v", err)
+	}
+	if len(notification.DataIds) != 2 || !bytes.Equal(notification.DataIds[0], dataIDs[0]) {
+		t.Errorf("DataIds = %x, want %x", notification.DataIds, dataIDs)
+	}
+}
+
+func TestSeal_InvalidKey(t *testing.T) {
+	msg, err := newMessage("test-token", [][]byte{{0x01}}, nil, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+	if err := seal(msg, []byte("short"), DefaultPayloadKey); err == nil {
+		t.Error("seal() accepted a 5-byte key")
+	}
+	if msg.Data["payload"] == "" {
+		t.Error("payload removed despite the error")
+	}
+}
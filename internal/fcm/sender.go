@@ -7,40 +7,317 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/messaging"
-	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/pkg/payload"
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/option"
-	"google.golang.org/protobuf/proto"
+	htransport "google.golang.org/api/transport/http"
 )
 
 // Config holds FCM sender configuration.
 type Config struct {
 	CredentialsFile string
+	// CredentialsJSON is the service account JSON, used instead of
+	// CredentialsFile when set.
+	CredentialsJSON string
 	ProjectID       string
 	// Endpoint overrides the FCM API endpoint (for testing only).
 	// If empty, the default FCM endpoint is used.
 	Endpoint string
+	// QPS limits sends per second for the project. Zero disables rate limiting.
+	QPS float64
+	// Burst is the number of sends allowed above QPS in a short burst.
+	// Defaults to QPS (minimum 1) when rate limiting is enabled.
+	Burst int
+	// ChannelID is the Android notification channel for visible notifications.
+	ChannelID string
+	// AnalyticsLabels attaches an analytics label derived from the sender
+	// username to each message, for per-sender delivery reporting in Firebase.
+	AnalyticsLabels bool
+	// LabelHasher, when set, replaces sender usernames in analytics labels
+	// with its labels, such as a keyed hash, so Firebase never sees who sent
+	// a push.
+	LabelHasher labelhash.Hasher
+	// Provenance adds each data ID's sender, as a SenderHash, to the
+	// DataUpdateNotification, so the receiving app can prioritize syncs.
+	Provenance bool
+	// Transport carries requests to Firebase, including those for access
+	// tokens, e.g. through a proxy. Nil uses the SDK's default.
+	Transport http.RoundTripper
+	// Usage, when set, counts messages sent against the project's budget
+	// and may refuse sends past it.
+	Usage UsageMeter
+	// PayloadSchemas lays out the payload in the data map by the app
+	// version endpoints report in EndpointAppVersion. Without a schema for
+	// endpoints reporting none, they get the payload in DefaultPayloadKey
+	// and no schema version.
+	PayloadSchemas []PayloadSchema
 }
 
+// UsageMeter accounts for messages sent per Firebase project. Allow is
+// asked before each message send and may refuse it, typically with
+// *RateLimitedError; Record is told of each message FCM accepted. Dry-run
+// sends are neither checked nor counted.
+type UsageMeter interface {
+	Allow(projectID string) error
+	Record(projectID string)
+}
+
+// defaultProject names the project in usage accounting when Config.ProjectID
+// is empty and the project is taken from the credentials.
+const defaultProject = "default"
+
+// SendOptions holds optional per-message settings for Send. It is defined
+// by the batcher, which sends through this package.
+type SendOptions = batcher.SendOptions
+
+// Endpoint option keys honored by Send. Unknown keys and invalid values are
+// ignored, so endpoint lists can carry options for other providers.
+const (
+	EndpointChannelID    = "channel_id"     // Android channel for visible notifications, overriding the configured one
+	EndpointSound        = "sound"          // sound for visible notifications on Android, e.g. "default"
+	EndpointPriority     = "priority"       // Android delivery priority: "high" (the default) or "normal"
+	EndpointAPNSPushType = "apns_push_type" // iOS push type: "alert" or "background"
+	EndpointAppVersion   = "app_version"    // app version, e.g. "2.3.1", selecting the PayloadSchema
+)
+
 // Sender sends notifications to devices via Firebase Cloud Messaging.
 type Sender struct {
-	client *messaging.Client
+	clientMu sync.RWMutex
+	client   *messaging.Client // replaced by Reconnect
+	cfg      Config
+
+	limiter   *rate.Limiter
+	channelID string
+	labels    *labeler // nil when analytics labels are disabled
+
+	provenance bool
+
+	projectID string
+	usage     UsageMeter // nil when usage isn't accounted
+	schemas   *schemaSet
+}
+
+// RateLimitedError is returned by Send when the project's QPS budget is exhausted.
+// The caller should retry after RetryAfter instead of treating the send as failed.
+type RateLimitedError struct {
+	Delay time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("FCM rate limit reached, retry in %s", e.Delay)
+}
+
+// RetryAfter returns how long to wait before the send can proceed.
+func (e *RateLimitedError) RetryAfter() time.Duration {
+	return e.Delay
+}
+
+// ErrUnregistered matches an *InvalidTokenError with errors.Is.
+var ErrUnregistered = errors.New("FCM token unregistered")
+
+// InvalidTokenError is returned by Send when FCM reports the token is no
+// longer registered. Retrying the same token will not succeed.
+type InvalidTokenError struct {
+	Err error
+}
+
+func (e *InvalidTokenError) Error() string {
+	return fmt.Sprintf("FCM token no longer registered: %v", e.Err)
+}
+
+func (e *InvalidTokenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrUnregistered.
+func (e *InvalidTokenError) Is(target error) bool {
+	return target == ErrUnregistered
+}
+
+// InvalidToken marks the error as a permanently invalid token.
+func (e *InvalidTokenError) InvalidToken() bool {
+	return true
+}
+
+// ErrorCode returns the FCM error code, UNREGISTERED.
+func (e *InvalidTokenError) ErrorCode() string {
+	return errorUnregistered
+}
+
+// SendError is returned by Send when FCM rejects a message with a
+// structured error code.
+type SendError struct {
+	Code string // FCM error code, e.g. QUOTA_EXCEEDED
+	Err  error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("FCM send failed (%s): %v", e.Code, e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the FCM error code.
+func (e *SendError) ErrorCode() string {
+	return e.Code
+}
+
+// FCM error codes, as documented for the HTTP v1 API.
+const (
+	errorUnregistered        = "UNREGISTERED"
+	errorInvalidArgument     = "INVALID_ARGUMENT"
+	errorSenderIDMismatch    = "SENDER_ID_MISMATCH"
+	errorQuotaExceeded       = "QUOTA_EXCEEDED"
+	errorThirdPartyAuthError = "THIRD_PARTY_AUTH_ERROR"
+	errorUnavailable         = "UNAVAILABLE"
+	errorInternal            = "INTERNAL"
+)
+
+// errorCodes maps the messaging package's error checks to FCM error codes.
+var errorCodes = []struct {
+	code  string
+	match func(error) bool
+}{
+	{errorUnregistered, messaging.IsUnregistered},
+	{errorInvalidArgument, messaging.IsInvalidArgument},
+	{errorSenderIDMismatch, messaging.IsSenderIDMismatch},
+	{errorQuotaExceeded, messaging.IsQuotaExceeded},
+	{errorThirdPartyAuthError, messaging.IsThirdPartyAuthError},
+	{errorUnavailable, messaging.IsUnavailable},
+	{errorInternal, messaging.IsInternal},
+}
+
+// errorCode returns the FCM error code for an error from the messaging
+// client, or "" if FCM didn't report one (e.g. a network error).
+func errorCode(err error) string {
+	for _, c := range errorCodes {
+		if c.match(err) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// projectLimiters holds one token bucket per Firebase project so that all
+// senders for the same project share its QPS budget.
+var (
+	projectLimitersMu sync.Mutex
+	projectLimiters   = make(map[string]*rate.Limiter)
+)
+
+// limiterFor returns the shared limiter for a project, creating it if needed.
+// Returns nil when rate limiting is disabled.
+func limiterFor(projectID string, qps float64, burst int) *rate.Limiter {
+	if qps <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = max(1, int(qps))
+	}
+
+	projectLimitersMu.Lock()
+	defer projectLimitersMu.Unlock()
+
+	limiter, ok := projectLimiters[projectID]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(qps), burst)
+		projectLimiters[projectID] = limiter
+	}
+	return limiter
+}
+
+// credentials returns the client option authenticating as the Firebase
+// service account, given inline as JSON or as a file.
+func credentials(file, json string) (option.ClientOption, error) {
+	switch {
+	case json != "":
+		return option.WithCredentialsJSON([]byte(json)), nil
+	case file != "":
+		return option.WithCredentialsFile(file), nil
+	default:
+		return nil, errors.New("firebase credentials file is required")
+	}
+}
+
+// authorizedClient returns an HTTP client authenticating as creds, whose
+// requests go through base. Nil base uses the default transport.
+func authorizedClient(ctx context.Context, creds option.ClientOption, base http.RoundTripper) (*http.Client, error) {
+	if base == nil {
+		client, _, err := htransport.NewClient(ctx, creds, option.WithScopes(messagingScope))
+		return client, err
+	}
+	// The token source fetches access tokens with the context's client
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: base})
+	transport, err := htransport.NewTransport(ctx, base, creds, option.WithScopes(messagingScope))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
 }
 
 // New creates a new FCM Sender.
-// The credentials file should be a Firebase service account JSON file.
+// The credentials should be a Firebase service account JSON file, or its
+// contents.
 func New(ctx context.Context, cfg Config) (*Sender, error) {
-	if cfg.CredentialsFile == "" {
-		return nil, errors.New("firebase credentials file is required")
+	schemas, err := newSchemaSet(cfg.PayloadSchemas)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newMessagingClient(ctx, cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	var opts []option.ClientOption
-	opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	sender := &Sender{
+		client:    client,
+		cfg:       cfg,
+		limiter:   limiterFor(cfg.ProjectID, cfg.QPS, cfg.Burst),
+		channelID: cfg.ChannelID,
+	}
+	if cfg.AnalyticsLabels {
+		sender.labels = &labeler{hasher: cfg.LabelHasher}
+	}
+	sender.provenance = cfg.Provenance
+	sender.projectID = cfg.ProjectID
+	if sender.projectID == "" {
+		sender.projectID = defaultProject
+	}
+	sender.usage = cfg.Usage
+	sender.schemas = schemas
+	return sender, nil
+}
+
+// newMessagingClient creates a messaging client authenticating with cfg's
+// credentials.
+func newMessagingClient(ctx context.Context, cfg Config) (*messaging.Client, error) {
+	creds, err := credentials(cfg.CredentialsFile, cfg.CredentialsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []option.ClientOption{creds}
 	if cfg.Endpoint != "" {
 		opts = append(opts, option.WithEndpoint(cfg.Endpoint))
 	}
+	if cfg.Transport != nil {
+		client, err := authorizedClient(ctx, creds, cfg.Transport)
+		if err != nil {
+			return nil, fmt.Errorf("creating messaging transport: %w", err)
+		}
+		opts = append(opts, option.WithHTTPClient(client))
+	}
 
 	firebaseConfig := &firebase.Config{}
 	if cfg.ProjectID != "" {
@@ -56,24 +333,145 @@ func New(ctx context.Context, cfg Config) (*Sender, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getting messaging client: %w", err)
 	}
+	return client, nil
+}
+
+// Reconnect replaces the messaging client with one built afresh from the
+// Config, rereading the credentials file, e.g. after the service account
+// key was rotated. Sends in flight finish on the old client.
+func (s *Sender) Reconnect(ctx context.Context) error {
+	client, err := newMessagingClient(ctx, s.cfg)
+	if err != nil {
+		return err
+	}
+	s.clientMu.Lock()
+	s.client = client
+	s.clientMu.Unlock()
+	return nil
+}
 
-	return &Sender{client: client}, nil
+// messaging returns the current messaging client.
+func (s *Sender) messaging() *messaging.Client {
+	s.clientMu.RLock()
+	defer s.clientMu.RUnlock()
+	return s.client
 }
 
 // Send sends a data-only push notification to the specified FCM token.
 // The dataIDs are encoded as a protobuf DataUpdateNotification, then base64-encoded
-// and placed in the data payload.
+// and placed in the data payload. opts can add a TTL, an OS-rendered
+// notification, extra data keys, and an analytics label, and can seal the
+// payload to the recipient. Returns the FCM message ID.
+//
+// Errors FCM reports with a code are returned as *SendError, or
+// *InvalidTokenError for UNREGISTERED.
 //
 // This implements the batcher.Sender interface.
-func (s *Sender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte) error {
-	// Construct the protobuf payload
-	notification := &pb.DataUpdateNotification{
-		DataIds: dataIDs,
+func (s *Sender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	if err := s.allowUsage(); err != nil {
+		return "", err
+	}
+	if err := s.acquire(); err != nil {
+		return "", err
 	}
 
-	payloadBytes, err := proto.Marshal(notification)
+	var senders map[string]string
+	if s.provenance {
+		senders = opts.DataSenders
+	}
+	message, err := newMessage(fcmToken, dataIDs, senders, opts.TTL)
 	if err != nil {
-		return fmt.Errorf("marshaling notification: %w", err)
+		return "", err
+	}
+	schema := s.schemas.forApp(opts.Endpoint[EndpointAppVersion])
+	applySchema(message, schema)
+	addData(message, opts.Data)
+	if opts.CryptKey != nil {
+		if err := seal(message, opts.CryptKey, schema.Key); err != nil {
+			return "", err
+		}
+	}
+	if opts.Title != "" || opts.Body != "" {
+		addVisible(message, opts.Title, opts.Body, s.channelID)
+	}
+	applyEndpointOptions(message, opts.Endpoint)
+	if s.labels != nil {
+		message.FCMOptions = &messaging.FCMOptions{
+			AnalyticsLabel: s.labels.label(opts.Sender),
+		}
+	}
+
+	return s.send(ctx, message, opts.Sender, len(dataIDs))
+}
+
+// SendVisible sends like Send, attaching opts.Title and opts.Body as an
+// OS-rendered notification.
+//
+// This implements the batcher.VisibleSender interface.
+func (s *Sender) SendVisible(ctx context.Context, fcmToken string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	return s.Send(ctx, fcmToken, dataIDs, opts)
+}
+
+// send delivers a constructed message and logs the outcome.
+func (s *Sender) send(ctx context.Context, message *messaging.Message, sender string, dataIDCount int) (string, error) {
+	fcmToken := message.Token
+
+	start := time.Now()
+	messageID, err := s.messaging().Send(ctx, message)
+	if err != nil {
+		s.handleError(ctx, fcmToken, err)
+		return "", sendError(err)
+	}
+	s.recordUsage()
+
+	log.Printf("INFO: sent FCM message %s to token %s%s", messageID, truncateToken(fcmToken), logfield.Format(
+		logfield.User("sender", sender),
+		logfield.Count("data_ids", dataIDCount),
+		logfield.Duration("took", time.Since(start)),
+		logfield.Trace(ctx),
+	))
+	return messageID, nil
+}
+
+// Validate asks FCM whether fcmToken is still registered, with a dry-run
+// send of an empty notification that no device receives. It returns
+// *InvalidTokenError if the token is no longer registered. Like Send, it
+// takes from the project's QPS budget and returns *RateLimitedError when
+// that is exhausted.
+func (s *Sender) Validate(ctx context.Context, fcmToken string) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	message, err := newMessage(fcmToken, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := s.messaging().SendDryRun(ctx, message); err != nil {
+		return sendError(err)
+	}
+	return nil
+}
+
+// sendError wraps an error from the messaging client in *SendError, or
+// *InvalidTokenError for UNREGISTERED, if FCM reported an error code.
+func sendError(err error) error {
+	switch code := errorCode(err); code {
+	case "":
+		return err
+	case errorUnregistered:
+		return &InvalidTokenError{Err: err}
+	default:
+		return &SendError{Code: code, Err: err}
+	}
+}
+
+// newMessage builds the FCM data message carrying dataIDs for fcmToken.
+// senders, when set, attributes data IDs to their senders (see
+// appendProvenance).
+func newMessage(fcmToken string, dataIDs [][]byte, senders map[string]string, ttl time.Duration) (*messaging.Message, error) {
+	payloadBytes, err := EncodePayload(dataIDs, senders)
+	if err != nil {
+		return nil, err
 	}
 
 	// Base64-encode the protobuf
@@ -83,42 +481,141 @@ func (s *Sender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte) er
 	message := &messaging.Message{
 		Token: fcmToken,
 		Data: map[string]string{
-			"payload": payloadB64,
+			DefaultPayloadKey: payloadB64,
 		},
 		Android: &messaging.AndroidConfig{
 			Priority: "high",
 		},
 	}
+	if ttl > 0 {
+		message.Android.TTL = &ttl
+	}
 
-	// Send the message
-	messageID, err := s.client.Send(ctx, message)
+	return message, nil
+}
+
+// EncodePayload returns the DataUpdateNotification carrying dataIDs, as sent
+// base64-encoded in the "payload" data key. senders, when set, attributes
+// data IDs to their senders (see appendProvenance).
+func EncodePayload(dataIDs [][]byte, senders map[string]string) ([]byte, error) {
+	raw, err := payload.Marshal(dataIDs)
 	if err != nil {
-		s.handleError(fcmToken, err)
-		return err
+		return nil, err
+	}
+	if len(senders) > 0 {
+		raw = appendProvenance(raw, dataIDs, senders)
+	}
+	return raw, nil
+}
+
+// addData adds extra keys to message's data payload, keeping keys already set.
+func addData(message *messaging.Message, data map[string]string) {
+	for k, v := range data {
+		if _, taken := message.Data[k]; !taken {
+			message.Data[k] = v
+		}
+	}
+}
+
+// addVisible adds a display notification to message, posted to channelID on Android.
+func addVisible(message *messaging.Message, title, body, channelID string) {
+	message.Notification = &messaging.Notification{
+		Title: title,
+		Body:  body,
+	}
+	if channelID != "" {
+		message.Android.Notification = &messaging.AndroidNotification{
+			ChannelID: channelID,
+		}
+	}
+}
+
+// applyEndpointOptions adjusts message to the Endpoint* options. Channel and
+// sound only affect visible notifications.
+func applyEndpointOptions(message *messaging.Message, options map[string]string) {
+	if p := options[EndpointPriority]; p == "high" || p == "normal" {
+		message.Android.Priority = p
 	}
 
-	log.Printf("INFO: sent FCM message %s to token %s (%d data IDs)", messageID, truncateToken(fcmToken), len(dataIDs))
+	switch options[EndpointAPNSPushType] {
+	case "alert":
+		message.APNS = &messaging.APNSConfig{
+			Headers: map[string]string{"apns-push-type": "alert"},
+		}
+	case "background":
+		// Apple requires low priority and content-available for background pushes
+		message.APNS = &messaging.APNSConfig{
+			Headers: map[string]string{"apns-push-type": "background", "apns-priority": "5"},
+			Payload: &messaging.APNSPayload{Aps: &messaging.Aps{ContentAvailable: true}},
+		}
+	}
+
+	channelID, sound := options[EndpointChannelID], options[EndpointSound]
+	if message.Notification == nil || (channelID == "" && sound == "") {
+		return
+	}
+	if message.Android.Notification == nil {
+		message.Android.Notification = &messaging.AndroidNotification{}
+	}
+	if channelID != "" {
+		message.Android.Notification.ChannelID = channelID
+	}
+	if sound != "" {
+		message.Android.Notification.Sound = sound
+	}
+}
+
+// acquire takes a token from the project's rate limiter.
+// Rather than blocking the caller, it returns a RateLimitedError when no token
+// is available so the flush can be rescheduled.
+func (s *Sender) acquire() error {
+	if s.limiter == nil {
+		return nil
+	}
+
+	r := s.limiter.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		r.Cancel()
+		return &RateLimitedError{Delay: delay}
+	}
 	return nil
 }
 
+// allowUsage asks the usage meter, if any, whether another message may be
+// sent through the project.
+func (s *Sender) allowUsage() error {
+	if s.usage == nil {
+		return nil
+	}
+	return s.usage.Allow(s.projectID)
+}
+
+// recordUsage counts a message FCM accepted.
+func (s *Sender) recordUsage() {
+	if s.usage != nil {
+		s.usage.Record(s.projectID)
+	}
+}
+
 // handleError logs FCM errors with appropriate context.
 // Push is best-effort, so errors are logged but don't propagate beyond the return.
-func (s *Sender) handleError(fcmToken string, err error) {
+func (s *Sender) handleError(ctx context.Context, fcmToken string, err error) {
 	tokenSnippet := truncateToken(fcmToken)
+	trace := logfield.Format(logfield.Trace(ctx))
 
 	// Check for specific FCM error types
 	if messaging.IsUnregistered(err) {
-		log.Printf("WARNING: FCM token %s is no longer valid (NotRegistered)", tokenSnippet)
+		log.Printf("WARNING: FCM token %s is no longer valid (NotRegistered)%s", tokenSnippet, trace)
 		return
 	}
 
 	if messaging.IsInvalidArgument(err) {
-		log.Printf("WARNING: FCM token %s has invalid registration", tokenSnippet)
+		log.Printf("WARNING: FCM token %s has invalid registration%s", tokenSnippet, trace)
 		return
 	}
 
 	// Network or other errors
-	log.Printf("ERROR: FCM send failed for token %s: %v", tokenSnippet, err)
+	log.Printf("ERROR: FCM send failed for token %s: %v%s", tokenSnippet, err, trace)
 }
 
 // truncateToken returns a truncated version of the FCM token for logging.
@@ -2,12 +2,23 @@ package fcm
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"firebase.google.com/go/v4/messaging"
 	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -208,6 +219,187 @@ func TestNew_MissingCredentials(t *testing.T) {
 	}
 }
 
+// recordingTransport records the hosts of the requests it carries.
+type recordingTransport struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.hosts = append(rt.hosts, req.URL.Host)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// serviceAccountJSON returns credentials for a new service account whose
+// tokens are issued by tokenURL.
+func serviceAccountJSON(t *testing.T, tokenURL string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	credentialsJSON, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"project_id":     "test-project",
+		"private_key_id": "test-key",
+		"private_key":    string(keyPEM),
+		"client_email":   "gateway@test-project.iam.gserviceaccount.com",
+		"token_uri":      tokenURL,
+	})
+	return string(credentialsJSON)
+}
+
+func TestNew_Transport(t *testing.T) {
+	// One server plays both the OAuth token endpoint and FCM
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`)
+	})
+	mux.HandleFunc("POST /v1/projects/test-project/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer test-token" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer test-token")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"projects/test-project/messages/1"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	transport := &recordingTransport{}
+	sender, err := New(context.Background(), Config{
+		CredentialsJSON: serviceAccountJSON(t, server.URL+"/token"),
+		ProjectID:       "test-project",
+		Endpoint:        server.URL + "/v1",
+		Transport:       transport,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := sender.Send(context.Background(), "token", [][]byte{[]byte("data")}, SendOptions{}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	// The token request and the send both went through the transport
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if len(transport.hosts) != 2 {
+		t.Errorf("transport carried %d requests, want 2 (token and send)", len(transport.hosts))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`)
+	})
+	mux.HandleFunc("POST /v1/projects/test-project/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ValidateOnly bool `json:"validate_only"`
+			Message      struct {
+				Token string `json:"token"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.ValidateOnly {
+			t.Errorf("send to %s without validate_only", req.Message.Token)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if req.Message.Token == "dead-token" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":404,"message":"Requested entity was not found.","status":"NOT_FOUND",`+
+				`"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"projects/test-project/messages/fake_message_id"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sender, err := New(context.Background(), Config{
+		CredentialsJSON: serviceAccountJSON(t, server.URL+"/token"),
+		ProjectID:       "test-project",
+		Endpoint:        server.URL + "/v1",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := sender.Validate(context.Background(), "live-token"); err != nil {
+		t.Errorf("Validate(live) error = %v", err)
+	}
+	if err := sender.Validate(context.Background(), "dead-token"); !errors.Is(err, ErrUnregistered) {
+		t.Errorf("Validate(dead) error = %v, want ErrUnregistered", err)
+	}
+}
+
+// countingMeter refuses sends once limit messages were recorded.
+type countingMeter struct {
+	limit    int
+	recorded map[string]int
+}
+
+func (m *countingMeter) Allow(projectID string) error {
+	if m.recorded[projectID] >= m.limit {
+		return &RateLimitedError{Delay: time.Minute}
+	}
+	return nil
+}
+
+func (m *countingMeter) Record(projectID string) {
+	m.recorded[projectID]++
+}
+
+func TestSend_UsageMeter(t *testing.T) {
+	sends := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`)
+	})
+	mux.HandleFunc("POST /v1/projects/test-project/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		sends++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name":"projects/test-project/messages/fake_message_id"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	meter := &countingMeter{limit: 1, recorded: make(map[string]int)}
+	sender, err := New(context.Background(), Config{
+		CredentialsJSON: serviceAccountJSON(t, server.URL+"/token"),
+		ProjectID:       "test-project",
+		Endpoint:        server.URL + "/v1",
+		Usage:           meter,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := sender.Send(ctx, "token", [][]byte{{1}}, SendOptions{}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if err := sender.Validate(ctx, "token"); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if meter.recorded["test-project"] != 1 {
+		t.Errorf("recorded %d sends, want 1; dry runs aren't counted", meter.recorded["test-project"])
+	}
+
+	var rateLimited *RateLimitedError
+	if _, err := sender.Send(ctx, "token", [][]byte{{1}}, SendOptions{}); !errors.As(err, &rateLimited) {
+		t.Errorf("Send() past budget error = %v, want *RateLimitedError", err)
+	}
+	if sends != 2 {
+		t.Errorf("FCM got %d requests, want 2: the refused send isn't made", sends)
+	}
+}
+
 func TestSend_MultipleDevices(t *testing.T) {
 	// Test sending to multiple devices sequentially
 	// This tests that the sender can handle multiple distinct FCM tokens
@@ -335,3 +527,199 @@ func TestSend_ContextCancellation(t *testing.T) {
 		t.Error("expected error for cancelled context")
 	}
 }
+
+func TestAcquire_NoLimiter(t *testing.T) {
+	s := &Sender{}
+	for i := 0; i < 10; i++ {
+		if err := s.acquire(); err != nil {
+			t.Fatalf("acquire() error = %v, want nil without limiter", err)
+		}
+	}
+}
+
+func TestAcquire_ExhaustedBudgetReturnsRetryAfter(t *testing.T) {
+	s := &Sender{limiter: rate.NewLimiter(rate.Limit(1), 2)}
+
+	// Burst allows two immediate sends
+	for i := 0; i < 2; i++ {
+		if err := s.acquire(); err != nil {
+			t.Fatalf("acquire() #%d error = %v", i+1, err)
+		}
+	}
+
+	err := s.acquire()
+	var rlErr *RateLimitedError
+	if !errors.As(err, &rlErr) {
+		t.Fatalf("expected RateLimitedError, got %v", err)
+	}
+	if rlErr.RetryAfter() <= 0 || rlErr.RetryAfter() > time.Second {
+		t.Errorf("RetryAfter() = %s, want within (0, 1s]", rlErr.RetryAfter())
+	}
+}
+
+func TestLimiterFor_SharedPerProject(t *testing.T) {
+	if limiterFor("project-a", 0, 0) != nil {
+		t.Error("expected nil limiter when QPS is zero")
+	}
+
+	a1 := limiterFor("project-a", 5, 0)
+	a2 := limiterFor("project-a", 5, 0)
+	b := limiterFor("project-b", 5, 0)
+
+	if a1 != a2 {
+		t.Error("expected senders for the same project to share a limiter")
+	}
+	if a1 == b {
+		t.Error("expected different projects to have separate limiters")
+	}
+	if a1.Burst() != 5 {
+		t.Errorf("Burst() = %d, want default of QPS (5)", a1.Burst())
+	}
+}
+
+func TestNewMessage_TTL(t *testing.T) {
+	msg, err := newMessage("test-token", [][]byte{{0x01}}, nil, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+	if msg.Android.TTL != nil {
+		t.Errorf("Android.TTL = %s, want unset for zero ttl", *msg.Android.TTL)
+	}
+
+	msg, err = newMessage("test-token", [][]byte{{0x01}}, nil, 90*time.Second)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+	if msg.Android.TTL == nil || *msg.Android.TTL != 90*time.Second {
+		t.Errorf("Android.TTL = %v, want 90s", msg.Android.TTL)
+	}
+}
+
+func TestAddData(t *testing.T) {
+	msg, err := newMessage("test-token", [][]byte{{0x01}}, nil, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+	payload := msg.Data["payload"]
+
+	addData(msg, map[string]string{"thread_id": "chat-42", "payload": "spoofed"})
+
+	if msg.Data["thread_id"] != "chat-42" {
+		t.Errorf("Data[thread_id] = %q, want %q", msg.Data["thread_id"], "chat-42")
+	}
+	if msg.Data["payload"] != payload {
+		t.Errorf("Data[payload] was replaced with %q", msg.Data["payload"])
+	}
+}
+
+func TestAddVisible(t *testing.T) {
+	msg, err := newMessage("test-token", [][]byte{{0x01}}, nil, 0)
+	if err != nil {
+		t.Fatalf("newMessage() error = %v", err)
+	}
+
+	addVisible(msg, "New activity", "2 new updates", "updates")
+
+	if msg.Notification == nil || msg.Notification.Title != "New activity" || msg.Notification.Body != "2 new updates" {
+		t.Errorf("Notification = %+v, want title and body set", msg.Notification)
+	}
+	if msg.Android.Notification == nil || msg.Android.Notification.ChannelID != "updates" {
+		t.Errorf("Android.Notification = %+v, want channel %q", msg.Android.Notification, "updates")
+	}
+	if msg.Android.Priority != "high" {
+		t.Errorf("Android.Priority = %q, want %q", msg.Android.Priority, "high")
+	}
+	if _, ok := msg.Data["payload"]; !ok {
+		t.Error("expected data payload to be kept")
+	}
+}
+
+func TestApplyEndpointOptions(t *testing.T) {
+	newMsg := func(visible bool) *messaging.Message {
+		msg, err := newMessage("test-token", [][]byte{{0x01}}, nil, 0)
+		if err != nil {
+			t.Fatalf("newMessage() error = %v", err)
+		}
+		if visible {
+			addVisible(msg, "New activity", "2 new updates", "updates")
+		}
+		return msg
+	}
+
+	t.Run("visible", func(t *testing.T) {
+		msg := newMsg(true)
+		applyEndpointOptions(msg, map[string]string{
+			EndpointChannelID:    "chat",
+			EndpointSound:        "default",
+			EndpointPriority:     "normal",
+			EndpointAPNSPushType: "alert",
+			"vibrate":            "short", // not an option FCM messages get
+		})
+		if n := msg.Android.Notification; n == nil || n.ChannelID != "chat" || n.Sound != "default" {
+			t.Errorf("Android.Notification = %+v, want channel chat and sound default", n)
+		}
+		if msg.Android.Priority != "normal" {
+			t.Errorf("Android.Priority = %q, want normal", msg.Android.Priority)
+		}
+		if msg.APNS == nil || msg.APNS.Headers["apns-push-type"] != "alert" {
+			t.Errorf("APNS = %+v, want push type alert", msg.APNS)
+		}
+		if _, ok := msg.Data["vibrate"]; ok {
+			t.Error("unknown option added to the data payload")
+		}
+	})
+
+	t.Run("data only", func(t *testing.T) {
+		msg := newMsg(false)
+		applyEndpointOptions(msg, map[string]string{
+			EndpointChannelID:    "chat",
+			EndpointAPNSPushType: "background",
+		})
+		if msg.Android.Notification != nil {
+			t.Errorf("Android.Notification = %+v, want none for a data message", msg.Android.Notification)
+		}
+		if msg.APNS == nil || msg.APNS.Headers["apns-push-type"] != "background" || msg.APNS.Headers["apns-priority"] != "5" {
+			t.Errorf("APNS headers = %+v, want background push type at priority 5", msg.APNS)
+		} else if msg.APNS.Payload == nil || !msg.APNS.Payload.Aps.ContentAvailable {
+			t.Error("expected content-available for a background push")
+		}
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		msg := newMsg(true)
+		applyEndpointOptions(msg, map[string]string{
+			EndpointPriority:     "urgent",
+			EndpointAPNSPushType: "voip",
+		})
+		if msg.Android.Priority != "high" {
+			t.Errorf("Android.Priority = %q, want the default high", msg.Android.Priority)
+		}
+		if msg.APNS != nil {
+			t.Errorf("APNS = %+v, want none", msg.APNS)
+		}
+		if msg.Android.Notification.ChannelID != "updates" {
+			t.Errorf("channel = %q, want the configured one", msg.Android.Notification.ChannelID)
+		}
+	})
+}
+
+func TestErrorCode(t *testing.T) {
+	if code := errorCode(errors.New("connection refused")); code != "" {
+		t.Errorf("errorCode(network error) = %q, want empty", code)
+	}
+
+	var coded interface{ ErrorCode() string }
+	if !errors.As(fmt.Errorf("flush: %w", &InvalidTokenError{Err: errors.New("gone")}), &coded) || coded.ErrorCode() != errorUnregistered {
+		t.Errorf("InvalidTokenError code not reachable through wrapping")
+	}
+	if err := (&SendError{Code: errorQuotaExceeded, Err: errors.New("quota")}); err.ErrorCode() != errorQuotaExceeded {
+		t.Errorf("SendError.ErrorCode() = %q", err.ErrorCode())
+	}
+
+	if !errors.Is(fmt.Errorf("flush: %w", &InvalidTokenError{Err: errors.New("gone")}), ErrUnregistered) {
+		t.Errorf("wrapped InvalidTokenError doesn't match ErrUnregistered")
+	}
+	if errors.Is(&SendError{Code: errorQuotaExceeded, Err: errors.New("quota")}, ErrUnregistered) {
+		t.Errorf("SendError matches ErrUnregistered")
+	}
+}
@@ -0,0 +1,126 @@
+package fcm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// maxTopicTokens is FCM's limit on tokens per topic management request.
+const maxTopicTokens = 1000
+
+// broadcastLabel is the analytics label for topic broadcasts.
+const broadcastLabel = "broadcast"
+
+// topicPattern matches names FCM accepts as topics.
+var topicPattern = regexp.MustCompile(`^[a-zA-Z0-9\-_.~%]{1,900}$`)
+
+// ValidTopic reports whether topic is a valid FCM topic name (without the
+// "/topics/" prefix).
+func ValidTopic(topic string) bool {
+	return topicPattern.MatchString(topic)
+}
+
+// TopicResult summarizes a topic subscription change.
+type TopicResult struct {
+	SuccessCount int      `json:"success_count"`
+	FailureCount int      `json:"failure_count"`
+	Errors       []string `json:"errors,omitempty"` // e.g. "token 3: invalid-argument"
+}
+
+// SendToTopic sends a data notification carrying dataIDs to every device
+// subscribed to topic, and returns the FCM message ID. opts.Title and
+// opts.Body add visible text; opts.Sender is ignored and the message is
+// labeled "broadcast" when analytics labels are enabled. Subscribers' app
+// versions aren't known, so the payload has the schema for endpoints that
+// report none.
+func (s *Sender) SendToTopic(ctx context.Context, topic string, dataIDs [][]byte, opts SendOptions) (string, error) {
+	if !ValidTopic(topic) {
+		return "", fmt.Errorf("invalid topic %q", topic)
+	}
+	if err := s.allowUsage(); err != nil {
+		return "", err
+	}
+	if err := s.acquire(); err != nil {
+		return "", err
+	}
+
+	message, err := newTopicMessage(topic, dataIDs, opts.TTL)
+	if err != nil {
+		return "", err
+	}
+	applySchema(message, s.schemas.forApp(""))
+	if opts.Title != "" || opts.Body != "" {
+		addVisible(message, opts.Title, opts.Body, s.channelID)
+	}
+	if s.labels != nil {
+		message.FCMOptions = &messaging.FCMOptions{AnalyticsLabel: broadcastLabel}
+	}
+
+	messageID, err := s.messaging().Send(ctx, message)
+	if err != nil {
+		log.Printf("ERROR: FCM broadcast to topic %s failed: %v", topic, err)
+		return "", err
+	}
+	s.recordUsage()
+
+	log.Printf("INFO: sent FCM broadcast %s to topic %s%s", messageID, topic, logfield.Format(logfield.Count("data_ids", len(dataIDs))))
+	return messageID, nil
+}
+
+// SubscribeToTopic subscribes fcmTokens to topic.
+func (s *Sender) SubscribeToTopic(ctx context.Context, topic string, fcmTokens []string) (*TopicResult, error) {
+	return s.manageTopic(ctx, topic, fcmTokens, s.messaging().SubscribeToTopic)
+}
+
+// UnsubscribeFromTopic unsubscribes fcmTokens from topic.
+func (s *Sender) UnsubscribeFromTopic(ctx context.Context, topic string, fcmTokens []string) (*TopicResult, error) {
+	return s.manageTopic(ctx, topic, fcmTokens, s.messaging().UnsubscribeFromTopic)
+}
+
+// topicOp is a messaging.Client topic management method.
+type topicOp func(ctx context.Context, tokens []string, topic string) (*messaging.TopicManagementResponse, error)
+
+// manageTopic applies op to fcmTokens in chunks of at most maxTopicTokens.
+// Per-token failures are reported in the result; a failed request aborts.
+func (s *Sender) manageTopic(ctx context.Context, topic string, fcmTokens []string, op topicOp) (*TopicResult, error) {
+	if !ValidTopic(topic) {
+		return nil, fmt.Errorf("invalid topic %q", topic)
+	}
+
+	result := &TopicResult{}
+	for start := 0; start < len(fcmTokens); start += maxTopicTokens {
+		end := min(start+maxTopicTokens, len(fcmTokens))
+		resp, err := op(ctx, fcmTokens[start:end], topic)
+		if err != nil {
+			return result, fmt.Errorf("updating topic %s subscriptions: %w", topic, err)
+		}
+		mergeTopicResponse(result, resp, start)
+	}
+	return result, nil
+}
+
+// mergeTopicResponse adds resp to result. offset is the index of the
+// response's first token within the caller's token list.
+func mergeTopicResponse(result *TopicResult, resp *messaging.TopicManagementResponse, offset int) {
+	result.SuccessCount += resp.SuccessCount
+	result.FailureCount += resp.FailureCount
+	for _, e := range resp.Errors {
+		result.Errors = append(result.Errors, fmt.Sprintf("token %d: %s", offset+e.Index, e.Reason))
+	}
+}
+
+// newTopicMessage builds the FCM data message carrying dataIDs for topic.
+func newTopicMessage(topic string, dataIDs [][]byte, ttl time.Duration) (*messaging.Message, error) {
+	message, err := newMessage("", dataIDs, nil, ttl)
+	if err != nil {
+		return nil, err
+	}
+	message.Topic = topic
+	return message, nil
+}
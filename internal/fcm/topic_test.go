@@ -0,0 +1,58 @@
+package fcm
+
+import (
+	"strings"
+	"testing"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{topic: "all-devices", want: true},
+		{topic: "maintenance_2026.10~eu%20", want: true},
+		{topic: "", want: false},
+		{topic: "/topics/all-devices", want: false},
+		{topic: "has space", want: false},
+		{topic: strings.Repeat("a", 901), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidTopic(tt.topic); got != tt.want {
+			t.Errorf("ValidTopic(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestNewTopicMessage(t *testing.T) {
+	msg, err := newTopicMessage("all-devices", [][]byte{{0x01}}, 0)
+	if err != nil {
+		t.Fatalf("newTopicMessage() error = %v", err)
+	}
+	if msg.Topic != "all-devices" || msg.Token != "" {
+		t.Errorf("Topic = %q, Token = %q; want topic only", msg.Topic, msg.Token)
+	}
+	if msg.Data["payload"] == "" {
+		t.Error("expected data payload")
+	}
+}
+
+func TestMergeTopicResponse(t *testing.T) {
+	result := &TopicResult{}
+	mergeTopicResponse(result, &messaging.TopicManagementResponse{SuccessCount: 2}, 0)
+	mergeTopicResponse(result, &messaging.TopicManagementResponse{
+		SuccessCount: 1,
+		FailureCount: 1,
+		Errors:       []*messaging.ErrorInfo{{Index: 1, Reason: "invalid-argument"}},
+	}, maxTopicTokens)
+
+	if result.SuccessCount != 3 || result.FailureCount != 1 {
+		t.Errorf("result = %+v, want 3 successes and 1 failure", result)
+	}
+	if len(result.Errors) != 1 || result.Errors[0] != "token 1001: invalid-argument" {
+		t.Errorf("Errors = %v, want the failed token's overall index", result.Errors)
+	}
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RestrictAccess returns middleware admitting only requests from clients in
+// allowFrom, each an IP address or CIDR range, and carrying token as an
+// "Authorization: Bearer" token. An empty allowFrom admits every client and
+// an empty token needs none. The client is as resolved by ClientIP, so
+// TrustedProxies.Middleware must run first behind a proxy.
+func RestrictAccess(allowFrom []string, token string) (func(http.Handler) http.Handler, error) {
+	prefixes, err := parsePrefixes(allowFrom, "client address")
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(prefixes) > 0 {
+				addr, err := netip.ParseAddr(ClientIP(r))
+				if err != nil || !containsAddr(prefixes, addr) {
+					WriteError(w, r, http.StatusForbidden, CodePermissionDenied, "forbidden")
+					return
+				}
+			}
+			if token != "" {
+				presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+				if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+					WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, "unauthorized")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRestrictAccess(t *testing.T) {
+	access, err := RestrictAccess([]string{"10.0.0.0/8", "192.0.2.7"}, "internal-token")
+	if err != nil {
+		t.Fatalf("RestrictAccess() error = %v", err)
+	}
+	h := access(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		token      string
+		want       int
+	}{
+		{name: "allowed range", remoteAddr: "10.1.2.3:5000", token: "internal-token", want: http.StatusOK},
+		{name: "allowed address", remoteAddr: "192.0.2.7:5000", token: "internal-token", want: http.StatusOK},
+		{name: "IPv4-mapped", remoteAddr: "[::ffff:10.1.2.3]:5000", token: "internal-token", want: http.StatusOK},
+		{name: "outside", remoteAddr: "203.0.113.9:5000", token: "internal-token", want: http.StatusForbidden},
+		{name: "no token", remoteAddr: "10.1.2.3:5000", want: http.StatusUnauthorized},
+		{name: "wrong token", remoteAddr: "10.1.2.3:5000", token: "guess", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/status/x", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+
+	if _, err := RestrictAccess([]string{"10.0.0.0/33"}, ""); err == nil {
+		t.Error("RestrictAccess() with an invalid range succeeded, want an error")
+	}
+}
@@ -0,0 +1,714 @@
+// Package handler provides HTTP request handlers for the push gateway.
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/abuse"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/counters"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/endpointhealth"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/quota"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// defaultHistoryDays and maxHistoryDays bound GET /admin/history's days parameter.
+const (
+	defaultHistoryDays = 30
+	maxHistoryDays     = 366
+)
+
+// defaultQuotaDays is used when GET /admin/quota has no days parameter.
+const defaultQuotaDays = 1
+
+// defaultRequeueWindow is used when POST /admin/requeue has no since parameter.
+const defaultRequeueWindow = time.Hour
+
+// defaultFailuresLimit and maxFailuresLimit bound GET /admin/failures's limit parameter.
+const (
+	defaultFailuresLimit = 50
+	maxFailuresLimit     = 500
+)
+
+// defaultHealthLimit and maxHealthLimit bound GET /admin/endpoints/health's
+// limit parameter.
+const (
+	defaultHealthLimit = 50
+	maxHealthLimit     = 1000
+)
+
+// defaultExportWindow is used when GET /admin/status/export has no since
+// parameter.
+const defaultExportWindow = 24 * time.Hour
+
+// exportPageSize is how many statuses GET /admin/status/export reads from the
+// database at a time. The database is free for other requests between pages.
+const exportPageSize = 500
+
+// exportWriteTimeout is how long GET /admin/status/export waits for the client
+// to take each page, replacing the server's write timeout so a long export
+// isn't cut off while a client that stops reading still is.
+const exportWriteTimeout = 30 * time.Second
+
+// AdminHandler handles operator-only maintenance requests.
+type AdminHandler struct {
+	batcher  *batcher.Batcher
+	token    string
+	abuse    *abuse.Detector         // nil when abuse detection is disabled
+	quota    *quota.Accountant       // nil when FCM usage isn't accounted
+	counters *counters.Counters      // nil when push totals aren't kept
+	labels   labelhash.Hasher        // nil when labels aren't looked up
+	health   *endpointhealth.Tracker // nil when endpoint health isn't scored
+	reloader Reloader                // nil when components can't be reloaded
+
+	duplicates *DuplicateTracker // nil when endpoints aren't deduplicated
+	capture    *CaptureBuffer    // nil when requests can't be captured
+}
+
+// NewAdminHandler creates a new AdminHandler.
+// Requests must present the token as "Authorization: Bearer <token>".
+func NewAdminHandler(b *batcher.Batcher, token string) *AdminHandler {
+	return &AdminHandler{
+		batcher: b,
+		token:   token,
+	}
+}
+
+// SetCapture lets the /admin/capture endpoints switch capture of push
+// requests into c on and off. Must be called before the handler serves
+// requests.
+func (h *AdminHandler) SetCapture(c *CaptureBuffer) {
+	h.capture = c
+}
+
+// SetAbuseDetector lets the suspension endpoints view and lift d's
+// suspensions. Must be called before the handler serves requests.
+func (h *AdminHandler) SetAbuseDetector(d *abuse.Detector) {
+	h.abuse = d
+}
+
+// SetQuota lets GET /admin/quota report a's FCM usage. Must be called
+// before the handler serves requests.
+func (h *AdminHandler) SetQuota(a *quota.Accountant) {
+	h.quota = a
+}
+
+// SetCounters lets GET /admin/counters report c's push totals. Must be
+// called before the handler serves requests.
+func (h *AdminHandler) SetCounters(c *counters.Counters) {
+	h.counters = c
+}
+
+// SetLabelHasher lets GET /admin/labels/{username} list the labels l
+// records username under. Must be called before the handler serves
+// requests.
+func (h *AdminHandler) SetLabelHasher(l labelhash.Hasher) {
+	h.labels = l
+}
+
+// SetEndpointHealth lets GET /admin/endpoints/health list t's scores. Must
+// be called before the handler serves requests.
+func (h *AdminHandler) SetEndpointHealth(t *endpointhealth.Tracker) {
+	h.health = t
+}
+
+// SetDuplicateTracker lets GET /admin/endpoints/duplicates list the
+// duplicate endpoints t recorded. Must be called before the handler serves
+// requests.
+func (h *AdminHandler) SetDuplicateTracker(t *DuplicateTracker) {
+	h.duplicates = t
+}
+
+// RequeueResponse is the JSON response for POST /admin/requeue.
+type RequeueResponse struct {
+	Requeued int `json:"requeued"`
+}
+
+// RecipientBatch summarizes one pending batch in the GET /admin/batches response.
+type RecipientBatch struct {
+	FcmToken   string    `json:"fcm_token"`
+	RequestIDs []string  `json:"request_ids"`
+	CreatedAt  time.Time `json:"created_at"`
+	FlushAt    time.Time `json:"flush_at"`
+}
+
+// StatsResponse is the JSON response for GET /admin/stats.
+type StatsResponse struct {
+	// DroppedNotifications counts notifications that were never queued, so
+	// operators notice data loss that /push callers may have ignored.
+	DroppedNotifications uint64            `json:"dropped_notifications"`
+	Drops                batcher.DropStats `json:"drops"`
+}
+
+// Failure is one row of the GET /admin/failures response.
+type Failure struct {
+	RequestID string    `json:"request_id"`
+	FailedAt  time.Time `json:"failed_at"`
+	State     string    `json:"state"`
+	ErrorCode string    `json:"error_code,omitempty"` // FCM error code, e.g. "UNREGISTERED"
+	Error     string    `json:"error,omitempty"`
+}
+
+// HistoryEntry is one row of the GET /admin/history response.
+type HistoryEntry struct {
+	Day    string `json:"day"` // UTC date, e.g. "2024-05-01"
+	Sender string `json:"sender"`
+	State  string `json:"state"`
+	Count  int64  `json:"count"`
+}
+
+// LabelsResponse is the JSON response for GET /admin/labels/{username}.
+type LabelsResponse struct {
+	Username string `json:"username"`
+	// Labels are what the username is recorded as in analytics labels and
+	// hashed log lines, the current label first, then those under previous
+	// hash keys.
+	Labels []string `json:"labels"`
+}
+
+// EndpointHealthResponse is the JSON response for GET
+// /admin/endpoints/health.
+type EndpointHealthResponse struct {
+	Stats     endpointhealth.Stats      `json:"stats"`
+	Endpoints []endpointhealth.Endpoint `json:"endpoints"` // worst first
+}
+
+// QuotaUsage is one row of the history in the GET /admin/quota response.
+type QuotaUsage struct {
+	ProjectID string    `json:"project_id"`
+	Hour      time.Time `json:"hour"` // start of the UTC hour
+	Sends     int64     `json:"sends"`
+}
+
+// QuotaResponse is the JSON response for GET /admin/quota.
+type QuotaResponse struct {
+	quota.Stats
+	History []QuotaUsage `json:"history"` // oldest first
+}
+
+// StatusExport is one line of the GET /admin/status/export response.
+type StatusExport struct {
+	RequestID string     `json:"request_id"`
+	State     string     `json:"state"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	QueuedAt  *time.Time `json:"queued_at,omitempty"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	MessageID string     `json:"message_id,omitempty"`
+	ErrorCode string     `json:"error_code,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Sender    string     `json:"sender,omitempty"`
+	Target    string     `json:"target,omitempty"`
+	DeviceID  string     `json:"device_id,omitempty"`
+}
+
+// RequireToken is middleware that rejects requests without the admin bearer token.
+func (h *AdminHandler) RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if h.token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(h.token)) != 1 {
+			WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleRequeue handles POST /admin/requeue?since=1h requests.
+// Deliveries that failed within the window are requeued under their original
+// request IDs, recovering from transient FCM outages without client resubmission.
+//
+// HTTP Status Codes:
+//   - 200 OK: Requeue completed
+//   - 400 Bad Request: Invalid since duration
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleRequeue(w http.ResponseWriter, r *http.Request) {
+	since := defaultRequeueWindow
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid since duration")
+			return
+		}
+		since = d
+	}
+
+	requeued, err := h.batcher.RequeueFailed(r.Context(), since)
+	if err != nil {
+		log.Printf("ERROR: requeue failed: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	log.Printf("Requeued %d failed requests from the last %s", requeued, since)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&RequeueResponse{Requeued: requeued})
+}
+
+// HandleListBatches handles GET /admin/batches?recipient=alice@oc requests,
+// listing what is currently queued for the recipient's endpoints.
+//
+// HTTP Status Codes:
+//   - 200 OK: Batches listed (possibly empty)
+//   - 400 Bad Request: Missing recipient
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleListBatches(w http.ResponseWriter, r *http.Request) {
+	recipient := r.URL.Query().Get("recipient")
+	if recipient == "" {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "recipient is required")
+		return
+	}
+
+	batches, err := h.batcher.ListByRecipient(r.Context(), recipient)
+	if err != nil {
+		log.Printf("ERROR: listing batches: %v%s", err, logfield.Format(logfield.User("recipient", recipient)))
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	resp := make([]RecipientBatch, 0, len(batches))
+	for fcmToken, batch := range batches {
+		rb := RecipientBatch{
+			FcmToken:   fcmToken,
+			RequestIDs: make([]string, 0, len(batch.Notifications)),
+			CreatedAt:  batch.CreatedAt,
+			FlushAt:    batch.FlushAt,
+		}
+		for _, n := range batch.Notifications {
+			rb.RequestIDs = append(rb.RequestIDs, n.RequestID)
+		}
+		resp = append(resp, rb)
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].FlushAt.Before(resp[j].FlushAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleListFailures handles GET /admin/failures?since=1h&limit=50 requests,
+// listing the most recent failed deliveries that POST /admin/requeue could
+// still retry, newest first, with their current status.
+//
+// HTTP Status Codes:
+//   - 200 OK: Failures listed (possibly empty)
+//   - 400 Bad Request: Invalid since or limit
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleListFailures(w http.ResponseWriter, r *http.Request) {
+	since := defaultRequeueWindow
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid since duration")
+			return
+		}
+		since = d
+	}
+	limit := defaultFailuresLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxFailuresLimit {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "limit must be between 1 and "+strconv.Itoa(maxFailuresLimit))
+			return
+		}
+		limit = n
+	}
+
+	failed, err := h.batcher.FailedSince(r.Context(), since)
+	if err != nil {
+		log.Printf("ERROR: listing failed deliveries: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	resp := make([]Failure, 0, min(len(failed), limit))
+	for i := len(failed) - 1; i >= 0 && len(resp) < limit; i-- {
+		fd := failed[i]
+		f := Failure{RequestID: fd.RequestID, FailedAt: fd.FailedAt}
+		if status, err := h.batcher.GetStatus(r.Context(), fd.RequestID); err == nil {
+			f.State = status.State
+			f.ErrorCode = status.ErrorCode
+			f.Error = status.Error
+		}
+		resp = append(resp, f)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleHistory handles GET /admin/history?days=30&sender=alice@oc requests,
+// listing daily delivery counts per sender and final state. Counts come from
+// statuses rolled up when they expire, so the current retention period is
+// not included yet.
+//
+// HTTP Status Codes:
+//   - 200 OK: History listed (possibly empty)
+//   - 400 Bad Request: Invalid days
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	days := defaultHistoryDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxHistoryDays {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid days")
+			return
+		}
+		days = n
+	}
+	since := time.Now().UTC().AddDate(0, 0, -(days - 1))
+
+	summaries, err := h.batcher.DeliveryHistory(r.Context(), since, r.URL.Query().Get("sender"))
+	if err != nil {
+		log.Printf("ERROR: listing delivery history: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	resp := make([]HistoryEntry, 0, len(summaries))
+	for _, s := range summaries {
+		resp = append(resp, HistoryEntry{Day: s.Day, Sender: s.Sender, State: s.State, Count: s.Count})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleExportStatus handles GET /admin/status/export?since=1h requests,
+// streaming the statuses updated within the window as newline-delimited JSON,
+// oldest update first. since is a duration or an RFC 3339 time. A request
+// updated during the export can appear twice; its last line is current.
+//
+// The stream is read from the database a page at a time and flushed after
+// each page, so it only advances as fast as the client reads. A database
+// error after the first page aborts the connection, leaving the chunked body
+// unterminated so the client sees the export as incomplete.
+//
+// HTTP Status Codes:
+//   - 200 OK: Statuses streamed (possibly none)
+//   - 400 Bad Request: Invalid since
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleExportStatus(w http.ResponseWriter, r *http.Request) {
+	since := time.Now().Add(-defaultExportWindow)
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			since = t
+		} else if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+			since = time.Now().Add(-d)
+		} else {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid since: want a duration or an RFC 3339 time")
+			return
+		}
+	}
+
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	var after store.StatusCursor
+	for started := false; ; started = true {
+		records, err := h.batcher.StatusesSince(ctx, since, after, exportPageSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: exporting statuses: %v", err)
+			if started {
+				panic(http.ErrAbortHandler)
+			}
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+			return
+		}
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+
+		// Not every writer supports deadlines; the server's timeout applies then
+		rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+		for _, rec := range records {
+			line := StatusExport{
+				RequestID: rec.RequestID,
+				State:     rec.State,
+				UpdatedAt: rec.UpdatedAt,
+				SentAt:    rec.SentAt,
+				MessageID: rec.MessageID,
+				ErrorCode: rec.ErrorCode,
+				Error:     rec.Error,
+				Sender:    rec.Sender,
+				Target:    rec.Target,
+				DeviceID:  rec.DeviceID,
+			}
+			if !rec.QueuedAt.IsZero() {
+				queuedAt := rec.QueuedAt
+				line.QueuedAt = &queuedAt
+			}
+			if err := enc.Encode(&line); err != nil {
+				return // client went away
+			}
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+
+		if len(records) < exportPageSize {
+			return
+		}
+		last := records[len(records)-1]
+		after = store.StatusCursor{UpdatedAt: last.UpdatedAt, RequestID: last.RequestID}
+	}
+}
+
+// HandleExportBatches handles GET /admin/batches/export requests, streaming
+// the persisted pending batches and statuses as a snapshot for
+// POST /admin/batches/import or "pushserver import-batches" on another
+// instance. Batches this instance flushes after the export are sent by both,
+// so stop sending it pushes first.
+//
+// A database error aborts the connection; the snapshot then lacks its last
+// line, and importing it reports it incomplete.
+//
+// HTTP Status Codes:
+//   - 200 OK: Snapshot streamed
+func (h *AdminHandler) HandleExportBatches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	dw := &deadlineWriter{w: w, rc: http.NewResponseController(w)}
+	counts, err := h.batcher.WriteSnapshot(r.Context(), dw)
+	if err != nil {
+		if r.Context().Err() != nil || dw.failed {
+			return // client went away
+		}
+		log.Printf("ERROR: exporting batches: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("Exported %d batches and %d statuses", counts.Batches, counts.Statuses)
+}
+
+// deadlineWriter extends the write deadline before each write, so a long
+// export is only cut off by a client that stops reading.
+type deadlineWriter struct {
+	w      io.Writer
+	rc     *http.ResponseController
+	failed bool // a write failed
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	// Not every writer supports deadlines; the server's timeout applies then
+	d.rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+	n, err := d.w.Write(p)
+	if err != nil {
+		d.failed = true
+	}
+	return n, err
+}
+
+// HandleImportBatches handles POST /admin/batches/import requests, adding the
+// batches and statuses in a snapshot from GET /admin/batches/export to this
+// instance. Batches are merged into the ones already pending for the same
+// token and flush when they were due; overdue ones flush right away. A
+// status that changed here more recently than in the snapshot is kept.
+//
+// The snapshot is imported as it is read. If it is incomplete, what was read
+// stays imported; importing the complete snapshot again adds only the rest.
+//
+// HTTP Status Codes:
+//   - 200 OK: Snapshot imported; the response counts what it held
+//   - 400 Bad Request: Malformed or incomplete snapshot
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleImportBatches(w http.ResponseWriter, r *http.Request) {
+	counts, err := store.ReadSnapshot(r.Context(), r.Body, h.batcher)
+	if errors.Is(err, store.ErrInvalidSnapshot) {
+		log.Printf("WARNING: importing batches: %v (after %d batches and %d statuses)", err, counts.Batches, counts.Statuses)
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: importing batches: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+	log.Printf("Imported %d batches and %d statuses", counts.Batches, counts.Statuses)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&counts)
+}
+
+// HandleStats handles GET /admin/stats requests, summarizing notifications
+// dropped before they could be queued, by cause.
+func (h *AdminHandler) HandleStats(w http.ResponseWriter, r *http.Request) {
+	drops := h.batcher.Drops()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&StatsResponse{
+		DroppedNotifications: drops.Total,
+		Drops:                drops,
+	})
+}
+
+// HandleRecovery handles GET /admin/recovery requests, reporting the
+// progress of the latest recovery of batches pending from a previous run.
+func (h *AdminHandler) HandleRecovery(w http.ResponseWriter, r *http.Request) {
+	progress := h.batcher.RecoveryProgress()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&progress)
+}
+
+// HandleQuota handles GET /admin/quota?days=1 requests, reporting each
+// Firebase project's sends in the current hour and day against its budgets,
+// and the hourly send counts of the last days UTC days, today included.
+//
+// HTTP Status Codes:
+//   - 200 OK: Usage reported
+//   - 400 Bad Request: Invalid days
+//   - 500 Internal Server Error: Database error
+func (h *AdminHandler) HandleQuota(w http.ResponseWriter, r *http.Request) {
+	days := defaultQuotaDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxHistoryDays {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid days")
+			return
+		}
+		days = n
+	}
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+
+	usage, err := h.quota.History(r.Context(), since)
+	if err != nil {
+		log.Printf("ERROR: listing FCM usage: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	resp := QuotaResponse{
+		Stats:   h.quota.Stats(),
+		History: make([]QuotaUsage, 0, len(usage)),
+	}
+	for _, u := range usage {
+		resp.History = append(resp.History, QuotaUsage{ProjectID: u.ProjectID, Hour: u.Hour, Sends: u.Sends})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// HandleCounters handles GET /admin/counters requests, reporting the totals
+// of pushes accepted, delivered, failed, and dropped, which carry on from
+// where the previous run left off.
+func (h *AdminHandler) HandleCounters(w http.ResponseWriter, r *http.Request) {
+	snap := h.counters.Snapshot()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&snap)
+}
+
+// HandleListSuspensions handles GET /admin/suspensions requests, listing the
+// senders currently suspended for abuse, soonest to be lifted first.
+func (h *AdminHandler) HandleListSuspensions(w http.ResponseWriter, r *http.Request) {
+	suspensions := h.abuse.List()
+	if suspensions == nil {
+		suspensions = []abuse.Suspension{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suspensions)
+}
+
+// HandleListDuplicates handles GET /admin/endpoints/duplicates?username=bob@oc
+// requests, listing the devices recent pushes found listed more than once
+// in their owner's endpoint list, most recently seen first. username is
+// optional.
+func (h *AdminHandler) HandleListDuplicates(w http.ResponseWriter, r *http.Request) {
+	duplicates := h.duplicates.List(r.URL.Query().Get("username"))
+	if duplicates == nil {
+		duplicates = []DuplicateEndpoint{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(duplicates)
+}
+
+// HandleLiftSuspension handles DELETE /admin/suspensions/{sender} requests,
+// ending a sender's suspension before its cooldown runs out.
+//
+// HTTP Status Codes:
+//   - 204 No Content: Suspension lifted
+//   - 404 Not Found: Sender is not suspended
+func (h *AdminHandler) HandleLiftSuspension(w http.ResponseWriter, r *http.Request) {
+	sender := chi.URLParam(r, "sender")
+	if !h.abuse.Lift(sender) {
+		WriteError(w, r, http.StatusNotFound, CodeNotFound, "sender not suspended")
+		return
+	}
+
+	log.Printf("Lifted suspension of sender%s", logfield.Format(logfield.User("sender", sender)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLabels handles GET /admin/labels/{username} requests, listing the
+// labels username is recorded under in analytics labels and hashed log
+// lines, including those from before a hash key rotation.
+//
+// HTTP Status Codes:
+//   - 200 OK: Labels returned
+func (h *AdminHandler) HandleLabels(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	resp := LabelsResponse{Username: username, Labels: []string{username}}
+	if h.labels != nil {
+		resp.Labels = h.labels.Labels(username)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleEndpointHealth handles GET
+// /admin/endpoints/health?recipient=bob@oc&max_score=0.5&limit=50 requests,
+// listing endpoints' delivery scores worst first. recipient limits the list
+// to one user's endpoints, and max_score to those scoring at most it.
+//
+// HTTP Status Codes:
+//   - 200 OK: Scores returned
+//   - 400 Bad Request: Invalid max_score or limit
+func (h *AdminHandler) HandleEndpointHealth(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	maxScore := 1.0
+	if raw := query.Get("max_score"); raw != "" {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil || f < 0 || f > 1 {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "max_score must be between 0 and 1")
+			return
+		}
+		maxScore = f
+	}
+	limit := defaultHealthLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxHealthLimit {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "limit must be between 1 and "+strconv.Itoa(maxHealthLimit))
+			return
+		}
+		limit = n
+	}
+
+	resp := EndpointHealthResponse{
+		Stats:     h.health.Stats(),
+		Endpoints: h.health.List(query.Get("recipient"), maxScore, limit),
+	}
+	if resp.Endpoints == nil {
+		resp.Endpoints = []endpointhealth.Endpoint{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
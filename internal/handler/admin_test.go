@@ -0,0 +1,551 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/abuse"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/endpointhealth"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/quota"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestRequireToken(t *testing.T) {
+	h := NewAdminHandler(nil, "secret")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "missing header", header: "", want: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "valid token", header: "Bearer secret", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/requeue", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rr := httptest.NewRecorder()
+
+			h.RequireToken(next).ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequeue_InvalidSince(t *testing.T) {
+	h := NewAdminHandler(nil, "secret") // nil batcher - fails before reaching it
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/requeue?since=soon", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleRequeue(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleRequeue_NothingFailed(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/requeue?since=30m", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleRequeue(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var resp RequeueResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Requeued != 0 {
+		t.Errorf("requeued = %d, want 0", resp.Requeued)
+	}
+}
+
+func TestHandleListFailures(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	for _, tt := range []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusOK},
+		{"?since=24h&limit=10", http.StatusOK},
+		{"?since=soon", http.StatusBadRequest},
+		{"?limit=0", http.StatusBadRequest},
+		{"?limit=501", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/failures"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		h.HandleListFailures(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("%q: status = %d, want %d", tt.query, rr.Code, tt.want)
+		}
+		if rr.Code == http.StatusOK && strings.TrimSpace(rr.Body.String()) != "[]" {
+			t.Errorf("%q: body = %s, want []", tt.query, rr.Body.String())
+		}
+	}
+}
+
+func TestHandleListBatches(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	ctx := context.Background()
+	aliceID, err := b.Queue(ctx, "alice@oc", "alice-phone", [][]byte{{1}})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	if _, err := b.Queue(ctx, "bob@oc", "bob-phone", [][]byte{{2}}); err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/batches?recipient=alice@oc", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleListBatches(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var resp []RecipientBatch
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp) != 1 {
+		t.Fatalf("got %d batches, want 1", len(resp))
+	}
+	if resp[0].FcmToken != "alice-phone" {
+		t.Errorf("fcm_token = %q, want %q", resp[0].FcmToken, "alice-phone")
+	}
+	if len(resp[0].RequestIDs) != 1 || resp[0].RequestIDs[0] != aliceID {
+		t.Errorf("request_ids = %v, want [%s]", resp[0].RequestIDs, aliceID)
+	}
+}
+
+func TestHandleListBatches_MissingRecipient(t *testing.T) {
+	h := NewAdminHandler(nil, "secret")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/batches", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleListBatches(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	b.Stop()
+	if _, err := b.Queue(context.Background(), "bob@oc", "token1", [][]byte{{1}}); err == nil {
+		t.Fatal("expected Queue() to fail after Stop")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleStats(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var resp StatsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.DroppedNotifications != 1 || resp.Drops.Stopped != 1 {
+		t.Errorf("stats = %+v, want 1 dropped while stopped", resp)
+	}
+}
+
+func TestHandleRecovery(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	if err := b.Recover(context.Background()); err != nil {
+		t.Fatalf("Recover() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/recovery", nil)
+	rr := httptest.NewRecorder()
+	h.HandleRecovery(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var resp batcher.RecoveryProgress
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Running || resp.StartedAt == nil || resp.FinishedAt == nil || resp.Loaded != 0 {
+		t.Errorf("progress = %+v, want an empty recovery finished", resp)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/history?days=7&sender=alice@oc", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleHistory(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var resp []HistoryEntry
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp) != 0 {
+		t.Errorf("history = %+v, want empty", resp)
+	}
+}
+
+func TestHandleHistory_InvalidDays(t *testing.T) {
+	h := NewAdminHandler(nil, "secret") // nil batcher - fails before reaching it
+
+	for _, days := range []string{"0", "-1", "soon", "1000"} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/history?days="+days, nil)
+		rr := httptest.NewRecorder()
+
+		h.HandleHistory(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("days=%s: status = %d, want %d", days, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHandleQuota(t *testing.T) {
+	st, err := store.New(store.Config{Path: t.TempDir() + "/quota.db"})
+	if err != nil {
+		t.Fatalf("store.New() error = %v", err)
+	}
+	defer st.Close()
+	accountant, err := quota.New(context.Background(), st, quota.Config{Default: quota.Budget{Hourly: 2}})
+	if err != nil {
+		t.Fatalf("quota.New() error = %v", err)
+	}
+	accountant.Record("proj")
+	accountant.Record("proj")
+
+	h := NewAdminHandler(nil, "secret")
+	h.SetQuota(accountant)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/quota?days=2", nil)
+	rr := httptest.NewRecorder()
+
+	h.HandleQuota(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var resp QuotaResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Projects) != 1 || resp.Projects[0].Hour.Sends != 2 || !resp.Projects[0].Exhausted {
+		t.Errorf("projects = %+v, want proj with its hourly budget of 2 used up", resp.Projects)
+	}
+	if len(resp.History) != 1 || resp.History[0].ProjectID != "proj" || resp.History[0].Sends != 2 {
+		t.Errorf("history = %+v, want 2 sends for proj", resp.History)
+	}
+
+	// Invalid days
+	req = httptest.NewRequest(http.MethodGet, "/admin/quota?days=0", nil)
+	rr = httptest.NewRecorder()
+	h.HandleQuota(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("days=0: status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleExportStatus(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewAdminHandler(b, "secret")
+
+	ctx := context.Background()
+	want := make(map[string]bool)
+	for _, token := range []string{"token1", "token2", "token3"} {
+		id, err := b.Queue(ctx, "bob@oc", token, [][]byte{[]byte(token)})
+		if err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+		want[id] = true
+	}
+	b.FlushPending(ctx)
+
+	export := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/status/export"+query, nil)
+		rr := httptest.NewRecorder()
+		h.HandleExportStatus(rr, req)
+		return rr
+	}
+
+	rr := export("?since=1h")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	dec := json.NewDecoder(rr.Body)
+	var got []StatusExport
+	for dec.More() {
+		var line StatusExport
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("failed to decode line: %v", err)
+		}
+		got = append(got, line)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("exported %d statuses, want %d", len(got), len(want))
+	}
+	for i, line := range got {
+		if !want[line.RequestID] || line.State != "sent" || line.SentAt == nil {
+			t.Errorf("line %d = %+v, want a sent request", i, line)
+		}
+		if i > 0 && line.UpdatedAt.Before(got[i-1].UpdatedAt) {
+			t.Errorf("line %d updated before line %d", i, i-1)
+		}
+	}
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if rr := export("?since=" + future); rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("since=%s: status = %d, body = %q; want 200 and no lines", future, rr.Code, rr.Body.String())
+	}
+	for _, since := range []string{"soon", "-1h", "2024-13-01"} {
+		if rr := export("?since=" + since); rr.Code != http.StatusBadRequest {
+			t.Errorf("since=%s: status = %d, want %d", since, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHandleExportImportBatches(t *testing.T) {
+	from, cleanupFrom := createTestBatcher(t)
+	defer cleanupFrom()
+	to, cleanupTo := createTestBatcher(t)
+	defer cleanupTo()
+
+	ctx := context.Background()
+	sentID, err := from.Queue(ctx, "bob@oc", "token1", [][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatalf("Queue() error = %v", err)
+	}
+	from.FlushPending(ctx)
+	var pendingIDs []string
+	for _, data := range []string{"b", "c"} {
+		id, err := from.Queue(ctx, "bob@oc", "token2", [][]byte{[]byte(data)})
+		if err != nil {
+			t.Fatalf("Queue() error = %v", err)
+		}
+		pendingIDs = append(pendingIDs, id)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/batches/export", nil)
+	rr := httptest.NewRecorder()
+	NewAdminHandler(from, "secret").HandleExportBatches(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("export status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	snapshot := rr.Body.String()
+
+	importSnapshot := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/batches/import", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		NewAdminHandler(to, "secret").HandleImportBatches(rr, req)
+		return rr
+	}
+
+	// Importing twice adds nothing the second time
+	for range 2 {
+		rr := importSnapshot(snapshot)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("import status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var counts store.SnapshotCounts
+		if err := json.NewDecoder(rr.Body).Decode(&counts); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if counts.Batches != 1 || counts.Statuses != 1 {
+			t.Errorf("imported %+v, want 1 batch and 1 status", counts)
+		}
+	}
+
+	batches, err := to.ListByRecipient(ctx, "bob@oc")
+	if err != nil {
+		t.Fatalf("ListByRecipient() error = %v", err)
+	}
+	batch := batches["token2"]
+	if len(batches) != 1 || batch == nil || len(batch.Notifications) != 2 {
+		t.Fatalf("imported batches = %+v, want token2's with 2 notifications", batches)
+	}
+	for i, notif := range batch.Notifications {
+		if notif.RequestID != pendingIDs[i] {
+			t.Errorf("notification %d request ID = %q, want %q", i, notif.RequestID, pendingIDs[i])
+		}
+	}
+	status, err := to.GetStatus(ctx, sentID)
+	if err != nil || status.State != "sent" {
+		t.Errorf("GetStatus(%s) = %+v, %v; want sent", sentID, status, err)
+	}
+
+	// A snapshot cut short is rejected
+	lines := strings.SplitAfter(snapshot, "\n")
+	truncated := strings.Join(lines[:len(lines)-2], "")
+	if rr := importSnapshot(truncated); rr.Code != http.StatusBadRequest {
+		t.Errorf("truncated import status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleSuspensions(t *testing.T) {
+	d := abuse.New(abuse.Config{MaxBurst: 1, BurstWindow: time.Hour})
+	d.Record("spammer@oc", false)
+	d.Record("spammer@oc", false) // Second push within the hour is a burst
+	h := NewAdminHandler(nil, "secret")
+	h.SetAbuseDetector(d)
+
+	rr := httptest.NewRecorder()
+	h.HandleListSuspensions(rr, httptest.NewRequest(http.MethodGet, "/admin/suspensions", nil))
+
+	var list []abuse.Suspension
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list) != 1 || list[0].Sender != "spammer@oc" || list[0].Reason != abuse.ReasonBurst {
+		t.Fatalf("suspensions = %+v, want spammer@oc for %s", list, abuse.ReasonBurst)
+	}
+
+	lift := func(sender string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/admin/suspensions/"+sender, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("sender", sender)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rr := httptest.NewRecorder()
+		h.HandleLiftSuspension(rr, req)
+		return rr.Code
+	}
+
+	if code := lift("spammer@oc"); code != http.StatusNoContent {
+		t.Errorf("lift: status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := lift("spammer@oc"); code != http.StatusNotFound {
+		t.Errorf("second lift: status = %d, want %d", code, http.StatusNotFound)
+	}
+	if _, ok := d.Suspended("spammer@oc"); ok {
+		t.Error("sender still suspended after lift")
+	}
+}
+
+func TestHandleLabels(t *testing.T) {
+	hasher := labelhash.NewHMAC("new key", "old key")
+	h := NewAdminHandler(nil, "secret")
+	h.SetLabelHasher(hasher)
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/labels/alice@oc", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("username", "alice@oc")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rr := httptest.NewRecorder()
+	h.HandleLabels(rr, req)
+
+	var resp LabelsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	want := []string{hasher.Label("alice@oc"), labelhash.NewHMAC("old key").Label("alice@oc")}
+	if resp.Username != "alice@oc" || !slices.Equal(resp.Labels, want) {
+		t.Errorf("response = %+v, want alice@oc's labels %v", resp, want)
+	}
+}
+
+func TestHandleEndpointHealth(t *testing.T) {
+	tracker, err := endpointhealth.New(endpointhealth.Config{})
+	if err != nil {
+		t.Fatalf("endpointhealth.New() error = %v", err)
+	}
+	tracker.Record("phone", "bob@oc", false)
+	tracker.Record("tablet", "bob@oc", true)
+	tracker.Record("laptop", "carol@oc", false)
+	h := NewAdminHandler(nil, "secret")
+	h.SetEndpointHealth(tracker)
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantTokens []string
+	}{
+		{"", http.StatusOK, []string{"laptop", "phone", "tablet"}},
+		{"?recipient=bob@oc", http.StatusOK, []string{"phone", "tablet"}},
+		{"?max_score=0.5", http.StatusOK, []string{"laptop", "phone"}},
+		{"?limit=1", http.StatusOK, []string{"laptop"}},
+		{"?max_score=2", http.StatusBadRequest, nil},
+		{"?limit=0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		h.HandleEndpointHealth(rr, httptest.NewRequest(http.MethodGet, "/admin/endpoints/health"+tt.query, nil))
+		if rr.Code != tt.wantStatus {
+			t.Errorf("%q: status = %d, want %d", tt.query, rr.Code, tt.wantStatus)
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		var resp EndpointHealthResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		var tokens []string
+		for _, e := range resp.Endpoints {
+			tokens = append(tokens, e.FcmToken)
+		}
+		if !slices.Equal(tokens, tt.wantTokens) {
+			t.Errorf("%q: endpoints = %v, want %v", tt.query, tokens, tt.wantTokens)
+		}
+		if resp.Stats.Tracked != 3 {
+			t.Errorf("%q: tracked = %d, want 3", tt.query, resp.Stats.Tracked)
+		}
+	}
+}
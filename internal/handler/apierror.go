@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Error codes in an ErrorResponse. Unlike the message, a code never changes
+// for the same failure, so clients branch on it.
+const (
+	CodeInvalidArgument  = "invalid_argument"  // 400: a parameter or the body is malformed
+	CodeUnauthenticated  = "unauthenticated"   // 401: missing or wrong token or signature
+	CodePermissionDenied = "permission_denied" // 403: the caller may not do this
+	CodeNotFound         = "not_found"         // 404: no such request, component or sender
+	CodeConflict         = "conflict"          // 409: the target's state doesn't allow it
+	CodePayloadTooLarge  = "payload_too_large" // 413: the body exceeds the limit
+	CodeInternal         = "internal"          // 500: the gateway failed, e.g. its store
+	CodeUpstreamFailed   = "upstream_failed"   // 502: FCM rejected the call
+	CodeUnavailable      = "unavailable"       // 503: try again after Retry-After
+	CodeRateLimited      = "rate_limited"      // 503: a quota was reached; try again after Retry-After
+)
+
+// ErrorResponse is the body of every error answer from the JSON endpoints.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes a failed request. Message is meant for people and
+// may change. RequestID is the request's trace ID, as logged.
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteError answers r with status and an ErrorResponse carrying code and
+// message.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{Error: ErrorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: middleware.GetReqID(r.Context()),
+	}})
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestWriteError_Envelope(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewStatusHandler(b)
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", "nonexistent-id")
+	req := httptest.NewRequest(http.MethodGet, "/status/nonexistent-id", nil)
+	req.Header.Set(middleware.RequestIDHeader, "trace-1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rr := httptest.NewRecorder()
+	middleware.RequestID(http.HandlerFunc(h.HandleGetStatus)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", rr.Body.String(), err)
+	}
+	want := ErrorDetail{Code: CodeNotFound, Message: "request not found", RequestID: "trace-1"}
+	if resp.Error != want {
+		t.Errorf("error = %+v, want %+v", resp.Error, want)
+	}
+}
+
+func TestWriteError_NoRequestID(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteError(rr, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusBadRequest, CodeInvalidArgument, "bad")
+
+	var body map[string]map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", rr.Body.String(), err)
+	}
+	if _, ok := body["error"]["request_id"]; ok {
+		t.Errorf("body = %s, want request_id omitted", rr.Body.String())
+	}
+	if body["error"]["code"] != CodeInvalidArgument {
+		t.Errorf("code = %v, want %s", body["error"]["code"], CodeInvalidArgument)
+	}
+}
@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+)
+
+// Names of the authenticators an AuthChain can be built from.
+const (
+	// AuthSignature accepts pushes carrying the sender's OurCloud signature.
+	AuthSignature = "signature"
+	// AuthAPIKey accepts pushes carrying an API key issued to the sender in
+	// APIKeyHeader.
+	AuthAPIKey = "api_key"
+	// AuthClientCert accepts pushes over a connection authenticated with a
+	// client certificate mapped to the sender.
+	AuthClientCert = "client_cert"
+)
+
+// APIKeyHeader carries the API key of a push authenticated by AuthAPIKey.
+// It is separate from Authorization, which routes.push.token may use.
+const APIKeyHeader = "X-Push-API-Key"
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// none of the credentials it checks, so the chain moves on quietly.
+var ErrNoCredentials = errors.New("no credentials")
+
+// errSignatureInvalid is returned for a push whose signature doesn't verify.
+var errSignatureInvalid = errors.New("invalid signature")
+
+// Authenticator establishes who sent a push.
+type Authenticator interface {
+	// Name identifies the authenticator in errors and metrics.
+	Name() string
+	// Authenticate returns the username of the sender r and req come
+	// from, or ErrNoCredentials if r carries none of the credentials it
+	// checks.
+	Authenticate(ctx context.Context, r *http.Request, req *pb.PushRequest) (string, error)
+}
+
+// AuthChain authenticates pushes with each of its authenticators in turn.
+// The first to establish the push's sender_username accepts the push, so a
+// deployment moving between schemes can accept both while clients migrate.
+type AuthChain struct {
+	auths    []Authenticator
+	accepted map[string]*atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// AuthStats counts the pushes an AuthChain accepted, by authenticator, and
+// rejected.
+type AuthStats struct {
+	Accepted map[string]uint64 `json:"accepted"`
+	Rejected uint64            `json:"rejected"`
+}
+
+// NewAuthChain creates a chain trying auths in order.
+func NewAuthChain(auths ...Authenticator) (*AuthChain, error) {
+	if len(auths) == 0 {
+		return nil, errors.New("no authenticators")
+	}
+	c := &AuthChain{auths: auths, accepted: make(map[string]*atomic.Uint64, len(auths))}
+	for _, a := range auths {
+		if _, ok := c.accepted[a.Name()]; ok {
+			return nil, fmt.Errorf("authenticator %q listed twice", a.Name())
+		}
+		c.accepted[a.Name()] = new(atomic.Uint64)
+	}
+	return c, nil
+}
+
+// Authenticate returns the name of the first authenticator to establish
+// that req comes from req.SenderUsername. If none does, the error gives each
+// one's reason, and wraps ourcloud.ErrUnavailable if an authenticator that
+// found credentials couldn't check them because OurCloud was unreachable.
+func (c *AuthChain) Authenticate(ctx context.Context, r *http.Request, req *pb.PushRequest) (string, error) {
+	var reasons []string
+	unavailable := false
+	for _, a := range c.auths {
+		sender, err := a.Authenticate(ctx, r, req)
+		if err == nil && sender != req.SenderUsername {
+			err = fmt.Errorf("credentials belong to %q", sender)
+		}
+		if err == nil {
+			c.accepted[a.Name()].Add(1)
+			return a.Name(), nil
+		}
+		if errors.Is(err, ourcloud.ErrUnavailable) {
+			unavailable = true
+		}
+		reasons = append(reasons, a.Name()+": "+err.Error())
+	}
+	c.rejected.Add(1)
+	err := errors.New(strings.Join(reasons, "; "))
+	if unavailable {
+		return "", fmt.Errorf("%w: %w", ourcloud.ErrUnavailable, err)
+	}
+	return "", err
+}
+
+// Stats returns the pushes accepted and rejected since startup.
+func (c *AuthChain) Stats() AuthStats {
+	stats := AuthStats{Accepted: make(map[string]uint64, len(c.accepted))}
+	for name, n := range c.accepted {
+		stats.Accepted[name] = n.Load()
+	}
+	stats.Rejected = c.rejected.Load()
+	return stats
+}
+
+// PushVerifier verifies the signatures of pushes.
+// *ourcloud.Client implements this interface.
+type PushVerifier interface {
+	VerifyPushRequest(ctx context.Context, req *pb.PushRequest) (bool, error)
+}
+
+// SignatureAuth accepts pushes signed by their sender's OurCloud key.
+type SignatureAuth struct {
+	verifier PushVerifier
+}
+
+// NewSignatureAuth creates a SignatureAuth checking signatures with v.
+func NewSignatureAuth(v PushVerifier) *SignatureAuth {
+	return &SignatureAuth{verifier: v}
+}
+
+// Name returns AuthSignature.
+func (a *SignatureAuth) Name() string { return AuthSignature }
+
+// Authenticate returns req's sender if req carries its valid signature.
+func (a *SignatureAuth) Authenticate(ctx context.Context, r *http.Request, req *pb.PushRequest) (string, error) {
+	if len(req.Signature) == 0 {
+		return "", ErrNoCredentials
+	}
+	valid, err := a.verifier.VerifyPushRequest(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if !valid {
+		return "", errSignatureInvalid
+	}
+	return req.SenderUsername, nil
+}
+
+// APIKeyAuth accepts pushes carrying an API key in APIKeyHeader, each key
+// issued to one sender.
+type APIKeyAuth struct {
+	// senders by SHA-256 of the key, so looking a key up takes the same
+	// time however much of it matches
+	senders map[[sha256.Size]byte]string
+}
+
+// NewAPIKeyAuth creates an APIKeyAuth from keys, mapping each key to the
+// sender it was issued to.
+func NewAPIKeyAuth(keys map[string]string) (*APIKeyAuth, error) {
+	a := &APIKeyAuth{senders: make(map[[sha256.Size]byte]string, len(keys))}
+	for key, sender := range keys {
+		if key == "" || sender == "" {
+			return nil, errors.New("API keys need a key and a sender")
+		}
+		a.senders[sha256.Sum256([]byte(key))] = sender
+	}
+	return a, nil
+}
+
+// Name returns AuthAPIKey.
+func (a *APIKeyAuth) Name() string { return AuthAPIKey }
+
+// Authenticate returns the sender the key in r's APIKeyHeader was issued to.
+func (a *APIKeyAuth) Authenticate(ctx context.Context, r *http.Request, req *pb.PushRequest) (string, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	sender, ok := a.senders[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", errors.New("unknown API key")
+	}
+	return sender, nil
+}
+
+// ClientCertAuth accepts pushes over connections authenticated with a
+// client certificate, mapping the certificate's subject to a sender. The
+// certificate is the one verified by the gateway's own TLS listener or, if
+// a header is set, the subject a TLS-terminating trusted proxy passes in it.
+type ClientCertAuth struct {
+	senders map[string]string
+	header  string
+}
+
+// NewClientCertAuth creates a ClientCertAuth mapping certificate subjects,
+// each a distinguished name in RFC 2253 form or a common name, to senders.
+// header, if not empty, names the header in which trusted proxies pass the
+// subject of the client certificate they verified.
+func NewClientCertAuth(senders map[string]string, header string) (*ClientCertAuth, error) {
+	for subject, sender := range senders {
+		if subject == "" || sender == "" {
+			return nil, errors.New("client certificate mappings need a subject and a sender")
+		}
+	}
+	return &ClientCertAuth{senders: senders, header: header}, nil
+}
+
+// Name returns AuthClientCert.
+func (a *ClientCertAuth) Name() string { return AuthClientCert }
+
+// Authenticate returns the sender mapped to the subject of r's client
+// certificate.
+func (a *ClientCertAuth) Authenticate(ctx context.Context, r *http.Request, req *pb.PushRequest) (string, error) {
+	var dn, cn string
+	switch {
+	case r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		dn, cn = subject.String(), subject.CommonName
+	case a.header != "" && r.Header.Get(a.header) != "" && fromTrustedProxy(r):
+		dn = r.Header.Get(a.header)
+		cn = commonName(dn)
+	default:
+		return "", ErrNoCredentials
+	}
+	if sender, ok := a.senders[dn]; ok {
+		return sender, nil
+	}
+	if sender, ok := a.senders[cn]; ok && cn != "" {
+		return sender, nil
+	}
+	return "", fmt.Errorf("no sender for certificate %q", dn)
+}
+
+// commonName returns the CN attribute of dn, a distinguished name in
+// RFC 2253 form, or "" if it has none.
+func commonName(dn string) string {
+	var attr strings.Builder
+	escaped := false
+	flush := func() string {
+		if name, value, ok := strings.Cut(attr.String(), "="); ok && strings.EqualFold(strings.TrimSpace(name), "CN") {
+			return strings.TrimSpace(value)
+		}
+		attr.Reset()
+		return ""
+	}
+	for _, ch := range dn {
+		switch {
+		case escaped:
+			attr.WriteRune(ch)
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case ch == ',' || ch == '+':
+			if cn := flush(); cn != "" {
+				return cn
+			}
+		default:
+			attr.WriteRune(ch)
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+)
+
+func newTestAuthChain(t *testing.T, verifier PushVerifier) *AuthChain {
+	t.Helper()
+	keys, err := NewAPIKeyAuth(map[string]string{"key-alice": "alice@oc"})
+	if err != nil {
+		t.Fatalf("NewAPIKeyAuth() error = %v", err)
+	}
+	certs, err := NewClientCertAuth(map[string]string{"billing": "billing@oc"}, "X-SSL-Client-DN")
+	if err != nil {
+		t.Fatalf("NewClientCertAuth() error = %v", err)
+	}
+	chain, err := NewAuthChain(NewSignatureAuth(verifier), keys, certs)
+	if err != nil {
+		t.Fatalf("NewAuthChain() error = %v", err)
+	}
+	return chain
+}
+
+func TestAuthChain_FirstSuccessWins(t *testing.T) {
+	chain := newTestAuthChain(t, &mockOurCloudClient{verifyResult: false})
+
+	tests := []struct {
+		name    string
+		sender  string
+		sig     []byte
+		setup   func(r *http.Request)
+		want    string
+		wantErr bool
+	}{
+		{name: "no credentials", sender: "alice@oc", wantErr: true},
+		{name: "bad signature, good key", sender: "alice@oc", sig: []byte("forged"),
+			setup: func(r *http.Request) { r.Header.Set(APIKeyHeader, "key-alice") }, want: AuthAPIKey},
+		{name: "key of another sender", sender: "mallory@oc",
+			setup: func(r *http.Request) { r.Header.Set(APIKeyHeader, "key-alice") }, wantErr: true},
+		{name: "unknown key", sender: "alice@oc",
+			setup: func(r *http.Request) { r.Header.Set(APIKeyHeader, "guess") }, wantErr: true},
+		{name: "verified certificate", sender: "billing@oc",
+			setup: func(r *http.Request) {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing", Organization: []string{"OurCloud"}}}
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}, want: AuthClientCert},
+		{name: "subject header from trusted proxy", sender: "billing@oc",
+			setup: func(r *http.Request) {
+				r.Header.Set("X-SSL-Client-DN", `O=OurCloud\, Inc.,CN=billing`)
+				*r = *r.WithContext(context.WithValue(r.Context(), trustedPeerKey{}, true))
+			}, want: AuthClientCert},
+		{name: "subject header from client", sender: "billing@oc",
+			setup: func(r *http.Request) { r.Header.Set("X-SSL-Client-DN", "CN=billing") }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/push", nil)
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			got, err := chain.Authenticate(context.Background(), r, &pb.PushRequest{SenderUsername: tt.sender, Signature: tt.sig})
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("Authenticate() = %q, %v; want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	stats := chain.Stats()
+	if stats.Accepted[AuthAPIKey] != 1 || stats.Accepted[AuthClientCert] != 2 || stats.Rejected != 4 {
+		t.Errorf("stats = %+v, want 1 by api_key, 2 by client_cert, 4 rejected", stats)
+	}
+}
+
+func TestAuthChain_OurCloudUnavailable(t *testing.T) {
+	chain := newTestAuthChain(t, &mockOurCloudClient{verifyErr: ourcloud.ErrUnavailable})
+
+	r := httptest.NewRequest(http.MethodPost, "/push", nil)
+	_, err := chain.Authenticate(context.Background(), r, &pb.PushRequest{SenderUsername: "alice@oc", Signature: []byte("sig")})
+	if !errors.Is(err, ourcloud.ErrUnavailable) {
+		t.Errorf("Authenticate() error = %v, want ourcloud.ErrUnavailable", err)
+	}
+}
+
+func TestNewAuthChain_RejectsDuplicates(t *testing.T) {
+	sig := NewSignatureAuth(&mockOurCloudClient{})
+	if _, err := NewAuthChain(sig, sig); err == nil {
+		t.Error("NewAuthChain() with an authenticator listed twice succeeded, want an error")
+	}
+}
+
+func TestHandlePush_APIKeyWithoutSignature(t *testing.T) {
+	mock := &mockOurCloudClient{
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "device1", FcmToken: "token1"}},
+		},
+	}
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewPushHandlerWithClient(mock, b)
+	h.SetAuthChain(newTestAuthChain(t, mock))
+
+	body := marshalPushRequest(t, &pb.PushRequest{SenderUsername: "alice@oc", TargetUsername: "bob@oc"})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set(APIKeyHeader, "key-alice")
+	rr := httptest.NewRecorder()
+	h.HandlePush(rr, req)
+
+	if resp := parsePushResponse(t, rr); !resp.Accepted {
+		t.Errorf("push with an API key rejected: error_code=%d, %q", resp.ErrorCode, resp.Message)
+	}
+}
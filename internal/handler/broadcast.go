@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// AdminActorHeader optionally names the operator making an admin request.
+// It is recorded in the broadcast audit log and the audit lines of component
+// reloads; the remote address is used when absent.
+const AdminActorHeader = "X-Admin-Actor"
+
+// defaultBroadcastListLimit is used when GET /admin/broadcasts has no limit parameter.
+const defaultBroadcastListLimit = 50
+
+// maxBroadcastListLimit caps the limit parameter of GET /admin/broadcasts.
+const maxBroadcastListLimit = 1000
+
+// broadcastsSent counts successful topic broadcasts.
+var broadcastsSent = expvar.NewInt("broadcasts_sent")
+
+// Broadcaster sends to and manages FCM topics.
+// *fcm.Sender implements this interface.
+type Broadcaster interface {
+	SendToTopic(ctx context.Context, topic string, dataIDs [][]byte, opts fcm.SendOptions) (string, error)
+	SubscribeToTopic(ctx context.Context, topic string, fcmTokens []string) (*fcm.TopicResult, error)
+	UnsubscribeFromTopic(ctx context.Context, topic string, fcmTokens []string) (*fcm.TopicResult, error)
+}
+
+// BroadcastAuditor records and lists broadcasts.
+// store.Store implements this interface.
+type BroadcastAuditor interface {
+	RecordBroadcast(ctx context.Context, b store.Broadcast) error
+	ListBroadcasts(ctx context.Context, limit int) ([]store.Broadcast, error)
+}
+
+// BroadcastHandler handles operator broadcasts to FCM topics, such as
+// maintenance announcements to an "all-devices" topic.
+type BroadcastHandler struct {
+	sender Broadcaster
+	audit  BroadcastAuditor
+	topics map[string]bool // allowed topics; empty allows any valid topic
+}
+
+// NewBroadcastHandler creates a new BroadcastHandler. If topics is non-empty,
+// only those topics can be broadcast to or managed.
+func NewBroadcastHandler(sender Broadcaster, audit BroadcastAuditor, topics []string) *BroadcastHandler {
+	allowed := make(map[string]bool, len(topics))
+	for _, t := range topics {
+		allowed[t] = true
+	}
+	return &BroadcastHandler{
+		sender: sender,
+		audit:  audit,
+		topics: allowed,
+	}
+}
+
+// BroadcastRequest is the JSON body for POST /admin/broadcast.
+type BroadcastRequest struct {
+	Topic   string   `json:"topic"`
+	DataIDs [][]byte `json:"data_ids,omitempty"` // base64-encoded
+	Title   string   `json:"title,omitempty"`
+	Body    string   `json:"body,omitempty"`
+	TTL     string   `json:"ttl,omitempty"` // Go duration, e.g. "1h"
+}
+
+// BroadcastResponse is the JSON response for POST /admin/broadcast.
+type BroadcastResponse struct {
+	MessageID string `json:"message_id"`
+}
+
+// TopicTokensRequest is the JSON body for topic subscription changes.
+type TopicTokensRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
+// BroadcastRecord is one entry in the GET /admin/broadcasts response.
+type BroadcastRecord struct {
+	Topic       string    `json:"topic"`
+	DataIDCount int       `json:"data_id_count"`
+	Title       string    `json:"title,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	SentAt      time.Time `json:"sent_at"`
+}
+
+// HandleBroadcast handles POST /admin/broadcast requests.
+// Every attempt that reaches FCM is recorded in the audit log, successful or not.
+//
+// HTTP Status Codes:
+//   - 200 OK: Broadcast sent
+//   - 400 Bad Request: Invalid body, topic, or TTL
+//   - 403 Forbidden: Topic not in the allowed list
+//   - 502 Bad Gateway: FCM rejected the broadcast
+//   - 503 Service Unavailable: FCM rate limit reached; retry later
+func (h *BroadcastHandler) HandleBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req BroadcastRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid request body")
+		return
+	}
+	if !h.checkTopic(w, r, req.Topic) {
+		return
+	}
+	if len(req.DataIDs) == 0 && req.Title == "" && req.Body == "" {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "data_ids or title/body is required")
+		return
+	}
+
+	opts := fcm.SendOptions{Title: req.Title, Body: req.Body}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid ttl")
+			return
+		}
+		opts.TTL = ttl
+	}
+
+	ctx := r.Context()
+	messageID, err := h.sender.SendToTopic(ctx, req.Topic, req.DataIDs, opts)
+
+	var rateLimited *fcm.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		// Nothing was sent, so there is nothing to audit
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.RetryAfter().Seconds()))))
+		WriteError(w, r, http.StatusServiceUnavailable, CodeRateLimited, "FCM rate limit reached")
+		return
+	}
+
+	record := store.Broadcast{
+		Topic:       req.Topic,
+		DataIDCount: len(req.DataIDs),
+		Title:       req.Title,
+		Actor:       actor(r),
+		MessageID:   messageID,
+		SentAt:      time.Now(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if auditErr := h.audit.RecordBroadcast(ctx, record); auditErr != nil {
+		log.Printf("ERROR: failed to audit broadcast to %s: %v", req.Topic, auditErr)
+	}
+	log.Printf("INFO: broadcast to topic %s by %s (message %q, error %q)", record.Topic, record.Actor, messageID, record.Error)
+
+	if err != nil {
+		WriteError(w, r, http.StatusBadGateway, CodeUpstreamFailed, "broadcast failed")
+		return
+	}
+	broadcastsSent.Add(1)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&BroadcastResponse{MessageID: messageID})
+}
+
+// HandleListBroadcasts handles GET /admin/broadcasts?limit=50 requests,
+// listing the most recent broadcasts, newest first.
+//
+// HTTP Status Codes:
+//   - 200 OK: Broadcasts listed (possibly empty)
+//   - 400 Bad Request: Invalid limit
+//   - 500 Internal Server Error: Database error
+func (h *BroadcastHandler) HandleListBroadcasts(w http.ResponseWriter, r *http.Request) {
+	limit := defaultBroadcastListLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxBroadcastListLimit {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	broadcasts, err := h.audit.ListBroadcasts(r.Context(), limit)
+	if err != nil {
+		log.Printf("ERROR: listing broadcasts: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	resp := make([]BroadcastRecord, 0, len(broadcasts))
+	for _, b := range broadcasts {
+		resp = append(resp, BroadcastRecord{
+			Topic:       b.Topic,
+			DataIDCount: b.DataIDCount,
+			Title:       b.Title,
+			Actor:       b.Actor,
+			MessageID:   b.MessageID,
+			Error:       b.Error,
+			SentAt:      b.SentAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleSubscribe handles POST /admin/topics/{topic}/subscribe requests.
+func (h *BroadcastHandler) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	h.handleTopicTokens(w, r, h.sender.SubscribeToTopic)
+}
+
+// HandleUnsubscribe handles POST /admin/topics/{topic}/unsubscribe requests.
+func (h *BroadcastHandler) HandleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	h.handleTopicTokens(w, r, h.sender.UnsubscribeFromTopic)
+}
+
+// handleTopicTokens applies a subscription change to the tokens in the body.
+// Per-token failures are reported in the 200 response body.
+//
+// HTTP Status Codes:
+//   - 200 OK: Request processed; see success_count and failure_count
+//   - 400 Bad Request: Invalid body or topic
+//   - 403 Forbidden: Topic not in the allowed list
+//   - 502 Bad Gateway: FCM rejected the request
+func (h *BroadcastHandler) handleTopicTokens(w http.ResponseWriter, r *http.Request, op func(context.Context, string, []string) (*fcm.TopicResult, error)) {
+	topic := chi.URLParam(r, "topic")
+	if !h.checkTopic(w, r, topic) {
+		return
+	}
+
+	var req TopicTokensRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Tokens) == 0 {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "tokens are required")
+		return
+	}
+
+	result, err := op(r.Context(), topic, req.Tokens)
+	if err != nil {
+		log.Printf("ERROR: topic %s subscription change failed: %v", topic, err)
+		WriteError(w, r, http.StatusBadGateway, CodeUpstreamFailed, "topic update failed")
+		return
+	}
+
+	log.Printf("INFO: topic %s subscription change by %s: %d succeeded, %d failed", topic, actor(r), result.SuccessCount, result.FailureCount)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkTopic validates topic, writing an error response if it can't be used.
+func (h *BroadcastHandler) checkTopic(w http.ResponseWriter, r *http.Request, topic string) bool {
+	if !fcm.ValidTopic(topic) {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid topic")
+		return false
+	}
+	if len(h.topics) > 0 && !h.topics[topic] {
+		WriteError(w, r, http.StatusForbidden, CodePermissionDenied, "topic not allowed")
+		return false
+	}
+	return true
+}
+
+// actor identifies who made an admin request, for auditing.
+func actor(r *http.Request) string {
+	if a := r.Header.Get(AdminActorHeader); a != "" {
+		return a
+	}
+	return ClientIP(r)
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// mockBroadcaster records topic sends and subscription changes.
+type mockBroadcaster struct {
+	sendErr    error
+	topic      string
+	opts       fcm.SendOptions
+	subscribed []string
+}
+
+func (m *mockBroadcaster) SendToTopic(ctx context.Context, topic string, dataIDs [][]byte, opts fcm.SendOptions) (string, error) {
+	m.topic = topic
+	m.opts = opts
+	if m.sendErr != nil {
+		return "", m.sendErr
+	}
+	return "projects/test/messages/1", nil
+}
+
+func (m *mockBroadcaster) SubscribeToTopic(ctx context.Context, topic string, fcmTokens []string) (*fcm.TopicResult, error) {
+	m.subscribed = append(m.subscribed, fcmTokens...)
+	return &fcm.TopicResult{SuccessCount: len(fcmTokens)}, nil
+}
+
+func (m *mockBroadcaster) UnsubscribeFromTopic(ctx context.Context, topic string, fcmTokens []string) (*fcm.TopicResult, error) {
+	return &fcm.TopicResult{SuccessCount: len(fcmTokens)}, nil
+}
+
+// mockAuditor keeps broadcasts in memory.
+type mockAuditor struct {
+	broadcasts []store.Broadcast
+}
+
+func (m *mockAuditor) RecordBroadcast(ctx context.Context, b store.Broadcast) error {
+	m.broadcasts = append(m.broadcasts, b)
+	return nil
+}
+
+func (m *mockAuditor) ListBroadcasts(ctx context.Context, limit int) ([]store.Broadcast, error) {
+	return m.broadcasts, nil
+}
+
+func TestHandleBroadcast_SendsAndAudits(t *testing.T) {
+	sender := &mockBroadcaster{}
+	audit := &mockAuditor{}
+	h := NewBroadcastHandler(sender, audit, nil)
+
+	body := `{"topic": "all-devices", "data_ids": ["AQI="], "title": "Maintenance", "body": "Back soon", "ttl": "1h"}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader(body))
+	req.Header.Set(AdminActorHeader, "ops@example.com")
+	rr := httptest.NewRecorder()
+
+	h.HandleBroadcast(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var resp BroadcastResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.MessageID != "projects/test/messages/1" {
+		t.Errorf("message_id = %q", resp.MessageID)
+	}
+	if sender.topic != "all-devices" || sender.opts.Title != "Maintenance" || sender.opts.TTL != time.Hour {
+		t.Errorf("sent topic=%q opts=%+v", sender.topic, sender.opts)
+	}
+
+	if len(audit.broadcasts) != 1 {
+		t.Fatalf("expected 1 audit record, got %d", len(audit.broadcasts))
+	}
+	rec := audit.broadcasts[0]
+	if rec.Actor != "ops@example.com" || rec.DataIDCount != 1 || rec.MessageID != resp.MessageID || rec.Error != "" {
+		t.Errorf("audit record = %+v", rec)
+	}
+}
+
+func TestHandleBroadcast_Failures(t *testing.T) {
+	tests := []struct {
+		name      string
+		topics    []string
+		sendErr   error
+		body      string
+		want      int
+		wantAudit int
+	}{
+		{name: "invalid json", body: `{`, want: http.StatusBadRequest},
+		{name: "invalid topic", body: `{"topic": "has space", "title": "x"}`, want: http.StatusBadRequest},
+		{name: "topic not allowed", topics: []string{"all-devices"}, body: `{"topic": "beta", "title": "x"}`, want: http.StatusForbidden},
+		{name: "empty message", body: `{"topic": "all-devices"}`, want: http.StatusBadRequest},
+		{name: "invalid ttl", body: `{"topic": "all-devices", "title": "x", "ttl": "soon"}`, want: http.StatusBadRequest},
+		{name: "rate limited", sendErr: &fcm.RateLimitedError{Delay: 1500 * time.Millisecond}, body: `{"topic": "all-devices", "title": "x"}`, want: http.StatusServiceUnavailable},
+		{name: "fcm error", sendErr: errors.New("quota exceeded"), body: `{"topic": "all-devices", "title": "x"}`, want: http.StatusBadGateway, wantAudit: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit := &mockAuditor{}
+			h := NewBroadcastHandler(&mockBroadcaster{sendErr: tt.sendErr}, audit, tt.topics)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			h.HandleBroadcast(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if len(audit.broadcasts) != tt.wantAudit {
+				t.Errorf("audit records = %d, want %d", len(audit.broadcasts), tt.wantAudit)
+			}
+			if tt.want == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "2" {
+				t.Errorf("Retry-After = %q, want %q", rr.Header().Get("Retry-After"), "2")
+			}
+		})
+	}
+}
+
+func TestHandleSubscribe(t *testing.T) {
+	sender := &mockBroadcaster{}
+	h := NewBroadcastHandler(sender, &mockAuditor{}, []string{"all-devices"})
+
+	r := chi.NewRouter()
+	r.Post("/admin/topics/{topic}/subscribe", h.HandleSubscribe)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/topics/all-devices/subscribe", strings.NewReader(`{"tokens": ["t1", "t2"]}`))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var result fcm.TopicResult
+	if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.SuccessCount != 2 || len(sender.subscribed) != 2 {
+		t.Errorf("result = %+v, subscribed = %v", result, sender.subscribed)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/topics/other/subscribe", strings.NewReader(`{"tokens": ["t1"]}`))
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d for disallowed topic", rr.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+)
+
+// CancelHandler lets senders withdraw pushes whose batch hasn't flushed,
+// or that are scheduled for later delivery.
+type CancelHandler struct {
+	batcher  *batcher.Batcher
+	verifier SignatureVerifier
+}
+
+// NewCancelHandler creates a new CancelHandler.
+func NewCancelHandler(b *batcher.Batcher, verifier SignatureVerifier) *CancelHandler {
+	return &CancelHandler{
+		batcher:  b,
+		verifier: verifier,
+	}
+}
+
+// HandleCancel handles DELETE /push/{request_id} requests. The request must
+// be signed by the push's sender: SignatureHeader holds their signature of
+// SignedRequestMessage over the method, path, and TimestampHeader.
+//
+// HTTP Status Codes:
+//   - 204 No Content: Removed from its batch, or from the scheduled pushes;
+//     status is now cancelled
+//   - 401 Unauthorized: Missing, stale, or invalid signature
+//   - 403 Forbidden: The push has no sender who could authorize it
+//   - 404 Not Found: Request ID not found, expired, or awaiting recovery
+//   - 409 Conflict: Too late, the request is no longer pending
+//   - 500 Internal Server Error: Database error
+func (h *CancelHandler) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	requestID := chi.URLParam(r, "request_id")
+
+	sender, err := h.batcher.PendingSender(r.Context(), requestID)
+	if errors.Is(err, batcher.ErrNotPending) {
+		h.notPending(w, r, requestID)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: looking up request %s to cancel: %v", requestID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+	if sender == "" {
+		WriteError(w, r, http.StatusForbidden, CodePermissionDenied, "request has no sender to authorize cancellation")
+		return
+	}
+
+	if msg := verifySignedRequest(r, h.verifier, sender); msg != "" {
+		WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, msg)
+		return
+	}
+
+	err = h.batcher.Cancel(r.Context(), requestID, sender)
+	if errors.Is(err, batcher.ErrNotPending) {
+		h.notPending(w, r, requestID)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: cancelling request %s: %v", requestID, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notPending responds to a cancellation of a request no batch holds: 409
+// with its current state if it has a status, 404 if not.
+func (h *CancelHandler) notPending(w http.ResponseWriter, r *http.Request, requestID string) {
+	status, err := h.batcher.GetStatus(r.Context(), requestID)
+	if err != nil {
+		WriteError(w, r, http.StatusNotFound, CodeNotFound, "request not found")
+		return
+	}
+	WriteError(w, r, http.StatusConflict, CodeConflict, "request is no longer pending: "+status.State)
+}
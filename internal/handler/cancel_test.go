@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestHandleCancel(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+
+	alicePub, aliceKey, _ := ed25519.GenerateKey(nil)
+	_, bobKey, _ := ed25519.GenerateKey(nil)
+	h := NewCancelHandler(b, &mockConsentInspector{keys: map[string]ed25519.PublicKey{"alice@oc": alicePub}})
+	r := chi.NewRouter()
+	r.Delete("/push/{request_id}", h.HandleCancel)
+
+	requestID, err := b.QueueWithOptions(context.Background(), "bob@oc", "test-token", [][]byte{{1}}, batcher.QueueOptions{Sender: "alice@oc"})
+	if err != nil {
+		t.Fatalf("failed to queue: %v", err)
+	}
+
+	cancel := func(id string, key ed25519.PrivateKey) int {
+		t.Helper()
+		path := "/push/" + id
+		req := httptest.NewRequest(http.MethodDelete, path, nil)
+		if key != nil {
+			now := strconv.FormatInt(time.Now().Unix(), 10)
+			req.Header.Set(TimestampHeader, now)
+			req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedRequestMessage(http.MethodDelete, path, now))))
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := cancel(requestID, nil); code != http.StatusUnauthorized {
+		t.Errorf("unsigned: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := cancel(requestID, bobKey); code != http.StatusUnauthorized {
+		t.Errorf("signed by recipient: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := cancel("unknown-id", aliceKey); code != http.StatusNotFound {
+		t.Errorf("unknown request: status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := cancel(requestID, aliceKey); code != http.StatusNoContent {
+		t.Fatalf("signed by sender: status = %d, want %d", code, http.StatusNoContent)
+	}
+
+	status, err := b.GetStatus(context.Background(), requestID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if status.State != store.StatusCancelled {
+		t.Errorf("state = %s, want %s", status.State, store.StatusCancelled)
+	}
+	if code := cancel(requestID, aliceKey); code != http.StatusConflict {
+		t.Errorf("already cancelled: status = %d, want %d", code, http.StatusConflict)
+	}
+}
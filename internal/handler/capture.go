@@ -0,0 +1,377 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// capturedHeaderPrefix selects the request headers a capture keeps, besides
+// Content-Type: the push options, such as ExpiresAtHeader. Credentials are
+// never kept, even under the prefix.
+const capturedHeaderPrefix = "X-Push-"
+
+// errCaptureDuration rejects a capture duration out of range.
+var errCaptureDuration = errors.New("invalid capture duration")
+
+// CapturedRequest is a POST /push request recorded by a CaptureBuffer, for
+// cmd/replay to send again.
+type CapturedRequest struct {
+	CapturedAt time.Time         `json:"captured_at"`
+	TraceID    string            `json:"trace_id,omitempty"`
+	Headers    map[string]string `json:"headers"`
+	Body       []byte            `json:"body"`
+	// Scrubbed is set when the data IDs were replaced and the signature and
+	// passthrough fields removed. The body is then protobuf.
+	Scrubbed bool `json:"scrubbed,omitempty"`
+	// Status is the HTTP status the gateway answered with.
+	Status int `json:"status"`
+}
+
+// CaptureStatus describes a CaptureBuffer, for GET /admin/capture.
+type CaptureStatus struct {
+	Active   bool       `json:"active"`
+	Until    *time.Time `json:"until,omitempty"`
+	Scrub    bool       `json:"scrub"`
+	Captured int64      `json:"captured"` // requests captured since startup
+	Buffered int        `json:"buffered"` // requests held for GET /admin/capture/requests
+	File     string     `json:"file,omitempty"`
+}
+
+// CaptureBuffer records POST /push requests while an operator has switched
+// capture on, keeping the latest in a ring buffer and optionally appending
+// them to a file, to reproduce bugs with cmd/replay. Capture turns
+// itself off when the time it was started for runs out. It is safe for
+// concurrent use.
+type CaptureBuffer struct {
+	maxDuration time.Duration
+	path        string
+	credentials map[string]bool // canonical names of headers never captured
+
+	mu       sync.Mutex
+	ring     []CapturedRequest
+	next     int // index the next request is written to
+	buffered int
+	until    time.Time
+	scrub    bool
+	file     *os.File // open while capturing, when path is set
+	captured int64
+}
+
+// NewCaptureBuffer returns a buffer keeping the last size requests, which
+// captures for at most maxDuration at a time. With path set, captured
+// requests are also appended to that file as JSON lines.
+func NewCaptureBuffer(size int, maxDuration time.Duration, path string) *CaptureBuffer {
+	c := &CaptureBuffer{
+		maxDuration: maxDuration,
+		path:        path,
+		credentials: make(map[string]bool),
+		ring:        make([]CapturedRequest, size),
+	}
+	c.ExcludeHeaders(SignatureHeader, APIKeyHeader, ForwardSignatureHeader)
+	return c
+}
+
+// ExcludeHeaders keeps the named headers out of captures, in addition to
+// SignatureHeader and APIKeyHeader, for headers carrying credentials such as
+// a client certificate passed by a proxy. It must be called before the
+// middleware serves requests.
+func (c *CaptureBuffer) ExcludeHeaders(names ...string) {
+	for _, name := range names {
+		c.credentials[http.CanonicalHeaderKey(name)] = true
+	}
+}
+
+// Start captures requests for d, replacing an earlier deadline. With scrub,
+// data IDs are replaced and signatures and passthrough fields removed before
+// requests are kept.
+func (c *CaptureBuffer) Start(d time.Duration, scrub bool) error {
+	if d <= 0 || d > c.maxDuration {
+		return fmt.Errorf("%w: must be more than 0 and at most %s", errCaptureDuration, c.maxDuration)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path != "" && c.file == nil {
+		f, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("opening capture file: %w", err)
+		}
+		c.file = f
+	}
+	c.until = time.Now().Add(d)
+	c.scrub = scrub
+	return nil
+}
+
+// Stop ends capturing. The buffered requests are kept.
+func (c *CaptureBuffer) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.until = time.Time{}
+	c.closeFileLocked()
+}
+
+// closeFileLocked closes the capture file, if open. Caller must hold c.mu.
+func (c *CaptureBuffer) closeFileLocked() {
+	if c.file == nil {
+		return
+	}
+	if err := c.file.Close(); err != nil {
+		log.Printf("WARNING: closing capture file: %v", err)
+	}
+	c.file = nil
+}
+
+// activeLocked reports whether requests are being captured, closing the
+// file once the deadline has passed. Caller must hold c.mu.
+func (c *CaptureBuffer) activeLocked(now time.Time) bool {
+	if now.Before(c.until) {
+		return true
+	}
+	c.closeFileLocked()
+	return false
+}
+
+// capturing reports whether requests are being captured, and if so whether
+// they are scrubbed.
+func (c *CaptureBuffer) capturing() (active, scrub bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.activeLocked(time.Now()), c.scrub
+}
+
+// add keeps req, overwriting the oldest request when the buffer is full.
+func (c *CaptureBuffer) add(req CapturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.activeLocked(req.CapturedAt) {
+		return
+	}
+	c.captured++
+	if len(c.ring) > 0 {
+		c.ring[c.next] = req
+		c.next = (c.next + 1) % len(c.ring)
+		c.buffered = min(c.buffered+1, len(c.ring))
+	}
+	if c.file != nil {
+		if err := json.NewEncoder(c.file).Encode(req); err != nil {
+			log.Printf("WARNING: writing capture file: %v", err)
+		}
+	}
+}
+
+// Requests returns the buffered requests, oldest first.
+func (c *CaptureBuffer) Requests() []CapturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reqs := make([]CapturedRequest, 0, c.buffered)
+	start := (c.next - c.buffered + len(c.ring)) % max(len(c.ring), 1)
+	for i := 0; i < c.buffered; i++ {
+		reqs = append(reqs, c.ring[(start+i)%len(c.ring)])
+	}
+	return reqs
+}
+
+// Status describes whether requests are being captured, and how many were.
+func (c *CaptureBuffer) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := CaptureStatus{
+		Active:   c.activeLocked(time.Now()),
+		Captured: c.captured,
+		Buffered: c.buffered,
+		File:     c.path,
+	}
+	if status.Active {
+		until := c.until
+		status.Until = &until
+		status.Scrub = c.scrub
+	}
+	return status
+}
+
+// Middleware captures the requests next handles while capture is on. The
+// body is read ahead and handed on unchanged; one that can't be read in
+// full, such as one over the route's max_body, isn't captured.
+func (c *CaptureBuffer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active, scrub := c.capturing()
+		if !active {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			// Let the handler see the same failure
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		captured := CapturedRequest{
+			CapturedAt: time.Now(),
+			TraceID:    middleware.GetReqID(r.Context()),
+			Headers:    make(map[string]string),
+			Body:       body,
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			captured.Headers["Content-Type"] = ct
+		}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, capturedHeaderPrefix) && !c.credentials[name] {
+				captured.Headers[name] = values[0]
+			}
+		}
+		if scrub {
+			captured.Scrubbed = true
+			captured.Body, err = scrubPushBody(captured.Headers["Content-Type"], body)
+			if err != nil {
+				// Unparseable bodies aren't kept, as they can't be scrubbed
+				captured.Body = nil
+			}
+			captured.Headers["Content-Type"] = "application/x-protobuf"
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		captured.Status = ww.Status()
+		c.add(captured)
+	})
+}
+
+// scrubPushBody decodes a PushRequest body, replaces its data IDs with
+// hashes of the same length, so repeated IDs stay repeated, removes the
+// signature and unknown fields, and encodes it as protobuf.
+func scrubPushBody(contentType string, body []byte) ([]byte, error) {
+	var req pb.PushRequest
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var err error
+	if mediaType == "application/json" {
+		err = protojson.Unmarshal(body, &req)
+	} else {
+		err = proto.Unmarshal(body, &req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range req.DataIds {
+		req.DataIds[i] = scrubID(id)
+	}
+	req.Signature = nil
+	req.ProtoReflect().SetUnknown(nil)
+	return proto.Marshal(&req)
+}
+
+// scrubID returns an ID as long as id derived from its SHA-256 hash.
+func scrubID(id []byte) []byte {
+	sum := sha256.Sum256(id)
+	scrubbed := make([]byte, len(id))
+	for i := range scrubbed {
+		scrubbed[i] = sum[i%len(sum)]
+	}
+	return scrubbed
+}
+
+// ReadCapturedRequests reads requests written as JSON lines by
+// GET /admin/capture/requests or to admin.capture.file.
+func ReadCapturedRequests(r io.Reader) ([]CapturedRequest, error) {
+	var reqs []CapturedRequest
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var req CapturedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, scanner.Err()
+}
+
+// HandleStartCapture handles POST /admin/capture?duration=10m&scrub=true
+// requests, capturing POST /push requests for duration, at most
+// admin.capture.max_duration. A capture already running is given the new
+// duration and scrub setting.
+//
+// HTTP Status Codes:
+//   - 200 OK: Capturing; the capture status is returned
+//   - 400 Bad Request: Invalid or too long duration, or invalid scrub
+//   - 500 Internal Server Error: The capture file can't be opened
+func (h *AdminHandler) HandleStartCapture(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid duration")
+		return
+	}
+	scrub := false
+	if v := r.URL.Query().Get("scrub"); v != "" {
+		if scrub, err = strconv.ParseBool(v); err != nil {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid scrub")
+			return
+		}
+	}
+	if err := h.capture.Start(d, scrub); err != nil {
+		if errors.Is(err, errCaptureDuration) {
+			WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, err.Error())
+			return
+		}
+		log.Printf("ERROR: starting capture: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	log.Printf("INFO: capturing push requests for %s (scrub=%t)", d, scrub)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.capture.Status())
+}
+
+// HandleStopCapture handles DELETE /admin/capture requests. Requests
+// captured so far stay available.
+//
+// HTTP Status Codes:
+//   - 204 No Content: Capture stopped, or wasn't running
+func (h *AdminHandler) HandleStopCapture(w http.ResponseWriter, r *http.Request) {
+	h.capture.Stop()
+	log.Printf("INFO: stopped capturing push requests")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCaptureStatus handles GET /admin/capture requests.
+func (h *AdminHandler) HandleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.capture.Status())
+}
+
+// HandleExportCaptures handles GET /admin/capture/requests, writing the
+// buffered requests as JSON lines, oldest first, for cmd/replay.
+func (h *AdminHandler) HandleExportCaptures(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, req := range h.capture.Requests() {
+		if err := enc.Encode(req); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCaptureBuffer_Middleware(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	c := NewCaptureBuffer(2, time.Hour, file)
+	c.ExcludeHeaders("x-push-client-subject")
+	var handled [][]byte
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		handled = append(handled, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	send := func(body string) {
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set(ExpiresAtHeader, "1700000000")
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set(APIKeyHeader, "live-key")
+		req.Header.Set("X-Push-Client-Subject", "CN=app")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("before")
+	if err := c.Start(time.Minute, false); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	send("one")
+	send("two")
+	send("three")
+	c.Stop()
+	send("after")
+
+	if len(handled) != 5 || string(handled[2]) != "two" {
+		t.Errorf("handler saw bodies %q, want every body unchanged", handled)
+	}
+	reqs := c.Requests()
+	if len(reqs) != 2 || string(reqs[0].Body) != "two" || string(reqs[1].Body) != "three" {
+		t.Fatalf("Requests() = %+v, want the last two captured, oldest first", reqs)
+	}
+	if got := reqs[0]; got.Status != http.StatusAccepted || got.Headers[ExpiresAtHeader] != "1700000000" || len(got.Headers) != 2 {
+		t.Errorf("captured request = %+v, want status 202 and only Content-Type and the push options", got)
+	}
+	if status := c.Status(); status.Active || status.Captured != 3 {
+		t.Errorf("Status() = %+v, want inactive with 3 captured", status)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("opening capture file: %v", err)
+	}
+	defer f.Close()
+	fromFile, err := ReadCapturedRequests(f)
+	if err != nil {
+		t.Fatalf("ReadCapturedRequests() error = %v", err)
+	}
+	if len(fromFile) != 3 || string(fromFile[0].Body) != "one" {
+		t.Errorf("capture file holds %d requests, want all 3 captured", len(fromFile))
+	}
+	for _, req := range fromFile {
+		if len(req.Headers) != 2 {
+			t.Errorf("capture file kept headers %v, want no credentials", req.Headers)
+		}
+	}
+
+	if err := c.Start(2*time.Hour, false); err == nil {
+		t.Error("Start() beyond the maximum duration succeeded, want an error")
+	}
+}
+
+func TestCaptureBuffer_Scrub(t *testing.T) {
+	c := NewCaptureBuffer(10, time.Hour, "")
+	if err := c.Start(time.Minute, true); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	h := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	id := []byte("secret-data-id")
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		DataIds:        [][]byte{id, id},
+		Signature:      []byte("sig"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	reqs := c.Requests()
+	if len(reqs) != 1 || !reqs[0].Scrubbed {
+		t.Fatalf("Requests() = %+v, want one scrubbed request", reqs)
+	}
+	var scrubbed pb.PushRequest
+	if err := proto.Unmarshal(reqs[0].Body, &scrubbed); err != nil {
+		t.Fatalf("decoding scrubbed body: %v", err)
+	}
+	if scrubbed.SenderUsername != "alice@oc" || scrubbed.Signature != nil {
+		t.Errorf("scrubbed request = %v, want the sender kept and no signature", &scrubbed)
+	}
+	ids := scrubbed.DataIds
+	if len(ids) != 2 || len(ids[0]) != len(id) || bytes.Equal(ids[0], id) || !bytes.Equal(ids[0], ids[1]) {
+		t.Errorf("scrubbed data IDs = %x, want two equal replacements as long as %x", ids, id)
+	}
+}
+
+func TestHandleStartCapture(t *testing.T) {
+	h := NewAdminHandler(nil, "secret")
+	h.SetCapture(NewCaptureBuffer(10, time.Hour, ""))
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{query: "duration=10m&scrub=true", want: http.StatusOK},
+		{query: "duration=2h", want: http.StatusBadRequest},
+		{query: "duration=soon", want: http.StatusBadRequest},
+		{query: "duration=1m&scrub=maybe", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		h.HandleStartCapture(rr, httptest.NewRequest(http.MethodPost, "/admin/capture?"+tt.query, nil))
+		if rr.Code != tt.want {
+			t.Errorf("POST /admin/capture?%s: status = %d, want %d", tt.query, rr.Code, tt.want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	h.HandleCaptureStatus(rr, httptest.NewRequest(http.MethodGet, "/admin/capture", nil))
+	var status CaptureStatus
+	json.NewDecoder(rr.Body).Decode(&status)
+	if !status.Active || !status.Scrub || status.Until == nil {
+		t.Errorf("GET /admin/capture = %+v, want an active scrubbing capture", status)
+	}
+}
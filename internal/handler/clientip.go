@@ -0,0 +1,146 @@
+// Package handler provides HTTP request handlers for the push gateway.
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIPKey is the context key for the resolved client IP.
+type clientIPKey struct{}
+
+// trustedPeerKey is the context key marking requests whose connection came
+// from a trusted proxy.
+type trustedPeerKey struct{}
+
+// TrustedProxies resolves the real client IP of requests that arrive through
+// reverse proxies or load balancers the operator trusts.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies parses proxies, each an IP address or CIDR range.
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	prefixes, err := parsePrefixes(proxies, "trusted proxy")
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{prefixes: prefixes}, nil
+}
+
+// parsePrefixes parses addrs, each an IP address or CIDR range, naming
+// them as what in errors.
+func parsePrefixes(addrs []string, what string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range addrs {
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", what, p, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", what, p, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// trusted reports whether addr belongs to a trusted proxy.
+func (t *TrustedProxies) trusted(addr netip.Addr) bool {
+	return containsAddr(t.prefixes, addr)
+}
+
+// containsAddr reports whether addr is in one of prefixes.
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware resolves each request's client IP and stores it for ClientIP.
+// It also replaces r.RemoteAddr with it, so request logs show the client
+// rather than the proxy.
+func (t *TrustedProxies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if peer, err := netip.ParseAddr(remoteHost(r.RemoteAddr)); err == nil && t.trusted(peer) {
+			ctx = context.WithValue(ctx, trustedPeerKey{}, true)
+		}
+		ip := t.resolve(r)
+		r.RemoteAddr = ip
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, clientIPKey{}, ip)))
+	})
+}
+
+// resolve returns the client IP for r. Forwarding headers are believed only
+// when the peer is a trusted proxy. X-Forwarded-For is read right to left,
+// skipping trusted proxies, so a client can't spoof its address by sending
+// the header itself; X-Real-IP is used when X-Forwarded-For is absent.
+func (t *TrustedProxies) resolve(r *http.Request) string {
+	peer := remoteHost(r.RemoteAddr)
+	peerAddr, err := netip.ParseAddr(peer)
+	if err != nil || !t.trusted(peerAddr) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break // Malformed hop: trust nothing further left
+			}
+			client = addr.Unmap().String()
+			if !t.trusted(addr) {
+				break
+			}
+		}
+		return client
+	}
+
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); real != "" {
+		if addr, err := netip.ParseAddr(real); err == nil {
+			return addr.Unmap().String()
+		}
+	}
+	return peer
+}
+
+// ClientIP returns the client IP for r, as resolved by
+// TrustedProxies.Middleware, or the connection's peer address without it.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// fromTrustedProxy reports whether r's connection came from a trusted
+// proxy, as found by TrustedProxies.Middleware, so headers the proxy sets
+// can be believed.
+func fromTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(trustedPeerKey{}).(bool)
+	return trusted
+}
+
+// remoteHost strips the port from a RemoteAddr.
+func remoteHost(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
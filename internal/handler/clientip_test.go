@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatalf("NewTrustedProxies() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:5555", want: "203.0.113.7"},
+		{name: "untrusted peer spoofing", remoteAddr: "203.0.113.7:5555", xff: "1.2.3.4", realIP: "1.2.3.4", want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:5555", xff: "198.51.100.9", want: "198.51.100.9"},
+		{name: "proxy chain", remoteAddr: "10.1.2.3:5555", xff: "198.51.100.9, 192.168.1.5", want: "198.51.100.9"},
+		{name: "client-supplied prefix ignored", remoteAddr: "10.1.2.3:5555", xff: "1.2.3.4, 198.51.100.9", want: "198.51.100.9"},
+		{name: "all hops trusted", remoteAddr: "10.1.2.3:5555", xff: "10.9.9.9", want: "10.9.9.9"},
+		{name: "malformed hop", remoteAddr: "10.1.2.3:5555", xff: "198.51.100.9, garbage", want: "10.1.2.3"},
+		{name: "x-real-ip", remoteAddr: "192.168.1.5:5555", realIP: "198.51.100.9", want: "198.51.100.9"},
+		{name: "ipv6 client", remoteAddr: "10.1.2.3:5555", xff: "2001:db8::1", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			var got, gotRemote string
+			proxies.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+				gotRemote = r.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+			if gotRemote != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", gotRemote, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTrustedProxies_Invalid(t *testing.T) {
+	for _, p := range []string{"10.0.0.0/33", "not-an-ip", ""} {
+		if _, err := NewTrustedProxies([]string{p}); err == nil {
+			t.Errorf("NewTrustedProxies(%q) succeeded, want error", p)
+		}
+	}
+}
+
+func TestClientIP_WithoutMiddleware(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.7:5555"
+	if got := ClientIP(req); got != "203.0.113.7" {
+		t.Errorf("ClientIP() = %q, want %q", got, "203.0.113.7")
+	}
+}
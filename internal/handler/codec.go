@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media types of protobuf endpoint bodies.
+const (
+	mediaTypeXProtobuf = "application/x-protobuf"
+	mediaTypeProtobuf  = "application/protobuf"
+	mediaTypeJSON      = "application/json"
+)
+
+// Codec reads and writes the bodies of protobuf endpoints. Bodies are binary
+// protobuf, sent as application/x-protobuf or application/protobuf, or, with
+// JSON allowed, the protojson encoding as application/json. Responses use
+// the encoding Accept prefers among those, or the request's otherwise.
+type Codec struct {
+	allowJSON bool
+}
+
+// NewCodec creates a Codec. allowJSON enables the JSON encoding.
+func NewCodec(allowJSON bool) *Codec {
+	return &Codec{allowJSON: allowJSON}
+}
+
+// Decode reads r's body into msg. Errors are worded for the client.
+func (c *Codec) Decode(r *http.Request, msg proto.Message) error {
+	mediaType := c.requestType(r)
+	if mediaType == "" {
+		if c.allowJSON {
+			return &requestError{message: "invalid content type, expected application/x-protobuf or application/json"}
+		}
+		return &requestError{message: "invalid content type, expected application/x-protobuf"}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &requestError{message: fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit)}
+	}
+	if err != nil {
+		return &requestError{message: "failed to read request body"}
+	}
+	defer r.Body.Close()
+
+	if len(body) == 0 {
+		return &requestError{message: "empty request body"}
+	}
+
+	if mediaType == mediaTypeJSON {
+		if err := protojson.Unmarshal(body, msg); err != nil {
+			return &requestError{message: "failed to unmarshal JSON: " + err.Error()}
+		}
+		return nil
+	}
+	if err := proto.Unmarshal(body, msg); err != nil {
+		return &requestError{message: "failed to unmarshal protobuf"}
+	}
+	return nil
+}
+
+// Encode writes msg with the HTTP status, in the encoding negotiated for r.
+func (c *Codec) Encode(w http.ResponseWriter, r *http.Request, status int, msg proto.Message) {
+	mediaType := c.responseType(r)
+
+	var data []byte
+	var err error
+	if mediaType == mediaTypeJSON {
+		data, err = protojson.Marshal(msg)
+	} else {
+		data, err = proto.Marshal(msg)
+	}
+	w.Header().Set("Content-Type", mediaType)
+	if err != nil {
+		log.Printf("ERROR: encoding %s response: %v", mediaType, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// requestType returns the supported media type of r's body, or "".
+func (c *Codec) requestType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return c.supported(mediaType)
+}
+
+// responseType picks the response media type for r: the supported type
+// Accept prefers, else the request's type, else binary protobuf.
+func (c *Codec) responseType(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if t := c.supported(mediaType); t != "" && q > bestQ {
+			best, bestQ = t, q
+		}
+	}
+	if best != "" {
+		return best
+	}
+	if t := c.requestType(r); t != "" {
+		return t
+	}
+	return mediaTypeXProtobuf
+}
+
+// supported returns mediaType if the codec reads and writes it, or "".
+func (c *Codec) supported(mediaType string) string {
+	switch mediaType {
+	case mediaTypeXProtobuf, mediaTypeProtobuf:
+		return mediaType
+	case mediaTypeJSON:
+		if c.allowJSON {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// ErrorEnvelope builds an endpoint's response for a failed request from the
+// error code and message.
+type ErrorEnvelope func(code int32, message string) proto.Message
+
+// ProtoFunc handles a decoded protobuf request. It returns the response and
+// its error code, which sets the HTTP status. It may set response headers,
+// but not write the body.
+type ProtoFunc[Req proto.Message] func(w http.ResponseWriter, r *http.Request, req Req) (proto.Message, int32)
+
+// HandleProto returns a handler that decodes each request body into a new
+// Req, calls fn, and encodes its response with the HTTP status for its error
+// code. Bodies that can't be decoded get envelope's ErrorCodeInvalidRequest
+// response, so protobuf endpoints all report errors the same way.
+func HandleProto[Req proto.Message](c *Codec, envelope ErrorEnvelope, fn ProtoFunc[Req]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveProto(w, r, c, envelope, fn)
+	}
+}
+
+// serveProto serves one request as HandleProto describes.
+func serveProto[Req proto.Message](w http.ResponseWriter, r *http.Request, c *Codec, envelope ErrorEnvelope, fn ProtoFunc[Req]) {
+	var zero Req
+	req := zero.ProtoReflect().Type().New().Interface().(Req)
+	if err := c.Decode(r, req); err != nil {
+		c.Encode(w, r, httpStatus(ErrorCodeInvalidRequest), envelope(ErrorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	resp, code := fn(w, r, req)
+	c.Encode(w, r, httpStatus(code), resp)
+}
+
+// httpStatus maps an error code to the HTTP status it is sent with.
+func httpStatus(code int32) int {
+	switch code {
+	case ErrorCodeSuccess, ErrorCodePartial:
+		return http.StatusOK
+	case ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorCodeSignatureFailed:
+		return http.StatusUnauthorized
+	case ErrorCodeNoConsent:
+		return http.StatusForbidden
+	case ErrorCodeNoEndpoints:
+		return http.StatusNotFound
+	case ErrorCodeSuspended, ErrorCodeRateLimited:
+		return http.StatusTooManyRequests
+	case ErrorCodeUnavailable:
+		return http.StatusServiceUnavailable
+	case ErrorCodeContentNotFound:
+		return http.StatusUnprocessableEntity
+	case ErrorCodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
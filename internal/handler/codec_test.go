@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodec_ResponseType(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowJSON   bool
+		contentType string
+		accept      string
+		want        string
+	}{
+		{"request type by default", false, "application/protobuf", "", mediaTypeProtobuf},
+		{"accept wins", true, "application/x-protobuf", "application/json", mediaTypeJSON},
+		{"highest q wins", true, "application/json", "application/json;q=0.5, application/x-protobuf", mediaTypeXProtobuf},
+		{"json not allowed", false, "application/x-protobuf", "application/json", mediaTypeXProtobuf},
+		{"wildcard", true, "application/json", "*/*", mediaTypeJSON},
+		{"nothing usable", false, "text/plain", "text/html", mediaTypeXProtobuf},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/push", nil)
+			r.Header.Set("Content-Type", tt.contentType)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if got := NewCodec(tt.allowJSON).responseType(r); got != tt.want {
+				t.Errorf("responseType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodec_DecodeJSON(t *testing.T) {
+	body := `{"senderUsername": "alice@oc", "targetUsername": "bob@oc", "signature": "c2ln"}`
+
+	r := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	var req pb.PushRequest
+	if err := NewCodec(true).Decode(r, &req); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if req.SenderUsername != "alice@oc" || string(req.Signature) != "sig" {
+		t.Errorf("decoded %v, want sender alice@oc and signature \"sig\"", &req)
+	}
+
+	// Without JSON enabled the content type is refused
+	r = httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if err := NewCodec(false).Decode(r, &req); err == nil {
+		t.Error("expected an error decoding JSON with JSON disabled")
+	}
+}
+
+func TestHandleProto_ErrorEnvelope(t *testing.T) {
+	called := false
+	h := HandleProto(NewCodec(true), pushError, func(w http.ResponseWriter, r *http.Request, req *pb.PushRequest) (proto.Message, int32) {
+		called = true
+		return &pb.PushResponse{Accepted: true, RequestId: "req-" + req.SenderUsername}, ErrorCodeSuccess
+	})
+
+	// A body that doesn't parse gets the envelope, in the encoding asked for
+	r := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("{not json"))
+	r.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h(rr, r)
+
+	if called {
+		t.Error("handler called for an unparseable body")
+	}
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != mediaTypeJSON {
+		t.Errorf("Content-Type = %q, want %q", ct, mediaTypeJSON)
+	}
+	var resp pb.PushResponse
+	if err := protojson.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal JSON response: %v", err)
+	}
+	if resp.ErrorCode != ErrorCodeInvalidRequest || resp.Message == "" {
+		t.Errorf("response = %v, want error_code %d with a message", &resp, ErrorCodeInvalidRequest)
+	}
+
+	// A valid protobuf body reaches the handler
+	body, err := proto.Marshal(&pb.PushRequest{SenderUsername: "alice@oc"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	rr = httptest.NewRecorder()
+	h(rr, r)
+
+	resp.Reset()
+	if err := proto.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal protobuf response: %v", err)
+	}
+	if rr.Code != http.StatusOK || resp.RequestId != "req-alice@oc" {
+		t.Errorf("status %d, response %v; want 200 with request_id req-alice@oc", rr.Code, &resp)
+	}
+}
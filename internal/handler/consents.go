@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// ConsentInspector reads the consent lists recipients publish in OurCloud
+// and verifies their signatures.
+// *ourcloud.Client implements this interface.
+type ConsentInspector interface {
+	SignatureVerifier
+	GetConsentList(ctx context.Context, username string) (*pb.PushConsentList, error)
+}
+
+// ConsentHandler lets recipients see the consent list the gateway resolves
+// for them, to debug rejected pushes.
+type ConsentHandler struct {
+	lists  ConsentInspector
+	policy string
+}
+
+// NewConsentHandler creates a new ConsentHandler. policy names the consent
+// policy pushes are checked against, reported alongside the list.
+func NewConsentHandler(lists ConsentInspector, policy string) *ConsentHandler {
+	return &ConsentHandler{
+		lists:  lists,
+		policy: policy,
+	}
+}
+
+// ConsentResponse is the JSON response for GET /consents/{recipient}.
+type ConsentResponse struct {
+	Recipient string   `json:"recipient"`
+	Policy    string   `json:"policy"`          // consent policy; the list only decides pushes under "list"
+	Consents  []string `json:"consents"`        // senders on the recipient's published list
+	FetchedAt int64    `json:"fetched_at"`      // Unix timestamp (seconds) the list was read from OurCloud
+	Error     string   `json:"error,omitempty"` // why the list couldn't be read
+}
+
+// HandleGetConsents handles GET /consents/{recipient} requests. The request
+// must be signed by the recipient: SignatureHeader holds their signature of
+// SignedRequestMessage over the method, path, and TimestampHeader.
+//
+// The gateway doesn't cache consent lists, so the response is what the next
+// push to the recipient will be checked against.
+//
+// HTTP Status Codes:
+//   - 200 OK: List read (possibly empty)
+//   - 401 Unauthorized: Missing, stale, or invalid signature
+//   - 502 Bad Gateway: The list couldn't be read from OurCloud
+func (h *ConsentHandler) HandleGetConsents(w http.ResponseWriter, r *http.Request) {
+	recipient := chi.URLParam(r, "recipient")
+	if msg := verifySignedRequest(r, h.lists, recipient); msg != "" {
+		WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, msg)
+		return
+	}
+
+	resp := ConsentResponse{
+		Recipient: recipient,
+		Policy:    h.policy,
+		Consents:  []string{},
+		FetchedAt: time.Now().Unix(),
+	}
+	status := http.StatusOK
+
+	list, err := h.lists.GetConsentList(r.Context(), recipient)
+	if err != nil {
+		log.Printf("WARNING: reading consent list: %v%s", err, logfield.Format(logfield.User("recipient", recipient)))
+		resp.Error = err.Error()
+		status = http.StatusBadGateway
+	} else {
+		for _, c := range list.Consents {
+			resp.Consents = append(resp.Consents, c.Username)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+)
+
+// mockConsentInspector serves fixed consent lists and verifies signatures
+// against per-user keys.
+type mockConsentInspector struct {
+	keys    map[string]ed25519.PublicKey
+	lists   map[string][]string
+	listErr error
+}
+
+func (m *mockConsentInspector) GetConsentList(ctx context.Context, username string) (*pb.PushConsentList, error) {
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+	list := &pb.PushConsentList{}
+	for _, sender := range m.lists[username] {
+		list.Consents = append(list.Consents, &pb.PushConsent{Username: sender})
+	}
+	return list, nil
+}
+
+func (m *mockConsentInspector) VerifySignature(ctx context.Context, username string, message, signature []byte) (bool, error) {
+	key, ok := m.keys[username]
+	if !ok {
+		return false, errors.New("unknown user")
+	}
+	return ed25519.Verify(key, message, signature), nil
+}
+
+func TestHandleGetConsents(t *testing.T) {
+	bobPub, bobKey, _ := ed25519.GenerateKey(nil)
+	_, eveKey, _ := ed25519.GenerateKey(nil)
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sign := func(key ed25519.PrivateKey, path, timestamp string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedRequestMessage(http.MethodGet, path, timestamp)))
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		listErr   error
+		want      int
+		wantList  []string
+	}{
+		{name: "signed by recipient", timestamp: now, signature: sign(bobKey, "/consents/bob@oc", now), want: http.StatusOK, wantList: []string{"alice@oc", "carol@oc"}},
+		{name: "unsigned", want: http.StatusUnauthorized},
+		{name: "signed by someone else", timestamp: now, signature: sign(eveKey, "/consents/bob@oc", now), want: http.StatusUnauthorized},
+		{name: "signed for another path", timestamp: now, signature: sign(bobKey, "/consents/alice@oc", now), want: http.StatusUnauthorized},
+		{name: "stale timestamp", timestamp: stale, signature: sign(bobKey, "/consents/bob@oc", stale), want: http.StatusUnauthorized},
+		{name: "list unreadable", timestamp: now, signature: sign(bobKey, "/consents/bob@oc", now), listErr: errors.New("label not found"), want: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewConsentHandler(&mockConsentInspector{
+				keys:    map[string]ed25519.PublicKey{"bob@oc": bobPub},
+				lists:   map[string][]string{"bob@oc": {"alice@oc", "carol@oc"}},
+				listErr: tt.listErr,
+			}, "list")
+			r := chi.NewRouter()
+			r.Get("/consents/{recipient}", h.HandleGetConsents)
+
+			req := httptest.NewRequest(http.MethodGet, "/consents/bob@oc", nil)
+			if tt.timestamp != "" {
+				req.Header.Set(TimestampHeader, tt.timestamp)
+			}
+			if tt.signature != "" {
+				req.Header.Set(SignatureHeader, tt.signature)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rr.Code, tt.want, rr.Body.String())
+			}
+			if tt.want == http.StatusUnauthorized {
+				return
+			}
+
+			var resp ConsentResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.Recipient != "bob@oc" || resp.Policy != "list" {
+				t.Errorf("recipient, policy = %q, %q, want bob@oc, list", resp.Recipient, resp.Policy)
+			}
+			if tt.wantList != nil && !reflect.DeepEqual(resp.Consents, tt.wantList) {
+				t.Errorf("consents = %v, want %v", resp.Consents, tt.wantList)
+			}
+			if tt.listErr != nil && resp.Error == "" {
+				t.Error("expected the read error in the response")
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// Content verification cache lifetimes. Blocks are content-addressed and
+// never change, so a found block is remembered for long. A missing block is
+// rechecked soon, since the sender may push before its upload has spread.
+const (
+	contentFoundTTL   = time.Hour
+	contentMissingTTL = time.Minute
+)
+
+// maxContentCacheEntries bounds the content verification cache.
+const maxContentCacheEntries = 100000
+
+// BlockChecker reports whether content-addressed blocks exist in OurCloud.
+// *ourcloud.Client implements this interface.
+type BlockChecker interface {
+	HasBlock(ctx context.Context, id []byte) (bool, error)
+}
+
+// ContentVerifier checks that pushed data IDs resolve to blocks in OurCloud,
+// caching the answers to limit DHT load.
+type ContentVerifier struct {
+	blocks BlockChecker
+
+	mu    sync.Mutex
+	cache map[string]cachedBlock // keyed by data ID
+}
+
+// cachedBlock is a remembered existence check.
+type cachedBlock struct {
+	found     bool
+	expiresAt time.Time
+}
+
+// NewContentVerifier creates a ContentVerifier that looks blocks up in blocks.
+func NewContentVerifier(blocks BlockChecker) *ContentVerifier {
+	return &ContentVerifier{
+		blocks: blocks,
+		cache:  make(map[string]cachedBlock),
+	}
+}
+
+// missing returns the first of dataIDs with no block, or nil if all exist.
+// IDs that can't be checked are assumed to exist, so an OurCloud outage
+// doesn't turn away every push.
+func (v *ContentVerifier) missing(ctx context.Context, dataIDs [][]byte) []byte {
+	for _, id := range dataIDs {
+		if !v.exists(ctx, id) {
+			return id
+		}
+	}
+	return nil
+}
+
+// exists reports whether the block id exists, from the cache when possible.
+func (v *ContentVerifier) exists(ctx context.Context, id []byte) bool {
+	key := string(id)
+	now := time.Now()
+
+	v.mu.Lock()
+	cached, ok := v.cache[key]
+	v.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.found
+	}
+
+	found, err := v.blocks.HasBlock(ctx, id)
+	if err != nil {
+		log.Printf("WARNING: checking data ID %s: %v", hex.EncodeToString(id), err)
+		return true
+	}
+
+	ttl := contentFoundTTL
+	if !found {
+		ttl = contentMissingTTL
+	}
+	v.mu.Lock()
+	if len(v.cache) >= maxContentCacheEntries {
+		v.evictExpiredLocked(now)
+	}
+	if len(v.cache) < maxContentCacheEntries {
+		v.cache[key] = cachedBlock{found: found, expiresAt: now.Add(ttl)}
+	}
+	v.mu.Unlock()
+
+	return found
+}
+
+// evictExpiredLocked drops expired entries. v.mu must be held.
+func (v *ContentVerifier) evictExpiredLocked(now time.Time) {
+	for key, cached := range v.cache {
+		if !now.Before(cached.expiresAt) {
+			delete(v.cache, key)
+		}
+	}
+}
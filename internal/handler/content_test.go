@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+)
+
+// mockBlockChecker finds the blocks in found and counts lookups.
+type mockBlockChecker struct {
+	found map[string]bool
+	err   error
+
+	mu      sync.Mutex
+	lookups int
+}
+
+func (m *mockBlockChecker) HasBlock(ctx context.Context, id []byte) (bool, error) {
+	m.mu.Lock()
+	m.lookups++
+	m.mu.Unlock()
+	return m.found[string(id)], m.err
+}
+
+func TestContentVerifier_Missing(t *testing.T) {
+	blocks := &mockBlockChecker{found: map[string]bool{"a": true}}
+	v := NewContentVerifier(blocks)
+	ctx := context.Background()
+
+	if id := v.missing(ctx, [][]byte{[]byte("a"), []byte("b")}); string(id) != "b" {
+		t.Errorf("missing() = %q, want b", id)
+	}
+	// Both answers are cached
+	if id := v.missing(ctx, [][]byte{[]byte("a"), []byte("b")}); string(id) != "b" {
+		t.Errorf("second missing() = %q, want b", id)
+	}
+	if blocks.lookups != 2 {
+		t.Errorf("lookups = %d, want 2", blocks.lookups)
+	}
+}
+
+func TestContentVerifier_LookupErrorAssumesFound(t *testing.T) {
+	blocks := &mockBlockChecker{err: errors.New("unreachable")}
+	v := NewContentVerifier(blocks)
+
+	if id := v.missing(context.Background(), [][]byte{[]byte("a")}); id != nil {
+		t.Errorf("missing() = %q, want nil", id)
+	}
+	// Failed lookups aren't cached
+	v.missing(context.Background(), [][]byte{[]byte("a")})
+	if blocks.lookups != 2 {
+		t.Errorf("lookups = %d, want 2", blocks.lookups)
+	}
+}
+
+func TestHandlePush_RejectsMissingContent(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token1"}},
+		},
+	}
+	q := &mockQueuer{}
+	h := NewPushHandlerWithClient(mock, q)
+	h.SetContentVerifier(NewContentVerifier(&mockBlockChecker{found: map[string]bool{"\x01": true}}))
+
+	push := func(dataIDs ...[]byte) (*httptest.ResponseRecorder, *pb.PushResponse) {
+		t.Helper()
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: "alice@oc",
+			TargetUsername: "bob@oc",
+			DataIds:        dataIDs,
+			Signature:      []byte("valid-signature"),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		h.HandlePush(rr, req)
+		return rr, parsePushResponse(t, rr)
+	}
+
+	rr, resp := push([]byte{1}, []byte{2})
+	if resp.Accepted || resp.ErrorCode != ErrorCodeContentNotFound {
+		t.Errorf("missing data ID: accepted=%v error_code=%d, want error_code=%d", resp.Accepted, resp.ErrorCode, ErrorCodeContentNotFound)
+	}
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("missing data ID: status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+	if resp.Message != "data ID not found: 02" {
+		t.Errorf("message = %q", resp.Message)
+	}
+	if len(q.queued) != 0 {
+		t.Errorf("queued %v, want nothing", q.queued)
+	}
+
+	if _, resp := push([]byte{1}); !resp.Accepted {
+		t.Errorf("existing data ID: not accepted: %s", resp.Message)
+	}
+}
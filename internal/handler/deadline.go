@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// TimeoutHeader carries the client's overall deadline for a push, relative
+// to when the gateway receives it, in the grpc-timeout format: at most 8
+// digits followed by a unit, H (hours), M (minutes), S (seconds), m
+// (milliseconds), u (microseconds) or n (nanoseconds), e.g. "1500m".
+const TimeoutHeader = "X-Push-Timeout"
+
+// maxTimeoutDigits is the most digits a TimeoutHeader value may have.
+const maxTimeoutDigits = 8
+
+// errClientDeadline is the cause of a context ended by TimeoutHeader, to
+// tell it apart from the gateway's own route timeouts.
+var errClientDeadline = errors.New("client deadline exceeded")
+
+// timeoutUnits are the TimeoutHeader units, largest first.
+var timeoutUnits = []struct {
+	unit byte
+	d    time.Duration
+}{
+	{'H', time.Hour},
+	{'M', time.Minute},
+	{'S', time.Second},
+	{'m', time.Millisecond},
+	{'u', time.Microsecond},
+	{'n', time.Nanosecond},
+}
+
+// parseTimeout parses a TimeoutHeader value.
+func parseTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > maxTimeoutDigits+1 {
+		return 0, fmt.Errorf("invalid %s %q", TimeoutHeader, value)
+	}
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", TimeoutHeader, value)
+	}
+	for _, u := range timeoutUnits {
+		if u.unit == value[len(value)-1] {
+			if n == 0 {
+				return 0, fmt.Errorf("%s must be positive", TimeoutHeader)
+			}
+			return time.Duration(n) * u.d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid %s unit in %q", TimeoutHeader, value)
+}
+
+// formatTimeout formats d as a TimeoutHeader value, in the smallest unit
+// that fits in 8 digits. The value is rounded up, so a peer given the
+// remaining budget doesn't give up before the caller does.
+func formatTimeout(d time.Duration) string {
+	d = max(d, time.Nanosecond)
+	for i := len(timeoutUnits) - 1; i >= 0; i-- {
+		u := timeoutUnits[i]
+		n := (d + u.d - 1) / u.d
+		if n < 1e8 {
+			return strconv.FormatInt(int64(n), 10) + string(u.unit)
+		}
+	}
+	return "99999999H"
+}
+
+// withClientTimeout returns ctx ending after the TimeoutHeader value in
+// header, if any. The returned cancel function must be called.
+func withClientTimeout(ctx context.Context, header string) (context.Context, context.CancelFunc, error) {
+	if header == "" {
+		return ctx, func() {}, nil
+	}
+	timeout, err := parseTimeout(header)
+	if err != nil {
+		return ctx, func() {}, err
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, errClientDeadline)
+	return ctx, cancel, nil
+}
+
+// clientDeadlineExceeded reports whether ctx ended because the client's
+// TimeoutHeader passed.
+func clientDeadlineExceeded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errClientDeadline)
+}
+
+// deadlineExceeded rejects a push the client's deadline passed on before it
+// was validated. Like an OurCloud outage, it isn't recorded against the
+// sender.
+func (h *PushHandler) deadlineExceeded(w http.ResponseWriter) (proto.Message, int32) {
+	return h.respond(w, &PushResponse{
+		Accepted:  false,
+		ErrorCode: ErrorCodeDeadlineExceeded,
+		Message:   "deadline exceeded before the push was validated",
+	})
+}
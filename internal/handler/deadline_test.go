@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+)
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "1500m", want: 1500 * time.Millisecond},
+		{value: "2S", want: 2 * time.Second},
+		{value: "1H", want: time.Hour},
+		{value: "99999999n", want: 99999999 * time.Nanosecond},
+		{value: "0S", wantErr: true},
+		{value: "100", wantErr: true},
+		{value: "S", wantErr: true},
+		{value: "-1S", wantErr: true},
+		{value: "123456789m", wantErr: true},
+		{value: "1s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeout(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTimeout(%q) = %v, %v, want %v (error %t)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormatTimeout(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 1500 * time.Millisecond, want: "1500000u"},
+		{d: 250 * time.Nanosecond, want: "250n"},
+		{d: 2 * time.Hour, want: "7200000m"},
+		{d: 0, want: "1n"},
+	}
+	for _, tt := range tests {
+		got := formatTimeout(tt.d)
+		if got != tt.want {
+			t.Errorf("formatTimeout(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+		if d, err := parseTimeout(got); err != nil || d < tt.d {
+			t.Errorf("parseTimeout(formatTimeout(%v)) = %v, %v, want at least %v", tt.d, d, err, tt.d)
+		}
+	}
+}
+
+// slowOurCloudClient is a mockOurCloudClient whose endpoint lookups take
+// until the request's context ends, as a slow DHT lookup would.
+type slowOurCloudClient struct {
+	mockOurCloudClient
+}
+
+func (s *slowOurCloudClient) GetEndpoints(ctx context.Context, username string) (*pb.PushEndpointList, error) {
+	<-ctx.Done()
+	return nil, fmt.Errorf("%w: %w", ourcloud.ErrUnavailable, ctx.Err())
+}
+
+func TestHandlePush_TimeoutHeader(t *testing.T) {
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	newHandler := func() *PushHandler {
+		return NewPushHandlerWithClient(&slowOurCloudClient{mockOurCloudClient{verifyResult: true, hasConsentResult: true}}, nil)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set(TimeoutHeader, "50m")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	newHandler().HandlePush(rr, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("HandlePush() took %v, want it to give up after 50ms", elapsed)
+	}
+	resp := parsePushResponse(t, rr)
+	if rr.Code != http.StatusGatewayTimeout || resp.ErrorCode != ErrorCodeDeadlineExceeded {
+		t.Errorf("got %d with error_code=%d, want 504 with error_code=%d", rr.Code, resp.ErrorCode, ErrorCodeDeadlineExceeded)
+	}
+
+	// The gateway's own route timeout is still an OurCloud outage
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req = httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr = httptest.NewRecorder()
+	newHandler().HandlePush(rr, req)
+	if resp := parsePushResponse(t, rr); resp.ErrorCode != ErrorCodeUnavailable {
+		t.Errorf("route timeout: error_code = %d, want %d", resp.ErrorCode, ErrorCodeUnavailable)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set(TimeoutHeader, "soon")
+	rr = httptest.NewRecorder()
+	newHandler().HandlePush(rr, req)
+	if resp := parsePushResponse(t, rr); resp.ErrorCode != ErrorCodeInvalidRequest {
+		t.Errorf("invalid header: error_code = %d, want %d", resp.ErrorCode, ErrorCodeInvalidRequest)
+	}
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+)
+
+// EndpointRegisteredAt is the endpoint option holding when the app
+// registered the endpoint, in Unix seconds. Of several endpoints listed for
+// one device ID, the most recently registered is used.
+const EndpointRegisteredAt = "registered_at"
+
+// defaultDuplicateUsers caps how many users' duplicates a
+// DuplicateTracker remembers when NewDuplicateTracker is given no cap.
+const defaultDuplicateUsers = 1000
+
+// DuplicateEndpoint is a device listed more than once in a user's endpoint
+// list, typically because the app was reinstalled and registered a new
+// token without removing the old one.
+type DuplicateEndpoint struct {
+	Username string `json:"username"`
+	DeviceID string `json:"device_id"` // empty for a token listed more than once
+	// KeptToken is the FCM token pushes go to. StaleTokens are the device's
+	// other tokens, which are skipped.
+	KeptToken   string    `json:"kept_token"`
+	StaleTokens []string  `json:"stale_tokens"`
+	SeenAt      time.Time `json:"seen_at"` // when a push last found the duplicate
+}
+
+// DuplicateTracker remembers the duplicate endpoints pushes found in each
+// user's endpoint list, for GET /admin/endpoints/duplicates. A user's entry
+// is replaced at each push to them, so fixed lists drop out. Only the
+// users seen most recently are kept. It is safe for concurrent use.
+type DuplicateTracker struct {
+	mu       sync.Mutex
+	users    map[string][]DuplicateEndpoint
+	maxUsers int
+}
+
+// NewDuplicateTracker returns a tracker remembering the duplicates of up to
+// maxUsers users. Zero means 1000.
+func NewDuplicateTracker(maxUsers int) *DuplicateTracker {
+	if maxUsers <= 0 {
+		maxUsers = defaultDuplicateUsers
+	}
+	return &DuplicateTracker{
+		users:    make(map[string][]DuplicateEndpoint),
+		maxUsers: maxUsers,
+	}
+}
+
+// record replaces username's duplicates with dups.
+func (t *DuplicateTracker) record(username string, dups []DuplicateEndpoint) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(dups) == 0 {
+		delete(t.users, username)
+		return
+	}
+	if _, ok := t.users[username]; !ok && len(t.users) >= t.maxUsers {
+		t.evictOldest()
+	}
+	t.users[username] = dups
+}
+
+// evictOldest forgets the user whose duplicates were seen longest ago.
+// Caller must hold t.mu.
+func (t *DuplicateTracker) evictOldest() {
+	var oldest string
+	var oldestAt time.Time
+	for username, dups := range t.users {
+		if oldest == "" || dups[0].SeenAt.Before(oldestAt) {
+			oldest, oldestAt = username, dups[0].SeenAt
+		}
+	}
+	delete(t.users, oldest)
+}
+
+// List returns the duplicates remembered, most recently seen first. A
+// non-empty username limits them to that user's.
+func (t *DuplicateTracker) List(username string) []DuplicateEndpoint {
+	t.mu.Lock()
+	var list []DuplicateEndpoint
+	for u, dups := range t.users {
+		if username == "" || u == username {
+			list = append(list, dups...)
+		}
+	}
+	t.mu.Unlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].SeenAt.Equal(list[j].SeenAt) {
+			return list[i].SeenAt.After(list[j].SeenAt)
+		}
+		if list[i].Username != list[j].Username {
+			return list[i].Username < list[j].Username
+		}
+		return list[i].DeviceID < list[j].DeviceID
+	})
+	return list
+}
+
+// dedupEndpoints returns endpoints with duplicates removed, in their
+// original order, and the duplicates found. A token listed more than once
+// is kept once. Of the endpoints sharing a device ID, the one with the
+// latest EndpointRegisteredAt is kept; without it, or on a tie, the one
+// listed last, as apps append their new registration.
+func dedupEndpoints(username string, endpoints []*pb.PushEndpoint, now time.Time) ([]*pb.PushEndpoint, []DuplicateEndpoint) {
+	type device struct {
+		kept         int   // index in endpoints
+		registeredAt int64 // of kept
+		stale        []string
+	}
+	var (
+		devices     = make(map[string]*device)
+		deviceOrder []string
+		tokens      = make(map[string]bool, len(endpoints))
+		repeated    []DuplicateEndpoint
+		skip        = make(map[int]bool)
+	)
+	for i, endpoint := range endpoints {
+		token := endpoint.GetFcmToken()
+		if tokens[token] {
+			skip[i] = true
+			repeated = append(repeated, DuplicateEndpoint{
+				Username:    username,
+				DeviceID:    endpoint.GetDeviceId(),
+				KeptToken:   token,
+				StaleTokens: []string{token},
+				SeenAt:      now,
+			})
+			continue
+		}
+		tokens[token] = true
+
+		id := endpoint.GetDeviceId()
+		if id == "" {
+			continue
+		}
+		registeredAt, _ := strconv.ParseInt(endpointOptions(endpoint)[EndpointRegisteredAt], 10, 64)
+		d, ok := devices[id]
+		if !ok {
+			devices[id] = &device{kept: i, registeredAt: registeredAt}
+			deviceOrder = append(deviceOrder, id)
+			continue
+		}
+		if registeredAt >= d.registeredAt {
+			d.stale = append(d.stale, endpoints[d.kept].GetFcmToken())
+			skip[d.kept] = true
+			d.kept, d.registeredAt = i, registeredAt
+		} else {
+			d.stale = append(d.stale, token)
+			skip[i] = true
+		}
+	}
+	if len(skip) == 0 {
+		return endpoints, nil
+	}
+
+	kept := make([]*pb.PushEndpoint, 0, len(endpoints)-len(skip))
+	for i, endpoint := range endpoints {
+		if !skip[i] {
+			kept = append(kept, endpoint)
+		}
+	}
+	var dups []DuplicateEndpoint
+	for _, id := range deviceOrder {
+		d := devices[id]
+		if len(d.stale) == 0 {
+			continue
+		}
+		dups = append(dups, DuplicateEndpoint{
+			Username:    username,
+			DeviceID:    id,
+			KeptToken:   endpoints[d.kept].GetFcmToken(),
+			StaleTokens: d.stale,
+			SeenAt:      now,
+		})
+	}
+	return kept, append(dups, repeated...)
+}
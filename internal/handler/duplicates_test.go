@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+)
+
+func TestDedupEndpoints(t *testing.T) {
+	now := time.Now()
+	endpoints := []*pb.PushEndpoint{
+		endpointWithOptions(t, "phone", "phone-new", mapEntry(EndpointRegisteredAt, "2000")),
+		{DeviceId: "tablet", FcmToken: "tablet-old"},
+		endpointWithOptions(t, "phone", "phone-old", mapEntry(EndpointRegisteredAt, "1000")),
+		{DeviceId: "tablet", FcmToken: "tablet-new"},
+		{DeviceId: "laptop", FcmToken: "laptop"},
+		{DeviceId: "", FcmToken: "laptop"},
+	}
+
+	kept, dups := dedupEndpoints("bob@oc", endpoints, now)
+
+	if got, want := fcmTokens(kept), []string{"phone-new", "tablet-new", "laptop"}; !slices.Equal(got, want) {
+		t.Errorf("kept tokens = %v, want %v", got, want)
+	}
+	want := []DuplicateEndpoint{
+		{Username: "bob@oc", DeviceID: "phone", KeptToken: "phone-new", StaleTokens: []string{"phone-old"}, SeenAt: now},
+		{Username: "bob@oc", DeviceID: "tablet", KeptToken: "tablet-new", StaleTokens: []string{"tablet-old"}, SeenAt: now},
+		{Username: "bob@oc", DeviceID: "", KeptToken: "laptop", StaleTokens: []string{"laptop"}, SeenAt: now},
+	}
+	if !reflect.DeepEqual(dups, want) {
+		t.Errorf("duplicates = %+v, want %+v", dups, want)
+	}
+
+	unique := endpoints[:2]
+	if kept, dups := dedupEndpoints("bob@oc", unique, now); len(kept) != 2 || dups != nil {
+		t.Errorf("dedupEndpoints() of a list without duplicates = %v, %v; want it unchanged", fcmTokens(kept), dups)
+	}
+}
+
+func TestDuplicateTracker(t *testing.T) {
+	tracker := NewDuplicateTracker(2)
+	start := time.Now()
+	dup := func(username string, seenAt time.Time) []DuplicateEndpoint {
+		return []DuplicateEndpoint{{Username: username, DeviceID: "phone", KeptToken: "new", StaleTokens: []string{"old"}, SeenAt: seenAt}}
+	}
+
+	tracker.record("alice@oc", dup("alice@oc", start))
+	tracker.record("bob@oc", dup("bob@oc", start.Add(time.Second)))
+	tracker.record("carol@oc", dup("carol@oc", start.Add(2*time.Second)))
+
+	var users []string
+	for _, d := range tracker.List("") {
+		users = append(users, d.Username)
+	}
+	if want := []string{"carol@oc", "bob@oc"}; !slices.Equal(users, want) {
+		t.Errorf("List() users = %v, want %v with the oldest evicted", users, want)
+	}
+
+	// A push finding the list fixed forgets its duplicates
+	tracker.record("bob@oc", nil)
+	if got := tracker.List("bob@oc"); len(got) != 0 {
+		t.Errorf("List(bob@oc) after the list was fixed = %+v, want none", got)
+	}
+}
+
+func TestHandlePush_DedupsEndpoints(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{
+				{DeviceId: "phone", FcmToken: "token-old"},
+				{DeviceId: "phone", FcmToken: "token-new"},
+			},
+		},
+	}
+	q := &mockQueuer{}
+	h := NewPushHandlerWithClient(mock, q)
+	tracker := NewDuplicateTracker(0)
+	h.SetDuplicateTracker(tracker)
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	if resp := parsePushResponse(t, rr); !resp.Accepted {
+		t.Fatalf("expected accepted=true, got message %q", resp.Message)
+	}
+	if want := []string{"token-new"}; !slices.Equal(q.queued, want) {
+		t.Errorf("queued = %v, want %v", q.queued, want)
+	}
+
+	admin := NewAdminHandler(nil, "secret")
+	admin.SetDuplicateTracker(tracker)
+	rr = httptest.NewRecorder()
+	admin.HandleListDuplicates(rr, httptest.NewRequest(http.MethodGet, "/admin/endpoints/duplicates?username=bob@oc", nil))
+
+	var listed []DuplicateEndpoint
+	if err := json.NewDecoder(rr.Body).Decode(&listed); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(listed) != 1 || listed[0].KeptToken != "token-new" || !slices.Equal(listed[0].StaleTokens, []string{"token-old"}) {
+		t.Errorf("duplicates listed = %+v, want token-old stale for token-new", listed)
+	}
+}
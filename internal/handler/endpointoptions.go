@@ -0,0 +1,83 @@
+package handler
+
+import (
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// EndpointOptionsField is the PushEndpoint field number of
+// map<string, string> options: per-endpoint delivery settings such as the
+// notification channel. The gateway reads the field from unknown fields, so
+// endpoint lists can carry it before the shared schema defines it.
+const EndpointOptionsField protowire.Number = 3
+
+// endpointOptions returns endpoint's options, or nil if it has none.
+// As in protobuf, the last entry for a key wins. Malformed entries are
+// skipped.
+func endpointOptions(endpoint *pb.PushEndpoint) map[string]string {
+	var options map[string]string
+	b := endpoint.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return options
+		}
+		b = b[n:]
+
+		if num != EndpointOptionsField || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return options
+			}
+			b = b[n:]
+			continue
+		}
+
+		entry, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return options
+		}
+		b = b[n:]
+
+		if key, value, ok := decodeMapEntry(entry); ok {
+			if options == nil {
+				options = make(map[string]string)
+			}
+			options[key] = value
+		}
+	}
+	return options
+}
+
+// decodeMapEntry decodes a map<string, string> entry: key in field 1, value
+// in field 2. Either may be missing, meaning "".
+func decodeMapEntry(b []byte) (key, value string, ok bool) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", false
+		}
+		b = b[n:]
+
+		if (num == 1 || num == 2) && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return "", "", false
+			}
+			b = b[n:]
+			if num == 1 {
+				key = string(v)
+			} else {
+				value = string(v)
+			}
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return "", "", false
+		}
+		b = b[n:]
+	}
+	return key, value, true
+}
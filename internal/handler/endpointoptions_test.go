@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// endpointWithOptions returns an endpoint carrying options in
+// EndpointOptionsField, as a newer schema would encode them.
+func endpointWithOptions(t *testing.T, deviceID, fcmToken string, entries ...[]byte) *pb.PushEndpoint {
+	t.Helper()
+
+	data, err := proto.Marshal(&pb.PushEndpoint{DeviceId: deviceID, FcmToken: fcmToken})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	for _, entry := range entries {
+		data = protowire.AppendTag(data, EndpointOptionsField, protowire.BytesType)
+		data = protowire.AppendBytes(data, entry)
+	}
+	var endpoint pb.PushEndpoint
+	if err := proto.Unmarshal(data, &endpoint); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	return &endpoint
+}
+
+// mapEntry encodes a map<string, string> entry.
+func mapEntry(key, value string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, key)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, value)
+	return b
+}
+
+func TestEndpointOptions(t *testing.T) {
+	malformed := protowire.AppendTag(nil, 1, protowire.BytesType) // key with no length
+
+	endpoint := endpointWithOptions(t, "phone", "token1",
+		mapEntry("channel_id", "old"),
+		mapEntry("channel_id", "chat"),
+		mapEntry("sound", "default"),
+		malformed,
+	)
+	want := map[string]string{"channel_id": "chat", "sound": "default"}
+	if got := endpointOptions(endpoint); !reflect.DeepEqual(got, want) {
+		t.Errorf("endpointOptions() = %v, want %v", got, want)
+	}
+
+	if got := endpointOptions(&pb.PushEndpoint{DeviceId: "phone", FcmToken: "token1"}); got != nil {
+		t.Errorf("endpointOptions() without options = %v, want nil", got)
+	}
+}
+
+func TestHandlePush_PassesEndpointOptions(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{
+				endpointWithOptions(t, "phone", "token1", mapEntry("channel_id", "chat")),
+			},
+		},
+	}
+	q := &mockQueuer{}
+	h := NewPushHandlerWithClient(mock, q)
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	if resp := parsePushResponse(t, rr); !resp.Accepted {
+		t.Fatalf("expected accepted=true, got message %q", resp.Message)
+	}
+	if got := q.lastOpts.EndpointOptions["channel_id"]; got != "chat" {
+		t.Errorf("queued channel_id = %q, want chat", got)
+	}
+}
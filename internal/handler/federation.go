@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+	"google.golang.org/protobuf/proto"
+)
+
+// ForwardedByHeader names the gateway that forwarded a push. Forwarded pushes
+// are only delivered to the devices assigned to the receiving gateway and are
+// never forwarded again, so a misconfigured assignment can't cause a loop.
+const ForwardedByHeader = "X-Push-Forwarded-By"
+
+// ForwardSignatureHeader authenticates ForwardedByHeader. It is "sha256="
+// and the hex HMAC-SHA256, keyed by the federation secret, of the
+// forwarding gateway's URL, a ".", and the push's sender signature.
+// A push naming a forwarder without a valid signature is rejected.
+const ForwardSignatureHeader = "X-Push-Forward-Signature"
+
+// errPeerNotAllowed is returned for an assigned gateway the federation
+// won't forward to.
+var errPeerNotAllowed = errors.New("peer gateway not allowed")
+
+// GatewayResolver looks up which gateway delivers to each of a user's devices.
+// *ourcloud.Client implements this interface.
+type GatewayResolver interface {
+	GetGatewayAssignments(ctx context.Context, username string) (map[string]string, error)
+}
+
+// Federation forwards pushes for devices served by peer gateways, so several
+// gateway operators can share one OurCloud network.
+type Federation struct {
+	self      string // this gateway's base URL, as used in assignments
+	secret    []byte // shared by the peers, signing forwards
+	resolver  GatewayResolver
+	client    *http.Client
+	peerHosts map[string]bool // nil allows any host
+}
+
+// NewFederation creates a Federation for the gateway reachable at self
+// (e.g. "https://push.example.com"). Forwards between peers are signed with
+// secret, which every peer must share. Each forward is bounded by timeout.
+func NewFederation(self, secret string, resolver GatewayResolver, timeout time.Duration) *Federation {
+	return &Federation{
+		self:     strings.TrimRight(self, "/"),
+		secret:   []byte(secret),
+		resolver: resolver,
+		client: &http.Client{
+			Timeout: timeout,
+			// A peer can't send the push on to a host it wasn't allowed to
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// SetPeerHosts limits forwards to gateways on hosts, or allows any host if
+// it is empty. Must be called before the federation is used.
+func (f *Federation) SetPeerHosts(hosts []string) {
+	f.peerHosts = nil
+	if len(hosts) > 0 {
+		f.peerHosts = make(map[string]bool, len(hosts))
+		for _, host := range hosts {
+			f.peerHosts[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// allowed reports whether pushes may be forwarded to the gateway at peer.
+// Assignments are user-written, so only HTTPS URLs of allowed hosts are
+// trusted.
+func (f *Federation) allowed(peer string) bool {
+	u, err := url.Parse(peer)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		return false
+	}
+	return f.peerHosts == nil || f.peerHosts[strings.ToLower(u.Hostname())]
+}
+
+// sign returns the ForwardSignatureHeader value for a push forwarded by
+// forwarder.
+func (f *Federation) sign(forwarder string, req *pb.PushRequest) string {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write([]byte(forwarder))
+	mac.Write([]byte("."))
+	mac.Write(req.Signature)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether h carries a valid forward signature for req.
+func (f *Federation) verify(h http.Header, req *pb.PushRequest) bool {
+	want := f.sign(h.Get(ForwardedByHeader), req)
+	return hmac.Equal([]byte(h.Get(ForwardSignatureHeader)), []byte(want))
+}
+
+// route splits endpoints into those this gateway delivers to and the device
+// IDs assigned to each peer gateway. Unassigned endpoints are local unless
+// the push was forwarded, in which case the forwarding gateway has already
+// delivered them.
+func (f *Federation) route(ctx context.Context, username string, endpoints []*pb.PushEndpoint, forwarded bool) ([]*pb.PushEndpoint, map[string][]string) {
+	// A missing gateways label is normal; every device is then unassigned
+	assignments, err := f.resolver.GetGatewayAssignments(ctx, username)
+	if err != nil {
+		assignments = nil
+	}
+
+	var local []*pb.PushEndpoint
+	peers := make(map[string][]string)
+	for _, endpoint := range endpoints {
+		gateway, assigned := assignments[endpoint.DeviceId]
+		switch {
+		case assigned && gateway == f.self:
+			local = append(local, endpoint)
+		case forwarded:
+			// Delivered by the forwarding gateway or another peer
+		case assigned:
+			peers[gateway] = append(peers[gateway], endpoint.DeviceId)
+		default:
+			local = append(local, endpoint)
+		}
+	}
+	return local, peers
+}
+
+// passedHeaders are the delivery option headers of a push that are passed
+// through when it is forwarded to a peer gateway.
+var passedHeaders = []string{ExpiresAtHeader, DeliverAfterHeader}
+
+// forward sends req to the peer gateway at peer and returns the request IDs
+// it queued, and the results it reported for each device if it did.
+// The passedHeaders of in, the incoming request's headers, are passed through.
+func (f *Federation) forward(ctx context.Context, peer string, req *pb.PushRequest, in http.Header) ([]string, []DeviceResult, error) {
+	if !f.allowed(peer) {
+		return nil, nil, fmt.Errorf("%w: %s", errPeerNotAllowed, peer)
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling push request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/push", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set(ForwardedByHeader, f.self)
+	httpReq.Header.Set(ForwardSignatureHeader, f.sign(f.self, req))
+	// The peer's middleware.RequestID takes it up, so the push keeps its trace
+	if ids := logfield.TraceIDs(ctx); len(ids) > 0 {
+		httpReq.Header.Set(middleware.RequestIDHeader, ids[0])
+	}
+	for _, name := range passedHeaders {
+		if v := in.Get(name); v != "" {
+			httpReq.Header.Set(name, v)
+		}
+	}
+	// The peer gets what is left of the client's or the route's deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		httpReq.Header.Set(TimeoutHeader, formatTimeout(time.Until(deadline)))
+	}
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("forwarding to %s: %w", peer, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading response from %s: %w", peer, err)
+	}
+
+	var pbResp pb.PushResponse
+	if err := proto.Unmarshal(data, &pbResp); err != nil {
+		return nil, nil, fmt.Errorf("unmarshaling response from %s (HTTP %d): %w", peer, resp.StatusCode, err)
+	}
+	if !pbResp.Accepted {
+		return nil, nil, fmt.Errorf("%s rejected push: error_code=%d %s", peer, pbResp.ErrorCode, pbResp.Message)
+	}
+
+	results := parseDeviceResults(resp.Header.Get(DeviceResultsHeader))
+	if ids := resp.Header.Get(RequestIDsHeader); ids != "" {
+		return strings.Split(ids, ","), results, nil
+	}
+	return []string{pbResp.RequestId}, results, nil
+}
+
+// forwardAll forwards req to every peer at once and returns the request IDs
+// they queued, and the result for each of their devices, in peer URL order.
+// Failed forwards are logged and skipped, like failed local queues.
+func (f *Federation) forwardAll(ctx context.Context, peers map[string][]string, req *pb.PushRequest, in http.Header) ([]string, []DeviceResult) {
+	urls := make([]string, 0, len(peers))
+	for peer := range peers {
+		urls = append(urls, peer)
+	}
+	sort.Strings(urls)
+
+	type outcome struct {
+		ids     []string
+		results []DeviceResult
+	}
+	outcomes := make([]outcome, len(urls))
+	var wg sync.WaitGroup
+	for i, peer := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			devices := peers[peer]
+			ids, results, err := f.forward(ctx, peer, req, in)
+			if err != nil {
+				log.Printf("WARNING: failed to forward push for %d endpoints: %v%s", len(devices), err, logfield.Format(logfield.Trace(ctx)))
+				outcomes[i] = outcome{results: deviceResults(devices, DeviceFailed)}
+				return
+			}
+			if results == nil {
+				// The peer queued for its only device, or predates device results
+				results = deviceResults(devices, DeviceQueued)
+			}
+			outcomes[i] = outcome{ids: ids, results: results}
+		}()
+	}
+	wg.Wait()
+
+	var requestIDs []string
+	var results []DeviceResult
+	for _, o := range outcomes {
+		requestIDs = append(requestIDs, o.ids...)
+		results = append(results, o.results...)
+	}
+	return requestIDs, results
+}
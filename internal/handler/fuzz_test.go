@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"google.golang.org/protobuf/proto"
+)
+
+// countingQueuer accepts every notification without storing it.
+type countingQueuer struct {
+	queued atomic.Int64
+}
+
+func (q *countingQueuer) QueueWithOptions(ctx context.Context, recipient, fcmToken string, dataIDs [][]byte, opts batcher.QueueOptions) (string, error) {
+	return "req-" + strconv.FormatInt(q.queued.Add(1), 10), nil
+}
+
+// FuzzHandlePush feeds arbitrary bodies and endpoint lists through POST
+// /push with signature and consent checks passing, so the parser,
+// validation, and queueing all see untrusted input. The endpoint list
+// stands in for the one the target publishes in OurCloud; bytes that don't
+// decode give a nil list.
+func FuzzHandlePush(f *testing.F) {
+	seed := func(req *pb.PushRequest, endpoints *pb.PushEndpointList) {
+		body, err := proto.Marshal(req)
+		if err != nil {
+			f.Fatal(err)
+		}
+		list, err := proto.Marshal(endpoints)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body, list)
+	}
+	oneEndpoint := &pb.PushEndpointList{Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token1"}}}
+	seed(&pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		DataIds:        [][]byte{bytes.Repeat([]byte{0x11}, 32)},
+		Signature:      []byte("signature"),
+		Timestamp:      1234567890,
+	}, oneEndpoint)
+	seed(&pb.PushRequest{SenderUsername: "alice@oc", TargetNodeIds: []string{"node1"}, Signature: []byte{1}}, &pb.PushEndpointList{})
+	seed(&pb.PushRequest{SenderUsername: "alice@oc", TargetUsername: "bob@oc", Signature: []byte{1}},
+		&pb.PushEndpointList{Endpoints: []*pb.PushEndpoint{{DeviceId: "no-token"}, {FcmToken: "no-device"}}})
+	// The request the Android client sends, from the protobuf compatibility fixtures
+	if golden, err := os.ReadFile("../../test/proto-compat/testdata/push_request.bin"); err == nil {
+		list, _ := proto.Marshal(oneEndpoint)
+		f.Add(golden, list)
+	}
+	f.Add([]byte{}, []byte{})
+	f.Add([]byte("not-protobuf"), []byte{0xff})
+
+	f.Fuzz(func(t *testing.T, body, endpointBytes []byte) {
+		var endpoints *pb.PushEndpointList
+		if list := new(pb.PushEndpointList); proto.Unmarshal(endpointBytes, list) == nil {
+			endpoints = list
+		}
+		queuer := &countingQueuer{}
+		h := NewPushHandlerWithClient(&mockOurCloudClient{
+			verifyResult:     true,
+			hasConsentResult: true,
+			endpointsResult:  endpoints,
+		}, queuer)
+
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+
+		h.HandlePush(rr, req)
+
+		var resp pb.PushResponse
+		if err := proto.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("response isn't a PushResponse: %v", err)
+		}
+		if resp.Accepted != (queuer.queued.Load() > 0) {
+			t.Errorf("accepted = %v after queueing %d notifications", resp.Accepted, queuer.queued.Load())
+		}
+		if got, want := rr.Code, httpStatus(resp.ErrorCode); got != want {
+			t.Errorf("status = %d for error_code %d, want %d", got, resp.ErrorCode, want)
+		}
+	})
+}
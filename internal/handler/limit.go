@@ -0,0 +1,145 @@
+// Package handler provides HTTP request handlers for the push gateway.
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimiter bounds the number of requests handled at once.
+// Requests beyond the limit wait in a small queue; when the queue is full or
+// the wait times out, they are rejected with 503 so clients back off instead
+// of piling onto the DHT and store.
+type ConcurrencyLimiter struct {
+	slots       chan struct{} // held while a request is being handled
+	tickets     chan struct{} // held while a request is handled or waiting
+	waitTimeout time.Duration
+
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+	admitted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// LimiterStats is a snapshot of ConcurrencyLimiter saturation.
+type LimiterStats struct {
+	MaxInFlight int    `json:"max_in_flight"`
+	MaxQueued   int    `json:"max_queued"`
+	InFlight    int64  `json:"in_flight"`
+	Waiting     int64  `json:"waiting"`
+	Admitted    uint64 `json:"admitted"`
+	Rejected    uint64 `json:"rejected"`
+}
+
+// NewConcurrencyLimiter creates a limiter allowing maxInFlight concurrent
+// requests plus up to maxQueued waiting for at most waitTimeout.
+func NewConcurrencyLimiter(maxInFlight, maxQueued int, waitTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:       make(chan struct{}, maxInFlight),
+		tickets:     make(chan struct{}, maxInFlight+maxQueued),
+		waitTimeout: waitTimeout,
+	}
+}
+
+// Middleware wraps next with the concurrency limit.
+func (l *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail fast when both the in-flight slots and the queue are taken
+		select {
+		case l.tickets <- struct{}{}:
+		default:
+			l.reject(w, r)
+			return
+		}
+		defer func() { <-l.tickets }()
+
+		if !l.acquire(r) {
+			l.reject(w, r)
+			return
+		}
+		defer func() {
+			l.inFlight.Add(-1)
+			<-l.slots
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire waits for an in-flight slot. Returns false if the wait timed out or
+// the client went away.
+func (l *ConcurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.admit()
+		return true
+	default:
+	}
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+
+	timer := time.NewTimer(l.waitTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		l.admit()
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *ConcurrencyLimiter) admit() {
+	l.inFlight.Add(1)
+	l.admitted.Add(1)
+}
+
+func (l *ConcurrencyLimiter) reject(w http.ResponseWriter, r *http.Request) {
+	l.rejected.Add(1)
+	w.Header().Set("Retry-After", "1")
+	WriteError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "server busy")
+}
+
+// Stats returns current saturation counters.
+func (l *ConcurrencyLimiter) Stats() LimiterStats {
+	return LimiterStats{
+		MaxInFlight: cap(l.slots),
+		MaxQueued:   cap(l.tickets) - cap(l.slots),
+		InFlight:    l.inFlight.Load(),
+		Waiting:     l.waiting.Load(),
+		Admitted:    l.admitted.Load(),
+		Rejected:    l.rejected.Load(),
+	}
+}
+
+// RequestLimits returns middleware bounding each request's body to maxBody
+// bytes and its handling to timeout, by giving it a context deadline. A
+// non-positive value leaves that limit off. Bodies declared larger than
+// maxBody are rejected with 413; larger bodies without a declared length
+// fail when read.
+func RequestLimits(timeout time.Duration, maxBody int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if maxBody > 0 {
+				if r.ContentLength > maxBody {
+					WriteError(w, r, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, fmt.Sprintf("request body larger than %d bytes", maxBody))
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+			}
+			if timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
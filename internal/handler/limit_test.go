@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter_QueuesThenRejects(t *testing.T) {
+	l := NewConcurrencyLimiter(1, 1, time.Second)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/push", nil))
+			codes[i] = rr.Code
+		}(i)
+		// Let the first request take the slot before the second queues
+		if i == 0 {
+			<-started
+		}
+	}
+
+	// Wait for the second request to be queued
+	deadline := time.Now().Add(time.Second)
+	for l.Stats().Waiting != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Third request finds the slot and queue full
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/push", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("overflow status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header on 503")
+	}
+
+	close(release)
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d status = %d, want %d", i, code, http.StatusOK)
+		}
+	}
+
+	stats := l.Stats()
+	if stats.Admitted != 2 || stats.Rejected != 1 {
+		t.Errorf("stats = %+v, want 2 admitted and 1 rejected", stats)
+	}
+	if stats.InFlight != 0 || stats.Waiting != 0 {
+		t.Errorf("stats = %+v, want nothing in flight or waiting", stats)
+	}
+}
+
+func TestConcurrencyLimiter_WaitTimeout(t *testing.T) {
+	l := NewConcurrencyLimiter(1, 1, 20*time.Millisecond)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", nil))
+	<-started
+	defer close(release)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/push", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d after queue wait timeout", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	var (
+		readErr     error
+		hasDeadline bool
+	)
+	h := RequestLimits(time.Second, 8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+		_, hasDeadline = r.Context().Deadline()
+	}))
+
+	// Declared too large: rejected before the handler runs
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("0123456789")))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared oversize: status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// Undeclared length: reading past the limit fails
+	req := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("0123456789"))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var tooLarge *http.MaxBytesError
+	if !errors.As(readErr, &tooLarge) {
+		t.Errorf("undeclared oversize: read error = %v, want *http.MaxBytesError", readErr)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/push", strings.NewReader("01234567")))
+	if readErr != nil {
+		t.Errorf("body within limit: read error = %v", readErr)
+	}
+	if !hasDeadline {
+		t.Error("request context has no deadline")
+	}
+}
+
+func TestRequestLimits_Unlimited(t *testing.T) {
+	var hasDeadline bool
+	h := RequestLimits(0, -1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasDeadline = r.Context().Deadline()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/broadcast", strings.NewReader(strings.Repeat("x", 1<<20))))
+	if rr.Code != http.StatusOK || hasDeadline {
+		t.Errorf("status = %d, deadline = %v; want no limits", rr.Code, hasDeadline)
+	}
+}
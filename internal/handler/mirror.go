@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/mirror"
+)
+
+// MirrorHandler serves the routes a primary gateway mirrors its accepted
+// pushes to, on a standby gateway.
+type MirrorHandler struct {
+	standby *mirror.Standby
+}
+
+// NewMirrorHandler creates a MirrorHandler holding mirrored pushes in
+// standby.
+func NewMirrorHandler(standby *mirror.Standby) *MirrorHandler {
+	return &MirrorHandler{standby: standby}
+}
+
+// TakeoverResponse is the JSON response for POST /admin/mirror/takeover.
+type TakeoverResponse struct {
+	TakenOver int `json:"taken_over"`
+}
+
+// HandleReceive handles POST /mirror requests from the primary gateway,
+// carrying a mirror.Message. Every request, even an empty one, tells the
+// standby the primary is up.
+//
+// HTTP Status Codes:
+//   - 200 OK: Message stored
+//   - 400 Bad Request: Malformed message
+//   - 500 Internal Server Error: Database error
+func (h *MirrorHandler) HandleReceive(w http.ResponseWriter, r *http.Request) {
+	var msg mirror.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid request body")
+		return
+	}
+	if err := h.standby.Receive(r.Context(), msg, time.Now()); err != nil {
+		log.Printf("ERROR: storing mirrored pushes: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}\n"))
+}
+
+// HandleTakeovers handles GET /mirror/takeovers requests from a primary
+// gateway starting up, listing the request IDs this gateway delivered
+// while it was down.
+//
+// HTTP Status Codes:
+//   - 200 OK: Takeovers listed (possibly none)
+//   - 500 Internal Server Error: Database error
+func (h *MirrorHandler) HandleTakeovers(w http.ResponseWriter, r *http.Request) {
+	ids, err := h.standby.Takeovers(r.Context())
+	if err != nil {
+		log.Printf("ERROR: listing takeovers: %v", err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&mirror.Takeovers{RequestIDs: ids})
+}
+
+// HandleTakeOver handles POST /admin/mirror/takeover requests, delivering
+// the pushes mirrored from the primary gateway now instead of waiting for
+// mirror.takeover_after. Every attempt is written to the log with the
+// operator making it.
+//
+// HTTP Status Codes:
+//   - 200 OK: Pushes taken over (possibly none)
+//   - 500 Internal Server Error: Database error or the batcher stopped
+func (h *MirrorHandler) HandleTakeOver(w http.ResponseWriter, r *http.Request) {
+	log.Printf("AUDIT: %s is taking over the primary gateway's mirrored pushes", actor(r))
+	n, err := h.standby.TakeOver(r.Context(), time.Now())
+	if err != nil {
+		log.Printf("ERROR: taking over mirrored pushes after %d: %v", n, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "takeover failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&TakeoverResponse{TakenOver: n})
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/mirror"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// mockImporter counts the notifications a takeover queues.
+type mockImporter struct {
+	queued int
+}
+
+func (m *mockImporter) ImportBatch(ctx context.Context, fcmToken string, batch *store.Batch) error {
+	m.queued += len(batch.Notifications)
+	return nil
+}
+
+func (m *mockImporter) ImportStatuses(ctx context.Context, records []store.StatusRecord) error {
+	return nil
+}
+
+func newTestMirrorHandler(t *testing.T) (*MirrorHandler, *mockImporter) {
+	t.Helper()
+	st, err := store.New(store.Config{Path: filepath.Join(t.TempDir(), "standby.db")})
+	if err != nil {
+		t.Fatalf("store.New() error = %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	importer := &mockImporter{}
+	return NewMirrorHandler(mirror.NewStandby(st, importer, mirror.StandbyConfig{})), importer
+}
+
+func TestMirrorHandler_ReceiveTakeOverAndList(t *testing.T) {
+	h, importer := newTestMirrorHandler(t)
+
+	body := `{"notifications": [{"fcm_token": "tok", "recipient": "bob@oc", "notification": {"RequestID": "req-1"}}]}`
+	rr := httptest.NewRecorder()
+	h.HandleReceive(rr, httptest.NewRequest(http.MethodPost, "/mirror", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("receive status = %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.HandleTakeOver(rr, httptest.NewRequest(http.MethodPost, "/admin/mirror/takeover", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("takeover status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp TakeoverResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.TakenOver != 1 || importer.queued != 1 {
+		t.Errorf("taken_over = %d, queued = %d, want 1 and 1", resp.TakenOver, importer.queued)
+	}
+
+	rr = httptest.NewRecorder()
+	h.HandleTakeovers(rr, httptest.NewRequest(http.MethodGet, "/mirror/takeovers", nil))
+	var takeovers mirror.Takeovers
+	if err := json.NewDecoder(rr.Body).Decode(&takeovers); err != nil {
+		t.Fatalf("failed to decode takeovers: %v", err)
+	}
+	if len(takeovers.RequestIDs) != 1 || takeovers.RequestIDs[0] != "req-1" {
+		t.Errorf("takeovers = %v, want [req-1]", takeovers.RequestIDs)
+	}
+}
+
+func TestMirrorHandler_RejectsMalformedMessage(t *testing.T) {
+	h, _ := newTestMirrorHandler(t)
+
+	rr := httptest.NewRecorder()
+	h.HandleReceive(rr, httptest.NewRequest(http.MethodPost, "/mirror", strings.NewReader("{")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
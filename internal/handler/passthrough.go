@@ -0,0 +1,153 @@
+// Package handler provides HTTP request handlers for the push gateway.
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Passthrough field types.
+const (
+	PassthroughString = "string" // proto string; copied as is
+	PassthroughBytes  = "bytes"  // proto bytes or message, e.g. google.protobuf.Any; base64-encoded
+	PassthroughInt    = "int"    // proto int32/int64; decimal
+	PassthroughUint   = "uint"   // proto uint32/uint64; decimal
+	PassthroughBool   = "bool"   // "true" or "false"
+)
+
+// reservedDataKeys can't be used as passthrough names: the gateway sets
+// "payload" and "schema_version", and FCM rejects the others.
+var reservedDataKeys = map[string]bool{
+	"payload":        true,
+	"schema_version": true,
+	"from":           true,
+	"collapse_key":   true,
+	"message_type":   true,
+	"notification":   true,
+}
+
+// PassthroughField maps a PushRequest field the gateway's schema doesn't
+// define to a key in the FCM data payload.
+type PassthroughField struct {
+	Name   string // FCM data key
+	Number int32  // protobuf field number in PushRequest
+	Type   string // one of the Passthrough* types
+}
+
+// Passthrough copies allowlisted unknown PushRequest fields into the FCM data
+// payload, so applications can add notification metadata without a gateway
+// release. Fields not in the allowlist are ignored.
+type Passthrough struct {
+	fields map[protowire.Number]PassthroughField
+}
+
+// NewPassthrough validates fields and returns a Passthrough for them.
+func NewPassthrough(fields []PassthroughField) (*Passthrough, error) {
+	known := (&pb.PushRequest{}).ProtoReflect().Descriptor().Fields()
+	p := &Passthrough{fields: make(map[protowire.Number]PassthroughField, len(fields))}
+	names := make(map[string]bool, len(fields))
+
+	for _, f := range fields {
+		num := protowire.Number(f.Number)
+		switch {
+		case f.Name == "":
+			return nil, fmt.Errorf("field %d has no name", f.Number)
+		case reservedDataKeys[f.Name] || strings.HasPrefix(f.Name, "google.") || strings.HasPrefix(f.Name, "gcm."):
+			return nil, fmt.Errorf("field name %q is reserved", f.Name)
+		case names[f.Name]:
+			return nil, fmt.Errorf("duplicate field name %q", f.Name)
+		case !num.IsValid():
+			return nil, fmt.Errorf("field %q: invalid field number %d", f.Name, f.Number)
+		case known.ByNumber(num) != nil:
+			return nil, fmt.Errorf("field %q: number %d is already a PushRequest field", f.Name, f.Number)
+		case p.fields[num].Name != "":
+			return nil, fmt.Errorf("field %q: number %d is also used by %q", f.Name, f.Number, p.fields[num].Name)
+		}
+		switch f.Type {
+		case PassthroughString, PassthroughBytes, PassthroughInt, PassthroughUint, PassthroughBool:
+		default:
+			return nil, fmt.Errorf("field %q: unknown type %q (want string, bytes, int, uint, or bool)", f.Name, f.Type)
+		}
+
+		names[f.Name] = true
+		p.fields[num] = f
+	}
+	return p, nil
+}
+
+// extract returns the allowlisted unknown fields of req as FCM data, or nil
+// if it has none. As in protobuf, the last occurrence of a field wins. Values
+// whose wire type doesn't match the configured type are skipped.
+// A nil Passthrough extracts nothing.
+func (p *Passthrough) extract(req *pb.PushRequest) map[string]string {
+	if p == nil {
+		return nil
+	}
+
+	var data map[string]string
+	b := req.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return data
+		}
+		b = b[n:]
+
+		f, wanted := p.fields[num]
+		value, ok := "", false
+		if wanted {
+			value, n, ok = decodePassthrough(f.Type, typ, b)
+		}
+		if !ok {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return data
+		}
+		b = b[n:]
+
+		if ok {
+			if data == nil {
+				data = make(map[string]string)
+			}
+			data[f.Name] = value
+		}
+	}
+	return data
+}
+
+// decodePassthrough decodes one field value of wire type typ as fieldType.
+// Returns the value, the bytes consumed, and whether it matched.
+func decodePassthrough(fieldType string, typ protowire.Type, b []byte) (string, int, bool) {
+	switch {
+	case typ == protowire.BytesType && (fieldType == PassthroughString || fieldType == PassthroughBytes):
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", n, false
+		}
+		if fieldType == PassthroughString {
+			return string(v), n, true
+		}
+		return base64.StdEncoding.EncodeToString(v), n, true
+
+	case typ == protowire.VarintType:
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return "", n, false
+		}
+		switch fieldType {
+		case PassthroughInt:
+			return strconv.FormatInt(int64(v), 10), n, true
+		case PassthroughUint:
+			return strconv.FormatUint(v, 10), n, true
+		case PassthroughBool:
+			return strconv.FormatBool(v != 0), n, true
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewPassthrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  []PassthroughField
+		wantErr bool
+	}{
+		{name: "valid", fields: []PassthroughField{{Name: "thread_id", Number: 100, Type: PassthroughString}, {Name: "urgent", Number: 101, Type: PassthroughBool}}},
+		{name: "known field", fields: []PassthroughField{{Name: "sig", Number: 6, Type: PassthroughBytes}}, wantErr: true},
+		{name: "reserved name", fields: []PassthroughField{{Name: "payload", Number: 100, Type: PassthroughString}}, wantErr: true},
+		{name: "reserved prefix", fields: []PassthroughField{{Name: "google.x", Number: 100, Type: PassthroughString}}, wantErr: true},
+		{name: "duplicate name", fields: []PassthroughField{{Name: "a", Number: 100, Type: PassthroughString}, {Name: "a", Number: 101, Type: PassthroughString}}, wantErr: true},
+		{name: "duplicate number", fields: []PassthroughField{{Name: "a", Number: 100, Type: PassthroughString}, {Name: "b", Number: 100, Type: PassthroughString}}, wantErr: true},
+		{name: "invalid number", fields: []PassthroughField{{Name: "a", Number: 0, Type: PassthroughString}}, wantErr: true},
+		{name: "unknown type", fields: []PassthroughField{{Name: "a", Number: 100, Type: "float"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPassthrough(tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPassthrough() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPassthroughExtract(t *testing.T) {
+	p, err := NewPassthrough([]PassthroughField{
+		{Name: "thread_id", Number: 100, Type: PassthroughString},
+		{Name: "blob", Number: 101, Type: PassthroughBytes},
+		{Name: "count", Number: 102, Type: PassthroughInt},
+		{Name: "urgent", Number: 103, Type: PassthroughBool},
+		{Name: "mismatched", Number: 104, Type: PassthroughString},
+	})
+	if err != nil {
+		t.Fatalf("NewPassthrough() error = %v", err)
+	}
+
+	var extra []byte
+	extra = protowire.AppendTag(extra, 100, protowire.BytesType)
+	extra = protowire.AppendString(extra, "old")
+	extra = protowire.AppendTag(extra, 100, protowire.BytesType)
+	extra = protowire.AppendString(extra, "chat-42")
+	extra = protowire.AppendTag(extra, 101, protowire.BytesType)
+	extra = protowire.AppendBytes(extra, []byte{0xff, 0x00})
+	extra = protowire.AppendTag(extra, 102, protowire.VarintType)
+	count := int64(-3)
+	extra = protowire.AppendVarint(extra, uint64(count))
+	extra = protowire.AppendTag(extra, 103, protowire.VarintType)
+	extra = protowire.AppendVarint(extra, 1)
+	extra = protowire.AppendTag(extra, 104, protowire.VarintType) // not a string
+	extra = protowire.AppendVarint(extra, 7)
+	extra = protowire.AppendTag(extra, 200, protowire.BytesType) // not allowlisted
+	extra = protowire.AppendString(extra, "secret")
+
+	// Unknown fields survive the round trip through the wire format
+	known, err := proto.Marshal(&pb.PushRequest{SenderUsername: "alice@oc"})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var req pb.PushRequest
+	if err := proto.Unmarshal(append(known, extra...), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+
+	want := map[string]string{
+		"thread_id": "chat-42",
+		"blob":      "/wA=",
+		"count":     "-3",
+		"urgent":    "true",
+	}
+	if got := p.extract(&req); !reflect.DeepEqual(got, want) {
+		t.Errorf("extract() = %v, want %v", got, want)
+	}
+
+	var none *Passthrough
+	if got := none.extract(&req); got != nil {
+		t.Errorf("nil Passthrough extract() = %v, want nil", got)
+	}
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+)
+
+// PresenceHandler lets apps report that they are open on a device, so
+// pushes to it are batched on the short foreground window.
+type PresenceHandler struct {
+	batcher  *batcher.Batcher
+	verifier SignatureVerifier
+}
+
+// NewPresenceHandler creates a new PresenceHandler.
+func NewPresenceHandler(b *batcher.Batcher, verifier SignatureVerifier) *PresenceHandler {
+	return &PresenceHandler{
+		batcher:  b,
+		verifier: verifier,
+	}
+}
+
+// HandlePresence handles POST /presence/{recipient}/{device_id} requests,
+// sent by the app when it comes to the foreground, periodically while it
+// stays there, and when it handles a push. The request must be signed by
+// the recipient: SignatureHeader holds their signature of
+// SignedRequestMessage over the method, path, and TimestampHeader. The body
+// is ignored.
+//
+// HTTP Status Codes:
+//   - 204 No Content: Device marked as in the foreground
+//   - 401 Unauthorized: Missing, stale, or invalid signature
+func (h *PresenceHandler) HandlePresence(w http.ResponseWriter, r *http.Request) {
+	recipient := chi.URLParam(r, "recipient")
+	if msg := verifySignedRequest(r, h.verifier, recipient); msg != "" {
+		WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, msg)
+		return
+	}
+	h.batcher.MarkForeground(recipient, chi.URLParam(r, "device_id"))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+func TestHandlePresence(t *testing.T) {
+	st, err := store.New(store.Config{Path: filepath.Join(t.TempDir(), "presence.db")})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer st.Close()
+	b := batcher.New(st, &noopSender{}, batcher.Config{
+		BatchWindow:      time.Minute,
+		MaxBatchSize:     100,
+		LockTimeout:      100 * time.Millisecond,
+		StatusRetention:  time.Hour,
+		ForegroundWindow: time.Second,
+		ForegroundTTL:    time.Minute,
+	})
+	defer b.Stop()
+
+	bobPub, bobKey, _ := ed25519.GenerateKey(nil)
+	_, aliceKey, _ := ed25519.GenerateKey(nil)
+	h := NewPresenceHandler(b, &mockConsentInspector{keys: map[string]ed25519.PublicKey{"bob@oc": bobPub}})
+	r := chi.NewRouter()
+	r.Post("/presence/{recipient}/{device_id}", h.HandlePresence)
+
+	ping := func(key ed25519.PrivateKey) *httptest.ResponseRecorder {
+		t.Helper()
+		path := "/presence/bob@oc/phone"
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, now)
+		req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedRequestMessage(http.MethodPost, path, now))))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := ping(aliceKey); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("ping signed by another user: status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if got := b.ForegroundStats().Devices; got != 0 {
+		t.Errorf("unauthorized ping marked %d devices", got)
+	}
+	if rr := ping(bobKey); rr.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusNoContent, rr.Body.String())
+	}
+	if got := b.ForegroundStats().Devices; got != 1 {
+		t.Errorf("foreground devices = %d, want 1", got)
+	}
+}
@@ -3,23 +3,41 @@ package handler
 
 import (
 	"context"
-	"io"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5/middleware"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/abuse"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/consent"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
-	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/senderclass"
 	"google.golang.org/protobuf/proto"
 )
 
 // Error codes for PushResponse.
 const (
-	ErrorCodeSuccess         = 0 // Success
-	ErrorCodeNoEndpoints     = 1 // No endpoints registered
-	ErrorCodeNoConsent       = 2 // Sender not in consent list
-	ErrorCodeSignatureFailed = 3 // Signature verification failed
-	ErrorCodeInvalidRequest  = 4 // Invalid request / internal error
+	ErrorCodeSuccess          = 0  // Success
+	ErrorCodeNoEndpoints      = 1  // No endpoints registered
+	ErrorCodeNoConsent        = 2  // Sender not in consent list
+	ErrorCodeSignatureFailed  = 3  // Signature verification failed
+	ErrorCodeInvalidRequest   = 4  // Invalid request / internal error
+	ErrorCodeSuspended        = 5  // Sender suspended for abuse
+	ErrorCodeUnavailable      = 6  // Gateway temporarily can't accept pushes; retry later
+	ErrorCodeContentNotFound  = 7  // A data ID doesn't resolve to a block in OurCloud
+	ErrorCodePartial          = 8  // Accepted, but queued for only some of the target's endpoints
+	ErrorCodeRateLimited      = 9  // Sender exceeded its sender class's push rate; retry later
+	ErrorCodeDeadlineExceeded = 10 // The client's X-Push-Timeout passed before the push was validated
 )
 
 // OurCloudClient defines the interface for OurCloud operations needed by the push handler.
@@ -30,157 +48,628 @@ type OurCloudClient interface {
 	GetEndpoints(ctx context.Context, username string) (*pb.PushEndpointList, error)
 }
 
+// DeviceGrouper puts a user's endpoints in an FCM device group, so one send
+// reaches all of them.
+// *fcm.GroupManager implements this interface.
+type DeviceGrouper interface {
+	// Group returns the notification key of username's device group holding
+	// exactly fcmTokens, or "" if they shouldn't be grouped.
+	Group(ctx context.Context, username string, fcmTokens []string) (string, error)
+}
+
+// GroupDeviceID is the device ID recorded for pushes queued to a user's
+// device group rather than a single device.
+const GroupDeviceID = "group"
+
+// RequestIDsHeader lists every request ID created for a push, comma-separated,
+// when the target has more than one endpoint. The protobuf response carries only the first.
+const RequestIDsHeader = "X-Push-Request-Ids"
+
+// DeviceResultsHeader reports whether the push was queued for each of the
+// target's devices, as comma-separated device_id=result pairs, when the
+// target has more than one endpoint. Device IDs are query-escaped.
+const DeviceResultsHeader = "X-Push-Device-Results"
+
+// Results reported in DeviceResultsHeader.
+const (
+	DeviceQueued       = "queued"        // queued locally or by a peer gateway
+	DeviceFailed       = "failed"        // couldn't be queued or forwarded
+	DeviceInvalidToken = "invalid_token" // FCM reported the endpoint's token unregistered
+)
+
+// ExpiresAtHeader optionally carries a delivery deadline as a Unix timestamp
+// (seconds). Notifications still batched at the deadline are dropped, and the
+// remaining time is forwarded to FCM as the message TTL.
+const ExpiresAtHeader = "X-Push-Expires-At"
+
+// DeliverAfterHeader optionally holds a push until a Unix timestamp
+// (seconds), when scheduled delivery is enabled. It is queued for delivery
+// at that time, and ExpiresAtHeader, if set, must be later.
+const DeliverAfterHeader = "X-Push-Deliver-After"
+
+// RevalidateConsentHeader, set to "1" by a sender whose push was denied
+// before the recipient granted consent, drops the consent policy's cached
+// denial so the push is decided afresh. It is honored only once the sender
+// is verified, and the policy limits how often each pair may use it.
+const RevalidateConsentHeader = "X-Push-Revalidate-Consent"
+
+// Sender quota headers, set on /push responses once the sender is known,
+// when abuse detection is enabled. Senders staying within the limit are
+// never suspended for bursts.
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"     // pushes allowed within abuse.burst_window
+	RateLimitRemainingHeader = "X-RateLimit-Remaining" // pushes the sender can make now
+	RateLimitResetHeader     = "X-RateLimit-Reset"     // seconds until the allowance is full again
+)
+
+// Queuer queues notifications for batched delivery to a single endpoint.
+// *batcher.Batcher implements this interface.
+type Queuer interface {
+	QueueWithOptions(ctx context.Context, recipient, fcmToken string, dataIDs [][]byte, opts batcher.QueueOptions) (string, error)
+}
+
+// storeRetryAfter is the Retry-After, in seconds, sent when pushes are
+// rejected because the store is unavailable.
+const storeRetryAfter = 30
+
+// ourcloudRetryAfter is the Retry-After, in seconds, sent when pushes are
+// rejected because OurCloud can't be reached.
+const ourcloudRetryAfter = 10
+
 // PushHandler handles incoming push notification requests.
 type PushHandler struct {
-	ocClient OurCloudClient
-	batcher  *batcher.Batcher
+	ocClient    OurCloudClient
+	queuer      Queuer
+	consent     consent.Policy
+	codec       *Codec
+	passthrough *Passthrough            // nil when no fields pass through
+	federation  *Federation             // nil when federation is disabled
+	abuse       *abuse.Detector         // nil when abuse detection is disabled
+	groups      DeviceGrouper           // nil when device groups are disabled
+	content     *ContentVerifier        // nil when data IDs aren't verified
+	replies     *consent.ReplyGrants    // nil when reply grants are disabled
+	classes     *senderclass.Classifier // nil when no sender classes are configured
+	duplicates  *DuplicateTracker       // nil when duplicate endpoints are pushed to
+	auth        *AuthChain              // nil when only OurCloud signatures are accepted
+	timing      bool                    // report stage timings in ServerTimingHeader
+	maxDelay    time.Duration           // zero when scheduled delivery is disabled
 }
 
 // NewPushHandler creates a new PushHandler.
-func NewPushHandler(ocClient *ourcloud.Client, b *batcher.Batcher) *PushHandler {
+func NewPushHandler(ocClient *ourcloud.Client, q Queuer) *PushHandler {
 	return &PushHandler{
 		ocClient: ocClient,
-		batcher:  b,
+		queuer:   q,
+		consent:  consent.ListPolicy{Lists: ocClient},
+		codec:    NewCodec(false),
 	}
 }
 
 // NewPushHandlerWithClient creates a new PushHandler with any OurCloudClient implementation.
 // This is useful for testing with mock clients.
-func NewPushHandlerWithClient(client OurCloudClient, b *batcher.Batcher) *PushHandler {
+func NewPushHandlerWithClient(client OurCloudClient, q Queuer) *PushHandler {
 	return &PushHandler{
 		ocClient: client,
-		batcher:  b,
+		queuer:   q,
+		consent:  consent.ListPolicy{Lists: client},
+		codec:    NewCodec(false),
 	}
 }
 
+// SetConsentPolicy replaces the default policy of honoring recipients'
+// OurCloud consent lists. Must be called before the handler serves requests.
+func (h *PushHandler) SetConsentPolicy(p consent.Policy) {
+	h.consent = p
+}
+
+// SetAuthChain authenticates senders with c instead of requiring their
+// OurCloud signature. Must be called before the handler serves requests.
+func (h *PushHandler) SetAuthChain(c *AuthChain) {
+	h.auth = c
+}
+
+// SetCodec replaces the default codec, which only speaks binary protobuf.
+// Must be called before the handler serves requests.
+func (h *PushHandler) SetCodec(c *Codec) {
+	h.codec = c
+}
+
+// SetPassthrough copies p's allowlisted unknown PushRequest fields into the
+// FCM data payload. Must be called before the handler serves requests.
+func (h *PushHandler) SetPassthrough(p *Passthrough) {
+	h.passthrough = p
+}
+
+// SetFederation enables forwarding pushes to peer gateways.
+// Must be called before the handler serves requests.
+func (h *PushHandler) SetFederation(f *Federation) {
+	h.federation = f
+}
+
+// SetAbuseDetector suspends senders d finds abusive. Must be called before
+// the handler serves requests.
+func (h *PushHandler) SetAbuseDetector(d *abuse.Detector) {
+	h.abuse = d
+}
+
+// SetDeviceGroups queues pushes to users with several local endpoints once,
+// for their device group, instead of once per endpoint. Must be called before
+// the handler serves requests.
+func (h *PushHandler) SetDeviceGroups(g DeviceGrouper) {
+	h.groups = g
+}
+
+// SetContentVerifier rejects pushes whose data IDs v can't find in OurCloud.
+// Must be called before the handler serves requests.
+func (h *PushHandler) SetContentVerifier(v *ContentVerifier) {
+	h.content = v
+}
+
+// SetReplyGrants lets recipients of accepted pushes push back to their
+// senders for a while, whatever the senders' consent, as g records. Must be
+// called before the handler serves requests.
+func (h *PushHandler) SetReplyGrants(g *consent.ReplyGrants) {
+	h.replies = g
+}
+
+// SetSenderClasses applies the batch window, batch size and push rate of
+// each sender's class, as c assigns them. Must be called before the handler
+// serves requests.
+func (h *PushHandler) SetSenderClasses(c *senderclass.Classifier) {
+	h.classes = c
+}
+
+// SetDuplicateTracker removes duplicate endpoints from each target's
+// endpoint list before fan-out, keeping one per device and token, and
+// records the duplicates in t. Must be called before the handler serves
+// requests.
+func (h *PushHandler) SetDuplicateTracker(t *DuplicateTracker) {
+	h.duplicates = t
+}
+
+// SetTiming reports how long each stage of every push took, in
+// ServerTimingHeader. Must be called before the handler serves requests.
+func (h *PushHandler) SetTiming(enabled bool) {
+	h.timing = enabled
+}
+
+// SetScheduling accepts DeliverAfterHeader on pushes, holding them up to
+// maxDelay. Must be called before the handler serves requests.
+func (h *PushHandler) SetScheduling(maxDelay time.Duration) {
+	h.maxDelay = maxDelay
+}
+
 // PushResponse represents the response to a push request.
 // This is serialized as protobuf in the HTTP response.
 type PushResponse struct {
-	Accepted  bool   `json:"accepted"`
-	RequestID string `json:"request_id,omitempty"`
-	ErrorCode int32  `json:"error_code"`
-	Message   string `json:"message,omitempty"`
+	Accepted   bool         `json:"accepted"`
+	RequestID  string       `json:"request_id,omitempty"`
+	RequestIDs []string     `json:"request_ids,omitempty"` // One per queued endpoint; sent via RequestIDsHeader
+	ErrorCode  int32        `json:"error_code"`
+	Message    string       `json:"message,omitempty"`
+	Quota      *abuse.Quota `json:"quota,omitempty"` // Sender's burst allowance; sent via the RateLimit headers
+	// Devices holds the result for each of the target's devices; sent via
+	// DeviceResultsHeader.
+	Devices []DeviceResult `json:"devices,omitempty"`
+}
+
+// DeviceResult is the outcome of queueing a push for one device.
+type DeviceResult struct {
+	DeviceID string `json:"device_id"`
+	Result   string `json:"result"` // DeviceQueued, DeviceFailed or DeviceInvalidToken
+}
+
+// deviceResults returns the same result for each of deviceIDs.
+func deviceResults(deviceIDs []string, result string) []DeviceResult {
+	results := make([]DeviceResult, len(deviceIDs))
+	for i, id := range deviceIDs {
+		results[i] = DeviceResult{DeviceID: id, Result: result}
+	}
+	return results
+}
+
+// formatDeviceResults formats results as a DeviceResultsHeader value.
+func formatDeviceResults(results []DeviceResult) string {
+	pairs := make([]string, len(results))
+	for i, r := range results {
+		pairs[i] = url.QueryEscape(r.DeviceID) + "=" + r.Result
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseDeviceResults parses a DeviceResultsHeader value, returning nil if
+// it is empty or malformed.
+func parseDeviceResults(header string) []DeviceResult {
+	if header == "" {
+		return nil
+	}
+	var results []DeviceResult
+	for _, pair := range strings.Split(header, ",") {
+		id, result, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil
+		}
+		deviceID, err := url.QueryUnescape(id)
+		if err != nil {
+			return nil
+		}
+		results = append(results, DeviceResult{DeviceID: deviceID, Result: result})
+	}
+	return results
 }
 
 // HandlePush handles POST /push requests.
 // It implements the validation pipeline:
-// 1. Parse request          -> error_code=4 on failure
-// 2. Verify sender sig      -> error_code=3 on failure
-// 3. Check consent list     -> error_code=2 if not consented
-// 4. Get endpoints          -> error_code=1 if none
-// 5. Queue for delivery     -> return request_id
+//
+//  1. Parse request          -> error_code=4 on failure
+//     Sender suspended       -> error_code=5
+//  2. Verify sender sig      -> error_code=3 on failure
+//  3. Check consent list     -> error_code=2 if not consented
+//  4. Get endpoints          -> error_code=1 if none
+//     OurCloud unreachable   -> error_code=6 in steps 2-4
+//     Data ID missing        -> error_code=7 with ourcloud.verify_content
+//     Client deadline passed -> error_code=10 in steps 2-4, with X-Push-Timeout
+//  5. Queue for delivery     -> return request_id
+//     Store unavailable      -> error_code=6
+//     Some endpoints failed  -> error_code=8, still accepted
+//
+// With federation enabled, step 5 also forwards the push to the peer gateways
+// serving some of the target's devices, and the response covers both. Peers
+// verify the sender's signature themselves, so only signed pushes are
+// forwarded; the devices of pushes authenticated otherwise by the auth
+// chain fail. A push marked forwarded must carry a valid
+// ForwardSignatureHeader, or it fails step 2.
+//
+// With timing enabled, the time spent in each step is reported in
+// ServerTimingHeader.
 func (h *PushHandler) HandlePush(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	if h.timing {
+		r = withStageTimer(r)
+	}
+	// Step 1: Parse the request; the codec answers bodies it can't parse
+	serveProto(w, r, h.codec, pushError, h.push)
+}
 
-	// Step 1: Parse the protobuf request
-	req, err := h.parseRequest(r)
-	if err != nil {
-		h.writeResponse(w, &PushResponse{
+// pushError is the PushResponse for a failed push.
+func pushError(code int32, message string) proto.Message {
+	return &pb.PushResponse{ErrorCode: code, Message: message}
+}
+
+// push runs the validation pipeline on a parsed request.
+func (h *PushHandler) push(w http.ResponseWriter, r *http.Request, req *pb.PushRequest) (proto.Message, int32) {
+	// The request ID set by middleware.RequestID traces the push through the
+	// logs, from here to the flush of each batch it joins
+	traceID := middleware.GetReqID(r.Context())
+	ctx := logfield.WithTrace(r.Context(), traceID)
+	timer := stageTimerFrom(ctx)
+	defer timer.write(w)
+	timer.mark(StageParse)
+
+	// Validate required fields
+	if err := h.validateRequest(req); err != nil {
+		return h.respond(w, &PushResponse{
 			Accepted:  false,
 			ErrorCode: ErrorCodeInvalidRequest,
-			Message:   "failed to parse request",
+			Message:   err.Error(),
 		})
-		return
 	}
 
-	// Validate required fields
-	if err := h.validateRequest(req); err != nil {
-		h.writeResponse(w, &PushResponse{
+	deadline, err := parseDeadline(r.Header.Get(ExpiresAtHeader))
+	if err != nil {
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeInvalidRequest,
+			Message:   err.Error(),
+		})
+	}
+	deliverAfter, err := h.parseDeliverAfter(r.Header.Get(DeliverAfterHeader), deadline)
+	if err != nil {
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeInvalidRequest,
+			Message:   err.Error(),
+		})
+	}
+	// OurCloud lookups and forwards to peers give up once the client's
+	// TimeoutHeader budget runs out
+	ctx, cancel, err := withClientTimeout(ctx, r.Header.Get(TimeoutHeader))
+	defer cancel()
+	if err != nil {
+		return h.respond(w, &PushResponse{
 			Accepted:  false,
 			ErrorCode: ErrorCodeInvalidRequest,
 			Message:   err.Error(),
 		})
-		return
 	}
 
-	// Step 2: Verify sender signature
-	valid, err := h.ocClient.VerifyPushRequest(ctx, req)
-	if err != nil || !valid {
-		h.writeResponse(w, &PushResponse{
+	// Suspended senders are turned away before any OurCloud lookups. Only
+	// pushes that pass signature verification are recorded below, so nobody
+	// can get a sender suspended by forging pushes in its name.
+	if s, ok := h.abuse.Suspended(req.SenderUsername); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(s.Until).Seconds())+1))
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeSuspended,
+			Message:   "sender suspended until " + s.Until.UTC().Format(time.RFC3339),
+			Quota:     h.quota(req.SenderUsername),
+		})
+	}
+
+	// Step 2: Verify sender signature, or the auth chain's credentials
+	authenticator, err := h.authenticate(ctx, r, req)
+	timer.mark(StageVerify)
+	if clientDeadlineExceeded(ctx) {
+		return h.deadlineExceeded(w)
+	}
+	if errors.Is(err, ourcloud.ErrUnavailable) {
+		return h.ourcloudUnavailable(w)
+	}
+	// Only peers holding the federation secret may mark a push forwarded
+	forwarded := h.federation != nil && r.Header.Get(ForwardedByHeader) != ""
+	if err == nil && forwarded && !h.federation.verify(r.Header, req) {
+		log.Printf("WARNING: rejecting push forwarded by %q without a valid %s%s", r.Header.Get(ForwardedByHeader), ForwardSignatureHeader, logfield.Format(logfield.Trace(ctx)))
+		err = errors.New("invalid forward signature")
+	}
+	if err != nil {
+		return h.respond(w, &PushResponse{
 			Accepted:  false,
 			ErrorCode: ErrorCodeSignatureFailed,
-			Message:   "signature verification failed",
+			Message:   h.authFailure(),
+		})
+	}
+
+	// Rate limits are counted for verified senders only, so nobody can use
+	// up another sender's allowance by forging pushes in its name
+	class, retryAfter, ok := h.classes.Allow(req.SenderUsername)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeRateLimited,
+			Message:   fmt.Sprintf("sender class %s allows %d pushes per %s", class.Name, class.MaxPushes, class.Per),
 		})
-		return
 	}
 
 	// Step 3: Check consent list
-	hasConsent, err := h.isConsented(ctx, req.TargetUsername, req.SenderUsername)
+	h.revalidateConsent(ctx, r, req.TargetUsername, req.SenderUsername)
+	hasConsent, byReply, err := h.isConsented(ctx, req.TargetUsername, req.SenderUsername)
+	timer.mark(StageConsent)
+	if clientDeadlineExceeded(ctx) {
+		return h.deadlineExceeded(w)
+	}
+	if errors.Is(err, ourcloud.ErrUnavailable) {
+		return h.ourcloudUnavailable(w)
+	}
 	if err != nil || !hasConsent {
-		h.writeResponse(w, &PushResponse{
+		h.abuse.Record(req.SenderUsername, true)
+		return h.respond(w, &PushResponse{
 			Accepted:  false,
 			ErrorCode: ErrorCodeNoConsent,
 			Message:   "sender not in consent list",
+			Quota:     h.quota(req.SenderUsername),
 		})
-		return
 	}
 
 	// Step 4: Get endpoints for target user
 	endpoints, err := h.ocClient.GetEndpoints(ctx, req.TargetUsername)
-	if err != nil || len(endpoints.Endpoints) == 0 {
-		h.writeResponse(w, &PushResponse{
+	timer.mark(StageEndpoints)
+	if clientDeadlineExceeded(ctx) {
+		return h.deadlineExceeded(w)
+	}
+	if errors.Is(err, ourcloud.ErrUnavailable) {
+		return h.ourcloudUnavailable(w)
+	}
+	usable := usableEndpoints(endpoints)
+	if err != nil || len(usable) == 0 {
+		h.abuse.Record(req.SenderUsername, true)
+		return h.respond(w, &PushResponse{
 			Accepted:  false,
 			ErrorCode: ErrorCodeNoEndpoints,
 			Message:   "no endpoints registered",
+			Quota:     h.quota(req.SenderUsername),
 		})
-		return
 	}
 
+	// Checked last, since it can cost a DHT lookup per data ID
+	if h.content != nil {
+		id := h.content.missing(ctx, req.DataIds)
+		timer.mark(StageContent)
+		// IDs that couldn't be checked in time were assumed to exist
+		if clientDeadlineExceeded(ctx) {
+			return h.deadlineExceeded(w)
+		}
+		if id != nil {
+			h.abuse.Record(req.SenderUsername, true)
+			return h.respond(w, &PushResponse{
+				Accepted:  false,
+				ErrorCode: ErrorCodeContentNotFound,
+				Message:   "data ID not found: " + hex.EncodeToString(id),
+				Quota:     h.quota(req.SenderUsername),
+			})
+		}
+	}
+
+	h.abuse.Record(req.SenderUsername, false)
+	quota := h.quota(req.SenderUsername)
+
 	// Step 5: Queue for delivery to each endpoint
-	var requestID string
-	for _, endpoint := range endpoints.Endpoints {
-		rid, err := h.batcher.Queue(ctx, endpoint.FcmToken, req.DataIds)
+	local := usable
+	if h.duplicates != nil {
+		var dups []DuplicateEndpoint
+		local, dups = dedupEndpoints(req.TargetUsername, local, time.Now())
+		h.duplicates.record(req.TargetUsername, dups)
+	}
+	var peers map[string][]string
+	if h.federation != nil {
+		local, peers = h.federation.route(ctx, req.TargetUsername, local, forwarded)
+	}
+	if h.groups != nil {
+		local = h.group(ctx, req.TargetUsername, local)
+	}
+	expected := len(local)
+	for _, devices := range peers {
+		expected += len(devices)
+	}
+	if expected == 0 {
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeNoEndpoints,
+			Message:   "no endpoints registered",
+			Quota:     quota,
+		})
+	}
+
+	opts := batcher.QueueOptions{
+		Deadline:     deadline,
+		Sender:       req.SenderUsername,
+		Data:         h.passthrough.extract(req),
+		TraceID:      traceID,
+		DeliverAfter: deliverAfter,
+	}
+	if class != nil {
+		opts.Window = class.Window
+		opts.MaxBatchSize = class.MaxSize
+	}
+	digest := batcher.EndpointsDigest(fcmTokens(usable))
+	var requestIDs []string
+	var devices []DeviceResult
+	storeUnavailable := false
+	for _, endpoint := range local {
+		opts.DeviceID = endpoint.DeviceId
+		opts.EndpointOptions = endpointOptions(endpoint)
+		// A group's notification key isn't in the endpoint list to check
+		opts.EndpointsDigest = ""
+		if endpoint.DeviceId != GroupDeviceID {
+			opts.EndpointsDigest = digest
+		}
+		rid, err := h.queuer.QueueWithOptions(ctx, req.TargetUsername, endpoint.FcmToken, req.DataIds, opts)
 		if err != nil {
-			log.Printf("WARNING: failed to queue for endpoint %s: %v", endpoint.DeviceId, err)
+			log.Printf("WARNING: failed to queue for endpoint %s: %v%s", endpoint.DeviceId, err, logfield.Format(logfield.Trace(ctx)))
+			storeUnavailable = storeUnavailable || errors.Is(err, batcher.ErrStoreUnavailable)
+			result := DeviceFailed
+			if errors.Is(err, batcher.ErrInvalidToken) {
+				result = DeviceInvalidToken
+			}
+			devices = append(devices, DeviceResult{DeviceID: endpoint.DeviceId, Result: result})
 			continue
 		}
-		if requestID == "" {
-			requestID = rid // Return the first successful request ID
+		requestIDs = append(requestIDs, rid)
+		devices = append(devices, DeviceResult{DeviceID: endpoint.DeviceId, Result: DeviceQueued})
+	}
+	switch {
+	case len(peers) == 0:
+	case authenticator != AuthSignature:
+		// A peer would reject the push without its signature
+		for _, peerDevices := range peers {
+			log.Printf("WARNING: not forwarding push authenticated by %s for %d endpoints; peers need a signature%s", authenticator, len(peerDevices), logfield.Format(logfield.Trace(ctx)))
+			devices = append(devices, deviceResults(peerDevices, DeviceFailed)...)
 		}
+	default:
+		peerIDs, peerDevices := h.federation.forwardAll(ctx, peers, req, r.Header)
+		requestIDs = append(requestIDs, peerIDs...)
+		devices = append(devices, peerDevices...)
 	}
+	timer.mark(StageQueue)
 
-	if requestID == "" {
-		h.writeResponse(w, &PushResponse{
+	if len(requestIDs) == 0 && storeUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(storeRetryAfter))
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeUnavailable,
+			Message:   "storage unavailable, retry later",
+			Quota:     quota,
+			Devices:   devices,
+		})
+	}
+	if len(requestIDs) == 0 && countResult(devices, DeviceInvalidToken) == len(devices) {
+		return h.respond(w, &PushResponse{
+			Accepted:  false,
+			ErrorCode: ErrorCodeNoEndpoints,
+			Message:   "no endpoints with a registered FCM token",
+			Quota:     quota,
+			Devices:   devices,
+		})
+	}
+	if len(requestIDs) == 0 {
+		return h.respond(w, &PushResponse{
 			Accepted:  false,
 			ErrorCode: ErrorCodeInvalidRequest,
 			Message:   "failed to queue notification",
+			Quota:     quota,
+			Devices:   devices,
 		})
-		return
 	}
 
-	h.writeResponse(w, &PushResponse{
-		Accepted:  true,
-		RequestID: requestID,
-		ErrorCode: ErrorCodeSuccess,
-	})
-}
+	// Replies don't grant replies, so a grant can't be renewed indefinitely
+	if h.replies != nil && !byReply {
+		if err := h.replies.Grant(ctx, req.SenderUsername, req.TargetUsername); err != nil {
+			log.Printf("WARNING: recording reply grant: %v%s", err, logfield.Format(
+				logfield.User("sender", req.SenderUsername),
+				logfield.User("recipient", req.TargetUsername),
+				logfield.Trace(ctx),
+			))
+		}
+	}
 
-// parseRequest reads and parses the protobuf PushRequest from the HTTP request body.
-func (h *PushHandler) parseRequest(r *http.Request) (*pb.PushRequest, error) {
-	// Check content type
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/x-protobuf" && contentType != "application/protobuf" {
-		return nil, &requestError{message: "invalid content type, expected application/x-protobuf"}
+	// Partial failure: accepted, since at least one device will be woken
+	code := int32(ErrorCodeSuccess)
+	var message string
+	if queued := countResult(devices, DeviceQueued); queued < len(devices) {
+		code = ErrorCodePartial
+		message = fmt.Sprintf("queued for %d of %d endpoints", queued, len(devices))
 	}
 
-	// Read body
-	body, err := io.ReadAll(r.Body)
+	log.Printf("INFO: queued push as %s%s", strings.Join(requestIDs, ","), logfield.Format(
+		logfield.User("sender", req.SenderUsername),
+		logfield.User("recipient", req.TargetUsername),
+		logfield.Trace(ctx),
+	))
+	return h.respond(w, &PushResponse{
+		Accepted:   true,
+		RequestID:  requestIDs[0],
+		RequestIDs: requestIDs,
+		ErrorCode:  code,
+		Message:    message,
+		Quota:      quota,
+		Devices:    devices,
+	})
+}
+
+// group replaces endpoints with a single endpoint for username's device
+// group, if they should be grouped. Endpoints are returned unchanged when
+// the group can't be set up, so the push still reaches each device.
+func (h *PushHandler) group(ctx context.Context, username string, endpoints []*pb.PushEndpoint) []*pb.PushEndpoint {
+	key, err := h.groups.Group(ctx, username, fcmTokens(endpoints))
 	if err != nil {
-		return nil, &requestError{message: "failed to read request body"}
+		log.Printf("WARNING: device group unavailable, sending to each device: %v%s", err, logfield.Format(logfield.User("recipient", username)))
+		return endpoints
 	}
-	defer r.Body.Close()
-
-	if len(body) == 0 {
-		return nil, &requestError{message: "empty request body"}
+	if key == "" {
+		return endpoints
 	}
+	return []*pb.PushEndpoint{{DeviceId: GroupDeviceID, FcmToken: key}}
+}
 
-	// Parse protobuf
-	var req pb.PushRequest
-	if err := proto.Unmarshal(body, &req); err != nil {
-		return nil, &requestError{message: "failed to unmarshal protobuf"}
+// fcmTokens returns the FCM tokens of endpoints.
+func fcmTokens(endpoints []*pb.PushEndpoint) []string {
+	tokens := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		tokens[i] = endpoint.FcmToken
 	}
+	return tokens
+}
 
-	return &req, nil
+// usableEndpoints returns the endpoints in list that have an FCM token.
+// Endpoint lists are published by users, so a nil list, nil entries, and
+// entries without a token are skipped rather than trusted.
+func usableEndpoints(list *pb.PushEndpointList) []*pb.PushEndpoint {
+	var usable []*pb.PushEndpoint
+	for _, endpoint := range list.GetEndpoints() {
+		if endpoint.GetFcmToken() != "" {
+			usable = append(usable, endpoint)
+		}
+	}
+	return usable
 }
 
 // validateRequest performs basic validation on the parsed PushRequest.
@@ -191,54 +680,173 @@ func (h *PushHandler) validateRequest(req *pb.PushRequest) error {
 	if req.TargetUsername == "" && len(req.TargetNodeIds) == 0 {
 		return &requestError{message: "target_username or target_node_ids is required"}
 	}
-	if len(req.Signature) == 0 {
+	// With an auth chain, other credentials may stand in for the signature
+	if len(req.Signature) == 0 && h.auth == nil {
 		return &requestError{message: "signature is required"}
 	}
 	return nil
 }
 
-// isConsented checks if the sender has consent to send push notifications to the target.
-func (h *PushHandler) isConsented(ctx context.Context, targetUsername, senderUsername string) (bool, error) {
-	return h.ocClient.HasConsent(ctx, targetUsername, senderUsername)
+// authenticate checks that req comes from its sender, by its OurCloud
+// signature or, with an auth chain set, by the chain. Returns the
+// authenticator that accepted it.
+func (h *PushHandler) authenticate(ctx context.Context, r *http.Request, req *pb.PushRequest) (string, error) {
+	if h.auth != nil {
+		return h.auth.Authenticate(ctx, r, req)
+	}
+	valid, err := h.ocClient.VerifyPushRequest(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if !valid {
+		return "", errSignatureInvalid
+	}
+	return AuthSignature, nil
 }
 
-// writeResponse writes a PushResponse as protobuf to the HTTP response.
-func (h *PushHandler) writeResponse(w http.ResponseWriter, resp *PushResponse) {
-	// Create protobuf response
-	pbResp := &pb.PushResponse{
-		Accepted:  resp.Accepted,
-		RequestId: resp.RequestID,
-		ErrorCode: resp.ErrorCode,
-		Message:   resp.Message,
+// authFailure is the message for a push whose sender wasn't authenticated.
+func (h *PushHandler) authFailure() string {
+	if h.auth != nil {
+		return "authentication failed"
+	}
+	return "signature verification failed"
+}
+
+// parseDeadline parses the ExpiresAtHeader value. An empty value means no deadline.
+func parseDeadline(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, &requestError{message: "invalid " + ExpiresAtHeader + " header"}
 	}
+	deadline := time.Unix(secs, 0)
+	if !deadline.After(time.Now()) {
+		return time.Time{}, &requestError{message: "delivery deadline has already passed"}
+	}
+	return deadline, nil
+}
 
-	data, err := proto.Marshal(pbResp)
+// parseDeliverAfter parses the DeliverAfterHeader value, which must be
+// before deadline if there is one. An empty value, or a time already
+// passed, means the push is queued now.
+func (h *PushHandler) parseDeliverAfter(value string, deadline time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if h.maxDelay <= 0 {
+		return time.Time{}, &requestError{message: "scheduled delivery is not enabled"}
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
 	if err != nil {
-		// Fallback to a simple error response
-		w.Header().Set("Content-Type", "application/x-protobuf")
-		w.WriteHeader(http.StatusInternalServerError)
+		return time.Time{}, &requestError{message: "invalid " + DeliverAfterHeader + " header"}
+	}
+	deliverAfter := time.Unix(secs, 0)
+	if time.Until(deliverAfter) > h.maxDelay {
+		return time.Time{}, &requestError{message: "delivery time is more than " + h.maxDelay.String() + " away"}
+	}
+	if !deadline.IsZero() && !deliverAfter.Before(deadline) {
+		return time.Time{}, &requestError{message: "delivery time is not before the delivery deadline"}
+	}
+	return deliverAfter, nil
+}
+
+// ourcloudUnavailable rejects a push that couldn't be checked because
+// OurCloud can't be reached. It isn't the sender's fault, so it isn't
+// recorded against them.
+func (h *PushHandler) ourcloudUnavailable(w http.ResponseWriter) (proto.Message, int32) {
+	w.Header().Set("Retry-After", strconv.Itoa(ourcloudRetryAfter))
+	return h.respond(w, &PushResponse{
+		Accepted:  false,
+		ErrorCode: ErrorCodeUnavailable,
+		Message:   "OurCloud unavailable, retry later",
+	})
+}
+
+// revalidateConsent drops the policy's cached denial of sender by
+// recipient when r asks for it with RevalidateConsentHeader. The sender
+// must already be verified.
+func (h *PushHandler) revalidateConsent(ctx context.Context, r *http.Request, recipient, sender string) {
+	if r.Header.Get(RevalidateConsentHeader) != "1" {
 		return
 	}
+	policy, ok := h.consent.(consent.Revalidator)
+	if !ok || !policy.Revalidate(recipient, sender) {
+		return
+	}
+	log.Printf("INFO: revalidating cached consent denial on request%s", logfield.Format(
+		logfield.User("sender", sender),
+		logfield.User("recipient", recipient),
+		logfield.Trace(ctx),
+	))
+}
+
+// isConsented checks if the consent policy lets the sender push to the
+// target or, with reply grants, if the target recently pushed to the sender.
+// byReply is true when only a reply grant allows the push.
+func (h *PushHandler) isConsented(ctx context.Context, targetUsername, senderUsername string) (allowed, byReply bool, err error) {
+	allowed, err = h.consent.Allow(ctx, targetUsername, senderUsername)
+	if allowed || h.replies == nil {
+		return allowed, false, err
+	}
+	granted, grantErr := h.replies.Allow(ctx, targetUsername, senderUsername)
+	if grantErr != nil {
+		log.Printf("WARNING: checking reply grant: %v%s", grantErr, logfield.Format(
+			logfield.User("sender", senderUsername),
+			logfield.User("recipient", targetUsername),
+		))
+	}
+	if granted {
+		return true, true, nil
+	}
+	return false, false, err
+}
 
-	w.Header().Set("Content-Type", "application/x-protobuf")
-
-	// Set appropriate status code based on error
-	switch resp.ErrorCode {
-	case ErrorCodeSuccess:
-		w.WriteHeader(http.StatusOK)
-	case ErrorCodeInvalidRequest:
-		w.WriteHeader(http.StatusBadRequest)
-	case ErrorCodeSignatureFailed:
-		w.WriteHeader(http.StatusUnauthorized)
-	case ErrorCodeNoConsent:
-		w.WriteHeader(http.StatusForbidden)
-	case ErrorCodeNoEndpoints:
-		w.WriteHeader(http.StatusNotFound)
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
+// countResult returns how many of results are result.
+func countResult(results []DeviceResult, result string) int {
+	n := 0
+	for _, r := range results {
+		if r.Result == result {
+			n++
+		}
+	}
+	return n
+}
+
+// quota returns sender's burst allowance, or nil when abuse detection is
+// disabled.
+func (h *PushHandler) quota(sender string) *abuse.Quota {
+	q, ok := h.abuse.Quota(sender)
+	if !ok {
+		return nil
 	}
+	return &q
+}
 
-	w.Write(data)
+// respond converts resp to its protobuf message, and sends its request IDs
+// in RequestIDsHeader and its quota in the RateLimit headers, for the codec
+// to write. pb.PushResponse, defined by the ourcloud-proto module, has no
+// quota field, so the headers are the only place clients find the quota.
+func (h *PushHandler) respond(w http.ResponseWriter, resp *PushResponse) (proto.Message, int32) {
+	if len(resp.RequestIDs) > 1 {
+		w.Header().Set(RequestIDsHeader, strings.Join(resp.RequestIDs, ","))
+	}
+	if len(resp.Devices) > 1 {
+		w.Header().Set(DeviceResultsHeader, formatDeviceResults(resp.Devices))
+	}
+	if q := resp.Quota; q != nil {
+		reset := max(time.Until(q.Reset), 0)
+		w.Header().Set(RateLimitLimitHeader, strconv.Itoa(q.Limit))
+		w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(q.Remaining))
+		w.Header().Set(RateLimitResetHeader, strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+	}
+	return &pb.PushResponse{
+		Accepted:  resp.Accepted,
+		RequestId: resp.RequestID,
+		ErrorCode: resp.ErrorCode,
+		Message:   resp.Message,
+	}, resp.ErrorCode
 }
 
 // requestError represents a validation error in the request.
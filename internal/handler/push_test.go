@@ -4,16 +4,26 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5/middleware"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/abuse"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/consent"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/senderclass"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
-	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -43,8 +53,8 @@ func (m *mockOurCloudClient) GetEndpoints(ctx context.Context, username string)
 // noopSender is a test sender that does nothing.
 type noopSender struct{}
 
-func (s *noopSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte) error {
-	return nil
+func (s *noopSender) Send(ctx context.Context, fcmToken string, dataIDs [][]byte, opts fcm.SendOptions) (string, error) {
+	return "projects/test/messages/1", nil
 }
 
 // createTestBatcher creates a batcher with an in-memory SQLite database for testing.
@@ -220,8 +230,8 @@ func TestParseRequest_ValidProtobuf(t *testing.T) {
 	httpReq := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
 	httpReq.Header.Set("Content-Type", "application/x-protobuf")
 
-	parsed, err := h.parseRequest(httpReq)
-	if err != nil {
+	var parsed pb.PushRequest
+	if err := h.codec.Decode(httpReq, &parsed); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
@@ -250,8 +260,8 @@ func TestParseRequest_AcceptsProtobufContentType(t *testing.T) {
 	httpReq := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
 	httpReq.Header.Set("Content-Type", "application/protobuf")
 
-	_, err := h.parseRequest(httpReq)
-	if err != nil {
+	var parsed pb.PushRequest
+	if err := h.codec.Decode(httpReq, &parsed); err != nil {
 		t.Errorf("should accept application/protobuf: %v", err)
 	}
 }
@@ -331,12 +341,14 @@ func TestWriteResponse_StatusCodes(t *testing.T) {
 		{"signature_failed", ErrorCodeSignatureFailed, http.StatusUnauthorized},
 		{"no_consent", ErrorCodeNoConsent, http.StatusForbidden},
 		{"no_endpoints", ErrorCodeNoEndpoints, http.StatusNotFound},
+		{"suspended", ErrorCodeSuspended, http.StatusTooManyRequests},
+		{"unavailable", ErrorCodeUnavailable, http.StatusServiceUnavailable},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			rr := httptest.NewRecorder()
-			h.writeResponse(rr, &PushResponse{
+			writeResponse(h, rr, &PushResponse{
 				Accepted:  tt.errorCode == ErrorCodeSuccess,
 				ErrorCode: tt.errorCode,
 			})
@@ -363,7 +375,7 @@ func TestWriteResponse_IncludesRequestID(t *testing.T) {
 	h := NewPushHandlerWithClient(nil, nil)
 	rr := httptest.NewRecorder()
 
-	h.writeResponse(rr, &PushResponse{
+	writeResponse(h, rr, &PushResponse{
 		Accepted:  true,
 		RequestID: "test-request-id-123",
 		ErrorCode: ErrorCodeSuccess,
@@ -377,6 +389,12 @@ func TestWriteResponse_IncludesRequestID(t *testing.T) {
 
 // Helper functions
 
+// writeResponse writes resp as HandlePush answers a protobuf request.
+func writeResponse(h *PushHandler, w *httptest.ResponseRecorder, resp *PushResponse) {
+	msg, code := h.respond(w, resp)
+	h.codec.Encode(w, httptest.NewRequest(http.MethodPost, "/push", nil), httpStatus(code), msg)
+}
+
 func marshalPushRequest(t *testing.T, req *pb.PushRequest) []byte {
 	t.Helper()
 	data, err := proto.Marshal(req)
@@ -510,6 +528,41 @@ func TestHandlePush_SignatureVerificationError(t *testing.T) {
 	}
 }
 
+func TestHandlePush_OurCloudUnavailable(t *testing.T) {
+	unavailable := fmt.Errorf("getting sender user auth: %w", ourcloud.ErrNotConnected)
+	tests := []struct {
+		name string
+		mock *mockOurCloudClient
+	}{
+		{name: "verify", mock: &mockOurCloudClient{verifyErr: unavailable}},
+		{name: "consent", mock: &mockOurCloudClient{verifyResult: true, hasConsentErr: unavailable}},
+		{name: "endpoints", mock: &mockOurCloudClient{verifyResult: true, hasConsentResult: true, endpointsErr: unavailable}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewPushHandlerWithClient(tt.mock, nil)
+			body := marshalPushRequest(t, &pb.PushRequest{
+				SenderUsername: "alice@oc",
+				TargetUsername: "bob@oc",
+				Signature:      []byte("valid-signature"),
+			})
+			req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			rr := httptest.NewRecorder()
+
+			h.HandlePush(rr, req)
+
+			resp := parsePushResponse(t, rr)
+			if rr.Code != http.StatusServiceUnavailable || resp.ErrorCode != ErrorCodeUnavailable {
+				t.Errorf("got %d with error_code=%d, want 503 with error_code=%d", rr.Code, resp.ErrorCode, ErrorCodeUnavailable)
+			}
+			if rr.Header().Get("Retry-After") == "" {
+				t.Error("missing Retry-After")
+			}
+		})
+	}
+}
+
 func TestHandlePush_NoConsent(t *testing.T) {
 	// Test acceptance criteria: Missing consent returns error_code=2
 	mock := &mockOurCloudClient{
@@ -575,6 +628,289 @@ func TestHandlePush_ConsentError(t *testing.T) {
 	}
 }
 
+func TestHandlePush_ConsentPolicy(t *testing.T) {
+	// The deny policy rejects senders even when they are on the consent list
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+	}
+	h := NewPushHandlerWithClient(mock, nil)
+	h.SetConsentPolicy(consent.NewDenyPolicy(nil))
+
+	pushReq := &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	}
+	body := marshalPushRequest(t, pushReq)
+
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	resp := parsePushResponse(t, rr)
+	if resp.Accepted {
+		t.Error("expected accepted=false under deny policy")
+	}
+	if resp.ErrorCode != ErrorCodeNoConsent {
+		t.Errorf("expected error_code=%d, got %d", ErrorCodeNoConsent, resp.ErrorCode)
+	}
+}
+
+// revalidatingPolicy denies pushes until a pair is revalidated, recording
+// the revalidations asked for.
+type revalidatingPolicy struct {
+	revalidated []string
+}
+
+func (p *revalidatingPolicy) Allow(ctx context.Context, recipient, sender string) (bool, error) {
+	return len(p.revalidated) > 0, nil
+}
+
+func (p *revalidatingPolicy) Revalidate(recipient, sender string) bool {
+	p.revalidated = append(p.revalidated, sender+"->"+recipient)
+	return true
+}
+
+func TestHandlePush_RevalidateConsent(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "device1", FcmToken: "token1"}},
+		},
+	}
+	policy := &revalidatingPolicy{}
+	h := NewPushHandlerWithClient(mock, &mockQueuer{})
+	h.SetConsentPolicy(policy)
+
+	push := func(revalidate string) *pb.PushResponse {
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: "alice@oc",
+			TargetUsername: "bob@oc",
+			Signature:      []byte("valid-signature"),
+			DataIds:        [][]byte{[]byte("data1")},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if revalidate != "" {
+			req.Header.Set(RevalidateConsentHeader, revalidate)
+		}
+		rr := httptest.NewRecorder()
+		h.HandlePush(rr, req)
+		return parsePushResponse(t, rr)
+	}
+
+	if resp := push(""); resp.ErrorCode != ErrorCodeNoConsent {
+		t.Fatalf("error_code = %d without the hint, want %d", resp.ErrorCode, ErrorCodeNoConsent)
+	}
+
+	// Forged pushes can't make the gateway drop a cached decision
+	mock.verifyResult = false
+	push("1")
+	mock.verifyResult = true
+	if len(policy.revalidated) != 0 {
+		t.Fatalf("revalidated %v for an unverified sender", policy.revalidated)
+	}
+
+	if resp := push("1"); !resp.Accepted {
+		t.Errorf("push with %s = %+v, want accepted", RevalidateConsentHeader, resp)
+	}
+	if want := []string{"alice@oc->bob@oc"}; !reflect.DeepEqual(policy.revalidated, want) {
+		t.Errorf("revalidated = %v, want %v", policy.revalidated, want)
+	}
+}
+
+// memGrants keeps reply grants in memory, without expiry.
+type memGrants map[[2]string]bool
+
+func (m memGrants) GrantReply(ctx context.Context, recipient, sender string, expiresAt time.Time) error {
+	m[[2]string{recipient, sender}] = true
+	return nil
+}
+
+func (m memGrants) HasReplyGrant(ctx context.Context, recipient, sender string) (bool, error) {
+	return m[[2]string{recipient, sender}], nil
+}
+
+func TestHandlePush_ReplyGrants(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "device1", FcmToken: "token1"}},
+		},
+	}
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewPushHandlerWithClient(mock, b)
+	grants := memGrants{}
+	h.SetReplyGrants(consent.NewReplyGrants(grants, time.Minute))
+
+	push := func(sender, target string) *pb.PushResponse {
+		t.Helper()
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: sender,
+			TargetUsername: target,
+			Signature:      []byte("valid-signature"),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		h.HandlePush(rr, req)
+		return parsePushResponse(t, rr)
+	}
+
+	// alice is on bob's consent list; bob isn't on anyone's
+	if resp := push("alice@oc", "bob@oc"); !resp.Accepted {
+		t.Fatalf("consented push rejected: %v", resp)
+	}
+	mock.hasConsentResult = false
+
+	if resp := push("bob@oc", "alice@oc"); !resp.Accepted {
+		t.Errorf("reply rejected with error_code %d, want accepted under the grant", resp.ErrorCode)
+	}
+	if grants[[2]string{"bob@oc", "alice@oc"}] {
+		t.Error("the reply granted alice a reply path; replies mustn't renew grants")
+	}
+	if resp := push("bob@oc", "carol@oc"); resp.ErrorCode != ErrorCodeNoConsent {
+		t.Errorf("push to a user bob wasn't pushed by: error_code = %d, want %d", resp.ErrorCode, ErrorCodeNoConsent)
+	}
+}
+
+func TestHandlePush_SenderClasses(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "device1", FcmToken: "token1"}},
+		},
+	}
+	queuer := &mockQueuer{}
+	h := NewPushHandlerWithClient(mock, queuer)
+	classes, err := senderclass.New([]senderclass.Class{
+		{Name: "interactive", Senders: []string{"*@chat.example"}, Window: 2 * time.Second, MaxSize: 20},
+		{Name: "bulk", Senders: []string{"backup@oc"}, Window: 10 * time.Minute, MaxPushes: 1, Per: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("senderclass.New() error = %v", err)
+	}
+	h.SetSenderClasses(classes)
+
+	push := func(sender string) (*httptest.ResponseRecorder, *pb.PushResponse) {
+		t.Helper()
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: sender,
+			TargetUsername: "bob@oc",
+			Signature:      []byte("valid-signature"),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		h.HandlePush(rr, req)
+		return rr, parsePushResponse(t, rr)
+	}
+
+	if _, resp := push("alice@chat.example"); !resp.Accepted {
+		t.Fatalf("interactive push rejected: %v", resp)
+	}
+	if queuer.lastOpts.Window != 2*time.Second || queuer.lastOpts.MaxBatchSize != 20 {
+		t.Errorf("interactive push queued with window %s, max size %d; want 2s, 20", queuer.lastOpts.Window, queuer.lastOpts.MaxBatchSize)
+	}
+
+	if _, resp := push("carol@oc"); !resp.Accepted {
+		t.Fatalf("unclassified push rejected: %v", resp)
+	}
+	if queuer.lastOpts.Window != 0 || queuer.lastOpts.MaxBatchSize != 0 {
+		t.Errorf("unclassified push queued with window %s, max size %d; want the batch defaults", queuer.lastOpts.Window, queuer.lastOpts.MaxBatchSize)
+	}
+
+	if _, resp := push("backup@oc"); !resp.Accepted {
+		t.Fatalf("first bulk push rejected: %v", resp)
+	}
+	rr, resp := push("backup@oc")
+	if resp.ErrorCode != ErrorCodeRateLimited || rr.Code != http.StatusTooManyRequests {
+		t.Errorf("bulk push over the class rate: error_code %d, status %d; want %d, %d", resp.ErrorCode, rr.Code, ErrorCodeRateLimited, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("rate-limited push has no Retry-After")
+	}
+
+	// Forged pushes don't use up the sender's allowance
+	mock.verifyResult = false
+	if _, resp := push("alice@chat.example"); resp.ErrorCode != ErrorCodeSignatureFailed {
+		t.Errorf("forged push: error_code = %d, want %d", resp.ErrorCode, ErrorCodeSignatureFailed)
+	}
+	if stats := classes.Stats(); stats[0].Pushes != 1 || stats[1].Pushes != 1 || stats[1].Limited != 1 {
+		t.Errorf("Stats() = %+v, want 1 interactive push, 1 bulk push and 1 limited", stats)
+	}
+}
+
+func TestHandlePush_SuspendedSender(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: false,
+	}
+	h := NewPushHandlerWithClient(mock, nil)
+	h.SetAbuseDetector(abuse.New(abuse.Config{MinPushes: 3, MaxRejectRatio: 0.5}))
+
+	push := func() (*httptest.ResponseRecorder, *pb.PushResponse) {
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: "spammer@oc",
+			TargetUsername: "bob@oc",
+			Signature:      []byte("valid-signature"),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		h.HandlePush(rr, req)
+		return rr, parsePushResponse(t, rr)
+	}
+
+	// Forged pushes fail verification and don't count against the sender
+	mock.verifyResult = false
+	for i := 0; i < 5; i++ {
+		if rr, _ := push(); rr.Header().Get(RateLimitRemainingHeader) != "" {
+			t.Errorf("forged push got %s = %q", RateLimitRemainingHeader, rr.Header().Get(RateLimitRemainingHeader))
+		}
+	}
+	mock.verifyResult = true
+
+	for i := 0; i < 3; i++ {
+		rr, resp := push()
+		if resp.ErrorCode != ErrorCodeNoConsent {
+			t.Fatalf("push %d: error_code = %d, want %d", i, resp.ErrorCode, ErrorCodeNoConsent)
+		}
+		// The default burst allowance is 200, until the third rejection
+		// gets the sender suspended
+		want := strconv.Itoa(199 - i)
+		if i == 2 {
+			want = "0"
+		}
+		if got := rr.Header().Get(RateLimitRemainingHeader); got != want {
+			t.Errorf("push %d: %s = %q, want %q", i, RateLimitRemainingHeader, got, want)
+		}
+	}
+
+	rr, resp := push()
+	if resp.ErrorCode != ErrorCodeSuspended {
+		t.Fatalf("error_code = %d, want %d", resp.ErrorCode, ErrorCodeSuspended)
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if retry, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || retry <= 0 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", rr.Header().Get("Retry-After"))
+	}
+	if got := rr.Header().Get(RateLimitRemainingHeader); got != "0" {
+		t.Errorf("%s = %q, want 0 while suspended", RateLimitRemainingHeader, got)
+	}
+	if reset, err := strconv.Atoi(rr.Header().Get(RateLimitResetHeader)); err != nil || reset <= 0 {
+		t.Errorf("%s = %q, want seconds until the suspension ends", RateLimitResetHeader, rr.Header().Get(RateLimitResetHeader))
+	}
+}
+
 func TestHandlePush_NoEndpoints(t *testing.T) {
 	// Test acceptance criteria: No endpoints returns error_code=1
 	mock := &mockOurCloudClient{
@@ -641,3 +977,422 @@ func TestHandlePush_EndpointsError(t *testing.T) {
 		t.Errorf("expected error_code=%d, got %d", ErrorCodeNoEndpoints, resp.ErrorCode)
 	}
 }
+
+// mockQueuer is a Queuer that returns sequential IDs and fails for selected tokens.
+type mockQueuer struct {
+	failTokens map[string]bool
+	failErr    error // returned for every token when set
+	queued     []string
+	lastOpts   batcher.QueueOptions
+}
+
+func (m *mockQueuer) QueueWithOptions(ctx context.Context, recipient, fcmToken string, dataIDs [][]byte, opts batcher.QueueOptions) (string, error) {
+	if m.failErr != nil {
+		return "", m.failErr
+	}
+	if m.failTokens[fcmToken] {
+		return "", errors.New("lock timeout")
+	}
+	m.queued = append(m.queued, fcmToken)
+	m.lastOpts = opts
+	return "req-" + fcmToken, nil
+}
+
+func TestHandlePush_QueuesEachEndpoint(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{
+				{DeviceId: "phone", FcmToken: "token1"},
+				{DeviceId: "tablet", FcmToken: "token2"},
+			},
+		},
+	}
+	q := &mockQueuer{}
+	h := NewPushHandlerWithClient(mock, q)
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set(middleware.RequestIDHeader, "trace-1")
+	rr := httptest.NewRecorder()
+
+	middleware.RequestID(http.HandlerFunc(h.HandlePush)).ServeHTTP(rr, req)
+
+	resp := parsePushResponse(t, rr)
+	if !resp.Accepted {
+		t.Fatalf("expected accepted=true, got message %q", resp.Message)
+	}
+	if len(q.queued) != 2 {
+		t.Errorf("expected 2 endpoints queued, got %d", len(q.queued))
+	}
+	if q.lastOpts.TraceID != "trace-1" {
+		t.Errorf("TraceID = %q, want the HTTP request ID %q", q.lastOpts.TraceID, "trace-1")
+	}
+	if want := batcher.EndpointsDigest([]string{"token2", "token1"}); q.lastOpts.EndpointsDigest != want {
+		t.Errorf("EndpointsDigest = %q, want the digest of the endpoint list %q", q.lastOpts.EndpointsDigest, want)
+	}
+	if resp.RequestId != "req-token1" {
+		t.Errorf("request_id = %q, want %q", resp.RequestId, "req-token1")
+	}
+	if got := rr.Header().Get(RequestIDsHeader); got != "req-token1,req-token2" {
+		t.Errorf("%s = %q, want %q", RequestIDsHeader, got, "req-token1,req-token2")
+	}
+}
+
+func TestHandlePush_InvalidTokens(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{
+				{DeviceId: "phone", FcmToken: "token1"},
+				{DeviceId: "tablet", FcmToken: "token2"},
+			},
+		},
+	}
+	h := NewPushHandlerWithClient(mock, &mockQueuer{failErr: batcher.ErrInvalidToken})
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	// Every token failed its preflight check, so there is nothing to wake
+	resp := parsePushResponse(t, rr)
+	if resp.Accepted || resp.ErrorCode != ErrorCodeNoEndpoints {
+		t.Errorf("accepted = %v, error_code = %d; want rejected with %d", resp.Accepted, resp.ErrorCode, ErrorCodeNoEndpoints)
+	}
+	if got := rr.Header().Get(DeviceResultsHeader); got != "phone=invalid_token,tablet=invalid_token" {
+		t.Errorf("%s = %q, want both devices invalid_token", DeviceResultsHeader, got)
+	}
+}
+
+// mockGrouper groups tokens under a fixed key, or fails.
+type mockGrouper struct {
+	key    string
+	err    error
+	tokens []string
+}
+
+func (m *mockGrouper) Group(ctx context.Context, username string, fcmTokens []string) (string, error) {
+	m.tokens = fcmTokens
+	return m.key, m.err
+}
+
+func TestHandlePush_DeviceGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		grouper    *mockGrouper
+		wantQueued []string
+		wantDevice string
+	}{
+		{name: "grouped", grouper: &mockGrouper{key: "group-key"}, wantQueued: []string{"group-key"}, wantDevice: GroupDeviceID},
+		{name: "not worth grouping", grouper: &mockGrouper{}, wantQueued: []string{"token1", "token2"}, wantDevice: "tablet"},
+		{name: "group unavailable", grouper: &mockGrouper{err: errors.New("FCM returned 500")}, wantQueued: []string{"token1", "token2"}, wantDevice: "tablet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockOurCloudClient{
+				verifyResult:     true,
+				hasConsentResult: true,
+				endpointsResult: &pb.PushEndpointList{
+					Endpoints: []*pb.PushEndpoint{
+						{DeviceId: "phone", FcmToken: "token1"},
+						{DeviceId: "tablet", FcmToken: "token2"},
+					},
+				},
+			}
+			q := &mockQueuer{}
+			h := NewPushHandlerWithClient(mock, q)
+			h.SetDeviceGroups(tt.grouper)
+
+			body := marshalPushRequest(t, &pb.PushRequest{
+				SenderUsername: "alice@oc",
+				TargetUsername: "bob@oc",
+				Signature:      []byte("valid-signature"),
+			})
+			req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			rr := httptest.NewRecorder()
+
+			h.HandlePush(rr, req)
+
+			resp := parsePushResponse(t, rr)
+			if !resp.Accepted || resp.Message != "" {
+				t.Fatalf("expected a complete accept, got %+v", resp)
+			}
+			if !reflect.DeepEqual(tt.grouper.tokens, []string{"token1", "token2"}) {
+				t.Errorf("grouped tokens = %v, want both endpoints", tt.grouper.tokens)
+			}
+			if !reflect.DeepEqual(q.queued, tt.wantQueued) {
+				t.Errorf("queued = %v, want %v", q.queued, tt.wantQueued)
+			}
+			if q.lastOpts.DeviceID != tt.wantDevice {
+				t.Errorf("device ID = %q, want %q", q.lastOpts.DeviceID, tt.wantDevice)
+			}
+		})
+	}
+}
+
+func TestHandlePush_StoreUnavailable(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token1"}},
+		},
+	}
+	storeErr := fmt.Errorf("%w: %w", batcher.ErrStoreUnavailable, errors.New("database or disk is full"))
+	h := NewPushHandlerWithClient(mock, &mockQueuer{failErr: storeErr})
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	resp := parsePushResponse(t, rr)
+	if resp.Accepted || resp.ErrorCode != ErrorCodeUnavailable {
+		t.Fatalf("response = %+v, want error_code %d", resp, ErrorCodeUnavailable)
+	}
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got == "" {
+		t.Error("expected a Retry-After header")
+	}
+}
+
+func TestHandlePush_PartialQueueFailure(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{
+				{DeviceId: "phone", FcmToken: "token1"},
+				{DeviceId: "tablet", FcmToken: "token2"},
+			},
+		},
+	}
+	h := NewPushHandlerWithClient(mock, &mockQueuer{failTokens: map[string]bool{"token1": true}})
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	resp := parsePushResponse(t, rr)
+	if !resp.Accepted {
+		t.Error("expected accepted=true when at least one endpoint is queued")
+	}
+	if resp.RequestId != "req-token2" {
+		t.Errorf("request_id = %q, want %q", resp.RequestId, "req-token2")
+	}
+	if !strings.Contains(resp.Message, "1 of 2") {
+		t.Errorf("message = %q, want partial-failure note", resp.Message)
+	}
+	if resp.ErrorCode != ErrorCodePartial {
+		t.Errorf("error_code = %d, want %d", resp.ErrorCode, ErrorCodePartial)
+	}
+	if got, want := rr.Header().Get(DeviceResultsHeader), "phone=failed,tablet=queued"; got != want {
+		t.Errorf("%s = %q, want %q", DeviceResultsHeader, got, want)
+	}
+}
+
+func TestParseDeviceResults(t *testing.T) {
+	results := []DeviceResult{
+		{DeviceID: "phone", Result: DeviceQueued},
+		{DeviceID: "a=b,c d", Result: DeviceFailed},
+	}
+	header := formatDeviceResults(results)
+	if header != "phone=queued,a%3Db%2Cc+d=failed" {
+		t.Errorf("formatDeviceResults = %q", header)
+	}
+	if got := parseDeviceResults(header); !reflect.DeepEqual(got, results) {
+		t.Errorf("parseDeviceResults(%q) = %v, want %v", header, got, results)
+	}
+	for _, header := range []string{"", "phone", "phone=queued,%zz=failed"} {
+		if got := parseDeviceResults(header); got != nil {
+			t.Errorf("parseDeviceResults(%q) = %v, want nil", header, got)
+		}
+	}
+}
+
+func TestHandlePush_AllQueueFailures(t *testing.T) {
+	mock := &mockOurCloudClient{
+		verifyResult:     true,
+		hasConsentResult: true,
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{
+				{DeviceId: "phone", FcmToken: "token1"},
+			},
+		},
+	}
+	h := NewPushHandlerWithClient(mock, &mockQueuer{failTokens: map[string]bool{"token1": true}})
+
+	body := marshalPushRequest(t, &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("valid-signature"),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	rr := httptest.NewRecorder()
+
+	h.HandlePush(rr, req)
+
+	resp := parsePushResponse(t, rr)
+	if resp.Accepted {
+		t.Error("expected accepted=false when no endpoint could be queued")
+	}
+	if resp.ErrorCode != ErrorCodeInvalidRequest {
+		t.Errorf("expected error_code=%d, got %d", ErrorCodeInvalidRequest, resp.ErrorCode)
+	}
+}
+
+func TestHandlePush_ExpiresAtHeader(t *testing.T) {
+	deadline := time.Now().Add(time.Minute).Truncate(time.Second)
+
+	tests := []struct {
+		name         string
+		header       string
+		wantAccepted bool
+		wantDeadline time.Time
+	}{
+		{name: "no header", header: "", wantAccepted: true},
+		{name: "future deadline", header: strconv.FormatInt(deadline.Unix(), 10), wantAccepted: true, wantDeadline: deadline},
+		{name: "past deadline", header: strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10), wantAccepted: false},
+		{name: "not a number", header: "tomorrow", wantAccepted: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockOurCloudClient{
+				verifyResult:     true,
+				hasConsentResult: true,
+				endpointsResult: &pb.PushEndpointList{
+					Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token1"}},
+				},
+			}
+			q := &mockQueuer{}
+			h := NewPushHandlerWithClient(mock, q)
+
+			body := marshalPushRequest(t, &pb.PushRequest{
+				SenderUsername: "alice@oc",
+				TargetUsername: "bob@oc",
+				Signature:      []byte("valid-signature"),
+			})
+			req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			if tt.header != "" {
+				req.Header.Set(ExpiresAtHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+
+			h.HandlePush(rr, req)
+
+			resp := parsePushResponse(t, rr)
+			if resp.Accepted != tt.wantAccepted {
+				t.Fatalf("accepted = %v, want %v (message %q)", resp.Accepted, tt.wantAccepted, resp.Message)
+			}
+			if !tt.wantAccepted {
+				if resp.ErrorCode != ErrorCodeInvalidRequest {
+					t.Errorf("error_code = %d, want %d", resp.ErrorCode, ErrorCodeInvalidRequest)
+				}
+				return
+			}
+			if !q.lastOpts.Deadline.Equal(tt.wantDeadline) {
+				t.Errorf("deadline = %v, want %v", q.lastOpts.Deadline, tt.wantDeadline)
+			}
+			if q.lastOpts.Sender != "alice@oc" {
+				t.Errorf("sender = %q, want %q", q.lastOpts.Sender, "alice@oc")
+			}
+		})
+	}
+}
+
+func TestHandlePush_DeliverAfterHeader(t *testing.T) {
+	deliverAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	unix := func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+
+	tests := []struct {
+		name         string
+		maxDelay     time.Duration
+		header       string
+		expiresAt    string
+		wantAccepted bool
+		wantAfter    time.Time
+	}{
+		{name: "scheduled", maxDelay: 24 * time.Hour, header: unix(deliverAfter), wantAccepted: true, wantAfter: deliverAfter},
+		{name: "scheduling disabled", header: unix(deliverAfter), wantAccepted: false},
+		{name: "beyond max delay", maxDelay: time.Minute, header: unix(deliverAfter), wantAccepted: false},
+		{name: "after deadline", maxDelay: 24 * time.Hour, header: unix(deliverAfter), expiresAt: unix(deliverAfter.Add(-time.Minute)), wantAccepted: false},
+		{name: "not a number", maxDelay: 24 * time.Hour, header: "later", wantAccepted: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockOurCloudClient{
+				verifyResult:     true,
+				hasConsentResult: true,
+				endpointsResult: &pb.PushEndpointList{
+					Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token1"}},
+				},
+			}
+			q := &mockQueuer{}
+			h := NewPushHandlerWithClient(mock, q)
+			h.SetScheduling(tt.maxDelay)
+
+			body := marshalPushRequest(t, &pb.PushRequest{
+				SenderUsername: "alice@oc",
+				TargetUsername: "bob@oc",
+				Signature:      []byte("valid-signature"),
+			})
+			req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			req.Header.Set(DeliverAfterHeader, tt.header)
+			if tt.expiresAt != "" {
+				req.Header.Set(ExpiresAtHeader, tt.expiresAt)
+			}
+			rr := httptest.NewRecorder()
+
+			h.HandlePush(rr, req)
+
+			resp := parsePushResponse(t, rr)
+			if resp.Accepted != tt.wantAccepted {
+				t.Fatalf("accepted = %v, want %v (message %q)", resp.Accepted, tt.wantAccepted, resp.Message)
+			}
+			if tt.wantAccepted && !q.lastOpts.DeliverAfter.Equal(tt.wantAfter) {
+				t.Errorf("deliver after = %v, want %v", q.lastOpts.DeliverAfter, tt.wantAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi/v5"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// EndpointLister reads the endpoints users publish in OurCloud.
+// *ourcloud.Client implements this interface.
+type EndpointLister interface {
+	GetEndpoints(ctx context.Context, username string) (*pb.PushEndpointList, error)
+}
+
+// QueueHandler lets recipients see what is waiting to be pushed to their
+// devices, so apps can sync eagerly instead of waiting for the push.
+type QueueHandler struct {
+	batcher   *batcher.Batcher
+	verifier  SignatureVerifier
+	endpoints EndpointLister
+}
+
+// NewQueueHandler creates a new QueueHandler. endpoints names devices whose
+// pending notifications didn't record a device ID.
+func NewQueueHandler(b *batcher.Batcher, verifier SignatureVerifier, endpoints EndpointLister) *QueueHandler {
+	return &QueueHandler{
+		batcher:   b,
+		verifier:  verifier,
+		endpoints: endpoints,
+	}
+}
+
+// QueueResponse is the JSON response for GET /queue/{recipient}.
+type QueueResponse struct {
+	Recipient string        `json:"recipient"`
+	Devices   []DeviceQueue `json:"devices"` // devices with pending notifications, soonest flush first
+}
+
+// DeviceQueue describes the pending batch for one of the recipient's devices.
+type DeviceQueue struct {
+	DeviceID string `json:"device_id"` // empty if the endpoint is no longer listed
+	Pending  int    `json:"pending"`   // notifications waiting in the batch
+	FlushAt  int64  `json:"flush_at"`  // Unix timestamp (seconds) the batch is due to be sent
+}
+
+// HandleGetQueue handles GET /queue/{recipient} requests. The request must
+// be signed by the recipient: SignatureHeader holds their signature of
+// SignedRequestMessage over the method, path, and TimestampHeader.
+//
+// Devices with nothing pending aren't listed. A batch can flush before
+// FlushAt, when it fills up or the gateway shuts down, or later, when a send
+// is retried.
+//
+// HTTP Status Codes:
+//   - 200 OK: Queue listed (possibly empty)
+//   - 401 Unauthorized: Missing, stale, or invalid signature
+//   - 500 Internal Server Error: Database error
+func (h *QueueHandler) HandleGetQueue(w http.ResponseWriter, r *http.Request) {
+	recipient := chi.URLParam(r, "recipient")
+	if msg := verifySignedRequest(r, h.verifier, recipient); msg != "" {
+		WriteError(w, r, http.StatusUnauthorized, CodeUnauthenticated, msg)
+		return
+	}
+
+	batches, err := h.batcher.ListByRecipient(r.Context(), recipient)
+	if err != nil {
+		log.Printf("ERROR: listing batches: %v%s", err, logfield.Format(logfield.User("recipient", recipient)))
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+
+	resp := QueueResponse{
+		Recipient: recipient,
+		Devices:   make([]DeviceQueue, 0, len(batches)),
+	}
+	var devices map[string]string // FCM token -> device ID, read when first needed
+	for fcmToken, batch := range batches {
+		if len(batch.Notifications) == 0 {
+			continue
+		}
+		// The latest notification has the freshest device ID
+		deviceID := batch.Notifications[len(batch.Notifications)-1].DeviceID
+		if deviceID == "" {
+			if devices == nil {
+				devices = h.deviceIDs(r.Context(), recipient)
+			}
+			deviceID = devices[fcmToken]
+		}
+		resp.Devices = append(resp.Devices, DeviceQueue{
+			DeviceID: deviceID,
+			Pending:  len(batch.Notifications),
+			FlushAt:  batch.FlushAt.Unix(),
+		})
+	}
+	sort.Slice(resp.Devices, func(i, j int) bool { return resp.Devices[i].FlushAt < resp.Devices[j].FlushAt })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// deviceIDs maps recipient's listed FCM tokens to their device IDs. It
+// returns an empty map if the endpoints can't be read.
+func (h *QueueHandler) deviceIDs(ctx context.Context, recipient string) map[string]string {
+	devices := make(map[string]string)
+	list, err := h.endpoints.GetEndpoints(ctx, recipient)
+	if err != nil {
+		log.Printf("WARNING: reading endpoints: %v%s", err, logfield.Format(logfield.User("recipient", recipient)))
+		return devices
+	}
+	for _, endpoint := range list.GetEndpoints() {
+		devices[endpoint.FcmToken] = endpoint.DeviceId
+	}
+	return devices
+}
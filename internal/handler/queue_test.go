@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+)
+
+func TestHandleGetQueue(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+
+	bobPub, bobKey, _ := ed25519.GenerateKey(nil)
+	_, aliceKey, _ := ed25519.GenerateKey(nil)
+	endpoints := &mockOurCloudClient{
+		endpointsResult: &pb.PushEndpointList{
+			Endpoints: []*pb.PushEndpoint{{DeviceId: "tablet", FcmToken: "token2"}},
+		},
+	}
+	h := NewQueueHandler(b, &mockConsentInspector{keys: map[string]ed25519.PublicKey{"bob@oc": bobPub}}, endpoints)
+	r := chi.NewRouter()
+	r.Get("/queue/{recipient}", h.HandleGetQueue)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := b.QueueWithOptions(ctx, "bob@oc", "token1", [][]byte{{byte(i)}}, batcher.QueueOptions{DeviceID: "phone"}); err != nil {
+			t.Fatalf("failed to queue: %v", err)
+		}
+	}
+	// No device ID recorded, so it comes from the endpoint list
+	if _, err := b.Queue(ctx, "bob@oc", "token2", [][]byte{{9}}); err != nil {
+		t.Fatalf("failed to queue: %v", err)
+	}
+	if _, err := b.Queue(ctx, "carol@oc", "token3", [][]byte{{9}}); err != nil {
+		t.Fatalf("failed to queue: %v", err)
+	}
+
+	get := func(key ed25519.PrivateKey) *httptest.ResponseRecorder {
+		t.Helper()
+		path := "/queue/bob@oc"
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, now)
+		req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedRequestMessage(http.MethodGet, path, now))))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := get(aliceKey); rr.Code != http.StatusUnauthorized {
+		t.Errorf("signed by another user: status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	rr := get(bobKey)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var resp QueueResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	pending := make(map[string]int)
+	for _, d := range resp.Devices {
+		pending[d.DeviceID] = d.Pending
+		if d.FlushAt < time.Now().Unix() {
+			t.Errorf("flush_at of %s = %d, want in the future", d.DeviceID, d.FlushAt)
+		}
+	}
+	if len(resp.Devices) != 2 || pending["phone"] != 2 || pending["tablet"] != 1 {
+		t.Errorf("devices = %+v, want phone with 2 pending and tablet with 1", resp.Devices)
+	}
+}
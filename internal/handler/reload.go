@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Components POST /admin/reload/{component} restarts.
+const (
+	ComponentOurCloud   = "ourcloud"    // reconnect to the OurCloud nodes
+	ComponentStore      = "store"       // reopen the database, e.g. after manual maintenance
+	ComponentFCM        = "fcm"         // rebuild the FCM client, rereading the credentials
+	ComponentRateLimits = "rate_limits" // refill every sender's push allowance
+)
+
+// reloadComponents are the components HandleReload accepts.
+var reloadComponents = map[string]bool{
+	ComponentOurCloud:   true,
+	ComponentStore:      true,
+	ComponentFCM:        true,
+	ComponentRateLimits: true,
+}
+
+// ErrNotReloadable is returned by a Reloader for a component it can't
+// restart, such as one the embedding program supplied or one that isn't
+// configured.
+var ErrNotReloadable = errors.New("component can't be reloaded")
+
+// Reloader restarts the gateway's components in place, without restarting
+// the process. *gateway.Gateway implements it.
+type Reloader interface {
+	Reload(ctx context.Context, component string) error
+}
+
+// ReloadResponse is the JSON response for POST /admin/reload/{component}.
+type ReloadResponse struct {
+	Component string `json:"component"`
+	Took      string `json:"took"` // e.g. "1.2s"
+}
+
+// SetReloader lets POST /admin/reload/{component} restart r's components.
+// Must be called before the handler serves requests.
+func (h *AdminHandler) SetReloader(r Reloader) {
+	h.reloader = r
+}
+
+// HandleReload handles POST /admin/reload/{component}?confirm={component}
+// requests, restarting one component in place. The confirm parameter must
+// repeat the component, so a stray request can't interrupt traffic. Every
+// attempt is written to the log with the operator making it, named by the
+// X-Admin-Actor header or the remote address.
+//
+// HTTP Status Codes:
+//   - 200 OK: Component reloaded
+//   - 400 Bad Request: Missing or mismatched confirm parameter
+//   - 404 Not Found: Unknown component
+//   - 409 Conflict: Component can't be reloaded in this gateway
+//   - 500 Internal Server Error: Reload failed
+func (h *AdminHandler) HandleReload(w http.ResponseWriter, r *http.Request) {
+	component := chi.URLParam(r, "component")
+	if !reloadComponents[component] {
+		WriteError(w, r, http.StatusNotFound, CodeNotFound, "unknown component")
+		return
+	}
+	if r.URL.Query().Get("confirm") != component {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "confirm="+component+" is required to reload "+component)
+		return
+	}
+
+	who := actor(r)
+	log.Printf("AUDIT: %s is reloading %s", who, component)
+	start := time.Now()
+	err := h.reloader.Reload(r.Context(), component)
+	took := time.Since(start).Round(time.Millisecond)
+	switch {
+	case errors.Is(err, ErrNotReloadable):
+		log.Printf("AUDIT: %s can't reload %s: %v", who, component, err)
+		WriteError(w, r, http.StatusConflict, CodeConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("AUDIT: %s failed to reload %s after %s: %v", who, component, took, err)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "reloading "+component+" failed: "+err.Error())
+		return
+	}
+	log.Printf("AUDIT: %s reloaded %s in %s", who, component, took)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&ReloadResponse{Component: component, Took: took.String()})
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// mockReloader records the components it reloads. Components in
+// unsupported aren't reloadable, and err fails every other reload.
+type mockReloader struct {
+	reloaded    []string
+	unsupported map[string]bool
+	err         error
+}
+
+func (m *mockReloader) Reload(ctx context.Context, component string) error {
+	if m.unsupported[component] {
+		return fmt.Errorf("%w: %s isn't configured", ErrNotReloadable, component)
+	}
+	if m.err != nil {
+		return m.err
+	}
+	m.reloaded = append(m.reloaded, component)
+	return nil
+}
+
+func TestHandleReload(t *testing.T) {
+	reloader := &mockReloader{unsupported: map[string]bool{ComponentOurCloud: true}}
+	h := NewAdminHandler(nil, "secret")
+	h.SetReloader(reloader)
+
+	reload := func(component, query string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload/"+component+query, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("component", component)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rr := httptest.NewRecorder()
+		h.HandleReload(rr, req)
+		return rr.Code
+	}
+
+	tests := []struct {
+		name      string
+		component string
+		query     string
+		want      int
+	}{
+		{"confirmed", ComponentStore, "?confirm=store", http.StatusOK},
+		{"unconfirmed", ComponentFCM, "", http.StatusBadRequest},
+		{"confirmed another component", ComponentFCM, "?confirm=store", http.StatusBadRequest},
+		{"unknown component", "cache", "?confirm=cache", http.StatusNotFound},
+		{"not reloadable", ComponentOurCloud, "?confirm=ourcloud", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if got := reload(tt.component, tt.query); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if want := []string{ComponentStore}; !slices.Equal(reloader.reloaded, want) {
+		t.Errorf("reloaded %v, want %v", reloader.reloaded, want)
+	}
+
+	reloader.err = errors.New("database is locked")
+	if got := reload(ComponentStore, "?confirm=store"); got != http.StatusInternalServerError {
+		t.Errorf("failed reload: status = %d, want %d", got, http.StatusInternalServerError)
+	}
+}
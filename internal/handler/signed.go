@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// Headers authenticating requests a user signs, such as
+// GET /consents/{recipient} and DELETE /push/{request_id}.
+const (
+	// SignatureHeader carries the user's ed25519 signature of
+	// SignedRequestMessage, base64-encoded.
+	SignatureHeader = "X-Push-Signature"
+	// TimestampHeader carries the signing time as Unix seconds.
+	TimestampHeader = "X-Push-Timestamp"
+)
+
+// maxSignatureSkew bounds how far a signed request's timestamp may be from
+// the gateway's clock, limiting how long a captured request can be replayed.
+const maxSignatureSkew = 5 * time.Minute
+
+// SignedRequestMessage returns the bytes a user signs to authenticate a
+// request: the method, the path, and the TimestampHeader value.
+func SignedRequestMessage(method, path, timestamp string) []byte {
+	return []byte(method + " " + path + "\n" + timestamp)
+}
+
+// SignatureVerifier verifies users' signatures.
+// *ourcloud.Client implements this interface.
+type SignatureVerifier interface {
+	VerifySignature(ctx context.Context, username string, message, signature []byte) (bool, error)
+}
+
+// verifySignedRequest checks that r is signed by username with a current
+// timestamp. Returns why not, or "" if it is.
+func verifySignedRequest(r *http.Request, verifier SignatureVerifier, username string) string {
+	timestamp := r.Header.Get(TimestampHeader)
+	encoded := r.Header.Get(SignatureHeader)
+	if timestamp == "" || encoded == "" {
+		return "signature required"
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid timestamp"
+	}
+	if skew := time.Since(time.Unix(secs, 0)); skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return "timestamp too far from server time"
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "invalid signature encoding"
+	}
+
+	valid, err := verifier.VerifySignature(r.Context(), username, SignedRequestMessage(r.Method, r.URL.Path, timestamp), signature)
+	if err != nil {
+		log.Printf("WARNING: verifying signature: %v%s", err, logfield.Format(logfield.User("user", username)))
+	}
+	if err != nil || !valid {
+		return "signature verification failed"
+	}
+	return ""
+}
@@ -2,12 +2,21 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/wurp/ourcloud-fcm-push-gateway/internal/batcher"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
 )
 
 // StatusHandler handles status query requests.
@@ -24,46 +33,176 @@ func NewStatusHandler(b *batcher.Batcher) *StatusHandler {
 
 // StatusResponse is the JSON response for GET /status/{id}.
 type StatusResponse struct {
-	State     string `json:"state"`                // "queued", "sent", "failed"
+	State     string `json:"state"`                // "scheduled", "queued", "sent", "failed", "failed_permanent", "expired", "timed_out", "lost", "cancelled", "skipped_invalid_token", "held_dnd", "dropped_dnd", "recipient_gone", "expired_unclaimed", "taken_over"
 	SentAt    int64  `json:"sent_at,omitempty"`    // Unix timestamp (seconds), omitted if not sent
-	Error     string `json:"error,omitempty"`      // Error message if failed
+	MessageID string `json:"message_id,omitempty"` // FCM message ID if sent
+	Error     string `json:"error,omitempty"`      // Error message if failed before reaching FCM
+	ErrorCode string `json:"error_code,omitempty"` // FCM error code if FCM rejected the send, e.g. "UNREGISTERED"
 	ExpiresAt int64  `json:"expires_at,omitempty"` // Unix timestamp (seconds) when record expires
+	Sender    string `json:"sender,omitempty"`     // Requesting username
+	Target    string `json:"target,omitempty"`     // Username the push was addressed to; omitted in privacy mode
+	DeviceID  string `json:"device_id,omitempty"`  // Target's device; omitted in privacy mode
+	QueuedAt  int64  `json:"queued_at,omitempty"`  // Unix timestamp (seconds) when first queued
 }
 
 // HandleGetStatus handles GET /status/{id} requests.
 // Returns JSON with delivery status for the given request ID.
 //
+// Responses carry an ETag; a request whose If-None-Match matches gets 304
+// with no body. While delivery is still pending, Retry-After suggests when
+// the status may next change, so pollers can back off.
+//
 // HTTP Status Codes:
 //   - 200 OK: Status found
+//   - 304 Not Modified: Status unchanged since the If-None-Match ETag
 //   - 400 Bad Request: Missing request ID
 //   - 404 Not Found: Request ID not found or expired
 //   - 500 Internal Server Error: Database error
 func (h *StatusHandler) HandleGetStatus(w http.ResponseWriter, r *http.Request) {
 	requestID := chi.URLParam(r, "id")
 	if requestID == "" {
-		http.Error(w, "missing request ID", http.StatusBadRequest)
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "missing request ID")
 		return
 	}
 
 	status, err := h.batcher.GetStatus(r.Context(), requestID)
 	if err != nil {
-		if strings.Contains(err.Error(), "request not found") {
-			http.Error(w, "request not found", http.StatusNotFound)
+		if errors.Is(err, store.ErrRequestNotFound) {
+			WriteError(w, r, http.StatusNotFound, CodeNotFound, "request not found")
 			return
 		}
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
 		return
 	}
 
+	resp := newStatusResponse(status)
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+		return
+	}
+	etag := statusETag(body)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if resp.State == store.StatusQueued || resp.State == store.StatusTimedOut || resp.State == store.StatusHeldDND {
+		w.Header().Set("Retry-After", retryAfterSeconds(h.batcher.BatchWindow()))
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+// MaxBatchStatusIDs caps the request IDs accepted by one POST /status/batch.
+const MaxBatchStatusIDs = 100
+
+// BatchStatusRequest is the JSON body for POST /status/batch.
+type BatchStatusRequest struct {
+	RequestIDs []string `json:"request_ids"`
+}
+
+// BatchStatusResponse is the JSON response for POST /status/batch.
+type BatchStatusResponse struct {
+	Statuses map[string]*StatusResponse `json:"statuses"`            // Keyed by request ID
+	NotFound []string                   `json:"not_found,omitempty"` // IDs with no status, e.g. expired
+}
+
+// HandleBatchStatus handles POST /status/batch requests.
+// Returns the statuses of up to MaxBatchStatusIDs request IDs in one response.
+//
+// HTTP Status Codes:
+//   - 200 OK: Lookup done; unknown IDs are listed in not_found
+//   - 400 Bad Request: Malformed body, no IDs, or too many IDs
+//   - 500 Internal Server Error: Database error
+func (h *StatusHandler) HandleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	var req BatchStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "invalid JSON body")
+		return
+	}
+	if len(req.RequestIDs) == 0 {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, "request_ids is required")
+		return
+	}
+	if len(req.RequestIDs) > MaxBatchStatusIDs {
+		WriteError(w, r, http.StatusBadRequest, CodeInvalidArgument, fmt.Sprintf("at most %d request_ids per call", MaxBatchStatusIDs))
+		return
+	}
+
+	resp := &BatchStatusResponse{Statuses: make(map[string]*StatusResponse, len(req.RequestIDs))}
+	for _, id := range req.RequestIDs {
+		if _, seen := resp.Statuses[id]; seen || id == "" {
+			continue
+		}
+		status, err := h.batcher.GetStatus(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, store.ErrRequestNotFound) {
+				if !slices.Contains(resp.NotFound, id) {
+					resp.NotFound = append(resp.NotFound, id)
+				}
+				continue
+			}
+			WriteError(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+			return
+		}
+		resp.Statuses[id] = newStatusResponse(status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// newStatusResponse converts a stored status to its JSON form.
+func newStatusResponse(status store.Status) *StatusResponse {
 	resp := &StatusResponse{
 		State:     status.State,
+		MessageID: status.MessageID,
 		Error:     status.Error,
+		ErrorCode: status.ErrorCode,
 		ExpiresAt: status.ExpiresAt.Unix(),
+		Sender:    status.Sender,
+		Target:    status.Target,
+		DeviceID:  status.DeviceID,
 	}
 	if status.SentAt != nil {
 		resp.SentAt = status.SentAt.Unix()
 	}
+	if !status.QueuedAt.IsZero() {
+		resp.QueuedAt = status.QueuedAt.Unix()
+	}
+	return resp
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+// statusETag derives a strong ETag from the encoded status response, so it
+// changes whenever any field the client sees changes.
+func statusETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag,
+// using the weak comparison RFC 9110 specifies for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfterSeconds formats d as a Retry-After value, rounded up to at least one second.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
 }
@@ -3,8 +3,10 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,7 +21,7 @@ func TestHandleGetStatus_BeforeFlush_NotFound(t *testing.T) {
 	h := NewStatusHandler(b)
 
 	// Queue a notification to get a request ID
-	requestID, err := b.Queue(context.Background(), "test-token", [][]byte{{1, 2, 3}})
+	requestID, err := b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{1, 2, 3}})
 	if err != nil {
 		t.Fatalf("failed to queue: %v", err)
 	}
@@ -84,14 +86,14 @@ func TestHandleGetStatus_AfterFlush_Sent(t *testing.T) {
 	h := NewStatusHandler(b)
 
 	// Queue a notification
-	requestID, err := b.Queue(context.Background(), "test-token", [][]byte{{1, 2, 3}})
+	requestID, err := b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{1, 2, 3}})
 	if err != nil {
 		t.Fatalf("failed to queue: %v", err)
 	}
 
 	// Queue enough to trigger immediate flush (MaxBatchSize is 100, so queue 100)
 	for i := 0; i < 99; i++ {
-		_, err := b.Queue(context.Background(), "test-token", [][]byte{{byte(i)}})
+		_, err := b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{byte(i)}})
 		if err != nil {
 			t.Fatalf("failed to queue: %v", err)
 		}
@@ -128,6 +130,9 @@ func TestHandleGetStatus_AfterFlush_Sent(t *testing.T) {
 	if resp.ExpiresAt == 0 {
 		t.Error("expected non-zero expires_at")
 	}
+	if resp.Target != "bob@oc" || resp.QueuedAt == 0 {
+		t.Errorf("target = %q, queued_at = %d; want bob@oc and non-zero", resp.Target, resp.QueuedAt)
+	}
 }
 
 func TestHandleGetStatus_ContentType(t *testing.T) {
@@ -136,9 +141,9 @@ func TestHandleGetStatus_ContentType(t *testing.T) {
 	h := NewStatusHandler(b)
 
 	// Queue and flush to get a valid status
-	requestID, _ := b.Queue(context.Background(), "test-token", [][]byte{{1}})
+	requestID, _ := b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{1}})
 	for i := 0; i < 99; i++ {
-		b.Queue(context.Background(), "test-token", [][]byte{{byte(i)}})
+		b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{byte(i)}})
 	}
 	time.Sleep(100 * time.Millisecond)
 
@@ -156,3 +161,160 @@ func TestHandleGetStatus_ContentType(t *testing.T) {
 		t.Errorf("Content-Type = %q, want %q", contentType, "application/json")
 	}
 }
+
+func TestHandleGetStatus_IfNoneMatch(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewStatusHandler(b)
+
+	// Queue and flush to get a valid status
+	requestID, _ := b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{1}})
+	for i := 0; i < 99; i++ {
+		b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{byte(i)}})
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/status/"+requestID, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", requestID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rr := httptest.NewRecorder()
+		h.HandleGetStatus(rr, req)
+		return rr
+	}
+
+	first := get("")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", first.Code, http.StatusOK)
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected ETag header")
+	}
+	if first.Header().Get("Retry-After") != "" {
+		t.Errorf("Retry-After = %q, want none for a sent notification", first.Header().Get("Retry-After"))
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{name: "matching", ifNoneMatch: etag, want: http.StatusNotModified},
+		{name: "weak", ifNoneMatch: "W/" + etag, want: http.StatusNotModified},
+		{name: "list", ifNoneMatch: `"other", ` + etag, want: http.StatusNotModified},
+		{name: "wildcard", ifNoneMatch: "*", want: http.StatusNotModified},
+		{name: "stale", ifNoneMatch: `"other"`, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := get(tt.ifNoneMatch)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+			if rr.Header().Get("ETag") != etag {
+				t.Errorf("ETag = %q, want %q", rr.Header().Get("ETag"), etag)
+			}
+			if tt.want == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("expected empty body for 304, got %q", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleBatchStatus(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewStatusHandler(b)
+
+	// Queue a full batch so it flushes immediately
+	var sentID string
+	for i := 0; i < 100; i++ {
+		id, err := b.Queue(context.Background(), "bob@oc", "test-token", [][]byte{{byte(i)}})
+		if err != nil {
+			t.Fatalf("failed to queue: %v", err)
+		}
+		if i == 0 {
+			sentID = id
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	body := `{"request_ids": ["` + sentID + `", "nonexistent-id", "` + sentID + `"]}`
+	req := httptest.NewRequest(http.MethodPost, "/status/batch", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	h.HandleBatchStatus(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+
+	var resp BatchStatusResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.Statuses) != 1 || resp.Statuses[sentID] == nil {
+		t.Fatalf("statuses = %v, want only %s", resp.Statuses, sentID)
+	}
+	if resp.Statuses[sentID].State != "sent" {
+		t.Errorf("state = %q, want %q", resp.Statuses[sentID].State, "sent")
+	}
+	if len(resp.NotFound) != 1 || resp.NotFound[0] != "nonexistent-id" {
+		t.Errorf("not_found = %v, want [nonexistent-id]", resp.NotFound)
+	}
+}
+
+func TestHandleBatchStatus_BadRequest(t *testing.T) {
+	b, cleanup := createTestBatcher(t)
+	defer cleanup()
+	h := NewStatusHandler(b)
+
+	tooMany := make([]string, MaxBatchStatusIDs+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("id-%d", i)
+	}
+	tooManyBody, _ := json.Marshal(&BatchStatusRequest{RequestIDs: tooMany})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"malformed", "{"},
+		{"empty", `{"request_ids": []}`},
+		{"too_many", string(tooManyBody)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/status/batch", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+
+			h.HandleBatchStatus(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 0, want: "1"},
+		{d: 100 * time.Millisecond, want: "1"},
+		{d: 5 * time.Second, want: "5"},
+		{d: 5500 * time.Millisecond, want: "6"},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.d); got != tt.want {
+			t.Errorf("retryAfterSeconds(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServerTimingHeader reports how long each stage of a push took, when push
+// timing is enabled, in the standard Server-Timing format with durations in
+// milliseconds, e.g. "parse;dur=0.041, verify;dur=2.310, total;dur=3.052".
+// Stages the push didn't reach are left out.
+const ServerTimingHeader = "Server-Timing"
+
+// Push stages reported in ServerTimingHeader.
+const (
+	StageParse     = "parse"     // reading and decoding the request
+	StageVerify    = "verify"    // checking the sender's signature
+	StageConsent   = "consent"   // checking the consent policy
+	StageEndpoints = "endpoints" // looking up the target's endpoints
+	StageContent   = "content"   // verifying data IDs, with ourcloud.verify_content
+	StageQueue     = "queue"     // routing, grouping and queueing the notifications
+	StageTotal     = "total"     // the whole push
+)
+
+// stageTimer measures the stages of one push. A nil *stageTimer measures
+// nothing, so the pipeline can mark stages unconditionally.
+type stageTimer struct {
+	start  time.Time
+	last   time.Time
+	stages []stageTiming
+}
+
+// stageTiming is how long one stage took.
+type stageTiming struct {
+	name string
+	dur  time.Duration
+}
+
+type stageTimerKey struct{}
+
+// withStageTimer returns a copy of r carrying a timer started now.
+func withStageTimer(r *http.Request) *http.Request {
+	now := time.Now()
+	t := &stageTimer{start: now, last: now}
+	return r.WithContext(context.WithValue(r.Context(), stageTimerKey{}, t))
+}
+
+// stageTimerFrom returns the timer carried by ctx, or nil.
+func stageTimerFrom(ctx context.Context) *stageTimer {
+	t, _ := ctx.Value(stageTimerKey{}).(*stageTimer)
+	return t
+}
+
+// mark ends stage, which began when the previous one ended.
+func (t *stageTimer) mark(stage string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.stages = append(t.stages, stageTiming{name: stage, dur: now.Sub(t.last)})
+	t.last = now
+}
+
+// write sets ServerTimingHeader to the stages marked so far, followed by the
+// total time since the timer started.
+func (t *stageTimer) write(w http.ResponseWriter) {
+	if t == nil {
+		return
+	}
+	parts := make([]string, 0, len(t.stages)+1)
+	for _, s := range t.stages {
+		parts = append(parts, formatTiming(s.name, s.dur))
+	}
+	parts = append(parts, formatTiming(StageTotal, time.Since(t.start)))
+	w.Header().Set(ServerTimingHeader, strings.Join(parts, ", "))
+}
+
+// formatTiming formats one Server-Timing metric, to the microsecond.
+func formatTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d.Microseconds())/1000)
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+)
+
+func TestHandlePush_Timing(t *testing.T) {
+	push := func(h *PushHandler) *httptest.ResponseRecorder {
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: "alice@oc",
+			TargetUsername: "bob@oc",
+			Signature:      []byte("valid-signature"),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/push", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		h.HandlePush(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name   string
+		mock   *mockOurCloudClient
+		queuer Queuer
+		want   string
+	}{
+		{
+			name: "accepted",
+			mock: &mockOurCloudClient{
+				verifyResult:     true,
+				hasConsentResult: true,
+				endpointsResult: &pb.PushEndpointList{
+					Endpoints: []*pb.PushEndpoint{{DeviceId: "device1", FcmToken: "token1"}},
+				},
+			},
+			queuer: &mockQueuer{},
+			want:   `^parse;dur=\d+\.\d{3}, verify;dur=\d+\.\d{3}, consent;dur=\d+\.\d{3}, endpoints;dur=\d+\.\d{3}, queue;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`,
+		},
+		{
+			name: "no consent",
+			mock: &mockOurCloudClient{verifyResult: true},
+			want: `^parse;dur=\d+\.\d{3}, verify;dur=\d+\.\d{3}, consent;dur=\d+\.\d{3}, total;dur=\d+\.\d{3}$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewPushHandlerWithClient(tt.mock, tt.queuer)
+			h.SetTiming(true)
+			rr := push(h)
+			if got := rr.Header().Get(ServerTimingHeader); !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("%s = %q, want match for %s", ServerTimingHeader, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		h := NewPushHandlerWithClient(&mockOurCloudClient{verifyResult: true}, nil)
+		if got := push(h).Header().Get(ServerTimingHeader); got != "" {
+			t.Errorf("%s = %q, want none", ServerTimingHeader, got)
+		}
+	})
+}
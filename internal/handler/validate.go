@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+)
+
+// Stages reported by POST /validate, in the order they are checked.
+const (
+	ValidateStageRequest   = "request"   // body parses, required fields and headers are valid
+	ValidateStageSender    = "sender"    // sender isn't suspended for abuse
+	ValidateStageSignature = "signature" // sender's signature, or auth chain credentials, verify
+	ValidateStageConsent   = "consent"   // target's consent policy lets the sender push
+	ValidateStageEndpoints = "endpoints" // target has registered endpoints
+	ValidateStageContent   = "content"   // data IDs exist in OurCloud, with ourcloud.verify_content
+)
+
+// StageResult is the outcome of one stage in the POST /validate response.
+type StageResult struct {
+	Stage   string `json:"stage"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// ValidateResponse is the JSON response for POST /validate.
+type ValidateResponse struct {
+	// Valid is true when every stage passed, so /push would queue the request.
+	Valid bool `json:"valid"`
+	// ErrorCode is the error code /push would answer with, or 0.
+	ErrorCode int32 `json:"error_code"`
+	// Stages lists the stages checked, ending with the first that failed.
+	Stages []StageResult `json:"stages"`
+	// Endpoints counts the target's endpoints, once that stage is reached.
+	Endpoints int `json:"endpoints"`
+}
+
+// HandleValidate handles POST /validate requests, running a signed
+// PushRequest through the checks /push makes without queueing it, so
+// integrators can verify their signing and consent setup before going live.
+// The body is read as for /push, including ExpiresAtHeader and
+// TimeoutHeader.
+//
+// Checking stops at the first stage that fails. Later stages need the
+// earlier ones: consent and endpoints are only looked up for a verified
+// sender, so nobody learns of another user's setup. Verified senders'
+// validations are recorded by abuse detection as pushes are, so failing
+// ones can't probe consent and endpoints for free. No FCM message is sent.
+//
+// HTTP Status Codes:
+//   - 200 OK: Report returned, whether or not the request is valid
+//   - 503 Service Unavailable: OurCloud unreachable; the report ends at the
+//     stage that needed it
+//   - 504 Gateway Timeout: TimeoutHeader passed; the report ends at the
+//     stage that was running
+func (h *PushHandler) HandleValidate(w http.ResponseWriter, r *http.Request) {
+	resp := h.validate(r)
+	status := http.StatusOK
+	if resp.ErrorCode == ErrorCodeUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(ourcloudRetryAfter))
+		status = http.StatusServiceUnavailable
+	}
+	if resp.ErrorCode == ErrorCodeDeadlineExceeded {
+		status = http.StatusGatewayTimeout
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// validate runs the /push checks on r's body, stopping at the first that
+// fails.
+func (h *PushHandler) validate(r *http.Request) *ValidateResponse {
+	ctx := r.Context()
+	resp := &ValidateResponse{Stages: []StageResult{}}
+	fail := func(stage string, code int32, message string) *ValidateResponse {
+		resp.Stages = append(resp.Stages, StageResult{Stage: stage, Message: message})
+		resp.ErrorCode = code
+		return resp
+	}
+	pass := func(stage, message string) {
+		resp.Stages = append(resp.Stages, StageResult{Stage: stage, OK: true, Message: message})
+	}
+
+	var req pb.PushRequest
+	if err := h.codec.Decode(r, &req); err != nil {
+		return fail(ValidateStageRequest, ErrorCodeInvalidRequest, err.Error())
+	}
+	if err := h.validateRequest(&req); err != nil {
+		return fail(ValidateStageRequest, ErrorCodeInvalidRequest, err.Error())
+	}
+	deadline, err := parseDeadline(r.Header.Get(ExpiresAtHeader))
+	if err != nil {
+		return fail(ValidateStageRequest, ErrorCodeInvalidRequest, err.Error())
+	}
+	if _, err := h.parseDeliverAfter(r.Header.Get(DeliverAfterHeader), deadline); err != nil {
+		return fail(ValidateStageRequest, ErrorCodeInvalidRequest, err.Error())
+	}
+	ctx, cancel, err := withClientTimeout(ctx, r.Header.Get(TimeoutHeader))
+	defer cancel()
+	if err != nil {
+		return fail(ValidateStageRequest, ErrorCodeInvalidRequest, err.Error())
+	}
+	pass(ValidateStageRequest, "")
+
+	if s, ok := h.abuse.Suspended(req.SenderUsername); ok {
+		return fail(ValidateStageSender, ErrorCodeSuspended, "sender suspended until "+s.Until.UTC().Format(time.RFC3339))
+	}
+	if class := h.classes.Match(req.SenderUsername); class != nil {
+		pass(ValidateStageSender, "sender class "+class.Name)
+	} else {
+		pass(ValidateStageSender, "")
+	}
+
+	authenticator, err := h.authenticate(ctx, r, &req)
+	if clientDeadlineExceeded(ctx) {
+		return fail(ValidateStageSignature, ErrorCodeDeadlineExceeded, "deadline exceeded")
+	}
+	if errors.Is(err, ourcloud.ErrUnavailable) {
+		return fail(ValidateStageSignature, ErrorCodeUnavailable, "OurCloud unavailable, retry later")
+	}
+	if errors.Is(err, errSignatureInvalid) {
+		return fail(ValidateStageSignature, ErrorCodeSignatureFailed, h.authFailure())
+	}
+	if err != nil {
+		return fail(ValidateStageSignature, ErrorCodeSignatureFailed, h.authFailure()+": "+err.Error())
+	}
+	if h.auth != nil {
+		pass(ValidateStageSignature, "authenticated by "+authenticator)
+	} else {
+		pass(ValidateStageSignature, "")
+	}
+
+	h.revalidateConsent(ctx, r, req.TargetUsername, req.SenderUsername)
+	hasConsent, byReply, err := h.isConsented(ctx, req.TargetUsername, req.SenderUsername)
+	if clientDeadlineExceeded(ctx) {
+		return fail(ValidateStageConsent, ErrorCodeDeadlineExceeded, "deadline exceeded")
+	}
+	if errors.Is(err, ourcloud.ErrUnavailable) {
+		return fail(ValidateStageConsent, ErrorCodeUnavailable, "OurCloud unavailable, retry later")
+	}
+	if err != nil {
+		h.abuse.Record(req.SenderUsername, true)
+		return fail(ValidateStageConsent, ErrorCodeNoConsent, "consent check failed: "+err.Error())
+	}
+	if !hasConsent {
+		h.abuse.Record(req.SenderUsername, true)
+		return fail(ValidateStageConsent, ErrorCodeNoConsent, "sender not in consent list")
+	}
+	if byReply {
+		pass(ValidateStageConsent, "allowed as a reply to a recent push from the target")
+	} else {
+		pass(ValidateStageConsent, "")
+	}
+
+	endpoints, err := h.ocClient.GetEndpoints(ctx, req.TargetUsername)
+	if clientDeadlineExceeded(ctx) {
+		return fail(ValidateStageEndpoints, ErrorCodeDeadlineExceeded, "deadline exceeded")
+	}
+	if errors.Is(err, ourcloud.ErrUnavailable) {
+		return fail(ValidateStageEndpoints, ErrorCodeUnavailable, "OurCloud unavailable, retry later")
+	}
+	if err != nil {
+		h.abuse.Record(req.SenderUsername, true)
+		return fail(ValidateStageEndpoints, ErrorCodeNoEndpoints, "reading endpoints failed: "+err.Error())
+	}
+	resp.Endpoints = len(usableEndpoints(endpoints))
+	if resp.Endpoints == 0 {
+		h.abuse.Record(req.SenderUsername, true)
+		return fail(ValidateStageEndpoints, ErrorCodeNoEndpoints, "no endpoints registered")
+	}
+	pass(ValidateStageEndpoints, fmt.Sprintf("%d endpoints found", resp.Endpoints))
+
+	if h.content != nil {
+		id := h.content.missing(ctx, req.DataIds)
+		if clientDeadlineExceeded(ctx) {
+			return fail(ValidateStageContent, ErrorCodeDeadlineExceeded, "deadline exceeded")
+		}
+		if id != nil {
+			h.abuse.Record(req.SenderUsername, true)
+			return fail(ValidateStageContent, ErrorCodeContentNotFound, "data ID not found: "+hex.EncodeToString(id))
+		}
+		pass(ValidateStageContent, "")
+	}
+
+	h.abuse.Record(req.SenderUsername, false)
+	resp.Valid = true
+	return resp
+}
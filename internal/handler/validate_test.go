@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/abuse"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+)
+
+func TestHandleValidate(t *testing.T) {
+	endpoints := &pb.PushEndpointList{
+		Endpoints: []*pb.PushEndpoint{
+			{DeviceId: "phone", FcmToken: "token1"},
+			{DeviceId: "tablet", FcmToken: "token2"},
+		},
+	}
+	signed := &pb.PushRequest{
+		SenderUsername: "alice@oc",
+		TargetUsername: "bob@oc",
+		Signature:      []byte("signature"),
+		Timestamp:      1234567890,
+	}
+
+	tests := []struct {
+		name       string
+		client     *mockOurCloudClient
+		req        *pb.PushRequest
+		wantStatus int
+		wantCode   int32
+		wantStages []string // stages reported; the last failed unless the request is valid
+	}{
+		{
+			name:       "valid",
+			client:     &mockOurCloudClient{verifyResult: true, hasConsentResult: true, endpointsResult: endpoints},
+			req:        signed,
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorCodeSuccess,
+			wantStages: []string{"request", "sender", "signature", "consent", "endpoints"},
+		},
+		{
+			name:       "missing signature",
+			client:     &mockOurCloudClient{},
+			req:        &pb.PushRequest{SenderUsername: "alice@oc", TargetUsername: "bob@oc"},
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorCodeInvalidRequest,
+			wantStages: []string{"request"},
+		},
+		{
+			name:       "bad signature",
+			client:     &mockOurCloudClient{verifyResult: false, hasConsentResult: true, endpointsResult: endpoints},
+			req:        signed,
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorCodeSignatureFailed,
+			wantStages: []string{"request", "sender", "signature"},
+		},
+		{
+			name:       "no consent",
+			client:     &mockOurCloudClient{verifyResult: true, hasConsentResult: false, endpointsResult: endpoints},
+			req:        signed,
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorCodeNoConsent,
+			wantStages: []string{"request", "sender", "signature", "consent"},
+		},
+		{
+			name:       "no endpoints",
+			client:     &mockOurCloudClient{verifyResult: true, hasConsentResult: true, endpointsResult: &pb.PushEndpointList{}},
+			req:        signed,
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorCodeNoEndpoints,
+			wantStages: []string{"request", "sender", "signature", "consent", "endpoints"},
+		},
+		{
+			name:       "OurCloud unavailable",
+			client:     &mockOurCloudClient{verifyErr: ourcloud.ErrNotConnected},
+			req:        signed,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   ErrorCodeUnavailable,
+			wantStages: []string{"request", "sender", "signature"},
+		},
+		{
+			name:       "verify error",
+			client:     &mockOurCloudClient{verifyErr: errors.New("user not found")},
+			req:        signed,
+			wantStatus: http.StatusOK,
+			wantCode:   ErrorCodeSignatureFailed,
+			wantStages: []string{"request", "sender", "signature"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// nil queuer: validating must never queue
+			h := NewPushHandlerWithClient(tt.client, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(marshalPushRequest(t, tt.req)))
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			rr := httptest.NewRecorder()
+
+			h.HandleValidate(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			var resp ValidateResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.ErrorCode != tt.wantCode {
+				t.Errorf("error_code = %d, want %d", resp.ErrorCode, tt.wantCode)
+			}
+			if resp.Valid != (tt.wantCode == ErrorCodeSuccess) {
+				t.Errorf("valid = %v with error_code %d", resp.Valid, resp.ErrorCode)
+			}
+			if len(resp.Stages) != len(tt.wantStages) {
+				t.Fatalf("stages = %+v, want %v", resp.Stages, tt.wantStages)
+			}
+			for i, stage := range resp.Stages {
+				if stage.Stage != tt.wantStages[i] {
+					t.Errorf("stage %d = %q, want %q", i, stage.Stage, tt.wantStages[i])
+				}
+				wantOK := resp.Valid || i < len(resp.Stages)-1
+				if stage.OK != wantOK {
+					t.Errorf("stage %q ok = %v, want %v", stage.Stage, stage.OK, wantOK)
+				}
+			}
+			if tt.wantCode == ErrorCodeSuccess && resp.Endpoints != 2 {
+				t.Errorf("endpoints = %d, want 2", resp.Endpoints)
+			}
+		})
+	}
+}
+
+func TestHandleValidate_RecordsRejections(t *testing.T) {
+	mock := &mockOurCloudClient{verifyResult: false}
+	h := NewPushHandlerWithClient(mock, nil)
+	h.SetAbuseDetector(abuse.New(abuse.Config{MinPushes: 3, MaxRejectRatio: 0.5}))
+
+	validate := func() ValidateResponse {
+		body := marshalPushRequest(t, &pb.PushRequest{
+			SenderUsername: "prober@oc",
+			TargetUsername: "bob@oc",
+			Signature:      []byte("signature"),
+		})
+		req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		h.HandleValidate(rr, req)
+		var resp ValidateResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	// Forged validations fail verification and don't count against the sender
+	for i := 0; i < 5; i++ {
+		validate()
+	}
+	mock.verifyResult = true
+
+	// Probing for consent counts as rejected pushes do
+	for i := 0; i < 3; i++ {
+		if resp := validate(); resp.ErrorCode != ErrorCodeNoConsent {
+			t.Fatalf("validation %d: error_code = %d, want %d", i, resp.ErrorCode, ErrorCodeNoConsent)
+		}
+	}
+	if resp := validate(); resp.ErrorCode != ErrorCodeSuspended {
+		t.Errorf("error_code = %d after repeated rejections, want %d", resp.ErrorCode, ErrorCodeSuspended)
+	}
+}
@@ -0,0 +1,94 @@
+// Package labelhash pseudonymizes usernames in labels that outlive a
+// request, such as FCM analytics labels and the usernames in hashed log
+// lines. Metrics and logs labelled by raw usernames would reveal who pushes
+// to whom; a keyed hash keeps each user's label stable without naming them.
+package labelhash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Hasher names, as "hmac" or "plain", for selecting a Hasher in
+// configuration.
+const (
+	NameHMAC  = "hmac"
+	NamePlain = "plain"
+)
+
+// Hasher turns a username into the label recorded in its place.
+type Hasher interface {
+	// Label returns username's label. The same username always gets the
+	// same label from one Hasher.
+	Label(username string) string
+	// Labels returns every label username may have been recorded under,
+	// the current one first, such as labels made with keys since rotated
+	// out.
+	Labels(username string) []string
+}
+
+// New returns the Hasher called name. An HMAC hasher labels with key and
+// also recognizes labels made with the previous keys, newest first.
+func New(name, key string, previous []string) (Hasher, error) {
+	switch name {
+	case "", NameHMAC:
+		return NewHMAC(key, previous...), nil
+	case NamePlain:
+		return Plain{}, nil
+	}
+	return nil, fmt.Errorf("unknown hasher %q (want %s or %s)", name, NameHMAC, NamePlain)
+}
+
+// HMAC labels a username with the first 32 hex digits of an HMAC-SHA256
+// of it.
+type HMAC struct {
+	keys [][]byte // current key first
+}
+
+// NewHMAC returns an HMAC hasher labelling with key. Labels made with the
+// previous keys are still listed by Labels, so a user's history can be
+// followed across a key rotation.
+func NewHMAC(key string, previous ...string) *HMAC {
+	h := &HMAC{keys: [][]byte{[]byte(key)}}
+	for _, k := range previous {
+		h.keys = append(h.keys, []byte(k))
+	}
+	return h
+}
+
+// Label returns username's label under the current key.
+func (h *HMAC) Label(username string) string {
+	return sum(h.keys[0], username)
+}
+
+// Labels returns username's label under each key, the current one first.
+func (h *HMAC) Labels(username string) []string {
+	labels := make([]string, len(h.keys))
+	for i, key := range h.keys {
+		labels[i] = sum(key, username)
+	}
+	return labels
+}
+
+// sum returns the first 32 hex digits of an HMAC-SHA256 of username.
+func sum(key []byte, username string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// Plain labels each username as itself. It is meant for development,
+// where readable labels matter more than privacy.
+type Plain struct{}
+
+// Label returns username.
+func (Plain) Label(username string) string {
+	return username
+}
+
+// Labels returns username.
+func (Plain) Labels(username string) []string {
+	return []string{username}
+}
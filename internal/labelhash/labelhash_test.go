@@ -0,0 +1,49 @@
+package labelhash
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHMAC_Rotation(t *testing.T) {
+	old := NewHMAC("key-2024")
+	rotated := NewHMAC("key-2025", "key-2024")
+
+	label := rotated.Label("alice@oc")
+	if len(label) != 32 {
+		t.Errorf("Label() = %q, want 32 hex digits", label)
+	}
+	if label == old.Label("alice@oc") {
+		t.Error("label unchanged by key rotation")
+	}
+	if label == rotated.Label("bob@oc") {
+		t.Error("two users share a label")
+	}
+
+	want := []string{label, old.Label("alice@oc")}
+	if got := rotated.Labels("alice@oc"); !slices.Equal(got, want) {
+		t.Errorf("Labels() = %v, want %v", got, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	h, err := New(NamePlain, "ignored", nil)
+	if err != nil {
+		t.Fatalf("New(plain) error = %v", err)
+	}
+	if got := h.Label("alice@oc"); got != "alice@oc" {
+		t.Errorf("plain Label() = %q, want the username", got)
+	}
+
+	h, err = New("", "key", nil)
+	if err != nil {
+		t.Fatalf("New(\"\") error = %v", err)
+	}
+	if got, want := h.Label("alice@oc"), NewHMAC("key").Label("alice@oc"); got != want {
+		t.Errorf("default Label() = %q, want the HMAC label %q", got, want)
+	}
+
+	if _, err := New("md5", "key", nil); err == nil {
+		t.Error("New(md5) succeeded, want error")
+	}
+}
@@ -0,0 +1,102 @@
+package logfield
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/labelhash"
+)
+
+func TestFormat(t *testing.T) {
+	t.Cleanup(func() { Configure(Full, "") })
+
+	fields := []Field{
+		User("sender", "alice@oc"),
+		User("recipient", ""),
+		Count("data_ids", 3),
+		Duration("took", 1500*time.Microsecond),
+	}
+	tests := []struct {
+		level Level
+		want  string
+	}{
+		{Full, " sender=alice@oc data_ids=3 took=1.5ms"},
+		{Hashed, " sender=" + labelhash.NewHMAC("key").Label("alice@oc") + " data_ids=3 took=1.5ms"},
+		{Minimal, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			Configure(tt.level, "key")
+			if got := Format(fields...); got != tt.want {
+				t.Errorf("Format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat_Hashed(t *testing.T) {
+	t.Cleanup(func() { Configure(Full, "") })
+
+	Configure(Hashed, "key")
+	alice := Format(User("sender", "alice@oc"))
+	if alice != Format(User("sender", "alice@oc")) {
+		t.Error("hash of the same username differs between lines")
+	}
+	if alice == Format(User("sender", "bob@oc")) {
+		t.Error("different usernames hash alike")
+	}
+
+	Configure(Hashed, "other key")
+	if alice == Format(User("sender", "alice@oc")) {
+		t.Error("hash doesn't depend on the key")
+	}
+
+	ConfigureHasher(Hashed, labelhash.Plain{})
+	if got := Format(User("sender", "alice@oc")); got != " sender=alice@oc" {
+		t.Errorf("Format() with the plain hasher = %q, want the username", got)
+	}
+}
+
+func TestFormat_Quoting(t *testing.T) {
+	t.Cleanup(func() { Configure(Full, "") })
+
+	Configure(Full, "")
+	if got, want := Format(User("sender", "a b=c")), ` sender="a b=c"`; got != want {
+		t.Errorf("Format() = %q, want %q", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{Full, Hashed, Minimal} {
+		got, err := ParseLevel(level.String())
+		if err != nil || got != level {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", level.String(), got, err, level)
+		}
+	}
+	if _, err := ParseLevel("partial"); err == nil {
+		t.Error("ParseLevel(\"partial\") succeeded, want error")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	t.Cleanup(func() { Configure(Full, "") })
+
+	ctx := WithTrace(context.Background(), "host/abc-000001", "", "host/abc-000002", "host/abc-000001")
+	want := " trace=host/abc-000001,host/abc-000002"
+
+	// Trace IDs don't identify anyone, so they survive every level
+	for _, level := range []Level{Full, Hashed, Minimal} {
+		Configure(level, "key")
+		if got := Format(User("sender", "alice@oc"), Trace(ctx)); level == Minimal && got != want {
+			t.Errorf("%s: Format() = %q, want %q", level, got, want)
+		} else if !strings.HasSuffix(got, want) {
+			t.Errorf("%s: Format() = %q, want it to end with %q", level, got, want)
+		}
+	}
+
+	if got := Format(Trace(context.Background())); got != "" {
+		t.Errorf("Format() without a trace = %q, want empty", got)
+	}
+}
@@ -0,0 +1,39 @@
+package logfield
+
+import (
+	"context"
+	"strings"
+)
+
+type traceKey struct{}
+
+// WithTrace returns a copy of ctx carrying the trace IDs of the pushes it
+// works on: the ID of the HTTP request that queued a push, or of each push
+// in a batch being flushed.
+func WithTrace(ctx context.Context, ids ...string) context.Context {
+	var kept []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, traceKey{}, kept)
+}
+
+// TraceIDs returns the trace IDs carried by ctx, or nil.
+func TraceIDs(ctx context.Context) []string {
+	ids, _ := ctx.Value(traceKey{}).([]string)
+	return ids
+}
+
+// Trace is a "trace" field listing the trace IDs carried by ctx. Trace IDs
+// are opaque, so unlike usernames they are written at every level: grepping
+// for one finds every line about the push, from HandlePush to the flush.
+func Trace(ctx context.Context) Field {
+	return Field{key: "trace", value: strings.Join(TraceIDs(ctx), ","), id: true}
+}
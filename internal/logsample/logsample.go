@@ -0,0 +1,162 @@
+// Package logsample collapses repeated lines written to the standard logger,
+// so an error that recurs on every flush, such as a dead token, doesn't flood
+// the log.
+//
+// The first occurrence of a line in each interval is written as usual.
+// Identical lines after it are counted instead, and when the interval ends a
+// summary line says how many were suppressed.
+package logsample
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLines bounds the distinct lines tracked per interval. Lines beyond it
+// are written without sampling.
+const maxLines = 10000
+
+// Stats counts the sampler's work since it started.
+type Stats struct {
+	Suppressed int64 `json:"suppressed"` // lines not written because they repeated
+	Summaries  int64 `json:"summaries"`  // "repeated" summary lines written
+}
+
+// Sampler is an io.Writer for the standard logger that suppresses repeated
+// lines. Lines are compared without the logger's timestamp, so the logger
+// must write with no flags; Sampler adds them back.
+type Sampler struct {
+	out      *log.Logger
+	interval time.Duration
+
+	mu     sync.Mutex
+	counts map[string]int // lines seen this interval -> repeats suppressed
+	stats  Stats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a Sampler writing to w with the log flags flags, summarizing
+// every interval.
+func New(w io.Writer, flags int, interval time.Duration) *Sampler {
+	s := &Sampler{
+		out:      log.New(w, "", flags),
+		interval: interval,
+		counts:   make(map[string]int),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Write writes the log line in p unless it already appeared this interval.
+func (s *Sampler) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+
+	s.mu.Lock()
+	if n, seen := s.counts[line]; seen {
+		s.counts[line] = n + 1
+		s.stats.Suppressed++
+		s.mu.Unlock()
+		return len(p), nil
+	}
+	if len(s.counts) < maxLines {
+		s.counts[line] = 0
+	}
+	s.mu.Unlock()
+
+	if err := s.out.Output(2, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stats returns the sampler's counts.
+func (s *Sampler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close writes the summaries for the current interval and stops the
+// sampler.
+func (s *Sampler) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sampler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.summarize()
+		case <-s.stop:
+			s.summarize()
+			return
+		}
+	}
+}
+
+// summarize writes a summary for each line repeated this interval and starts
+// the next one.
+func (s *Sampler) summarize() {
+	s.mu.Lock()
+	var repeated []string
+	for line, n := range s.counts {
+		if n > 0 {
+			repeated = append(repeated, fmt.Sprintf("%s [repeated %d more times in the last %v]", line, n, s.interval))
+		}
+	}
+	s.counts = make(map[string]int)
+	s.stats.Summaries += int64(len(repeated))
+	s.mu.Unlock()
+
+	sort.Strings(repeated)
+	for _, summary := range repeated {
+		s.out.Print(summary)
+	}
+}
+
+// active is the sampler Install put in place, if any, for the metric.
+var active atomic.Pointer[Sampler]
+
+var publishOnce sync.Once
+
+// Install routes the standard logger through a new Sampler and publishes
+// its Stats as the "log_sampling" expvar variable. The returned function
+// closes the sampler and restores the logger's output and flags.
+func Install(interval time.Duration) func() {
+	w, flags := log.Writer(), log.Flags()
+	s := New(w, flags, interval)
+	log.SetFlags(0)
+	log.SetOutput(s)
+	active.Store(s)
+
+	publishOnce.Do(func() {
+		expvar.Publish("log_sampling", expvar.Func(func() any {
+			if s := active.Load(); s != nil {
+				return s.Stats()
+			}
+			return Stats{}
+		}))
+	})
+
+	return func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+		s.Close()
+	}
+}
@@ -0,0 +1,89 @@
+package logsample
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the sampler's goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSuffix(b.buf.String(), "\n"), "\n")
+}
+
+func TestSampler(t *testing.T) {
+	var buf syncBuffer
+	s := New(&buf, 0, time.Hour)
+	logger := log.New(s, "", 0)
+
+	for i := 0; i < 5; i++ {
+		logger.Printf("ERROR: sending to dead-token: unregistered")
+	}
+	logger.Printf("INFO: something else")
+	s.Close()
+
+	want := []string{
+		"ERROR: sending to dead-token: unregistered",
+		"INFO: something else",
+		"ERROR: sending to dead-token: unregistered [repeated 4 more times in the last 1h0m0s]",
+	}
+	if got := buf.lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if stats := s.Stats(); stats.Suppressed != 4 || stats.Summaries != 1 {
+		t.Errorf("Stats() = %+v, want 4 suppressed and 1 summary", stats)
+	}
+}
+
+func TestSampler_NewInterval(t *testing.T) {
+	var buf syncBuffer
+	s := New(&buf, 0, 20*time.Millisecond)
+	defer s.Close()
+	logger := log.New(s, "", 0)
+
+	logger.Print("WARNING: flaky")
+	time.Sleep(50 * time.Millisecond)
+	logger.Print("WARNING: flaky")
+
+	// A line seen once isn't summarized, and is written again in the next interval
+	if got := buf.lines(); len(got) != 2 || got[0] != got[1] {
+		t.Errorf("output = %q, want the line twice", got)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	restore := Install(time.Hour)
+
+	log.Print("ERROR: same")
+	log.Print("ERROR: same")
+	restore()
+
+	if n := strings.Count(buf.String(), "ERROR: same"); n != 2 {
+		t.Errorf("line written %d times, want once plus a summary:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "[repeated 1 more times") {
+		t.Errorf("no summary in output:\n%s", buf.String())
+	}
+	if log.Writer() != &buf {
+		t.Error("log output not restored")
+	}
+}
@@ -0,0 +1,293 @@
+// Package mirror streams the pushes a gateway accepts to a standby gateway
+// in another region, which delivers them if the primary goes down.
+//
+// The primary's Replicator sends each accepted notification, and later the
+// request IDs it delivered or dropped, to the standby's POST /mirror every
+// interval. The standby's Standby holds the notifications it hasn't heard
+// the outcome of. When the primary has been silent for the takeover
+// period, the standby queues them for delivery itself, keeping their
+// request IDs, and records them as taken over. A restarted primary asks
+// for the takeovers before recovering its batches, so it doesn't send them
+// a second time. A primary that kept running, but couldn't reach the
+// standby, asks again every interval and drops the taken-over
+// notifications still in its batches.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// Notification is an accepted notification, as mirrored to the standby.
+type Notification struct {
+	FCMToken     string                   `json:"fcm_token"`
+	Recipient    string                   `json:"recipient"`
+	Notification store.QueuedNotification `json:"notification"`
+}
+
+// Message is the body of POST /mirror. A message with no fields set is a
+// heartbeat, telling the standby the primary is up.
+type Message struct {
+	Notifications []Notification `json:"notifications,omitempty"`
+	// Resolved are the request IDs the primary delivered or dropped, which
+	// the standby no longer needs.
+	Resolved []string `json:"resolved,omitempty"`
+	// Reconciled are the takeovers the primary has suppressed, which the
+	// standby can forget.
+	Reconciled []string `json:"reconciled,omitempty"`
+}
+
+// Takeovers is the body of the standby's GET /mirror/takeovers response.
+type Takeovers struct {
+	RequestIDs []string `json:"request_ids"`
+}
+
+// Config configures a Replicator.
+type Config struct {
+	// URL is the standby gateway's base URL, e.g. "https://push-b.example.com".
+	URL string
+	// Token is sent as an "Authorization: Bearer" token, if set.
+	Token string
+	// Buffer caps the notifications, and separately the resolved request
+	// IDs, held for the next send. More are dropped and counted.
+	Buffer int
+	// Timeout bounds each request to the standby.
+	Timeout time.Duration
+	// Transport carries the requests; nil uses http.DefaultTransport.
+	Transport http.RoundTripper
+	// DropTakenOver, if set, is called by Run with the request IDs the
+	// standby took over, to remove them from the batches still pending
+	// here. They are then reported reconciled.
+	DropTakenOver func(ctx context.Context, requestIDs []string)
+}
+
+// ReplicatorStats counts mirroring since startup.
+type ReplicatorStats struct {
+	Mirrored uint64 `json:"mirrored"` // notifications the standby received
+	Resolved uint64 `json:"resolved"` // outcomes the standby received
+	// Dropped counts notifications and outcomes discarded because the
+	// buffer was full, such as while the standby was unreachable.
+	Dropped    uint64    `json:"dropped"`
+	Pending    int       `json:"pending"` // notifications waiting for the next send
+	Failures   uint64    `json:"failures"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastSentAt time.Time `json:"last_sent_at,omitzero"`
+}
+
+// Replicator mirrors a primary gateway's accepted notifications to its
+// standby. Mirror and Resolve never block; Send delivers what they
+// collected.
+type Replicator struct {
+	url    string
+	token  string
+	buffer int
+	client *http.Client
+	drop   func(ctx context.Context, requestIDs []string)
+
+	send sync.Mutex // one send at a time, so batches arrive in order
+
+	mu         sync.Mutex
+	pending    []Notification
+	resolved   []string
+	reconciled []string
+	stats      ReplicatorStats
+}
+
+// NewReplicator creates a Replicator for the standby at cfg.URL.
+func NewReplicator(cfg Config) *Replicator {
+	return &Replicator{
+		url:    strings.TrimRight(cfg.URL, "/"),
+		token:  cfg.Token,
+		buffer: cfg.Buffer,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: cfg.Transport},
+		drop:   cfg.DropTakenOver,
+	}
+}
+
+// Mirror holds n for the next send, or drops it if the buffer is full.
+func (r *Replicator) Mirror(n Notification) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buffer > 0 && len(r.pending) >= r.buffer {
+		r.stats.Dropped++
+		return
+	}
+	r.pending = append(r.pending, n)
+}
+
+// Resolve tells the standby, at the next send, that the notifications with
+// requestIDs were delivered or dropped. The oldest outcomes are dropped if
+// the buffer is full; the standby then forgets them after its retention.
+func (r *Replicator) Resolve(requestIDs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolved = append(r.resolved, requestIDs...)
+	if over := len(r.resolved) - r.buffer; r.buffer > 0 && over > 0 {
+		r.resolved = r.resolved[over:]
+		r.stats.Dropped += uint64(over)
+	}
+}
+
+// Takeovers asks the standby for the request IDs it delivered while this
+// gateway was down. Pass them to the batcher's SuppressTakenOver before
+// recovery, then to Reconciled.
+func (r *Replicator) Takeovers(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+"/mirror/takeovers", nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var takeovers Takeovers
+	if err := json.NewDecoder(resp.Body).Decode(&takeovers); err != nil {
+		return nil, fmt.Errorf("decoding takeovers from %s: %w", r.url, err)
+	}
+	return takeovers.RequestIDs, nil
+}
+
+// Reconciled tells the standby, at the next send, that the takeovers with
+// requestIDs were suppressed, so it can forget them.
+func (r *Replicator) Reconciled(requestIDs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconciled = append(r.reconciled, requestIDs...)
+}
+
+// Send sends the notifications and outcomes collected since the last send
+// to the standby, or a heartbeat if there are none. On failure they are
+// kept for the next send, as far as the buffer allows.
+func (r *Replicator) Send(ctx context.Context) error {
+	r.send.Lock()
+	defer r.send.Unlock()
+
+	r.mu.Lock()
+	msg := Message{Notifications: r.pending, Resolved: r.resolved, Reconciled: r.reconciled}
+	r.pending, r.resolved, r.reconciled = nil, nil, nil
+	r.mu.Unlock()
+
+	err := r.post(ctx, msg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.stats.Failures++
+		r.stats.LastError = err.Error()
+		// Ahead of what arrived meanwhile, which was accepted later
+		r.pending = append(msg.Notifications, r.pending...)
+		if over := len(r.pending) - r.buffer; r.buffer > 0 && over > 0 {
+			r.pending = r.pending[:r.buffer]
+			r.stats.Dropped += uint64(over)
+		}
+		r.resolved = append(msg.Resolved, r.resolved...)
+		if over := len(r.resolved) - r.buffer; r.buffer > 0 && over > 0 {
+			r.resolved = r.resolved[over:]
+			r.stats.Dropped += uint64(over)
+		}
+		r.reconciled = append(msg.Reconciled, r.reconciled...)
+		return err
+	}
+	r.stats.Mirrored += uint64(len(msg.Notifications))
+	r.stats.Resolved += uint64(len(msg.Resolved))
+	r.stats.LastSentAt = time.Now()
+	return nil
+}
+
+// post sends msg to the standby's POST /mirror.
+func (r *Replicator) post(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshaling message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+"/mirror", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends req with the token, failing unless the standby answers 200 OK.
+func (r *Replicator) do(req *http.Request) (*http.Response, error) {
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reaching standby %s: %w", r.url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("standby %s answered HTTP %d: %s", r.url, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// Run calls Send every interval until stop is closed, then once more so
+// the last outcomes reach the standby. With DropTakenOver set, it also asks
+// the standby for takeovers every interval, so pushes it delivered while it
+// couldn't hear from this gateway aren't sent again from here.
+func (r *Replicator) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval+r.client.Timeout)
+			if err := r.Send(ctx); err != nil {
+				log.Printf("WARNING: mirroring to the standby gateway failed: %v", err)
+			} else if r.drop != nil {
+				r.pollTakeovers(ctx)
+			}
+			cancel()
+		case <-stop:
+			if err := r.Send(context.Background()); err != nil {
+				log.Printf("WARNING: final mirroring to the standby gateway failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// pollTakeovers drops the notifications the standby took over from the
+// pending batches and reports them reconciled at the next send.
+func (r *Replicator) pollTakeovers(ctx context.Context) {
+	ids, err := r.Takeovers(ctx)
+	if err != nil {
+		log.Printf("WARNING: couldn't ask the standby gateway for takeovers: %v", err)
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+	r.drop(ctx, ids)
+	r.Reconciled(ids)
+}
+
+// Stats returns the mirroring counts since startup.
+func (r *Replicator) Stats() ReplicatorStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Pending = len(r.pending)
+	return stats
+}
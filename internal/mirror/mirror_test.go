@@ -0,0 +1,214 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// fakeStandby records the messages POSTed to /mirror and answers
+// GET /mirror/takeovers with takeovers.
+type fakeStandby struct {
+	mu        sync.Mutex
+	messages  []Message
+	auth      []string
+	fail      bool
+	takeovers []string
+}
+
+func (f *fakeStandby) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	if f.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/mirror":
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.messages = append(f.messages, msg)
+	case r.Method == http.MethodGet && r.URL.Path == "/mirror/takeovers":
+		json.NewEncoder(w).Encode(Takeovers{RequestIDs: f.takeovers})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeStandby) received() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message{}, f.messages...)
+}
+
+func notification(requestID string) Notification {
+	return Notification{
+		FCMToken:     "token-" + requestID,
+		Recipient:    "bob@oc",
+		Notification: store.QueuedNotification{RequestID: requestID, DataIDs: [][]byte{{1}}},
+	}
+}
+
+func TestReplicator_Send(t *testing.T) {
+	standby := &fakeStandby{}
+	srv := httptest.NewServer(standby)
+	defer srv.Close()
+
+	r := NewReplicator(Config{URL: srv.URL + "/", Token: "secret", Buffer: 10, Timeout: time.Second})
+	r.Mirror(notification("req-1"))
+	r.Mirror(notification("req-2"))
+	r.Resolve([]string{"req-0"})
+	r.Reconciled([]string{"req-old"})
+	if err := r.Send(context.Background()); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	// Nothing left: a heartbeat
+	if err := r.Send(context.Background()); err != nil {
+		t.Fatalf("Send() heartbeat error = %v", err)
+	}
+
+	got := standby.received()
+	if len(got) != 2 {
+		t.Fatalf("standby received %d messages, want 2", len(got))
+	}
+	if len(got[0].Notifications) != 2 || got[0].Notifications[0].Notification.RequestID != "req-1" || got[0].Notifications[1].FCMToken != "token-req-2" {
+		t.Errorf("first message notifications = %+v, want req-1 and req-2", got[0].Notifications)
+	}
+	if len(got[0].Resolved) != 1 || got[0].Resolved[0] != "req-0" || len(got[0].Reconciled) != 1 {
+		t.Errorf("first message = %+v, want req-0 resolved and req-old reconciled", got[0])
+	}
+	if len(got[1].Notifications) != 0 || len(got[1].Resolved) != 0 || len(got[1].Reconciled) != 0 {
+		t.Errorf("second message = %+v, want a heartbeat", got[1])
+	}
+	if standby.auth[0] != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the token", standby.auth[0])
+	}
+
+	stats := r.Stats()
+	if stats.Mirrored != 2 || stats.Resolved != 1 || stats.Pending != 0 || stats.LastSentAt.IsZero() {
+		t.Errorf("Stats() = %+v, want 2 mirrored and 1 resolved", stats)
+	}
+}
+
+func TestReplicator_SendFailureKeepsNotifications(t *testing.T) {
+	standby := &fakeStandby{fail: true}
+	srv := httptest.NewServer(standby)
+	defer srv.Close()
+
+	r := NewReplicator(Config{URL: srv.URL, Buffer: 2, Timeout: time.Second})
+	r.Mirror(notification("req-1"))
+	r.Mirror(notification("req-2"))
+	// Over the buffer
+	r.Mirror(notification("req-3"))
+	if err := r.Send(context.Background()); err == nil {
+		t.Fatal("Send() error = nil, want the standby's failure")
+	}
+	if stats := r.Stats(); stats.Pending != 2 || stats.Dropped != 1 || stats.Failures != 1 || stats.LastError == "" {
+		t.Errorf("Stats() after failure = %+v, want 2 pending, 1 dropped and 1 failure", stats)
+	}
+
+	standby.mu.Lock()
+	standby.fail = false
+	standby.mu.Unlock()
+	if err := r.Send(context.Background()); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	got := standby.received()
+	if len(got) != 1 || len(got[0].Notifications) != 2 || got[0].Notifications[0].Notification.RequestID != "req-1" {
+		t.Errorf("standby received %+v, want req-1 and req-2 in order", got)
+	}
+}
+
+func TestReplicator_ResolveKeepsNewest(t *testing.T) {
+	standby := &fakeStandby{}
+	srv := httptest.NewServer(standby)
+	defer srv.Close()
+
+	r := NewReplicator(Config{URL: srv.URL, Buffer: 2, Timeout: time.Second})
+	r.Resolve([]string{"req-1", "req-2", "req-3"})
+	if err := r.Send(context.Background()); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	got := standby.received()
+	if len(got) != 1 || len(got[0].Resolved) != 2 || got[0].Resolved[0] != "req-2" {
+		t.Errorf("standby received %+v, want req-2 and req-3 resolved", got)
+	}
+	if stats := r.Stats(); stats.Dropped != 1 {
+		t.Errorf("Stats().Dropped = %d, want 1", stats.Dropped)
+	}
+}
+
+func TestReplicator_Takeovers(t *testing.T) {
+	standby := &fakeStandby{takeovers: []string{"req-1", "req-2"}}
+	srv := httptest.NewServer(standby)
+	defer srv.Close()
+
+	r := NewReplicator(Config{URL: srv.URL, Timeout: time.Second})
+	ids, err := r.Takeovers(context.Background())
+	if err != nil {
+		t.Fatalf("Takeovers() error = %v", err)
+	}
+	if len(ids) != 2 || ids[0] != "req-1" || ids[1] != "req-2" {
+		t.Errorf("Takeovers() = %v, want [req-1 req-2]", ids)
+	}
+
+	standby.mu.Lock()
+	standby.fail = true
+	standby.mu.Unlock()
+	if _, err := r.Takeovers(context.Background()); err == nil {
+		t.Error("Takeovers() error = nil, want the standby's failure")
+	}
+}
+
+func TestReplicator_RunDropsTakeovers(t *testing.T) {
+	standby := &fakeStandby{takeovers: []string{"req-1"}}
+	srv := httptest.NewServer(standby)
+	defer srv.Close()
+
+	dropped := make(chan []string, 10)
+	r := NewReplicator(Config{
+		URL:     srv.URL,
+		Timeout: time.Second,
+		DropTakenOver: func(ctx context.Context, requestIDs []string) {
+			dropped <- requestIDs
+		},
+	})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.Run(10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	select {
+	case ids := <-dropped:
+		if len(ids) != 1 || ids[0] != "req-1" {
+			t.Errorf("DropTakenOver() got %v, want [req-1]", ids)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DropTakenOver wasn't called for the standby's takeovers")
+	}
+	close(stop)
+	<-done
+
+	// The takeovers are reported reconciled
+	reconciled := false
+	for _, msg := range standby.received() {
+		if len(msg.Reconciled) > 0 && msg.Reconciled[0] == "req-1" {
+			reconciled = true
+		}
+	}
+	if !reconciled {
+		t.Errorf("standby received %+v, want req-1 reconciled", standby.received())
+	}
+}
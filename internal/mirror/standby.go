@@ -0,0 +1,273 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// takeoverPageSize bounds the mirrored notifications TakeOver loads at a
+// time.
+const takeoverPageSize = 500
+
+// Store holds the notifications mirrored to a standby and its takeovers.
+// store.Store implements it.
+type Store interface {
+	SaveMirrored(ctx context.Context, notifications []store.MirroredNotification) error
+	DeleteMirrored(ctx context.Context, requestIDs []string) (int64, error)
+	LoadMirrored(ctx context.Context, limit int) ([]store.MirroredNotification, error)
+	MarkTakenOver(ctx context.Context, requestIDs []string, at time.Time) error
+	ListTakeovers(ctx context.Context) ([]string, error)
+	DeleteTakeovers(ctx context.Context, requestIDs []string) error
+	CleanupExpiredMirrored(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Importer queues taken-over notifications for delivery, keeping their
+// request IDs. *batcher.Batcher implements it.
+type Importer interface {
+	ImportBatch(ctx context.Context, fcmToken string, batch *store.Batch) error
+	ImportStatuses(ctx context.Context, records []store.StatusRecord) error
+}
+
+// StandbyConfig configures a Standby.
+type StandbyConfig struct {
+	// TakeoverAfter is how long the primary must be silent before Check
+	// takes over. Zero leaves takeovers to TakeOver.
+	TakeoverAfter time.Duration
+	// Retention is how long a mirrored notification is held without news
+	// of its outcome, and a takeover without the primary reconciling it.
+	Retention time.Duration
+	// StatusRetention is how long the status of a taken-over notification
+	// is kept, as the batcher's Config.StatusRetention.
+	StatusRetention time.Duration
+}
+
+// StandbyStats counts what a standby received and took over since startup.
+type StandbyStats struct {
+	Received  uint64 `json:"received"` // mirrored notifications stored
+	Resolved  uint64 `json:"resolved"` // stored notifications the primary resolved
+	TakenOver uint64 `json:"taken_over"`
+	Expired   uint64 `json:"expired"` // removed after Retention
+	// Active is true from a takeover until the primary is heard from again.
+	Active       bool      `json:"active"`
+	LastHeardAt  time.Time `json:"last_heard_at,omitzero"`
+	LastTakeover time.Time `json:"last_takeover,omitzero"`
+}
+
+// Standby holds the notifications a primary gateway mirrors to this one,
+// and delivers them if the primary goes silent.
+type Standby struct {
+	store    Store
+	importer Importer
+	cfg      StandbyConfig
+
+	takeover sync.Mutex // one takeover at a time
+
+	mu        sync.Mutex
+	started   time.Time
+	lastHeard time.Time // zero until the primary is first heard
+	stats     StandbyStats
+}
+
+// NewStandby creates a Standby keeping mirrored notifications in s and
+// queueing them with importer when it takes over.
+func NewStandby(s Store, importer Importer, cfg StandbyConfig) *Standby {
+	return &Standby{
+		store:    s,
+		importer: importer,
+		cfg:      cfg,
+		started:  time.Now(),
+	}
+}
+
+// Receive stores the notifications in msg and forgets the ones it
+// resolves, as of now. Hearing from the primary ends a takeover: the
+// notifications already taken over stay queued here, and later ones are
+// held again.
+func (s *Standby) Receive(ctx context.Context, msg Message, now time.Time) error {
+	s.mu.Lock()
+	s.lastHeard = now
+	s.stats.LastHeardAt = now
+	if s.stats.Active {
+		s.stats.Active = false
+		log.Printf("INFO: heard from the primary gateway again; standing down")
+	}
+	s.mu.Unlock()
+
+	if len(msg.Notifications) > 0 {
+		mirrored := make([]store.MirroredNotification, len(msg.Notifications))
+		for i, n := range msg.Notifications {
+			mirrored[i] = store.MirroredNotification{
+				FcmToken:     n.FCMToken,
+				Recipient:    n.Recipient,
+				Notification: n.Notification,
+				ReceivedAt:   now,
+			}
+		}
+		if err := s.store.SaveMirrored(ctx, mirrored); err != nil {
+			return fmt.Errorf("saving mirrored notifications: %w", err)
+		}
+	}
+	var resolved int64
+	if len(msg.Resolved) > 0 {
+		var err error
+		resolved, err = s.store.DeleteMirrored(ctx, msg.Resolved)
+		if err != nil {
+			return fmt.Errorf("deleting resolved notifications: %w", err)
+		}
+	}
+	if len(msg.Reconciled) > 0 {
+		if err := s.store.DeleteTakeovers(ctx, msg.Reconciled); err != nil {
+			return fmt.Errorf("deleting reconciled takeovers: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Received += uint64(len(msg.Notifications))
+	s.stats.Resolved += uint64(resolved)
+	return nil
+}
+
+// Takeovers returns the request IDs of the notifications this gateway took
+// over and the primary hasn't reconciled.
+func (s *Standby) Takeovers(ctx context.Context) ([]string, error) {
+	return s.store.ListTakeovers(ctx)
+}
+
+// Check takes over if the primary has been silent for TakeoverAfter as of
+// now, counting from startup if it hasn't been heard from since. Returns
+// how many notifications were taken over.
+func (s *Standby) Check(ctx context.Context, now time.Time) (int, error) {
+	if s.cfg.TakeoverAfter <= 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	since := s.lastHeard
+	if since.IsZero() {
+		since = s.started
+	}
+	silent := now.Sub(since)
+	s.mu.Unlock()
+	if silent < s.cfg.TakeoverAfter {
+		return 0, nil
+	}
+	return s.TakeOver(ctx, now)
+}
+
+// TakeOver queues every mirrored notification held for delivery by this
+// gateway, as of now, and records it as taken over. Notifications mirrored
+// during the takeover are taken over too, until the primary is heard from.
+// Returns how many notifications were taken over.
+func (s *Standby) TakeOver(ctx context.Context, now time.Time) (int, error) {
+	s.takeover.Lock()
+	defer s.takeover.Unlock()
+
+	taken := 0
+	for {
+		mirrored, err := s.store.LoadMirrored(ctx, takeoverPageSize)
+		if err != nil {
+			return taken, fmt.Errorf("loading mirrored notifications: %w", err)
+		}
+		if len(mirrored) == 0 {
+			break
+		}
+		if taken == 0 {
+			s.mu.Lock()
+			s.stats.Active = true
+			s.stats.LastTakeover = now
+			s.mu.Unlock()
+			log.Printf("WARNING: taking over the primary gateway's mirrored notifications")
+		}
+
+		n, err := s.takeOverPage(ctx, mirrored, now)
+		taken += n
+		s.mu.Lock()
+		s.stats.TakenOver += uint64(n)
+		s.mu.Unlock()
+		if err != nil {
+			return taken, err
+		}
+	}
+	if taken > 0 {
+		log.Printf("INFO: took over %d mirrored notifications", taken)
+	}
+	return taken, nil
+}
+
+// takeOverPage queues mirrored, grouped into one batch per FCM token due
+// now, and records them as taken over.
+func (s *Standby) takeOverPage(ctx context.Context, mirrored []store.MirroredNotification, now time.Time) (int, error) {
+	batches := make(map[string]*store.Batch)
+	var tokens []string
+	for _, m := range mirrored {
+		batch, ok := batches[m.FcmToken]
+		if !ok {
+			batch = &store.Batch{Recipient: m.Recipient, CreatedAt: m.ReceivedAt, FlushAt: now}
+			batches[m.FcmToken] = batch
+			tokens = append(tokens, m.FcmToken)
+		}
+		batch.Notifications = append(batch.Notifications, m.Notification)
+	}
+
+	taken := 0
+	for _, fcmToken := range tokens {
+		batch := batches[fcmToken]
+		records := make([]store.StatusRecord, len(batch.Notifications))
+		ids := make([]string, len(batch.Notifications))
+		for i, notif := range batch.Notifications {
+			ids[i] = notif.RequestID
+			records[i] = store.StatusRecord{
+				RequestID: notif.RequestID,
+				UpdatedAt: now,
+				Status: store.Status{
+					State:     store.StatusQueued,
+					ExpiresAt: now.Add(s.cfg.StatusRetention),
+					Sender:    notif.Sender,
+					Target:    notif.Target,
+					DeviceID:  notif.DeviceID,
+					QueuedAt:  notif.QueuedAt,
+				},
+			}
+		}
+		// Statuses first, so the flush's status isn't overwritten
+		if err := s.importer.ImportStatuses(ctx, records); err != nil {
+			return taken, fmt.Errorf("recording statuses for %s: %w", fcmToken, err)
+		}
+		if err := s.importer.ImportBatch(ctx, fcmToken, batch); err != nil {
+			return taken, fmt.Errorf("queueing batch for %s: %w", fcmToken, err)
+		}
+		// A crash before this leaves them mirrored; importing them again
+		// merges them by request ID
+		if err := s.store.MarkTakenOver(ctx, ids, now); err != nil {
+			return taken, fmt.Errorf("recording takeover for %s: %w", fcmToken, err)
+		}
+		taken += len(ids)
+	}
+	return taken, nil
+}
+
+// Cleanup removes the mirrored notifications and takeovers older than
+// Retention as of now. Returns how many mirrored notifications were
+// removed.
+func (s *Standby) Cleanup(ctx context.Context, now time.Time) (int64, error) {
+	if s.cfg.Retention <= 0 {
+		return 0, nil
+	}
+	n, err := s.store.CleanupExpiredMirrored(ctx, now.Add(-s.cfg.Retention))
+	s.mu.Lock()
+	s.stats.Expired += uint64(n)
+	s.mu.Unlock()
+	return n, err
+}
+
+// Stats returns what the standby received and took over since startup.
+func (s *Standby) Stats() StandbyStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
@@ -0,0 +1,169 @@
+package mirror
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// fakeImporter records the batches and statuses a takeover queues.
+type fakeImporter struct {
+	mu       sync.Mutex
+	batches  map[string]*store.Batch
+	statuses []store.StatusRecord
+}
+
+func (f *fakeImporter) ImportBatch(ctx context.Context, fcmToken string, batch *store.Batch) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.batches == nil {
+		f.batches = make(map[string]*store.Batch)
+	}
+	f.batches[fcmToken] = batch
+	return nil
+}
+
+func (f *fakeImporter) ImportStatuses(ctx context.Context, records []store.StatusRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses = append(f.statuses, records...)
+	return nil
+}
+
+func newTestStandby(t *testing.T, cfg StandbyConfig) (*Standby, *store.SQLiteStore, *fakeImporter) {
+	t.Helper()
+	st, err := store.New(store.Config{Path: filepath.Join(t.TempDir(), "standby.db")})
+	if err != nil {
+		t.Fatalf("store.New() error = %v", err)
+	}
+	t.Cleanup(func() { st.Close() })
+	importer := &fakeImporter{}
+	return NewStandby(st, importer, cfg), st, importer
+}
+
+func TestStandby_ReceiveAndResolve(t *testing.T) {
+	s, st, _ := newTestStandby(t, StandbyConfig{TakeoverAfter: time.Minute})
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := s.Receive(ctx, Message{Notifications: []Notification{notification("req-1"), notification("req-2")}}, now); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	// Mirrored again after a failed send: stored once
+	if err := s.Receive(ctx, Message{Notifications: []Notification{notification("req-2")}, Resolved: []string{"req-1"}}, now); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+
+	held, err := st.LoadMirrored(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadMirrored() error = %v", err)
+	}
+	if len(held) != 1 || held[0].Notification.RequestID != "req-2" || held[0].FcmToken != "token-req-2" || held[0].Recipient != "bob@oc" {
+		t.Errorf("LoadMirrored() = %+v, want only req-2", held)
+	}
+	if stats := s.Stats(); stats.Received != 3 || stats.Resolved != 1 || stats.LastHeardAt.IsZero() {
+		t.Errorf("Stats() = %+v, want 3 received and 1 resolved", stats)
+	}
+}
+
+func TestStandby_CheckTakesOverAfterSilence(t *testing.T) {
+	s, st, importer := newTestStandby(t, StandbyConfig{TakeoverAfter: time.Minute, StatusRetention: time.Hour})
+	ctx := context.Background()
+	heard := time.Now()
+
+	first := notification("req-1")
+	second := notification("req-2")
+	second.FCMToken = first.FCMToken
+	msg := Message{Notifications: []Notification{first, second, notification("req-3")}}
+	if err := s.Receive(ctx, msg, heard); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+
+	if n, err := s.Check(ctx, heard.Add(30*time.Second)); err != nil || n != 0 {
+		t.Fatalf("Check() before TakeoverAfter = %d, %v, want nothing taken over", n, err)
+	}
+	if len(importer.batches) != 0 {
+		t.Fatalf("imported %d batches before the takeover, want none", len(importer.batches))
+	}
+
+	now := heard.Add(2 * time.Minute)
+	n, err := s.Check(ctx, now)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Check() = %d, want 3 taken over", n)
+	}
+	batch := importer.batches["token-req-1"]
+	if batch == nil || len(batch.Notifications) != 2 || batch.Notifications[0].RequestID != "req-1" || !batch.FlushAt.Equal(now) || batch.Recipient != "bob@oc" {
+		t.Errorf("batch for token-req-1 = %+v, want req-1 and req-2 due now", batch)
+	}
+	if len(importer.batches) != 2 || len(importer.statuses) != 3 || importer.statuses[0].State != store.StatusQueued {
+		t.Errorf("imported %d batches and statuses %+v, want 2 batches and 3 queued statuses", len(importer.batches), importer.statuses)
+	}
+
+	held, err := st.LoadMirrored(ctx, 10)
+	if err != nil || len(held) != 0 {
+		t.Errorf("LoadMirrored() after takeover = %v, %v, want none", held, err)
+	}
+	ids, err := s.Takeovers(ctx)
+	if err != nil || len(ids) != 3 {
+		t.Errorf("Takeovers() = %v, %v, want 3", ids, err)
+	}
+	if stats := s.Stats(); !stats.Active || stats.TakenOver != 3 {
+		t.Errorf("Stats() = %+v, want active with 3 taken over", stats)
+	}
+
+	// The primary returns and reconciles
+	if err := s.Receive(ctx, Message{Reconciled: ids[:2]}, now.Add(time.Minute)); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if stats := s.Stats(); stats.Active {
+		t.Error("Stats().Active = true after hearing from the primary, want false")
+	}
+	if left, err := s.Takeovers(ctx); err != nil || len(left) != 1 || left[0] != ids[2] {
+		t.Errorf("Takeovers() after reconciling = %v, %v, want [%s]", left, err, ids[2])
+	}
+}
+
+func TestStandby_CheckWithoutTakeoverAfter(t *testing.T) {
+	s, _, importer := newTestStandby(t, StandbyConfig{})
+	ctx := context.Background()
+	if err := s.Receive(ctx, Message{Notifications: []Notification{notification("req-1")}}, time.Now()); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if n, err := s.Check(ctx, time.Now().Add(24*time.Hour)); err != nil || n != 0 {
+		t.Errorf("Check() = %d, %v, want nothing taken over", n, err)
+	}
+	if n, err := s.TakeOver(ctx, time.Now()); err != nil || n != 1 || len(importer.batches) != 1 {
+		t.Errorf("TakeOver() = %d, %v, want 1 taken over", n, err)
+	}
+}
+
+func TestStandby_Cleanup(t *testing.T) {
+	s, st, _ := newTestStandby(t, StandbyConfig{Retention: time.Hour})
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := s.Receive(ctx, Message{Notifications: []Notification{notification("req-old")}}, now.Add(-2*time.Hour)); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if err := s.Receive(ctx, Message{Notifications: []Notification{notification("req-new")}}, now); err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	n, err := s.Cleanup(ctx, now)
+	if err != nil || n != 1 {
+		t.Fatalf("Cleanup() = %d, %v, want 1 removed", n, err)
+	}
+	held, err := st.LoadMirrored(ctx, 10)
+	if err != nil || len(held) != 1 || held[0].Notification.RequestID != "req-new" {
+		t.Errorf("LoadMirrored() after cleanup = %+v, %v, want only req-new", held, err)
+	}
+	if stats := s.Stats(); stats.Expired != 1 {
+		t.Errorf("Stats().Expired = %d, want 1", stats.Expired)
+	}
+}
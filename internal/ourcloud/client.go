@@ -5,8 +5,12 @@ package ourcloud
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/wurp/friendly-backup-reboot/src/go/ourcloud-client/service"
 	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
@@ -23,23 +27,77 @@ func labelPathPushEndpoints(username string) string {
 	return fmt.Sprintf("/users/%s/platform/push/endpoints", username)
 }
 
+// labelPathPushGateways returns the label path for a user's gateway assignments.
+func labelPathPushGateways(username string) string {
+	return fmt.Sprintf("/users/%s/platform/push/gateways", username)
+}
+
+// labelPathLocale returns the label path for a user's locale preference.
+func labelPathLocale(username string) string {
+	return fmt.Sprintf("/users/%s/platform/preferences/locale", username)
+}
+
+// labelPathBatchWindow returns the label path for a user's batch window preference.
+func labelPathBatchWindow(username string) string {
+	return fmt.Sprintf("/users/%s/platform/preferences/batch_window", username)
+}
+
+// labelPathDoNotDisturb returns the label path for a user's Do-Not-Disturb flag.
+func labelPathDoNotDisturb(username string) string {
+	return fmt.Sprintf("/users/%s/platform/preferences/dnd", username)
+}
+
+// labelPathUrgentSenders returns the label path for the senders allowed to
+// bypass a user's Do-Not-Disturb.
+func labelPathUrgentSenders(username string) string {
+	return fmt.Sprintf("/users/%s/platform/preferences/dnd_urgent", username)
+}
+
 // Client wraps the ourcloud-client service.Client to provide
 // high-level access to push notification related data.
+// With several nodes configured, requests go to the node picked by Probe.
 type Client struct {
-	address string
-	client  *service.Client
+	address string          // address of the node currently in use
+	client  *service.Client // connection to the node currently in use
 	mu      sync.RWMutex
+
+	region      string // preferred node region
+	nodes       []*node
+	probeStop   chan struct{}
+	stopConnect func() // stops ConnectInBackground and waits for it
+	tunneler    Tunneler
+}
+
+// Tunneler reaches addresses through a proxy, for the client library that
+// can only be given an address to dial. *egress.Dialer implements it.
+type Tunneler interface {
+	// Tunnel returns a local address forwarding to address, and a function
+	// that closes the tunnel.
+	Tunnel(address string) (string, func() error, error)
 }
 
+// Bounds for the backoff between WaitReady attempts.
+const (
+	minConnectRetry = 500 * time.Millisecond
+	maxConnectRetry = 15 * time.Second
+)
+
 // NewClient creates a new OurCloud client wrapper.
 // The address should be in the form "host:port" (e.g., "localhost:50051").
 func NewClient(address string) *Client {
-	return &Client{
-		address: address,
-	}
+	return NewClientWithNodes([]Node{{Address: address}}, "")
+}
+
+// SetTunneler routes the connections to the nodes through t.
+// Call it before Connect.
+func (c *Client) SetTunneler(t Tunneler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tunneler = t
 }
 
-// Connect establishes a connection to the OurCloud node.
+// Connect establishes connections to the OurCloud nodes.
+// It fails only if no node can be connected.
 func (c *Client) Connect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -48,25 +106,132 @@ func (c *Client) Connect() error {
 		return nil
 	}
 
-	client, err := service.NewClient(c.address)
-	if err != nil {
-		return fmt.Errorf("connecting to OurCloud node: %w", err)
+	var lastErr error
+	for _, n := range c.nodes {
+		if n.client != nil {
+			continue
+		}
+		client, err := c.dialLocked(n)
+		if err != nil {
+			log.Printf("WARNING: connecting to OurCloud node %s: %v", n.Address, err)
+			lastErr = err
+			continue
+		}
+		n.client = client
 	}
 
-	c.client = client
+	c.selectLocked()
+	if c.client == nil {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no nodes configured")
+		}
+		return fmt.Errorf("connecting to OurCloud node: %w", lastErr)
+	}
 	return nil
 }
 
-// Close closes the connection to the OurCloud node.
+// dialLocked creates the client for n, through a tunnel if the client has a
+// Tunneler. c.mu must be held.
+func (c *Client) dialLocked(n *node) (*service.Client, error) {
+	if c.tunneler == nil {
+		return service.NewClient(n.Address)
+	}
+	local, closeTunnel, err := c.tunneler.Tunnel(n.Address)
+	if err != nil {
+		return nil, err
+	}
+	client, err := service.NewClient(local)
+	if err != nil {
+		closeTunnel()
+		return nil, err
+	}
+	n.closeTunnel = closeTunnel
+	return client, nil
+}
+
+// WaitReady connects and waits until a node answers HealthCheck, retrying
+// with exponential backoff. If ctx ends first, it returns the last error.
+func (c *Client) WaitReady(ctx context.Context) error {
+	delay := minConnectRetry
+	for {
+		err := c.Connect()
+		if err == nil {
+			checkCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			err = c.HealthCheck(checkCtx)
+			cancel()
+			if err == nil {
+				return nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Printf("WARNING: OurCloud not ready, retrying in %v: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxConnectRetry)
+	}
+}
+
+// ConnectInBackground runs WaitReady until it succeeds or Close is called,
+// then calls ready. Until then, requests fail and HealthCheck reports the
+// client as not ready.
+func (c *Client) ConnectInBackground(ready func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	c.mu.Lock()
+	c.stopConnect = func() {
+		cancel()
+		<-done
+	}
+	c.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		if err := c.WaitReady(ctx); err == nil {
+			ready()
+		}
+	}()
+}
+
+// Close closes the connections to the OurCloud nodes and stops probing.
 func (c *Client) Close() error {
+	// Stop connecting first; it needs c.mu to finish
+	c.mu.Lock()
+	stopConnect := c.stopConnect
+	c.stopConnect = nil
+	c.mu.Unlock()
+	if stopConnect != nil {
+		stopConnect()
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.client == nil {
-		return nil
+	if c.probeStop != nil {
+		close(c.probeStop)
+		c.probeStop = nil
 	}
 
-	err := c.client.Close()
+	var err error
+	for _, n := range c.nodes {
+		if n.client == nil {
+			continue
+		}
+		if closeErr := n.client.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		n.client = nil
+		if n.closeTunnel != nil {
+			n.closeTunnel()
+			n.closeTunnel = nil
+		}
+	}
 	c.client = nil
 	return err
 }
@@ -86,13 +251,13 @@ func (c *Client) HealthCheck(ctx context.Context) error {
 	c.mu.RUnlock()
 
 	if client == nil {
-		return fmt.Errorf("not connected to OurCloud node")
+		return ErrNotConnected
 	}
 
 	// Try to look up root@oc as a connectivity check
 	_, err := client.GetUserAuth(ctx, "root@oc")
 	if err != nil {
-		return fmt.Errorf("health check failed: %w", err)
+		return fmt.Errorf("health check failed: %w", translateUserAuth("root@oc", err))
 	}
 
 	return nil
@@ -106,96 +271,227 @@ func (c *Client) GetUserAuth(ctx context.Context, username string) (*pb.UserAuth
 	c.mu.RUnlock()
 
 	if client == nil {
-		return nil, fmt.Errorf("not connected to OurCloud node")
+		return nil, ErrNotConnected
+	}
+
+	auth, err := client.GetUserAuth(ctx, username)
+	if err != nil {
+		return nil, translateUserAuth(username, err)
 	}
+	return auth, nil
+}
 
-	return client.GetUserAuth(ctx, username)
+// GetCryptKey retrieves a user's public encryption key, an X25519 key, from
+// their UserAuth. The username should be in the form "alice@oc".
+func (c *Client) GetCryptKey(ctx context.Context, username string) ([]byte, error) {
+	auth, err := c.GetUserAuth(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("getting user auth for %s: %w", username, err)
+	}
+	if len(auth.PublicCryptKey) == 0 {
+		return nil, fmt.Errorf("%s has no public crypt key", username)
+	}
+	return auth.PublicCryptKey, nil
 }
 
 // GetConsentList retrieves the push notification consent list for a user.
 // The username should be in the form "alice@oc".
 func (c *Client) GetConsentList(ctx context.Context, username string) (*pb.PushConsentList, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathPushConsents(username), "consent list")
+	if err != nil {
+		return nil, err
+	}
+
+	var consentList pb.PushConsentList
+	if err := proto.Unmarshal(data, &consentList); err != nil {
+		return nil, fmt.Errorf("unmarshaling consent list: %w", err)
+	}
+
+	return &consentList, nil
+}
+
+// GetEndpoints retrieves the push notification endpoints for a user.
+// The username should be in the form "alice@oc".
+func (c *Client) GetEndpoints(ctx context.Context, username string) (*pb.PushEndpointList, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathPushEndpoints(username), "endpoints")
+	if err != nil {
+		return nil, err
+	}
+
+	var endpointList pb.PushEndpointList
+	if err := proto.Unmarshal(data, &endpointList); err != nil {
+		return nil, fmt.Errorf("unmarshaling endpoint list: %w", err)
+	}
+
+	return &endpointList, nil
+}
+
+// HasBlock reports whether the block with the given content address exists.
+// The DHT has no existence check, so the block is fetched and discarded.
+func (c *Client) HasBlock(ctx context.Context, id []byte) (bool, error) {
 	c.mu.RLock()
 	client := c.client
 	c.mu.RUnlock()
 
 	if client == nil {
-		return nil, fmt.Errorf("not connected to OurCloud node")
+		return false, ErrNotConnected
 	}
 
-	// First get the user's UserAuth to compute their owner ID
-	userAuth, err := client.GetUserAuth(ctx, username)
+	if _, err := client.Lookup(ctx, id); err != nil {
+		err = translate(err)
+		if errors.Is(err, ErrBlockNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("looking up block: %w", err)
+	}
+	return true, nil
+}
+
+// GetLocale retrieves a user's preferred locale (a BCP 47 tag such as "de-AT").
+// The preference label holds the tag as plain UTF-8 text.
+func (c *Client) GetLocale(ctx context.Context, username string) (string, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathLocale(username), "locale")
 	if err != nil {
-		return nil, fmt.Errorf("getting user auth for %q: %w", username, err)
+		return "", err
 	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	ownerID := computeContentAddress(userAuth)
+// GetBatchWindow retrieves how long a user prefers pushes to be batched
+// before delivery, trading latency for battery life.
+func (c *Client) GetBatchWindow(ctx context.Context, username string) (time.Duration, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathBatchWindow(username), "batch window")
+	if err != nil {
+		return 0, err
+	}
+	return parseBatchWindow(data)
+}
+
+// parseBatchWindow parses the batch window label, which holds a Go duration
+// such as "5s" or "10m" as plain UTF-8 text.
+func parseBatchWindow(data []byte) (time.Duration, error) {
+	window, err := time.ParseDuration(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("batch window label: %w", err)
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("batch window label: %s is not positive", window)
+	}
+	return window, nil
+}
 
-	// Read the consent list label
-	label, err := client.ReadLabel(ctx, ownerID, labelPathPushConsents(username))
+// GetDoNotDisturb retrieves whether a user has Do-Not-Disturb enabled.
+func (c *Client) GetDoNotDisturb(ctx context.Context, username string) (bool, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathDoNotDisturb(username), "dnd")
 	if err != nil {
-		return nil, fmt.Errorf("reading consent list label: %w", err)
+		return false, err
 	}
+	return parseDoNotDisturb(data)
+}
 
-	if label.DataId == nil {
-		return nil, fmt.Errorf("consent list label has no data ID")
+// parseDoNotDisturb parses the dnd label, which holds "on" or "off" as plain
+// UTF-8 text.
+func parseDoNotDisturb(data []byte) (bool, error) {
+	switch value := strings.ToLower(strings.TrimSpace(string(data))); value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	default:
+		return false, fmt.Errorf("dnd label: %q is neither on nor off", value)
 	}
+}
 
-	// Fetch the actual data
-	data, err := client.Lookup(ctx, label.DataId.Value)
+// GetUrgentSenders retrieves the senders whose pushes a user receives even
+// with Do-Not-Disturb enabled.
+func (c *Client) GetUrgentSenders(ctx context.Context, username string) ([]string, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathUrgentSenders(username), "dnd_urgent")
 	if err != nil {
-		return nil, fmt.Errorf("looking up consent list data: %w", err)
+		return nil, err
 	}
+	return parseUrgentSenders(data), nil
+}
 
-	var consentList pb.PushConsentList
-	if err := proto.Unmarshal(data, &consentList); err != nil {
-		return nil, fmt.Errorf("unmarshaling consent list: %w", err)
+// parseUrgentSenders parses the dnd_urgent label, which holds one sender
+// username per line as plain UTF-8 text. Blank lines and lines starting with
+// '#' are ignored.
+func parseUrgentSenders(data []byte) []string {
+	var senders []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		senders = append(senders, line)
 	}
+	return senders
+}
 
-	return &consentList, nil
+// GetGatewayAssignments retrieves which gateway delivers to each of a user's
+// devices, keyed by device ID. Devices not listed are delivered by whichever
+// gateway receives the push.
+func (c *Client) GetGatewayAssignments(ctx context.Context, username string) (map[string]string, error) {
+	data, err := c.readUserLabel(ctx, username, labelPathPushGateways(username), "gateways")
+	if err != nil {
+		return nil, err
+	}
+	return parseGatewayAssignments(data)
 }
 
-// GetEndpoints retrieves the push notification endpoints for a user.
-// The username should be in the form "alice@oc".
-func (c *Client) GetEndpoints(ctx context.Context, username string) (*pb.PushEndpointList, error) {
+// parseGatewayAssignments parses the gateways label, which holds one
+// "device_id gateway_url" pair per line as plain UTF-8 text. Blank lines and
+// lines starting with '#' are ignored.
+func parseGatewayAssignments(data []byte) (map[string]string, error) {
+	assignments := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("gateways label line %d: expected \"device_id gateway_url\"", i+1)
+		}
+		assignments[fields[0]] = strings.TrimRight(fields[1], "/")
+	}
+	return assignments, nil
+}
+
+// readUserLabel reads the data referenced by one of username's labels.
+// what names the label in error messages.
+func (c *Client) readUserLabel(ctx context.Context, username, path, what string) ([]byte, error) {
 	c.mu.RLock()
 	client := c.client
 	c.mu.RUnlock()
 
 	if client == nil {
-		return nil, fmt.Errorf("not connected to OurCloud node")
+		return nil, ErrNotConnected
 	}
 
 	// First get the user's UserAuth to compute their owner ID
 	userAuth, err := client.GetUserAuth(ctx, username)
 	if err != nil {
-		return nil, fmt.Errorf("getting user auth for %q: %w", username, err)
+		return nil, fmt.Errorf("getting user auth for %q: %w", username, translateUserAuth(username, err))
 	}
 
 	ownerID := computeContentAddress(userAuth)
 
-	// Read the endpoints label
-	label, err := client.ReadLabel(ctx, ownerID, labelPathPushEndpoints(username))
+	label, err := client.ReadLabel(ctx, ownerID, path)
 	if err != nil {
-		return nil, fmt.Errorf("reading endpoints label: %w", err)
+		return nil, fmt.Errorf("reading %s label: %w", what, translate(err))
 	}
 
 	if label.DataId == nil {
-		return nil, fmt.Errorf("endpoints label has no data ID")
+		return nil, fmt.Errorf("%s label has no data ID", what)
 	}
 
 	// Fetch the actual data
 	data, err := client.Lookup(ctx, label.DataId.Value)
 	if err != nil {
-		return nil, fmt.Errorf("looking up endpoints data: %w", err)
-	}
-
-	var endpointList pb.PushEndpointList
-	if err := proto.Unmarshal(data, &endpointList); err != nil {
-		return nil, fmt.Errorf("unmarshaling endpoint list: %w", err)
+		return nil, fmt.Errorf("looking up %s data: %w", what, translate(err))
 	}
 
-	return &endpointList, nil
+	return data, nil
 }
 
 // HasConsent checks if the sender has consent to send push notifications to the recipient.
@@ -1,10 +1,16 @@
 package ourcloud
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -13,16 +19,19 @@ func TestLabelPaths(t *testing.T) {
 		username      string
 		wantConsents  string
 		wantEndpoints string
+		wantGateways  string
 	}{
 		{
 			username:      "alice@oc",
 			wantConsents:  "/users/alice@oc/platform/push/consents",
 			wantEndpoints: "/users/alice@oc/platform/push/endpoints",
+			wantGateways:  "/users/alice@oc/platform/push/gateways",
 		},
 		{
 			username:      "bob@oc",
 			wantConsents:  "/users/bob@oc/platform/push/consents",
 			wantEndpoints: "/users/bob@oc/platform/push/endpoints",
+			wantGateways:  "/users/bob@oc/platform/push/gateways",
 		},
 	}
 
@@ -37,6 +46,11 @@ func TestLabelPaths(t *testing.T) {
 			if gotEndpoints != tt.wantEndpoints {
 				t.Errorf("labelPathPushEndpoints(%q) = %q, want %q", tt.username, gotEndpoints, tt.wantEndpoints)
 			}
+
+			gotGateways := labelPathPushGateways(tt.username)
+			if gotGateways != tt.wantGateways {
+				t.Errorf("labelPathPushGateways(%q) = %q, want %q", tt.username, gotGateways, tt.wantGateways)
+			}
 		})
 	}
 }
@@ -61,6 +75,101 @@ func TestIsConnected(t *testing.T) {
 	}
 }
 
+func TestWaitReady_Unreachable(t *testing.T) {
+	// Nothing listens on port 1
+	c := NewClient("127.0.0.1:1")
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.WaitReady(ctx); err == nil {
+		t.Fatal("WaitReady() succeeded with no node listening")
+	}
+}
+
+func TestConnectInBackground_Close(t *testing.T) {
+	c := NewClient("127.0.0.1:1")
+	ready := make(chan struct{})
+	c.ConnectInBackground(func() { close(ready) })
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() didn't stop background connecting")
+	}
+
+	select {
+	case <-ready:
+		t.Error("ready called with no node listening")
+	default:
+	}
+}
+
+// fakeTunneler records the tunnels it opens and closes.
+type fakeTunneler struct {
+	opened []string
+	closed int
+}
+
+func (f *fakeTunneler) Tunnel(address string) (string, func() error, error) {
+	f.opened = append(f.opened, address)
+	return "127.0.0.1:1", func() error { f.closed++; return nil }, nil
+}
+
+func TestConnect_Tunneler(t *testing.T) {
+	c := NewClientWithNodes([]Node{{Address: "node1:50051"}, {Address: "node2:50051"}}, "")
+	tunneler := &fakeTunneler{}
+	c.SetTunneler(tunneler)
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if !reflect.DeepEqual(tunneler.opened, []string{"node1:50051", "node2:50051"}) {
+		t.Errorf("tunnels opened to %v, want both nodes", tunneler.opened)
+	}
+
+	c.Close()
+	if tunneler.closed != 2 {
+		t.Errorf("%d tunnels closed, want 2", tunneler.closed)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"block", fmt.Errorf("block not found"), ErrBlockNotFound},
+		{"label", fmt.Errorf("label not found: /users/bob@oc/platform/push/endpoints"), ErrLabelNotFound},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), ErrUnavailable},
+		{"deadline", status.Error(codes.DeadlineExceeded, "deadline exceeded"), ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := translate(tt.err); !errors.Is(got, tt.want) {
+				t.Errorf("translate(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+
+	other := status.Error(codes.Internal, "boom")
+	if got := translate(other); got != other {
+		t.Errorf("translate(%v) = %v, want it unchanged", other, got)
+	}
+	if got := translateUserAuth("bob@oc", fmt.Errorf("label not found: bob@oc")); !errors.Is(got, ErrUserNotFound) {
+		t.Errorf("translateUserAuth() = %v, want ErrUserNotFound", got)
+	}
+	if !errors.Is(ErrNotConnected, ErrUnavailable) {
+		t.Error("ErrNotConnected doesn't match ErrUnavailable")
+	}
+}
+
 func TestComputeContentAddress(t *testing.T) {
 	// Create a test UserAuth
 	userAuth := &pb.UserAuth{
@@ -245,3 +354,85 @@ func TestCheckConsentInList_CaseSensitive(t *testing.T) {
 		t.Error("expected case-sensitive matching (ALICE@OC should not match alice@oc)")
 	}
 }
+
+func TestParseGatewayAssignments(t *testing.T) {
+	data := []byte("# phone is served by the EU operator\nphone https://push.eu.example.com/\n\n  tablet   https://push.us.example.com\n")
+
+	got, err := parseGatewayAssignments(data)
+	if err != nil {
+		t.Fatalf("parseGatewayAssignments() error = %v", err)
+	}
+	want := map[string]string{
+		"phone":  "https://push.eu.example.com",
+		"tablet": "https://push.us.example.com",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d assignments, want %d: %v", len(got), len(want), got)
+	}
+	for device, gateway := range want {
+		if got[device] != gateway {
+			t.Errorf("assignment for %s = %q, want %q", device, got[device], gateway)
+		}
+	}
+
+	if _, err := parseGatewayAssignments([]byte("phone\n")); err == nil {
+		t.Error("expected error for line without gateway URL")
+	}
+}
+
+func TestParseBatchWindow(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{data: "10m\n", want: 10 * time.Minute},
+		{data: " 5s ", want: 5 * time.Second},
+		{data: "soon", wantErr: true},
+		{data: "0s", wantErr: true},
+		{data: "-1m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBatchWindow([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBatchWindow(%q) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBatchWindow(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParseDoNotDisturb(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    bool
+		wantErr bool
+	}{
+		{data: "on\n", want: true},
+		{data: " OFF ", want: false},
+		{data: "", wantErr: true},
+		{data: "maybe", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDoNotDisturb([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDoNotDisturb(%q) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDoNotDisturb(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParseUrgentSenders(t *testing.T) {
+	got := parseUrgentSenders([]byte("# family\nmom@oc\n\n  pager@oc  \n"))
+	want := []string{"mom@oc", "pager@oc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseUrgentSenders() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,57 @@
+package ourcloud
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned by Client, wrapped with details; match them with errors.Is.
+var (
+	// ErrUnavailable means no OurCloud node could answer. The same request
+	// may succeed later.
+	ErrUnavailable = errors.New("OurCloud unavailable")
+	// ErrNotConnected means the client has no node to send requests to.
+	// It wraps ErrUnavailable.
+	ErrNotConnected = fmt.Errorf("%w: not connected to OurCloud node", ErrUnavailable)
+	// ErrUserNotFound means the username has no UserAuth in the DHT.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrLabelNotFound means the user hasn't published the label read.
+	ErrLabelNotFound = errors.New("label not found")
+	// ErrBlockNotFound means no block has the content address looked up.
+	ErrBlockNotFound = errors.New("block not found")
+)
+
+// translate maps an error from service.Client to the errors above. The
+// library returns plain text errors for missing labels and blocks, so this
+// is the one place that matches on their messages.
+func translate(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	msg := err.Error()
+	switch {
+	case msg == "block not found":
+		return ErrBlockNotFound
+	case strings.HasPrefix(msg, "label not found: "):
+		return fmt.Errorf("%w: %s", ErrLabelNotFound, strings.TrimPrefix(msg, "label not found: "))
+	}
+	return err
+}
+
+// translateUserAuth is translate for looking up username's UserAuth, which
+// the library reads through a label and a block of the root user.
+func translateUserAuth(username string, err error) error {
+	err = translate(err)
+	if errors.Is(err, ErrLabelNotFound) || errors.Is(err, ErrBlockNotFound) {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return err
+}
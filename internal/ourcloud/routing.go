@@ -0,0 +1,137 @@
+package ourcloud
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/wurp/friendly-backup-reboot/src/go/ourcloud-client/service"
+)
+
+// probeTimeout bounds a single latency probe.
+const probeTimeout = 5 * time.Second
+
+// Node is an OurCloud node the client can route requests to.
+type Node struct {
+	Address string // "host:port"
+	Region  string // free-form label, e.g. "eu-west"; empty if unknown
+}
+
+// node tracks the connection and probe results for a Node.
+type node struct {
+	Node
+	client      *service.Client
+	closeTunnel func() error // set while the client dials through a tunnel
+	latency     time.Duration
+	healthy     bool
+}
+
+// NewClientWithNodes creates a client that routes to the lowest-latency healthy
+// node, preferring nodes in region. Node health and latency are measured by
+// Probe; until the first probe, the first node in region (or the first node) is used.
+func NewClientWithNodes(nodes []Node, region string) *Client {
+	c := &Client{region: region}
+	for _, n := range nodes {
+		c.nodes = append(c.nodes, &node{Node: n, healthy: true})
+	}
+	if len(nodes) > 0 {
+		c.address = nodes[0].Address
+	}
+	return c
+}
+
+// Probe measures latency to every node and switches to the best healthy one.
+// Nodes are probed with the same root@oc lookup used by HealthCheck.
+func (c *Client) Probe(ctx context.Context) {
+	c.mu.RLock()
+	nodes := c.nodes
+	c.mu.RUnlock()
+
+	type result struct {
+		latency time.Duration
+		healthy bool
+	}
+	results := make([]result, len(nodes))
+	for i, n := range nodes {
+		if n.client == nil {
+			continue
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		start := time.Now()
+		_, err := n.client.GetUserAuth(probeCtx, "root@oc")
+		cancel()
+		results[i] = result{latency: time.Since(start), healthy: err == nil}
+		if err != nil {
+			log.Printf("WARNING: OurCloud node %s (%s) probe failed: %v", n.Address, n.Region, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, n := range nodes {
+		n.latency = results[i].latency
+		n.healthy = results[i].healthy
+	}
+	c.selectLocked()
+}
+
+// StartProbing probes nodes every interval until Close is called.
+// It is a no-op for single-node clients.
+func (c *Client) StartProbing(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.nodes) < 2 || c.probeStop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.probeStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Probe(context.Background())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// selectLocked points c.client at the best node. If no node is healthy the
+// current node is kept so requests still have somewhere to go.
+// Caller must hold c.mu.
+func (c *Client) selectLocked() {
+	best := selectNode(c.nodes, c.region)
+	if best == nil || best.client == c.client {
+		return
+	}
+	log.Printf("INFO: routing OurCloud requests to %s (region %q, latency %s)", best.Address, best.Region, best.latency)
+	c.client = best.client
+	c.address = best.Address
+}
+
+// selectNode returns the lowest-latency healthy, connected node, preferring
+// those in region. Returns nil if no node is usable.
+func selectNode(nodes []*node, region string) *node {
+	var best, bestInRegion *node
+	for _, n := range nodes {
+		if n.client == nil || !n.healthy {
+			continue
+		}
+		if best == nil || n.latency < best.latency {
+			best = n
+		}
+		if region != "" && n.Region == region && (bestInRegion == nil || n.latency < bestInRegion.latency) {
+			bestInRegion = n
+		}
+	}
+	if bestInRegion != nil {
+		return bestInRegion
+	}
+	return best
+}
@@ -0,0 +1,76 @@
+package ourcloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wurp/friendly-backup-reboot/src/go/ourcloud-client/service"
+)
+
+func TestSelectNode(t *testing.T) {
+	connected := &service.Client{}
+	mk := func(addr, region string, latency time.Duration, healthy bool) *node {
+		return &node{Node: Node{Address: addr, Region: region}, client: connected, latency: latency, healthy: healthy}
+	}
+
+	tests := []struct {
+		name   string
+		nodes  []*node
+		region string
+		want   string
+	}{
+		{
+			name:  "lowest latency without region preference",
+			nodes: []*node{mk("a", "us", 30*time.Millisecond, true), mk("b", "eu", 10*time.Millisecond, true)},
+			want:  "b",
+		},
+		{
+			name:   "prefers own region over faster remote node",
+			nodes:  []*node{mk("a", "us", 30*time.Millisecond, true), mk("b", "eu", 10*time.Millisecond, true)},
+			region: "us",
+			want:   "a",
+		},
+		{
+			name:   "falls back across regions when local nodes are unhealthy",
+			nodes:  []*node{mk("a", "us", 5*time.Millisecond, false), mk("b", "eu", 40*time.Millisecond, true), mk("c", "ap", 20*time.Millisecond, true)},
+			region: "us",
+			want:   "c",
+		},
+		{
+			name:  "skips unconnected nodes",
+			nodes: []*node{{Node: Node{Address: "a"}, healthy: true}, mk("b", "", 50*time.Millisecond, true)},
+			want:  "b",
+		},
+		{
+			name:  "none healthy",
+			nodes: []*node{mk("a", "us", 0, false)},
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectNode(tt.nodes, tt.region)
+			gotAddr := ""
+			if got != nil {
+				gotAddr = got.Address
+			}
+			if gotAddr != tt.want {
+				t.Errorf("selectNode() = %q, want %q", gotAddr, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientWithNodes(t *testing.T) {
+	c := NewClientWithNodes([]Node{{Address: "eu:50051", Region: "eu"}, {Address: "us:50051", Region: "us"}}, "us")
+	if c.address != "eu:50051" {
+		t.Errorf("client address = %q, want first node", c.address)
+	}
+	if len(c.nodes) != 2 || c.region != "us" {
+		t.Errorf("got %d nodes in region %q, want 2 in %q", len(c.nodes), c.region, "us")
+	}
+	if c.IsConnected() {
+		t.Error("IsConnected() should return false before Connect()")
+	}
+}
@@ -2,6 +2,7 @@ package ourcloud
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 
 	"github.com/wurp/friendly-backup-reboot/src/go/ourcloud-client/crypto"
@@ -47,3 +48,18 @@ func (c *Client) VerifyPushRequest(ctx context.Context, req *pb.PushRequest) (bo
 func VerifyPushRequestWithKey(req *pb.PushRequest, publicKey []byte) (bool, error) {
 	return crypto.VerifyPushRequestSignature(req, publicKey)
 }
+
+// VerifySignature verifies that signature is username's ed25519 signature of
+// message, using the public signing key from their UserAuth.
+func (c *Client) VerifySignature(ctx context.Context, username string, message, signature []byte) (bool, error) {
+	userAuth, err := c.GetUserAuth(ctx, username)
+	if err != nil {
+		return false, fmt.Errorf("getting user auth: %w", err)
+	}
+
+	if len(userAuth.PublicSignKey) != ed25519.PublicKeySize {
+		return false, fmt.Errorf("user has no valid public signing key")
+	}
+
+	return ed25519.Verify(userAuth.PublicSignKey, message, signature), nil
+}
@@ -0,0 +1,294 @@
+// Package quota accounts for FCM messages sent per Firebase project, so
+// operators see how close each project runs to its Firebase quota.
+//
+// Sends are counted per UTC hour and day in memory and written to the store
+// periodically. Each project can have an hourly and a daily budget: crossing
+// a fraction of one logs a warning once per period, and with hard limits
+// enabled, sends past it are refused until the period ends.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// Store persists hourly send counts.
+// *store.SQLiteStore and *store.ShardedStore implement this interface.
+type Store interface {
+	AddFCMUsage(ctx context.Context, projectID string, hour time.Time, sends int64) error
+	ListFCMUsage(ctx context.Context, since time.Time) ([]store.FCMUsage, error)
+}
+
+// Budget caps a project's sends. Zero leaves a period unbudgeted.
+type Budget struct {
+	Hourly int64
+	Daily  int64
+}
+
+// Config sets the budgets. Zero values take the defaults below.
+type Config struct {
+	// Default is the budget of projects not listed in Projects.
+	Default Budget
+	// Projects overrides the budget per Firebase project ID.
+	Projects map[string]Budget
+	// AlertAt is the fraction of a budget at which a warning is logged.
+	// Defaults to 0.8.
+	AlertAt float64
+	// HardLimit refuses sends once a budget is used up, with
+	// *fcm.RateLimitedError until the hour or day ends.
+	HardLimit bool
+}
+
+func (c *Config) setDefaults() {
+	if c.AlertAt == 0 {
+		c.AlertAt = 0.8
+	}
+}
+
+// period counts sends within one hour or day.
+type period struct {
+	start   time.Time
+	sends   int64
+	alerted bool
+}
+
+// roll starts a new period if now is past the current one.
+func (p *period) roll(start time.Time) {
+	if !p.start.Equal(start) {
+		*p = period{start: start}
+	}
+}
+
+// usage is a project's send counts for the current hour and day.
+type usage struct {
+	hour period
+	day  period
+}
+
+// pendingKey identifies sends not yet written to the store.
+type pendingKey struct {
+	projectID string
+	hour      time.Time
+}
+
+// Accountant counts sends per project against their budgets.
+// It implements fcm.UsageMeter.
+type Accountant struct {
+	cfg   Config
+	store Store
+	now   func() time.Time
+
+	mu       sync.Mutex
+	projects map[string]*usage
+	pending  map[pendingKey]int64
+	alerts   uint64
+	refused  uint64
+}
+
+// New creates an Accountant, resuming today's counts from st.
+func New(ctx context.Context, st Store, cfg Config) (*Accountant, error) {
+	return newAccountant(ctx, st, cfg, time.Now)
+}
+
+// newAccountant is New with a clock, for tests.
+func newAccountant(ctx context.Context, st Store, cfg Config, now func() time.Time) (*Accountant, error) {
+	cfg.setDefaults()
+	a := &Accountant{
+		cfg:      cfg,
+		store:    st,
+		now:      now,
+		projects: make(map[string]*usage),
+		pending:  make(map[pendingKey]int64),
+	}
+	if err := a.load(ctx); err != nil {
+		return nil, fmt.Errorf("loading FCM usage: %w", err)
+	}
+	return a, nil
+}
+
+// load reads today's hourly counts from the store.
+func (a *Accountant) load(ctx context.Context) error {
+	now := a.now().UTC()
+	dayStart := now.Truncate(24 * time.Hour)
+	hourStart := now.Truncate(time.Hour)
+
+	rows, err := a.store.ListFCMUsage(ctx, dayStart)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, row := range rows {
+		u := a.usageLocked(row.ProjectID, now)
+		u.day.sends += row.Sends
+		if row.Hour.Equal(hourStart) {
+			u.hour.sends += row.Sends
+		}
+	}
+	return nil
+}
+
+// usageLocked returns projectID's counts, rolled over to the periods
+// containing now. a.mu must be held.
+func (a *Accountant) usageLocked(projectID string, now time.Time) *usage {
+	u, ok := a.projects[projectID]
+	if !ok {
+		u = &usage{}
+		a.projects[projectID] = u
+	}
+	u.hour.roll(now.Truncate(time.Hour))
+	u.day.roll(now.Truncate(24 * time.Hour))
+	return u
+}
+
+// budget returns projectID's budget.
+func (a *Accountant) budget(projectID string) Budget {
+	if b, ok := a.cfg.Projects[projectID]; ok {
+		return b
+	}
+	return a.cfg.Default
+}
+
+// Allow refuses a send with *fcm.RateLimitedError, delayed until the
+// exhausted period ends, when hard limits are enabled and projectID has
+// used up its hourly or daily budget.
+func (a *Accountant) Allow(projectID string) error {
+	if !a.cfg.HardLimit {
+		return nil
+	}
+	budget := a.budget(projectID)
+	now := a.now().UTC()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.usageLocked(projectID, now)
+	var until time.Time
+	switch {
+	case budget.Daily > 0 && u.day.sends >= budget.Daily:
+		until = u.day.start.Add(24 * time.Hour)
+	case budget.Hourly > 0 && u.hour.sends >= budget.Hourly:
+		until = u.hour.start.Add(time.Hour)
+	default:
+		return nil
+	}
+	a.refused++
+	return &fcm.RateLimitedError{Delay: until.Sub(now)}
+}
+
+// Record counts a message sent through projectID, warning the first time
+// in each period that its sends reach the alert fraction of a budget.
+func (a *Accountant) Record(projectID string) {
+	budget := a.budget(projectID)
+	now := a.now().UTC()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u := a.usageLocked(projectID, now)
+	u.hour.sends++
+	u.day.sends++
+	a.pending[pendingKey{projectID: projectID, hour: u.hour.start}]++
+
+	a.alertLocked(projectID, "hourly", &u.hour, budget.Hourly)
+	a.alertLocked(projectID, "daily", &u.day, budget.Daily)
+}
+
+// alertLocked logs a warning if p's sends just reached the alert fraction of
+// limit. a.mu must be held.
+func (a *Accountant) alertLocked(projectID, name string, p *period, limit int64) {
+	if limit <= 0 || p.alerted || float64(p.sends) < a.cfg.AlertAt*float64(limit) {
+		return
+	}
+	p.alerted = true
+	a.alerts++
+	log.Printf("WARNING: Firebase project %s has sent %d of its %s budget of %d messages", projectID, p.sends, name, limit)
+}
+
+// Flush writes the sends counted since the last flush to the store. Counts
+// that fail to be written are kept for the next flush.
+func (a *Accountant) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[pendingKey]int64)
+	a.mu.Unlock()
+
+	var firstErr error
+	for key, sends := range pending {
+		if err := a.store.AddFCMUsage(ctx, key.projectID, key.hour, sends); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			a.mu.Lock()
+			a.pending[key] += sends
+			a.mu.Unlock()
+		}
+	}
+	return firstErr
+}
+
+// History flushes pending counts and returns every project's hourly counts
+// from since on, oldest first.
+func (a *Accountant) History(ctx context.Context, since time.Time) ([]store.FCMUsage, error) {
+	if err := a.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return a.store.ListFCMUsage(ctx, since)
+}
+
+// PeriodUsage is a project's sends within the current hour or day.
+type PeriodUsage struct {
+	Sends   int64     `json:"sends"`
+	Budget  int64     `json:"budget,omitempty"` // 0 when unbudgeted
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// ProjectUsage summarizes a project's sends in the current hour and day.
+type ProjectUsage struct {
+	ProjectID string      `json:"project_id"`
+	Hour      PeriodUsage `json:"hour"`
+	Day       PeriodUsage `json:"day"`
+	// Exhausted is true when a budget is used up; with hard limits, sends
+	// are being refused.
+	Exhausted bool `json:"exhausted"`
+}
+
+// Stats summarizes usage since startup.
+type Stats struct {
+	Projects []ProjectUsage `json:"projects"`
+	Alerts   uint64         `json:"alerts"`  // budget warnings logged
+	Refused  uint64         `json:"refused"` // sends refused by hard limits
+}
+
+// Stats returns each project's current usage, by project ID.
+func (a *Accountant) Stats() Stats {
+	now := a.now().UTC()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := Stats{
+		Projects: make([]ProjectUsage, 0, len(a.projects)),
+		Alerts:   a.alerts,
+		Refused:  a.refused,
+	}
+	for projectID := range a.projects {
+		u := a.usageLocked(projectID, now)
+		budget := a.budget(projectID)
+		stats.Projects = append(stats.Projects, ProjectUsage{
+			ProjectID: projectID,
+			Hour:      PeriodUsage{Sends: u.hour.sends, Budget: budget.Hourly, ResetAt: u.hour.start.Add(time.Hour)},
+			Day:       PeriodUsage{Sends: u.day.sends, Budget: budget.Daily, ResetAt: u.day.start.Add(24 * time.Hour)},
+			Exhausted: (budget.Hourly > 0 && u.hour.sends >= budget.Hourly) ||
+				(budget.Daily > 0 && u.day.sends >= budget.Daily),
+		})
+	}
+	sort.Slice(stats.Projects, func(i, j int) bool {
+		return stats.Projects[i].ProjectID < stats.Projects[j].ProjectID
+	})
+	return stats
+}
@@ -0,0 +1,137 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/fcm"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+)
+
+// memStore keeps hourly counts in memory.
+type memStore struct {
+	counts map[pendingKey]int64
+	err    error
+}
+
+func (m *memStore) AddFCMUsage(ctx context.Context, projectID string, hour time.Time, sends int64) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.counts[pendingKey{projectID: projectID, hour: hour}] += sends
+	return nil
+}
+
+func (m *memStore) ListFCMUsage(ctx context.Context, since time.Time) ([]store.FCMUsage, error) {
+	var usage []store.FCMUsage
+	for key, sends := range m.counts {
+		if !key.hour.Before(since.Truncate(time.Hour)) {
+			usage = append(usage, store.FCMUsage{ProjectID: key.projectID, Hour: key.hour, Sends: sends})
+		}
+	}
+	return usage, nil
+}
+
+func newTestAccountant(t *testing.T, st *memStore, now time.Time, cfg Config) *Accountant {
+	t.Helper()
+	a, err := newAccountant(context.Background(), st, cfg, func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return a
+}
+
+func TestAccountant_HardLimit(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 45, 0, 0, time.UTC)
+	st := &memStore{counts: make(map[pendingKey]int64)}
+	a := newTestAccountant(t, st, now, Config{
+		Default:   Budget{Hourly: 3},
+		Projects:  map[string]Budget{"big": {Hourly: 100}},
+		HardLimit: true,
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := a.Allow("small"); err != nil {
+			t.Fatalf("Allow() #%d error = %v", i+1, err)
+		}
+		a.Record("small")
+	}
+	err := a.Allow("small")
+	var rateLimited *fcm.RateLimitedError
+	if !errors.As(err, &rateLimited) {
+		t.Fatalf("Allow() past budget error = %v, want *fcm.RateLimitedError", err)
+	}
+	if rateLimited.Delay != 15*time.Minute {
+		t.Errorf("Delay = %s, want the rest of the hour, 15m", rateLimited.Delay)
+	}
+	if err := a.Allow("big"); err != nil {
+		t.Errorf("Allow() for project with own budget error = %v", err)
+	}
+
+	// The budget resets with the hour
+	a.now = func() time.Time { return now.Add(15 * time.Minute) }
+	if err := a.Allow("small"); err != nil {
+		t.Errorf("Allow() next hour error = %v", err)
+	}
+
+	stats := a.Stats()
+	if stats.Refused != 1 || stats.Alerts != 1 {
+		t.Errorf("Stats() refused = %d, alerts = %d, want 1, 1", stats.Refused, stats.Alerts)
+	}
+}
+
+func TestAccountant_SoftBudget(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	st := &memStore{counts: make(map[pendingKey]int64)}
+	a := newTestAccountant(t, st, now, Config{Default: Budget{Daily: 2}})
+
+	for i := 0; i < 4; i++ {
+		if err := a.Allow("p"); err != nil {
+			t.Fatalf("Allow() error = %v without hard limit", err)
+		}
+		a.Record("p")
+	}
+	stats := a.Stats()
+	if stats.Alerts != 1 {
+		t.Errorf("Alerts = %d, want one per period", stats.Alerts)
+	}
+	if len(stats.Projects) != 1 || !stats.Projects[0].Exhausted || stats.Projects[0].Day.Sends != 4 {
+		t.Errorf("Projects = %+v, want p exhausted with 4 sends", stats.Projects)
+	}
+}
+
+func TestAccountant_FlushAndResume(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	st := &memStore{counts: make(map[pendingKey]int64)}
+	// Yesterday's sends don't count against today
+	st.counts[pendingKey{projectID: "p", hour: now.Add(-24 * time.Hour).Truncate(time.Hour)}] = 50
+	st.counts[pendingKey{projectID: "p", hour: now.Add(-time.Hour).Truncate(time.Hour)}] = 5
+
+	a := newTestAccountant(t, st, now, Config{})
+	a.Record("p")
+	a.Record("p")
+
+	st.err = errors.New("disk full")
+	if err := a.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() error = nil, want the store's")
+	}
+	st.err = nil
+	if err := a.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if got := st.counts[pendingKey{projectID: "p", hour: now.Truncate(time.Hour)}]; got != 2 {
+		t.Errorf("stored sends this hour = %d, want 2 after a failed then successful flush", got)
+	}
+
+	// A restarted accountant resumes today's counts
+	resumed := newTestAccountant(t, st, now, Config{})
+	stats := resumed.Stats()
+	if len(stats.Projects) != 1 {
+		t.Fatalf("Projects = %+v, want p", stats.Projects)
+	}
+	if got := stats.Projects[0]; got.Hour.Sends != 2 || got.Day.Sends != 7 {
+		t.Errorf("resumed hour sends = %d, day sends = %d, want 2, 7", got.Hour.Sends, got.Day.Sends)
+	}
+}
@@ -0,0 +1,209 @@
+// Package senderclass sorts senders into classes defined by the operator,
+// such as interactive chat or bulk backup traffic, each with its own batch
+// window, batch size, and push rate. A backup service's bulk notifications
+// then don't set the latency of chat messages to the same device.
+package senderclass
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultPer is the rate period used when a class limits pushes without
+// setting one.
+const defaultPer = time.Minute
+
+// Class is a named group of senders sharing delivery settings.
+type Class struct {
+	Name string
+	// Senders lists username patterns in path.Match syntax, such as
+	// "*@chat.example" or "backup-?@oc".
+	Senders []string
+	// Window is how long the class's notifications may wait in a batch. A
+	// pending batch due later is brought forward. Zero uses the batch
+	// window.
+	Window time.Duration
+	// MaxSize flushes a batch once a notification from the class brings it
+	// to this many notifications. Zero uses the batch size limit.
+	MaxSize int
+	// MaxPushes limits each sender in the class to this many pushes per
+	// Per, which defaults to a minute. Zero means no limit.
+	MaxPushes int
+	Per       time.Duration
+}
+
+// Stats counts one class's pushes since startup.
+type Stats struct {
+	Name    string `json:"name"`
+	Pushes  uint64 `json:"pushes"`  // pushes allowed
+	Limited uint64 `json:"limited"` // pushes refused for exceeding MaxPushes
+	Senders int    `json:"senders"` // senders whose rate is being tracked
+}
+
+// sender tracks one rate-limited sender.
+type sender struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Classifier matches senders to classes and enforces their push rates.
+// A nil *Classifier puts every sender in no class.
+type Classifier struct {
+	classes []Class
+	now     func() time.Time
+
+	mu        sync.Mutex
+	senders   map[string]*sender // by username; a sender is in one class
+	pushes    []uint64           // by class index
+	limited   []uint64
+	lastPrune time.Time
+}
+
+// New creates a Classifier. A sender matching several classes is in the
+// first one listed.
+func New(classes []Class) (*Classifier, error) {
+	classes = append([]Class(nil), classes...)
+	seen := make(map[string]bool, len(classes))
+	for i := range classes {
+		c := &classes[i]
+		if c.Name == "" {
+			return nil, fmt.Errorf("sender class %d has no name", i)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("sender class %q defined twice", c.Name)
+		}
+		seen[c.Name] = true
+		if len(c.Senders) == 0 {
+			return nil, fmt.Errorf("sender class %q matches no senders", c.Name)
+		}
+		for _, pattern := range c.Senders {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("sender class %q: invalid pattern %q: %w", c.Name, pattern, err)
+			}
+		}
+		if c.Window < 0 || c.MaxSize < 0 || c.MaxPushes < 0 || c.Per < 0 {
+			return nil, fmt.Errorf("sender class %q: limits must not be negative", c.Name)
+		}
+		if c.Per == 0 {
+			c.Per = defaultPer
+		}
+	}
+	return &Classifier{
+		classes: classes,
+		now:     time.Now,
+		senders: make(map[string]*sender),
+		pushes:  make([]uint64, len(classes)),
+		limited: make([]uint64, len(classes)),
+	}, nil
+}
+
+// Match returns the class username is in, or nil if it's in none.
+func (c *Classifier) Match(username string) *Class {
+	if i := c.match(username); i >= 0 {
+		return &c.classes[i]
+	}
+	return nil
+}
+
+// match returns the index of the class username is in, or -1.
+func (c *Classifier) match(username string) int {
+	if c == nil {
+		return -1
+	}
+	for i, class := range c.classes {
+		for _, pattern := range class.Senders {
+			if ok, _ := path.Match(pattern, username); ok {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Allow counts a push from username against its class's rate. It returns
+// the class, nil if username is in none, and whether the push is allowed.
+// A refused push reports how long until the sender may push again.
+func (c *Classifier) Allow(username string) (class *Class, retryAfter time.Duration, ok bool) {
+	i := c.match(username)
+	if i < 0 {
+		return nil, 0, true
+	}
+	class = &c.classes[i]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if class.MaxPushes == 0 {
+		c.pushes[i]++
+		return class, 0, true
+	}
+
+	now := c.now()
+	c.prune(now)
+	s, found := c.senders[username]
+	if !found {
+		s = &sender{limiter: rate.NewLimiter(rate.Limit(float64(class.MaxPushes)/class.Per.Seconds()), class.MaxPushes)}
+		c.senders[username] = s
+	}
+	s.lastSeen = now
+
+	if !s.limiter.AllowN(now, 1) {
+		c.limited[i]++
+		missing := 1 - s.limiter.TokensAt(now)
+		return class, time.Duration(missing / float64(s.limiter.Limit()) * float64(time.Second)), false
+	}
+	c.pushes[i]++
+	return class, 0, true
+}
+
+// prune forgets senders idle long enough for their allowance to be full
+// again, at most once a minute. Caller must hold c.mu.
+func (c *Classifier) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+	for username, s := range c.senders {
+		if i := c.match(username); i < 0 || now.Sub(s.lastSeen) >= c.classes[i].Per {
+			delete(c.senders, username)
+		}
+	}
+}
+
+// Reset refills every sender's allowance, as if none had pushed yet. The
+// counts Stats reports are kept.
+func (c *Classifier) Reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.senders = make(map[string]*sender)
+}
+
+// Stats returns each class's counts, in configuration order.
+func (c *Classifier) Stats() []Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tracked := make([]int, len(c.classes))
+	for username := range c.senders {
+		if i := c.match(username); i >= 0 {
+			tracked[i]++
+		}
+	}
+	stats := make([]Stats, len(c.classes))
+	for i, class := range c.classes {
+		stats[i] = Stats{
+			Name:    class.Name,
+			Pushes:  c.pushes[i],
+			Limited: c.limited[i],
+			Senders: tracked[i],
+		}
+	}
+	return stats
+}
@@ -0,0 +1,112 @@
+package senderclass
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestClassifier returns a Classifier with a clock the test advances.
+func newTestClassifier(t *testing.T, classes []Class) (*Classifier, *time.Time) {
+	t.Helper()
+	c, err := New(classes)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestMatch(t *testing.T) {
+	c, _ := newTestClassifier(t, []Class{
+		{Name: "interactive", Senders: []string{"*@chat.example"}},
+		{Name: "bulk", Senders: []string{"backup-*@oc", "*@chat.example"}},
+	})
+
+	tests := []struct {
+		sender string
+		want   string
+	}{
+		{"alice@chat.example", "interactive"}, // first class listed wins
+		{"backup-nightly@oc", "bulk"},
+		{"bob@oc", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if class := c.Match(tt.sender); class != nil {
+			got = class.Name
+		}
+		if got != tt.want {
+			t.Errorf("Match(%q) = %q, want %q", tt.sender, got, tt.want)
+		}
+	}
+
+	var none *Classifier
+	if class, _, ok := none.Allow("alice@oc"); class != nil || !ok {
+		t.Errorf("nil Classifier Allow() = %v, %v; want no class, allowed", class, ok)
+	}
+}
+
+func TestAllow_RateLimit(t *testing.T) {
+	c, now := newTestClassifier(t, []Class{
+		{Name: "bulk", Senders: []string{"backup-*@oc"}, MaxPushes: 3, Per: 30 * time.Second},
+		{Name: "interactive", Senders: []string{"*@oc"}},
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, _, ok := c.Allow("backup-1@oc"); !ok {
+			t.Fatalf("push %d refused within MaxPushes", i+1)
+		}
+	}
+	class, retryAfter, ok := c.Allow("backup-1@oc")
+	if ok {
+		t.Fatal("push beyond MaxPushes allowed")
+	}
+	if class == nil || class.Name != "bulk" {
+		t.Errorf("class = %v, want bulk", class)
+	}
+	if retryAfter != 10*time.Second {
+		t.Errorf("retryAfter = %s, want 10s", retryAfter)
+	}
+
+	// Each sender has its own allowance; unlimited classes are never refused
+	if _, _, ok := c.Allow("backup-2@oc"); !ok {
+		t.Error("another sender in the class was refused")
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, ok := c.Allow("alice@oc"); !ok {
+			t.Fatal("sender in an unlimited class refused")
+		}
+	}
+
+	*now = now.Add(10 * time.Second)
+	if _, _, ok := c.Allow("backup-1@oc"); !ok {
+		t.Error("push refused after retryAfter passed")
+	}
+
+	stats := c.Stats()
+	if stats[0].Pushes != 5 || stats[0].Limited != 1 || stats[0].Senders != 2 {
+		t.Errorf("bulk stats = %+v, want 5 pushes, 1 limited, 2 senders", stats[0])
+	}
+	if stats[1].Pushes != 10 || stats[1].Senders != 0 {
+		t.Errorf("interactive stats = %+v, want 10 pushes, no tracked senders", stats[1])
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		classes []Class
+	}{
+		{"no name", []Class{{Senders: []string{"*"}}}},
+		{"duplicate", []Class{{Name: "a", Senders: []string{"*"}}, {Name: "a", Senders: []string{"*"}}}},
+		{"no senders", []Class{{Name: "a"}}},
+		{"bad pattern", []Class{{Name: "a", Senders: []string{"[oc"}}}},
+		{"negative", []Class{{Name: "a", Senders: []string{"*"}, Window: -time.Second}}},
+	}
+	for _, tt := range tests {
+		if _, err := New(tt.classes); err == nil {
+			t.Errorf("%s: New() succeeded, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CoalescingStore wraps a SQLiteStore so that SaveBatch returns once the
+// batch is in an in-memory write queue, and a background goroutine writes the
+// queue to SQLite in a single transaction every interval or maxEntries tokens.
+// Repeated saves of the same token between writes collapse into one row write,
+// so a busy device costs one fsync per interval instead of one per push.
+//
+// Crash window: batches saved within the last interval are lost if the process
+// dies before they are written. Their request IDs were already returned to
+// clients and will report "unknown". Close writes the queue before closing.
+//
+// Operations that read or delete batches write the queue first, so they
+// always see the latest saved state. Lookups by request ID read the queue
+// alongside SQLite instead, since they are frequent.
+//
+// While writes are failing, SaveBatch writes synchronously and returns the
+// error, so callers learn that their batch isn't persisted.
+type CoalescingStore struct {
+	*SQLiteStore
+
+	interval   time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	pending map[string]pendingBatch // latest unwritten batch per FCM token
+	kick    chan struct{}           // asks the writer to write now
+	stop    chan struct{}
+	done    chan struct{}
+
+	// writeMu serializes queue writes so a synchronous write by a caller
+	// can't commit older rows after a newer background write.
+	writeMu sync.Mutex
+
+	failing atomic.Bool // the last write failed
+
+	saves     atomic.Uint64
+	coalesced atomic.Uint64
+	writes    atomic.Uint64
+	rows      atomic.Uint64
+}
+
+// pendingBatch is a batch serialized at save time, so later changes by the
+// caller don't race with the background write.
+type pendingBatch struct {
+	recipient     string
+	notifications []byte
+	createdAt     int64
+	flushAt       int64
+	attempts      int
+	requestIDs    []string
+}
+
+// CoalescerStats is a snapshot of CoalescingStore write activity.
+type CoalescerStats struct {
+	Pending   int    `json:"pending"`
+	Saves     uint64 `json:"saves"`
+	Coalesced uint64 `json:"coalesced"` // saves replaced by a later save before being written
+	Writes    uint64 `json:"writes"`    // SQLite transactions committed
+	Rows      uint64 `json:"rows"`
+}
+
+// NewCoalescingStore starts writing s's queued batches every interval, or as
+// soon as maxEntries distinct tokens are waiting. When the queue is full and
+// the writer hasn't caught up, SaveBatch writes the queue itself, so callers
+// slow down to SQLite's pace instead of growing the queue without bound.
+func NewCoalescingStore(s *SQLiteStore, interval time.Duration, maxEntries int) *CoalescingStore {
+	c := &CoalescingStore{
+		SQLiteStore: s,
+		interval:    interval,
+		maxEntries:  maxEntries,
+		pending:     make(map[string]pendingBatch),
+		kick:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// SaveBatch queues batch to be written for the given FCM token.
+func (c *CoalescingStore) SaveBatch(ctx context.Context, fcmToken string, batch *Batch) error {
+	notifData, err := serializeNotifications(batch.Notifications)
+	if err != nil {
+		return fmt.Errorf("serializing notifications: %w", err)
+	}
+
+	c.mu.Lock()
+	prev, hadPrev := c.pending[fcmToken]
+	if hadPrev {
+		c.coalesced.Add(1)
+	}
+	c.pending[fcmToken] = pendingBatch{
+		recipient:     batch.Recipient,
+		notifications: notifData,
+		createdAt:     batch.CreatedAt.Unix(),
+		flushAt:       batch.FlushAt.Unix(),
+		attempts:      batch.Attempts,
+		requestIDs:    requestIDsOf(batch.Notifications),
+	}
+	queued := len(c.pending)
+	c.mu.Unlock()
+	c.saves.Add(1)
+
+	if c.failing.Load() {
+		// Find out now whether the store has recovered. If not, drop this
+		// save from the queue; the caller keeps the batch and saves it again.
+		if err := c.Flush(ctx); err != nil {
+			c.mu.Lock()
+			if hadPrev {
+				c.pending[fcmToken] = prev
+			} else {
+				delete(c.pending, fcmToken)
+			}
+			c.mu.Unlock()
+			return err
+		}
+		return nil
+	}
+
+	switch {
+	case queued >= 2*c.maxEntries:
+		// The writer is behind: apply backpressure
+		return c.Flush(ctx)
+	case queued >= c.maxEntries:
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Flush writes all queued batches to SQLite.
+func (c *CoalescingStore) Flush(ctx context.Context) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]pendingBatch)
+	c.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := c.writeBatches(ctx, pending); err != nil {
+		if ctx.Err() == nil {
+			c.failing.Store(true)
+		}
+		// Put the rows back unless a newer save replaced them meanwhile
+		c.mu.Lock()
+		for token, p := range pending {
+			if _, ok := c.pending[token]; !ok {
+				c.pending[token] = p
+			}
+		}
+		c.mu.Unlock()
+		return err
+	}
+
+	c.failing.Store(false)
+	c.writes.Add(1)
+	c.rows.Add(uint64(len(pending)))
+	return nil
+}
+
+// writeBatches writes pending in one transaction.
+func (c *CoalescingStore) writeBatches(ctx context.Context, pending map[string]pendingBatch) error {
+	s := c.SQLiteStore
+	defer s.observe(ctx, "write_batches", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT OR REPLACE INTO batches (fcm_token, recipient, notifications, created_at, flush_at, attempts)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for token, p := range pending {
+		if _, err := stmt.ExecContext(ctx, token, p.recipient, p.notifications, p.createdAt, p.flushAt, p.attempts); err != nil {
+			return fmt.Errorf("writing batch: %w", err)
+		}
+		if err := indexRequestIDs(ctx, tx, token, p.requestIDs, p.createdAt); err != nil {
+			return fmt.Errorf("indexing request IDs: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// run writes the queue every interval, or early when kicked, until Close.
+func (c *CoalescingStore) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.kick:
+		case <-c.stop:
+			return
+		}
+		if err := c.Flush(context.Background()); err != nil {
+			log.Printf("ERROR: failed to write queued batches: %v", err)
+		}
+	}
+}
+
+// Stats returns current write counters.
+func (c *CoalescingStore) Stats() CoalescerStats {
+	c.mu.Lock()
+	pending := len(c.pending)
+	c.mu.Unlock()
+
+	return CoalescerStats{
+		Pending:   pending,
+		Saves:     c.saves.Load(),
+		Coalesced: c.coalesced.Load(),
+		Writes:    c.writes.Load(),
+		Rows:      c.rows.Load(),
+	}
+}
+
+// LoadOldestBatches writes queued batches, then loads the oldest batches.
+func (c *CoalescingStore) LoadOldestBatches(ctx context.Context, limit int) (map[string]*Batch, error) {
+	if err := c.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return c.SQLiteStore.LoadOldestBatches(ctx, limit)
+}
+
+// ListBatchesByRecipient writes queued batches, then lists recipient's batches.
+func (c *CoalescingStore) ListBatchesByRecipient(ctx context.Context, recipient string) (map[string]*Batch, error) {
+	if err := c.Flush(ctx); err != nil {
+		return nil, err
+	}
+	return c.SQLiteStore.ListBatchesByRecipient(ctx, recipient)
+}
+
+// DeleteBatchAndSetStatus writes queued batches, then deletes the batch so
+// every request ID in its latest state gets the status.
+func (c *CoalescingStore) DeleteBatchAndSetStatus(ctx context.Context, fcmToken string, status Status) error {
+	if err := c.Flush(ctx); err != nil {
+		return err
+	}
+	return c.SQLiteStore.DeleteBatchAndSetStatus(ctx, fcmToken, status)
+}
+
+// DeleteNotificationsAndSetStatus writes queued batches, then deletes
+// requestIDs from the batch.
+func (c *CoalescingStore) DeleteNotificationsAndSetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error {
+	if err := c.Flush(ctx); err != nil {
+		return err
+	}
+	return c.SQLiteStore.DeleteNotificationsAndSetStatus(ctx, fcmToken, requestIDs, status)
+}
+
+// HasRequestID checks the queue, then SQLite, for requestID. It doesn't
+// write the queue, so lookups don't undo the coalescing.
+func (c *CoalescingStore) HasRequestID(ctx context.Context, requestID string) (bool, error) {
+	if token, _ := c.queued(requestID); token != "" {
+		return true, nil
+	}
+	return c.SQLiteStore.HasRequestID(ctx, requestID)
+}
+
+// FindPendingRequest looks for requestID in the queue, then in SQLite,
+// without writing the queue.
+func (c *CoalescingStore) FindPendingRequest(ctx context.Context, requestID string) (*PendingRequest, error) {
+	if token, p := c.queued(requestID); token != "" {
+		notifications, err := deserializeNotifications(p.notifications)
+		if err != nil {
+			return nil, fmt.Errorf("deserializing notifications: %w", err)
+		}
+		for i, notif := range notifications {
+			if notif.RequestID == requestID {
+				return &PendingRequest{FcmToken: token, Index: i, Notification: notif}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	pending, err := c.SQLiteStore.FindPendingRequest(ctx, requestID)
+	if err != nil || pending == nil {
+		return pending, err
+	}
+	// A queued save of the same token replaced the row SQLite holds, and
+	// no longer has requestID
+	c.mu.Lock()
+	_, replaced := c.pending[pending.FcmToken]
+	c.mu.Unlock()
+	if replaced {
+		return nil, nil
+	}
+	return pending, nil
+}
+
+// queued returns the token and queued batch holding requestID, or "" if no
+// queued batch holds it.
+func (c *CoalescingStore) queued(requestID string) (string, pendingBatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for token, p := range c.pending {
+		for _, id := range p.requestIDs {
+			if id == requestID {
+				return token, p
+			}
+		}
+	}
+	return "", pendingBatch{}
+}
+
+// MarkLost writes queued batches first, so statuses whose batch is only
+// queued aren't mistaken for lost.
+func (c *CoalescingStore) MarkLost(ctx context.Context, olderThan, expiresAt time.Time) (int64, error) {
+	if err := c.Flush(ctx); err != nil {
+		return 0, err
+	}
+	return c.SQLiteStore.MarkLost(ctx, olderThan, expiresAt)
+}
+
+// Reopen writes any queued batches, then replaces the database connection
+// as SQLiteStore.Reopen does.
+func (c *CoalescingStore) Reopen(ctx context.Context) error {
+	if err := c.Flush(ctx); err != nil {
+		return err
+	}
+	return c.SQLiteStore.Reopen(ctx)
+}
+
+// Close stops the writer, writes any queued batches, and closes the database.
+func (c *CoalescingStore) Close() error {
+	close(c.stop)
+	<-c.done
+
+	if err := c.Flush(context.Background()); err != nil {
+		log.Printf("ERROR: failed to write queued batches on close: %v", err)
+	}
+	return c.SQLiteStore.Close()
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCoalescingStore_ReadsSeeQueuedBatches(t *testing.T) {
+	c := NewCoalescingStore(newTestStore(t), time.Hour, 100)
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if err := c.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1", "req-2")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	found, err := c.HasRequestID(ctx, "req-2")
+	if err != nil || !found {
+		t.Errorf("HasRequestID(req-2) = %v, %v, want true", found, err)
+	}
+	pending, err := c.FindPendingRequest(ctx, "req-2")
+	if err != nil {
+		t.Fatalf("FindPendingRequest() error = %v", err)
+	}
+	if pending == nil || pending.FcmToken != "token1" || pending.Index != 1 {
+		t.Errorf("FindPendingRequest(req-2) = %+v, want token1 at index 1", pending)
+	}
+
+	// Lookups by request ID leave the queue alone
+	if stats := c.Stats(); stats.Pending != 1 || stats.Writes != 0 || stats.Coalesced != 1 {
+		t.Errorf("Stats() = %+v, want one queued batch, no writes, one coalesced save", stats)
+	}
+
+	// A queued save replaces the row already written
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if err := c.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-2")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if pending, _ := c.FindPendingRequest(ctx, "req-1"); pending != nil {
+		t.Errorf("FindPendingRequest(req-1) = %+v, want nil once the queued batch dropped it", pending)
+	}
+
+	// Reading batches writes the queue first
+	batches, err := c.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if b := batches["token1"]; b == nil || len(b.Notifications) != 1 || b.Notifications[0].RequestID != "req-2" {
+		t.Errorf("LoadOldestBatches() = %+v, want token1 holding req-2", batches)
+	}
+	if stats := c.Stats(); stats.Pending != 0 {
+		t.Errorf("Stats().Pending = %d after LoadOldestBatches, want 0", stats.Pending)
+	}
+}
+
+func TestCoalescingStore_CloseWritesQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	s, err := New(Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	c := NewCoalescingStore(s, time.Hour, 100)
+	ctx := context.Background()
+
+	if err := c.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	s, err = New(Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer s.Close()
+	batches, err := s.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(batches) != 1 || batches["token1"] == nil {
+		t.Errorf("LoadOldestBatches() after Close = %+v, want token1", batches)
+	}
+	if found, _ := s.HasRequestID(ctx, "req-1"); !found {
+		t.Error("HasRequestID(req-1) = false, want the written batch indexed")
+	}
+}
+
+func TestCoalescingStore_MaxEntriesWritesEarly(t *testing.T) {
+	c := NewCoalescingStore(newTestStore(t), time.Hour, 2)
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if stats := c.Stats(); stats.Pending != 1 {
+		t.Fatalf("Stats().Pending = %d, want 1 below maxEntries", stats.Pending)
+	}
+	if err := c.SaveBatch(ctx, "token2", testBatch("bob@oc", "req-2")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Stats().Writes == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats() = %+v, want a write once maxEntries tokens are queued", c.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Pending != 0 || stats.Rows != 2 {
+		t.Errorf("Stats() = %+v, want both batches written", stats)
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// FuzzDeserializeNotifications checks that batch rows read back from the
+// database, however damaged, either fail to decode or decode to
+// notifications that survive another round trip unchanged.
+func FuzzDeserializeNotifications(f *testing.F) {
+	queuedAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	seeds := [][]QueuedNotification{
+		nil,
+		{{
+			DataIDs:   [][]byte{bytes.Repeat([]byte{0x11}, 32)},
+			RequestID: "req-1",
+			Sender:    "alice@oc",
+			Target:    "bob@oc",
+			DeviceID:  "phone",
+			QueuedAt:  queuedAt,
+		}},
+		{{
+			DataIDs:         [][]byte{{1}, {2}},
+			RequestID:       "req-2",
+			Deadline:        queuedAt.Add(time.Hour),
+			Data:            map[string]string{"kind": "chat"},
+			EndpointOptions: map[string]string{"channel_id": "messages"},
+		}, {
+			RequestID: "req-3",
+		}},
+	}
+	for _, notifications := range seeds {
+		data, err := serializeNotifications(notifications)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(`[null, {"RequestID": 7}]`))
+	f.Add([]byte(`[{"Deadline": "not a time"}]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		notifications, err := deserializeNotifications(data)
+		if err != nil {
+			return
+		}
+		first, err := serializeNotifications(notifications)
+		if err != nil {
+			t.Fatalf("re-serializing decoded notifications: %v", err)
+		}
+		again, err := deserializeNotifications(first)
+		if err != nil {
+			t.Fatalf("decoding re-serialized notifications: %v", err)
+		}
+		second, err := serializeNotifications(again)
+		if err != nil {
+			t.Fatalf("re-serializing notifications again: %v", err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Errorf("round trip changed notifications:\n%s\n%s", first, second)
+		}
+	})
+}
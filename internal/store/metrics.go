@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/logfield"
+)
+
+// sizeInterval is how often the row counts and file size are sampled.
+// Counting rows scans whole tables, so it isn't done per metrics request.
+const sizeInterval = time.Minute
+
+// latencyBounds are the upper bounds of the latency histogram buckets. A
+// final bucket counts everything slower.
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// StoreMetrics is a snapshot of SQLiteStore size and latency metrics.
+type StoreMetrics struct {
+	Batches   int64 `json:"batches"`    // pending batch rows
+	Statuses  int64 `json:"statuses"`   // status rows
+	FileBytes int64 `json:"file_bytes"` // database file plus its WAL
+	SampledAt int64 `json:"sampled_at"` // Unix timestamp (seconds) of the counts above; 0 before the first sample
+
+	// Latency is per operation, named like the method in snake case.
+	// It includes waiting for the write lock, so it shows contention too.
+	Latency map[string]LatencyHistogram `json:"latency"`
+}
+
+// LatencyHistogram summarizes how long an operation took.
+type LatencyHistogram struct {
+	Count   uint64        `json:"count"`
+	SumMs   float64       `json:"sum_ms"`
+	Buckets []BucketCount `json:"buckets"`
+}
+
+// BucketCount counts operations that took at most LE, and longer than the
+// previous bucket's bound. The last bucket's LE is "+Inf".
+type BucketCount struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+	// Exemplar is the trace ID of the latest operation in the bucket done
+	// for a push, so a slow bucket leads to the push's log lines.
+	Exemplar string `json:"exemplar,omitempty"`
+}
+
+// histogram counts operation latencies into latencyBounds buckets.
+type histogram struct {
+	counts    []atomic.Uint64          // len(latencyBounds)+1
+	exemplars []atomic.Pointer[string] // by bucket, like counts
+	sum       atomic.Int64             // nanoseconds
+}
+
+// storeMetrics holds the metrics a SQLiteStore collects.
+type storeMetrics struct {
+	mu      sync.Mutex
+	latency map[string]*histogram
+
+	batches   atomic.Int64
+	statuses  atomic.Int64
+	fileBytes atomic.Int64
+	sampledAt atomic.Int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// observe records how long op took since start, with the first trace ID
+// carried by ctx as the bucket's exemplar. Use it as
+// defer s.observe(ctx, "op", time.Now()).
+func (s *SQLiteStore) observe(ctx context.Context, op string, start time.Time) {
+	elapsed := time.Since(start)
+
+	m := &s.metrics
+	m.mu.Lock()
+	h, ok := m.latency[op]
+	if !ok {
+		h = &histogram{
+			counts:    make([]atomic.Uint64, len(latencyBounds)+1),
+			exemplars: make([]atomic.Pointer[string], len(latencyBounds)+1),
+		}
+		m.latency[op] = h
+	}
+	m.mu.Unlock()
+
+	i := 0
+	for i < len(latencyBounds) && elapsed > latencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(elapsed))
+	if ids := logfield.TraceIDs(ctx); len(ids) > 0 {
+		h.exemplars[i].Store(&ids[0])
+	}
+}
+
+// Metrics returns the latest row counts and file size, and latency
+// histograms since the store was opened.
+func (s *SQLiteStore) Metrics() StoreMetrics {
+	m := &s.metrics
+	metrics := StoreMetrics{
+		Batches:   m.batches.Load(),
+		Statuses:  m.statuses.Load(),
+		FileBytes: m.fileBytes.Load(),
+		SampledAt: m.sampledAt.Load(),
+		Latency:   make(map[string]LatencyHistogram),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for op, h := range m.latency {
+		lh := LatencyHistogram{
+			SumMs:   float64(h.sum.Load()) / float64(time.Millisecond),
+			Buckets: make([]BucketCount, len(h.counts)),
+		}
+		for i := range h.counts {
+			count := h.counts[i].Load()
+			lh.Count += count
+			lh.Buckets[i].Count = count
+			if exemplar := h.exemplars[i].Load(); exemplar != nil {
+				lh.Buckets[i].Exemplar = *exemplar
+			}
+			if i < len(latencyBounds) {
+				lh.Buckets[i].LE = latencyBounds[i].String()
+			} else {
+				lh.Buckets[i].LE = "+Inf"
+			}
+		}
+		metrics.Latency[op] = lh
+	}
+	return metrics
+}
+
+// sampleSizes updates the row counts and file size every sizeInterval
+// until stop is closed.
+func (s *SQLiteStore) sampleSizes() {
+	m := &s.metrics
+	defer close(m.done)
+
+	ticker := time.NewTicker(sizeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sampleSizesOnce(context.Background()); err != nil {
+			log.Printf("WARNING: sampling store size: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// sampleSizesOnce counts batch and status rows and measures the files.
+func (s *SQLiteStore) sampleSizesOnce(ctx context.Context) error {
+	m := &s.metrics
+
+	var batches, statuses int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM batches`).Scan(&batches); err != nil {
+		return err
+	}
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM status`).Scan(&statuses); err != nil {
+		return err
+	}
+
+	var fileBytes int64
+	for _, path := range []string{s.path, s.path + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			fileBytes += info.Size()
+		}
+	}
+
+	m.batches.Store(batches)
+	m.statuses.Store(statuses)
+	m.fileBytes.Store(fileBytes)
+	m.sampledAt.Store(time.Now().Unix())
+	return nil
+}
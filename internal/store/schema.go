@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+)
+
+// SchemaVersion is the schema version New migrates databases to. It must
+// be raised with each new migrateVN.
+const SchemaVersion = 22
+
+// SchemaInfo describes a database's schema version and contents.
+type SchemaInfo struct {
+	Version int              // 0 for an empty database
+	Rows    map[string]int64 // row count per table, except schema_version
+}
+
+// Inspect reads the schema version and row counts of the database at path
+// without migrating or otherwise changing it.
+func Inspect(ctx context.Context, path string) (SchemaInfo, error) {
+	if _, err := os.Stat(path); err != nil {
+		return SchemaInfo{}, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return SchemaInfo{}, fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	info := SchemaInfo{Rows: make(map[string]int64)}
+	rows, err := db.QueryContext(ctx, `
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'
+	`)
+	if err != nil {
+		return SchemaInfo{}, fmt.Errorf("listing tables: %w", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return SchemaInfo{}, fmt.Errorf("listing tables: %w", err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return SchemaInfo{}, fmt.Errorf("listing tables: %w", err)
+	}
+
+	for _, table := range tables {
+		if table == "schema_version" {
+			err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&info.Version)
+			if err != nil {
+				return SchemaInfo{}, fmt.Errorf("reading schema version: %w", err)
+			}
+			continue
+		}
+		var count int64
+		// Table names come from sqlite_master, not user input
+		if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %q`, table)).Scan(&count); err != nil {
+			return SchemaInfo{}, fmt.Errorf("counting %s rows: %w", table, err)
+		}
+		info.Rows[table] = count
+	}
+	return info, nil
+}
+
+// Backup writes a consistent copy of the database at path to dest, which
+// must not exist. It is safe while a gateway is using the database.
+func Backup(ctx context.Context, path, dest string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?`, dest); err != nil {
+		return fmt.Errorf("copying database: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// TestNew_MigratesToSchemaVersion checks that the migrations New runs end at
+// SchemaVersion, so a new migrateVN can't be added without raising it.
+// "pushserver migrate" rolls back an upgrade that stops short of it.
+func TestNew_MigratesToSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+
+	// Opening again runs no migrations and must not change the version
+	for range 2 {
+		s, err := New(Config{Path: path})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		s.Close()
+
+		info, err := Inspect(ctx, path)
+		if err != nil {
+			t.Fatalf("Inspect() error = %v", err)
+		}
+		if info.Version != SchemaVersion {
+			t.Errorf("fresh database version = %d, want SchemaVersion %d", info.Version, SchemaVersion)
+		}
+	}
+}
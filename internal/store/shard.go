@@ -0,0 +1,575 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShardPaths returns the database files of a store split into n shards at
+// path: path itself for one shard, otherwise one file per shard beside it,
+// e.g. "pushserver.0-of-4.db" for path "pushserver.db". The shard count is
+// part of the name, so changing it starts from fresh files.
+func ShardPaths(path string, n int) []string {
+	if n <= 1 {
+		return []string{path}
+	}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s.%d-of-%d%s", stem, i, n, ext)
+	}
+	return paths
+}
+
+// CheckShards returns an error if database files for a shard count other
+// than n hold pending batches, which a store with n shards would never send.
+func CheckShards(ctx context.Context, path string, n int) error {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	others, err := filepath.Glob(stem + ".*-of-*" + ext)
+	if err != nil {
+		return err
+	}
+	others = append(others, path)
+
+	current := make(map[string]bool, n)
+	for _, p := range ShardPaths(path, n) {
+		current[p] = true
+	}
+	for _, p := range others {
+		if current[p] {
+			continue
+		}
+		info, err := Inspect(ctx, p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("inspecting %s: %w", p, err)
+		}
+		if pending := info.Rows["batches"]; pending > 0 {
+			return fmt.Errorf("%s holds %d pending batches from a different shard count; drain them before changing storage.shards", p, pending)
+		}
+	}
+	return nil
+}
+
+// ShardedStore spreads data over several stores by a hash of the FCM token,
+// so high write rates aren't limited by a single SQLite writer. A token's
+// batches, recent sends, failures and the statuses its flushes write all
+// live in the same shard, keeping each flush a single transaction.
+//
+// Lookups by request ID ask every shard. Imported statuses go to the shard
+// holding their request, or the one their ID hashes to if none does.
+// Broadcasts and device groups are kept in the first shard.
+type ShardedStore struct {
+	shards []Store
+}
+
+// NewShardedStore creates a ShardedStore over shards, which it closes on
+// Close. Tokens are assigned by position, so shards must always be passed in
+// the same order.
+func NewShardedStore(shards []Store) *ShardedStore {
+	return &ShardedStore{shards: shards}
+}
+
+// index returns the shard key hashes to.
+func (s *ShardedStore) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// shard returns the shard holding fcmToken's data.
+func (s *ShardedStore) shard(fcmToken string) Store {
+	return s.shards[s.index(fcmToken)]
+}
+
+// SaveBatch persists a batch in fcmToken's shard.
+func (s *ShardedStore) SaveBatch(ctx context.Context, fcmToken string, batch *Batch) error {
+	return s.shard(fcmToken).SaveBatch(ctx, fcmToken, batch)
+}
+
+// LoadOldestBatches loads the oldest batches across all shards, ordered by
+// flush_at.
+func (s *ShardedStore) LoadOldestBatches(ctx context.Context, limit int) (map[string]*Batch, error) {
+	type entry struct {
+		fcmToken string
+		batch    *Batch
+	}
+	var all []entry
+	for _, shard := range s.shards {
+		batches, err := shard.LoadOldestBatches(ctx, limit)
+		if err != nil {
+			return nil, err
+		}
+		for fcmToken, batch := range batches {
+			all = append(all, entry{fcmToken, batch})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].batch.FlushAt.Before(all[j].batch.FlushAt)
+	})
+
+	oldest := make(map[string]*Batch, min(len(all), limit))
+	for _, e := range all[:min(len(all), limit)] {
+		oldest[e.fcmToken] = e.batch
+	}
+	return oldest, nil
+}
+
+// ListBatchesByRecipient returns recipient's pending batches from all shards.
+func (s *ShardedStore) ListBatchesByRecipient(ctx context.Context, recipient string) (map[string]*Batch, error) {
+	all := make(map[string]*Batch)
+	for _, shard := range s.shards {
+		batches, err := shard.ListBatchesByRecipient(ctx, recipient)
+		if err != nil {
+			return nil, err
+		}
+		for fcmToken, batch := range batches {
+			all[fcmToken] = batch
+		}
+	}
+	return all, nil
+}
+
+// DeleteBatchAndSetStatus deletes fcmToken's batch and sets its statuses in
+// its shard.
+func (s *ShardedStore) DeleteBatchAndSetStatus(ctx context.Context, fcmToken string, status Status) error {
+	return s.shard(fcmToken).DeleteBatchAndSetStatus(ctx, fcmToken, status)
+}
+
+// DeleteNotificationsAndSetStatus deletes requestIDs from fcmToken's batch
+// and sets their statuses in its shard.
+func (s *ShardedStore) DeleteNotificationsAndSetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error {
+	return s.shard(fcmToken).DeleteNotificationsAndSetStatus(ctx, fcmToken, requestIDs, status)
+}
+
+// ClaimBatch takes the lease on fcmToken's batch in its shard.
+func (s *ShardedStore) ClaimBatch(ctx context.Context, fcmToken, owner string, ttl time.Duration) (bool, error) {
+	return s.shard(fcmToken).ClaimBatch(ctx, fcmToken, owner, ttl)
+}
+
+// ReleaseBatch gives up the lease on fcmToken's batch in its shard.
+func (s *ShardedStore) ReleaseBatch(ctx context.Context, fcmToken, owner string) error {
+	return s.shard(fcmToken).ReleaseBatch(ctx, fcmToken, owner)
+}
+
+// CleanupExpiredBatchLeases removes expired leases from every shard.
+func (s *ShardedStore) CleanupExpiredBatchLeases(ctx context.Context) (int64, error) {
+	return s.sum(ctx, Store.CleanupExpiredBatchLeases)
+}
+
+// RecordReceipt records the receipt for fcmToken's batch in its shard.
+func (s *ShardedStore) RecordReceipt(ctx context.Context, fcmToken string, receipt Receipt) error {
+	return s.shard(fcmToken).RecordReceipt(ctx, fcmToken, receipt)
+}
+
+// GetReceipt reads the receipt for fcmToken's batch from its shard.
+func (s *ShardedStore) GetReceipt(ctx context.Context, fcmToken, batchHash string) (*Receipt, error) {
+	return s.shard(fcmToken).GetReceipt(ctx, fcmToken, batchHash)
+}
+
+// SaveScheduled stores n in the shard of its FCM token, with its status.
+func (s *ShardedStore) SaveScheduled(ctx context.Context, n ScheduledNotification, status Status) error {
+	return s.shard(n.FcmToken).SaveScheduled(ctx, n, status)
+}
+
+// LoadDueScheduled returns up to limit due scheduled notifications from all
+// shards, soonest first.
+func (s *ShardedStore) LoadDueScheduled(ctx context.Context, now time.Time, limit int) ([]ScheduledNotification, error) {
+	var all []ScheduledNotification
+	for _, shard := range s.shards {
+		due, err := shard.LoadDueScheduled(ctx, now, limit)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, due...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].DeliverAt.Before(all[j].DeliverAt)
+	})
+	return all[:min(len(all), limit)], nil
+}
+
+// GetScheduled asks each shard for the scheduled notification with
+// requestID.
+func (s *ShardedStore) GetScheduled(ctx context.Context, requestID string) (*ScheduledNotification, error) {
+	for _, shard := range s.shards {
+		n, err := shard.GetScheduled(ctx, requestID)
+		if err != nil || n != nil {
+			return n, err
+		}
+	}
+	return nil, nil
+}
+
+// DeleteScheduledAndSetStatus deletes the scheduled notification with
+// requestID from whichever shard holds it, setting its status there.
+func (s *ShardedStore) DeleteScheduledAndSetStatus(ctx context.Context, requestID string, status Status) (bool, error) {
+	for _, shard := range s.shards {
+		deleted, err := shard.DeleteScheduledAndSetStatus(ctx, requestID, status)
+		if err != nil || deleted {
+			return deleted, err
+		}
+	}
+	return false, nil
+}
+
+// SetStatus sets the status of requests queued for fcmToken in its shard,
+// where their batch and the rest of their statuses are.
+func (s *ShardedStore) SetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error {
+	return s.shard(fcmToken).SetStatus(ctx, fcmToken, requestIDs, status)
+}
+
+// owner returns the shard holding requestID's status or pending batch, or
+// the shard its ID hashes to if none does.
+func (s *ShardedStore) owner(ctx context.Context, requestID string) (int, error) {
+	for i, shard := range s.shards {
+		found, err := shard.HasRequestID(ctx, requestID)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return i, nil
+		}
+	}
+	return s.index(requestID), nil
+}
+
+// GetStatus retrieves the delivery status for a request from whichever shard
+// holds it.
+func (s *ShardedStore) GetStatus(ctx context.Context, requestID string) (Status, error) {
+	for _, shard := range s.shards {
+		status, err := shard.GetStatus(ctx, requestID)
+		if err == nil {
+			return status, nil
+		}
+		if !errors.Is(err, ErrRequestNotFound) {
+			return Status{}, err
+		}
+	}
+	return Status{}, fmt.Errorf("%w: %s", ErrRequestNotFound, requestID)
+}
+
+// ListStatusesSince returns up to limit statuses from all shards, in update
+// order.
+func (s *ShardedStore) ListStatusesSince(ctx context.Context, since time.Time, after StatusCursor, limit int) ([]StatusRecord, error) {
+	var all []StatusRecord
+	for _, shard := range s.shards {
+		records, err := shard.ListStatusesSince(ctx, since, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, records...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].UpdatedAt.Equal(all[j].UpdatedAt) {
+			return all[i].UpdatedAt.Before(all[j].UpdatedAt)
+		}
+		return all[i].RequestID < all[j].RequestID
+	})
+	return all[:min(len(all), limit)], nil
+}
+
+// ImportStatuses writes each status to the shard holding its request, or
+// the one its ID hashes to.
+func (s *ShardedStore) ImportStatuses(ctx context.Context, records []StatusRecord) error {
+	byShard := make(map[int][]StatusRecord)
+	for _, rec := range records {
+		i, err := s.owner(ctx, rec.RequestID)
+		if err != nil {
+			return err
+		}
+		byShard[i] = append(byShard[i], rec)
+	}
+	for i, recs := range byShard {
+		if err := s.shards[i].ImportStatuses(ctx, recs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasRequestID reports whether any shard tracks requestID.
+func (s *ShardedStore) HasRequestID(ctx context.Context, requestID string) (bool, error) {
+	for _, shard := range s.shards {
+		found, err := shard.HasRequestID(ctx, requestID)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// ReserveRequestID claims requestID in the shard it hashes to, after checking
+// that no shard already tracks it.
+func (s *ShardedStore) ReserveRequestID(ctx context.Context, requestID string, at time.Time) error {
+	found, err := s.HasRequestID(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("%w: %s", ErrRequestIDTaken, requestID)
+	}
+	return s.shards[s.index(requestID)].ReserveRequestID(ctx, requestID, at)
+}
+
+// FindPendingRequest looks for requestID in every shard's pending batches.
+func (s *ShardedStore) FindPendingRequest(ctx context.Context, requestID string) (*PendingRequest, error) {
+	for _, shard := range s.shards {
+		pending, err := shard.FindPendingRequest(ctx, requestID)
+		if err != nil || pending != nil {
+			return pending, err
+		}
+	}
+	return nil, nil
+}
+
+// CleanupExpiredStatus expires statuses in every shard.
+func (s *ShardedStore) CleanupExpiredStatus(ctx context.Context) (int64, error) {
+	return s.sum(ctx, Store.CleanupExpiredStatus)
+}
+
+// CleanupExpiredStatusByState expires statuses in every shard, adding up
+// the counts per state.
+func (s *ShardedStore) CleanupExpiredStatusByState(ctx context.Context) (map[string]int64, error) {
+	byState := make(map[string]int64)
+	for _, shard := range s.shards {
+		counts, err := shard.CleanupExpiredStatusByState(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for state, n := range counts {
+			byState[state] += n
+		}
+	}
+	return byState, nil
+}
+
+// ListDailySummaries adds up the daily summaries of all shards.
+func (s *ShardedStore) ListDailySummaries(ctx context.Context, since time.Time, sender string) ([]DailySummary, error) {
+	type key struct{ day, sender, state string }
+	counts := make(map[key]int64)
+	for _, shard := range s.shards {
+		summaries, err := shard.ListDailySummaries(ctx, since, sender)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range summaries {
+			counts[key{d.Day, d.Sender, d.State}] += d.Count
+		}
+	}
+
+	summaries := make([]DailySummary, 0, len(counts))
+	for k, count := range counts {
+		summaries = append(summaries, DailySummary{Day: k.day, Sender: k.sender, State: k.state, Count: count})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Sender != b.Sender {
+			return a.Sender < b.Sender
+		}
+		return a.State < b.State
+	})
+	return summaries, nil
+}
+
+// MarkLost marks lost statuses in every shard.
+func (s *ShardedStore) MarkLost(ctx context.Context, olderThan, expiresAt time.Time) (int64, error) {
+	return s.sum(ctx, func(shard Store, ctx context.Context) (int64, error) {
+		return shard.MarkLost(ctx, olderThan, expiresAt)
+	})
+}
+
+// RecordRecentSends records sent data IDs in fcmToken's shard.
+func (s *ShardedStore) RecordRecentSends(ctx context.Context, fcmToken string, dataIDs [][]byte, expiresAt time.Time) error {
+	return s.shard(fcmToken).RecordRecentSends(ctx, fcmToken, dataIDs, expiresAt)
+}
+
+// FilterRecentSends filters data IDs against fcmToken's shard.
+func (s *ShardedStore) FilterRecentSends(ctx context.Context, fcmToken string, dataIDs [][]byte) ([][]byte, error) {
+	return s.shard(fcmToken).FilterRecentSends(ctx, fcmToken, dataIDs)
+}
+
+// CleanupExpiredRecentSends expires recent sends in every shard.
+func (s *ShardedStore) CleanupExpiredRecentSends(ctx context.Context) (int64, error) {
+	return s.sum(ctx, Store.CleanupExpiredRecentSends)
+}
+
+// LoadFailedSince returns the failed deliveries of all shards, oldest first.
+func (s *ShardedStore) LoadFailedSince(ctx context.Context, since time.Time) ([]FailedDelivery, error) {
+	var all []FailedDelivery
+	for _, shard := range s.shards {
+		failed, err := shard.LoadFailedSince(ctx, since)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, failed...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].FailedAt.Before(all[j].FailedAt)
+	})
+	return all, nil
+}
+
+// MarkRequeued marks fd requeued in its token's shard.
+func (s *ShardedStore) MarkRequeued(ctx context.Context, fd FailedDelivery) (bool, error) {
+	return s.shard(fd.FcmToken).MarkRequeued(ctx, fd)
+}
+
+// RecordInvalidToken records fcmToken as invalid in its shard.
+func (s *ShardedStore) RecordInvalidToken(ctx context.Context, fcmToken string) error {
+	return s.shard(fcmToken).RecordInvalidToken(ctx, fcmToken)
+}
+
+// IsInvalidToken checks fcmToken's shard.
+func (s *ShardedStore) IsInvalidToken(ctx context.Context, fcmToken string) (bool, error) {
+	return s.shard(fcmToken).IsInvalidToken(ctx, fcmToken)
+}
+
+// GrantReply records the grant in the first shard.
+func (s *ShardedStore) GrantReply(ctx context.Context, recipient, sender string, expiresAt time.Time) error {
+	return s.shards[0].GrantReply(ctx, recipient, sender, expiresAt)
+}
+
+// HasReplyGrant checks the first shard.
+func (s *ShardedStore) HasReplyGrant(ctx context.Context, recipient, sender string) (bool, error) {
+	return s.shards[0].HasReplyGrant(ctx, recipient, sender)
+}
+
+// CleanupExpiredReplyGrants expires grants in the first shard.
+func (s *ShardedStore) CleanupExpiredReplyGrants(ctx context.Context) (int64, error) {
+	return s.shards[0].CleanupExpiredReplyGrants(ctx)
+}
+
+// RecordBroadcast records b in the first shard.
+func (s *ShardedStore) RecordBroadcast(ctx context.Context, b Broadcast) error {
+	return s.shards[0].RecordBroadcast(ctx, b)
+}
+
+// ListBroadcasts lists broadcasts from the first shard.
+func (s *ShardedStore) ListBroadcasts(ctx context.Context, limit int) ([]Broadcast, error) {
+	return s.shards[0].ListBroadcasts(ctx, limit)
+}
+
+// AddFCMUsage counts sends in the first shard.
+func (s *ShardedStore) AddFCMUsage(ctx context.Context, projectID string, hour time.Time, sends int64) error {
+	return s.shards[0].AddFCMUsage(ctx, projectID, hour, sends)
+}
+
+// ListFCMUsage lists send counts from the first shard.
+func (s *ShardedStore) ListFCMUsage(ctx context.Context, since time.Time) ([]FCMUsage, error) {
+	return s.shards[0].ListFCMUsage(ctx, since)
+}
+
+// GetDeviceGroup reads username's device group from the first shard.
+func (s *ShardedStore) GetDeviceGroup(ctx context.Context, username string) (*DeviceGroup, error) {
+	return s.shards[0].GetDeviceGroup(ctx, username)
+}
+
+// SaveDeviceGroup saves username's device group in the first shard.
+func (s *ShardedStore) SaveDeviceGroup(ctx context.Context, username string, group DeviceGroup) error {
+	return s.shards[0].SaveDeviceGroup(ctx, username, group)
+}
+
+// SaveMirrored stores the mirrored notifications in the first shard.
+func (s *ShardedStore) SaveMirrored(ctx context.Context, notifications []MirroredNotification) error {
+	return s.shards[0].SaveMirrored(ctx, notifications)
+}
+
+// DeleteMirrored deletes mirrored notifications from the first shard.
+func (s *ShardedStore) DeleteMirrored(ctx context.Context, requestIDs []string) (int64, error) {
+	return s.shards[0].DeleteMirrored(ctx, requestIDs)
+}
+
+// LoadMirrored loads mirrored notifications from the first shard.
+func (s *ShardedStore) LoadMirrored(ctx context.Context, limit int) ([]MirroredNotification, error) {
+	return s.shards[0].LoadMirrored(ctx, limit)
+}
+
+// MarkTakenOver records the takeovers in the first shard.
+func (s *ShardedStore) MarkTakenOver(ctx context.Context, requestIDs []string, at time.Time) error {
+	return s.shards[0].MarkTakenOver(ctx, requestIDs, at)
+}
+
+// ListTakeovers lists takeovers from the first shard.
+func (s *ShardedStore) ListTakeovers(ctx context.Context) ([]string, error) {
+	return s.shards[0].ListTakeovers(ctx)
+}
+
+// DeleteTakeovers deletes takeovers from the first shard.
+func (s *ShardedStore) DeleteTakeovers(ctx context.Context, requestIDs []string) error {
+	return s.shards[0].DeleteTakeovers(ctx, requestIDs)
+}
+
+// CleanupExpiredMirrored expires mirrored notifications in the first shard.
+func (s *ShardedStore) CleanupExpiredMirrored(ctx context.Context, before time.Time) (int64, error) {
+	return s.shards[0].CleanupExpiredMirrored(ctx, before)
+}
+
+// Reopener is a Store that can replace its database connection without
+// closing, such as *SQLiteStore.
+type Reopener interface {
+	Reopen(ctx context.Context) error
+}
+
+// Reopen reopens every shard in turn, stopping at the first error. Shards
+// that aren't Reopeners are left as they are.
+func (s *ShardedStore) Reopen(ctx context.Context) error {
+	for i, shard := range s.shards {
+		r, ok := shard.(Reopener)
+		if !ok {
+			continue
+		}
+		if err := r.Reopen(ctx); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Close closes every shard, returning the first error.
+func (s *ShardedStore) Close() error {
+	var err error
+	for _, shard := range s.shards {
+		if closeErr := shard.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// sum runs op on every shard and adds up the counts.
+func (s *ShardedStore) sum(ctx context.Context, op func(Store, context.Context) (int64, error)) (int64, error) {
+	var total int64
+	for _, shard := range s.shards {
+		n, err := op(shard, ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// AddCounters adds to the counters in the first shard.
+func (s *ShardedStore) AddCounters(ctx context.Context, deltas map[string]int64, at time.Time) error {
+	return s.shards[0].AddCounters(ctx, deltas, at)
+}
+
+// ListCounters lists the counters in the first shard.
+func (s *ShardedStore) ListCounters(ctx context.Context) ([]Counter, error) {
+	return s.shards[0].ListCounters(ctx)
+}
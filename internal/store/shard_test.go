@@ -0,0 +1,216 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestShardedStore(t *testing.T, n int) (*ShardedStore, []*SQLiteStore) {
+	t.Helper()
+
+	dir := t.TempDir()
+	shards := make([]Store, n)
+	sqlite := make([]*SQLiteStore, n)
+	for i, path := range ShardPaths(filepath.Join(dir, "store.db"), n) {
+		s, err := New(Config{Path: path})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		shards[i], sqlite[i] = s, s
+	}
+	return NewShardedStore(shards), sqlite
+}
+
+// tokensByShard returns a token hashing to each shard.
+func tokensByShard(t *testing.T, s *ShardedStore) []string {
+	t.Helper()
+
+	tokens := make([]string, len(s.shards))
+	found := 0
+	for i := 0; found < len(tokens); i++ {
+		if i > 10000 {
+			t.Fatal("no token found for every shard")
+		}
+		token := fmt.Sprintf("token%d", i)
+		if idx := s.index(token); tokens[idx] == "" {
+			tokens[idx] = token
+			found++
+		}
+	}
+	return tokens
+}
+
+func TestShardedStore_RoutesByToken(t *testing.T) {
+	s, shards := newTestShardedStore(t, 3)
+	defer s.Close()
+	ctx := context.Background()
+	tokens := tokensByShard(t, s)
+
+	for i, token := range tokens {
+		id := fmt.Sprintf("req-%d", i)
+		if err := s.SaveBatch(ctx, token, testBatch("bob@oc", id)); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+		status := Status{State: StatusHeldDND, ExpiresAt: time.Now().Add(time.Hour)}
+		if err := s.SetStatus(ctx, token, []string{id}, status); err != nil {
+			t.Fatalf("SetStatus() error = %v", err)
+		}
+	}
+
+	for i, token := range tokens {
+		id := fmt.Sprintf("req-%d", i)
+		for j, shard := range shards {
+			batches, err := shard.LoadOldestBatches(ctx, 10)
+			if err != nil {
+				t.Fatalf("LoadOldestBatches() error = %v", err)
+			}
+			_, err = shard.GetStatus(ctx, id)
+			if want := i == j; (batches[token] != nil) != want || (err == nil) != want {
+				t.Errorf("shard %d holds %s's batch = %v, status = %v; want both %v", j, token, batches[token] != nil, err == nil, want)
+			}
+		}
+
+		status, err := s.GetStatus(ctx, id)
+		if err != nil || status.State != StatusHeldDND {
+			t.Errorf("GetStatus(%q) = %+v, %v, want %s", id, status, err, StatusHeldDND)
+		}
+		pending, err := s.FindPendingRequest(ctx, id)
+		if err != nil || pending == nil || pending.FcmToken != token {
+			t.Errorf("FindPendingRequest(%q) = %+v, %v, want %s", id, pending, err, token)
+		}
+	}
+
+	// Reservations are refused for IDs any shard tracks
+	if err := s.ReserveRequestID(ctx, "req-1", time.Now()); !errors.Is(err, ErrRequestIDTaken) {
+		t.Errorf("ReserveRequestID(req-1) error = %v, want %v", err, ErrRequestIDTaken)
+	}
+	if err := s.ReserveRequestID(ctx, "req-new", time.Now()); err != nil {
+		t.Errorf("ReserveRequestID(req-new) error = %v", err)
+	}
+}
+
+func TestShardedStore_MergesInOrder(t *testing.T) {
+	s, _ := newTestShardedStore(t, 3)
+	defer s.Close()
+	ctx := context.Background()
+	tokens := tokensByShard(t, s)
+	base := time.Now().Truncate(time.Second)
+
+	// Flush times interleave across shards
+	flushAt := map[string]time.Time{
+		tokens[2]: base.Add(1 * time.Second),
+		tokens[0]: base.Add(2 * time.Second),
+		tokens[1]: base.Add(3 * time.Second),
+	}
+	for token, at := range flushAt {
+		batch := testBatch("bob@oc", "req-"+token)
+		batch.FlushAt = at
+		if err := s.SaveBatch(ctx, token, batch); err != nil {
+			t.Fatalf("SaveBatch() error = %v", err)
+		}
+	}
+	oldest, err := s.LoadOldestBatches(ctx, 2)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	if len(oldest) != 2 || oldest[tokens[2]] == nil || oldest[tokens[0]] == nil {
+		t.Errorf("LoadOldestBatches(2) = %v, want the batches of %s and %s", keys(oldest), tokens[2], tokens[0])
+	}
+
+	// Imported statuses land in the shard their ID hashes to, and are
+	// listed in update order whichever shard holds them
+	var records []StatusRecord
+	for i, id := range []string{"c", "a", "e", "b", "d"} {
+		records = append(records, StatusRecord{
+			RequestID: id,
+			UpdatedAt: base.Add(time.Duration(i) * time.Second),
+			Status:    Status{State: StatusSent, ExpiresAt: base.Add(time.Hour)},
+		})
+	}
+	if err := s.ImportStatuses(ctx, records); err != nil {
+		t.Fatalf("ImportStatuses() error = %v", err)
+	}
+	listed, err := s.ListStatusesSince(ctx, base, StatusCursor{}, 3)
+	if err != nil {
+		t.Fatalf("ListStatusesSince() error = %v", err)
+	}
+	var got []string
+	for _, rec := range listed {
+		got = append(got, rec.RequestID)
+	}
+	if strings.Join(got, ",") != "c,a,e" {
+		t.Errorf("ListStatusesSince() = %v, want [c a e]", got)
+	}
+
+	next, err := s.ListStatusesSince(ctx, base, StatusCursor{UpdatedAt: listed[2].UpdatedAt, RequestID: listed[2].RequestID}, 3)
+	if err != nil {
+		t.Fatalf("ListStatusesSince() error = %v", err)
+	}
+	got = got[:0]
+	for _, rec := range next {
+		got = append(got, rec.RequestID)
+	}
+	if strings.Join(got, ",") != "b,d" {
+		t.Errorf("ListStatusesSince() after cursor = %v, want [b d]", got)
+	}
+}
+
+func keys(batches map[string]*Batch) []string {
+	var tokens []string
+	for token := range batches {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func TestCheckShards(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "store.db")
+
+	open := func(n int) *ShardedStore {
+		shards := make([]Store, n)
+		for i, p := range ShardPaths(path, n) {
+			st, err := New(Config{Path: p})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			shards[i] = st
+		}
+		return NewShardedStore(shards)
+	}
+
+	// Fresh files for any count
+	if err := CheckShards(ctx, path, 2); err != nil {
+		t.Fatalf("CheckShards() with no files error = %v", err)
+	}
+
+	s := open(2)
+	if err := s.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	s.Close()
+
+	if err := CheckShards(ctx, path, 2); err != nil {
+		t.Errorf("CheckShards() with the same count error = %v", err)
+	}
+	for _, n := range []int{1, 4} {
+		if err := CheckShards(ctx, path, n); err == nil {
+			t.Errorf("CheckShards(%d) = nil, want an error for batches in the 2-shard files", n)
+		}
+	}
+
+	// Drained files no longer block a change
+	s = open(2)
+	if err := s.DeleteBatchAndSetStatus(ctx, "token1", Status{State: StatusSent, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("DeleteBatchAndSetStatus() error = %v", err)
+	}
+	s.Close()
+	if err := CheckShards(ctx, path, 4); err != nil {
+		t.Errorf("CheckShards(4) after draining error = %v", err)
+	}
+}
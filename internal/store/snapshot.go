@@ -0,0 +1,169 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format WriteSnapshot
+// writes. ReadSnapshot reads it and older versions.
+const SnapshotVersion = 1
+
+// snapshotPageSize is how many statuses a snapshot reads or imports at a
+// time.
+const snapshotPageSize = 500
+
+// ErrInvalidSnapshot is returned by ReadSnapshot for input that isn't a
+// complete snapshot.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// SnapshotCounts is how many batches and statuses a snapshot holds.
+type SnapshotCounts struct {
+	Batches  int `json:"batches"`
+	Statuses int `json:"statuses"`
+}
+
+// snapshotLine is one line of a snapshot. The first line holds the version
+// and creation time, the last line the counts; each line between holds a
+// batch or a status.
+type snapshotLine struct {
+	Version   int             `json:"version,omitempty"`
+	CreatedAt *time.Time      `json:"created_at,omitempty"`
+	FcmToken  string          `json:"fcm_token,omitempty"`
+	Batch     *Batch          `json:"batch,omitempty"`
+	Status    *StatusRecord   `json:"status,omitempty"`
+	End       *SnapshotCounts `json:"end,omitempty"`
+}
+
+// SnapshotImporter receives the batches and statuses ReadSnapshot reads.
+type SnapshotImporter interface {
+	ImportBatch(ctx context.Context, fcmToken string, batch *Batch) error
+	ImportStatuses(ctx context.Context, records []StatusRecord) error
+}
+
+// WriteSnapshot writes s's pending batches and statuses to w, as
+// newline-delimited JSON, for ReadSnapshot to load into another store.
+// Batches come first, so statuses imported after them land in the same
+// shard. Changes made while it runs may or may not be included.
+func WriteSnapshot(ctx context.Context, s Store, w io.Writer) (SnapshotCounts, error) {
+	var counts SnapshotCounts
+	enc := json.NewEncoder(w)
+
+	now := time.Now().UTC()
+	if err := enc.Encode(&snapshotLine{Version: SnapshotVersion, CreatedAt: &now}); err != nil {
+		return counts, err
+	}
+
+	batches, err := s.LoadOldestBatches(ctx, math.MaxInt32)
+	if err != nil {
+		return counts, fmt.Errorf("loading batches: %w", err)
+	}
+	for fcmToken, batch := range batches {
+		if err := enc.Encode(&snapshotLine{FcmToken: fcmToken, Batch: batch}); err != nil {
+			return counts, err
+		}
+		counts.Batches++
+	}
+
+	var after StatusCursor
+	for {
+		records, err := s.ListStatusesSince(ctx, time.Unix(0, 0), after, snapshotPageSize)
+		if err != nil {
+			return counts, fmt.Errorf("loading statuses: %w", err)
+		}
+		for i := range records {
+			if err := enc.Encode(&snapshotLine{Status: &records[i]}); err != nil {
+				return counts, err
+			}
+			counts.Statuses++
+		}
+		if len(records) < snapshotPageSize {
+			break
+		}
+		last := records[len(records)-1]
+		after = StatusCursor{UpdatedAt: last.UpdatedAt, RequestID: last.RequestID}
+	}
+
+	return counts, enc.Encode(&snapshotLine{End: &counts})
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot from r into imp and
+// returns what it imported. Lines are imported as they are read, so a
+// truncated snapshot is partly imported before the error is reported.
+// Importing is idempotent: reading the complete snapshot again finishes the
+// job without duplicating anything.
+func ReadSnapshot(ctx context.Context, r io.Reader, imp SnapshotImporter) (SnapshotCounts, error) {
+	var counts SnapshotCounts
+	dec := json.NewDecoder(r)
+
+	var header snapshotLine
+	if err := dec.Decode(&header); err != nil {
+		return counts, fmt.Errorf("%w: reading header: %v", ErrInvalidSnapshot, err)
+	}
+	if header.Version == 0 || header.CreatedAt == nil {
+		return counts, fmt.Errorf("%w: missing header", ErrInvalidSnapshot)
+	}
+	if header.Version > SnapshotVersion {
+		return counts, fmt.Errorf("%w: version %d is newer than this build's %d", ErrInvalidSnapshot, header.Version, SnapshotVersion)
+	}
+
+	var statuses []StatusRecord
+	importStatuses := func() error {
+		if len(statuses) == 0 {
+			return nil
+		}
+		if err := imp.ImportStatuses(ctx, statuses); err != nil {
+			return fmt.Errorf("importing statuses: %w", err)
+		}
+		counts.Statuses += len(statuses)
+		statuses = statuses[:0]
+		return nil
+	}
+
+	for {
+		var line snapshotLine
+		if err := dec.Decode(&line); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("snapshot ends before its last line")
+			}
+			return counts, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+
+		switch {
+		case line.Batch != nil:
+			if line.FcmToken == "" {
+				return counts, fmt.Errorf("%w: batch without an FCM token", ErrInvalidSnapshot)
+			}
+			if err := imp.ImportBatch(ctx, line.FcmToken, line.Batch); err != nil {
+				return counts, fmt.Errorf("importing batch for %s: %w", line.FcmToken, err)
+			}
+			counts.Batches++
+		case line.Status != nil:
+			if line.Status.RequestID == "" {
+				return counts, fmt.Errorf("%w: status without a request ID", ErrInvalidSnapshot)
+			}
+			statuses = append(statuses, *line.Status)
+			if len(statuses) == snapshotPageSize {
+				if err := importStatuses(); err != nil {
+					return counts, err
+				}
+			}
+		case line.End != nil:
+			if err := importStatuses(); err != nil {
+				return counts, err
+			}
+			if *line.End != counts {
+				return counts, fmt.Errorf("%w: read %d batches and %d statuses, snapshot has %d and %d",
+					ErrInvalidSnapshot, counts.Batches, counts.Statuses, line.End.Batches, line.End.Statuses)
+			}
+			return counts, nil
+		default:
+			return counts, fmt.Errorf("%w: line without a batch or status", ErrInvalidSnapshot)
+		}
+	}
+}
@@ -4,7 +4,9 @@ package store
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,49 +18,314 @@ import (
 
 // Status states for delivery tracking.
 const (
-	StatusQueued = "queued"
-	StatusSent   = "sent"
-	StatusFailed = "failed"
+	StatusQueued   = "queued"
+	StatusSent     = "sent"
+	StatusFailed   = "failed"
+	StatusExpired  = "expired"   // deadline passed before the batch flushed
+	StatusTimedOut = "timed_out" // last flush attempt timed out; retry scheduled
+	StatusLost     = "lost"      // pending with no batch left to deliver it
+
+	StatusFailedPermanent = "failed_permanent" // flushes kept failing; batch moved to dead letters
+	StatusCancelled       = "cancelled"        // withdrawn by the sender before its batch flushed
+
+	StatusSkippedInvalidToken = "skipped_invalid_token" // recovered for a token FCM reported unregistered
+
+	StatusHeldDND    = "held_dnd"    // recipient has Do-Not-Disturb enabled; delivery waits for it to end
+	StatusDroppedDND = "dropped_dnd" // dropped because the recipient had Do-Not-Disturb enabled
+
+	StatusRecipientGone = "recipient_gone" // recipient account or endpoint removed before the batch flushed
+
+	StatusExpiredUnclaimed = "expired_unclaimed" // batch purged after outliving batch.max_retention undelivered
+
+	StatusScheduled = "scheduled" // held until its deliver_after time, then queued
+
+	StatusTakenOver = "taken_over" // delivered by the standby gateway while this one was down
 )
 
 // QueuedNotification represents a single push notification queued for delivery.
 // This mirrors the proto definition until it's generated.
 type QueuedNotification struct {
-	DataIDs   [][]byte // Content IDs to cache (32 bytes each)
-	RequestID string   // Gateway-generated ID for status tracking
+	DataIDs   [][]byte          // Content IDs to cache (32 bytes each)
+	RequestID string            // Gateway-generated ID for status tracking
+	Deadline  time.Time         // Drop instead of sending after this time; zero means no deadline
+	Sender    string            // Requesting username, for delivery analytics; may be empty
+	Data      map[string]string // Extra FCM data payload, e.g. passthrough PushRequest fields
+	TraceID   string            // ID of the HTTP request that queued it, for correlating log lines; may be empty
+
+	// EndpointsDigest identifies the recipient's endpoint list the push was
+	// queued from, to notice endpoints removed since; may be empty
+	EndpointsDigest string
+
+	// EndpointOptions are the target endpoint's delivery settings, such as
+	// its notification channel, as listed when the request was queued
+	EndpointOptions map[string]string
+
+	// Context recorded with the status, for investigating deliveries; may be empty
+	Target   string    // Username the push was addressed to
+	DeviceID string    // Target's device owning the endpoint
+	QueuedAt time.Time // When the request was first queued
+
+	// Owner names the gateway that saved it to a batch shared with other
+	// gateways; empty otherwise. See Batch.Owner.
+	Owner string
 }
 
 // Batch represents queued notifications for a single endpoint.
 type Batch struct {
+	Recipient     string // username owning the endpoint; empty if unknown
 	Notifications []QueuedNotification
 	CreatedAt     time.Time
 	FlushAt       time.Time
+	Attempts      int // flush attempts that failed and were retried
+
+	// Owner, when set, names the gateway saving the batch to a database it
+	// shares with others. SaveBatch then replaces only the notifications
+	// saved by Owner before, keeping the ones other gateways queued for the
+	// same token.
+	Owner string
+}
+
+// Merge adds the notifications from other that b lacks, by request ID, ahead
+// of b's own, as other's were queued first. b takes other's recipient if it
+// has none, and the earlier of their creation and flush times. Returns the
+// number of notifications added; if none, b is unchanged.
+func (b *Batch) Merge(other *Batch) int {
+	held := make(map[string]bool, len(b.Notifications))
+	for _, notif := range b.Notifications {
+		held[notif.RequestID] = true
+	}
+	var missing []QueuedNotification
+	for _, notif := range other.Notifications {
+		if !held[notif.RequestID] {
+			missing = append(missing, notif)
+		}
+	}
+	if len(missing) == 0 {
+		return 0
+	}
+
+	b.Notifications = append(missing, b.Notifications...)
+	if b.Recipient == "" {
+		b.Recipient = other.Recipient
+	}
+	if other.CreatedAt.Before(b.CreatedAt) {
+		b.CreatedAt = other.CreatedAt
+	}
+	if other.FlushAt.Before(b.FlushAt) {
+		b.FlushAt = other.FlushAt
+	}
+	return len(missing)
+}
+
+// PendingRequest locates a notification in a pending batch.
+type PendingRequest struct {
+	FcmToken     string
+	Index        int // position in the batch's notifications
+	Notification QueuedNotification
 }
 
 // Status represents the delivery status of a request.
 type Status struct {
 	State     string
 	SentAt    *time.Time
+	MessageID string // FCM message ID, set when sent
 	Error     string
+	ErrorCode string // FCM error code such as UNREGISTERED, set when FCM rejected the send
 	ExpiresAt time.Time
+
+	// Request context, as recorded by GetStatus; empty if unknown
+	Sender   string
+	Target   string
+	DeviceID string
+	QueuedAt time.Time
+}
+
+// StatusRecord is a request's delivery status as exported, with its request
+// ID and when it last changed.
+type StatusRecord struct {
+	RequestID string
+	UpdatedAt time.Time
+	Status
+}
+
+// StatusCursor is the position of a StatusRecord in update order. The zero
+// cursor comes before every record.
+type StatusCursor struct {
+	UpdatedAt time.Time
+	RequestID string
+}
+
+// DailySummary counts requests from one sender that ended in one state on one
+// day. Statuses are rolled up into summaries before they expire.
+type DailySummary struct {
+	Day    string // UTC date, "2006-01-02"
+	Sender string // requesting username; empty if unknown
+	State  string
+	Count  int64
+}
+
+// FailedDelivery is a retained copy of a notification whose delivery failed,
+// kept so it can be requeued without client resubmission.
+type FailedDelivery struct {
+	RequestID string
+	FcmToken  string
+	DataIDs   [][]byte
+	FailedAt  time.Time
+}
+
+// DeviceGroup is the FCM device group holding a user's endpoints.
+type DeviceGroup struct {
+	NotificationKey string
+	Members         []string // FCM tokens in the group
+	UpdatedAt       time.Time
+}
+
+// Broadcast is an audit record of an operator broadcast to an FCM topic.
+type Broadcast struct {
+	ID          int64
+	Topic       string
+	DataIDCount int
+	Title       string // visible title, if any
+	Actor       string // who sent it, as reported by the admin client
+	MessageID   string // FCM message ID; empty if the send failed
+	Error       string
+	SentAt      time.Time
+}
+
+// Receipt records that FCM accepted a batch, written before the batch is
+// deleted, so a batch left behind by a crash or a failed delete isn't sent
+// again on recovery.
+type Receipt struct {
+	BatchHash string // identifies the batch's notifications
+	MessageID string
+	SentAt    time.Time
+}
+
+// ScheduledNotification is a notification held until DeliverAt, when it
+// joins its endpoint's batch.
+type ScheduledNotification struct {
+	FcmToken     string
+	Recipient    string // username owning the endpoint
+	Notification QueuedNotification
+	DeliverAt    time.Time
+	// Window and MaxBatchSize are the queue options it was pushed with, to
+	// apply when it is queued; zero for the defaults.
+	Window       time.Duration
+	MaxBatchSize int
+}
+
+// MirroredNotification is a notification another gateway accepted and
+// mirrored here, held for this gateway to deliver if that one goes down.
+type MirroredNotification struct {
+	FcmToken     string
+	Recipient    string // username owning the endpoint
+	Notification QueuedNotification
+	ReceivedAt   time.Time
+}
+
+// FCMUsage counts the messages sent through one Firebase project in one hour.
+type FCMUsage struct {
+	ProjectID string
+	Hour      time.Time // start of the hour, UTC
+	Sends     int64
+}
+
+// Counter is a running total kept across restarts, such as pushes accepted.
+type Counter struct {
+	Name      string
+	Value     int64
+	CreatedAt time.Time // when the counter was first written
+	UpdatedAt time.Time
 }
 
+// ErrRequestNotFound is returned by GetStatus for request IDs without a status.
+var ErrRequestNotFound = errors.New("request not found")
+
+// ErrRequestIDTaken is returned by ReserveRequestID for a request ID that
+// is already in use.
+var ErrRequestIDTaken = errors.New("request ID already in use")
+
+// reservationTTL is how long a reserved request ID is kept without a batch
+// taking it over. Reservations for scheduled pushes are replaced by their
+// status sooner.
+const reservationTTL = time.Hour
+
 // Store defines the interface for persistence operations.
 type Store interface {
 	SaveBatch(ctx context.Context, fcmToken string, batch *Batch) error
 	LoadOldestBatches(ctx context.Context, limit int) (map[string]*Batch, error)
 	DeleteBatchAndSetStatus(ctx context.Context, fcmToken string, status Status) error
+	DeleteNotificationsAndSetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error
+	ListBatchesByRecipient(ctx context.Context, recipient string) (map[string]*Batch, error)
+
+	ClaimBatch(ctx context.Context, fcmToken, owner string, ttl time.Duration) (bool, error)
+	ReleaseBatch(ctx context.Context, fcmToken, owner string) error
+	CleanupExpiredBatchLeases(ctx context.Context) (int64, error)
+
+	RecordReceipt(ctx context.Context, fcmToken string, receipt Receipt) error
+	GetReceipt(ctx context.Context, fcmToken, batchHash string) (*Receipt, error)
 
+	SaveScheduled(ctx context.Context, n ScheduledNotification, status Status) error
+	LoadDueScheduled(ctx context.Context, now time.Time, limit int) ([]ScheduledNotification, error)
+	GetScheduled(ctx context.Context, requestID string) (*ScheduledNotification, error)
+	DeleteScheduledAndSetStatus(ctx context.Context, requestID string, status Status) (bool, error)
+
+	SetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error
 	GetStatus(ctx context.Context, requestID string) (Status, error)
+	ListStatusesSince(ctx context.Context, since time.Time, after StatusCursor, limit int) ([]StatusRecord, error)
+	ImportStatuses(ctx context.Context, records []StatusRecord) error
+	HasRequestID(ctx context.Context, requestID string) (bool, error)
+	ReserveRequestID(ctx context.Context, requestID string, at time.Time) error
+	FindPendingRequest(ctx context.Context, requestID string) (*PendingRequest, error)
 	CleanupExpiredStatus(ctx context.Context) (int64, error)
+	CleanupExpiredStatusByState(ctx context.Context) (map[string]int64, error)
+	ListDailySummaries(ctx context.Context, since time.Time, sender string) ([]DailySummary, error)
+	MarkLost(ctx context.Context, olderThan, expiresAt time.Time) (int64, error)
+
+	RecordRecentSends(ctx context.Context, fcmToken string, dataIDs [][]byte, expiresAt time.Time) error
+	FilterRecentSends(ctx context.Context, fcmToken string, dataIDs [][]byte) ([][]byte, error)
+	CleanupExpiredRecentSends(ctx context.Context) (int64, error)
+
+	LoadFailedSince(ctx context.Context, since time.Time) ([]FailedDelivery, error)
+	MarkRequeued(ctx context.Context, fd FailedDelivery) (bool, error)
+
+	RecordInvalidToken(ctx context.Context, fcmToken string) error
+	IsInvalidToken(ctx context.Context, fcmToken string) (bool, error)
+
+	GrantReply(ctx context.Context, recipient, sender string, expiresAt time.Time) error
+	HasReplyGrant(ctx context.Context, recipient, sender string) (bool, error)
+	CleanupExpiredReplyGrants(ctx context.Context) (int64, error)
+
+	RecordBroadcast(ctx context.Context, b Broadcast) error
+	ListBroadcasts(ctx context.Context, limit int) ([]Broadcast, error)
+
+	AddFCMUsage(ctx context.Context, projectID string, hour time.Time, sends int64) error
+	ListFCMUsage(ctx context.Context, since time.Time) ([]FCMUsage, error)
+
+	GetDeviceGroup(ctx context.Context, username string) (*DeviceGroup, error)
+	SaveDeviceGroup(ctx context.Context, username string, group DeviceGroup) error
+
+	SaveMirrored(ctx context.Context, notifications []MirroredNotification) error
+	DeleteMirrored(ctx context.Context, requestIDs []string) (int64, error)
+	LoadMirrored(ctx context.Context, limit int) ([]MirroredNotification, error)
+	MarkTakenOver(ctx context.Context, requestIDs []string, at time.Time) error
+	ListTakeovers(ctx context.Context) ([]string, error)
+	DeleteTakeovers(ctx context.Context, requestIDs []string) error
+	CleanupExpiredMirrored(ctx context.Context, before time.Time) (int64, error)
+
+	AddCounters(ctx context.Context, deltas map[string]int64, at time.Time) error
+	ListCounters(ctx context.Context) ([]Counter, error)
 
 	Close() error
 }
 
 // SQLiteStore implements Store using SQLite.
 type SQLiteStore struct {
-	db *sql.DB
-	mu sync.Mutex // serializes writes
+	db   *sql.DB
+	mu   sync.Mutex // serializes writes
+	path string
+
+	metrics storeMetrics
 }
 
 // Config holds SQLite store configuration.
@@ -81,13 +348,23 @@ func New(cfg Config) (*SQLiteStore, error) {
 	db.SetMaxOpenConns(1)
 	db.SetMaxIdleConns(1)
 
-	store := &SQLiteStore{db: db}
+	store := &SQLiteStore{
+		db:   db,
+		path: cfg.Path,
+		metrics: storeMetrics{
+			latency: make(map[string]*histogram),
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		},
+	}
 
 	if err := store.migrate(context.Background()); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("running migrations: %w", err)
 	}
 
+	go store.sampleSizes()
+
 	return store, nil
 }
 
@@ -106,6 +383,132 @@ func (s *SQLiteStore) migrate(ctx context.Context) error {
 		}
 	}
 
+	if version < 2 {
+		if err := s.migrateV2(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 3 {
+		if err := s.migrateV3(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 4 {
+		if err := s.migrateV4(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 5 {
+		if err := s.migrateV5(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 6 {
+		if err := s.migrateV6(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 7 {
+		if err := s.migrateV7(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 8 {
+		if err := s.migrateV8(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 9 {
+		if err := s.migrateV9(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 10 {
+		if err := s.migrateV10(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 11 {
+		if err := s.migrateV11(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 12 {
+		if err := s.migrateV12(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 13 {
+		if err := s.migrateV13(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 14 {
+		if err := s.migrateV14(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 15 {
+		if err := s.migrateV15(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 16 {
+		if err := s.migrateV16(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 17 {
+		if err := s.migrateV17(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 18 {
+		if err := s.migrateV18(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 19 {
+		if err := s.migrateV19(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 20 {
+		if err := s.migrateV20(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 21 {
+		if err := s.migrateV21(ctx); err != nil {
+			return err
+		}
+	}
+
+	if version < 22 {
+		if err := s.migrateV22(ctx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -147,176 +550,2208 @@ func (s *SQLiteStore) migrateV1(ctx context.Context) error {
 	return tx.Commit()
 }
 
-// SaveBatch persists a batch for the given FCM token.
-func (s *SQLiteStore) SaveBatch(ctx context.Context, fcmToken string, batch *Batch) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	notifData, err := serializeNotifications(batch.Notifications)
+// migrateV2 adds the recent_sends table used for duplicate suppression.
+func (s *SQLiteStore) migrateV2(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("serializing notifications: %w", err)
+		return err
 	}
+	defer tx.Rollback()
 
-	_, err = s.db.ExecContext(ctx, `
-		INSERT OR REPLACE INTO batches (fcm_token, notifications, created_at, flush_at)
-		VALUES (?, ?, ?, ?)
-	`, fcmToken, notifData, batch.CreatedAt.Unix(), batch.FlushAt.Unix())
-
-	return err
-}
-
-// LoadOldestBatches loads the oldest batches ordered by flush_at.
-// Returns fewer than limit entries when no more batches exist.
-func (s *SQLiteStore) LoadOldestBatches(ctx context.Context, limit int) (map[string]*Batch, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT fcm_token, notifications, created_at, flush_at
-		FROM batches
-		ORDER BY flush_at ASC
-		LIMIT ?
-	`, limit)
-	if err != nil {
-		return nil, err
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS recent_sends (
+			fcm_token TEXT NOT NULL,
+			data_id BLOB NOT NULL,
+			expires_at INTEGER NOT NULL,
+			PRIMARY KEY (fcm_token, data_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_recent_sends_expires ON recent_sends(expires_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (2)`,
 	}
-	defer rows.Close()
-
-	batches := make(map[string]*Batch)
-	for rows.Next() {
-		var (
-			fcmToken  string
-			notifData []byte
-			createdAt int64
-			flushAt   int64
-		)
-
-		if err := rows.Scan(&fcmToken, &notifData, &createdAt, &flushAt); err != nil {
-			return nil, err
-		}
-
-		notifications, err := deserializeNotifications(notifData)
-		if err != nil {
-			return nil, fmt.Errorf("deserializing notifications for token %s: %w", fcmToken, err)
-		}
 
-		batches[fcmToken] = &Batch{
-			Notifications: notifications,
-			CreatedAt:     time.Unix(createdAt, 0),
-			FlushAt:       time.Unix(flushAt, 0),
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
 		}
 	}
 
-	return batches, rows.Err()
+	return tx.Commit()
 }
 
-// DeleteBatchAndSetStatus atomically deletes a batch and sets status for all its request IDs.
-func (s *SQLiteStore) DeleteBatchAndSetStatus(ctx context.Context, fcmToken string, status Status) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+// migrateV3 adds the failed_deliveries table retaining data IDs of failed sends.
+func (s *SQLiteStore) migrateV3(ctx context.Context) error {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	// Get notifications from the batch to extract request IDs
-	var notifData []byte
-	err = tx.QueryRowContext(ctx, `
-		SELECT notifications FROM batches WHERE fcm_token = ?
-	`, fcmToken).Scan(&notifData)
-	if err == sql.ErrNoRows {
-		return nil // No batch exists, nothing to do
-	}
-	if err != nil {
-		return err
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS failed_deliveries (
+			request_id TEXT PRIMARY KEY,
+			fcm_token TEXT NOT NULL,
+			data_ids BLOB NOT NULL,
+			failed_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_failed_deliveries_failed_at ON failed_deliveries(failed_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (3)`,
 	}
 
-	notifications, err := deserializeNotifications(notifData)
-	if err != nil {
-		return fmt.Errorf("deserializing notifications: %w", err)
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
 	}
 
-	// Delete the batch
-	_, err = tx.ExecContext(ctx, `DELETE FROM batches WHERE fcm_token = ?`, fcmToken)
+	return tx.Commit()
+}
+
+// migrateV4 records the recipient username on batches, indexed for per-user lookups.
+func (s *SQLiteStore) migrateV4(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Set status for all request IDs
-	var sentAt *int64
-	if status.SentAt != nil {
-		t := status.SentAt.Unix()
-		sentAt = &t
-	}
-
-	stmt, err := tx.PrepareContext(ctx, `
-		INSERT OR REPLACE INTO status (request_id, state, sent_at, error, expires_at)
-		VALUES (?, ?, ?, ?, ?)
-	`)
-	if err != nil {
-		return err
+	statements := []string{
+		`ALTER TABLE batches ADD COLUMN recipient TEXT NOT NULL DEFAULT ''`,
+		`CREATE INDEX IF NOT EXISTS idx_batches_recipient ON batches(recipient)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (4)`,
 	}
-	defer stmt.Close()
 
-	for _, notif := range notifications {
-		_, err = stmt.ExecContext(ctx, notif.RequestID, status.State, sentAt, status.Error, status.ExpiresAt.Unix())
-		if err != nil {
-			return err
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
 		}
 	}
 
 	return tx.Commit()
 }
 
-// GetStatus retrieves the delivery status for a request.
-func (s *SQLiteStore) GetStatus(ctx context.Context, requestID string) (Status, error) {
-	var (
+// migrateV5 tracks when each status last changed, for detecting stuck statuses.
+// Existing rows get 0 and so count as long unchanged.
+func (s *SQLiteStore) migrateV5(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE status ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0`,
+		`CREATE INDEX IF NOT EXISTS idx_status_state_updated ON status(state, updated_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (5)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// pendingUpdatedNow sets updated_at to the current time for pending statuses
+// that have none.
+const pendingUpdatedNow = `UPDATE status SET updated_at = CAST(strftime('%s', 'now') AS INTEGER)
+	WHERE updated_at = 0 AND state IN ('queued', 'timed_out', 'held_dnd')`
+
+func (s *SQLiteStore) migrateV6(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS invalid_tokens (
+			fcm_token TEXT PRIMARY KEY,
+			recorded_at INTEGER NOT NULL
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (6)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) migrateV7(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS broadcasts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL,
+			data_id_count INTEGER NOT NULL,
+			title TEXT NOT NULL DEFAULT '',
+			actor TEXT NOT NULL DEFAULT '',
+			message_id TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			sent_at INTEGER NOT NULL
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (7)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV8 records FCM's response to each send: the message ID on success
+// and the structured error code on failure.
+func (s *SQLiteStore) migrateV8(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE status ADD COLUMN message_id TEXT`,
+		`ALTER TABLE status ADD COLUMN error_code TEXT`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (8)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV9 attributes statuses to their sender and adds the status_daily
+// table that expired statuses are rolled up into.
+func (s *SQLiteStore) migrateV9(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE status ADD COLUMN sender TEXT NOT NULL DEFAULT ''`,
+		`CREATE TABLE IF NOT EXISTS status_daily (
+			day TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			state TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			PRIMARY KEY (day, sender, state)
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (9)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV10 records each request's target, device, and queue time with its
+// status, for context when investigating deliveries.
+func (s *SQLiteStore) migrateV10(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE status ADD COLUMN target TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE status ADD COLUMN device_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE status ADD COLUMN queued_at INTEGER`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (10)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV11 counts failed flush attempts per batch and adds the dead_letters
+// table that batches are moved to when the batcher gives up on them.
+func (s *SQLiteStore) migrateV11(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE batches ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS dead_letters (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			fcm_token TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			notifications BLOB NOT NULL,
+			created_at INTEGER NOT NULL,
+			attempts INTEGER NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			dead_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_dead_letters_expires ON dead_letters(expires_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (11)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV12 adds the device_groups table recording each user's FCM device
+// group and its members.
+func (s *SQLiteStore) migrateV12(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS device_groups (
+			username TEXT PRIMARY KEY,
+			notification_key TEXT NOT NULL,
+			members BLOB NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (12)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV13 indexes statuses by update time, so they can be exported in
+// pages without scanning the table.
+func (s *SQLiteStore) migrateV13(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE INDEX IF NOT EXISTS idx_status_updated ON status(updated_at, request_id)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (13)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV14 adds the fcm_usage table counting messages sent per Firebase
+// project per hour.
+func (s *SQLiteStore) migrateV14(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS fcm_usage (
+			project_id TEXT NOT NULL,
+			hour INTEGER NOT NULL,
+			sends INTEGER NOT NULL,
+			PRIMARY KEY (project_id, hour)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_fcm_usage_hour ON fcm_usage(hour)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (14)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV15 adds the reply_grants table recording which users may push
+// back to a sender that recently pushed to them.
+func (s *SQLiteStore) migrateV15(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS reply_grants (
+			recipient TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			expires_at INTEGER NOT NULL,
+			PRIMARY KEY (recipient, sender)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_reply_grants_expires ON reply_grants(expires_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (15)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV16 adds the batch_leases table through which gateways sharing a
+// database agree which of them flushes each endpoint's batch. expires_at is
+// in milliseconds, as leases are short.
+func (s *SQLiteStore) migrateV16(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS batch_leases (
+			fcm_token TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_batch_leases_expires ON batch_leases(expires_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (16)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV17 adds the send_receipts table recording batches FCM accepted
+// until they are deleted.
+func (s *SQLiteStore) migrateV17(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS send_receipts (
+			fcm_token TEXT NOT NULL,
+			batch_hash TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			sent_at INTEGER NOT NULL,
+			PRIMARY KEY (fcm_token, batch_hash)
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (17)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV18 adds the scheduled table holding notifications until their
+// delivery time.
+func (s *SQLiteStore) migrateV18(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS scheduled (
+			request_id TEXT PRIMARY KEY,
+			fcm_token TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			notification BLOB NOT NULL,
+			deliver_at INTEGER NOT NULL,
+			window_ms INTEGER NOT NULL DEFAULT 0,
+			max_batch_size INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_scheduled_deliver_at ON scheduled(deliver_at)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (18)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV19 adds the mirrored table holding notifications mirrored from a
+// primary gateway, and mirror_takeovers recording those this gateway took
+// over.
+func (s *SQLiteStore) migrateV19(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS mirrored (
+			request_id TEXT PRIMARY KEY,
+			fcm_token TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			notification BLOB NOT NULL,
+			received_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_mirrored_received_at ON mirrored(received_at)`,
+		`CREATE TABLE IF NOT EXISTS mirror_takeovers (
+			request_id TEXT PRIMARY KEY,
+			taken_at INTEGER NOT NULL
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (19)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV20 adds the counters table keeping running totals across
+// restarts.
+func (s *SQLiteStore) migrateV20(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS counters (
+			name TEXT PRIMARY KEY,
+			value INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (20)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV21 adds the request_ids table, which indexes the request IDs of
+// pending batches by FCM token so lookups by request ID don't read every
+// batch, and holds request IDs reserved before use. It is filled from the
+// batches already pending.
+func (s *SQLiteStore) migrateV21(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS request_ids (
+			request_id TEXT PRIMARY KEY,
+			fcm_token TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_request_ids_fcm_token ON request_ids(fcm_token)`,
+		`INSERT OR IGNORE INTO request_ids (request_id, fcm_token, created_at)
+			SELECT json_extract(n.value, '$.RequestID'), b.fcm_token, b.created_at
+			FROM batches b, json_each(CAST(b.notifications AS TEXT)) n
+			WHERE json_extract(n.value, '$.RequestID') IS NOT NULL`,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (21)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// migrateV22 gives pending statuses whose updated_at is still the 0 that
+// version 5 defaulted it to the current time, so MarkLost gives them the
+// full grace period instead of marking them all lost at once.
+func (s *SQLiteStore) migrateV22(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		pendingUpdatedNow,
+		`INSERT OR REPLACE INTO schema_version (version) VALUES (22)`,
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("executing %q: %w", stmt, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SaveBatch persists a batch for the given FCM token.
+func (s *SQLiteStore) SaveBatch(ctx context.Context, fcmToken string, batch *Batch) error {
+	defer s.observe(ctx, "save_batch", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if batch.Owner != "" {
+		if batch, err = shareBatch(ctx, tx, fcmToken, batch); err != nil {
+			return err
+		}
+	}
+	notifData, err := serializeNotifications(batch.Notifications)
+	if err != nil {
+		return fmt.Errorf("serializing notifications: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO batches (fcm_token, recipient, notifications, created_at, flush_at, attempts)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, fcmToken, batch.Recipient, notifData, batch.CreatedAt.Unix(), batch.FlushAt.Unix(), batch.Attempts)
+	if err != nil {
+		return err
+	}
+	if err := indexRequestIDs(ctx, tx, fcmToken, requestIDsOf(batch.Notifications), batch.CreatedAt.Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// shareBatch returns a copy of batch with its notifications marked as
+// batch.Owner's, after the notifications other owners saved for fcmToken.
+func shareBatch(ctx context.Context, tx *sql.Tx, fcmToken string, batch *Batch) (*Batch, error) {
+	shared := *batch
+	shared.Notifications = nil
+	held := make(map[string]bool, len(batch.Notifications))
+	for _, notif := range batch.Notifications {
+		held[notif.RequestID] = true
+	}
+
+	var notifData []byte
+	err := tx.QueryRowContext(ctx, `SELECT notifications FROM batches WHERE fcm_token = ?`, fcmToken).Scan(&notifData)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		stored, err := deserializeNotifications(notifData)
+		if err != nil {
+			return nil, fmt.Errorf("deserializing notifications: %w", err)
+		}
+		// Untagged notifications predate sharing and are the saver's own
+		for _, notif := range stored {
+			if notif.Owner != "" && notif.Owner != batch.Owner && !held[notif.RequestID] {
+				shared.Notifications = append(shared.Notifications, notif)
+			}
+		}
+	}
+
+	for _, notif := range batch.Notifications {
+		notif.Owner = batch.Owner
+		shared.Notifications = append(shared.Notifications, notif)
+	}
+	return &shared, nil
+}
+
+// indexRequestIDs records requestIDs as those of fcmToken's pending batch,
+// replacing what was recorded for it. A request ID reserved with
+// ReserveRequestID passes to the batch.
+func indexRequestIDs(ctx context.Context, tx *sql.Tx, fcmToken string, requestIDs []string, createdAt int64) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM request_ids WHERE fcm_token = ?`, fcmToken); err != nil {
+		return err
+	}
+	if len(requestIDs) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO request_ids (request_id, fcm_token, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (request_id) DO UPDATE SET fcm_token = excluded.fcm_token
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, id := range requestIDs {
+		if _, err := stmt.ExecContext(ctx, id, fcmToken, createdAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestIDsOf returns the request IDs of notifications.
+func requestIDsOf(notifications []QueuedNotification) []string {
+	ids := make([]string, len(notifications))
+	for i, notif := range notifications {
+		ids[i] = notif.RequestID
+	}
+	return ids
+}
+
+// LoadOldestBatches loads the oldest batches ordered by flush_at.
+// Returns fewer than limit entries when no more batches exist.
+func (s *SQLiteStore) LoadOldestBatches(ctx context.Context, limit int) (map[string]*Batch, error) {
+	defer s.observe(ctx, "load_oldest_batches", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT fcm_token, recipient, notifications, created_at, flush_at, attempts
+		FROM batches
+		ORDER BY flush_at ASC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanBatches(rows)
+}
+
+// ListBatchesByRecipient returns all pending batches for endpoints owned by
+// recipient, keyed by FCM token.
+func (s *SQLiteStore) ListBatchesByRecipient(ctx context.Context, recipient string) (map[string]*Batch, error) {
+	defer s.observe(ctx, "list_batches_by_recipient", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT fcm_token, recipient, notifications, created_at, flush_at, attempts
+		FROM batches
+		WHERE recipient = ?
+		ORDER BY flush_at ASC
+	`, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanBatches(rows)
+}
+
+// scanBatches reads batch rows selected as (fcm_token, recipient, notifications, created_at, flush_at, attempts).
+func scanBatches(rows *sql.Rows) (map[string]*Batch, error) {
+	batches := make(map[string]*Batch)
+	for rows.Next() {
+		var (
+			fcmToken  string
+			recipient string
+			notifData []byte
+			createdAt int64
+			flushAt   int64
+			attempts  int
+		)
+
+		if err := rows.Scan(&fcmToken, &recipient, &notifData, &createdAt, &flushAt, &attempts); err != nil {
+			return nil, err
+		}
+
+		notifications, err := deserializeNotifications(notifData)
+		if err != nil {
+			return nil, fmt.Errorf("deserializing notifications for token %s: %w", fcmToken, err)
+		}
+
+		batches[fcmToken] = &Batch{
+			Recipient:     recipient,
+			Notifications: notifications,
+			CreatedAt:     time.Unix(createdAt, 0),
+			FlushAt:       time.Unix(flushAt, 0),
+			Attempts:      attempts,
+		}
+	}
+
+	return batches, rows.Err()
+}
+
+// DeleteBatchAndSetStatus atomically deletes a batch and sets status for all its request IDs.
+// When the status is failed, the data IDs are retained alongside it for requeueing.
+// When it is failed_permanent, the batch is moved to the dead_letters table
+// until the status expires. The token's send receipts go with the batch.
+func (s *SQLiteStore) DeleteBatchAndSetStatus(ctx context.Context, fcmToken string, status Status) error {
+	defer s.observe(ctx, "delete_batch_and_set_status", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteNotifications(ctx, fcmToken, nil, status)
+}
+
+// DeleteNotificationsAndSetStatus is DeleteBatchAndSetStatus for the
+// notifications of fcmToken's batch with requestIDs only. The rest stay
+// queued, and the batch is deleted once none are left. Gateways sharing the
+// database use it to settle their own notifications of a shared batch.
+func (s *SQLiteStore) DeleteNotificationsAndSetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error {
+	defer s.observe(ctx, "delete_notifications_and_set_status", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[string]bool, len(requestIDs))
+	for _, id := range requestIDs {
+		ids[id] = true
+	}
+	return s.deleteNotifications(ctx, fcmToken, ids, status)
+}
+
+// deleteNotifications removes the notifications of fcmToken's batch with
+// the request IDs in ids, or all of them if ids is nil, and sets their
+// status. Caller must hold s.mu.
+func (s *SQLiteStore) deleteNotifications(ctx context.Context, fcmToken string, ids map[string]bool, status Status) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Get notifications from the batch to extract request IDs
+	var notifData []byte
+	var createdAt int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT notifications, created_at FROM batches WHERE fcm_token = ?
+	`, fcmToken).Scan(&notifData, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil // No batch exists, nothing to do
+	}
+	if err != nil {
+		return err
+	}
+
+	stored, err := deserializeNotifications(notifData)
+	if err != nil {
+		return fmt.Errorf("deserializing notifications: %w", err)
+	}
+	notifications, kept := stored, []QueuedNotification(nil)
+	if ids != nil {
+		notifications = nil
+		for _, notif := range stored {
+			if ids[notif.RequestID] {
+				notifications = append(notifications, notif)
+			} else {
+				kept = append(kept, notif)
+			}
+		}
+		if len(notifications) == 0 {
+			return nil
+		}
+	}
+
+	if status.State == StatusFailedPermanent {
+		deadData, err := serializeNotifications(notifications)
+		if err != nil {
+			return fmt.Errorf("serializing notifications: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO dead_letters (fcm_token, recipient, notifications, created_at, attempts, error, dead_at, expires_at)
+			SELECT fcm_token, recipient, ?, created_at, attempts, ?, ?, ?
+			FROM batches WHERE fcm_token = ?
+		`, deadData, status.Error, time.Now().Unix(), status.ExpiresAt.Unix(), fcmToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(kept) > 0 {
+		keptData, err := serializeNotifications(kept)
+		if err != nil {
+			return fmt.Errorf("serializing notifications: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE batches SET notifications = ? WHERE fcm_token = ?`, keptData, fcmToken)
+		if err != nil {
+			return err
+		}
+		if err := indexRequestIDs(ctx, tx, fcmToken, requestIDsOf(kept), createdAt); err != nil {
+			return err
+		}
+	} else {
+		// Delete the batch
+		_, err = tx.ExecContext(ctx, `DELETE FROM batches WHERE fcm_token = ?`, fcmToken)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM request_ids WHERE fcm_token = ?`, fcmToken)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM send_receipts WHERE fcm_token = ?`, fcmToken)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Set status for all request IDs
+	if err := writeStatus(ctx, tx, notifications, status); err != nil {
+		return err
+	}
+
+	if status.State == StatusFailed {
+		if err := retainFailed(ctx, tx, fcmToken, notifications, status.ExpiresAt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// retainFailed keeps a copy of each failed notification's data IDs until expiresAt.
+func retainFailed(ctx context.Context, tx *sql.Tx, fcmToken string, notifications []QueuedNotification, expiresAt time.Time) error {
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT OR REPLACE INTO failed_deliveries (request_id, fcm_token, data_ids, failed_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	failedAt := time.Now().Unix()
+	for _, notif := range notifications {
+		dataIDs, err := json.Marshal(notif.DataIDs)
+		if err != nil {
+			return fmt.Errorf("serializing data IDs: %w", err)
+		}
+		if _, err := stmt.ExecContext(ctx, notif.RequestID, fcmToken, dataIDs, failedAt, expiresAt.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadFailedSince returns retained failed deliveries that failed at or after since,
+// oldest first.
+func (s *SQLiteStore) LoadFailedSince(ctx context.Context, since time.Time) ([]FailedDelivery, error) {
+	defer s.observe(ctx, "load_failed_since", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT request_id, fcm_token, data_ids, failed_at
+		FROM failed_deliveries
+		WHERE failed_at >= ? AND expires_at >= ?
+		ORDER BY failed_at ASC
+	`, since.Unix(), time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failed []FailedDelivery
+	for rows.Next() {
+		var (
+			fd       FailedDelivery
+			dataIDs  []byte
+			failedAt int64
+		)
+
+		if err := rows.Scan(&fd.RequestID, &fd.FcmToken, &dataIDs, &failedAt); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(dataIDs, &fd.DataIDs); err != nil {
+			return nil, fmt.Errorf("deserializing data IDs for request %s: %w", fd.RequestID, err)
+		}
+		fd.FailedAt = time.Unix(failedAt, 0)
+
+		failed = append(failed, fd)
+	}
+
+	return failed, rows.Err()
+}
+
+// MarkRequeued drops the retained copy of a failed delivery and resets its status
+// to queued. A status or retention row that changed since fd was loaded is left alone.
+// It reports whether the retained copy was still there, so a delivery
+// requeued by several callers at once is claimed by one.
+func (s *SQLiteStore) MarkRequeued(ctx context.Context, fd FailedDelivery) (bool, error) {
+	defer s.observe(ctx, "mark_requeued", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM failed_deliveries WHERE request_id = ? AND failed_at <= ?
+	`, fd.RequestID, fd.FailedAt.Unix())
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE status SET state = ?, error = NULL, error_code = NULL, updated_at = ? WHERE request_id = ? AND state = ?
+	`, StatusQueued, time.Now().Unix(), fd.RequestID, StatusFailed)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// SetStatus sets the status of the given request IDs, queued for fcmToken,
+// without touching their batch.
+func (s *SQLiteStore) SetStatus(ctx context.Context, fcmToken string, requestIDs []string, status Status) error {
+	defer s.observe(ctx, "set_status", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	notifications := make([]QueuedNotification, len(requestIDs))
+	for i, id := range requestIDs {
+		notifications[i].RequestID = id
+	}
+	if err := writeStatus(ctx, tx, notifications, status); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// writeStatus upserts status for each notification's request ID, stamping
+// updated_at with now. Context a notification lacks, such as the sender of a
+// requeued request, keeps what is already recorded for its request ID, and the
+// first queue time is never overwritten.
+func writeStatus(ctx context.Context, tx *sql.Tx, notifications []QueuedNotification, status Status) error {
+	var sentAt *int64
+	if status.SentAt != nil {
+		t := status.SentAt.Unix()
+		sentAt = &t
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO status (request_id, state, sent_at, message_id, error, error_code, expires_at, updated_at,
+			sender, target, device_id, queued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (request_id) DO UPDATE SET
+			state = excluded.state,
+			sent_at = excluded.sent_at,
+			message_id = excluded.message_id,
+			error = excluded.error,
+			error_code = excluded.error_code,
+			expires_at = excluded.expires_at,
+			updated_at = excluded.updated_at,
+			sender = CASE WHEN excluded.sender != '' THEN excluded.sender ELSE status.sender END,
+			target = CASE WHEN excluded.target != '' THEN excluded.target ELSE status.target END,
+			device_id = CASE WHEN excluded.device_id != '' THEN excluded.device_id ELSE status.device_id END,
+			queued_at = COALESCE(status.queued_at, excluded.queued_at)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, notif := range notifications {
+		var queuedAt *int64
+		if !notif.QueuedAt.IsZero() {
+			t := notif.QueuedAt.Unix()
+			queuedAt = &t
+		}
+		if _, err := stmt.ExecContext(ctx, notif.RequestID, status.State, sentAt, status.MessageID, status.Error, status.ErrorCode, status.ExpiresAt.Unix(), now,
+			notif.Sender, notif.Target, notif.DeviceID, queuedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarkLost marks statuses stuck in a pending state (queued, timed_out or
+// held_dnd) as lost when they haven't changed since before olderThan and no
+// pending batch still holds their request ID. Lost statuses are kept until expiresAt.
+// Returns the number of statuses marked.
+func (s *SQLiteStore) MarkLost(ctx context.Context, olderThan, expiresAt time.Time) (int64, error) {
+	defer s.observe(ctx, "mark_lost", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// request_ids indexes the request IDs of pending batches; reservations,
+	// which have no token, hold no batch.
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE status
+		SET state = ?, error = ?, expires_at = ?, updated_at = ?
+		WHERE state IN (?, ?, ?) AND updated_at < ?
+		AND NOT EXISTS (
+			SELECT 1 FROM request_ids WHERE request_id = status.request_id AND fcm_token != ''
+		)
+	`, StatusLost, "batch never flushed", expiresAt.Unix(), time.Now().Unix(),
+		StatusQueued, StatusTimedOut, StatusHeldDND, olderThan.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetStatus retrieves the delivery status for a request.
+func (s *SQLiteStore) GetStatus(ctx context.Context, requestID string) (Status, error) {
+	defer s.observe(ctx, "get_status", time.Now())
+
+	var (
 		state     string
 		sentAt    *int64
+		messageID sql.NullString
 		errMsg    sql.NullString
+		errCode   sql.NullString
 		expiresAt int64
+		queuedAt  *int64
+		status    Status
+	)
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT state, sent_at, message_id, error, error_code, expires_at, sender, target, device_id, queued_at
+		FROM status WHERE request_id = ?
+	`, requestID).Scan(&state, &sentAt, &messageID, &errMsg, &errCode, &expiresAt,
+		&status.Sender, &status.Target, &status.DeviceID, &queuedAt)
+	if err == sql.ErrNoRows {
+		return Status{}, fmt.Errorf("%w: %s", ErrRequestNotFound, requestID)
+	}
+	if err != nil {
+		return Status{}, err
+	}
+
+	status.State = state
+	status.ExpiresAt = time.Unix(expiresAt, 0)
+	if sentAt != nil {
+		t := time.Unix(*sentAt, 0)
+		status.SentAt = &t
+	}
+	if queuedAt != nil {
+		status.QueuedAt = time.Unix(*queuedAt, 0)
+	}
+	status.MessageID = messageID.String
+	if errMsg.Valid {
+		status.Error = errMsg.String
+	}
+	status.ErrorCode = errCode.String
+
+	return status, nil
+}
+
+// ListStatusesSince returns up to limit statuses updated at or after since
+// that come after the cursor, in update order. Pass the last record's
+// cursor to read the next page; a request updated between pages is
+// returned again.
+func (s *SQLiteStore) ListStatusesSince(ctx context.Context, since time.Time, after StatusCursor, limit int) ([]StatusRecord, error) {
+	defer s.observe(ctx, "list_statuses_since", time.Now())
+
+	from := since.Unix()
+	afterAt := from - 1
+	if !after.UpdatedAt.IsZero() && after.UpdatedAt.Unix() >= from {
+		afterAt = after.UpdatedAt.Unix()
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT request_id, updated_at, state, sent_at, message_id, error, error_code, expires_at,
+			sender, target, device_id, queued_at
+		FROM status
+		WHERE updated_at > ? OR (updated_at = ? AND request_id > ?)
+		ORDER BY updated_at ASC, request_id ASC
+		LIMIT ?
+	`, afterAt, afterAt, after.RequestID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []StatusRecord
+	for rows.Next() {
+		var (
+			rec       StatusRecord
+			updatedAt int64
+			sentAt    *int64
+			messageID sql.NullString
+			errMsg    sql.NullString
+			errCode   sql.NullString
+			expiresAt int64
+			queuedAt  *int64
+		)
+
+		if err := rows.Scan(&rec.RequestID, &updatedAt, &rec.State, &sentAt, &messageID, &errMsg, &errCode,
+			&expiresAt, &rec.Sender, &rec.Target, &rec.DeviceID, &queuedAt); err != nil {
+			return nil, err
+		}
+
+		rec.UpdatedAt = time.Unix(updatedAt, 0)
+		rec.ExpiresAt = time.Unix(expiresAt, 0)
+		if sentAt != nil {
+			t := time.Unix(*sentAt, 0)
+			rec.SentAt = &t
+		}
+		if queuedAt != nil {
+			rec.QueuedAt = time.Unix(*queuedAt, 0)
+		}
+		rec.MessageID = messageID.String
+		rec.Error = errMsg.String
+		rec.ErrorCode = errCode.String
+
+		records = append(records, rec)
+	}
+
+	return records, rows.Err()
+}
+
+// ImportStatuses writes statuses read from another store, keeping their
+// update times and request context. A request whose status here changed
+// later than the imported one keeps its own.
+func (s *SQLiteStore) ImportStatuses(ctx context.Context, records []StatusRecord) error {
+	defer s.observe(ctx, "import_statuses", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO status (request_id, state, sent_at, message_id, error, error_code, expires_at, updated_at,
+			sender, target, device_id, queued_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (request_id) DO UPDATE SET
+			state = excluded.state,
+			sent_at = excluded.sent_at,
+			message_id = excluded.message_id,
+			error = excluded.error,
+			error_code = excluded.error_code,
+			expires_at = excluded.expires_at,
+			updated_at = excluded.updated_at,
+			sender = excluded.sender,
+			target = excluded.target,
+			device_id = excluded.device_id,
+			queued_at = excluded.queued_at
+		WHERE excluded.updated_at > status.updated_at
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rec := range records {
+		var sentAt, queuedAt *int64
+		if rec.SentAt != nil {
+			t := rec.SentAt.Unix()
+			sentAt = &t
+		}
+		if !rec.QueuedAt.IsZero() {
+			t := rec.QueuedAt.Unix()
+			queuedAt = &t
+		}
+		if _, err := stmt.ExecContext(ctx, rec.RequestID, rec.State, sentAt, rec.MessageID, rec.Error, rec.ErrorCode,
+			rec.ExpiresAt.Unix(), rec.UpdatedAt.Unix(), rec.Sender, rec.Target, rec.DeviceID, queuedAt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// HasRequestID reports whether a request ID is already tracked, either by a
+// status record, by a notification in a pending batch, or by a reservation.
+func (s *SQLiteStore) HasRequestID(ctx context.Context, requestID string) (bool, error) {
+	defer s.observe(ctx, "has_request_id", time.Now())
+
+	var found int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT 1 FROM status WHERE request_id = ?
+		UNION ALL
+		SELECT 1 FROM request_ids WHERE request_id = ?
+		LIMIT 1
+	`, requestID, requestID).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReserveRequestID claims requestID for a new request, returning
+// ErrRequestIDTaken if a status, a pending batch, or another reservation
+// already uses it. The check and the claim are one statement, so two
+// requests can't both claim an ID. The batch that later holds the request
+// takes the reservation over; one no batch takes over expires after an hour.
+func (s *SQLiteStore) ReserveRequestID(ctx context.Context, requestID string, at time.Time) error {
+	defer s.observe(ctx, "reserve_request_id", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO request_ids (request_id, fcm_token, created_at)
+		SELECT ?, '', ? WHERE NOT EXISTS (SELECT 1 FROM status WHERE request_id = ?)
+		ON CONFLICT (request_id) DO NOTHING
+	`, requestID, at.Unix(), requestID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", ErrRequestIDTaken, requestID)
+	}
+	return nil
+}
+
+// FindPendingRequest returns the pending batch notification with requestID,
+// or nil if no pending batch holds it.
+func (s *SQLiteStore) FindPendingRequest(ctx context.Context, requestID string) (*PendingRequest, error) {
+	defer s.observe(ctx, "find_pending_request", time.Now())
+
+	var (
+		fcmToken  string
+		notifData []byte
+	)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT b.fcm_token, b.notifications
+		FROM request_ids r JOIN batches b ON b.fcm_token = r.fcm_token
+		WHERE r.request_id = ?
+	`, requestID).Scan(&fcmToken, &notifData)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	notifications, err := deserializeNotifications(notifData)
+	if err != nil {
+		return nil, fmt.Errorf("deserializing notifications: %w", err)
+	}
+	for i, notif := range notifications {
+		if notif.RequestID == requestID {
+			return &PendingRequest{FcmToken: fcmToken, Index: i, Notification: notif}, nil
+		}
+	}
+	return nil, nil
+}
+
+// CleanupExpiredStatus removes expired status records along with any retained
+// failed deliveries and dead letters that share their retention period.
+func (s *SQLiteStore) CleanupExpiredStatus(ctx context.Context) (int64, error) {
+	byState, err := s.CleanupExpiredStatusByState(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, n := range byState {
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// CleanupExpiredStatusByState is like CleanupExpiredStatus, but returns the
+// number of statuses removed in each state.
+func (s *SQLiteStore) CleanupExpiredStatusByState(ctx context.Context) (map[string]int64, error) {
+	defer s.observe(ctx, "cleanup_expired_status", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM failed_deliveries WHERE expires_at < ?
+	`, now); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM dead_letters WHERE expires_at < ?
+	`, now); err != nil {
+		return nil, err
+	}
+
+	// Drop reservations no batch took over
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM request_ids WHERE fcm_token = '' AND created_at < ?
+	`, now-int64(reservationTTL/time.Second)); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Roll expiring statuses up by the day they reached their final state,
+	// so delivery rates stay queryable after the records are gone. Rows
+	// written before updated_at existed fall back to their expiry day.
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO status_daily (day, sender, state, count)
+		SELECT date(CASE WHEN updated_at > 0 THEN updated_at ELSE expires_at END, 'unixepoch'), sender, state, COUNT(*)
+		FROM status
+		WHERE expires_at < ?
+		GROUP BY 1, 2, 3
+		ON CONFLICT (day, sender, state) DO UPDATE SET count = count + excluded.count
+	`, now); err != nil {
+		return nil, fmt.Errorf("summarizing expired statuses: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT state, COUNT(*) FROM status WHERE expires_at < ? GROUP BY state
+	`, now)
+	if err != nil {
+		return nil, fmt.Errorf("counting expired statuses: %w", err)
+	}
+	byState := make(map[string]int64)
+	for rows.Next() {
+		var state string
+		var n int64
+		if err := rows.Scan(&state, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byState[state] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM status WHERE expires_at < ?
+	`, now); err != nil {
+		return nil, err
+	}
+	return byState, tx.Commit()
+}
+
+// ListDailySummaries returns the daily status summaries from since's UTC day
+// onward, oldest first. A non-empty sender limits them to that sender.
+func (s *SQLiteStore) ListDailySummaries(ctx context.Context, since time.Time, sender string) ([]DailySummary, error) {
+	defer s.observe(ctx, "list_daily_summaries", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT day, sender, state, count
+		FROM status_daily
+		WHERE day >= ? AND (? = '' OR sender = ?)
+		ORDER BY day, sender, state
+	`, since.UTC().Format("2006-01-02"), sender, sender)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []DailySummary
+	for rows.Next() {
+		var d DailySummary
+		if err := rows.Scan(&d.Day, &d.Sender, &d.State, &d.Count); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, d)
+	}
+	return summaries, rows.Err()
+}
+
+// RecordRecentSends records data IDs delivered to an FCM token so repeats can be
+// suppressed until expiresAt.
+func (s *SQLiteStore) RecordRecentSends(ctx context.Context, fcmToken string, dataIDs [][]byte, expiresAt time.Time) error {
+	defer s.observe(ctx, "record_recent_sends", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT OR REPLACE INTO recent_sends (fcm_token, data_id, expires_at)
+		VALUES (?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, dataID := range dataIDs {
+		if _, err := stmt.ExecContext(ctx, fcmToken, dataID, expiresAt.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FilterRecentSends returns the subset of dataIDs that have not been sent to the
+// FCM token within the suppression window. Order is preserved.
+func (s *SQLiteStore) FilterRecentSends(ctx context.Context, fcmToken string, dataIDs [][]byte) ([][]byte, error) {
+	defer s.observe(ctx, "filter_recent_sends", time.Now())
+
+	now := time.Now().Unix()
+
+	var remaining [][]byte
+	for _, dataID := range dataIDs {
+		var found int
+		err := s.db.QueryRowContext(ctx, `
+			SELECT 1 FROM recent_sends WHERE fcm_token = ? AND data_id = ? AND expires_at >= ?
+		`, fcmToken, dataID, now).Scan(&found)
+		if err == sql.ErrNoRows {
+			remaining = append(remaining, dataID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return remaining, nil
+}
+
+// CleanupExpiredRecentSends removes expired duplicate-suppression records.
+func (s *SQLiteStore) CleanupExpiredRecentSends(ctx context.Context) (int64, error) {
+	defer s.observe(ctx, "cleanup_expired_recent_sends", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM recent_sends WHERE expires_at < ?
+	`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RecordInvalidToken records that FCM reported fcmToken as no longer registered.
+func (s *SQLiteStore) RecordInvalidToken(ctx context.Context, fcmToken string) error {
+	defer s.observe(ctx, "record_invalid_token", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO invalid_tokens (fcm_token, recorded_at) VALUES (?, ?)
+	`, fcmToken, time.Now().Unix())
+	return err
+}
+
+// IsInvalidToken reports whether fcmToken was recorded as invalid.
+func (s *SQLiteStore) IsInvalidToken(ctx context.Context, fcmToken string) (bool, error) {
+	defer s.observe(ctx, "is_invalid_token", time.Now())
+
+	var exists int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT 1 FROM invalid_tokens WHERE fcm_token = ?
+	`, fcmToken).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ClaimBatch takes the lease on fcmToken's batch for owner until ttl from
+// now, reporting whether it was taken. A lease is granted when nobody holds
+// it, when owner already does (extending it), or when its holder let it
+// expire, which recovers batches from instances that died mid-flush.
+func (s *SQLiteStore) ClaimBatch(ctx context.Context, fcmToken, owner string, ttl time.Duration) (bool, error) {
+	defer s.observe(ctx, "claim_batch", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO batch_leases (fcm_token, owner, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (fcm_token) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+		WHERE batch_leases.owner = excluded.owner OR batch_leases.expires_at < ?
+	`, fcmToken, owner, now.Add(ttl).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// ReleaseBatch gives up owner's lease on fcmToken's batch. A lease that has
+// since passed to another owner is left alone.
+func (s *SQLiteStore) ReleaseBatch(ctx context.Context, fcmToken, owner string) error {
+	defer s.observe(ctx, "release_batch", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM batch_leases WHERE fcm_token = ? AND owner = ?
+	`, fcmToken, owner)
+	return err
+}
+
+// CleanupExpiredBatchLeases removes leases their owners never released.
+func (s *SQLiteStore) CleanupExpiredBatchLeases(ctx context.Context) (int64, error) {
+	defer s.observe(ctx, "cleanup_expired_batch_leases", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM batch_leases WHERE expires_at < ?
+	`, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RecordReceipt records that FCM accepted fcmToken's batch. It lasts until
+// the batch is deleted.
+func (s *SQLiteStore) RecordReceipt(ctx context.Context, fcmToken string, receipt Receipt) error {
+	defer s.observe(ctx, "record_receipt", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO send_receipts (fcm_token, batch_hash, message_id, sent_at)
+		VALUES (?, ?, ?, ?)
+	`, fcmToken, receipt.BatchHash, receipt.MessageID, receipt.SentAt.Unix())
+	return err
+}
+
+// GetReceipt returns the receipt for fcmToken's batch with batchHash, or nil
+// if FCM hasn't accepted it.
+func (s *SQLiteStore) GetReceipt(ctx context.Context, fcmToken, batchHash string) (*Receipt, error) {
+	defer s.observe(ctx, "get_receipt", time.Now())
+
+	receipt := Receipt{BatchHash: batchHash}
+	var sentAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT message_id, sent_at FROM send_receipts WHERE fcm_token = ? AND batch_hash = ?
+	`, fcmToken, batchHash).Scan(&receipt.MessageID, &sentAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	receipt.SentAt = time.Unix(sentAt, 0)
+	return &receipt, nil
+}
+
+// SaveScheduled stores n until its delivery time and gives its request
+// status, atomically.
+func (s *SQLiteStore) SaveScheduled(ctx context.Context, n ScheduledNotification, status Status) error {
+	defer s.observe(ctx, "save_scheduled", time.Now())
+
+	notifData, err := json.Marshal(n.Notification)
+	if err != nil {
+		return fmt.Errorf("serializing notification: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO scheduled (request_id, fcm_token, recipient, notification, deliver_at, window_ms, max_batch_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, n.Notification.RequestID, n.FcmToken, n.Recipient, notifData, n.DeliverAt.Unix(), n.Window.Milliseconds(), n.MaxBatchSize); err != nil {
+		return err
+	}
+	if err := writeStatus(ctx, tx, []QueuedNotification{n.Notification}, status); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LoadDueScheduled returns up to limit scheduled notifications due at or
+// before now, soonest first.
+func (s *SQLiteStore) LoadDueScheduled(ctx context.Context, now time.Time, limit int) ([]ScheduledNotification, error) {
+	defer s.observe(ctx, "load_due_scheduled", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT fcm_token, recipient, notification, deliver_at, window_ms, max_batch_size
+		FROM scheduled
+		WHERE deliver_at <= ?
+		ORDER BY deliver_at ASC
+		LIMIT ?
+	`, now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []ScheduledNotification
+	for rows.Next() {
+		n, err := scanScheduled(rows)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, *n)
+	}
+	return due, rows.Err()
+}
+
+// GetScheduled returns the scheduled notification with requestID, or nil if
+// none is held.
+func (s *SQLiteStore) GetScheduled(ctx context.Context, requestID string) (*ScheduledNotification, error) {
+	defer s.observe(ctx, "get_scheduled", time.Now())
+
+	n, err := scanScheduled(s.db.QueryRowContext(ctx, `
+		SELECT fcm_token, recipient, notification, deliver_at, window_ms, max_batch_size
+		FROM scheduled WHERE request_id = ?
+	`, requestID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return n, err
+}
+
+// scanScheduled reads a scheduled row selected as (fcm_token, recipient,
+// notification, deliver_at, window_ms, max_batch_size).
+func scanScheduled(row interface{ Scan(...any) error }) (*ScheduledNotification, error) {
+	var (
+		n         ScheduledNotification
+		notifData []byte
+		deliverAt int64
+		windowMS  int64
 	)
+	if err := row.Scan(&n.FcmToken, &n.Recipient, &notifData, &deliverAt, &windowMS, &n.MaxBatchSize); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(notifData, &n.Notification); err != nil {
+		return nil, fmt.Errorf("deserializing scheduled notification for token %s: %w", n.FcmToken, err)
+	}
+	n.DeliverAt = time.Unix(deliverAt, 0)
+	n.Window = time.Duration(windowMS) * time.Millisecond
+	return &n, nil
+}
+
+// DeleteScheduledAndSetStatus atomically deletes the scheduled notification
+// with requestID and sets its status. Returns false, changing nothing, if
+// none is held, e.g. because another caller deleted it first.
+func (s *SQLiteStore) DeleteScheduledAndSetStatus(ctx context.Context, requestID string, status Status) (bool, error) {
+	defer s.observe(ctx, "delete_scheduled_and_set_status", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM scheduled WHERE request_id = ?`, requestID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := writeStatus(ctx, tx, []QueuedNotification{{RequestID: requestID}}, status); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// GrantReply lets sender push to recipient until expiresAt, regardless of
+// recipient's consent. An existing grant is only ever extended.
+func (s *SQLiteStore) GrantReply(ctx context.Context, recipient, sender string, expiresAt time.Time) error {
+	defer s.observe(ctx, "grant_reply", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO reply_grants (recipient, sender, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (recipient, sender) DO UPDATE SET expires_at = MAX(expires_at, excluded.expires_at)
+	`, recipient, sender, expiresAt.Unix())
+	return err
+}
+
+// HasReplyGrant reports whether sender holds an unexpired grant to push to
+// recipient.
+func (s *SQLiteStore) HasReplyGrant(ctx context.Context, recipient, sender string) (bool, error) {
+	defer s.observe(ctx, "has_reply_grant", time.Now())
 
+	var exists int
 	err := s.db.QueryRowContext(ctx, `
-		SELECT state, sent_at, error, expires_at FROM status WHERE request_id = ?
-	`, requestID).Scan(&state, &sentAt, &errMsg, &expiresAt)
+		SELECT 1 FROM reply_grants WHERE recipient = ? AND sender = ? AND expires_at >= ?
+	`, recipient, sender, time.Now().Unix()).Scan(&exists)
 	if err == sql.ErrNoRows {
-		return Status{}, fmt.Errorf("request not found: %s", requestID)
+		return false, nil
 	}
 	if err != nil {
-		return Status{}, err
+		return false, err
 	}
+	return true, nil
+}
+
+// CleanupExpiredReplyGrants removes expired reply grants.
+func (s *SQLiteStore) CleanupExpiredReplyGrants(ctx context.Context) (int64, error) {
+	defer s.observe(ctx, "cleanup_expired_reply_grants", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	status := Status{
-		State:     state,
-		ExpiresAt: time.Unix(expiresAt, 0),
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM reply_grants WHERE expires_at < ?
+	`, time.Now().Unix())
+	if err != nil {
+		return 0, err
 	}
-	if sentAt != nil {
-		t := time.Unix(*sentAt, 0)
-		status.SentAt = &t
+	return result.RowsAffected()
+}
+
+// GetDeviceGroup returns username's device group, or nil if none was saved.
+func (s *SQLiteStore) GetDeviceGroup(ctx context.Context, username string) (*DeviceGroup, error) {
+	defer s.observe(ctx, "get_device_group", time.Now())
+
+	var (
+		group     DeviceGroup
+		members   []byte
+		updatedAt int64
+	)
+	err := s.db.QueryRowContext(ctx, `
+		SELECT notification_key, members, updated_at FROM device_groups WHERE username = ?
+	`, username).Scan(&group.NotificationKey, &members, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	if errMsg.Valid {
-		status.Error = errMsg.String
+	if err != nil {
+		return nil, err
 	}
 
-	return status, nil
+	if err := json.Unmarshal(members, &group.Members); err != nil {
+		return nil, fmt.Errorf("deserializing device group members for %s: %w", username, err)
+	}
+	group.UpdatedAt = time.Unix(updatedAt, 0)
+	return &group, nil
 }
 
-// CleanupExpiredStatus removes expired status records.
-func (s *SQLiteStore) CleanupExpiredStatus(ctx context.Context) (int64, error) {
+// SaveDeviceGroup records username's device group, replacing any previous one.
+func (s *SQLiteStore) SaveDeviceGroup(ctx context.Context, username string, group DeviceGroup) error {
+	defer s.observe(ctx, "save_device_group", time.Now())
+
+	members, err := json.Marshal(group.Members)
+	if err != nil {
+		return fmt.Errorf("serializing device group members: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO device_groups (username, notification_key, members, updated_at)
+		VALUES (?, ?, ?, ?)
+	`, username, group.NotificationKey, members, group.UpdatedAt.Unix())
+	return err
+}
+
+// RecordBroadcast appends b to the broadcast audit log. b.ID is ignored.
+func (s *SQLiteStore) RecordBroadcast(ctx context.Context, b Broadcast) error {
+	defer s.observe(ctx, "record_broadcast", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO broadcasts (topic, data_id_count, title, actor, message_id, error, sent_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, b.Topic, b.DataIDCount, b.Title, b.Actor, b.MessageID, b.Error, b.SentAt.Unix())
+	return err
+}
+
+// ListBroadcasts returns the most recent broadcasts, newest first.
+func (s *SQLiteStore) ListBroadcasts(ctx context.Context, limit int) ([]Broadcast, error) {
+	defer s.observe(ctx, "list_broadcasts", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, topic, data_id_count, title, actor, message_id, error, sent_at
+		FROM broadcasts
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var broadcasts []Broadcast
+	for rows.Next() {
+		var (
+			b      Broadcast
+			sentAt int64
+		)
+		if err := rows.Scan(&b.ID, &b.Topic, &b.DataIDCount, &b.Title, &b.Actor, &b.MessageID, &b.Error, &sentAt); err != nil {
+			return nil, err
+		}
+		b.SentAt = time.Unix(sentAt, 0)
+		broadcasts = append(broadcasts, b)
+	}
+
+	return broadcasts, rows.Err()
+}
+
+// AddFCMUsage adds sends to the count of messages sent through projectID in
+// the hour starting at hour.
+func (s *SQLiteStore) AddFCMUsage(ctx context.Context, projectID string, hour time.Time, sends int64) error {
+	defer s.observe(ctx, "add_fcm_usage", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO fcm_usage (project_id, hour, sends) VALUES (?, ?, ?)
+		ON CONFLICT (project_id, hour) DO UPDATE SET sends = sends + excluded.sends
+	`, projectID, hour.Unix(), sends)
+	return err
+}
+
+// ListFCMUsage returns the hourly send counts of every project from the hour
+// containing since on, oldest first.
+func (s *SQLiteStore) ListFCMUsage(ctx context.Context, since time.Time) ([]FCMUsage, error) {
+	defer s.observe(ctx, "list_fcm_usage", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT project_id, hour, sends
+		FROM fcm_usage
+		WHERE hour >= ?
+		ORDER BY hour, project_id
+	`, since.Truncate(time.Hour).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []FCMUsage
+	for rows.Next() {
+		var (
+			u    FCMUsage
+			hour int64
+		)
+		if err := rows.Scan(&u.ProjectID, &hour, &u.Sends); err != nil {
+			return nil, err
+		}
+		u.Hour = time.Unix(hour, 0).UTC()
+		usage = append(usage, u)
+	}
+
+	return usage, rows.Err()
+}
+
+// SaveMirrored stores notifications mirrored from a primary gateway. One
+// already held is left as it is.
+func (s *SQLiteStore) SaveMirrored(ctx context.Context, notifications []MirroredNotification) error {
+	defer s.observe(ctx, "save_mirrored", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, n := range notifications {
+		notifData, err := json.Marshal(n.Notification)
+		if err != nil {
+			return fmt.Errorf("serializing notification: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO mirrored (request_id, fcm_token, recipient, notification, received_at)
+			VALUES (?, ?, ?, ?, ?)
+		`, n.Notification.RequestID, n.FcmToken, n.Recipient, notifData, n.ReceivedAt.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteMirrored removes the mirrored notifications with requestIDs, once
+// the primary has delivered or dropped them. Returns how many were held.
+func (s *SQLiteStore) DeleteMirrored(ctx context.Context, requestIDs []string) (int64, error) {
+	defer s.observe(ctx, "delete_mirrored", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	for _, id := range requestIDs {
+		result, err := tx.ExecContext(ctx, `DELETE FROM mirrored WHERE request_id = ?`, id)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+	}
+
+	return deleted, tx.Commit()
+}
+
+// LoadMirrored returns up to limit mirrored notifications, oldest first.
+func (s *SQLiteStore) LoadMirrored(ctx context.Context, limit int) ([]MirroredNotification, error) {
+	defer s.observe(ctx, "load_mirrored", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT fcm_token, recipient, notification, received_at
+		FROM mirrored
+		ORDER BY received_at ASC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mirrored []MirroredNotification
+	for rows.Next() {
+		var (
+			n          MirroredNotification
+			notifData  []byte
+			receivedAt int64
+		)
+		if err := rows.Scan(&n.FcmToken, &n.Recipient, &notifData, &receivedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(notifData, &n.Notification); err != nil {
+			return nil, fmt.Errorf("deserializing mirrored notification for token %s: %w", n.FcmToken, err)
+		}
+		n.ReceivedAt = time.Unix(receivedAt, 0)
+		mirrored = append(mirrored, n)
+	}
+	return mirrored, rows.Err()
+}
+
+// MarkTakenOver atomically moves the mirrored notifications with
+// requestIDs, which this gateway has queued for delivery, to the takeovers
+// the primary is told about when it returns.
+func (s *SQLiteStore) MarkTakenOver(ctx context.Context, requestIDs []string, at time.Time) error {
+	defer s.observe(ctx, "mark_taken_over", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range requestIDs {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM mirrored WHERE request_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO mirror_takeovers (request_id, taken_at) VALUES (?, ?)
+		`, id, at.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListTakeovers returns the request IDs of the mirrored notifications this
+// gateway took over, oldest first.
+func (s *SQLiteStore) ListTakeovers(ctx context.Context) ([]string, error) {
+	defer s.observe(ctx, "list_takeovers", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT request_id FROM mirror_takeovers ORDER BY taken_at ASC, request_id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteTakeovers forgets the takeovers with requestIDs, once the primary
+// has suppressed them.
+func (s *SQLiteStore) DeleteTakeovers(ctx context.Context, requestIDs []string) error {
+	defer s.observe(ctx, "delete_takeovers", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range requestIDs {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM mirror_takeovers WHERE request_id = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CleanupExpiredMirrored removes mirrored notifications received, and
+// takeovers made, before before. Returns how many mirrored notifications
+// were removed.
+func (s *SQLiteStore) CleanupExpiredMirrored(ctx context.Context, before time.Time) (int64, error) {
+	defer s.observe(ctx, "cleanup_expired_mirrored", time.Now())
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	result, err := s.db.ExecContext(ctx, `
-		DELETE FROM status WHERE expires_at < ?
-	`, time.Now().Unix())
+		DELETE FROM mirrored WHERE received_at < ?
+	`, before.Unix())
 	if err != nil {
 		return 0, err
 	}
+	if _, err := s.db.ExecContext(ctx, `
+		DELETE FROM mirror_takeovers WHERE taken_at < ?
+	`, before.Unix()); err != nil {
+		return 0, err
+	}
 	return result.RowsAffected()
 }
 
-// Close closes the database connection.
+// Reopen replaces the database connection with a new one and reruns the
+// migrations, e.g. after the file was vacuumed or restored from a backup
+// while the gateway kept running. Queries wait for the connection until it
+// is replaced.
+func (s *SQLiteStore) Reopen(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Taking the only connection waits for queries using it; reporting it
+	// bad makes the pool close it instead of reusing it
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for database connection: %w", err)
+	}
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("reopening database: %w", err)
+	}
+	if err := s.migrate(ctx); err != nil {
+		return fmt.Errorf("running migrations: %w", err)
+	}
+	return nil
+}
+
+// Close stops sampling metrics and closes the database connection.
 func (s *SQLiteStore) Close() error {
+	close(s.metrics.stop)
+	<-s.metrics.done
 	return s.db.Close()
 }
 
@@ -334,3 +2769,57 @@ func deserializeNotifications(data []byte) ([]QueuedNotification, error) {
 	}
 	return notifications, nil
 }
+
+// AddCounters adds each delta to the counter it names as of at, creating
+// counters not written before.
+func (s *SQLiteStore) AddCounters(ctx context.Context, deltas map[string]int64, at time.Time) error {
+	defer s.observe(ctx, "add_counters", time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for name, delta := range deltas {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO counters (name, value, created_at, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET value = value + excluded.value, updated_at = excluded.updated_at
+		`, name, delta, at.Unix(), at.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListCounters returns every counter, by name.
+func (s *SQLiteStore) ListCounters(ctx context.Context) ([]Counter, error) {
+	defer s.observe(ctx, "list_counters", time.Now())
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT name, value, created_at, updated_at
+		FROM counters
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counters []Counter
+	for rows.Next() {
+		var c Counter
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&c.Name, &c.Value, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = time.Unix(createdAt, 0)
+		c.UpdatedAt = time.Unix(updatedAt, 0)
+		counters = append(counters, c)
+	}
+	return counters, rows.Err()
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+
+	s, err := New(Config{Path: filepath.Join(t.TempDir(), "store.db")})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return s
+}
+
+func testBatch(recipient string, requestIDs ...string) *Batch {
+	now := time.Now()
+	batch := &Batch{Recipient: recipient, CreatedAt: now, FlushAt: now.Add(time.Minute)}
+	for _, id := range requestIDs {
+		batch.Notifications = append(batch.Notifications, QueuedNotification{
+			DataIDs:   [][]byte{[]byte(id)},
+			RequestID: id,
+			QueuedAt:  now,
+		})
+	}
+	return batch
+}
+
+func TestHasRequestID_TracksPendingBatches(t *testing.T) {
+	s := newTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	if err := s.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1", "req-2")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	// A request ID inside another field doesn't count
+	batch := testBatch("bob@oc", "req-3")
+	batch.Notifications[0].Data = map[string]string{"RequestID": "req-9"}
+	if err := s.SaveBatch(ctx, "token2", batch); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	for id, want := range map[string]bool{"req-1": true, "req-2": true, "req-3": true, "req-9": false} {
+		found, err := s.HasRequestID(ctx, id)
+		if err != nil {
+			t.Fatalf("HasRequestID(%q) error = %v", id, err)
+		}
+		if found != want {
+			t.Errorf("HasRequestID(%q) = %v, want %v", id, found, want)
+		}
+	}
+
+	pending, err := s.FindPendingRequest(ctx, "req-2")
+	if err != nil {
+		t.Fatalf("FindPendingRequest() error = %v", err)
+	}
+	if pending == nil || pending.FcmToken != "token1" || pending.Index != 1 {
+		t.Errorf("FindPendingRequest(req-2) = %+v, want token1 at index 1", pending)
+	}
+
+	// Saving the batch without req-1 forgets it
+	if err := s.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-2")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if found, _ := s.HasRequestID(ctx, "req-1"); found {
+		t.Error("HasRequestID(req-1) = true after its notification was removed")
+	}
+
+	if err := s.DeleteBatchAndSetStatus(ctx, "token1", Status{State: StatusSent, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("DeleteBatchAndSetStatus() error = %v", err)
+	}
+	if pending, _ := s.FindPendingRequest(ctx, "req-2"); pending != nil {
+		t.Errorf("FindPendingRequest(req-2) = %+v after delete, want nil", pending)
+	}
+	// Still tracked by its status
+	if found, _ := s.HasRequestID(ctx, "req-2"); !found {
+		t.Error("HasRequestID(req-2) = false, want tracked by its status")
+	}
+}
+
+func TestReserveRequestID(t *testing.T) {
+	s := newTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := s.ReserveRequestID(ctx, "abc", now); err != nil {
+		t.Fatalf("ReserveRequestID() error = %v", err)
+	}
+	if err := s.ReserveRequestID(ctx, "abc", now); !errors.Is(err, ErrRequestIDTaken) {
+		t.Errorf("ReserveRequestID() again error = %v, want %v", err, ErrRequestIDTaken)
+	}
+
+	// The batch takes the reservation over
+	if err := s.SaveBatch(ctx, "token1", testBatch("bob@oc", "abc")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	pending, err := s.FindPendingRequest(ctx, "abc")
+	if err != nil || pending == nil {
+		t.Fatalf("FindPendingRequest() = %+v, %v, want the batch", pending, err)
+	}
+	if err := s.ReserveRequestID(ctx, "abc", now); !errors.Is(err, ErrRequestIDTaken) {
+		t.Errorf("ReserveRequestID() of a pending ID error = %v, want %v", err, ErrRequestIDTaken)
+	}
+
+	// IDs with a status are taken too
+	if err := s.DeleteBatchAndSetStatus(ctx, "token1", Status{State: StatusSent, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("DeleteBatchAndSetStatus() error = %v", err)
+	}
+	if err := s.ReserveRequestID(ctx, "abc", now); !errors.Is(err, ErrRequestIDTaken) {
+		t.Errorf("ReserveRequestID() of an ID with a status error = %v, want %v", err, ErrRequestIDTaken)
+	}
+
+	// Reservations no batch takes over expire
+	if err := s.ReserveRequestID(ctx, "stale", now.Add(-2*reservationTTL)); err != nil {
+		t.Fatalf("ReserveRequestID() error = %v", err)
+	}
+	if _, err := s.CleanupExpiredStatusByState(ctx); err != nil {
+		t.Fatalf("CleanupExpiredStatusByState() error = %v", err)
+	}
+	if err := s.ReserveRequestID(ctx, "stale", now); err != nil {
+		t.Errorf("ReserveRequestID() of an expired reservation error = %v", err)
+	}
+}
+
+func TestMarkLost_SparesRequestsInBatches(t *testing.T) {
+	s := newTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	if err := s.SaveBatch(ctx, "token1", testBatch("bob@oc", "pending")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	queued := Status{State: StatusQueued, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.SetStatus(ctx, "token1", []string{"pending", "orphan"}, queued); err != nil {
+		t.Fatalf("SetStatus() error = %v", err)
+	}
+	// A reservation holds no batch
+	if err := s.ReserveRequestID(ctx, "reserved", time.Now()); err != nil {
+		t.Fatalf("ReserveRequestID() error = %v", err)
+	}
+	if err := s.SetStatus(ctx, "token2", []string{"reserved"}, queued); err != nil {
+		t.Fatalf("SetStatus() error = %v", err)
+	}
+
+	n, err := s.MarkLost(ctx, time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("MarkLost() error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("MarkLost() = %d, want 2", n)
+	}
+	for id, want := range map[string]string{"pending": StatusQueued, "orphan": StatusLost, "reserved": StatusLost} {
+		if status, err := s.GetStatus(ctx, id); err != nil || status.State != want {
+			t.Errorf("GetStatus(%q) = %+v, %v, want %s", id, status, err, want)
+		}
+	}
+}
+
+func TestMarkRequeued_ClaimsOnce(t *testing.T) {
+	s := newTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	if err := s.SaveBatch(ctx, "token1", testBatch("bob@oc", "req-1")); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	if err := s.DeleteBatchAndSetStatus(ctx, "token1", Status{State: StatusFailed, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("DeleteBatchAndSetStatus() error = %v", err)
+	}
+	failed, err := s.LoadFailedSince(ctx, time.Now().Add(-time.Hour))
+	if err != nil || len(failed) != 1 {
+		t.Fatalf("LoadFailedSince() = %v, %v, want one delivery", failed, err)
+	}
+
+	claimed, err := s.MarkRequeued(ctx, failed[0])
+	if err != nil || !claimed {
+		t.Fatalf("MarkRequeued() = %v, %v, want claimed", claimed, err)
+	}
+	if status, _ := s.GetStatus(ctx, "req-1"); status.State != StatusQueued {
+		t.Errorf("GetStatus() = %+v, want %s", status, StatusQueued)
+	}
+
+	// A second requeue of the same delivery leaves it to the first
+	claimed, err = s.MarkRequeued(ctx, failed[0])
+	if err != nil || claimed {
+		t.Errorf("MarkRequeued() again = %v, %v, want not claimed", claimed, err)
+	}
+}
+
+func TestSaveBatch_KeepsOtherOwnersNotifications(t *testing.T) {
+	s := newTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+
+	a := testBatch("bob@oc", "a-1")
+	a.Owner = "gw-a"
+	if err := s.SaveBatch(ctx, "token1", a); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	// Another gateway saves its own view of the token's batch
+	b := testBatch("bob@oc", "b-1")
+	b.Owner = "gw-b"
+	if err := s.SaveBatch(ctx, "token1", b); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+	// The first gateway replaces only its own notifications
+	a = testBatch("bob@oc", "a-2")
+	a.Owner = "gw-a"
+	if err := s.SaveBatch(ctx, "token1", a); err != nil {
+		t.Fatalf("SaveBatch() error = %v", err)
+	}
+
+	batches, err := s.LoadOldestBatches(ctx, 10)
+	if err != nil {
+		t.Fatalf("LoadOldestBatches() error = %v", err)
+	}
+	var got []string
+	for _, notif := range batches["token1"].Notifications {
+		got = append(got, notif.Owner+":"+notif.RequestID)
+	}
+	if strings.Join(got, ",") != "gw-b:b-1,gw-a:a-2" {
+		t.Errorf("batch holds %v, want [gw-b:b-1 gw-a:a-2]", got)
+	}
+	if found, _ := s.HasRequestID(ctx, "b-1"); !found {
+		t.Error("HasRequestID(b-1) = false, want the merged notification indexed")
+	}
+
+	// Each gateway settles only the notifications it sent
+	sent := Status{State: StatusSent, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.DeleteNotificationsAndSetStatus(ctx, "token1", []string{"a-2"}, sent); err != nil {
+		t.Fatalf("DeleteNotificationsAndSetStatus() error = %v", err)
+	}
+	if _, err := s.GetStatus(ctx, "b-1"); err == nil {
+		t.Error("GetStatus(b-1) found a status, want none for the other gateway's notification")
+	}
+	pending, err := s.FindPendingRequest(ctx, "b-1")
+	if err != nil || pending == nil || pending.Index != 0 {
+		t.Errorf("FindPendingRequest(b-1) = %+v, %v, want token1 at index 0", pending, err)
+	}
+	if status, err := s.GetStatus(ctx, "a-2"); err != nil || status.State != StatusSent {
+		t.Errorf("GetStatus(a-2) = %+v, %v, want %s", status, err, StatusSent)
+	}
+
+	if err := s.DeleteNotificationsAndSetStatus(ctx, "token1", []string{"b-1"}, sent); err != nil {
+		t.Fatalf("DeleteNotificationsAndSetStatus() error = %v", err)
+	}
+	if batches, _ := s.LoadOldestBatches(ctx, 10); len(batches) != 0 {
+		t.Errorf("LoadOldestBatches() = %v, want the emptied batch deleted", keys(batches))
+	}
+}
@@ -0,0 +1,163 @@
+// Package visible renders OS-displayed notification text for recipients,
+// localized by the locale each user publishes in OurCloud.
+package visible
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// localeCacheTTL is how long a recipient's locale is reused before re-reading it.
+const localeCacheTTL = 10 * time.Minute
+
+// maxLocaleCacheEntries caps the recipients whose locale a Renderer caches.
+const maxLocaleCacheEntries = 10000
+
+// LocaleSource looks up a user's preferred locale. It returns "" and no
+// error for a user without a preference; errors are treated as transient.
+type LocaleSource interface {
+	GetLocale(ctx context.Context, username string) (string, error)
+}
+
+// Template is the title and body text for one locale.
+// Both are text/template strings; see Data for the available fields.
+type Template struct {
+	Title string
+	Body  string
+}
+
+// Data is passed to templates when rendering.
+type Data struct {
+	Recipient string // e.g. "alice@oc"
+	Count     int    // number of data IDs in the notification
+}
+
+// Renderer renders localized notification text.
+type Renderer struct {
+	locales       LocaleSource
+	defaultLocale string
+	templates     map[string]*parsedTemplate
+	now           func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedLocale
+}
+
+type parsedTemplate struct {
+	title *template.Template
+	body  *template.Template
+}
+
+type cachedLocale struct {
+	locale    string
+	expiresAt time.Time
+}
+
+// NewRenderer parses templates, keyed by locale tag (e.g. "en", "de-AT").
+// defaultLocale must have a template; it is used when the recipient has no
+// locale preference or none of their locale's templates exist.
+func NewRenderer(locales LocaleSource, defaultLocale string, templates map[string]Template) (*Renderer, error) {
+	r := &Renderer{
+		locales:       locales,
+		defaultLocale: strings.ToLower(defaultLocale),
+		templates:     make(map[string]*parsedTemplate, len(templates)),
+		now:           time.Now,
+		cache:         make(map[string]cachedLocale),
+	}
+
+	for locale, t := range templates {
+		title, err := template.New(locale + " title").Parse(t.Title)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s title template: %w", locale, err)
+		}
+		body, err := template.New(locale + " body").Parse(t.Body)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s body template: %w", locale, err)
+		}
+		r.templates[strings.ToLower(locale)] = &parsedTemplate{title: title, body: body}
+	}
+
+	if _, ok := r.templates[r.defaultLocale]; !ok {
+		return nil, fmt.Errorf("no template for default locale %q", defaultLocale)
+	}
+
+	return r, nil
+}
+
+// Render returns the notification title and body for recipient.
+// Locale lookup failures fall back to the default locale.
+func (r *Renderer) Render(ctx context.Context, recipient string, count int) (title, body string, err error) {
+	t := r.templateFor(r.localeOf(ctx, recipient))
+	data := Data{Recipient: recipient, Count: count}
+
+	var buf bytes.Buffer
+	if err := t.title.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("rendering title: %w", err)
+	}
+	title = buf.String()
+
+	buf.Reset()
+	if err := t.body.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("rendering body: %w", err)
+	}
+	return title, buf.String(), nil
+}
+
+// localeOf returns recipient's locale, or "" if unknown. Failed lookups
+// aren't cached, so the next notification tries again.
+func (r *Renderer) localeOf(ctx context.Context, recipient string) string {
+	now := r.now()
+
+	r.mu.Lock()
+	cached, ok := r.cache[recipient]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.locale
+	}
+
+	locale, err := r.locales.GetLocale(ctx, recipient)
+	if err != nil {
+		return ""
+	}
+	r.remember(recipient, locale, now)
+	return locale
+}
+
+// remember caches recipient's locale. A full cache drops its expired
+// entries first, and all of them if none had expired.
+func (r *Renderer) remember(recipient, locale string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= maxLocaleCacheEntries {
+		for k, c := range r.cache {
+			if !now.Before(c.expiresAt) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxLocaleCacheEntries {
+			clear(r.cache)
+		}
+	}
+	r.cache[recipient] = cachedLocale{locale: locale, expiresAt: now.Add(localeCacheTTL)}
+}
+
+// templateFor picks the template for locale, trying the full tag, then the
+// base language, then the default locale.
+func (r *Renderer) templateFor(locale string) *parsedTemplate {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if t, ok := r.templates[locale]; ok {
+		return t
+	}
+	if base, _, found := strings.Cut(locale, "-"); found {
+		if t, ok := r.templates[base]; ok {
+			return t
+		}
+	}
+	return r.templates[r.defaultLocale]
+}
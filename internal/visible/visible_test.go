@@ -0,0 +1,140 @@
+package visible
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// mockLocales returns configured locales and counts lookups. Users without
+// a locale have no preference; users in fail can't be looked up.
+type mockLocales struct {
+	locales map[string]string
+	fail    map[string]bool
+	lookups int
+}
+
+func (m *mockLocales) GetLocale(ctx context.Context, username string) (string, error) {
+	m.lookups++
+	if m.fail[username] {
+		return "", errors.New("OurCloud unavailable")
+	}
+	return m.locales[username], nil
+}
+
+func newTestRenderer(t *testing.T, locales LocaleSource) *Renderer {
+	t.Helper()
+	r, err := NewRenderer(locales, "en", map[string]Template{
+		"en":    {Title: "New activity", Body: "{{.Count}} new updates"},
+		"de":    {Title: "Neue Aktivität", Body: "{{.Count}} neue Updates"},
+		"pt-BR": {Title: "Nova atividade", Body: "{{.Count}} novas atualizações"},
+	})
+	if err != nil {
+		t.Fatalf("NewRenderer() error = %v", err)
+	}
+	return r
+}
+
+func TestRender_LocaleFallback(t *testing.T) {
+	locales := &mockLocales{locales: map[string]string{
+		"anna@oc":   "de-AT",
+		"joao@oc":   "pt_BR",
+		"pierre@oc": "fr",
+	}}
+	r := newTestRenderer(t, locales)
+
+	tests := []struct {
+		recipient string
+		wantTitle string
+		wantBody  string
+	}{
+		{recipient: "anna@oc", wantTitle: "Neue Aktivität", wantBody: "3 neue Updates"},
+		{recipient: "joao@oc", wantTitle: "Nova atividade", wantBody: "3 novas atualizações"},
+		{recipient: "pierre@oc", wantTitle: "New activity", wantBody: "3 new updates"},
+		{recipient: "nobody@oc", wantTitle: "New activity", wantBody: "3 new updates"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.recipient, func(t *testing.T) {
+			title, body, err := r.Render(context.Background(), tt.recipient, 3)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if title != tt.wantTitle || body != tt.wantBody {
+				t.Errorf("Render() = (%q, %q), want (%q, %q)", title, body, tt.wantTitle, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRender_CachesLocale(t *testing.T) {
+	locales := &mockLocales{locales: map[string]string{"anna@oc": "de"}}
+	r := newTestRenderer(t, locales)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := r.Render(context.Background(), "anna@oc", 1); err != nil {
+			t.Fatalf("Render() error = %v", err)
+		}
+	}
+	if locales.lookups != 1 {
+		t.Errorf("lookups = %d, want 1", locales.lookups)
+	}
+}
+
+func TestNewRenderer_Errors(t *testing.T) {
+	if _, err := NewRenderer(&mockLocales{}, "en", map[string]Template{"de": {Title: "x", Body: "y"}}); err == nil {
+		t.Error("expected error when default locale has no template")
+	}
+	if _, err := NewRenderer(&mockLocales{}, "en", map[string]Template{"en": {Title: "{{.Count", Body: "y"}}); err == nil {
+		t.Error("expected error for malformed template")
+	}
+}
+
+func TestRender_DoesNotCacheFailures(t *testing.T) {
+	locales := &mockLocales{locales: map[string]string{"anna@oc": "de"}, fail: map[string]bool{"anna@oc": true}}
+	r := newTestRenderer(t, locales)
+
+	// The failed lookup falls back to the default locale
+	if title, _, _ := r.Render(context.Background(), "anna@oc", 1); title != "New activity" {
+		t.Errorf("Render() title = %q during the outage, want the default locale", title)
+	}
+
+	delete(locales.fail, "anna@oc")
+	if title, _, _ := r.Render(context.Background(), "anna@oc", 1); title != "Neue Aktivität" {
+		t.Errorf("Render() title = %q after the outage, want the recipient's locale", title)
+	}
+	if locales.lookups != 2 {
+		t.Errorf("lookups = %d, want 2", locales.lookups)
+	}
+}
+
+func TestRender_CacheIsBounded(t *testing.T) {
+	r := newTestRenderer(t, &mockLocales{})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < maxLocaleCacheEntries; i++ {
+		r.localeOf(context.Background(), fmt.Sprintf("user%d@oc", i))
+	}
+	if len(r.cache) != maxLocaleCacheEntries {
+		t.Fatalf("cache holds %d entries, want %d", len(r.cache), maxLocaleCacheEntries)
+	}
+
+	// Once the entries expire, the next lookup sweeps them out
+	now = now.Add(localeCacheTTL)
+	r.localeOf(context.Background(), "late@oc")
+	if len(r.cache) != 1 {
+		t.Errorf("cache holds %d entries after the sweep, want 1", len(r.cache))
+	}
+
+	// A full cache of live entries is dropped rather than grown
+	for i := 0; len(r.cache) < maxLocaleCacheEntries; i++ {
+		r.localeOf(context.Background(), fmt.Sprintf("user%d@oc", i))
+	}
+	r.localeOf(context.Background(), "overflow@oc")
+	if len(r.cache) > maxLocaleCacheEntries {
+		t.Errorf("cache holds %d entries, want at most %d", len(r.cache), maxLocaleCacheEntries)
+	}
+}
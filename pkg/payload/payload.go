@@ -0,0 +1,275 @@
+// Package payload encodes and decodes the payload of the gateway's FCM data
+// messages: a DataUpdateNotification listing the data IDs to sync, sent
+// base64-encoded under Key, or sealed to the recipient's crypt key under
+// SealedKey.
+//
+// The gateway encodes every payload with this package, so it is the
+// reference for the format. Apps can also bind it with gomobile:
+//
+//	gomobile bind -target=android ./pkg/payload
+//
+// gomobile can't pass [][]byte or maps, so Decode and Open return a
+// *Notification read through its methods. Functions taking those types are
+// skipped by the binding and are for Go callers.
+//
+// Later payload variants, such as compressed ones, get a data key of their
+// own, so apps can tell them apart from the data map alone.
+package payload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Key is the FCM data key carrying the base64 payload, unless the gateway
+// is configured with a payload schema naming another.
+const Key = "payload"
+
+// SealedKey is the FCM data key carrying the base64 payload sealed to the
+// recipient's public crypt key. It replaces Key, so apps can tell the two
+// apart.
+const SealedKey = "sealed_payload"
+
+// CryptKeySize is the size of an X25519 crypt key, public or private.
+const CryptKeySize = 32
+
+// SenderHashLength is the length of a SenderHash, enough to tell a user's
+// contacts apart while keeping the payload small.
+const SenderHashLength = 16
+
+// MaxProvenanceSize bounds the payload with provenance added. Its base64
+// form must fit FCM's 4KB data limit alongside the other keys.
+const MaxProvenanceSize = 2800
+
+// dataSendersField is the DataUpdateNotification field carrying provenance:
+//
+//	message DataSender {
+//	  bytes data_id = 1;
+//	  bytes sender_hash = 2; // SenderHash of the pushing username
+//	}
+//	repeated DataSender data_senders = 2;
+//
+// ourcloud-proto doesn't define it yet, so it is encoded by hand. Apps built
+// against the current definition skip it as an unknown field.
+const dataSendersField = 2
+
+// ErrCannotOpen is returned by Open when the sealed payload wasn't sealed
+// to the given key pair, or was altered.
+var ErrCannotOpen = errors.New("sealed payload can't be opened with this key pair")
+
+// SenderHash returns the hash identifying sender in provenance. It is the
+// first 16 bytes of the SHA-256 of the username, so the receiving app can
+// compute it for its contacts.
+func SenderHash(sender string) []byte {
+	sum := sha256.Sum256([]byte(sender))
+	return sum[:SenderHashLength]
+}
+
+// Marshal returns the DataUpdateNotification carrying dataIDs, without
+// provenance.
+func Marshal(dataIDs [][]byte) ([]byte, error) {
+	raw, err := proto.Marshal(&pb.DataUpdateNotification{DataIds: dataIDs})
+	if err != nil {
+		return nil, fmt.Errorf("marshaling notification: %w", err)
+	}
+	return raw, nil
+}
+
+// AppendProvenance appends a data_senders entry to the marshaled
+// DataUpdateNotification raw for each of dataIDs with a sender in senders,
+// which maps data IDs, as strings, to usernames. If the result would be
+// larger than MaxProvenanceSize, raw is returned unchanged with false.
+func AppendProvenance(raw []byte, dataIDs [][]byte, senders map[string]string) ([]byte, bool) {
+	out := raw
+	hashes := make(map[string][]byte)
+	for _, id := range dataIDs {
+		sender, ok := senders[string(id)]
+		if !ok {
+			continue
+		}
+		hash, ok := hashes[sender]
+		if !ok {
+			hash = SenderHash(sender)
+			hashes[sender] = hash
+		}
+
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, id)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, hash)
+
+		out = protowire.AppendTag(out, dataSendersField, protowire.BytesType)
+		out = protowire.AppendBytes(out, entry)
+	}
+
+	if len(out) > MaxProvenanceSize {
+		return raw, false
+	}
+	return out, true
+}
+
+// Encode returns the base64 payload carrying dataIDs, as sent under Key.
+// senders, when set, maps data IDs to the usernames that pushed them (see
+// AppendProvenance).
+func Encode(dataIDs [][]byte, senders map[string]string) (string, error) {
+	raw, err := Marshal(dataIDs)
+	if err != nil {
+		return "", err
+	}
+	if len(senders) > 0 {
+		raw, _ = AppendProvenance(raw, dataIDs, senders)
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Seal seals the marshaled payload raw to publicKey, the recipient's X25519
+// public crypt key, and returns it base64-encoded, as sent under SealedKey.
+// This is libsodium's crypto_box_seal, so the app can open it with
+// crypto_box_seal_open instead of Open. Sealing adds 48 bytes: an ephemeral
+// public key and a MAC.
+func Seal(raw, publicKey []byte) (string, error) {
+	if len(publicKey) != CryptKeySize {
+		return "", fmt.Errorf("public crypt key is %d bytes, want %d", len(publicKey), CryptKeySize)
+	}
+	sealed, err := box.SealAnonymous(nil, raw, (*[CryptKeySize]byte)(publicKey), rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("sealing payload: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decode parses the base64 payload sent under Key.
+func Decode(encoded string) (*Notification, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	return Unmarshal(raw)
+}
+
+// Open opens and parses the base64 payload sent under SealedKey, using the
+// recipient's X25519 crypt key pair.
+func Open(sealed string, publicKey, privateKey []byte) (*Notification, error) {
+	if len(publicKey) != CryptKeySize || len(privateKey) != CryptKeySize {
+		return nil, fmt.Errorf("crypt keys are %d and %d bytes, want %d", len(publicKey), len(privateKey), CryptKeySize)
+	}
+	box64, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decoding sealed payload: %w", err)
+	}
+	raw, ok := box.OpenAnonymous(nil, box64, (*[CryptKeySize]byte)(publicKey), (*[CryptKeySize]byte)(privateKey))
+	if !ok {
+		return nil, ErrCannotOpen
+	}
+	return Unmarshal(raw)
+}
+
+// Unmarshal parses a marshaled DataUpdateNotification, with its
+// provenance if present. Unknown fields other than provenance are ignored,
+// as the app's generated code would.
+func Unmarshal(raw []byte) (*Notification, error) {
+	var msg pb.DataUpdateNotification
+	if err := proto.Unmarshal(raw, &msg); err != nil {
+		return nil, fmt.Errorf("unmarshaling notification: %w", err)
+	}
+
+	n := &Notification{dataIDs: msg.DataIds}
+	unknown := msg.ProtoReflect().GetUnknown()
+	for len(unknown) > 0 {
+		num, typ, size := protowire.ConsumeTag(unknown)
+		if size < 0 {
+			return nil, fmt.Errorf("unmarshaling notification: %w", protowire.ParseError(size))
+		}
+		unknown = unknown[size:]
+		if num != dataSendersField || typ != protowire.BytesType {
+			size = protowire.ConsumeFieldValue(num, typ, unknown)
+			if size < 0 {
+				return nil, fmt.Errorf("unmarshaling notification: %w", protowire.ParseError(size))
+			}
+			unknown = unknown[size:]
+			continue
+		}
+		entry, size := protowire.ConsumeBytes(unknown)
+		if size < 0 {
+			return nil, fmt.Errorf("unmarshaling data_senders: %w", protowire.ParseError(size))
+		}
+		unknown = unknown[size:]
+
+		id, hash, err := parseDataSender(entry)
+		if err != nil {
+			return nil, err
+		}
+		if n.senders == nil {
+			n.senders = make(map[string][]byte)
+		}
+		n.senders[string(id)] = hash
+	}
+	return n, nil
+}
+
+// parseDataSender parses one data_senders entry.
+func parseDataSender(entry []byte) (id, hash []byte, err error) {
+	for len(entry) > 0 {
+		num, typ, size := protowire.ConsumeTag(entry)
+		if size < 0 {
+			return nil, nil, fmt.Errorf("unmarshaling data_senders: %w", protowire.ParseError(size))
+		}
+		entry = entry[size:]
+		if typ != protowire.BytesType {
+			size = protowire.ConsumeFieldValue(num, typ, entry)
+		} else {
+			var v []byte
+			v, size = protowire.ConsumeBytes(entry)
+			switch num {
+			case 1:
+				id = v
+			case 2:
+				hash = v
+			}
+		}
+		if size < 0 {
+			return nil, nil, fmt.Errorf("unmarshaling data_senders: %w", protowire.ParseError(size))
+		}
+		entry = entry[size:]
+	}
+	return id, hash, nil
+}
+
+// Notification is a decoded payload.
+type Notification struct {
+	dataIDs [][]byte
+	senders map[string][]byte // data ID -> SenderHash
+}
+
+// Len returns the number of data IDs to sync.
+func (n *Notification) Len() int {
+	return len(n.dataIDs)
+}
+
+// DataID returns the i'th data ID, or nil if i is out of range.
+func (n *Notification) DataID(i int) []byte {
+	if i < 0 || i >= len(n.dataIDs) {
+		return nil
+	}
+	return n.dataIDs[i]
+}
+
+// DataIDs returns the data IDs to sync.
+func (n *Notification) DataIDs() [][]byte {
+	return n.dataIDs
+}
+
+// SenderHash returns the SenderHash of the user who pushed dataID, or nil
+// if the payload doesn't say.
+func (n *Notification) SenderHash(dataID []byte) []byte {
+	return n.senders[string(dataID)]
+}
@@ -0,0 +1,130 @@
+package payload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	dataIDs := [][]byte{{0x01}, {0x02}, {0x03}}
+	encoded, err := Encode(dataIDs, map[string]string{
+		"\x01": "alice@oc",
+		"\x02": "bob@oc",
+	})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	n, err := Decode(encoded)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if n.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", n.Len())
+	}
+	for i, id := range dataIDs {
+		if got := n.DataID(i); !bytes.Equal(got, id) {
+			t.Errorf("DataID(%d) = %x, want %x", i, got, id)
+		}
+	}
+	if got := n.DataID(3); got != nil {
+		t.Errorf("DataID(3) = %x, want nil past the end", got)
+	}
+	if got := n.SenderHash([]byte{0x01}); !bytes.Equal(got, SenderHash("alice@oc")) {
+		t.Errorf("SenderHash(0x01) = %x, want %x", got, SenderHash("alice@oc"))
+	}
+	if got := n.SenderHash([]byte{0x02}); !bytes.Equal(got, SenderHash("bob@oc")) {
+		t.Errorf("SenderHash(0x02) = %x, want %x", got, SenderHash("bob@oc"))
+	}
+	if got := n.SenderHash([]byte{0x03}); got != nil {
+		t.Errorf("SenderHash(0x03) = %x, want nil for a data ID without a sender", got)
+	}
+}
+
+func TestEncode_ReadableWithoutProvenanceSupport(t *testing.T) {
+	encoded, err := Encode([][]byte{{0x01}}, map[string]string{"\x01": "alice@oc"})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+
+	var notification pb.DataUpdateNotification
+	if err := proto.Unmarshal(raw, &notification); err != nil {
+		t.Fatalf("generated code can't parse the payload: %v", err)
+	}
+	if len(notification.DataIds) != 1 || !bytes.Equal(notification.DataIds[0], []byte{0x01}) {
+		t.Errorf("DataIds = %x, want [01]", notification.DataIds)
+	}
+}
+
+func TestAppendProvenance_TooLarge(t *testing.T) {
+	dataIDs := make([][]byte, 60)
+	senders := make(map[string]string)
+	for i := range dataIDs {
+		dataIDs[i] = make([]byte, 32)
+		dataIDs[i][0] = byte(i)
+		senders[string(dataIDs[i])] = "alice@oc"
+	}
+	raw, err := Marshal(dataIDs)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	out, ok := AppendProvenance(raw, dataIDs, senders)
+	if ok || !bytes.Equal(out, raw) {
+		t.Errorf("AppendProvenance() = %d bytes, %v; want the payload unchanged and false", len(out), ok)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	dataIDs := [][]byte{{0x01, 0x02}, {0x03}}
+	raw, err := Marshal(dataIDs)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+
+	sealed, err := Seal(raw, publicKey[:])
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	n, err := Open(sealed, publicKey[:], privateKey[:])
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if n.Len() != 2 || !bytes.Equal(n.DataID(0), dataIDs[0]) {
+		t.Errorf("DataIDs() = %x, want %x", n.DataIDs(), dataIDs)
+	}
+
+	otherPublic, otherPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	if _, err := Open(sealed, otherPublic[:], otherPrivate[:]); !errors.Is(err, ErrCannotOpen) {
+		t.Errorf("Open() with another key pair error = %v, want ErrCannotOpen", err)
+	}
+	if _, err := Seal(raw, []byte("short")); err == nil {
+		t.Error("Seal() accepted a 5-byte key")
+	}
+}
+
+func TestDecode_Invalid(t *testing.T) {
+	for _, encoded := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte{0x0a, 0x05, 0x01})} {
+		if _, err := Decode(encoded); err == nil {
+			t.Errorf("Decode(%q) succeeded, want an error", encoded)
+		}
+	}
+}
@@ -12,8 +12,12 @@ mkdir -p "$OUT_DIR"
 echo "=== Building binaries ==="
 cd "$PROJECT_ROOT"
 
+COMMIT="$(git rev-parse HEAD 2>/dev/null || echo unknown)"
+BUILD_TIME="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+LDFLAGS="-X main.commit=$COMMIT -X main.buildTime=$BUILD_TIME"
+
 echo "Building pushserver..."
-go build -o "$OUT_DIR/pushserver" ./cmd/pushserver
+go build -ldflags "$LDFLAGS" -o "$OUT_DIR/pushserver" ./cmd/pushserver
 
 echo "Building ourcloud-stub..."
 go build -o "$OUT_DIR/ourcloud-stub" ./cmd/stubs/ourcloud-stub
@@ -21,6 +25,15 @@ go build -o "$OUT_DIR/ourcloud-stub" ./cmd/stubs/ourcloud-stub
 echo "Building fcm-stub..."
 go build -o "$OUT_DIR/fcm-stub" ./cmd/stubs/fcm-stub
 
+echo "Building genfixtures..."
+go build -o "$OUT_DIR/genfixtures" ./cmd/genfixtures
+
+echo "Building soaktest..."
+go build -o "$OUT_DIR/soaktest" ./cmd/soaktest
+
+echo "Building replay..."
+go build -o "$OUT_DIR/replay" ./cmd/replay
+
 echo ""
 echo "Build complete. Binaries in $OUT_DIR:"
 ls -la "$OUT_DIR/"
@@ -0,0 +1,49 @@
+#!/bin/bash
+# Build release binaries and a multi-arch container image.
+#
+# SQLite needs CGO, so each architecture is built natively under emulation
+# by docker buildx rather than cross-compiled. One-time setup on a new host:
+#   docker run --privileged --rm tonistiigi/binfmt --install all
+#   docker buildx create --use
+#
+# Usage: scripts/release.sh [image]
+#   Writes dist/pushserver-<os>-<arch> for each platform. With an image name
+#   (e.g. registry.example.com/pushserver:v1.2.0), also pushes the image.
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+PROJECT_ROOT="$(cd "$SCRIPT_DIR/.." && pwd)"
+DIST_DIR="$PROJECT_ROOT/dist"
+
+PLATFORMS="${PLATFORMS:-linux/amd64,linux/arm64,linux/arm/v7}"
+IMAGE="$1"
+
+cd "$PROJECT_ROOT"
+
+COMMIT="$(git rev-parse HEAD 2>/dev/null || echo unknown)"
+BUILD_TIME="$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+BUILD_ARGS=(--build-arg "COMMIT=$COMMIT" --build-arg "BUILD_TIME=$BUILD_TIME")
+
+echo "=== Building binaries for $PLATFORMS ==="
+rm -rf "$DIST_DIR"
+docker buildx build --platform "$PLATFORMS" "${BUILD_ARGS[@]}" \
+    --target binary --output "type=local,dest=$DIST_DIR" .
+
+# buildx writes one directory per platform, e.g. dist/linux_arm_v7/pushserver
+for dir in "$DIST_DIR"/*/; do
+    platform="$(basename "$dir")"
+    mv "$dir/pushserver" "$DIST_DIR/pushserver-${platform//_/-}"
+    rmdir "$dir"
+done
+(cd "$DIST_DIR" && sha256sum pushserver-* > SHA256SUMS)
+
+if [ -n "$IMAGE" ]; then
+    echo "=== Building and pushing $IMAGE ==="
+    docker buildx build --platform "$PLATFORMS" "${BUILD_ARGS[@]}" \
+        --tag "$IMAGE" --push .
+fi
+
+echo ""
+echo "=== Release artifacts ==="
+ls -l "$DIST_DIR"
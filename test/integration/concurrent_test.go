@@ -0,0 +1,190 @@
+//go:build integration
+
+package integration
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/test/integration/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+// concurrentGatewayPort is where TestConcurrentBidirectionalPushes runs its
+// own gateway, so batches left by other tests can't skew its counts.
+const concurrentGatewayPort = 8087
+
+const (
+	concurrentPushes  = 200 // per direction
+	concurrentWorkers = 8   // goroutines pushing in each direction
+
+	// batch.window and batch.max_size in config.yaml
+	batchWindow  = 100 * time.Millisecond
+	maxBatchSize = 10
+)
+
+// TestConcurrentBidirectionalPushes has alice and bob push to each other at
+// once from several goroutines each, and checks every data ID reaches each of
+// the target's devices exactly once, batched, without ever landing on another
+// user's token
+func TestConcurrentBidirectionalPushes(t *testing.T) {
+	clearFCMCaptures(t)
+
+	gw := testutil.NewGateway("config.yaml", concurrentGatewayPort,
+		"PUSHSERVER_STORAGE_PATH="+filepath.Join(t.TempDir(), "concurrent.db"),
+	)
+	if err := gw.Start(); err != nil {
+		t.Fatalf("failed to start gateway: %v", err)
+	}
+	defer gw.Stop()
+
+	// The first byte of each data ID tells the directions apart
+	directions := []struct {
+		sender, target string
+		tag            byte
+		tokens         []string
+	}{
+		{"bob@oc", "alice@oc", 0xA0, []string{"fcm-token-alice-phone", "fcm-token-alice-tablet"}},
+		{"alice@oc", "bob@oc", 0xB0, []string{"fcm-token-bob-phone"}},
+	}
+
+	start := time.Now()
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		requestIDs []string
+		errs       []error
+	)
+	for _, d := range directions {
+		for w := range concurrentWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := w; i < concurrentPushes; i += concurrentWorkers {
+					resp, err := pushTo(gw.URL, d.sender, d.target, [][]byte{{d.tag, byte(i >> 8), byte(i)}})
+					if err == nil && !resp.Accepted {
+						err = fmt.Errorf("push %d from %s not accepted: %s", i, d.sender, resp.Message)
+					}
+
+					mu.Lock()
+					if err != nil {
+						errs = append(errs, err)
+					} else {
+						requestIDs = append(requestIDs, resp.RequestId)
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if len(errs) > 0 {
+		t.FailNow()
+	}
+
+	// Every request is sent
+	deadline := time.Now().Add(10 * time.Second)
+	for _, id := range requestIDs {
+		if state := awaitFinalState(t, gw.URL, id, deadline); state != "sent" {
+			t.Errorf("state of %s = %q, want sent", id, state)
+		}
+	}
+	elapsed := time.Since(start)
+
+	tagOf := make(map[string]byte)
+	for _, d := range directions {
+		for _, token := range d.tokens {
+			tagOf[token] = d.tag
+		}
+	}
+	calls := make(map[string]int)
+	delivered := make(map[string]map[string]int) // by token, then data ID
+	for _, msg := range getFCMCaptures(t).Messages {
+		tag, ok := tagOf[msg.Token]
+		if !ok {
+			t.Errorf("FCM call to unexpected token %s", msg.Token)
+			continue
+		}
+		calls[msg.Token]++
+		dataIDs := decodePayload(t, msg)
+		if delivered[msg.Token] == nil {
+			delivered[msg.Token] = make(map[string]int)
+		}
+		for _, id := range dataIDs {
+			if len(id) == 0 || id[0] != tag {
+				t.Errorf("FCM call to %s carried data ID %x pushed to another user", msg.Token, id)
+			}
+			delivered[msg.Token][string(id)]++
+		}
+	}
+
+	// A batch is flushed either on filling to max_size, or by its timer a
+	// window after it started. One token's batches follow each other, so at
+	// most one timed flush fits in each window.
+	maxCalls := concurrentPushes/maxBatchSize + int(elapsed/batchWindow) + 1
+	for _, d := range directions {
+		for _, token := range d.tokens {
+			if calls[token] > maxCalls {
+				t.Errorf("%d FCM calls to %s in %s, want at most %d", calls[token], token, elapsed, maxCalls)
+			}
+			for i := range concurrentPushes {
+				id := string([]byte{d.tag, byte(i >> 8), byte(i)})
+				if n := delivered[token][id]; n != 1 {
+					t.Errorf("data ID %x delivered to %s %d times, want once", id, token, n)
+				}
+			}
+		}
+	}
+}
+
+// decodePayload returns the data IDs in a captured FCM message's payload.
+func decodePayload(t *testing.T, msg fcmMessage) [][]byte {
+	t.Helper()
+
+	raw, err := base64.StdEncoding.DecodeString(msg.Data["payload"])
+	if err != nil {
+		t.Fatalf("FCM call to %s has an undecodable payload: %v", msg.Token, err)
+	}
+	var notification pb.DataUpdateNotification
+	if err := proto.Unmarshal(raw, &notification); err != nil {
+		t.Fatalf("FCM call to %s has an unparseable payload: %v", msg.Token, err)
+	}
+	return notification.DataIds
+}
+
+// awaitFinalState polls requestID's status until it is no longer pending or
+// deadline passes, and returns its state. Requests not yet flushed may have
+// no status.
+func awaitFinalState(t *testing.T, baseURL, requestID string, deadline time.Time) string {
+	t.Helper()
+
+	for {
+		httpResp, err := http.Get(baseURL + "/status/" + requestID)
+		if err != nil {
+			t.Fatalf("status request failed: %v", err)
+		}
+		var status statusResponse
+		if httpResp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(httpResp.Body).Decode(&status); err != nil {
+				t.Fatalf("failed to decode status response: %v", err)
+			}
+		}
+		httpResp.Body.Close()
+
+		pending := status.State == "" || status.State == "queued"
+		if !pending || time.Now().After(deadline) {
+			return status.State
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -147,6 +147,33 @@ func TestStatusAfterFlush(t *testing.T) {
 	}
 }
 
+// TestFCMErrorCodes tests that FCM v1 error responses are classified by the
+// Admin SDK and reported in the status as they would be in production
+func TestFCMErrorCodes(t *testing.T) {
+	// UNREGISTERED is left out: it would mark bob's token invalid for the
+	// tests that follow
+	for _, code := range []string{"INVALID_ARGUMENT", "SENDER_ID_MISMATCH", "QUOTA_EXCEEDED", "THIRD_PARTY_AUTH_ERROR", "INTERNAL"} {
+		t.Run(code, func(t *testing.T) {
+			failFCMSend(t, code, "fcm-token-bob-phone")
+
+			resp := sendPush(t, "alice@oc", "bob@oc", [][]byte{{0xEE}})
+			if !resp.Accepted {
+				t.Fatalf("request not accepted: %s", resp.Message)
+			}
+
+			time.Sleep(300 * time.Millisecond)
+
+			status := getStatus(t, resp.RequestId)
+			if status.State != "failed" {
+				t.Errorf("expected state=failed, got %s", status.State)
+			}
+			if status.ErrorCode != code {
+				t.Errorf("expected error_code=%s, got %q", code, status.ErrorCode)
+			}
+		})
+	}
+}
+
 // TestStatusNotFound tests status endpoint for unknown request
 func TestStatusNotFound(t *testing.T) {
 	httpResp, err := http.Get(gatewayURL + "/status/nonexistent-request-id")
@@ -189,7 +216,23 @@ func TestHealthEndpoint(t *testing.T) {
 
 func sendPush(t *testing.T, sender, target string, dataIDs [][]byte) *pb.PushResponse {
 	t.Helper()
+	return sendPushTo(t, gatewayURL, sender, target, dataIDs)
+}
+
+// sendPushTo is sendPush against the gateway at baseURL.
+func sendPushTo(t *testing.T, baseURL, sender, target string, dataIDs [][]byte) *pb.PushResponse {
+	t.Helper()
 
+	resp, err := pushTo(baseURL, sender, target, dataIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// pushTo is sendPushTo returning an error instead of failing the test, for
+// pushing from several goroutines.
+func pushTo(baseURL, sender, target string, dataIDs [][]byte) (*pb.PushResponse, error) {
 	pushReq := &pb.PushRequest{
 		SenderUsername: sender,
 		TargetUsername: target,
@@ -199,31 +242,31 @@ func sendPush(t *testing.T, sender, target string, dataIDs [][]byte) *pb.PushRes
 
 	// Sign the request with the sender's private key
 	if err := testutil.SignPushRequest(pushReq); err != nil {
-		t.Fatalf("failed to sign PushRequest: %v", err)
+		return nil, fmt.Errorf("failed to sign PushRequest: %v", err)
 	}
 
 	body, err := proto.Marshal(pushReq)
 	if err != nil {
-		t.Fatalf("failed to marshal PushRequest: %v", err)
+		return nil, fmt.Errorf("failed to marshal PushRequest: %v", err)
 	}
 
-	httpResp, err := http.Post(gatewayURL+"/push", "application/x-protobuf", bytes.NewReader(body))
+	httpResp, err := http.Post(baseURL+"/push", "application/x-protobuf", bytes.NewReader(body))
 	if err != nil {
-		t.Fatalf("push request failed: %v", err)
+		return nil, fmt.Errorf("push request failed: %v", err)
 	}
 	defer httpResp.Body.Close()
 
 	respBody, err := io.ReadAll(httpResp.Body)
 	if err != nil {
-		t.Fatalf("failed to read response: %v", err)
+		return nil, fmt.Errorf("failed to read response: %v", err)
 	}
 
 	var resp pb.PushResponse
 	if err := proto.Unmarshal(respBody, &resp); err != nil {
-		t.Fatalf("failed to unmarshal PushResponse: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal PushResponse: %v", err)
 	}
 
-	return &resp
+	return &resp, nil
 }
 
 type statusResponse struct {
@@ -231,12 +274,19 @@ type statusResponse struct {
 	SentAt    int64  `json:"sent_at,omitempty"`
 	ExpiresAt int64  `json:"expires_at,omitempty"`
 	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
 }
 
 func getStatus(t *testing.T, requestID string) *statusResponse {
 	t.Helper()
+	return getStatusFrom(t, gatewayURL, requestID)
+}
 
-	httpResp, err := http.Get(gatewayURL + "/status/" + requestID)
+// getStatusFrom is getStatus against the gateway at baseURL.
+func getStatusFrom(t *testing.T, baseURL, requestID string) *statusResponse {
+	t.Helper()
+
+	httpResp, err := http.Get(baseURL + "/status/" + requestID)
 	if err != nil {
 		t.Fatalf("status request failed: %v", err)
 	}
@@ -292,6 +342,21 @@ func clearFCMCaptures(t *testing.T) {
 	httpResp.Body.Close()
 }
 
+// failFCMSend makes fcm-stub fail the next send to token with an FCM error code.
+func failFCMSend(t *testing.T, code, token string) {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]interface{}{"code": code, "token": token})
+	httpResp, err := http.Post(fcmStubURL+"/fail-next", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to configure FCM failure: %v", err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatalf("fail-next returned %d", httpResp.StatusCode)
+	}
+}
+
 func init() {
 	// Give services a moment to be ready when tests start
 	fmt.Println("Integration tests starting - services should be running")
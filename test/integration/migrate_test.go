@@ -0,0 +1,147 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/store"
+	"github.com/wurp/ourcloud-fcm-push-gateway/test/integration/testutil"
+)
+
+// TestMigrate upgrades databases written by older versions with
+// "pushserver migrate", checking the dry run leaves them unchanged and the
+// upgrade keeps their batches and statuses.
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		version   int
+		token     string
+		requestID string
+	}{
+		{"schema-v1.sql", 1, "token-v1", "req-v1"},
+		{"schema-v5.sql", 5, "token-v5", "req-v5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			ctx := context.Background()
+			path := loadFixtureDB(t, tt.fixture)
+			before, err := store.Inspect(ctx, path)
+			if err != nil {
+				t.Fatalf("Inspect() error = %v", err)
+			}
+			if before.Version != tt.version {
+				t.Fatalf("fixture version = %d, want %d", before.Version, tt.version)
+			}
+
+			out := runMigrate(t, "-verify", "-db", path)
+			if !strings.Contains(out, "Dry run OK") {
+				t.Errorf("verify output doesn't report success:\n%s", out)
+			}
+			if info, _ := store.Inspect(ctx, path); info.Version != tt.version {
+				t.Errorf("after -verify: version = %d, want unchanged %d", info.Version, tt.version)
+			}
+
+			runMigrate(t, "-db", path)
+			after, err := store.Inspect(ctx, path)
+			if err != nil {
+				t.Fatalf("Inspect() error = %v", err)
+			}
+			if after.Version != store.SchemaVersion {
+				t.Errorf("migrated version = %d, want %d", after.Version, store.SchemaVersion)
+			}
+			for table, count := range before.Rows {
+				if after.Rows[table] != count {
+					t.Errorf("table %s: %d rows after, want %d", table, after.Rows[table], count)
+				}
+			}
+			if _, err := os.Stat(fmt.Sprintf("%s.v%d.bak", path, tt.version)); err != nil {
+				t.Errorf("backup missing: %v", err)
+			}
+
+			// The gateway reads the migrated batch and status
+			s, err := store.New(store.Config{Path: path})
+			if err != nil {
+				t.Fatalf("store.New() error = %v", err)
+			}
+			defer s.Close()
+			batches, err := s.LoadOldestBatches(ctx, 10)
+			if err != nil {
+				t.Fatalf("LoadOldestBatches() error = %v", err)
+			}
+			batch, ok := batches[tt.token]
+			if !ok || len(batch.Notifications) != 1 || batch.Notifications[0].RequestID != tt.requestID {
+				t.Errorf("batches = %+v, want %s holding %s", batches, tt.token, tt.requestID)
+			}
+			if status, err := s.GetStatus(ctx, tt.requestID); err != nil || status.State != store.StatusQueued {
+				t.Errorf("GetStatus(%s) = %+v, %v, want queued", tt.requestID, status, err)
+			}
+			if pending, err := s.FindPendingRequest(ctx, tt.requestID); err != nil || pending == nil || pending.FcmToken != tt.token {
+				t.Errorf("FindPendingRequest(%s) = %+v, %v, want the migrated batch", tt.requestID, pending, err)
+			}
+			// Pending statuses get a fresh grace period rather than being
+			// marked lost right after the upgrade
+			if n, err := s.MarkLost(ctx, time.Now().Add(-time.Minute), time.Now().Add(time.Hour)); err != nil || n != 0 {
+				t.Errorf("MarkLost() = %d, %v, want 0", n, err)
+			}
+		})
+	}
+}
+
+// TestMigrate_NewerSchema checks migrate refuses a database from a newer
+// build instead of touching it.
+func TestMigrate_NewerSchema(t *testing.T) {
+	path := loadFixtureDB(t, "schema-v1.sql")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO schema_version (version) VALUES (?)`, store.SchemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	out, err := exec.Command(testutil.BinPath("pushserver"), "migrate", "-db", path).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "newer than this build") {
+		t.Errorf("migrate of a newer schema: err = %v, output:\n%s", err, out)
+	}
+}
+
+// loadFixtureDB creates a database from the SQL fixture in testdata.
+func loadFixtureDB(t *testing.T, fixture string) string {
+	t.Helper()
+	schema, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "pushserver.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("creating fixture database: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("loading %s: %v", fixture, err)
+	}
+	return path
+}
+
+// runMigrate runs "pushserver migrate" with args, failing the test if it fails.
+func runMigrate(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command(testutil.BinPath("pushserver"), append([]string{"migrate"}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("pushserver migrate %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
@@ -0,0 +1,78 @@
+//go:build integration
+
+package integration
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wurp/ourcloud-fcm-push-gateway/test/integration/testutil"
+)
+
+// recoveryGatewayPort is where TestRecoveryAfterCrash runs its own gateway,
+// beside the one run.sh started.
+const recoveryGatewayPort = 8086
+
+// recoveryBatchWindow is long enough to kill the gateway before it flushes.
+const recoveryBatchWindow = 2 * time.Second
+
+// TestRecoveryAfterCrash kills a gateway while batches are pending, restarts
+// it on the same database, and checks each batch is delivered exactly once
+func TestRecoveryAfterCrash(t *testing.T) {
+	clearFCMCaptures(t)
+
+	gw := testutil.NewGateway("config.yaml", recoveryGatewayPort,
+		"PUSHSERVER_STORAGE_PATH="+filepath.Join(t.TempDir(), "recovery.db"),
+		"PUSHSERVER_BATCH_WINDOW="+recoveryBatchWindow.String(),
+	)
+	if err := gw.Start(); err != nil {
+		t.Fatalf("failed to start gateway: %v", err)
+	}
+	defer gw.Stop()
+
+	// Alice has 2 devices, so these make 2 batches of 3 requests
+	var requestIDs []string
+	for i := 0; i < 3; i++ {
+		resp := sendPushTo(t, gw.URL, "bob@oc", "alice@oc", [][]byte{{0xC0, byte(i)}})
+		if !resp.Accepted {
+			t.Fatalf("request %d not accepted: %s", i, resp.Message)
+		}
+		requestIDs = append(requestIDs, resp.RequestId)
+	}
+	if err := gw.Kill(); err != nil {
+		t.Fatalf("failed to kill gateway: %v", err)
+	}
+	if captures := getFCMCaptures(t); captures.Count != 0 {
+		t.Fatalf("expected no FCM calls before the window elapsed, got %d", captures.Count)
+	}
+
+	// Startup recovery flushes the persisted batches
+	if err := gw.Start(); err != nil {
+		t.Fatalf("failed to restart gateway: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	for _, id := range requestIDs {
+		if status := getStatusFrom(t, gw.URL, id); status.State != "sent" {
+			t.Errorf("after restart: state of %s = %s, want sent", id, status.State)
+		}
+	}
+
+	// Nothing more may arrive once the original window has passed
+	time.Sleep(recoveryBatchWindow)
+
+	captures := getFCMCaptures(t)
+	if captures.Count != 2 {
+		t.Fatalf("expected 2 FCM calls (one per device), got %d", captures.Count)
+	}
+	tokens := make(map[string]int)
+	for _, msg := range captures.Messages {
+		tokens[msg.Token]++
+	}
+	for _, token := range []string{"fcm-token-alice-phone", "fcm-token-alice-tablet"} {
+		if tokens[token] != 1 {
+			t.Errorf("expected exactly one FCM call to %s, got %d", token, tokens[token])
+		}
+	}
+}
@@ -12,6 +12,7 @@ BIN_DIR="$PROJECT_ROOT/bin"
 
 # Ports
 OURCLOUD_PORT=50052
+OURCLOUD_CONTROL_PORT=50053
 FCM_PORT=9099
 GATEWAY_PORT=8085
 
@@ -39,10 +40,14 @@ for bin in pushserver ourcloud-stub fcm-stub; do
     fi
 done
 
+echo "=== Checking fixtures ==="
+"$BIN_DIR/ourcloud-stub" -check -config "$SCRIPT_DIR/fixtures.json"
+
+echo ""
 echo "=== Starting stub services ==="
 
 echo "Starting OurCloud stub on port $OURCLOUD_PORT..."
-"$BIN_DIR/ourcloud-stub" -port "$OURCLOUD_PORT" -config "$SCRIPT_DIR/fixtures.json" &
+"$BIN_DIR/ourcloud-stub" -port "$OURCLOUD_PORT" -control-port "$OURCLOUD_CONTROL_PORT" -config "$SCRIPT_DIR/fixtures.json" &
 OURCLOUD_PID=$!
 sleep 0.5
 
@@ -75,7 +80,9 @@ done
 echo ""
 echo "=== Running integration tests ==="
 cd "$PROJECT_ROOT"
-go test -v ./test/integration/... -tags=integration
+# TestRecoveryAfterCrash and TestConcurrentBidirectionalPushes start their own
+# gateways from the built binaries
+INTEGRATION_BIN_DIR="$BIN_DIR" go test -v ./test/integration/... -tags=integration
 
 echo ""
 echo "=== Integration tests passed ==="
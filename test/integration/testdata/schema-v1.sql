@@ -0,0 +1,25 @@
+-- A database as written by the first release (schema v1), with one pending
+-- batch and its status.
+CREATE TABLE schema_version (
+	version INTEGER PRIMARY KEY
+);
+CREATE TABLE batches (
+	fcm_token TEXT PRIMARY KEY,
+	notifications BLOB NOT NULL,
+	created_at INTEGER NOT NULL,
+	flush_at INTEGER NOT NULL
+);
+CREATE INDEX idx_batches_flush_at ON batches(flush_at);
+CREATE TABLE status (
+	request_id TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	sent_at INTEGER,
+	error TEXT,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX idx_status_expires ON status(expires_at);
+INSERT INTO schema_version (version) VALUES (1);
+
+INSERT INTO batches VALUES ('token-v1', '[{"RequestID":"req-v1","DataIDs":["AQI="],"QueuedAt":"2024-05-01T12:00:00Z"}]', 1714564800, 1714564860);
+INSERT INTO status VALUES ('req-v1', 'queued', NULL, NULL, 4102444800);
+INSERT INTO status VALUES ('req-v1-sent', 'sent', 1714564000, NULL, 4102444800);
@@ -0,0 +1,45 @@
+-- A database at schema v5: duplicate suppression, failed deliveries, batch
+-- recipients, and status update times, with a row in each table.
+CREATE TABLE schema_version (
+	version INTEGER PRIMARY KEY
+);
+CREATE TABLE batches (
+	fcm_token TEXT PRIMARY KEY,
+	notifications BLOB NOT NULL,
+	created_at INTEGER NOT NULL,
+	flush_at INTEGER NOT NULL,
+	recipient TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_batches_flush_at ON batches(flush_at);
+CREATE INDEX idx_batches_recipient ON batches(recipient);
+CREATE TABLE status (
+	request_id TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	sent_at INTEGER,
+	error TEXT,
+	expires_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_status_expires ON status(expires_at);
+CREATE INDEX idx_status_state_updated ON status(state, updated_at);
+CREATE TABLE recent_sends (
+	fcm_token TEXT NOT NULL,
+	data_id BLOB NOT NULL,
+	expires_at INTEGER NOT NULL,
+	PRIMARY KEY (fcm_token, data_id)
+);
+CREATE INDEX idx_recent_sends_expires ON recent_sends(expires_at);
+CREATE TABLE failed_deliveries (
+	request_id TEXT PRIMARY KEY,
+	fcm_token TEXT NOT NULL,
+	data_ids BLOB NOT NULL,
+	failed_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX idx_failed_deliveries_failed_at ON failed_deliveries(failed_at);
+INSERT INTO schema_version (version) VALUES (1), (2), (3), (4), (5);
+
+INSERT INTO batches VALUES ('token-v5', '[{"RequestID":"req-v5","DataIDs":["AwQ="],"QueuedAt":"2024-05-01T12:00:00Z"}]', 1714564800, 1714564860, 'bob@oc');
+INSERT INTO status VALUES ('req-v5', 'queued', NULL, NULL, 4102444800, 1714564800);
+INSERT INTO recent_sends VALUES ('token-v5', X'0102', 4102444800);
+INSERT INTO failed_deliveries VALUES ('req-v5-failed', 'token-v5', X'0A020506', 1714564000, 4102444800);
@@ -26,26 +26,32 @@ func init() {
 	users := []string{"alice@oc", "bob@oc", "carol@oc", "nodevice@oc", "root@oc"}
 
 	for _, username := range users {
-		// Create deterministic seed from username
-		seed := make([]byte, ed25519.SeedSize)
-		copy(seed, []byte(username))
+		TestUsers[username] = NewTestUser(username)
+	}
+}
 
-		privateKey := ed25519.NewKeyFromSeed(seed)
-		publicKey := privateKey.Public().(ed25519.PublicKey)
+// NewTestUser derives a deterministic keypair for username. The seed is the
+// username's bytes, zero-padded (or truncated) to the seed size, so fixtures
+// generated by cmd/genfixtures match the keys used for signing here.
+func NewTestUser(username string) *TestUser {
+	seed := make([]byte, ed25519.SeedSize)
+	copy(seed, []byte(username))
 
-		TestUsers[username] = &TestUser{
-			Username:   username,
-			PublicKey:  publicKey,
-			PrivateKey: privateKey,
-		}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	return &TestUser{
+		Username:   username,
+		PublicKey:  privateKey.Public().(ed25519.PublicKey),
+		PrivateKey: privateKey,
 	}
 }
 
 // SignPushRequest signs a PushRequest with the sender's private key.
+// Senders outside TestUsers, such as generated fixture users, get their
+// derived key.
 func SignPushRequest(req *pb.PushRequest) error {
 	user, ok := TestUsers[req.SenderUsername]
 	if !ok {
-		return fmt.Errorf("unknown test user: %s", req.SenderUsername)
+		user = NewTestUser(req.SenderUsername)
 	}
 
 	// Clear signature before marshaling
@@ -0,0 +1,293 @@
+// Package ourcloudcompat checks the gateway's ourcloud.Client against the
+// ourcloud-client library it is built with, talking to an in-process node
+// that implements the BlockStorageAPI as pinned here: where labels and
+// UserAuths live, how owner IDs are derived, and how misses are reported.
+// A library version that changes any of these fails here rather than
+// turning every push into "user not found".
+//
+// The tests run with the unit tests against the library go.mod points at.
+// run.sh runs them against each version listed in versions.
+package ourcloudcompat
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wurp/friendly-backup-reboot/src/go/ourcloud-client/service"
+	pb "github.com/wurp/friendly-backup-reboot/src/go/ourcloud-proto"
+	"github.com/wurp/ourcloud-fcm-push-gateway/internal/ourcloud"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// serviceClient is the part of service.Client the gateway calls. A version
+// renaming or changing one of these fails to compile.
+type serviceClient interface {
+	GetUserAuth(ctx context.Context, username string) (*pb.UserAuth, error)
+	ReadLabel(ctx context.Context, ownerID []byte, path string) (*pb.Label, error)
+	Lookup(ctx context.Context, id []byte) ([]byte, error)
+	Close() error
+}
+
+var _ serviceClient = (*service.Client)(nil)
+
+// rootOwner owns the labels mapping usernames to their UserAuth.
+var rootOwner = append(make([]byte, 31), 1)
+
+// node is a BlockStorageAPI node storing labels under
+// SHA-256(owner ID || path) and blocks under SHA-256 of their data. Misses
+// are answered with found=false, not an error.
+type node struct {
+	pb.UnimplementedBlockStorageAPIServer
+
+	mu     sync.Mutex
+	labels map[string]*pb.Label // label key (hex) -> label
+	blocks map[string][]byte    // block ID (hex) -> raw data
+}
+
+func newNode() *node {
+	return &node{
+		labels: make(map[string]*pb.Label),
+		blocks: make(map[string][]byte),
+	}
+}
+
+func (n *node) GetBlock(ctx context.Context, req *pb.GetBlockRequest) (*pb.GetBlockResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	data, ok := n.blocks[hex.EncodeToString(req.GetId().GetValue())]
+	if !ok {
+		return &pb.GetBlockResponse{Found: false}, nil
+	}
+	return &pb.GetBlockResponse{
+		Found: true,
+		Block: &pb.Datum{Data: &pb.Datum_RawData{RawData: &pb.RawData{Data: data}}},
+	}, nil
+}
+
+func (n *node) GetLabel(ctx context.Context, req *pb.GetLabelRequest) (*pb.GetLabelResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	label, ok := n.labels[hex.EncodeToString(req.GetKey())]
+	if !ok {
+		return &pb.GetLabelResponse{Found: false}, nil
+	}
+	return &pb.GetLabelResponse{Found: true, Label: label}, nil
+}
+
+// putBlock stores data and returns its content address.
+func (n *node) putBlock(data []byte) []byte {
+	id := sha256.Sum256(data)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocks[hex.EncodeToString(id[:])] = data
+	return id[:]
+}
+
+// putLabel points owner's label at path to the block id.
+func (n *node) putLabel(owner []byte, path string, id []byte) {
+	key := sha256.Sum256(append(append([]byte{}, owner...), path...))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.labels[hex.EncodeToString(key[:])] = &pb.Label{DataId: &pb.ID{Value: id}}
+}
+
+// putUser publishes username's UserAuth, encoded as authData, and returns
+// the owner ID of the user's labels: the UserAuth block's content address.
+func (n *node) putUser(username string, authData []byte) []byte {
+	id := n.putBlock(authData)
+	n.putLabel(rootOwner, username, id)
+	return id
+}
+
+// putUserLabel publishes msg as the data of owner's label at path.
+func (n *node) putUserLabel(t *testing.T, owner []byte, path string, msg proto.Message) {
+	t.Helper()
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	n.putLabel(owner, path, n.putBlock(data))
+}
+
+// startNode serves n on a local port and returns a gateway client
+// connected to it, and a function stopping the node.
+func startNode(t *testing.T, n *node) (*ourcloud.Client, func()) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterBlockStorageAPIServer(srv, n)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	client := ourcloud.NewClient(lis.Addr().String())
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, srv.Stop
+}
+
+func marshalUserAuth(t *testing.T, auth *pb.UserAuth) []byte {
+	t.Helper()
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(auth)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return data
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestUserLookup(t *testing.T) {
+	n := newNode()
+	auth := &pb.UserAuth{
+		FormatVersion:  &pb.FormatVersion{Value: 1},
+		UserName:       "bob@oc",
+		PublicSignKey:  []byte("bob-sign-key"),
+		PublicCryptKey: []byte("bob-crypt-key"),
+	}
+	n.putUser("bob@oc", marshalUserAuth(t, auth))
+	client, _ := startNode(t, n)
+	ctx := testContext(t)
+
+	got, err := client.GetUserAuth(ctx, "bob@oc")
+	if err != nil {
+		t.Fatalf("GetUserAuth() error = %v", err)
+	}
+	if !proto.Equal(got, auth) {
+		t.Errorf("GetUserAuth() = %v, want %v", got, auth)
+	}
+	// root@oc isn't published, but the node answered
+	if err := client.HealthCheck(ctx); !errors.Is(err, ourcloud.ErrUserNotFound) {
+		t.Errorf("HealthCheck() without root@oc error = %v, want it to wrap ErrUserNotFound", err)
+	}
+
+	if _, err := client.GetUserAuth(ctx, "nobody@oc"); !errors.Is(err, ourcloud.ErrUserNotFound) {
+		t.Errorf("GetUserAuth(nobody@oc) error = %v, want ErrUserNotFound", err)
+	}
+
+	// A username label pointing at a block the node lost
+	n.putLabel(rootOwner, "ghost@oc", []byte("missing"))
+	if _, err := client.GetUserAuth(ctx, "ghost@oc"); !errors.Is(err, ourcloud.ErrUserNotFound) {
+		t.Errorf("GetUserAuth(ghost@oc) error = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestUserLabels(t *testing.T) {
+	n := newNode()
+	owner := n.putUser("bob@oc", marshalUserAuth(t, &pb.UserAuth{
+		FormatVersion: &pb.FormatVersion{Value: 1},
+		UserName:      "bob@oc",
+		PublicSignKey: []byte("bob-sign-key"),
+	}))
+	n.putUserLabel(t, owner, "/users/bob@oc/platform/push/consents", &pb.PushConsentList{
+		Consents: []*pb.PushConsent{{Username: "alice@oc"}},
+	})
+	n.putUserLabel(t, owner, "/users/bob@oc/platform/push/endpoints", &pb.PushEndpointList{
+		Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token-1"}},
+	})
+	n.putLabel(owner, "/users/bob@oc/platform/preferences/locale", n.putBlock([]byte("de-AT\n")))
+	client, _ := startNode(t, n)
+	ctx := testContext(t)
+
+	if ok, err := client.HasConsent(ctx, "bob@oc", "alice@oc"); err != nil || !ok {
+		t.Errorf("HasConsent(bob@oc, alice@oc) = %v, %v; want true", ok, err)
+	}
+	endpoints, err := client.GetEndpoints(ctx, "bob@oc")
+	if err != nil {
+		t.Fatalf("GetEndpoints() error = %v", err)
+	}
+	if len(endpoints.Endpoints) != 1 || endpoints.Endpoints[0].FcmToken != "token-1" {
+		t.Errorf("GetEndpoints() = %v, want the phone's token-1", endpoints)
+	}
+	if locale, err := client.GetLocale(ctx, "bob@oc"); err != nil || locale != "de-AT" {
+		t.Errorf("GetLocale() = %q, %v; want de-AT", locale, err)
+	}
+
+	// Unpublished labels are misses, named by their path
+	_, err = client.GetDoNotDisturb(ctx, "bob@oc")
+	if !errors.Is(err, ourcloud.ErrLabelNotFound) {
+		t.Fatalf("GetDoNotDisturb() error = %v, want ErrLabelNotFound", err)
+	}
+	if !strings.Contains(err.Error(), "/users/bob@oc/platform/preferences/dnd") {
+		t.Errorf("GetDoNotDisturb() error = %q, want it to name the label path", err)
+	}
+
+	// A label pointing at a block the node lost
+	n.putLabel(owner, "/users/bob@oc/platform/preferences/batch_window", []byte("missing"))
+	if _, err := client.GetBatchWindow(ctx, "bob@oc"); !errors.Is(err, ourcloud.ErrBlockNotFound) {
+		t.Errorf("GetBatchWindow() error = %v, want ErrBlockNotFound", err)
+	}
+}
+
+// TestUserLabels_NewerUserAuth checks that labels still resolve for a
+// UserAuth with fields the gateway's ourcloud-proto doesn't know: the owner
+// ID must stay the content address of the block as published.
+func TestUserLabels_NewerUserAuth(t *testing.T) {
+	n := newNode()
+	authData := marshalUserAuth(t, &pb.UserAuth{
+		FormatVersion: &pb.FormatVersion{Value: 2},
+		UserName:      "bob@oc",
+		PublicSignKey: []byte("bob-sign-key"),
+	})
+	authData = protowire.AppendTag(authData, 15, protowire.BytesType)
+	authData = protowire.AppendBytes(authData, []byte("added in format 2"))
+	owner := n.putUser("bob@oc", authData)
+	n.putUserLabel(t, owner, "/users/bob@oc/platform/push/endpoints", &pb.PushEndpointList{
+		Endpoints: []*pb.PushEndpoint{{DeviceId: "phone", FcmToken: "token-1"}},
+	})
+	client, _ := startNode(t, n)
+
+	endpoints, err := client.GetEndpoints(testContext(t), "bob@oc")
+	if err != nil {
+		t.Fatalf("GetEndpoints() error = %v", err)
+	}
+	if len(endpoints.Endpoints) != 1 {
+		t.Errorf("GetEndpoints() = %v, want one endpoint", endpoints)
+	}
+}
+
+func TestHasBlock(t *testing.T) {
+	n := newNode()
+	id := n.putBlock([]byte("update"))
+	client, _ := startNode(t, n)
+	ctx := testContext(t)
+
+	if ok, err := client.HasBlock(ctx, id); err != nil || !ok {
+		t.Errorf("HasBlock(stored) = %v, %v; want true", ok, err)
+	}
+	missing := sha256.Sum256([]byte("never stored"))
+	if ok, err := client.HasBlock(ctx, missing[:]); err != nil || ok {
+		t.Errorf("HasBlock(missing) = %v, %v; want false without error", ok, err)
+	}
+}
+
+func TestNodeDown(t *testing.T) {
+	n := newNode()
+	n.putUser("bob@oc", marshalUserAuth(t, &pb.UserAuth{UserName: "bob@oc"}))
+	client, stop := startNode(t, n)
+	stop()
+
+	if _, err := client.GetUserAuth(testContext(t), "bob@oc"); !errors.Is(err, ourcloud.ErrUnavailable) {
+		t.Errorf("GetUserAuth() with the node down error = %v, want ErrUnavailable", err)
+	}
+	if ok, err := client.HasBlock(testContext(t), []byte("id")); !errors.Is(err, ourcloud.ErrUnavailable) {
+		t.Errorf("HasBlock() with the node down = %v, %v; want ErrUnavailable", ok, err)
+	}
+}
@@ -0,0 +1,54 @@
+#!/bin/bash
+# OurCloud client contract test runner
+# Runs the ourcloud-compat tests once for each ourcloud-client version listed
+# in versions, by swapping the module's replace directive in a copy of
+# go.mod. go.mod and go.sum themselves are left alone.
+#
+# Usage: test/ourcloud-compat/run.sh [name...]
+# With names, only those versions are tested.
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+PROJECT_ROOT="$(cd "$SCRIPT_DIR/../.." && pwd)"
+MODULE=github.com/wurp/friendly-backup-reboot/src/go/ourcloud-client
+
+WORK_DIR="$(mktemp -d)"
+trap 'rm -rf "$WORK_DIR"' EXIT
+
+cd "$PROJECT_ROOT"
+
+failed=()
+tested=0
+while read -r name target; do
+    [ -z "$name" ] || [[ "$name" == \#* ]] && continue
+    if [ $# -gt 0 ] && [[ ! " $* " =~ " $name " ]]; then
+        continue
+    fi
+    # Directories are resolved here, as the copied go.mod lives elsewhere
+    if [[ "$target" != *@* ]]; then
+        target="$(cd "$PROJECT_ROOT/$target" && pwd)"
+    fi
+
+    echo "=== ourcloud-client $name ($target) ==="
+    cp go.mod "$WORK_DIR/$name.mod"
+    cp go.sum "$WORK_DIR/$name.sum"
+    go mod edit -modfile="$WORK_DIR/$name.mod" -replace "$MODULE=$target"
+    tested=$((tested + 1))
+    if ! go test -count=1 -mod=mod -modfile="$WORK_DIR/$name.mod" ./test/ourcloud-compat/; then
+        failed+=("$name")
+    fi
+done < "$SCRIPT_DIR/versions"
+
+if [ "$tested" -eq 0 ]; then
+    echo "ERROR: no versions matched"
+    exit 1
+fi
+if [ ${#failed[@]} -gt 0 ]; then
+    echo ""
+    echo "=== Contract broken by: ${failed[*]} ==="
+    exit 1
+fi
+
+echo ""
+echo "=== Contract holds for $tested version(s) ==="